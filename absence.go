@@ -0,0 +1,158 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"time"
+
+	"github.com/bemasher/rtlamr/lru"
+	"github.com/bemasher/rtlamr/parse"
+)
+
+// absenceCheckInterval is how often meters are checked for absence.
+const absenceCheckInterval = 10 * time.Second
+
+// AbsenceMonitor alerts when a meter hasn't been heard for longer than its
+// -meterdb interval, or Default if it has none, and again once it's heard.
+// Meters in -meterdb are watched from the start even if they're never
+// heard, other meters once they've passed the filters.
+type AbsenceMonitor struct {
+	Default time.Duration
+	Aliases *Aliases // Names meters and gives their intervals, if any.
+
+	meters  *lru.Cache // *absenceEntry keyed by meter id.
+	started time.Time
+	resumed time.Time // Meters aren't absent until their threshold after this.
+}
+
+type absenceEntry struct {
+	MsgType  string
+	LastSeen time.Time
+	Alerted  bool
+}
+
+// AbsenceState is the last time -absence heard a meter.
+type AbsenceState struct {
+	ID       uint32
+	MsgType  string `json:",omitempty"`
+	LastSeen time.Time
+	Alerted  bool
+}
+
+func NewAbsenceMonitor(def time.Duration, maxMeters int, aliases *Aliases, now time.Time) *AbsenceMonitor {
+	return &AbsenceMonitor{Default: def, Aliases: aliases, meters: lru.New(maxMeters), started: now}
+}
+
+// threshold returns how long the meter may go unheard, zero if it isn't
+// watched.
+func (am *AbsenceMonitor) threshold(id uint32) time.Duration {
+	if alias, ok := am.Aliases.Lookup(id); ok && alias.Interval != 0 {
+		return alias.Interval
+	}
+	return am.Default
+}
+
+// Heard records that msg's meter was heard, returning a recovery alert if it
+// was absent.
+func (am *AbsenceMonitor) Heard(msg parse.LogMessage) *Alert {
+	if am == nil || !msg.Message.ChecksumOK() || am.threshold(msg.MeterID()) == 0 {
+		return nil
+	}
+
+	var prev absenceEntry
+	if v, ok := am.meters.Get(msg.MeterID()); ok {
+		prev = *v.(*absenceEntry)
+	}
+	am.meters.Add(msg.MeterID(), &absenceEntry{MsgType: msg.MsgType(), LastSeen: msg.Time})
+
+	if !prev.Alerted {
+		return nil
+	}
+	return &Alert{
+		Time:      msg.Time,
+		Alert:     "recovered",
+		MsgType:   msg.MsgType(),
+		ID:        msg.MeterID(),
+		MeterName: msg.MeterName,
+		Since:     prev.LastSeen,
+	}
+}
+
+// Check returns an alert for each meter which has become absent.
+func (am *AbsenceMonitor) Check(now time.Time) (alerts []Alert) {
+	if am == nil {
+		return nil
+	}
+
+	// Watch meters in -meterdb which haven't been heard yet.
+	for id := range am.Aliases.load().ids {
+		if _, ok := am.meters.Get(id); !ok && am.threshold(id) != 0 {
+			am.meters.Add(id, &absenceEntry{LastSeen: am.started})
+		}
+	}
+
+	am.meters.Range(func(key, value interface{}) {
+		id, entry := key.(uint32), value.(*absenceEntry)
+
+		threshold := am.threshold(id)
+		if threshold == 0 || entry.Alerted {
+			return
+		}
+
+		last := entry.LastSeen
+		if am.resumed.After(last) {
+			last = am.resumed
+		}
+		if now.Sub(last) < threshold {
+			return
+		}
+
+		entry.Alerted = true
+		alert := Alert{Time: now, Alert: "absent", MsgType: entry.MsgType, ID: id, Since: entry.LastSeen}
+		if alias, ok := am.Aliases.Lookup(id); ok {
+			alert.MeterName = alias.Name
+		}
+		alerts = append(alerts, alert)
+	})
+
+	return alerts
+}
+
+// Resume restarts the clock on every meter, such as after time outside of
+// -schedule's windows during which nothing could be heard.
+func (am *AbsenceMonitor) Resume(now time.Time) {
+	if am != nil {
+		am.resumed = now
+	}
+}
+
+// Snapshot returns the state of every watched meter from least to most
+// recently heard.
+func (am *AbsenceMonitor) Snapshot() (states []AbsenceState) {
+	am.meters.Range(func(key, value interface{}) {
+		entry := value.(*absenceEntry)
+		states = append(states, AbsenceState{key.(uint32), entry.MsgType, entry.LastSeen, entry.Alerted})
+	})
+	return
+}
+
+// Restore adds states from a previous Snapshot.
+func (am *AbsenceMonitor) Restore(states []AbsenceState) {
+	for _, s := range states {
+		am.meters.Add(s.ID, &absenceEntry{s.MsgType, s.LastSeen, s.Alerted})
+	}
+}
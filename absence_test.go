@@ -0,0 +1,85 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bemasher/rtlamr/parse"
+	"github.com/bemasher/rtlamr/scm"
+)
+
+func TestAbsenceMonitor(t *testing.T) {
+	table, err := readMeterDB(strings.NewReader("1:\n  name: house-water\n  interval: 30m\n2:\n  name: house-gas\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var aliases Aliases
+	aliases.table.Store(table)
+
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	am := NewAbsenceMonitor(time.Hour, 0, &aliases, start)
+
+	heard := func(id uint32, elapsed time.Duration) *Alert {
+		return am.Heard(parse.LogMessage{Time: start.Add(elapsed), Message: scm.SCM{ID: id}})
+	}
+	check := func(elapsed time.Duration) (ids []uint32) {
+		for _, alert := range am.Check(start.Add(elapsed)) {
+			if alert.Alert != "absent" {
+				t.Fatalf("Expected absent alert got %+v\n", alert)
+			}
+			ids = append(ids, alert.ID)
+		}
+		return
+	}
+
+	if heard(3, 10*time.Minute) != nil {
+		t.Fatal("Unexpected alert for new meter")
+	}
+
+	// Meter 1 is never heard and uses its own interval, meter 2 in the
+	// database and meter 3 use the default.
+	if ids := check(20 * time.Minute); len(ids) != 0 {
+		t.Fatalf("Unexpected absent meters %v\n", ids)
+	}
+	if ids := check(30 * time.Minute); len(ids) != 1 || ids[0] != 1 {
+		t.Fatalf("Expected meter 1 absent got %v\n", ids)
+	}
+	if ids := check(time.Hour); len(ids) != 1 || ids[0] != 2 {
+		t.Fatalf("Expected meter 2 absent got %v\n", ids)
+	}
+	if ids := check(70 * time.Minute); len(ids) != 1 || ids[0] != 3 {
+		t.Fatalf("Expected meter 3 absent got %v\n", ids)
+	}
+
+	// Alerts aren't repeated.
+	if ids := check(3 * time.Hour); len(ids) != 0 {
+		t.Fatalf("Unexpected repeated alerts %v\n", ids)
+	}
+
+	// Meters not watched by default are ignored once -absence is disabled.
+	am.Default = 0
+	if heard(4, 3*time.Hour) != nil || len(check(5*time.Hour)) != 0 {
+		t.Fatal("Unexpected alert for unwatched meter")
+	}
+	am.Default = time.Hour
+
+	recovered := heard(3, 3*time.Hour)
+	if recovered == nil || recovered.Alert != "recovered" || !recovered.Since.Equal(start.Add(10*time.Minute)) {
+		t.Fatalf("Expected recovery alert got %+v\n", recovered)
+	}
+
+	// State survives a restart, so a meter absent before it is still reported
+	// as recovered.
+	restored := NewAbsenceMonitor(time.Hour, 0, &aliases, start.Add(4*time.Hour))
+	restored.Restore(am.Snapshot())
+	if recovered := restored.Heard(parse.LogMessage{Time: start.Add(4 * time.Hour), Message: scm.SCM{ID: 2}}); recovered == nil {
+		t.Fatal("Expected recovery alert after restore")
+	}
+
+	// Time outside of -schedule's windows doesn't count.
+	am.Resume(start.Add(10 * time.Hour))
+	if ids := check(10*time.Hour + 30*time.Minute); len(ids) != 0 {
+		t.Fatalf("Unexpected absent meters after resume %v\n", ids)
+	}
+}
@@ -0,0 +1,85 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/bemasher/rtlamr/parse"
+)
+
+// Alert is written to the output stream when a meter looks to be leaking,
+// see -leakalert, or goes silent and is heard again, see -absence.
+type Alert struct {
+	Time      time.Time
+	Alert     string // leak, absent or recovered.
+	Source    string `json:",omitempty" xml:",omitempty"` // flow for continuous usage, flags for r900 leak flags.
+	MsgType   string `json:",omitempty" xml:",omitempty"` // Empty for meters never heard.
+	ID        uint32
+	MeterName string    `json:",omitempty" xml:",omitempty"`
+	Since     time.Time // Start of a leak, or when an absent meter was last heard.
+}
+
+func (a Alert) String() string {
+	fields := fmt.Sprintf("Time:%s Alert:%s", a.Time.Format(parse.TimeFormat), a.Alert)
+	if a.Source != "" {
+		fields += " Source:" + a.Source
+	}
+	if a.MsgType != "" {
+		fields += " MsgType:" + a.MsgType
+	}
+	fields += fmt.Sprintf(" ID:%d", a.ID)
+	if a.MeterName != "" {
+		fields += " MeterName:" + a.MeterName
+	}
+	return "{" + fields + " Since:" + a.Since.Format(parse.TimeFormat) + "}"
+}
+
+func (a Alert) Record() []string {
+	return []string{
+		a.Time.Format(time.RFC3339Nano),
+		a.Alert,
+		a.Source,
+		a.MsgType,
+		strconv.FormatUint(uint64(a.ID), 10),
+		a.MeterName,
+		a.Since.Format(time.RFC3339Nano),
+	}
+}
+
+// emitAlert logs alert and writes it to enc. Messages and the status
+// line may share a terminal.
+func emitAlert(enc Encoder, alert Alert, statusSink *syncWriter) {
+	switch alert.Alert {
+	case "recovered":
+		log.Printf("Meter %d heard again, last heard %s\n", alert.ID, alert.Since.Format(time.RFC3339))
+	case "absent":
+		slog.Warn("meter not heard", "id", alert.ID, "name", alert.MeterName, "since", alert.Since)
+	default:
+		slog.Warn(alert.Alert+" detected", "msgtype", alert.MsgType, "id", alert.ID, "source", alert.Source, "since", alert.Since)
+	}
+
+	statusSink.Around(func() {
+		if err := enc.Encode(alert); err != nil {
+			slog.Warn("writing alert", "err", err)
+		}
+	})
+}
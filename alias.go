@@ -0,0 +1,211 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode"
+
+	"github.com/bemasher/rtlamr/parse"
+)
+
+// Alias names a meter and optionally its commodity and multiplier.
+type Alias struct {
+	Name      string
+	Commodity string
+	Scale     *Scale
+	Interval  time.Duration // How often the meter is expected to be heard, see -meterdb.
+
+	line int // Where the meter is defined in a -meterdb file.
+}
+
+// Aliases maps meter ids to names loaded from a csv file of the form:
+//
+//	# meter id, name, optional commodity, optional multiplier
+//	12345678,house-water,water,0.1
+//
+// The table in effect is replaced rather than mutated so the file can be
+// reloaded while packets are being processed.
+//
+// Aliases may instead be loaded from a -meterdb file, see readMeterDB. A nil
+// Aliases names no meters.
+type Aliases struct {
+	Filename string
+	MeterDB  bool // Filename is a meter database rather than csv.
+
+	table atomic.Value // *aliasTable
+}
+
+type aliasTable struct {
+	ids   map[uint32]Alias
+	names map[string]uint32
+}
+
+func (a *Aliases) load() *aliasTable {
+	if a == nil {
+		return &aliasTable{}
+	}
+	if t, ok := a.table.Load().(*aliasTable); ok {
+		return t
+	}
+	return &aliasTable{}
+}
+
+// Reload re-reads the alias file and swaps in the new table. Returns the
+// names added and removed.
+func (a *Aliases) Reload() (added, removed []string, err error) {
+	file, err := os.Open(a.Filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	read := readAliases
+	if a.MeterDB {
+		read = readMeterDB
+	}
+
+	next, err := read(file)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %s", a.Filename, err)
+	}
+
+	prev := a.load()
+	for name := range next.names {
+		if _, ok := prev.names[name]; !ok {
+			added = append(added, name)
+		}
+	}
+	for name := range prev.names {
+		if _, ok := next.names[name]; !ok {
+			removed = append(removed, name)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+
+	a.table.Store(next)
+
+	return added, removed, nil
+}
+
+// readAliases parses a csv table of meter aliases. Lines beginning with #
+// are ignored. Names must be unique and can't themselves be meter ids.
+func readAliases(r io.Reader) (*aliasTable, error) {
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	t := &aliasTable{make(map[uint32]Alias), make(map[string]uint32)}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		line, _ := reader.FieldPos(0)
+		if len(record) < 2 || len(record) > 4 {
+			return nil, fmt.Errorf("line %d: expected meter id, name, optional commodity and optional multiplier", line)
+		}
+
+		id, err := ParseUint(strings.TrimSpace(record[0]), 32)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid meter id: %s", line, err)
+		}
+
+		var alias Alias
+		alias.Name = strings.TrimSpace(record[1])
+		if !isAliasName(alias.Name) {
+			return nil, fmt.Errorf("line %d: invalid name %q, names must begin with a letter and not be a meter id", line, alias.Name)
+		}
+		if prev, dup := t.names[alias.Name]; dup {
+			return nil, fmt.Errorf("line %d: name %q is already used by meter %d", line, alias.Name, prev)
+		}
+
+		if len(record) > 2 {
+			alias.Commodity = strings.ToLower(strings.TrimSpace(record[2]))
+			if alias.Commodity != "" && !isCommodity(alias.Commodity) {
+				return nil, fmt.Errorf("line %d: invalid commodity %q, expected one of: electric, gas, water", line, record[2])
+			}
+		}
+
+		if len(record) > 3 {
+			f, err := strconv.ParseFloat(strings.TrimSpace(record[3]), 64)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid multiplier: %s", line, err)
+			}
+			alias.Scale = &Scale{Multiplier: f}
+		}
+
+		t.ids[uint32(id)] = alias
+		t.names[alias.Name] = uint32(id)
+	}
+
+	return t, nil
+}
+
+// isAliasName returns true if name can be used as an alias. Names which
+// parse as meter ids or wildcards would be ambiguous in -filterid.
+func isAliasName(name string) bool {
+	if name == "" || !unicode.IsLetter(rune(name[0])) || strings.Contains(name, ",") {
+		return false
+	}
+	_, err := ParseIDRange(name)
+	return err != nil
+}
+
+// Lookup returns the alias of the given meter id, if any.
+func (a *Aliases) Lookup(id uint32) (alias Alias, ok bool) {
+	alias, ok = a.load().ids[id]
+	return
+}
+
+// ID returns the meter id with the given name, if any.
+func (a *Aliases) ID(name string) (id uint32, ok bool) {
+	id, ok = a.load().names[name]
+	return
+}
+
+// Apply fills in the name and commodity of msg's meter. The alias's
+// multiplier only applies if -multiplier didn't already scale msg.
+func (a *Aliases) Apply(msg *parse.LogMessage) {
+	alias, ok := a.Lookup(msg.MeterID())
+	if !ok {
+		return
+	}
+
+	msg.MeterName = alias.Name
+	msg.Commodity = alias.Commodity
+
+	if alias.Scale != nil && msg.ScaledConsumption == nil {
+		scaled := float64(msg.MeterConsumption()) * alias.Scale.Multiplier
+		msg.ScaledConsumption = &scaled
+		msg.Unit = alias.Scale.Unit
+	}
+}
@@ -0,0 +1,158 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// APIMeter is a meter listed by /api/meters.
+type APIMeter struct {
+	ID       uint32
+	MsgType  string
+	Name     string `json:",omitempty"` // Given by -aliases.
+	LastSeen time.Time
+	Count    uint64
+}
+
+// apiError is the body of api responses which fail.
+type apiError struct {
+	Error string
+}
+
+func writeAPIError(w http.ResponseWriter, code int, msg string) {
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(apiError{msg})
+}
+
+// serveAPI serves:
+//
+//	GET /api/meters                     meters heard, most recent first
+//	GET /api/meters/{id}                the last message from a meter
+//	GET /api/meters/{id}/history?since= a meter's consumption history
+func (h *Health) serveAPI(w http.ResponseWriter, r *http.Request, now time.Time) {
+	if h.Token != "" {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(h.Token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="rtlamr"`)
+			writeAPIError(w, http.StatusUnauthorized, "missing or invalid bearer token")
+			return
+		}
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/"), "/")
+	if parts[0] != "meters" || len(parts) > 3 || (len(parts) == 3 && parts[2] != "history") {
+		writeAPIError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	if len(parts) == 1 || (len(parts) == 2 && parts[1] == "") {
+		json.NewEncoder(w).Encode(h.apiMeters())
+		return
+	}
+
+	id, err := strconv.ParseUint(parts[1], 10, 32)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid meter id "+strconv.Quote(parts[1]))
+		return
+	}
+	reading, ok := h.reading(uint32(id))
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "meter "+parts[1]+" hasn't been heard")
+		return
+	}
+
+	if len(parts) == 2 {
+		json.NewEncoder(w).Encode(reading.last)
+		return
+	}
+
+	if h.History <= 0 {
+		writeAPIError(w, http.StatusNotFound, "history is disabled by -dashboard.history")
+		return
+	}
+	since, err := parseSince(r.URL.Query().Get("since"), now)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	history := []HistoryPoint{}
+	for _, p := range reading.History {
+		if !p.Time.Before(since) {
+			history = append(history, p)
+		}
+	}
+	json.NewEncoder(w).Encode(history)
+}
+
+// parseSince parses the since parameter of /history, a time in RFC 3339
+// format or a duration before now. Blank returns the zero time.
+func parseSince(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid since %q, expected an RFC 3339 time or a duration", s)
+}
+
+// apiMeters lists the meters heard, most recently heard first.
+func (h *Health) apiMeters() []APIMeter {
+	h.mu.Lock()
+	meters := make([]APIMeter, 0, h.meters.Len())
+	h.meters.Range(func(key, value interface{}) {
+		r := value.(*MeterReading)
+		meters = append(meters, APIMeter{r.ID, r.MsgType, r.Name, r.Time, r.Count})
+	})
+	h.mu.Unlock()
+
+	sort.SliceStable(meters, func(i, j int) bool {
+		return meters[i].LastSeen.After(meters[j].LastSeen)
+	})
+	return meters
+}
+
+// reading returns a copy of the last reading of a meter.
+func (h *Health) reading(id uint32) (MeterReading, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	value, ok := h.meters.Get(id)
+	if !ok {
+		return MeterReading{}, false
+	}
+	r := *value.(*MeterReading)
+	r.History = append([]HistoryPoint(nil), r.History...)
+	return r, true
+}
@@ -0,0 +1,218 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/bemasher/rtlamr/parse"
+)
+
+// Maximum number of example meter ids reported per protocol.
+const detectExampleIDs = 5
+
+// DetectResult summarizes the packets heard for a single message type.
+type DetectResult struct {
+	MsgType    string
+	CenterFreq uint32
+	SampleRate int
+	Count      int
+	MeterIDs   []uint32
+}
+
+// DetectReport is the outcome of -msgtype=auto.
+type DetectReport struct {
+	Protocols      []DetectResult
+	Recommendation string
+}
+
+// detectGroup is a set of parsers sharing a center frequency and sample rate
+// which can decode the same sample stream concurrently.
+type detectGroup struct {
+	CenterFreq uint32
+	SampleRate int
+	parsers    []parse.Parser
+	results    []*DetectResult
+}
+
+// detectMsgTypes returns the message types -msgtype=auto listens for.
+func detectMsgTypes() (names []string) {
+	for _, name := range parse.Names() {
+		if *lowRate && !lowRateMsgTypes[name] {
+			continue
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+func newDetectGroups() (groups []*detectGroup, err error) {
+	for _, name := range detectMsgTypes() {
+		p, err := parse.NewParser(name, *symbolLength, *decimation)
+		if err != nil {
+			return nil, configError(err)
+		}
+		cfg := p.Cfg()
+
+		var group *detectGroup
+		for _, g := range groups {
+			if g.CenterFreq == cfg.CenterFreq && g.SampleRate == cfg.SampleRate {
+				group = g
+			}
+		}
+		if group == nil {
+			group = &detectGroup{CenterFreq: cfg.CenterFreq, SampleRate: cfg.SampleRate}
+			groups = append(groups, group)
+		}
+
+		group.parsers = append(group.parsers, p)
+		group.results = append(group.results, &DetectResult{
+			MsgType:    name,
+			CenterFreq: cfg.CenterFreq,
+			SampleRate: cfg.SampleRate,
+		})
+	}
+
+	return
+}
+
+// listen decodes samples from r for the given duration with every parser in
+// the group, tallying the packets each one hears. Stops early if ctx is
+// cancelled.
+func (g *detectGroup) listen(ctx context.Context, r io.Reader, d time.Duration) error {
+	// Block sizes are powers of two, so the largest is a multiple of all the
+	// others. Read the largest and feed each parser blocks of its own size.
+	blockSize := 0
+	for _, p := range g.parsers {
+		if size := p.Dec().DecCfg.BlockSize2; size > blockSize {
+			blockSize = size
+		}
+	}
+	block := make([]byte, blockSize)
+
+	seen := make([]map[uint32]bool, len(g.parsers))
+	for idx := range seen {
+		seen[idx] = make(map[uint32]bool)
+	}
+
+	// Discard samples buffered before retuning.
+	if _, err := io.ReadFull(r, block); err != nil {
+		return withStatus(exitDevice, fmt.Errorf("reading samples: %s", err))
+	}
+
+	for deadline := time.Now().Add(d); time.Now().Before(deadline); {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(r, block); err != nil {
+			return withStatus(exitDevice, fmt.Errorf("reading samples: %s", err))
+		}
+
+		for pIdx, p := range g.parsers {
+			size := p.Dec().DecCfg.BlockSize2
+			for offset := 0; offset < len(block); offset += size {
+				indices := p.Dec().Decode(block[offset : offset+size])
+				for _, pkt := range p.Parse(indices) {
+					if !pkt.ChecksumOK() {
+						continue
+					}
+
+					result := g.results[pIdx]
+					result.Count++
+
+					id := pkt.MeterID()
+					if !seen[pIdx][id] && len(result.MeterIDs) < detectExampleIDs {
+						result.MeterIDs = append(result.MeterIDs, id)
+					}
+					seen[pIdx][id] = true
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// Detect listens on each group of registered message types in turn and
+// returns the message type with the most traffic.
+func (rcvr *Receiver) Detect(ctx context.Context) (string, error) {
+	if !gainFlagsSet() {
+		rcvr.SetGainMode(true)
+	}
+
+	var report DetectReport
+	var best *DetectResult
+
+	groups, err := newDetectGroups()
+	if err != nil {
+		return "", err
+	}
+
+	for _, g := range groups {
+		var names []string
+		for _, result := range g.results {
+			names = append(names, result.MsgType)
+		}
+		log.Printf("Listening for %v at %d Hz, %d S/s for %s\n", names, g.CenterFreq, g.SampleRate, *autoListen)
+
+		rcvr.SetCenterFreq(g.CenterFreq)
+		rcvr.SetSampleRate(uint32(g.SampleRate))
+		if err := g.listen(ctx, rcvr, *autoListen); err != nil {
+			return "", err
+		}
+
+		for _, result := range g.results {
+			report.Protocols = append(report.Protocols, *result)
+			if result.Count > 0 && (best == nil || result.Count > best.Count) {
+				best = result
+			}
+		}
+	}
+
+	if best != nil {
+		report.Recommendation = best.MsgType
+	}
+
+	if *format == "json" {
+		if err := json.NewEncoder(os.Stdout).Encode(report); err != nil {
+			return "", withStatus(exitOutput, fmt.Errorf("encoding detection report: %s", err))
+		}
+	} else {
+		for _, result := range report.Protocols {
+			log.Printf("Heard %d %s packets, meter ids: %v\n", result.Count, result.MsgType, result.MeterIDs)
+		}
+	}
+
+	if best == nil {
+		return "", withStatus(exitNoMessages, errors.New("no packets heard from any message type, try a longer -auto.listen or check the antenna"))
+	}
+
+	if *autoExit {
+		fmt.Fprintf(os.Stderr, "Recommendation: -msgtype=%s\n", report.Recommendation)
+	} else {
+		log.Println("Locking onto message type:", report.Recommendation)
+	}
+
+	return report.Recommendation, nil
+}
@@ -0,0 +1,235 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"runtime"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bemasher/rtlamr/decode"
+	"github.com/bemasher/rtlamr/gen"
+	"github.com/bemasher/rtlamr/parse"
+)
+
+// BenchReport is written by the bench subcommand. Times are in seconds.
+type BenchReport struct {
+	MsgType      string
+	SymbolLength int
+	Decimation   int
+	SampleRate   int // Of the samples decoded, before decimation.
+	Platform     string
+	CPUs         int
+	GoVersion    string
+	Commit       string
+
+	Samples    int64
+	Blocks     int64
+	Packets    int64 // Parsed, whether or not their checksums pass.
+	Seconds    float64
+	MSps       float64 // Millions of samples decoded per second.
+	RealTime   float64 // Multiple of the sample rate decoded at.
+	Stages     BenchStages
+	Allocs     float64 // Heap allocations per block.
+	AllocBytes float64 // Heap bytes allocated per block.
+}
+
+// BenchStages is the time spent in each stage of decoding, see
+// decode.Stages. Other is the remainder, such as reading blocks.
+type BenchStages struct {
+	Magnitude, Filter, Search, Parse, Other float64
+}
+
+// runBench decodes a capture as fast as possible, reporting throughput and
+// where the time goes so users can tell whether a configuration keeps up on
+// their hardware before deploying it.
+func runBench(args []string) int {
+	fs := newSubcommandFlags("bench", "[file.cu8 ...]")
+	msgType := fs.String("msgtype", "scm", "message type to decode: scm, scm+, idm, r900 or r900bcd")
+	symbolLength := fs.Int("symbollength", 72, "symbol length in samples")
+	decimation := fs.Int("decimation", 1, "integer decimation factor, keep every nth sample")
+	duration := fs.Duration("duration", 3*time.Second, "decode for at least this long, repeating the capture")
+	format := fs.String("format", "text", "format of the report: text or json")
+	files, status, exit := parseSubcommandArgs(fs, args)
+	if exit {
+		return status
+	}
+
+	*msgType = strings.ToLower(*msgType)
+	if *format != "text" && *format != "json" {
+		log.Printf("bench: invalid -format %q, expected text or json\n", *format)
+		return exitUsage
+	}
+	if *decimation < 1 || *duration < 0 {
+		log.Println("bench: -decimation must be positive and -duration not negative")
+		return exitUsage
+	}
+
+	p, err := parse.NewParser(*msgType, *symbolLength, *decimation)
+	if err != nil {
+		log.Println("bench:", configError(err))
+		return exitUsage
+	}
+	dec := p.Dec()
+	if dec.DecCfg.ChipLength < 3 {
+		log.Println("bench: -decimation is too large for -symbollength")
+		return exitUsage
+	}
+	cfg := *p.Cfg()
+
+	samples, err := benchSamples(cfg, *msgType, files)
+	if err != nil {
+		log.Println("bench:", err)
+		return exitUsage
+	}
+
+	report := BenchReport{
+		MsgType:      *msgType,
+		SymbolLength: *symbolLength,
+		Decimation:   *decimation,
+		SampleRate:   cfg.SampleRate,
+		Platform:     runtime.GOOS + "/" + runtime.GOARCH,
+		CPUs:         runtime.NumCPU(),
+		GoVersion:    runtime.Version(),
+		Commit:       commitHash,
+	}
+
+	var stages decode.Stages
+	dec.Instrument(&stages)
+	defer dec.Instrument(nil)
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	start := time.Now()
+	for pass := 0; pass == 0 || time.Since(start) < *duration; pass++ {
+		for block := samples; len(block) != 0; block = block[cfg.BlockSize2:] {
+			indices := dec.Decode(block[:cfg.BlockSize2])
+
+			mark := time.Now()
+			report.Packets += int64(len(p.Parse(indices)))
+			stages.Parse += time.Since(mark)
+
+			report.Blocks++
+		}
+	}
+	elapsed := time.Since(start)
+	runtime.ReadMemStats(&after)
+
+	report.Samples = report.Blocks * int64(cfg.BlockSize)
+	report.Seconds = elapsed.Seconds()
+	report.MSps = float64(report.Samples) / report.Seconds / 1e6
+	report.RealTime = report.MSps * 1e6 / float64(cfg.SampleRate)
+	report.Stages = BenchStages{
+		Magnitude: stages.Magnitude.Seconds(),
+		Filter:    stages.Filter.Seconds(),
+		Search:    stages.Search.Seconds(),
+		Parse:     stages.Parse.Seconds(),
+		Other:     (elapsed - stages.Magnitude - stages.Filter - stages.Search - stages.Parse).Seconds(),
+	}
+	report.Allocs = float64(after.Mallocs-before.Mallocs) / float64(report.Blocks)
+	report.AllocBytes = float64(after.TotalAlloc-before.TotalAlloc) / float64(report.Blocks)
+
+	if *format == "json" {
+		err = json.NewEncoder(stdoutWriter{}).Encode(report)
+	} else {
+		err = report.WriteText(stdoutWriter{})
+	}
+	if err != nil {
+		log.Println("bench:", err)
+		return exitOutput
+	}
+	return exitOK
+}
+
+// benchSamples returns the samples of the named files in whole blocks, or
+// without any files a capture of synthetic packets of the message type.
+func benchSamples(cfg decode.PacketConfig, msgType string, files []string) ([]byte, error) {
+	if len(files) == 0 {
+		newPacket, err := genPacket(msgType, 12345678, 7, 0, 0, 0)
+		if err != nil {
+			return nil, err
+		}
+		ch := gen.Channel{SNR: 15, Rand: rand.New(rand.NewSource(1))}
+		return genSamples(cfg, ch, 8, 250*time.Millisecond, func(idx int) []byte {
+			return newPacket(idx, uint32(1000+idx))
+		}), nil
+	}
+
+	var samples []byte
+	for _, name := range files {
+		f, err := openSamples(name)
+		if err != nil {
+			return nil, err
+		}
+		buf, err := io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		samples = append(samples, buf[:len(buf)/cfg.BlockSize2*cfg.BlockSize2]...)
+	}
+	if len(samples) == 0 {
+		return nil, fmt.Errorf("less than a block of samples in %s", strings.Join(files, ", "))
+	}
+	return samples, nil
+}
+
+// WriteText writes the report for people to read.
+func (r BenchReport) WriteText(w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s, symbol length %d, decimation %d, %s with %d CPUs, %s\n",
+		r.MsgType, r.SymbolLength, r.Decimation, r.Platform, r.CPUs, r.GoVersion)
+	fmt.Fprintf(&b, "Decoded %.1f million samples in %.2fs: %.2f MS/s, %.1fx real time at %.3f MS/s\n",
+		float64(r.Samples)/1e6, r.Seconds, r.MSps, r.RealTime, float64(r.SampleRate)/1e6)
+	if r.RealTime < 1 {
+		b.WriteString("This configuration can't keep up, try a larger -decimation or shorter -symbollength.\n")
+	}
+	fmt.Fprintf(&b, "%d blocks, %d packets, %.1f allocations and %.0f bytes allocated per block\n\n",
+		r.Blocks, r.Packets, r.Allocs, r.AllocBytes)
+
+	tw := tabwriter.NewWriter(&b, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "stage\tseconds\tshare\tµs/block\t")
+	for _, stage := range []struct {
+		name    string
+		seconds float64
+	}{
+		{"magnitude", r.Stages.Magnitude},
+		{"filter", r.Stages.Filter},
+		{"search", r.Stages.Search},
+		{"parse", r.Stages.Parse},
+		{"other", r.Stages.Other},
+	} {
+		share := 100 * stage.seconds / r.Seconds
+		if math.IsNaN(share) {
+			share = 0
+		}
+		fmt.Fprintf(tw, "%s\t%.3f\t%.1f%%\t%.1f\t\n", stage.name, stage.seconds, share, stage.seconds/float64(r.Blocks)*1e6)
+	}
+	tw.Flush()
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
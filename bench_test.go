@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBench(t *testing.T) {
+	dir := t.TempDir()
+	out, err := os.Create(filepath.Join(dir, "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	if status := runRtlamr(t, out, "bench", "-duration=0", "-format=json"); status != exitOK {
+		t.Fatalf("expected status %d, got %d", exitOK, status)
+	}
+	buf, _ := os.ReadFile(out.Name())
+	var r BenchReport
+	if err := json.Unmarshal(buf, &r); err != nil {
+		t.Fatal(err)
+	}
+
+	// The generated capture holds 8 packets, each found in a block or two.
+	if r.Packets < 8 || r.Blocks == 0 || r.MSps <= 0 || r.SampleRate != 2359296 {
+		t.Errorf("unexpected report %+v", r)
+	}
+	s := r.Stages
+	if s.Magnitude <= 0 || s.Filter <= 0 || s.Search <= 0 || s.Magnitude+s.Filter+s.Search+s.Parse > r.Seconds {
+		t.Errorf("unexpected stage times %+v of %fs", s, r.Seconds)
+	}
+
+	var text strings.Builder
+	if err := r.WriteText(&text); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"MS/s", "real time", "magnitude", "parse"} {
+		if !strings.Contains(text.String(), want) {
+			t.Errorf("text report lacks %q:\n%s", want, text.String())
+		}
+	}
+
+	for _, args := range [][]string{
+		{"bench", "-format=xml"},
+		{"bench", "-decimation=0"},
+		{"bench", "-msgtype=nope"},
+		{"bench", filepath.Join(dir, "missing.cu8")},
+	} {
+		if status := runRtlamr(t, nil, args...); status != exitUsage {
+			t.Errorf("%v: expected status %d, got %d", args, exitUsage, status)
+		}
+	}
+}
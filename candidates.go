@@ -0,0 +1,106 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"log/slog"
+
+	"github.com/bemasher/rtlamr/clock"
+	"github.com/bemasher/rtlamr/decode"
+	"github.com/bemasher/rtlamr/parse"
+)
+
+// CandidateLogger logs every preamble candidate at debug level for
+// -debugcandidates: the preamble window as quantized, its distance from the
+// expected preamble and how far parsing got.
+type CandidateLogger struct {
+	limit rateLimiter
+	clock clock.Clock
+}
+
+func NewCandidateLogger(limit RateLimit) *CandidateLogger {
+	return &CandidateLogger{limit: rateLimiter{RateLimit: limit}, clock: clock.Real}
+}
+
+// Log records the candidates found in block by the most recent call to
+// p's decoder. Parsers are asked why each packet did or didn't parse, so Log
+// must follow p.Parse.
+func (cl *CandidateLogger) Log(p parse.Parser, indices []int, block uint64) {
+	d := p.Dec()
+	cfg := d.DecCfg
+	diag, _ := p.(parse.Diagnoser)
+
+	now := cl.clock.Now()
+	for _, qIdx := range indices {
+		// Candidates past the first block are found again in the next one.
+		if qIdx > cfg.BlockSize {
+			continue
+		}
+
+		if !cl.limit.Allow(now) {
+			continue
+		}
+
+		preamble, distance := preambleWindow(d, qIdx)
+		args := []any{"block", block, "offset", qIdx, "preamble", preamble, "distance", distance}
+
+		c := parse.Candidate{Stop: "unknown"}
+		if diag != nil {
+			c = diagnose(p, diag, qIdx)
+		}
+		if c.Stop == "" {
+			c.Stop = "parsed"
+		}
+		args = append(args, "stop", c.Stop)
+		if c.Checksum != "" {
+			args = append(args, "checksum", c.Checksum, "expected", c.Expected)
+		}
+
+		if dropped := cl.limit.Dropped(); dropped != 0 {
+			args = append(args, "dropped", dropped)
+		}
+
+		slog.Debug("Candidate", args...)
+	}
+}
+
+// preambleWindow returns the quantized symbols of the preamble at qIdx and
+// their Hamming distance from the expected preamble.
+func preambleWindow(d decode.Decoder, qIdx int) (bits string, distance int) {
+	cfg := d.DecCfg
+
+	window := make([]byte, cfg.PreambleSymbols)
+	for idx := range window {
+		window[idx] = '0' + d.Quantized[qIdx+idx*cfg.SymbolLength]
+		if window[idx] != d.Cfg.Preamble[idx] {
+			distance++
+		}
+	}
+
+	return string(window), distance
+}
+
+// diagnose asks diag about the candidate at idx as if p were only keeping
+// packets failing their checksum with -allowbadcrc. The receiver keeps them
+// to count them and drops them after parsing.
+func diagnose(p parse.Parser, diag parse.Diagnoser, idx int) parse.Candidate {
+	if s, ok := p.(parse.BadCRCSetter); ok {
+		s.SetAllowBadCRC(parse.AllowBadCRC)
+		defer s.SetAllowBadCRC(true)
+	}
+	return diag.Diagnose(idx)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bemasher/rtlamr/clock"
+	"github.com/bemasher/rtlamr/gen"
+	"github.com/bemasher/rtlamr/parse"
+)
+
+func TestCandidateLogger(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		corrupt bool
+		stop    string
+	}{
+		{"valid", false, "parsed"},
+		{"corrupt", true, "checksum"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			p, err := parse.NewParser("scm", 72, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The receiver keeps packets failing their checksum to count
+			// them, they're still logged as stopping at the checksum.
+			if s, ok := p.(parse.BadCRCSetter); ok {
+				s.SetAllowBadCRC(true)
+			}
+
+			pkt, err := gen.NewRandSCM()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.corrupt {
+				pkt[6] ^= 0x10
+			}
+			bits := gen.Upsample(gen.UnpackBits(gen.NewManchesterLUT().Encode(pkt)), 72<<1)
+			carrier := gen.CmplxOscillatorF64(len(bits)>>1, 10e3, float64(p.Cfg().SampleRate))
+			for idx := range carrier {
+				carrier[idx] *= float64(bits[idx])
+			}
+			signal := make([]byte, len(carrier))
+			gen.F64toU8(carrier, signal)
+			signal = append(signal, noise()...)
+
+			var buf bytes.Buffer
+			defer slog.SetDefault(slog.Default())
+			slog.SetDefault(slog.New(newLogHandler(&buf, slog.LevelDebug)))
+
+			cl := NewCandidateLogger(RateLimit{})
+			block := make([]byte, p.Cfg().BlockSize2)
+			for idx := 0; idx+len(block) <= len(signal); idx += len(block) {
+				copy(block, signal[idx:])
+				indices := p.Dec().Decode(block)
+				p.Parse(indices)
+				cl.Log(p, indices, uint64(idx/len(block)))
+			}
+
+			line := regexp.MustCompile(`Candidate block=\d+ offset=\d+ preamble=(\d+) distance=0 stop=(\w+) checksum=([0-9A-F]{4}) expected=([0-9A-F]{4})`)
+			m := line.FindStringSubmatch(buf.String())
+			if m == nil {
+				t.Fatalf("no candidate logged:\n%s", buf.String())
+			}
+			if m[1] != p.Cfg().Preamble {
+				t.Errorf("preamble %s, expected %s", m[1], p.Cfg().Preamble)
+			}
+			if m[2] != test.stop {
+				t.Errorf("stopped at %s, expected %s", m[2], test.stop)
+			}
+			if (m[3] == m[4]) == test.corrupt {
+				t.Errorf("checksum %s, expected %s", m[3], m[4])
+			}
+		})
+	}
+}
+
+func TestCandidateLoggerLimit(t *testing.T) {
+	p, err := parse.NewParser("scm", 72, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signal := scmSignal(t)
+
+	var buf bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(newLogHandler(&buf, slog.LevelDebug)))
+
+	fake := clock.NewFake(time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC))
+	cl := NewCandidateLogger(RateLimit{1, time.Hour})
+	cl.clock = fake
+
+	// logAll logs the candidates of every block of the signal, returning
+	// how many were found and how many of those were logged.
+	block := make([]byte, p.Cfg().BlockSize2)
+	logAll := func() (found, logged int) {
+		buf.Reset()
+		for idx := 0; idx+len(block) <= len(signal); idx += len(block) {
+			copy(block, signal[idx:])
+			indices := p.Dec().Decode(block)
+			p.Parse(indices)
+			for _, qIdx := range indices {
+				if qIdx <= p.Dec().DecCfg.BlockSize {
+					found++
+				}
+			}
+			cl.Log(p, indices, uint64(idx/len(block)))
+		}
+		return found, strings.Count(buf.String(), "Candidate")
+	}
+
+	found, logged := logAll()
+	if found < 2 {
+		t.Fatalf("expected several candidates, found %d", found)
+	}
+	if logged != 1 {
+		t.Errorf("expected 1 candidate logged, got %d:\n%s", logged, buf.String())
+	}
+	if cl.limit.dropped != found-1 {
+		t.Errorf("expected %d dropped, got %d", found-1, cl.limit.dropped)
+	}
+
+	// The window is measured from its first candidate.
+	fake.Advance(time.Hour - time.Second)
+	if _, logged := logAll(); logged != 0 {
+		t.Errorf("expected nothing logged within the window, got %d", logged)
+	}
+
+	// The next window reports those dropped by the last.
+	fake.Advance(time.Second)
+	if _, logged := logAll(); logged != 1 || !strings.Contains(buf.String(), fmt.Sprintf("dropped=%d", 2*found-1)) {
+		t.Errorf("expected 1 candidate logged with %d dropped, got:\n%s", 2*found-1, buf.String())
+	}
+}
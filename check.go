@@ -0,0 +1,104 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+)
+
+// ProbeResult describes a block of samples read by -check.
+type ProbeResult struct {
+	MsgType    string
+	CenterFreq uint32
+	SampleRate uint32
+	Samples    int
+	NoiseFloor float64 // Mean power in dBFS.
+	Clipping   float64 // Percentage of components at either end of the range.
+}
+
+func (pr ProbeResult) String() string {
+	return fmt.Sprintf("read %d samples at %d Hz, %d S/s: noise floor %.1f dBFS, %.2f%% clipped",
+		pr.Samples, pr.CenterFreq, pr.SampleRate, pr.NoiseFloor, pr.Clipping)
+}
+
+// NewProbeResult measures the noise floor and clipping of a block of
+// interleaved 8-bit inphase and quadrature samples.
+func NewProbeResult(block []byte) (pr ProbeResult) {
+	pr.Samples = len(block) >> 1
+	if pr.Samples == 0 {
+		return pr
+	}
+
+	var power float64
+	var clipped int
+	for idx := 0; idx < pr.Samples<<1; idx += 2 {
+		i := (float64(block[idx]) - 127.5) / 127.5
+		q := (float64(block[idx+1]) - 127.5) / 127.5
+		power += i*i + q*q
+
+		for _, b := range block[idx : idx+2] {
+			if b == 0 || b == 255 {
+				clipped++
+			}
+		}
+	}
+
+	pr.NoiseFloor = 10 * math.Log10(power/float64(pr.Samples))
+	pr.Clipping = 100 * float64(clipped) / float64(pr.Samples<<1)
+
+	return pr
+}
+
+// Probe reads one block of samples from the configured receiver to verify
+// samples are flowing.
+func (rcvr *Receiver) Probe() (ProbeResult, error) {
+	block := make([]byte, rcvr.blockSize())
+	if _, err := io.ReadFull(rcvr, block); err != nil {
+		return ProbeResult{}, withStatus(exitDevice, fmt.Errorf("reading samples: %s", err))
+	}
+
+	pr := NewProbeResult(block)
+	pr.MsgType = *msgType
+	pr.CenterFreq, pr.SampleRate = rcvr.centerFreq, rcvr.sampleRate
+
+	return pr, nil
+}
+
+// check reports the result of probing the receiver for -check, once flags,
+// output files and the receiver have been set up. Returns the exit status.
+func (rcvr *Receiver) check() int {
+	pr, err := rcvr.Probe()
+	if err != nil {
+		log.Println("Check failed:", err)
+		return exitStatus(err, exitFatal)
+	}
+
+	if *format == "json" {
+		if err := json.NewEncoder(os.Stdout).Encode(pr); err != nil {
+			log.Println("Check failed: encoding report:", err)
+			return exitOutput
+		}
+	}
+	log.Println("Check passed:", pr)
+
+	return exitOK
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestNewProbeResult(t *testing.T) {
+	// Full scale on both components has a mean power of 2, or 3 dBFS, and is
+	// entirely clipped.
+	pr := NewProbeResult([]byte{255, 0, 0, 255})
+	if pr.Samples != 2 || math.Abs(pr.NoiseFloor-10*math.Log10(2)) > 1e-9 || pr.Clipping != 100 {
+		t.Fatalf("Unexpected result for full scale samples: %+v\n", pr)
+	}
+
+	// Quiet samples are far below full scale and unclipped.
+	quiet := make([]byte, 1024)
+	for idx := range quiet {
+		quiet[idx] = 128
+	}
+	pr = NewProbeResult(quiet)
+	if pr.NoiseFloor > -40 || pr.Clipping != 0 {
+		t.Fatalf("Unexpected result for quiet samples: %+v\n", pr)
+	}
+
+	if pr := NewProbeResult(nil); pr.Samples != 0 {
+		t.Fatalf("Unexpected result for no samples: %+v\n", pr)
+	}
+}
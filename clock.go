@@ -0,0 +1,105 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"time"
+)
+
+// clockFloor is the earliest plausible time for builds without a buildDate.
+var clockFloor = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// clockSlack is how far block times may drift from the clock before they're
+// resynchronized, such as after samples stop flowing while suspended.
+const clockSlack = time.Second
+
+// Clock timestamps packets. Times never go backwards: if the system clock
+// steps back, time continues from the monotonic clock instead, while a step
+// forward, such as NTP setting the clock for the first time, is followed.
+type Clock struct {
+	Floor time.Time // Times before Floor aren't sane.
+
+	now     func() time.Time     // System clock.
+	elapsed func() time.Duration // Monotonic clock.
+	synced  func() (synced, known bool)
+
+	based       bool
+	wall        time.Time     // System clock when it was last followed.
+	wallElapsed time.Duration // Monotonic clock at wall.
+	block       time.Time     // End of the last block of samples.
+}
+
+func NewClock() *Clock {
+	start := time.Now()
+	c := &Clock{
+		Floor:   clockFloor,
+		now:     time.Now,
+		elapsed: func() time.Duration { return time.Since(start) },
+		synced:  clockSynced,
+	}
+	if t, err := time.Parse("2006-01-02", buildDate); err == nil {
+		c.Floor = t
+	}
+	return c
+}
+
+// Now returns the later of the system clock and the monotonic clock since
+// the system clock was last followed.
+func (c *Clock) Now() time.Time {
+	now, elapsed := c.now().Round(0), c.elapsed()
+	if c.based {
+		if mono := c.wall.Add(elapsed - c.wallElapsed); !now.After(mono) {
+			return mono
+		}
+	}
+
+	c.based, c.wall, c.wallElapsed = true, now, elapsed
+	return now
+}
+
+// Block returns the time a block of samples lasting d finished, counted in
+// samples from the previous block so jitter in reading them doesn't affect
+// packet times. Blocks arriving faster than real time, such as a backlog
+// buffered by rtl_tcp, hold at the last block's time until the clock catches
+// up rather than going backwards.
+func (c *Clock) Block(d time.Duration) time.Time {
+	now := c.Now()
+
+	next := c.block.Add(d)
+	switch diff := now.Sub(next); {
+	case c.block.IsZero() || diff > clockSlack:
+		next = now
+	case diff < -clockSlack:
+		next = c.block
+		if now.After(next) {
+			next = now
+		}
+	}
+
+	c.block = next
+	return next
+}
+
+// Sane returns true if the system clock is past Floor and, where the
+// system reports it, synchronized.
+func (c *Clock) Sane() bool {
+	if c.now().Before(c.Floor) {
+		return false
+	}
+	synced, known := c.synced()
+	return synced || !known
+}
@@ -0,0 +1,185 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package clock abstracts the current time and timers so features which
+// depend on the passage of time, such as filter windows, rate limits and
+// schedules, can be stepped deterministically in tests.
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is a source of the current time and of channels delivering it
+// later, as package time provides.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker delivers the time on C every period until stopped, dropping ticks
+// for slow receivers like time.Ticker.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// Real is the system clock.
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (realClock) NewTicker(d time.Duration) Ticker       { return realTicker{time.NewTicker(d)} }
+
+type realTicker struct {
+	t *time.Ticker
+}
+
+func (rt realTicker) C() <-chan time.Time { return rt.t.C }
+func (rt realTicker) Stop()               { rt.t.Stop() }
+
+// Fake is a Clock which only moves when Advance or Set is called, firing
+// the timers and tickers which fall due in order. It's safe for concurrent
+// use.
+type Fake struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []*waiter
+}
+
+// waiter is a pending timer, or a ticker if period is non-zero.
+type waiter struct {
+	at     time.Time
+	period time.Duration
+	c      chan time.Time
+}
+
+// NewFake returns a fake clock starting at now.
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now}
+}
+
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+// After returns a channel receiving the time once the clock has advanced by
+// d, immediately if d isn't positive.
+func (f *Fake) After(d time.Duration) <-chan time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.add(d, 0).c
+}
+
+// NewTicker returns a ticker firing each time the clock passes a multiple
+// of d from now. It panics if d isn't positive, as time.NewTicker does.
+func (f *Fake) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("clock: non-positive interval for NewTicker")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return &fakeTicker{f, f.add(d, d)}
+}
+
+// Waiters returns the number of timers and tickers pending, so tests can
+// wait for a goroutine to start waiting before advancing the clock.
+func (f *Fake) Waiters() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.waiters)
+}
+
+// Advance moves the clock forward by d.
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.advance(f.now.Add(d))
+}
+
+// Set moves the clock to t, which may be earlier than Now, firing nothing
+// if so.
+func (f *Fake) Set(t time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.advance(t)
+}
+
+func (f *Fake) add(d time.Duration, period time.Duration) *waiter {
+	w := &waiter{at: f.now.Add(d), period: period, c: make(chan time.Time, 1)}
+	if period == 0 && d <= 0 {
+		w.c <- f.now
+		return w
+	}
+	f.waiters = append(f.waiters, w)
+	return w
+}
+
+func (f *Fake) remove(w *waiter) {
+	for idx, other := range f.waiters {
+		if other == w {
+			f.waiters = append(f.waiters[:idx], f.waiters[idx+1:]...)
+			return
+		}
+	}
+}
+
+// advance fires waiters due by end in order of their deadlines, with the
+// clock reading each deadline as it fires.
+func (f *Fake) advance(end time.Time) {
+	for {
+		sort.SliceStable(f.waiters, func(i, j int) bool {
+			return f.waiters[i].at.Before(f.waiters[j].at)
+		})
+		if len(f.waiters) == 0 || f.waiters[0].at.After(end) {
+			break
+		}
+
+		w := f.waiters[0]
+		f.now = w.at
+		select {
+		case w.c <- f.now:
+		default:
+		}
+
+		if w.period == 0 {
+			f.waiters = f.waiters[1:]
+		} else {
+			w.at = w.at.Add(w.period)
+		}
+	}
+	f.now = end
+}
+
+type fakeTicker struct {
+	f *Fake
+	w *waiter
+}
+
+func (ft *fakeTicker) C() <-chan time.Time { return ft.w.c }
+
+func (ft *fakeTicker) Stop() {
+	ft.f.mu.Lock()
+	defer ft.f.mu.Unlock()
+	ft.f.remove(ft.w)
+}
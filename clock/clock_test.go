@@ -0,0 +1,88 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+var epoch = time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// received returns the time waiting on c, if any.
+func received(c <-chan time.Time) (time.Time, bool) {
+	select {
+	case t := <-c:
+		return t, true
+	default:
+		return time.Time{}, false
+	}
+}
+
+func TestFakeAfter(t *testing.T) {
+	f := NewFake(epoch)
+
+	if _, ok := received(f.After(0)); !ok {
+		t.Error("expected a zero timer to fire immediately")
+	}
+
+	c := f.After(time.Minute)
+	f.Advance(59 * time.Second)
+	if _, ok := received(c); ok {
+		t.Fatal("timer fired early")
+	}
+	f.Advance(2 * time.Second)
+	if recv, ok := received(c); !ok || !recv.Equal(epoch.Add(time.Minute)) {
+		t.Fatalf("expected the timer to fire at its deadline, got %s %t", recv, ok)
+	}
+	if recv, expt := f.Now(), epoch.Add(61*time.Second); !recv.Equal(expt) {
+		t.Errorf("expected %s got %s", expt, recv)
+	}
+	if f.Waiters() != 0 {
+		t.Errorf("expected a fired timer to be removed, %d waiting", f.Waiters())
+	}
+}
+
+func TestFakeTicker(t *testing.T) {
+	f := NewFake(epoch)
+	ticker := f.NewTicker(time.Second)
+
+	f.Advance(time.Second)
+	if recv, ok := received(ticker.C()); !ok || !recv.Equal(epoch.Add(time.Second)) {
+		t.Fatalf("expected a tick at 1s, got %s %t", recv, ok)
+	}
+
+	// Ticks aren't queued for slow receivers.
+	f.Advance(3 * time.Second)
+	if recv, ok := received(ticker.C()); !ok || !recv.Equal(epoch.Add(2*time.Second)) {
+		t.Fatalf("expected the first missed tick, got %s %t", recv, ok)
+	}
+	if _, ok := received(ticker.C()); ok {
+		t.Fatal("expected later ticks to be dropped")
+	}
+
+	ticker.Stop()
+	f.Advance(time.Hour)
+	if _, ok := received(ticker.C()); ok {
+		t.Error("stopped ticker fired")
+	}
+}
+
+func TestFakeOrder(t *testing.T) {
+	f := NewFake(epoch)
+	late, early := f.After(2*time.Second), f.After(time.Second)
+
+	// Each fires reading its own deadline, even when passed by one step.
+	f.Advance(time.Hour)
+	for _, c := range []struct {
+		c    <-chan time.Time
+		expt time.Duration
+	}{{early, time.Second}, {late, 2 * time.Second}} {
+		if recv, ok := received(c.c); !ok || !recv.Equal(epoch.Add(c.expt)) {
+			t.Errorf("expected %s got %s %t", epoch.Add(c.expt), recv, ok)
+		}
+	}
+
+	f.Set(epoch)
+	if !f.Now().Equal(epoch) {
+		t.Errorf("expected Set to move the clock back, got %s", f.Now())
+	}
+}
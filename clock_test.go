@@ -0,0 +1,124 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClock(t *testing.T) {
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// Each step advances the monotonic clock by a second and sets the system
+	// clock to the given number of seconds after start.
+	testCases := []struct {
+		name  string
+		walls []int
+		expt  []int
+	}{
+		{"Steady", []int{0, 1, 2}, []int{0, 1, 2}},
+		{"StepForward", []int{0, 1, 3600, 3601}, []int{0, 1, 3600, 3601}},
+		{"StepBackward", []int{0, 1, -3600, -3599, 10}, []int{0, 1, 2, 3, 10}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var step int
+			c := &Clock{
+				now:     func() time.Time { return start.Add(time.Duration(tc.walls[step]) * time.Second) },
+				elapsed: func() time.Duration { return time.Duration(step) * time.Second },
+			}
+
+			for step = range tc.walls {
+				if recv, expt := c.Now(), start.Add(time.Duration(tc.expt[step])*time.Second); !recv.Equal(expt) {
+					t.Fatalf("Step %d: expected %s got %s\n", step, expt, recv)
+				}
+			}
+		})
+	}
+}
+
+func TestClockBlock(t *testing.T) {
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	var now time.Duration
+	c := &Clock{
+		now:     func() time.Time { return start.Add(now) },
+		elapsed: func() time.Duration { return now },
+	}
+
+	// Blocks read with jitter are spaced by their duration.
+	block := 10 * time.Millisecond
+	for idx, read := range []time.Duration{10, 25, 30, 40} {
+		now = read * time.Millisecond
+		if recv, expt := c.Block(block), start.Add(time.Duration(idx+1)*block); idx != 0 && !recv.Equal(expt) {
+			t.Fatalf("Block %d: expected %s got %s\n", idx, expt, recv)
+		}
+	}
+
+	// Blocks resume from the clock after a gap.
+	now = time.Minute
+	if recv, expt := c.Block(block), start.Add(now); !recv.Equal(expt) {
+		t.Fatalf("Expected %s got %s\n", expt, recv)
+	}
+}
+
+func TestClockBlockAhead(t *testing.T) {
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	var now time.Duration
+	c := &Clock{
+		now:     func() time.Time { return start.Add(now) },
+		elapsed: func() time.Duration { return now },
+	}
+
+	// A backlog of blocks read in bursts much faster than real time gets
+	// ahead of the clock, times must still never go backwards.
+	block := 100 * time.Millisecond
+	var last time.Time
+	for idx := 0; idx < 200; idx++ {
+		now = time.Duration(idx) * time.Millisecond
+		recv := c.Block(block)
+		if recv.Before(last) {
+			t.Fatalf("Block %d: went backwards from %s to %s\n", idx, last, recv)
+		}
+		if ahead := recv.Sub(start.Add(now)); ahead > clockSlack+block {
+			t.Fatalf("Block %d: %s ahead of the clock\n", idx, ahead)
+		}
+		last = recv
+	}
+
+	// Once blocks come in real time again, they follow the clock.
+	now = time.Minute
+	if recv, expt := c.Block(block), start.Add(now); !recv.Equal(expt) {
+		t.Fatalf("Expected %s got %s\n", expt, recv)
+	}
+}
+
+func TestClockSane(t *testing.T) {
+	floor := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name          string
+		now           time.Time
+		synced, known bool
+		expt          bool
+	}{
+		{"BeforeFloor", time.Unix(0, 0), true, true, false},
+		{"Synced", floor.Add(time.Hour), true, true, true},
+		{"Unsynced", floor.Add(time.Hour), false, true, false},
+		{"Unknown", floor.Add(time.Hour), false, false, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := &Clock{
+				Floor:  floor,
+				now:    func() time.Time { return tc.now },
+				synced: func() (bool, bool) { return tc.synced, tc.known },
+			}
+			if recv := c.Sane(); recv != tc.expt {
+				t.Fatalf("Expected %t got %t\n", tc.expt, recv)
+			}
+		})
+	}
+}
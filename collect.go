@@ -0,0 +1,160 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/bemasher/rtlamr/idm"
+	"github.com/bemasher/rtlamr/lru"
+	"github.com/bemasher/rtlamr/parse"
+)
+
+// IntervalRecord is written to the output by -collect in place of IDM
+// messages, one for each completed consumption interval not written before.
+type IntervalRecord struct {
+	Time        time.Time // End of the interval.
+	MsgType     string
+	ID          uint32
+	MeterName   string `json:",omitempty" xml:",omitempty"`
+	Count       uint8  // The interval's ConsumptionIntervalCount.
+	Consumption uint16 // Consumption during the interval.
+}
+
+func (r IntervalRecord) String() string {
+	fields := fmt.Sprintf("Time:%s Interval MsgType:%s ID:%d", r.Time.Format(parse.TimeFormat), r.MsgType, r.ID)
+	if r.MeterName != "" {
+		fields += " MeterName:" + r.MeterName
+	}
+	return "{" + fields + fmt.Sprintf(" Count:%d Consumption:%d}", r.Count, r.Consumption)
+}
+
+func (r IntervalRecord) Record() []string {
+	return []string{
+		r.Time.Format(time.RFC3339Nano),
+		"interval",
+		r.MsgType,
+		strconv.FormatUint(uint64(r.ID), 10),
+		r.MeterName,
+		strconv.FormatUint(uint64(r.Count), 10),
+		strconv.FormatUint(uint64(r.Consumption), 10),
+	}
+}
+
+// IntervalCollector stitches the differential consumption intervals carried
+// by successive IDM packets from each meter into a continuous series.
+//
+// Each packet carries the 47 most recent intervals, most recent first, of
+// which the first is still accumulating. Intervals are numbered by
+// ConsumptionIntervalCount, which wraps at 256, and TransmitTimeOffset gives
+// the time since the current interval began in 1/16ths of a second.
+// Successive packets overlap, so the collector remembers the count and end
+// of the last interval written for each meter and returns only those
+// following it.
+type IntervalCollector struct {
+	Interval time.Duration // Length of each interval.
+
+	last *lru.Cache // collectEntry keyed by meter id.
+}
+
+type collectEntry struct {
+	Count uint8
+	End   time.Time
+}
+
+// CollectState is the last interval -collect wrote for a meter.
+type CollectState struct {
+	ID    uint32
+	Count uint8
+	End   time.Time
+}
+
+func NewIntervalCollector(interval time.Duration, maxMeters int) *IntervalCollector {
+	return &IntervalCollector{Interval: interval, last: lru.New(maxMeters)}
+}
+
+// Collect returns the intervals in pkt, received at t, which haven't been
+// returned before, oldest first.
+func (ic *IntervalCollector) Collect(pkt idm.IDM, t time.Time, meterName string) (records []IntervalRecord) {
+	intervals := pkt.DifferentialConsumptionIntervals
+
+	// End of the most recently completed interval.
+	end := t.Add(-time.Duration(pkt.TransmitTimeOffset) * time.Second / 16)
+	count := pkt.ConsumptionIntervalCount - 1
+
+	// Number of intervals completed since the last one written, taking the
+	// elapsed time into account to resolve wrapping of the count.
+	newIntervals := len(intervals) - 1
+	if v, ok := ic.last.Get(pkt.MeterID()); ok {
+		last := v.(collectEntry)
+		newIntervals = ic.elapsed(last, count, end)
+		if newIntervals <= 0 {
+			return nil
+		}
+		if newIntervals > len(intervals)-1 {
+			newIntervals = len(intervals) - 1
+		}
+	}
+
+	for idx := newIntervals; idx >= 1; idx-- {
+		records = append(records, IntervalRecord{
+			Time:        end.Add(-time.Duration(idx-1) * ic.Interval),
+			MsgType:     pkt.MsgType(),
+			ID:          pkt.MeterID(),
+			MeterName:   meterName,
+			Count:       count - uint8(idx-1),
+			Consumption: intervals[idx],
+		})
+	}
+	ic.last.Add(pkt.MeterID(), collectEntry{count, end})
+
+	return records
+}
+
+// elapsed returns the number of intervals from last to the interval count
+// ending at end. Counts are congruent modulo 256, so of those the one
+// closest to the time elapsed is chosen.
+func (ic *IntervalCollector) elapsed(last collectEntry, count uint8, end time.Time) int {
+	modular := int(count - last.Count)
+	if ic.Interval <= 0 {
+		return modular
+	}
+
+	estimate := math.Round(float64(end.Sub(last.End)) / float64(ic.Interval))
+	wraps := math.Round((estimate - float64(modular)) / 256)
+	return modular + 256*int(wraps)
+}
+
+// Snapshot returns the last interval written for every tracked meter from
+// least to most recently heard.
+func (ic *IntervalCollector) Snapshot() (states []CollectState) {
+	ic.last.Range(func(key, value interface{}) {
+		v := value.(collectEntry)
+		states = append(states, CollectState{key.(uint32), v.Count, v.End})
+	})
+	return
+}
+
+// Restore adds intervals from a previous Snapshot.
+func (ic *IntervalCollector) Restore(states []CollectState) {
+	for _, s := range states {
+		ic.last.Add(s.ID, collectEntry{s.Count, s.End})
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bemasher/rtlamr/idm"
+)
+
+// idmMeter simulates a meter's interval history, transmitting a packet at
+// any time.
+type idmMeter struct {
+	start time.Time     // Beginning of interval 0.
+	usage []uint16      // Consumption during each interval.
+	step  time.Duration // Length of each interval.
+}
+
+// packet returns the packet transmitted at t.
+func (m idmMeter) packet(t time.Time) idm.IDM {
+	elapsed := t.Sub(m.start)
+	current := int(elapsed / m.step)
+
+	var pkt idm.IDM
+	pkt.ERTSerialNumber = 12345678
+	pkt.ConsumptionIntervalCount = uint8(current)
+	pkt.TransmitTimeOffset = uint16((elapsed % m.step) * 16 / time.Second)
+	for idx := range pkt.DifferentialConsumptionIntervals {
+		if current-idx >= 0 {
+			pkt.DifferentialConsumptionIntervals[idx] = m.usage[current-idx]
+		}
+	}
+	return pkt
+}
+
+func TestIntervalCollector(t *testing.T) {
+	meter := idmMeter{
+		start: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		usage: make([]uint16, 700),
+		step:  5 * time.Minute,
+	}
+	for idx := range meter.usage {
+		meter.usage[idx] = uint16(idx*37) % 511
+	}
+
+	// Packets are heard every 30s to 3m with reception delays, some
+	// twice, and with a silence of 3h, long enough to wrap the interval
+	// count.
+	var times []time.Time
+	for t := meter.start.Add(47*meter.step + time.Minute); t.Before(meter.start.Add(699 * meter.step)); {
+		times = append(times, t)
+		if len(times)%7 == 0 {
+			times = append(times, t.Add(40*time.Millisecond))
+		}
+		switch {
+		case len(times) == 200:
+			t = t.Add(3 * time.Hour)
+		case len(times)%3 == 0:
+			t = t.Add(3 * time.Minute)
+		default:
+			t = t.Add(30 * time.Second)
+		}
+	}
+
+	collect := func(ic *IntervalCollector, times []time.Time) (records []IntervalRecord) {
+		for _, t := range times {
+			records = append(records, ic.Collect(meter.packet(t), t, "")...)
+		}
+		return
+	}
+
+	ic := NewIntervalCollector(meter.step, 100)
+	records := collect(ic, times[:300])
+
+	// Restart halfway with the collector's state.
+	restored := NewIntervalCollector(meter.step, 100)
+	restored.Restore(ic.Snapshot())
+	records = append(records, collect(restored, times[300:])...)
+
+	first := 1 // The first packet carries intervals 1 through 46.
+	for idx, r := range records {
+		interval := first + idx
+		end := meter.start.Add(time.Duration(interval+1) * meter.step)
+		if r.Count != uint8(interval) || r.Consumption != meter.usage[interval] {
+			t.Fatalf("record %d: got count %d consumption %d, want interval %d with %d", idx, r.Count, r.Consumption, interval, meter.usage[interval])
+		}
+		if d := r.Time.Sub(end); d < 0 || d > time.Second {
+			t.Fatalf("record %d: interval %d ends at %s, want %s", idx, interval, r.Time, end)
+		}
+	}
+
+	// Every interval completed by the last packet is written once.
+	last := times[len(times)-1]
+	if n := len(records); first+n != int(last.Sub(meter.start)/meter.step) {
+		t.Errorf("got %d records, want intervals %d to %d", n, first, int(last.Sub(meter.start)/meter.step)-1)
+	}
+}
+
+func TestIntervalCollectorLongGap(t *testing.T) {
+	meter := idmMeter{
+		start: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		usage: make([]uint16, 400),
+		step:  5 * time.Minute,
+	}
+	for idx := range meter.usage {
+		meter.usage[idx] = uint16(idx)
+	}
+
+	ic := NewIntervalCollector(meter.step, 100)
+	t0 := meter.start.Add(50*meter.step + time.Minute)
+	ic.Collect(meter.packet(t0), t0, "")
+
+	// 300 intervals later the count has advanced by 44 modulo 256, the
+	// elapsed time tells the two apart.
+	t1 := t0.Add(300 * meter.step)
+	records := ic.Collect(meter.packet(t1), t1, "")
+	if len(records) != 46 {
+		t.Fatalf("got %d records, want 46", len(records))
+	}
+	if r := records[0]; r.Count != 304%256 || r.Consumption != 304 {
+		t.Errorf("oldest record %+v, want interval 304", r)
+	}
+}
@@ -0,0 +1,118 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/bemasher/rtlamr/lru"
+	"github.com/bemasher/rtlamr/parse"
+)
+
+// Meters remembered for rate limiting, the least recently heard are forgotten
+// first and may be written early.
+const collectdMaxMeters = 10000
+
+// CollectdEncoder writes consumption as PUTVAL commands for collectd's exec
+// plugin. Each meter is written at most once per Interval, later messages
+// within the interval are dropped. Values other than messages, such as
+// alerts, aren't written.
+type CollectdEncoder struct {
+	Hostname string
+	Interval time.Duration
+
+	w    io.Writer
+	last *lru.Cache // time.Time of the last PUTVAL keyed by uniqueKey.
+}
+
+// NewCollectdEncoder returns an encoder writing to w. Blank hostname and
+// zero interval are taken from the COLLECTD_HOSTNAME and COLLECTD_INTERVAL
+// variables set by the exec plugin, falling back to the system's hostname
+// and 30s.
+func NewCollectdEncoder(w io.Writer, hostname string, interval time.Duration) *CollectdEncoder {
+	if hostname == "" {
+		hostname = os.Getenv("COLLECTD_HOSTNAME")
+	}
+	if hostname == "" {
+		hostname, _ = os.Hostname()
+	}
+	if hostname == "" {
+		hostname = "localhost"
+	}
+
+	if interval <= 0 {
+		if secs, err := strconv.ParseFloat(os.Getenv("COLLECTD_INTERVAL"), 64); err == nil && secs > 0 {
+			interval = time.Duration(secs * float64(time.Second))
+		}
+	}
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+
+	return &CollectdEncoder{
+		Hostname: hostname,
+		Interval: interval,
+		w:        w,
+		last:     lru.New(collectdMaxMeters),
+	}
+}
+
+func (ce *CollectdEncoder) Encode(v interface{}) error {
+	var msg parse.LogMessage
+	switch m := v.(type) {
+	case parse.LogMessage:
+		msg = m
+	case *parse.LogMessage:
+		msg = *m
+	default:
+		return nil
+	}
+
+	key := uniqueKey{msg.MeterID(), msg.MsgType()}
+	if last, ok := ce.last.Get(key); ok && msg.Time.Sub(last.(time.Time)) < ce.Interval {
+		return nil
+	}
+	ce.last.Add(key, msg.Time)
+
+	value := strconv.FormatUint(uint64(msg.MeterConsumption()), 10)
+	if msg.ScaledConsumption != nil {
+		value = strconv.FormatFloat(*msg.ScaledConsumption, 'f', -1, 64)
+	}
+
+	_, err := fmt.Fprintf(ce.w, "PUTVAL \"%s/rtlamr-%s/gauge-consumption\" interval=%s N:%s\n",
+		ce.Hostname, ce.pluginInstance(msg), strconv.FormatFloat(ce.Interval.Seconds(), 'f', -1, 64), value)
+	return err
+}
+
+// pluginInstance names the meter by its commodity and id, or by id alone if
+// its commodity isn't known.
+func (ce *CollectdEncoder) pluginInstance(msg parse.LogMessage) string {
+	id := strconv.FormatUint(uint64(msg.MeterID()), 10)
+
+	commodity := msg.Commodity
+	if commodity == "" {
+		commodity = commodityOf(msg.MsgType(), uint(msg.MeterType()))
+	}
+	if commodity == "" {
+		return id
+	}
+	return commodity + "_" + id
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bemasher/rtlamr/parse"
+	"github.com/bemasher/rtlamr/r900"
+	"github.com/bemasher/rtlamr/scm"
+)
+
+func TestCollectdEncoder(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	scaled := 12.5
+
+	var buf bytes.Buffer
+	enc := NewCollectdEncoder(&buf, "host", 30*time.Second)
+
+	msgs := []parse.LogMessage{
+		{Time: start, Message: scm.SCM{ID: 1, Type: 12, Consumption: 100}},
+		{Time: start.Add(10 * time.Second), Message: scm.SCM{ID: 1, Type: 12, Consumption: 101}},
+		{Time: start.Add(10 * time.Second), Message: scm.SCM{ID: 2, Type: 3, Consumption: 200}},
+		{Time: start.Add(30 * time.Second), Message: scm.SCM{ID: 1, Type: 12, Consumption: 102}},
+		{Time: start, Message: r900.R900{ID: 3, Consumption: 300}, ScaledConsumption: &scaled},
+		{Time: start, Message: scm.SCM{ID: 4, Type: 12, Consumption: 400}, Commodity: "water"},
+	}
+	for _, msg := range msgs {
+		if err := enc.Encode(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := enc.Encode(&Alert{}); err != nil {
+		t.Fatal(err)
+	}
+
+	expt := strings.Join([]string{
+		`PUTVAL "host/rtlamr-gas_1/gauge-consumption" interval=30 N:100`,
+		`PUTVAL "host/rtlamr-2/gauge-consumption" interval=30 N:200`,
+		`PUTVAL "host/rtlamr-gas_1/gauge-consumption" interval=30 N:102`,
+		`PUTVAL "host/rtlamr-water_3/gauge-consumption" interval=30 N:12.5`,
+		`PUTVAL "host/rtlamr-water_4/gauge-consumption" interval=30 N:400`,
+	}, "\n") + "\n"
+	if buf.String() != expt {
+		t.Errorf("got:\n%s\nwant:\n%s", buf.String(), expt)
+	}
+}
+
+func TestCollectdEncoderEnv(t *testing.T) {
+	t.Setenv("COLLECTD_HOSTNAME", "plugin-host")
+	t.Setenv("COLLECTD_INTERVAL", "10.000")
+
+	enc := NewCollectdEncoder(nil, "", 0)
+	if enc.Hostname != "plugin-host" || enc.Interval != 10*time.Second {
+		t.Errorf("got %s %s, want plugin-host 10s", enc.Hostname, enc.Interval)
+	}
+
+	enc = NewCollectdEncoder(nil, "flag-host", time.Minute)
+	if enc.Hostname != "flag-host" || enc.Interval != time.Minute {
+		t.Errorf("got %s %s, want flag-host 1m0s", enc.Hostname, enc.Interval)
+	}
+}
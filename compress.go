@@ -0,0 +1,297 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/bemasher/rtlamr/zstd"
+)
+
+const (
+	// Blocks queued for compression before they're dropped.
+	compressQueue = 64
+
+	// Compressed streams are ended this often so a recording cut short,
+	// such as by a crash or power loss, decompresses up to the last one.
+	compressInterval = 10 * time.Second
+)
+
+// compressor is implemented by gzip.Writer and zstd.Writer.
+type compressor interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+// newCompressor returns a compressor for files named with a .gz or .zst
+// extension, nil for other names.
+func newCompressor(name string) compressor {
+	switch filepath.Ext(name) {
+	case ".gz":
+		return gzip.NewWriter(nil)
+	case ".zst":
+		return zstd.NewWriter(nil)
+	}
+	return nil
+}
+
+// SampleFile is the file -samplefile writes to. Files named with a .gz or .zst
+// extension are compressed on a goroutine of their own fed through a bounded
+// queue, so compression never stalls decoding. Blocks arriving while the
+// queue is full are dropped and counted rather than waited for.
+type SampleFile struct {
+	*os.File
+
+	queue chan []byte
+	flush chan chan error
+	done  chan struct{}
+	pos   int64 // Uncompressed bytes written or queued.
+
+	dropped, droppedBytes int64
+	warned                time.Time
+
+	mu  sync.Mutex
+	err error // First failure to compress or write.
+}
+
+// newSampleFile writes to f, compressing if its name calls for it. pos is the
+// uncompressed length of samples already in a compressed file, those in an
+// uncompressed file are found by seeking to its end. Pipes and devices which
+// can't seek begin at pos.
+func newSampleFile(f *os.File, pos int64) *SampleFile {
+	s := &SampleFile{File: f, pos: pos}
+	if z := newCompressor(f.Name()); z != nil {
+		s.queue = make(chan []byte, compressQueue)
+		s.flush = make(chan chan error)
+		s.done = make(chan struct{})
+		go s.compress(z)
+	} else if end, err := f.Seek(0, io.SeekEnd); err == nil {
+		s.pos = end
+	}
+	return s
+}
+
+// Compressed returns true if samples are compressed.
+func (s *SampleFile) Compressed() bool {
+	return s.queue != nil
+}
+
+// Position returns the offset in the uncompressed samples the next write
+// begins at. It's counted as samples are written rather than asked of the
+// file, which /dev/null and pipes can't answer.
+func (s *SampleFile) Position() int64 {
+	return s.pos
+}
+
+// Size returns the length of the file, which for a compressed file lags the
+// samples queued.
+func (s *SampleFile) Size() int64 {
+	if !s.Compressed() {
+		return s.pos
+	}
+	fi, err := s.Stat()
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
+
+// Write writes p, or queues a copy of it for compression. Returns the error
+// which stopped compression, if any, so the file is reopened.
+func (s *SampleFile) Write(p []byte) (int, error) {
+	if !s.Compressed() {
+		n, err := s.File.Write(p)
+		s.pos += int64(n)
+		return n, err
+	}
+	if err := s.error(); err != nil {
+		return 0, err
+	}
+
+	select {
+	case s.queue <- append([]byte(nil), p...):
+		s.pos += int64(len(p))
+	default:
+		s.dropped++
+		s.droppedBytes += int64(len(p))
+		if now := time.Now(); now.Sub(s.warned) >= retryLogInterval {
+			slog.Warn("compression can't keep up, dropping samples", "file", s.Name(), "blocks", s.dropped, "bytes", s.droppedBytes)
+			s.warned = now
+		}
+	}
+	return len(p), nil
+}
+
+func (s *SampleFile) error() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (s *SampleFile) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+// compress compresses queued blocks to the file until the queue is closed,
+// ending the stream every compressInterval and when flushed.
+func (s *SampleFile) compress(z compressor) {
+	defer close(s.done)
+
+	var started time.Time
+	write := func(block []byte) {
+		if s.error() != nil {
+			return
+		}
+		if started.IsZero() {
+			z.Reset(s.File)
+			started = time.Now()
+		}
+		if _, err := z.Write(block); err != nil {
+			s.fail(err)
+		}
+	}
+	end := func() {
+		if !started.IsZero() {
+			if err := z.Close(); err != nil {
+				s.fail(err)
+			}
+			started = time.Time{}
+		}
+	}
+
+	for {
+		select {
+		case block, ok := <-s.queue:
+			if !ok {
+				end()
+				return
+			}
+			write(block)
+			if time.Since(started) >= compressInterval {
+				end()
+			}
+		case done := <-s.flush:
+			// Blocks queued before the flush are compressed first.
+			for n := len(s.queue); n > 0; n-- {
+				write(<-s.queue)
+			}
+			end()
+			done <- s.error()
+		}
+	}
+}
+
+// Flush compresses the blocks queued and ends the compressed stream, so the
+// file decompresses in full. The next block begins another.
+func (s *SampleFile) Flush() error {
+	if !s.Compressed() {
+		return nil
+	}
+	done := make(chan error)
+	select {
+	case s.flush <- done:
+		return <-done
+	case <-s.done:
+		return s.error()
+	}
+}
+
+// Sync flushes compressed samples and commits the file to disk.
+func (s *SampleFile) Sync() error {
+	if err := s.Flush(); err != nil {
+		return err
+	}
+	return s.File.Sync()
+}
+
+// Stop compresses the blocks queued, ends the stream and stops compressing
+// without closing the file. Writes fail once stopped.
+func (s *SampleFile) Stop() error {
+	if !s.Compressed() {
+		return nil
+	}
+	select {
+	case <-s.done:
+	default:
+		close(s.queue)
+		<-s.done
+		s.fail(os.ErrClosed)
+	}
+	if s.dropped != 0 {
+		slog.Warn("samples dropped while compressing", "file", s.Name(), "blocks", s.dropped, "bytes", s.droppedBytes)
+		s.dropped, s.droppedBytes = 0, 0
+	}
+	if err := s.error(); err != os.ErrClosed {
+		return err
+	}
+	return nil
+}
+
+// Close stops compressing and closes the file.
+func (s *SampleFile) Close() error {
+	err := s.Stop()
+	return errors.Join(err, s.File.Close())
+}
+
+// openSamples opens a file of samples for reading, decompressing files named
+// with a .gz or .zst extension. A compressed file cut short reads up to
+// where it ends. The name - reads uncompressed samples from stdin, which
+// isn't offered as an io.Seeker as it may be a pipe.
+func openSamples(name string) (io.ReadCloser, error) {
+	if name == "-" {
+		return struct {
+			io.Reader
+			io.Closer
+		}{os.Stdin, io.NopCloser(nil)}, nil
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var r io.Reader
+	switch filepath.Ext(name) {
+	case ".gz":
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		r = zr
+	case ".zst":
+		r = zstd.NewReader(f)
+	default:
+		return f, nil
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{r, f}, nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSampleFileCompressed(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping receiving in short mode")
+	}
+
+	signal := fakeRTLTCP(t, scmSignal(t))
+	dir := t.TempDir()
+
+	record := func(name string) []byte {
+		stdout, err := os.Create(filepath.Join(dir, name+".json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer stdout.Close()
+
+		args := []string{"-summary=false", "-server=" + signal, "-format=json", "-msglimit=3", "-duration=10s",
+			"-samplefile=" + filepath.Join(dir, name)}
+		if status := runRtlamr(t, stdout, args...); status != exitOK {
+			t.Fatalf("%s: expected status %d, got %d", name, exitOK, status)
+		}
+		buf, _ := os.ReadFile(stdout.Name())
+		return buf
+	}
+
+	plainMsgs := record("capture.cu8")
+	plain, err := os.ReadFile(filepath.Join(dir, "capture.cu8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ext := range []string{".gz", ".zst"} {
+		name := "capture.cu8" + ext
+		msgs := record(name)
+
+		f, err := openSamples(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		samples, err := io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !bytes.Equal(samples, plain) {
+			t.Errorf("%s: decompressed %d bytes, want the %d recorded uncompressed", name, len(samples), len(plain))
+		}
+
+		// Offsets are into the decompressed samples.
+		offsets := func(buf []byte) (offsets []int64) {
+			for _, line := range strings.Split(strings.TrimSpace(string(buf)), "\n") {
+				var msg struct{ Offset, Length int64 }
+				if err := json.Unmarshal([]byte(line), &msg); err != nil {
+					t.Fatal(err)
+				}
+				offsets = append(offsets, msg.Offset, msg.Length)
+			}
+			return offsets
+		}
+		if got, want := offsets(msgs), offsets(plainMsgs); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: offsets and lengths %v, want %v", name, got, want)
+		}
+
+		out, err := os.Create(filepath.Join(dir, name+".replay"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer out.Close()
+		if status := runRtlamr(t, out, "replay", "-format=json", "-start=1ms", filepath.Join(dir, name)); status != exitOK {
+			t.Fatalf("%s: replay: expected status %d, got %d", name, exitOK, status)
+		}
+		if buf, _ := os.ReadFile(out.Name()); bytes.Count(buf, []byte("\n")) != 3 {
+			t.Errorf("%s: replay decoded %q, want 3 messages", name, buf)
+		}
+	}
+}
+
+func TestSampleFileDrops(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "samples.cu8.zst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// Compression hasn't started, so the queue fills and later blocks are
+	// dropped without moving the position.
+	s := &SampleFile{File: f, queue: make(chan []byte, 2)}
+	for idx := 0; idx < 5; idx++ {
+		if n, err := s.Write(make([]byte, 10)); n != 10 || err != nil {
+			t.Fatalf("write %d: %d, %v", idx, n, err)
+		}
+	}
+	if pos := s.Position(); pos != 20 || s.dropped != 3 || s.droppedBytes != 30 {
+		t.Errorf("position %d with %d blocks of %d bytes dropped, want 20 with 3 of 30", pos, s.dropped, s.droppedBytes)
+	}
+}
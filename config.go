@@ -0,0 +1,243 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Flags whose values are redacted by -config.print.
+var secretWords = []string{"password", "secret", "token"}
+
+// ReadConfigFile loads settings from a configuration file into fs, see
+// ReadConfig.
+func ReadConfigFile(fs *flag.FlagSet, filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := ReadConfig(fs, file); err != nil {
+		return fmt.Errorf("%s: %s", filename, err)
+	}
+
+	return nil
+}
+
+// ReadConfig sets flags in fs from a subset of TOML. Keys are flag names and
+// tables prefix the keys following them, so window under [unique] sets
+// -unique.window. Values are strings, numbers, booleans or single line
+// arrays of them. Flags already set, on the command line or by environment
+// variables, take precedence over the file. Unknown keys are an error.
+//
+//	msgtype = "scm+"
+//	filterid = [12345678, 23456789]
+//
+//	[unique]
+//	window = "15m"
+func ReadConfig(fs *flag.FlagSet, r io.Reader) error {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	seen := make(map[string]bool)
+	table := ""
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimSpace(stripComment(scanner.Text()))
+		if entry == "" {
+			continue
+		}
+
+		if strings.HasPrefix(entry, "[") {
+			if !strings.HasSuffix(entry, "]") {
+				return fmt.Errorf("line %d: invalid table %q", line, entry)
+			}
+			table = strings.TrimSpace(entry[1:len(entry)-1]) + "."
+			continue
+		}
+
+		idx := strings.Index(entry, "=")
+		if idx == -1 {
+			return fmt.Errorf("line %d: expected key = value", line)
+		}
+
+		name := table + strings.TrimSpace(entry[:idx])
+		f := fs.Lookup(name)
+		if f == nil || name == "config" || name == "config.print" {
+			return fmt.Errorf("line %d: unknown setting %q", line, name)
+		}
+		if seen[name] {
+			return fmt.Errorf("line %d: %q is already set", line, name)
+		}
+		seen[name] = true
+
+		values, err := parseConfigValue(strings.TrimSpace(entry[idx+1:]))
+		if err != nil {
+			return fmt.Errorf("line %d: %s: %s", line, name, err)
+		}
+
+		if set[name] {
+			continue
+		}
+
+		// Flags with their own list syntax accumulate each element, the
+		// standard flag types take a comma-separated list.
+		if _, ok := f.Value.(flag.Getter); ok {
+			values = []string{strings.Join(values, ",")}
+		}
+		for _, value := range values {
+			if _, ok := f.Value.(flag.Getter); !ok && value == "" {
+				continue
+			}
+			if err := fs.Set(name, value); err != nil {
+				return fmt.Errorf("line %d: %s: %s", line, name, err)
+			}
+		}
+	}
+
+	return scanner.Err()
+}
+
+// stripComment removes anything following a # outside of a string.
+func stripComment(line string) string {
+	var quote byte
+	for idx := 0; idx < len(line); idx++ {
+		switch c := line[idx]; {
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == '"' && c == '\\':
+			idx++
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && c == '#':
+			return line[:idx]
+		}
+	}
+	return line
+}
+
+// parseConfigValue parses a scalar or an array of scalars.
+func parseConfigValue(value string) (values []string, err error) {
+	if !strings.HasPrefix(value, "[") {
+		v, err := parseConfigScalar(value)
+		return []string{v}, err
+	}
+
+	if !strings.HasSuffix(value, "]") {
+		return nil, fmt.Errorf("arrays must be on a single line")
+	}
+
+	for _, element := range splitConfigArray(value[1 : len(value)-1]) {
+		if element = strings.TrimSpace(element); element == "" {
+			continue
+		}
+		v, err := parseConfigScalar(element)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+
+	return values, nil
+}
+
+// splitConfigArray splits array elements on commas outside of strings.
+func splitConfigArray(s string) (elements []string) {
+	var quote byte
+	start := 0
+	for idx := 0; idx < len(s); idx++ {
+		switch c := s[idx]; {
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == '"' && c == '\\':
+			idx++
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && c == ',':
+			elements = append(elements, s[start:idx])
+			start = idx + 1
+		}
+	}
+	return append(elements, s[start:])
+}
+
+func parseConfigScalar(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, `"`):
+		return strconv.Unquote(value)
+	case strings.HasPrefix(value, "'"):
+		if len(value) < 2 || !strings.HasSuffix(value, "'") {
+			return "", fmt.Errorf("unterminated string %s", value)
+		}
+		return value[1 : len(value)-1], nil
+	case value == "true" || value == "false":
+		return value, nil
+	}
+
+	if _, err := strconv.ParseFloat(strings.Replace(value, "_", "", -1), 64); err != nil {
+		return "", fmt.Errorf("invalid value %s, strings must be quoted", value)
+	}
+	return strings.Replace(value, "_", "", -1), nil
+}
+
+// PrintConfig writes the value of every flag in fs in the format read by
+// ReadConfig. Values of flags named like secrets are redacted.
+func PrintConfig(fs *flag.FlagSet, w io.Writer) error {
+	var names []string
+	fs.VisitAll(func(f *flag.Flag) {
+		_, alias := f.Value.(*flagAlias)
+		if !alias && f.Name != "config" && f.Name != "config.print" && f.Name != "help" {
+			names = append(names, f.Name)
+		}
+	})
+	sort.Strings(names)
+
+	for _, name := range names {
+		f := fs.Lookup(name)
+
+		value := strconv.Quote(f.Value.String())
+		if g, ok := f.Value.(flag.Getter); ok {
+			switch g.Get().(type) {
+			case bool, int, int64, uint, uint64, float64:
+				value = f.Value.String()
+			}
+		}
+
+		for _, word := range secretWords {
+			if strings.Contains(strings.ToLower(name), word) && f.Value.String() != "" {
+				value = `"<redacted>"`
+			}
+		}
+
+		if _, err := fmt.Fprintf(w, "%s = %s\n", name, value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
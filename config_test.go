@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newConfigFlagSet() (*flag.FlagSet, *MeterIDFilter) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("msgtype", "scm", "")
+	fs.String("server", "127.0.0.1:1234", "")
+	fs.Bool("unique", false, "")
+	fs.Duration("unique.window", 0, "")
+	fs.String("onchange.fields", "", "")
+	fs.String("mqtt.password", "", "")
+
+	ids := NewMeterIDFilter()
+	fs.Var(ids, "filterid", "")
+
+	return fs, ids
+}
+
+func TestReadConfig(t *testing.T) {
+	fs, ids := newConfigFlagSet()
+	if err := fs.Parse([]string{"-msgtype=idm"}); err != nil {
+		t.Fatal(err)
+	}
+
+	config := `# receiver
+msgtype = "scm+" # overridden by the command line
+server = 'localhost:1234'
+filterid = [12345678, "0x10"]
+onchange.fields = ["Consumption", "TamperPhy"]
+
+[unique]
+window = "15m"
+`
+	if err := ReadConfig(fs, strings.NewReader(config)); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, expt := range map[string]string{
+		"msgtype":         "idm",
+		"server":          "localhost:1234",
+		"unique.window":   (15 * time.Minute).String(),
+		"onchange.fields": "Consumption,TamperPhy",
+		"filterid":        "12345678,16",
+	} {
+		if recv := fs.Lookup(name).Value.String(); recv != expt {
+			t.Fatalf("%s: expected %q got %q\n", name, expt, recv)
+		}
+	}
+	if _, _, err := ids.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	for config, expt := range map[string]string{
+		"msgtyp = \"scm\"\n":              `line 1: unknown setting "msgtyp"`,
+		"[unique]\nwindw = \"1m\"\n":      `line 2: unknown setting "unique.windw"`,
+		"server = localhost\n":            "line 1: server: invalid value localhost, strings must be quoted",
+		"unique = true\nunique = false\n": `line 2: "unique" is already set`,
+		"unique.window = \"soon\"\n":      "line 1: unique.window:",
+	} {
+		fs, _ := newConfigFlagSet()
+		err := ReadConfig(fs, strings.NewReader(config))
+		if err == nil || !strings.HasPrefix(err.Error(), expt) {
+			t.Fatalf("%q: expected error %q got %v\n", config, expt, err)
+		}
+	}
+}
+
+func TestPrintConfig(t *testing.T) {
+	fs, _ := newConfigFlagSet()
+	if err := fs.Parse([]string{"-mqtt.password=hunter2", "-unique"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := PrintConfig(fs, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	recv := buf.String()
+	for _, expt := range []string{`mqtt.password = "<redacted>"`, "unique = true\n", `unique.window = "0s"`, `msgtype = "scm"`} {
+		if !strings.Contains(recv, expt) {
+			t.Fatalf("Expected %s in:\n%s\n", expt, recv)
+		}
+	}
+
+	// The printed configuration reads back.
+	fs2, _ := newConfigFlagSet()
+	if err := ReadConfig(fs2, strings.NewReader(recv)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEnvOverride(t *testing.T) {
+	env := map[string]string{
+		"RTLAMR_MSGTYPE":       "scm+",
+		"RTLAMR_UNIQUE_WINDOW": "1h",
+		"RTLAMR_FILTERID":      "1,2",
+		"RTLAMR_SERVER":        "localhost:1234",
+	}
+
+	fs, _ := newConfigFlagSet()
+	EnvOverride(fs, func(name string) string { return env[name] })
+	if err := fs.Parse([]string{"-server=remote:1234", "-filterid=3"}); err != nil {
+		t.Fatal(err)
+	}
+	EnvOverride(fs, func(name string) string { return env[name] })
+
+	for name, expt := range map[string]string{
+		"msgtype":       "scm+",
+		"unique.window": time.Hour.String(),
+		"server":        "remote:1234",
+		"filterid":      "3",
+	} {
+		if recv := fs.Lookup(name).Value.String(); recv != expt {
+			t.Fatalf("%s: expected %q got %q\n", name, expt, recv)
+		}
+	}
+
+	// Flags set by the environment are visited, so gain and filter flags
+	// given this way take effect.
+	visited := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		visited[f.Name] = true
+	})
+	if !visited["msgtype"] || !visited["unique.window"] {
+		t.Fatalf("Expected flags set by the environment to be visited got %v\n", visited)
+	}
+}
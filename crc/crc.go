@@ -1,7 +1,23 @@
+// Package crc implements the checksums used by ERT protocols: the BCH code
+// protecting SCM and the CRC-CCITT variant protecting SCM+ and IDM.
 package crc
 
 import "fmt"
 
+// Parameters of the checksums used by ERT protocols.
+const (
+	BCHPoly = 0x6F63
+
+	CCITTInit    = 0xFFFF
+	CCITTPoly    = 0x1021
+	CCITTResidue = 0x1D0F
+)
+
+var (
+	bchTable   = NewTable(BCHPoly)
+	ccittTable = NewTable(CCITTPoly)
+)
+
 type CRC struct {
 	Name    string
 	Init    uint16
@@ -21,6 +37,16 @@ func NewCRC(name string, init, poly, residue uint16) (crc CRC) {
 	return
 }
 
+// NewBCH returns the BCH code used by SCM.
+func NewBCH() CRC {
+	return CRC{"BCH", 0, BCHPoly, 0, bchTable}
+}
+
+// NewCCITT returns the CRC-CCITT variant used by SCM+ and IDM.
+func NewCCITT() CRC {
+	return CRC{"CCITT", CCITTInit, CCITTPoly, CCITTResidue, ccittTable}
+}
+
 func (crc CRC) String() string {
 	return fmt.Sprintf("{Name:%s Init:0x%04X Poly:0x%04X Residue:0x%04X}", crc.Name, crc.Init, crc.Poly, crc.Residue)
 }
@@ -29,6 +55,32 @@ func (crc CRC) Checksum(data []byte) uint16 {
 	return Checksum(crc.Init, data, crc.tbl)
 }
 
+// Valid reports whether data, including its trailing checksum, leaves the
+// expected residue.
+func (crc CRC) Valid(data []byte) bool {
+	return crc.Checksum(data) == crc.Residue
+}
+
+// Syndrome returns the checksum of the error pattern present in data,
+// including its trailing checksum. Valid data has a syndrome of 0.
+func (crc CRC) Syndrome(data []byte) uint16 {
+	return crc.Checksum(data) ^ crc.Residue
+}
+
+// BCH computes the BCH checksum of data with the given generator polynomial.
+func BCH(poly uint16, data []byte) uint16 {
+	tbl := bchTable
+	if poly != BCHPoly {
+		tbl = NewTable(poly)
+	}
+	return Checksum(0, data, tbl)
+}
+
+// CCITT computes the CRC-CCITT checksum of data.
+func CCITT(data []byte) uint16 {
+	return Checksum(CCITTInit, data, ccittTable)
+}
+
 type Table [256]uint16
 
 func NewTable(poly uint16) (table Table) {
@@ -53,3 +105,35 @@ func Checksum(init uint16, data []byte, table Table) (crc uint16) {
 	}
 	return
 }
+
+// SyndromeTable maps the syndrome of every single-bit error in a message of
+// fixed length to the index of the erroneous bit, MSB first.
+type SyndromeTable map[uint16]int
+
+// NewSyndromeTable computes the single-bit error syndromes of messages of
+// the given length in bytes, including the trailing checksum.
+func NewSyndromeTable(crc CRC, length int) SyndromeTable {
+	st := make(SyndromeTable, length<<3)
+
+	// Checksums are linear, so the syndrome of a corrupted message is the
+	// checksum of the error pattern alone with a zero initial value.
+	errVec := make([]byte, length)
+	for bit := 0; bit < length<<3; bit++ {
+		errVec[bit>>3] = 0x80 >> uint(bit&7)
+		st[Checksum(0, errVec, crc.tbl)] = bit
+		errVec[bit>>3] = 0
+	}
+
+	return st
+}
+
+// Correct flips the bit of data identified by syndrome. It reports whether
+// the syndrome corresponds to a correctable single-bit error.
+func (st SyndromeTable) Correct(data []byte, syndrome uint16) bool {
+	bit, ok := st[syndrome]
+	if !ok || bit>>3 >= len(data) {
+		return false
+	}
+	data[bit>>3] ^= 0x80 >> uint(bit&7)
+	return true
+}
@@ -71,3 +71,66 @@ func BenchmarkCCITT(b *testing.B) {
 func init() {
 	mrand.Seed(time.Now().UnixNano())
 }
+
+func TestNamedChecksums(t *testing.T) {
+	bch := NewCRC("BCH", 0, 0x6F63, 0)
+	ccitt := NewCRC("CCITT", 0xFFFF, 0x1021, 0x1D0F)
+
+	for trial := 0; trial < Trials; trial++ {
+		buf := make([]byte, mrand.Intn(96)+1)
+		crand.Read(buf)
+
+		if recv, expt := BCH(BCHPoly, buf), bch.Checksum(buf); recv != expt {
+			t.Fatalf("BCH: expected %04X got %04X\n", expt, recv)
+		}
+		if recv, expt := NewBCH().Checksum(buf), bch.Checksum(buf); recv != expt {
+			t.Fatalf("NewBCH: expected %04X got %04X\n", expt, recv)
+		}
+		if recv, expt := CCITT(buf), ccitt.Checksum(buf); recv != expt {
+			t.Fatalf("CCITT: expected %04X got %04X\n", expt, recv)
+		}
+		if recv, expt := NewCCITT().Checksum(buf), ccitt.Checksum(buf); recv != expt {
+			t.Fatalf("NewCCITT: expected %04X got %04X\n", expt, recv)
+		}
+	}
+}
+
+func TestCorrect(t *testing.T) {
+	for _, crc := range []CRC{NewBCH(), NewCCITT()} {
+		const length = 12
+
+		st := NewSyndromeTable(crc, length)
+		if len(st) != length<<3 {
+			t.Fatalf("%s: expected %d unique syndromes got %d\n", crc.Name, length<<3, len(st))
+		}
+
+		for trial := 0; trial < Trials; trial++ {
+			buf := make([]byte, length)
+			crand.Read(buf[:length-2])
+
+			// CCITT transmits the complement of the checksum.
+			checksum := crc.Checksum(buf[:length-2])
+			if crc.Residue != 0 {
+				checksum = ^checksum
+			}
+			binary.BigEndian.PutUint16(buf[length-2:], checksum)
+
+			if !crc.Valid(buf) {
+				t.Fatalf("%s: expected valid message %02X\n", crc.Name, buf)
+			}
+
+			expt := make([]byte, length)
+			copy(expt, buf)
+
+			bit := mrand.Intn(length << 3)
+			buf[bit>>3] ^= 0x80 >> uint(bit&7)
+
+			if crc.Valid(buf) {
+				t.Fatalf("%s: expected invalid message %02X\n", crc.Name, buf)
+			}
+			if !st.Correct(buf, crc.Syndrome(buf)) || !crc.Valid(buf) {
+				t.Fatalf("%s: failed to correct bit %d of %02X\n", crc.Name, bit, expt)
+			}
+		}
+	}
+}
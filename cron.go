@@ -0,0 +1,145 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSearchYears bounds the search for the next match of a cron expression,
+// so expressions which never match such as 0 0 30 2 * don't loop forever.
+const cronSearchYears = 5
+
+// Cron is a parsed cron expression of five fields: minute, hour, day of
+// month, month and day of week. Fields may be *, numbers, ranges, lists and
+// steps such as */15 or 1-5.
+type Cron struct {
+	minute, hour, dom, month, dow uint64 // Bit sets of matching values.
+
+	domAny, dowAny bool // Unrestricted day fields, see day.
+}
+
+// cronField describes the range of values a field may take.
+type cronField struct {
+	name     string
+	min, max int
+}
+
+var cronFields = []cronField{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+// ParseCron parses a five field cron expression.
+func ParseCron(expr string) (c Cron, err error) {
+	fields := strings.Fields(expr)
+	if len(fields) != len(cronFields) {
+		return c, fmt.Errorf("invalid cron expression %q, expected 5 fields: minute hour day month weekday", expr)
+	}
+
+	sets := []*uint64{&c.minute, &c.hour, &c.dom, &c.month, &c.dow}
+	for idx, field := range fields {
+		if *sets[idx], err = parseCronField(field, cronFields[idx]); err != nil {
+			return c, err
+		}
+	}
+
+	// Sunday may be given as either 0 or 7.
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+
+	c.domAny, c.dowAny = fields[2] == "*", fields[4] == "*"
+
+	return c, nil
+}
+
+func parseCronField(field string, f cronField) (set uint64, err error) {
+	for _, token := range strings.Split(field, ",") {
+		rng, step := token, 1
+		if idx := strings.Index(token, "/"); idx != -1 {
+			rng = token[:idx]
+			if step, err = strconv.Atoi(token[idx+1:]); err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid %s %q, expected a positive step", f.name, token)
+			}
+		}
+
+		lo, hi := f.min, f.max
+		if rng != "*" {
+			bounds := strings.SplitN(rng, "-", 2)
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("invalid %s %q", f.name, token)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("invalid %s %q", f.name, token)
+				}
+			} else if step != 1 {
+				hi = f.max
+			}
+		}
+		if lo < f.min || hi > f.max || lo > hi {
+			return 0, fmt.Errorf("invalid %s %q, expected values from %d to %d", f.name, token, f.min, f.max)
+		}
+
+		for v := lo; v <= hi; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+	return set, nil
+}
+
+// day returns true if the day of t matches. As in cron, if both day fields
+// are restricted a day matching either does.
+func (c Cron) day(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domAny || c.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// Next returns the first minute after t matching the expression, in t's
+// location. Returns the zero time if none does within a few years.
+func (c Cron) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(cronSearchYears, 0, 0)
+
+	for t.Before(limit) {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.day(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
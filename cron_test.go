@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCron(t *testing.T) {
+	at := func(day, hour, min int) time.Time {
+		// 2015-06-01 was a Monday.
+		return time.Date(2015, 6, day, hour, min, 0, 0, time.UTC)
+	}
+
+	for _, tc := range []struct {
+		Expr string
+		T    time.Time
+		Next time.Time
+	}{
+		{"0 9 * * *", at(1, 8, 59), at(1, 9, 0)},
+		{"0 9 * * *", at(1, 9, 0), at(2, 9, 0)},
+		{"*/15 * * * *", at(1, 9, 7), at(1, 9, 15)},
+		{"30 8-10/2 * * *", at(1, 9, 0), at(1, 10, 30)},
+		{"0 9 * * 6,7", at(1, 0, 0), at(6, 9, 0)},
+		{"0 9 * * 0", at(1, 0, 0), at(7, 9, 0)},
+		{"0 0 15 * 1", at(2, 0, 0), at(8, 0, 0)},
+		{"0 0 1 7 *", at(1, 0, 0), time.Date(2015, 7, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", at(1, 0, 0), time.Time{}},
+	} {
+		c, err := ParseCron(tc.Expr)
+		if err != nil {
+			t.Fatalf("%s: %s\n", tc.Expr, err)
+		}
+		if recv := c.Next(tc.T); !recv.Equal(tc.Next) {
+			t.Fatalf("%s after %s: expected %s got %s\n", tc.Expr, tc.T, tc.Next, recv)
+		}
+	}
+
+	for _, expr := range []string{"0 9 * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "a * * * *"} {
+		if _, err := ParseCron(expr); err == nil {
+			t.Fatalf("%s: expected error\n", expr)
+		}
+	}
+}
+
+func TestCronSchedule(t *testing.T) {
+	c, err := ParseCron("0 9 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := Schedule{Location: time.UTC, Cron: &c, CronDuration: 20 * time.Minute}
+
+	at := func(day, hour, min int) time.Time {
+		return time.Date(2015, 6, day, hour, min, 0, 0, time.UTC)
+	}
+
+	for _, step := range []struct {
+		T      time.Time
+		Active bool
+		Next   time.Time
+	}{
+		{at(1, 8, 0), false, at(1, 9, 0)},
+		{at(1, 9, 0), true, at(1, 9, 20)},
+		{at(1, 9, 19), true, at(1, 9, 20)},
+		{at(1, 9, 20), false, at(2, 9, 0)},
+	} {
+		if recv := s.Active(step.T); recv != step.Active {
+			t.Fatalf("%s: expected active %t got %t\n", step.T, step.Active, recv)
+		}
+		if recv := s.Next(step.T); !recv.Equal(step.Next) {
+			t.Fatalf("%s: expected next %s got %s\n", step.T, step.Next, recv)
+		}
+	}
+
+	// Overlapping captures are treated as one.
+	overlapping, err := ParseCron("*/15 9 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Cron = &overlapping
+	if recv := s.Next(at(1, 9, 5)); !recv.Equal(at(1, 10, 5)) {
+		t.Fatalf("Expected overlapping captures to end at %s got %s\n", at(1, 10, 5), recv)
+	}
+}
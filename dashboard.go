@@ -0,0 +1,87 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	_ "embed"
+	"time"
+
+	"github.com/bemasher/rtlamr/parse"
+)
+
+// dashboardSlots is the number of points of consumption history kept per
+// meter, spread evenly over -dashboard.history.
+const dashboardSlots = 96
+
+// dashboardHTML is served by -http.listen at /, it polls /meters.
+//
+//go:embed web/index.html
+var dashboardHTML []byte
+
+// HistoryPoint is a meter's consumption at a point in time.
+type HistoryPoint struct {
+	Time        time.Time
+	Consumption uint32
+}
+
+// MeterReading is the last message emitted for a meter, served by /meters.
+type MeterReading struct {
+	ID          uint32
+	MsgType     string
+	Name        string `json:",omitempty"` // Given by -aliases.
+	Consumption uint32
+	Time        time.Time
+	Count       uint64
+	History     []HistoryPoint `json:",omitempty"` // Oldest first.
+
+	last parse.LogMessage // Served by /api/meters/{id}.
+}
+
+// update records an emitted message, keeping the last reading in each of
+// dashboardSlots slots over the given period of history.
+func (r *MeterReading) update(msg parse.LogMessage, history time.Duration) {
+	t := msg.Time
+	r.ID, r.MsgType = msg.MeterID(), msg.MsgType()
+	if msg.MeterName != "" {
+		r.Name = msg.MeterName
+	}
+	r.Consumption, r.Time = msg.MeterConsumption(), t
+	r.Count++
+	r.last = msg
+
+	if history <= 0 {
+		return
+	}
+
+	point := HistoryPoint{t, r.Consumption}
+	slot := history / dashboardSlots
+	if n := len(r.History); n != 0 && r.History[n-1].Time.Truncate(slot).Equal(t.Truncate(slot)) {
+		r.History[n-1] = point
+	} else {
+		r.History = append(r.History, point)
+	}
+
+	// Drop points which have aged out, reusing the backing array so memory
+	// stays bounded by the number of slots.
+	drop := 0
+	for drop < len(r.History) && (t.Sub(r.History[drop].Time) > history || len(r.History)-drop > dashboardSlots) {
+		drop++
+	}
+	if drop != 0 {
+		r.History = append(r.History[:0], r.History[drop:]...)
+	}
+}
@@ -0,0 +1,340 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package dbus implements enough of the D-Bus wire protocol to own a name on
+// a message bus, emit signals and answer method calls. Only unix socket
+// transports, EXTERNAL authentication and basic types are supported.
+package dbus
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	busName      = "org.freedesktop.DBus"
+	busPath      = ObjectPath("/org/freedesktop/DBus")
+	busInterface = "org.freedesktop.DBus"
+)
+
+// Error is a D-Bus error reply.
+type Error struct {
+	Name    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return e.Name
+	}
+	return e.Name + ": " + e.Message
+}
+
+// Handler answers a method call with the body of its reply. Returning an
+// *Error replies with that error, other errors reply with
+// org.freedesktop.DBus.Error.Failed.
+type Handler func(call *Message) ([]interface{}, error)
+
+// Conn is a connection to a message bus. Emit is safe for concurrent use.
+type Conn struct {
+	conn net.Conn
+	r    *bufio.Reader
+
+	mu     sync.Mutex // Guards serial and writes.
+	serial uint32
+
+	// UniqueName is the name the bus assigned to the connection.
+	UniqueName string
+}
+
+// SessionBusAddress returns the address of the session bus.
+func SessionBusAddress() (string, error) {
+	if addr := os.Getenv("DBUS_SESSION_BUS_ADDRESS"); addr != "" {
+		return addr, nil
+	}
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return "unix:path=" + dir + "/bus", nil
+	}
+	return "", errors.New("dbus: session bus address unknown, DBUS_SESSION_BUS_ADDRESS isn't set")
+}
+
+// SystemBusAddress returns the address of the system bus.
+func SystemBusAddress() string {
+	if addr := os.Getenv("DBUS_SYSTEM_BUS_ADDRESS"); addr != "" {
+		return addr
+	}
+	return "unix:path=/var/run/dbus/system_bus_socket"
+}
+
+// Dial connects to the bus at address, authenticates and registers with it.
+// Addresses separated by semicolons are tried in turn.
+func Dial(address string) (*Conn, error) {
+	var errs []error
+	for _, addr := range strings.Split(address, ";") {
+		if addr == "" {
+			continue
+		}
+		network, path, err := parseAddress(addr)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		nc, err := net.Dial(network, path)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		c, err := NewConn(nc)
+		if err != nil {
+			nc.Close()
+			errs = append(errs, err)
+			continue
+		}
+		return c, nil
+	}
+	if len(errs) == 0 {
+		return nil, fmt.Errorf("dbus: no address in %q", address)
+	}
+	return nil, errors.Join(errs...)
+}
+
+// parseAddress returns the network and path to dial for a unix transport.
+func parseAddress(addr string) (network, path string, err error) {
+	transport, params, ok := strings.Cut(addr, ":")
+	if !ok || transport != "unix" {
+		return "", "", fmt.Errorf("dbus: unsupported address %q", addr)
+	}
+	for _, param := range strings.Split(params, ",") {
+		key, value, _ := strings.Cut(param, "=")
+		value, err := unescape(value)
+		if err != nil {
+			return "", "", err
+		}
+		switch key {
+		case "path":
+			return "unix", value, nil
+		case "abstract":
+			return "unix", "@" + value, nil
+		}
+	}
+	return "", "", fmt.Errorf("dbus: address %q has no path", addr)
+}
+
+// unescape decodes %xx escapes in an address value.
+func unescape(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+2 >= len(s) {
+			return "", fmt.Errorf("dbus: invalid escape in %q", s)
+		}
+		v, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", fmt.Errorf("dbus: invalid escape in %q", s)
+		}
+		b.WriteByte(byte(v))
+		i += 2
+	}
+	return b.String(), nil
+}
+
+// NewConn authenticates and registers with the bus over an established
+// connection.
+func NewConn(nc net.Conn) (*Conn, error) {
+	c := &Conn{conn: nc, r: bufio.NewReader(nc)}
+
+	uid := hex.EncodeToString([]byte(strconv.Itoa(os.Getuid())))
+	if _, err := fmt.Fprintf(nc, "\x00AUTH EXTERNAL %s\r\n", uid); err != nil {
+		return nil, err
+	}
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "OK ") {
+		return nil, fmt.Errorf("dbus: authentication rejected: %s", strings.TrimSpace(line))
+	}
+	if _, err := fmt.Fprint(nc, "BEGIN\r\n"); err != nil {
+		return nil, err
+	}
+
+	reply, err := c.call(&Message{
+		Type:        TypeMethodCall,
+		Path:        busPath,
+		Interface:   busInterface,
+		Member:      "Hello",
+		Destination: busName,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(reply.Body) != 1 {
+		return nil, errors.New("dbus: invalid reply to Hello")
+	}
+	c.UniqueName, _ = reply.Body[0].(string)
+
+	return c, nil
+}
+
+// Close closes the connection.
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+// send assigns msg a serial and writes it.
+func (c *Conn) send(msg *Message) (uint32, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.serial++
+	if c.serial == 0 {
+		c.serial++
+	}
+	msg.Serial = c.serial
+
+	buf, err := msg.marshal()
+	if err != nil {
+		return 0, err
+	}
+	_, err = c.conn.Write(buf)
+	return msg.Serial, err
+}
+
+// call sends a method call and reads messages until its reply, discarding
+// any others. It may only be used before Serve.
+func (c *Conn) call(msg *Message) (*Message, error) {
+	serial, err := c.send(msg)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		reply, err := readMessage(c.r)
+		if err != nil {
+			return nil, err
+		}
+		if reply.ReplySerial != serial {
+			continue
+		}
+		switch reply.Type {
+		case TypeMethodReturn:
+			return reply, nil
+		case TypeError:
+			e := &Error{Name: reply.ErrorName}
+			if len(reply.Body) != 0 {
+				e.Message, _ = reply.Body[0].(string)
+			}
+			return nil, e
+		}
+	}
+}
+
+// Name ownership replies to RequestName.
+const (
+	requestNamePrimaryOwner = 1
+	requestNameAlreadyOwner = 4
+)
+
+// RequestName claims name on the bus, failing if it's owned by another
+// connection. It may only be used before Serve.
+func (c *Conn) RequestName(name string) error {
+	const doNotQueue = 0x4
+	reply, err := c.call(&Message{
+		Type:        TypeMethodCall,
+		Path:        busPath,
+		Interface:   busInterface,
+		Member:      "RequestName",
+		Destination: busName,
+		Body:        []interface{}{name, uint32(doNotQueue)},
+	})
+	if err != nil {
+		return err
+	}
+	if len(reply.Body) != 1 {
+		return errors.New("dbus: invalid reply to RequestName")
+	}
+	switch reply.Body[0] {
+	case uint32(requestNamePrimaryOwner), uint32(requestNameAlreadyOwner):
+		return nil
+	}
+	return fmt.Errorf("dbus: %s is owned by another connection", name)
+}
+
+// Emit sends a signal.
+func (c *Conn) Emit(path ObjectPath, iface, member string, args ...interface{}) error {
+	_, err := c.send(&Message{
+		Type:      TypeSignal,
+		Path:      path,
+		Interface: iface,
+		Member:    member,
+		Body:      args,
+	})
+	return err
+}
+
+// Serve answers method calls with h until reading from the connection
+// fails. org.freedesktop.DBus.Peer is answered without h.
+func (c *Conn) Serve(h Handler) error {
+	for {
+		msg, err := readMessage(c.r)
+		if err != nil {
+			return err
+		}
+		if msg.Type != TypeMethodCall {
+			continue
+		}
+
+		var body []interface{}
+		switch {
+		case msg.Interface == "org.freedesktop.DBus.Peer" && msg.Member == "Ping":
+		case msg.Interface == "org.freedesktop.DBus.Peer" && msg.Member == "GetMachineId":
+			id, _ := os.ReadFile("/etc/machine-id")
+			body = []interface{}{strings.TrimSpace(string(id))}
+		default:
+			body, err = h(msg)
+		}
+
+		if msg.Flags&FlagNoReplyExpected != 0 {
+			continue
+		}
+		reply := &Message{
+			Type:        TypeMethodReturn,
+			ReplySerial: msg.Serial,
+			Destination: msg.Sender,
+			Body:        body,
+		}
+		if err != nil {
+			var e *Error
+			if !errors.As(err, &e) {
+				e = &Error{Name: "org.freedesktop.DBus.Error.Failed", Message: err.Error()}
+			}
+			reply.Type, reply.ErrorName = TypeError, e.Name
+			reply.Body = []interface{}{e.Message}
+		}
+		if _, err := c.send(reply); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package dbus
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	msg := &Message{
+		Type:        TypeSignal,
+		Serial:      7,
+		Path:        "/org/rtlamr/Receiver",
+		Interface:   "org.rtlamr.Receiver",
+		Member:      "ReadingReceived",
+		Destination: ":1.2",
+		Body: []interface{}{
+			uint32(12345678), "SCM", uint64(1234567), int64(-1), true,
+			byte(3), int16(-2), 1.5, ObjectPath("/a"), Signature("us"),
+		},
+	}
+	buf, err := msg.marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := readMessage(bytes.NewReader(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.Signature = "ustxbyndog"
+	if !reflect.DeepEqual(got, msg) {
+		t.Errorf("got %+v, want %+v", got, msg)
+	}
+}
+
+func TestMarshalHeader(t *testing.T) {
+	msg := &Message{Type: TypeMethodCall, Serial: 1, Member: "Ping"}
+	buf, err := msg.marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Fixed header, fields array of 16 bytes, member field padded to 8.
+	expt := []byte{
+		'l', 1, 0, 1, 0, 0, 0, 0, 1, 0, 0, 0, 13, 0, 0, 0,
+		3, 1, 's', 0, 4, 0, 0, 0, 'P', 'i', 'n', 'g', 0, 0, 0, 0,
+	}
+	if !bytes.Equal(buf, expt) {
+		t.Errorf("got  % x\nwant % x", buf, expt)
+	}
+}
+
+// fakeBus answers authentication, Hello and RequestName, then calls
+// GetLatest on the client and returns its reply.
+func fakeBus(t *testing.T, nc net.Conn, owner uint32) <-chan *Message {
+	replies := make(chan *Message, 1)
+	go func() {
+		defer close(replies)
+		r := bufio.NewReader(nc)
+
+		line, _ := r.ReadString('\n')
+		if !strings.HasPrefix(line, "\x00AUTH EXTERNAL ") {
+			t.Errorf("unexpected auth %q", line)
+			return
+		}
+		nc.Write([]byte("OK 0123456789abcdef\r\n"))
+		if line, _ := r.ReadString('\n'); line != "BEGIN\r\n" {
+			t.Errorf("unexpected %q, want BEGIN", line)
+			return
+		}
+
+		var serial uint32
+		send := func(msg *Message) {
+			serial++
+			msg.Serial = serial
+			buf, _ := msg.marshal()
+			nc.Write(buf)
+		}
+		for _, reply := range []interface{}{":1.42", owner} {
+			call, err := readMessage(r)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			send(&Message{Type: TypeSignal, Member: "NameAcquired", Body: []interface{}{"unrelated"}})
+			send(&Message{Type: TypeMethodReturn, ReplySerial: call.Serial, Body: []interface{}{reply}})
+		}
+
+		send(&Message{Type: TypeMethodCall, Path: "/obj", Member: "GetLatest", Body: []interface{}{uint32(1)}})
+		reply, err := readMessage(r)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		replies <- reply
+	}()
+	return replies
+}
+
+func TestConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	replies := fakeBus(t, server, requestNamePrimaryOwner)
+
+	c, err := NewConn(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.UniqueName != ":1.42" {
+		t.Errorf("unique name %q, want :1.42", c.UniqueName)
+	}
+	if err := c.RequestName("org.rtlamr.Test"); err != nil {
+		t.Fatal(err)
+	}
+
+	go c.Serve(func(call *Message) ([]interface{}, error) {
+		if call.Member != "GetLatest" || call.Body[0] != uint32(1) {
+			return nil, errors.New("unexpected call")
+		}
+		return []interface{}{"SCM", uint64(100)}, nil
+	})
+
+	reply := <-replies
+	if reply == nil {
+		t.FailNow()
+	}
+	if reply.Type != TypeMethodReturn || !reflect.DeepEqual(reply.Body, []interface{}{"SCM", uint64(100)}) {
+		t.Errorf("unexpected reply %+v", reply)
+	}
+}
+
+func TestRequestNameOwned(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	fakeBus(t, server, 3)
+
+	c, err := NewConn(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.RequestName("org.rtlamr.Test"); err == nil {
+		t.Error("expected an error for a name owned by another connection")
+	}
+}
+
+func TestParseAddress(t *testing.T) {
+	testCases := []struct {
+		addr, path string
+		ok         bool
+	}{
+		{"unix:path=/run/user/1000/bus", "/run/user/1000/bus", true},
+		{"unix:abstract=/tmp/dbus-abc,guid=123", "@/tmp/dbus-abc", true},
+		{"unix:path=/tmp/a%20b", "/tmp/a b", true},
+		{"tcp:host=localhost,port=1234", "", false},
+		{"unix:guid=123", "", false},
+	}
+	for _, tc := range testCases {
+		_, path, err := parseAddress(tc.addr)
+		if (err == nil) != tc.ok || path != tc.path {
+			t.Errorf("%q: got %q, %v", tc.addr, path, err)
+		}
+	}
+}
@@ -0,0 +1,447 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package dbus
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Type is the kind of a message.
+type Type byte
+
+const (
+	TypeMethodCall   Type = 1
+	TypeMethodReturn Type = 2
+	TypeError        Type = 3
+	TypeSignal       Type = 4
+)
+
+// FlagNoReplyExpected marks method calls the caller doesn't want a reply to.
+const FlagNoReplyExpected = 0x1
+
+// Header field codes.
+const (
+	fieldPath        = 1
+	fieldInterface   = 2
+	fieldMember      = 3
+	fieldErrorName   = 4
+	fieldReplySerial = 5
+	fieldDestination = 6
+	fieldSender      = 7
+	fieldSignature   = 8
+)
+
+// Messages, header and body together, may be at most 128MiB.
+const maxMessageLength = 1 << 27
+
+// ObjectPath is a value of D-Bus type o.
+type ObjectPath string
+
+// Signature is a value of D-Bus type g.
+type Signature string
+
+// Message is a D-Bus message. Bodies are limited to basic types: byte,
+// bool, int16, uint16, int32, uint32, int64, uint64, float64, string,
+// ObjectPath and Signature.
+type Message struct {
+	Type        Type
+	Flags       byte
+	Serial      uint32
+	Path        ObjectPath
+	Interface   string
+	Member      string
+	ErrorName   string
+	ReplySerial uint32
+	Destination string
+	Sender      string
+	Signature   Signature
+	Body        []interface{}
+}
+
+// marshal encodes msg in little endian byte order.
+func (msg *Message) marshal() ([]byte, error) {
+	body := &encoder{}
+	var sig []byte
+	for _, v := range msg.Body {
+		code, err := signatureOf(v)
+		if err != nil {
+			return nil, err
+		}
+		sig = append(sig, code)
+		body.value(v)
+	}
+
+	hdr := &encoder{}
+	hdr.buf = append(hdr.buf, 'l', byte(msg.Type), msg.Flags, 1)
+	hdr.uint32(uint32(len(body.buf)))
+	hdr.uint32(msg.Serial)
+
+	// Header fields are an array of (byte, variant) structs.
+	hdr.uint32(0)
+	lengthAt := len(hdr.buf) - 4
+	hdr.align(8)
+	start := len(hdr.buf)
+	field := func(code byte, sig byte, v interface{}) {
+		hdr.align(8)
+		hdr.buf = append(hdr.buf, code, 1, sig, 0)
+		hdr.value(v)
+	}
+	if msg.Path != "" {
+		field(fieldPath, 'o', msg.Path)
+	}
+	if msg.Interface != "" {
+		field(fieldInterface, 's', msg.Interface)
+	}
+	if msg.Member != "" {
+		field(fieldMember, 's', msg.Member)
+	}
+	if msg.ErrorName != "" {
+		field(fieldErrorName, 's', msg.ErrorName)
+	}
+	if msg.ReplySerial != 0 {
+		field(fieldReplySerial, 'u', msg.ReplySerial)
+	}
+	if msg.Destination != "" {
+		field(fieldDestination, 's', msg.Destination)
+	}
+	if msg.Sender != "" {
+		field(fieldSender, 's', msg.Sender)
+	}
+	if len(sig) != 0 {
+		field(fieldSignature, 'g', Signature(sig))
+	}
+	binary.LittleEndian.PutUint32(hdr.buf[lengthAt:], uint32(len(hdr.buf)-start))
+	hdr.align(8)
+
+	if len(hdr.buf)+len(body.buf) > maxMessageLength {
+		return nil, errors.New("dbus: message too long")
+	}
+	return append(hdr.buf, body.buf...), nil
+}
+
+// readMessage reads and decodes a message from r.
+func readMessage(r io.Reader) (*Message, error) {
+	fixed := make([]byte, 16)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, err
+	}
+
+	var order binary.ByteOrder
+	switch fixed[0] {
+	case 'l':
+		order = binary.LittleEndian
+	case 'B':
+		order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("dbus: invalid byte order %q", fixed[0])
+	}
+	if fixed[3] != 1 {
+		return nil, fmt.Errorf("dbus: unsupported protocol version %d", fixed[3])
+	}
+
+	bodyLen := uint64(order.Uint32(fixed[4:]))
+	fieldsLen := uint64(order.Uint32(fixed[12:]))
+	headerLen := (16 + fieldsLen + 7) &^ 7
+	if headerLen+bodyLen > maxMessageLength {
+		return nil, errors.New("dbus: message too long")
+	}
+
+	buf := make([]byte, headerLen+bodyLen)
+	copy(buf, fixed)
+	if _, err := io.ReadFull(r, buf[16:]); err != nil {
+		return nil, err
+	}
+
+	msg := &Message{
+		Type:   Type(fixed[1]),
+		Flags:  fixed[2],
+		Serial: order.Uint32(fixed[8:]),
+	}
+
+	d := &decoder{buf: buf[:16+fieldsLen], pos: 16, order: order}
+	for d.pos < len(d.buf) {
+		if err := d.align(8); err != nil {
+			return nil, err
+		}
+		code, err := d.value('y')
+		if err != nil {
+			return nil, err
+		}
+		v, err := d.variant()
+		if err != nil {
+			return nil, err
+		}
+
+		ok := true
+		switch code.(byte) {
+		case fieldPath:
+			msg.Path, ok = v.(ObjectPath)
+		case fieldInterface:
+			msg.Interface, ok = v.(string)
+		case fieldMember:
+			msg.Member, ok = v.(string)
+		case fieldErrorName:
+			msg.ErrorName, ok = v.(string)
+		case fieldReplySerial:
+			msg.ReplySerial, ok = v.(uint32)
+		case fieldDestination:
+			msg.Destination, ok = v.(string)
+		case fieldSender:
+			msg.Sender, ok = v.(string)
+		case fieldSignature:
+			msg.Signature, ok = v.(Signature)
+		}
+		if !ok {
+			return nil, fmt.Errorf("dbus: header field %d has the wrong type", code)
+		}
+	}
+
+	// Bodies with types we can't decode are left empty, the message can
+	// still be answered.
+	d = &decoder{buf: buf[headerLen:], order: order}
+	var body []interface{}
+	for i := 0; i < len(msg.Signature); i++ {
+		v, err := d.value(msg.Signature[i])
+		if err != nil {
+			body = nil
+			break
+		}
+		body = append(body, v)
+	}
+	msg.Body = body
+
+	return msg, nil
+}
+
+// signatureOf returns the type code of a basic value.
+func signatureOf(v interface{}) (byte, error) {
+	switch v.(type) {
+	case byte:
+		return 'y', nil
+	case bool:
+		return 'b', nil
+	case int16:
+		return 'n', nil
+	case uint16:
+		return 'q', nil
+	case int32:
+		return 'i', nil
+	case uint32:
+		return 'u', nil
+	case int64:
+		return 'x', nil
+	case uint64:
+		return 't', nil
+	case float64:
+		return 'd', nil
+	case string:
+		return 's', nil
+	case ObjectPath:
+		return 'o', nil
+	case Signature:
+		return 'g', nil
+	}
+	return 0, fmt.Errorf("dbus: unsupported type %T", v)
+}
+
+// encoder appends values to buf, which begins 8-byte aligned.
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) align(n int) {
+	for len(e.buf)%n != 0 {
+		e.buf = append(e.buf, 0)
+	}
+}
+
+func (e *encoder) uint32(v uint32) {
+	e.align(4)
+	e.buf = binary.LittleEndian.AppendUint32(e.buf, v)
+}
+
+func (e *encoder) value(v interface{}) {
+	switch v := v.(type) {
+	case byte:
+		e.buf = append(e.buf, v)
+	case bool:
+		if v {
+			e.uint32(1)
+		} else {
+			e.uint32(0)
+		}
+	case int16:
+		e.align(2)
+		e.buf = binary.LittleEndian.AppendUint16(e.buf, uint16(v))
+	case uint16:
+		e.align(2)
+		e.buf = binary.LittleEndian.AppendUint16(e.buf, v)
+	case int32:
+		e.uint32(uint32(v))
+	case uint32:
+		e.uint32(v)
+	case int64:
+		e.align(8)
+		e.buf = binary.LittleEndian.AppendUint64(e.buf, uint64(v))
+	case uint64:
+		e.align(8)
+		e.buf = binary.LittleEndian.AppendUint64(e.buf, v)
+	case float64:
+		e.value(math.Float64bits(v))
+	case string:
+		e.uint32(uint32(len(v)))
+		e.buf = append(append(e.buf, v...), 0)
+	case ObjectPath:
+		e.value(string(v))
+	case Signature:
+		e.buf = append(append(append(e.buf, byte(len(v))), v...), 0)
+	}
+}
+
+// decoder reads values from buf starting at pos, which is relative to an
+// 8-byte aligned position.
+type decoder struct {
+	buf   []byte
+	pos   int
+	order binary.ByteOrder
+}
+
+var errShort = errors.New("dbus: message truncated")
+
+func (d *decoder) align(n int) error {
+	d.pos = (d.pos + n - 1) / n * n
+	if d.pos > len(d.buf) {
+		return errShort
+	}
+	return nil
+}
+
+func (d *decoder) next(n int) ([]byte, error) {
+	if d.pos+n > len(d.buf) {
+		return nil, errShort
+	}
+	b := d.buf[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+func (d *decoder) fixed(n int) ([]byte, error) {
+	if err := d.align(n); err != nil {
+		return nil, err
+	}
+	return d.next(n)
+}
+
+func (d *decoder) string(lengthSize int) (string, error) {
+	var n int
+	if lengthSize == 1 {
+		b, err := d.next(1)
+		if err != nil {
+			return "", err
+		}
+		n = int(b[0])
+	} else {
+		b, err := d.fixed(4)
+		if err != nil {
+			return "", err
+		}
+		n = int(d.order.Uint32(b))
+	}
+	if n < 0 || n > len(d.buf) {
+		return "", errShort
+	}
+	b, err := d.next(n + 1)
+	if err != nil {
+		return "", err
+	}
+	return string(b[:n]), nil
+}
+
+// value decodes a value of the given basic type code.
+func (d *decoder) value(code byte) (interface{}, error) {
+	switch code {
+	case 'y':
+		b, err := d.next(1)
+		if err != nil {
+			return nil, err
+		}
+		return b[0], nil
+	case 'b':
+		b, err := d.fixed(4)
+		if err != nil {
+			return nil, err
+		}
+		return d.order.Uint32(b) != 0, nil
+	case 'n', 'q':
+		b, err := d.fixed(2)
+		if err != nil {
+			return nil, err
+		}
+		if code == 'n' {
+			return int16(d.order.Uint16(b)), nil
+		}
+		return d.order.Uint16(b), nil
+	case 'i', 'u':
+		b, err := d.fixed(4)
+		if err != nil {
+			return nil, err
+		}
+		if code == 'i' {
+			return int32(d.order.Uint32(b)), nil
+		}
+		return d.order.Uint32(b), nil
+	case 'x', 't', 'd':
+		b, err := d.fixed(8)
+		if err != nil {
+			return nil, err
+		}
+		switch code {
+		case 'x':
+			return int64(d.order.Uint64(b)), nil
+		case 'd':
+			return math.Float64frombits(d.order.Uint64(b)), nil
+		}
+		return d.order.Uint64(b), nil
+	case 's':
+		return d.string(4)
+	case 'o':
+		s, err := d.string(4)
+		return ObjectPath(s), err
+	case 'g':
+		s, err := d.string(1)
+		return Signature(s), err
+	case 'v':
+		return d.variant()
+	}
+	return nil, fmt.Errorf("dbus: unsupported type code %q", code)
+}
+
+// variant decodes a variant holding a basic value.
+func (d *decoder) variant() (interface{}, error) {
+	sig, err := d.string(1)
+	if err != nil {
+		return nil, err
+	}
+	if len(sig) != 1 {
+		return nil, fmt.Errorf("dbus: unsupported variant type %q", sig)
+	}
+	return d.value(sig[0])
+}
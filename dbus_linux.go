@@ -0,0 +1,250 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bemasher/rtlamr/dbus"
+	"github.com/bemasher/rtlamr/lru"
+	"github.com/bemasher/rtlamr/parse"
+)
+
+const (
+	dbusName      = "org.rtlamr.Receiver"
+	dbusPath      = dbus.ObjectPath("/org/rtlamr/Receiver")
+	dbusInterface = "org.rtlamr.Receiver"
+)
+
+// Number of meters whose last reading is kept for GetLatest.
+const dbusMaxMeters = 10000
+
+// Signals queued while the bus is slow, further signals are dropped.
+const dbusQueueLength = 64
+
+const dbusIntrospection = `<!DOCTYPE node PUBLIC "-//freedesktop//DTD D-BUS Object Introspection 1.0//EN"
+ "http://www.freedesktop.org/standards/dbus/1.0/introspect.dtd">
+<node>
+  <interface name="org.rtlamr.Receiver">
+    <signal name="ReadingReceived">
+      <arg name="meterID" type="u"/>
+      <arg name="proto" type="s"/>
+      <arg name="consumption" type="t"/>
+      <arg name="timestamp" type="x"/>
+      <arg name="json" type="s"/>
+    </signal>
+    <method name="GetLatest">
+      <arg name="meterID" type="u" direction="in"/>
+      <arg name="proto" type="s" direction="out"/>
+      <arg name="consumption" type="t" direction="out"/>
+      <arg name="timestamp" type="x" direction="out"/>
+      <arg name="json" type="s" direction="out"/>
+    </method>
+  </interface>
+  <interface name="org.freedesktop.DBus.Introspectable">
+    <method name="Introspect">
+      <arg name="data" type="s" direction="out"/>
+    </method>
+  </interface>
+  <interface name="org.freedesktop.DBus.Peer">
+    <method name="Ping"/>
+    <method name="GetMachineId">
+      <arg name="machine_uuid" type="s" direction="out"/>
+    </method>
+  </interface>
+</node>
+`
+
+// DBusService owns org.rtlamr.Receiver on the session or system bus, emits
+// ReadingReceived for each message written to the output and answers
+// GetLatest with the last reading of a meter. Losing the bus doesn't affect
+// the receiver, the service reconnects with backoff and signals emitted in
+// the meantime are dropped. A nil service does nothing.
+type DBusService struct {
+	System bool // Use the system bus rather than the session bus.
+
+	policy  RetryPolicy
+	signals chan []interface{}
+
+	mu     sync.Mutex
+	latest *lru.Cache // Signal arguments keyed by meter id.
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func NewDBusService(system bool, policy RetryPolicy) (*DBusService, error) {
+	return &DBusService{
+		System:  system,
+		policy:  policy,
+		signals: make(chan []interface{}, dbusQueueLength),
+		latest:  lru.New(dbusMaxMeters),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}, nil
+}
+
+// Reading records msg as the latest reading of its meter and emits it.
+func (ds *DBusService) Reading(msg parse.LogMessage) {
+	if ds == nil {
+		return
+	}
+
+	buf, err := json.Marshal(msg)
+	if err != nil {
+		slog.Debug("dbus: encoding reading", "err", err)
+		return
+	}
+	args := []interface{}{
+		msg.MeterID(),
+		msg.MsgType(),
+		uint64(msg.MeterConsumption()),
+		msg.Time.Unix(),
+		string(buf),
+	}
+
+	ds.mu.Lock()
+	ds.latest.Add(msg.MeterID(), args)
+	ds.mu.Unlock()
+
+	select {
+	case ds.signals <- args:
+	default:
+	}
+}
+
+// Start connects to the bus and serves until Close is called.
+func (ds *DBusService) Start() {
+	if ds == nil {
+		return
+	}
+	go ds.run()
+}
+
+// Close releases the bus name and disconnects. The service must have been
+// started.
+func (ds *DBusService) Close() {
+	if ds == nil {
+		return
+	}
+	close(ds.stop)
+	<-ds.done
+}
+
+func (ds *DBusService) run() {
+	defer close(ds.done)
+
+	bus := "session"
+	if ds.System {
+		bus = "system"
+	}
+	connecting := retrier{Op: "dbus: connecting to the " + bus + " bus", Policy: ds.policy}
+
+	for {
+		conn, err := ds.connect()
+		if err == nil {
+			slog.Info("dbus: serving "+dbusName, "bus", bus)
+			connecting.Succeed()
+			err = ds.serve(conn)
+			conn.Close()
+			if err == nil {
+				return
+			}
+			slog.Warn("dbus: lost connection to the "+bus+" bus", "err", err)
+		}
+		connecting.Fail(err)
+
+		select {
+		case <-time.After(connecting.Backoff()):
+		case <-ds.stop:
+			return
+		}
+	}
+}
+
+func (ds *DBusService) connect() (*dbus.Conn, error) {
+	addr := dbus.SystemBusAddress()
+	if !ds.System {
+		var err error
+		if addr, err = dbus.SessionBusAddress(); err != nil {
+			return nil, err
+		}
+	}
+
+	conn, err := dbus.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.RequestName(dbusName); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// serve emits queued signals and answers method calls until the connection
+// fails, returning its error, or until Close is called.
+func (ds *DBusService) serve(conn *dbus.Conn) error {
+	served := make(chan error, 1)
+	go func() {
+		served <- conn.Serve(ds.handle)
+	}()
+
+	for {
+		select {
+		case args := <-ds.signals:
+			if err := conn.Emit(dbusPath, dbusInterface, "ReadingReceived", args...); err != nil {
+				return err
+			}
+		case err := <-served:
+			return err
+		case <-ds.stop:
+			return nil
+		}
+	}
+}
+
+// handle answers method calls on the bus.
+func (ds *DBusService) handle(call *dbus.Message) ([]interface{}, error) {
+	switch {
+	case call.Interface == "org.freedesktop.DBus.Introspectable" && call.Member == "Introspect":
+		return []interface{}{dbusIntrospection}, nil
+	case call.Path != dbusPath:
+		return nil, &dbus.Error{Name: "org.freedesktop.DBus.Error.UnknownObject", Message: "no object at " + string(call.Path)}
+	case (call.Interface == dbusInterface || call.Interface == "") && call.Member == "GetLatest":
+		if call.Signature != "u" || len(call.Body) != 1 {
+			return nil, &dbus.Error{Name: "org.freedesktop.DBus.Error.InvalidArgs", Message: "expected a meter id of type u"}
+		}
+		id := call.Body[0].(uint32)
+
+		ds.mu.Lock()
+		args, ok := ds.latest.Get(id)
+		ds.mu.Unlock()
+		if !ok {
+			return nil, &dbus.Error{Name: dbusInterface + ".Error.UnknownMeter", Message: "no reading from meter " + strconv.FormatUint(uint64(id), 10)}
+		}
+		return args.([]interface{})[1:], nil
+	}
+	return nil, &dbus.Error{Name: "org.freedesktop.DBus.Error.UnknownMethod", Message: "unknown method " + call.Interface + "." + call.Member}
+}
@@ -0,0 +1,37 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+
+	"github.com/bemasher/rtlamr/parse"
+)
+
+// DBusService isn't available on this platform.
+type DBusService struct{}
+
+func NewDBusService(system bool, policy RetryPolicy) (*DBusService, error) {
+	return nil, errors.New("only supported on Linux")
+}
+
+func (ds *DBusService) Reading(msg parse.LogMessage) {}
+func (ds *DBusService) Start()                       {}
+func (ds *DBusService) Close()                       {}
@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"log"
 	"math"
+	"time"
 )
 
 // PacketConfig specifies packet-specific radio configuration.
@@ -72,10 +73,6 @@ func (d Decoder) Log() {
 			log.Println("Warning: decimated symbol length is non-integral, sensitivity may be poor")
 		}
 
-		if d.DecCfg.ChipLength < 3 {
-			log.Fatal("Error: illegal decimation factor, choose a smaller factor")
-		}
-
 		return
 	}
 
@@ -110,6 +107,34 @@ type Decoder struct {
 	preambleFinder *byteFinder
 
 	pkt []byte
+
+	timing *timing // Shared by copies of the decoder.
+}
+
+// Stages accumulates the time spent in each stage of decoding, for
+// benchmarking. Filter includes the bit decision and Search transposing the
+// quantized signal. Parse is left to the caller, parsers follow decoding.
+type Stages struct {
+	Magnitude, Filter, Search, Parse time.Duration
+}
+
+type timing struct {
+	stages *Stages
+}
+
+// Instrument accumulates the time each stage of decoding takes in s, or stops
+// if s is nil. Uninstrumented decoders cost a nil check per stage.
+func (d Decoder) Instrument(s *Stages) {
+	if d.timing != nil {
+		d.timing.stages = s
+	}
+}
+
+// lap adds the time since mark to stage, returning the time it ended.
+func lap(stage *time.Duration, mark time.Time) time.Time {
+	now := time.Now()
+	*stage += now.Sub(mark)
+	return now
 }
 
 // Create a new decoder with the given packet configuration.
@@ -163,29 +188,47 @@ func NewDecoder(cfg PacketConfig, decimation int) (d Decoder) {
 	// store packed version 8-bits per byte.
 	d.pkt = make([]byte, (d.DecCfg.PacketSymbols+7)>>3)
 
+	d.timing = new(timing)
+
 	return
 }
 
 // Decode accepts a sample block and performs various DSP techniques to extract a packet.
 func (d Decoder) Decode(input []byte) []int {
+	var stages *Stages
+	var mark time.Time
+	if d.timing != nil && d.timing.stages != nil {
+		stages, mark = d.timing.stages, time.Now()
+	}
+
 	// Shift buffers to append new block.
 	copy(d.Signal, d.Signal[d.DecCfg.BlockSize:])
 	copy(d.Quantized, d.Quantized[d.DecCfg.BlockSize:])
 
 	// Compute the magnitude of the new block.
 	d.demod.Execute(input, d.Signal[d.DecCfg.SymbolLength:])
+	if stages != nil {
+		mark = lap(&stages.Magnitude, mark)
+	}
 
 	// Perform matched filter on new block.
 	d.Filter(d.Signal, d.Filtered)
 
 	// Perform bit-decision on new block.
 	Quantize(d.Filtered, d.Quantized[d.DecCfg.PacketLength:])
+	if stages != nil {
+		mark = lap(&stages.Filter, mark)
+	}
 
 	// Pack the quantized signal into slices for searching.
 	d.Transpose(d.Quantized)
 
 	// Return a list of indexes the preamble exists at.
-	return d.Search()
+	indices := d.Search()
+	if stages != nil {
+		lap(&stages.Search, mark)
+	}
+	return indices
 }
 
 // A Demodulator knows how to demodulate an array of uint8 IQ samples into an
@@ -83,3 +83,24 @@ func BenchmarkDecode(b *testing.B) {
 		_ = d.Decode(block)
 	}
 }
+
+func TestInstrument(t *testing.T) {
+	d := NewDecoder(NewPacketConfig(72), 1)
+	input := make([]byte, d.DecCfg.BlockSize2)
+
+	// Copies of the decoder, as parsers return, share instrumentation.
+	var s Stages
+	copied := d
+	copied.Instrument(&s)
+	d.Decode(input)
+	if s.Magnitude <= 0 || s.Filter <= 0 || s.Search <= 0 {
+		t.Fatalf("unexpected stage times %+v", s)
+	}
+
+	d.Instrument(nil)
+	before := s
+	d.Decode(input)
+	if s != before {
+		t.Errorf("stages changed after instrumentation stopped")
+	}
+}
@@ -0,0 +1,91 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+
+	"github.com/bemasher/rtlamr/parse"
+)
+
+func init() {
+	// Types written besides messages, see parse.GobRecord.
+	gob.RegisterName("Merged", MergedMessage{})
+	gob.RegisterName("Alert", Alert{})
+	gob.RegisterName("IntervalRecord", IntervalRecord{})
+}
+
+// runDecodeGob converts logs written with -format=gob to json, one value per
+// line on stdout.
+func runDecodeGob(args []string) int {
+	fs := newSubcommandFlags("decode-gob", "file ...")
+	if status, exit := parseSubcommandFlags(fs, args); exit {
+		return status
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	enc := json.NewEncoder(stdoutWriter{})
+	for _, name := range fs.Args() {
+		if status, err := decodeGob(name, enc); err != nil {
+			log.Printf("decode-gob: %s: %s\n", name, err)
+			return status
+		}
+	}
+	return exitOK
+}
+
+// decodeGob writes the values of the named gob log, or stdin given -, to enc.
+// A log ending part way through a record, as when rtlamr was killed while
+// writing it, is decoded up to that record. Returns the exit status.
+func decodeGob(name string, enc Encoder) (int, error) {
+	var r io.Reader = os.Stdin
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return exitUsage, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	gr := parse.NewGobReader(r)
+	for {
+		record, err := gr.Read()
+		if err == io.EOF {
+			return exitOK, nil
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			slog.Warn("gob log ends part way through a record", "file", name)
+			return exitOK, nil
+		}
+		if err != nil {
+			return exitFatal, err
+		}
+		if err := enc.Encode(record.Value); err != nil {
+			return exitOutput, err
+		}
+	}
+}
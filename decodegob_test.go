@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bemasher/rtlamr/idm"
+	"github.com/bemasher/rtlamr/parse"
+	"github.com/bemasher/rtlamr/r900"
+	"github.com/bemasher/rtlamr/scm"
+	"github.com/bemasher/rtlamr/scmplus"
+)
+
+func TestDecodeGob(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	scaled := 12.5
+
+	var history idm.Interval
+	history[0] = 17
+
+	values := map[string]interface{}{
+		"SCM":      parse.LogMessage{Time: now, Message: scm.SCM{ID: 12345678, Type: 7, Consumption: 1000}},
+		"SCM+":     parse.LogMessage{Time: now, ScaledConsumption: &scaled, Unit: "kWh", Message: scmplus.SCM{EndpointID: 23456789, EndpointType: 156}},
+		"IDM":      parse.LogMessage{Time: now, Message: idm.IDM{ERTSerialNumber: 34567890, TamperCounters: []byte{1, 2, 3, 4, 5, 6}, DifferentialConsumptionIntervals: history}},
+		"R900":     parse.LogMessage{Time: now, Message: r900.R900{ID: 45678901, Consumption: 2000, Leak: 2}},
+		"Extended": parse.LogMessage{Time: now, Message: r900.R900Extended{R900: r900.R900{ID: 45678901}, Experimental: []r900.ExtendedValue{{Name: "ExpTamper", Offset: 72, Length: 2, Value: 1}}, Payload: "00"}},
+		"Merged": parse.LogMessage{Time: now, Message: MergedMessage{Trigger: "SCM", ID: 12345678, Protocols: []ProtocolState{
+			{MsgType: "SCM", LastSeen: now, Message: scm.SCM{ID: 12345678}},
+			{MsgType: "IDM", LastSeen: now, Message: idm.IDM{ERTSerialNumber: 12345678}},
+		}}},
+		"Alert":    Alert{Time: now, Alert: "leak", Source: "flow", MsgType: "SCM", ID: 12345678, Since: now},
+		"Interval": IntervalRecord{Time: now, MsgType: "IDM", ID: 34567890, Count: 3, Consumption: 17},
+	}
+	mixture := []string{"SCM", "IDM", "Alert", "SCM+", "R900", "Merged", "Extended", "Interval", "SCM"}
+
+	roundTrip := func(t *testing.T, names []string) {
+		t.Helper()
+
+		var log, expt bytes.Buffer
+		gobEnc := parse.NewGobEncoder(&log)
+		jsonEnc := json.NewEncoder(&expt)
+		for _, name := range names {
+			if err := gobEnc.Encode(values[name]); err != nil {
+				t.Fatal(err)
+			}
+			if err := jsonEnc.Encode(values[name]); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		file := filepath.Join(t.TempDir(), "log.gob")
+		if err := os.WriteFile(file, log.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		var recv bytes.Buffer
+		if status, err := decodeGob(file, json.NewEncoder(&recv)); err != nil || status != exitOK {
+			t.Fatalf("Expected status %d got %d: %v\n", exitOK, status, err)
+		}
+		if recv.String() != expt.String() {
+			t.Fatalf("Expected:\n%s\ngot:\n%s\n", expt.String(), recv.String())
+		}
+	}
+
+	for name := range values {
+		t.Run(name, func(t *testing.T) {
+			roundTrip(t, []string{name})
+		})
+	}
+	t.Run("Mixture", func(t *testing.T) {
+		roundTrip(t, mixture)
+	})
+}
+
+func TestDecodeGobSubcommand(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping gob subcommand tests in short mode")
+	}
+
+	dir := t.TempDir()
+	server := fakeRTLTCP(t, scmSignal(t))
+
+	// Gob isn't written to stdout without -gobunsafe.
+	args := []string{"-summary=false", "-format=gob", "-server=" + server, "-msglimit=1"}
+	if status := runRtlamr(t, nil, args...); status != exitUsage {
+		t.Fatalf("Expected status %d, got %d\n", exitUsage, status)
+	}
+
+	// Two runs appending to the same log.
+	log := filepath.Join(dir, "log.gob")
+	for run := 0; run < 2; run++ {
+		args := []string{"-summary=false", "-format=gob", "-server=" + server, "-logfile=" + log, "-msglimit=2", "-duration=10s"}
+		if status := runRtlamr(t, nil, args...); status != exitOK {
+			t.Fatalf("Expected status %d, got %d\n", exitOK, status)
+		}
+	}
+
+	stdout, err := os.Create(filepath.Join(dir, "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdout.Close()
+	if status := runRtlamr(t, stdout, "decode-gob", log); status != exitOK {
+		t.Fatalf("Expected status %d, got %d\n", exitOK, status)
+	}
+
+	if _, err := stdout.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	var lines int
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		lines++
+		if !strings.HasPrefix(scanner.Text(), `{"MsgType":"SCM",`) {
+			t.Fatalf("Expected an SCM message, got %s\n", scanner.Text())
+		}
+	}
+	if lines != 4 {
+		t.Fatalf("Expected 4 messages, got %d\n", lines)
+	}
+}
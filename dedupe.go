@@ -0,0 +1,98 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"time"
+
+	"github.com/bemasher/rtlamr/lru"
+	"github.com/bemasher/rtlamr/parse"
+)
+
+// CrossProtoFilter drops messages reporting the same consumption as a message
+// of another type emitted by the same meter within Window. Meters sending
+// both SCM and SCM+ or IDM report each reading more than once.
+type CrossProtoFilter struct {
+	Window time.Duration
+
+	last       *lru.Cache // []crossProtoEntry keyed by id truncated to SCM's width.
+	now        func() time.Time
+	suppressed uint64
+}
+
+type crossProtoEntry struct {
+	ID          uint32
+	MsgType     string
+	Consumption uint32
+	Emitted     time.Time
+}
+
+func NewCrossProtoFilter(window time.Duration, maxMeters int) *CrossProtoFilter {
+	return &CrossProtoFilter{
+		Window: window,
+		last:   lru.New(maxMeters),
+		now:    time.Now,
+	}
+}
+
+// Suppressed returns the number of messages dropped as duplicates.
+func (cp *CrossProtoFilter) Suppressed() uint64 {
+	return cp.suppressed
+}
+
+// sameMeter returns true if e and msg, whose ids agree in their lower 26 bits,
+// came from the same meter. SCM truncates ids to 26 bits, so only the
+// truncated ids can be compared against it.
+func (e crossProtoEntry) sameMeter(msg parse.Message) bool {
+	return e.MsgType == "SCM" || msg.MsgType() == "SCM" || e.ID == msg.MeterID()
+}
+
+func (cp *CrossProtoFilter) Stateful() {}
+
+func (cp *CrossProtoFilter) Filter(msg parse.Message) bool {
+	// Packets with bad checksums don't carry trustworthy values.
+	if !msg.ChecksumOK() {
+		return true
+	}
+
+	key := msg.MeterID() & (1<<idBits["SCM"] - 1)
+	now := cp.now()
+
+	var entries []crossProtoEntry
+	if v, ok := cp.last.Get(key); ok {
+		entries = v.([]crossProtoEntry)
+	}
+
+	for _, e := range entries {
+		if e.MsgType != msg.MsgType() && e.Consumption == msg.MeterConsumption() &&
+			now.Sub(e.Emitted) < cp.Window && e.sameMeter(msg) {
+			cp.suppressed++
+			return false
+		}
+	}
+
+	// Replace this meter and message type's entry, dropping expired ones.
+	next := []crossProtoEntry{{msg.MeterID(), msg.MsgType(), msg.MeterConsumption(), now}}
+	for _, e := range entries {
+		if (e.ID != msg.MeterID() || e.MsgType != msg.MsgType()) && now.Sub(e.Emitted) < cp.Window {
+			next = append(next, e)
+		}
+	}
+	cp.last.Add(key, next)
+
+	return true
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bemasher/rtlamr/idm"
+	"github.com/bemasher/rtlamr/parse"
+	"github.com/bemasher/rtlamr/scm"
+	"github.com/bemasher/rtlamr/scmplus"
+)
+
+func TestCrossProtoFilter(t *testing.T) {
+	now := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	cp := NewCrossProtoFilter(time.Minute, 0)
+	cp.now = func() time.Time { return now }
+
+	// SCM carries the lower 26 bits of the SCM+ endpoint id.
+	const id = 0x1C000001
+	scmMsg := scm.SCM{ID: id & (1<<26 - 1), Consumption: 100}
+	scmPlus := scmplus.SCM{EndpointID: id, Consumption: 100}
+	otherPlus := scmplus.SCM{EndpointID: 0x2C000001, Consumption: 100}
+	idmMsg := idm.IDM{ERTSerialNumber: 0x2C000001, LastConsumptionCount: 100}
+
+	for idx, step := range []struct {
+		Elapsed time.Duration
+		Msg     parse.Message
+		Expt    bool
+	}{
+		{0, scmMsg, true},
+		{time.Second, scmPlus, false},   // Same reading, truncated id.
+		{time.Second, scmMsg, true},     // Same type is left to -unique.
+		{time.Second, otherPlus, false}, // Also matches SCM's truncated id.
+		{time.Second, scmplus.SCM{EndpointID: id, Consumption: 101}, true}, // New reading.
+		{2 * time.Minute, scmPlus, true},                                   // Window expired.
+		{time.Second, idmMsg, true},                                        // Full ids compared between SCM+ and IDM.
+		{time.Second, idm.IDM{ERTSerialNumber: id, LastConsumptionCount: 100}, false},
+	} {
+		now = now.Add(step.Elapsed)
+		if recv := cp.Filter(step.Msg); recv != step.Expt {
+			t.Fatalf("Step %d: expected %t got %t\n", idx, step.Expt, recv)
+		}
+	}
+
+	if recv := cp.Suppressed(); recv != 3 {
+		t.Fatalf("Expected 3 suppressed got %d\n", recv)
+	}
+}
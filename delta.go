@@ -0,0 +1,136 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"time"
+
+	"github.com/bemasher/rtlamr/lru"
+	"github.com/bemasher/rtlamr/parse"
+)
+
+// DeltaTracker remembers the last reading of each meter and fills in the
+// change in consumption and the rate of use since then.
+type DeltaTracker struct {
+	// R900BCD is set when R900 consumption is decoded as BCD, which wraps
+	// at 999999 rather than at 24 bits.
+	R900BCD bool
+
+	last *lru.Cache // deltaEntry keyed by uniqueKey.
+}
+
+type deltaEntry struct {
+	Consumption uint32
+	Time        time.Time
+}
+
+// DeltaState is the last reading -delta saw from a meter.
+type DeltaState struct {
+	ID          uint32
+	MsgType     string
+	Consumption uint32
+	Time        time.Time
+}
+
+func NewDeltaTracker(maxMeters int) *DeltaTracker {
+	return &DeltaTracker{last: lru.New(maxMeters)}
+}
+
+// Len returns the number of meters tracked.
+func (dt *DeltaTracker) Len() int {
+	return dt.last.Len()
+}
+
+// Snapshot returns the last reading of every tracked meter from least to
+// most recently heard.
+func (dt *DeltaTracker) Snapshot() (states []DeltaState) {
+	dt.last.Range(func(key, value interface{}) {
+		k, v := key.(uniqueKey), value.(deltaEntry)
+		states = append(states, DeltaState{k.ID, k.MsgType, v.Consumption, v.Time})
+	})
+	return
+}
+
+// Restore adds readings from a previous Snapshot.
+func (dt *DeltaTracker) Restore(states []DeltaState) {
+	for _, s := range states {
+		dt.last.Add(uniqueKey{s.ID, s.MsgType}, deltaEntry{s.Consumption, s.Time})
+	}
+}
+
+// modulus returns the value at which the consumption counter of msgType
+// wraps to zero.
+func (dt *DeltaTracker) modulus(msgType string) uint64 {
+	switch msgType {
+	case "SCM":
+		return 1 << 24
+	case "R900":
+		if dt.R900BCD {
+			return 1000000
+		}
+		return 1 << 24
+	}
+	return 1 << 32
+}
+
+// delta returns the change from prev to next. A decrease is taken as the
+// counter wrapping only if the wrapped change is less than half the
+// counter's range, anything else is more likely a replaced or reset meter
+// and ok is false.
+func (dt *DeltaTracker) delta(msgType string, prev, next uint32) (delta int64, ok bool) {
+	if next >= prev {
+		return int64(next - prev), true
+	}
+
+	mod := dt.modulus(msgType)
+	wrapped := mod - uint64(prev) + uint64(next)
+	if uint64(prev) >= mod || wrapped >= mod/2 {
+		return 0, false
+	}
+	return int64(wrapped), true
+}
+
+// Apply sets the Delta and Rate fields of msg from the meter's previous
+// reading and remembers this one. Neither is set for the first reading of
+// a meter, after a reset and for packets with bad checksums. Rate is only
+// set if time has passed since the previous reading.
+func (dt *DeltaTracker) Apply(msg *parse.LogMessage) {
+	if !msg.Message.ChecksumOK() {
+		return
+	}
+
+	key := uniqueKey{msg.MeterID(), msg.MsgType()}
+	consumption := msg.MeterConsumption()
+
+	v, ok := dt.last.Get(key)
+	dt.last.Add(key, deltaEntry{consumption, msg.Time})
+	if !ok {
+		return
+	}
+	prev := v.(deltaEntry)
+
+	delta, ok := dt.delta(msg.MsgType(), prev.Consumption, consumption)
+	if !ok {
+		return
+	}
+	msg.Delta = &delta
+
+	if elapsed := msg.Time.Sub(prev.Time); elapsed > 0 {
+		rate := float64(delta) / elapsed.Hours()
+		msg.Rate = &rate
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bemasher/rtlamr/parse"
+	"github.com/bemasher/rtlamr/r900"
+	"github.com/bemasher/rtlamr/scm"
+	"github.com/bemasher/rtlamr/scmplus"
+)
+
+func TestDeltaTracker(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	type reading struct {
+		msg     parse.Message
+		elapsed time.Duration
+		expt    string // Delta and Rate, - if unset.
+	}
+
+	testCases := []struct {
+		name     string
+		r900BCD  bool
+		readings []reading
+	}{
+		{"FirstSuppressed", false, []reading{
+			{scm.SCM{ID: 1, Consumption: 100}, 0, "- -"},
+			{scm.SCM{ID: 1, Consumption: 110}, 30 * time.Minute, "10 20"},
+			{scm.SCM{ID: 1, Consumption: 110}, time.Hour, "0 0"},
+		}},
+		{"PerMeter", false, []reading{
+			{scm.SCM{ID: 1, Consumption: 100}, 0, "- -"},
+			{scm.SCM{ID: 2, Consumption: 500}, 0, "- -"},
+			{scm.SCM{ID: 1, Consumption: 105}, time.Hour, "5 5"},
+		}},
+		{"NoTimeElapsed", false, []reading{
+			{scm.SCM{ID: 1, Consumption: 100}, 0, "- -"},
+			{scm.SCM{ID: 1, Consumption: 101}, 0, "1 -"},
+		}},
+		{"SCMRollover", false, []reading{
+			{scm.SCM{ID: 1, Consumption: 1<<24 - 2}, 0, "- -"},
+			{scm.SCM{ID: 1, Consumption: 3}, time.Hour, "5 5"},
+		}},
+		{"SCMPlusRollover", false, []reading{
+			{scmplus.SCM{EndpointID: 1, Consumption: 1<<32 - 1}, 0, "- -"},
+			{scmplus.SCM{EndpointID: 1, Consumption: 1}, time.Hour, "2 2"},
+		}},
+		{"R900BCDRollover", true, []reading{
+			{r900.R900{ID: 1, Consumption: 999998}, 0, "- -"},
+			{r900.R900{ID: 1, Consumption: 2}, time.Hour, "4 4"},
+		}},
+		{"Reset", false, []reading{
+			{scm.SCM{ID: 1, Consumption: 5000}, 0, "- -"},
+			{scm.SCM{ID: 1, Consumption: 10}, time.Hour, "- -"},
+			{scm.SCM{ID: 1, Consumption: 15}, time.Hour, "5 5"},
+		}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dt := NewDeltaTracker(0)
+			dt.R900BCD = tc.r900BCD
+
+			now := start
+			for idx, r := range tc.readings {
+				now = now.Add(r.elapsed)
+				msg := parse.LogMessage{Time: now, Message: r.msg}
+				dt.Apply(&msg)
+
+				if recv := formatDelta(msg); recv != r.expt {
+					t.Fatalf("Reading %d: expected %q got %q\n", idx, r.expt, recv)
+				}
+			}
+		})
+	}
+}
+
+func formatDelta(msg parse.LogMessage) string {
+	delta, rate := "-", "-"
+	if msg.Delta != nil {
+		delta = strconv.FormatInt(*msg.Delta, 10)
+	}
+	if msg.Rate != nil {
+		rate = strconv.FormatFloat(*msg.Rate, 'f', -1, 64)
+	}
+	return delta + " " + rate
+}
+
+func TestDeltaTrackerRestore(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	dt := NewDeltaTracker(0)
+	dt.Apply(&parse.LogMessage{Time: start, Message: scm.SCM{ID: 1, Consumption: 100}})
+
+	restored := NewDeltaTracker(0)
+	restored.Restore(dt.Snapshot())
+
+	msg := parse.LogMessage{Time: start.Add(2 * time.Hour), Message: scm.SCM{ID: 1, Consumption: 110}}
+	restored.Apply(&msg)
+	if recv, expt := formatDelta(msg), "10 5"; recv != expt {
+		t.Fatalf("Expected %q got %q\n", expt, recv)
+	}
+}
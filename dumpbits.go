@@ -0,0 +1,190 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bemasher/rtlamr/clock"
+	"github.com/bemasher/rtlamr/decode"
+)
+
+// RateLimit is a flag value of the form count/unit, such as 100/s. Units are
+// s, m or h. A bare count is per second and 0 disables the limit.
+type RateLimit struct {
+	Count int
+	Per   time.Duration
+}
+
+func (rl *RateLimit) String() string {
+	unit := "s"
+	switch rl.Per {
+	case time.Minute:
+		unit = "m"
+	case time.Hour:
+		unit = "h"
+	}
+	return strconv.Itoa(rl.Count) + "/" + unit
+}
+
+func (rl *RateLimit) Set(value string) (err error) {
+	count, unit := value, "s"
+	if idx := strings.Index(value, "/"); idx != -1 {
+		count, unit = value[:idx], value[idx+1:]
+	}
+
+	if rl.Count, err = strconv.Atoi(count); err != nil || rl.Count < 0 {
+		return fmt.Errorf("invalid rate %q, expected count/unit", value)
+	}
+
+	switch unit {
+	case "s":
+		rl.Per = time.Second
+	case "m":
+		rl.Per = time.Minute
+	case "h":
+		rl.Per = time.Hour
+	default:
+		return fmt.Errorf("invalid rate unit %q, expected s, m or h", unit)
+	}
+
+	return nil
+}
+
+// rateLimiter counts records against a RateLimit in fixed windows, each
+// beginning with the first record after the last window ended.
+type rateLimiter struct {
+	RateLimit
+
+	windowStart time.Time
+	written     int
+	dropped     int
+}
+
+// Allow reports whether a record at now is within the limit, counting it
+// as dropped if not.
+func (rl *rateLimiter) Allow(now time.Time) bool {
+	if rl.Count == 0 {
+		return true
+	}
+	if now.Sub(rl.windowStart) >= rl.Per {
+		rl.windowStart = now
+		rl.written = 0
+	}
+	if rl.written >= rl.Count {
+		rl.dropped++
+		return false
+	}
+	rl.written++
+	return true
+}
+
+// Dropped returns the number of records dropped since it was last called.
+func (rl *rateLimiter) Dropped() (dropped int) {
+	dropped, rl.dropped = rl.dropped, 0
+	return dropped
+}
+
+// BitRecord is written by -dumpbits for each preamble candidate.
+type BitRecord struct {
+	Time    time.Time
+	Block   uint64  // Sample block the candidate was found in.
+	Offset  int     // Index of the candidate in the decoder's quantized buffer.
+	Score   float64 // Mean filter output across the preamble per chip.
+	Bits    string  // Quantized symbols of the candidate packet window.
+	Dropped int     `json:",omitempty"` // Candidates dropped by the rate limit since the previous record.
+}
+
+// BitDumper writes every preamble candidate as a line of JSON, whether or
+// not a packet is decoded from it.
+type BitDumper struct {
+	enc   *json.Encoder
+	limit rateLimiter
+	clock clock.Clock
+
+	// The decoder only keeps the filtered signal of the latest block, keep
+	// enough history to score candidates in the quantized buffer.
+	filtered []float64
+}
+
+func NewBitDumper(w io.Writer, limit RateLimit, cfg decode.PacketConfig) *BitDumper {
+	return &BitDumper{
+		enc:      json.NewEncoder(w),
+		limit:    rateLimiter{RateLimit: limit},
+		clock:    clock.Real,
+		filtered: make([]float64, cfg.BufferLength),
+	}
+}
+
+// SetWriter directs further records to w, such as after the dump file is
+// reopened.
+func (bd *BitDumper) SetWriter(w io.Writer) {
+	bd.enc = json.NewEncoder(w)
+}
+
+// Dump records the candidates found by the most recent call to d.Decode.
+func (bd *BitDumper) Dump(d decode.Decoder, indices []int, block uint64) error {
+	cfg := d.DecCfg
+
+	copy(bd.filtered, bd.filtered[cfg.BlockSize:])
+	copy(bd.filtered[cfg.PacketLength:], d.Filtered)
+
+	now := bd.clock.Now()
+	for _, qIdx := range indices {
+		// Candidates past the first block are found again in the next one.
+		if qIdx > cfg.BlockSize {
+			continue
+		}
+
+		if !bd.limit.Allow(now) {
+			continue
+		}
+
+		rec := BitRecord{
+			Time:    now,
+			Block:   block,
+			Offset:  qIdx,
+			Dropped: bd.limit.Dropped(),
+		}
+
+		for idx := 0; idx < cfg.PreambleSymbols; idx++ {
+			val := bd.filtered[qIdx+idx*cfg.SymbolLength]
+			if d.Cfg.Preamble[idx] == '0' {
+				val = -val
+			}
+			rec.Score += val
+		}
+		rec.Score /= float64(cfg.PreambleSymbols * cfg.ChipLength)
+
+		bits := make([]byte, cfg.PacketSymbols)
+		for idx := range bits {
+			bits[idx] = '0' + d.Quantized[qIdx+idx*cfg.SymbolLength]
+		}
+		rec.Bits = string(bits)
+
+		if err := bd.enc.Encode(rec); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
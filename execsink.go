@@ -0,0 +1,337 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Time the child is given to exit after its stdin is closed before it's
+// killed.
+const execShutdownTimeout = 5 * time.Second
+
+// A child running at least this long is considered healthy, so restarting
+// it after it exits begins again from the shortest backoff.
+const execHealthyRun = time.Minute
+
+// ExecSink writes each value it's given as a json line to the stdin of a
+// child process, restarting the child if it exits. Values are queued so a
+// slow child doesn't stall the receiver, unless Block is set.
+type ExecSink struct {
+	Args  []string
+	Block bool // Wait for space in the queue rather than dropping values.
+
+	queue   chan []byte
+	policy  RetryPolicy
+	dropped atomic.Uint64
+
+	stop    chan struct{}
+	done    chan struct{}
+	closing sync.Once
+}
+
+// NewExecSink returns a sink for command, split into arguments as by a
+// shell, queueing up to buffer values. The child isn't started until Start.
+func NewExecSink(command string, buffer int, block bool, policy RetryPolicy) (*ExecSink, error) {
+	args, err := splitArgs(command)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		return nil, errors.New("no command given")
+	}
+	if buffer < 0 {
+		return nil, errors.New("buffer must not be negative")
+	}
+
+	return &ExecSink{
+		Args:   args,
+		Block:  block,
+		queue:  make(chan []byte, buffer),
+		policy: policy,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}, nil
+}
+
+// Encode queues v to be written to the child.
+func (es *ExecSink) Encode(v interface{}) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	if es.Block {
+		select {
+		case es.queue <- line:
+		case <-es.done:
+			return errors.New("exec: sink closed")
+		}
+		return nil
+	}
+
+	select {
+	case es.queue <- line:
+	default:
+		if n := es.dropped.Add(1); n&(n-1) == 0 {
+			slog.Warn("exec: child is reading slowly, dropping messages", "dropped", n)
+		}
+	}
+	return nil
+}
+
+// Dropped returns the number of values dropped because the queue was full.
+func (es *ExecSink) Dropped() uint64 {
+	return es.dropped.Load()
+}
+
+// Start runs the child, restarting it with backoff whenever it exits, until
+// Close is called.
+func (es *ExecSink) Start() {
+	go es.run()
+}
+
+// Close writes the values already queued, closes the child's stdin and
+// waits briefly for it to exit before killing it.
+func (es *ExecSink) Close() {
+	es.closing.Do(func() {
+		close(es.stop)
+	})
+	<-es.done
+}
+
+func (es *ExecSink) run() {
+	defer close(es.done)
+
+	restarts := retrier{Op: "exec: child exited", Policy: es.policy}
+	var pending []byte // Value the last child failed to read.
+	for {
+		started := time.Now()
+		closed, err := es.runChild(&pending)
+		if closed {
+			return
+		}
+
+		if time.Since(started) >= execHealthyRun {
+			restarts.Succeed()
+		}
+		if err == nil {
+			err = errors.New("exit status 0")
+		}
+		restarts.Fail(err)
+
+		select {
+		case <-time.After(restarts.Backoff()):
+		case <-es.stop:
+			return
+		}
+	}
+}
+
+// execChild is a running child process.
+type execChild struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+
+	exited  chan struct{} // Closed once the child has exited.
+	waitErr error
+
+	lines   chan []byte
+	written chan error
+}
+
+// runChild starts the child and feeds it queued values until it exits,
+// returning its error, or until the sink is closed and the child has been
+// shut down.
+func (es *ExecSink) runChild(pending *[]byte) (closed bool, err error) {
+	child := &execChild{
+		cmd:     exec.Command(es.Args[0], es.Args[1:]...),
+		exited:  make(chan struct{}),
+		lines:   make(chan []byte),
+		written: make(chan error, 1),
+	}
+	if child.stdin, err = child.cmd.StdinPipe(); err != nil {
+		return false, err
+	}
+	stderr, err := child.cmd.StderrPipe()
+	if err != nil {
+		return false, err
+	}
+	if err := child.cmd.Start(); err != nil {
+		return false, err
+	}
+	slog.Info("exec: started child", "pid", child.cmd.Process.Pid, "command", es.Args[0])
+
+	// Wait must follow reading all of stderr.
+	prefix := "exec " + filepath.Base(es.Args[0]) + ": "
+	go func() {
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			slog.Warn(prefix + scanner.Text())
+		}
+		child.waitErr = child.cmd.Wait()
+		close(child.exited)
+	}()
+
+	// Writes happen in their own goroutine so a child which stops reading
+	// without exiting can still be shut down.
+	go func() {
+		for line := range child.lines {
+			_, err := child.stdin.Write(line)
+			child.written <- err
+			if err != nil {
+				return
+			}
+		}
+	}()
+	defer close(child.lines)
+
+	for {
+		if *pending != nil {
+			if err := child.write(*pending); err != nil {
+				child.stdin.Close()
+				select {
+				case <-child.exited:
+					return false, child.waitErr
+				case <-es.stop:
+					child.cmd.Process.Kill()
+					<-child.exited
+					return true, nil
+				}
+			}
+			*pending = nil
+		}
+
+		select {
+		case line := <-es.queue:
+			*pending = line
+		case <-child.exited:
+			return false, child.waitErr
+		case <-es.stop:
+			es.shutdown(child)
+			return true, nil
+		}
+	}
+}
+
+// write writes line to the child's stdin, failing if the child exits first.
+func (child *execChild) write(line []byte) error {
+	select {
+	case child.lines <- line:
+	case <-child.exited:
+		return fmt.Errorf("child exited: %v", child.waitErr)
+	}
+	select {
+	case err := <-child.written:
+		return err
+	case <-child.exited:
+		return fmt.Errorf("child exited: %v", child.waitErr)
+	}
+}
+
+// shutdown writes what's left in the queue, closes the child's stdin and
+// kills the child if it doesn't exit in time.
+func (es *ExecSink) shutdown(child *execChild) {
+	deadline := time.After(execShutdownTimeout)
+
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		for {
+			select {
+			case line := <-es.queue:
+				if child.write(line) != nil {
+					return
+				}
+			default:
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-drained:
+	case <-deadline:
+	}
+	child.stdin.Close()
+
+	select {
+	case <-child.exited:
+	case <-deadline:
+		slog.Warn("exec: child didn't exit in time, killing it", "pid", child.cmd.Process.Pid)
+		child.cmd.Process.Kill()
+		<-child.exited
+	}
+	<-drained
+}
+
+// splitArgs splits s into words separated by spaces as a shell would, with
+// single and double quotes grouping words and backslash escaping the next
+// character outside single quotes.
+func splitArgs(s string) (args []string, err error) {
+	var (
+		word    strings.Builder
+		inWord  bool
+		quote   rune
+		escaped bool
+	)
+	for _, r := range s {
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped, inWord = true, true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote, inWord = r, true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inWord {
+				args = append(args, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, fmt.Errorf("unterminated quote or escape in %q", s)
+	}
+	if inWord {
+		args = append(args, word.String())
+	}
+	return args, nil
+}
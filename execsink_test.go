@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// execChildMain copies stdin to the named file and exits.
+func execChildMain(name string) {
+	f, err := os.Create(name)
+	if err != nil {
+		os.Exit(1)
+	}
+	io.WriteString(os.Stderr, "started\n")
+	io.Copy(f, os.Stdin)
+	f.Close()
+	os.Exit(0)
+}
+
+func TestExecSink(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "out.jsonl")
+	t.Setenv("RTLAMR_TESTEXEC", name)
+
+	sink, err := NewExecSink(strconv.Quote(os.Args[0]), 8, true, RetryPolicy{Backoff: time.Millisecond, MaxBackoff: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.Start()
+	for i := 0; i < 3; i++ {
+		if err := sink.Encode(map[string]int{"N": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sink.Close()
+
+	buf, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expt := "{\"N\":0}\n{\"N\":1}\n{\"N\":2}\n"
+	if string(buf) != expt {
+		t.Errorf("child read %q, want %q", buf, expt)
+	}
+}
+
+func TestExecSinkDrop(t *testing.T) {
+	sink, err := NewExecSink("true", 1, false, RetryPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := sink.Encode(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if sink.Dropped() != 2 {
+		t.Errorf("dropped %d, want 2", sink.Dropped())
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	testCases := []struct {
+		s    string
+		expt []string
+	}{
+		{"", nil},
+		{"/usr/local/bin/handler --foo", []string{"/usr/local/bin/handler", "--foo"}},
+		{"  a   b  ", []string{"a", "b"}},
+		{`a "b c" 'd "e"'`, []string{"a", "b c", `d "e"`}},
+		{`a\ b "c\"d" ''`, []string{"a b", `c"d`, ""}},
+	}
+	for _, tc := range testCases {
+		args, err := splitArgs(tc.s)
+		if err != nil {
+			t.Errorf("%q: %s", tc.s, err)
+			continue
+		}
+		if !reflect.DeepEqual(args, tc.expt) {
+			t.Errorf("%q: got %q, want %q", tc.s, args, tc.expt)
+		}
+	}
+
+	for _, s := range []string{`"a`, `a\`, `'b`} {
+		if _, err := splitArgs(s); err == nil || !strings.Contains(err.Error(), "unterminated") {
+			t.Errorf("%q: expected an unterminated error, got %v", s, err)
+		}
+	}
+}
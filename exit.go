@@ -0,0 +1,63 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import "errors"
+
+// Exit statuses for scripts wrapping rtlamr.
+const (
+	exitOK         = 0 // Completed: time limit, message limit or -single satisfied.
+	exitFatal      = 1 // Runtime error.
+	exitUsage      = 2 // Invalid flags or configuration, also used by the flag package.
+	exitDevice     = 3 // Connecting to or reading from rtl_tcp failed.
+	exitNoMessages = 4 // Completed but no messages passed the filters.
+	exitOutput     = 5 // Writing messages or output files failed.
+	exitNoPackets  = 6 // No packets decoded for -nopacketwatchdog with -nopacketaction=exit.
+	exitMissed     = 7 // -single stopped having heard some of the -filterid meters but not all.
+)
+
+// statusError is an error which causes the given exit status.
+type statusError struct {
+	status int
+	err    error
+}
+
+func (se statusError) Error() string {
+	return se.err.Error()
+}
+
+func (se statusError) Unwrap() error {
+	return se.err
+}
+
+// withStatus returns err annotated with the exit status it causes.
+func withStatus(status int, err error) error {
+	if err == nil {
+		return nil
+	}
+	return statusError{status, err}
+}
+
+// exitStatus returns the exit status err was annotated with by withStatus,
+// otherwise the given default.
+func exitStatus(err error, def int) int {
+	var se statusError
+	if errors.As(err, &se) {
+		return se.status
+	}
+	return def
+}
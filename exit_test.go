@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/bemasher/rtlamr/gen"
+	"github.com/bemasher/rtlamr/parse"
+)
+
+// TestMain runs rtlamr itself when re-executed by runRtlamr, or a child for
+// -exec when re-executed by TestExecSink.
+func TestMain(m *testing.M) {
+	if os.Getenv("RTLAMR_TESTMAIN") == "1" {
+		main()
+	}
+	if name := os.Getenv("RTLAMR_TESTEXEC"); name != "" {
+		execChildMain(name)
+	}
+	os.Exit(m.Run())
+}
+
+// runRtlamr runs rtlamr with the given arguments and returns its exit status.
+func runRtlamr(t *testing.T, stdout *os.File, args ...string) int {
+	t.Helper()
+	return runRtlamrStdin(t, nil, stdout, args...)
+}
+
+// runRtlamrStdin runs rtlamr like runRtlamr, reading stdin from the given
+// reader.
+func runRtlamrStdin(t *testing.T, stdin io.Reader, stdout *os.File, args ...string) int {
+	t.Helper()
+
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "RTLAMR_TESTMAIN=1")
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	var log bytes.Buffer
+	cmd.Stderr = &log
+
+	err := cmd.Run()
+	var ee *exec.ExitError
+	if errors.As(err, &ee) {
+		t.Logf("rtlamr %v:\n%s", args, log.String())
+		return ee.ExitCode()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return 0
+}
+
+// fakeRTLTCP serves the given samples repeatedly to rtl_tcp clients and
+// returns its address.
+func fakeRTLTCP(t *testing.T, samples []byte) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				// Discard tuner commands.
+				go func() {
+					buf := make([]byte, 5)
+					for {
+						if _, err := conn.Read(buf); err != nil {
+							return
+						}
+					}
+				}()
+				if _, err := conn.Write(append([]byte("RTL0"), make([]byte, 8)...)); err != nil {
+					return
+				}
+				for {
+					if _, err := conn.Write(samples); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+// noise returns a block of samples without any signal.
+func noise() []byte {
+	block := make([]byte, 1<<16)
+	for idx := range block {
+		block[idx] = 127
+	}
+	return block
+}
+
+// scmSignal returns a generated SCM packet followed by samples without any
+// signal.
+func scmSignal(t *testing.T) []byte {
+	t.Helper()
+
+	p, err := parse.NewParser("scm", 72, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sampleRate := float64(p.Cfg().SampleRate)
+
+	pkt, err := gen.NewRandSCM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bits := gen.Upsample(gen.UnpackBits(gen.NewManchesterLUT().Encode(pkt)), 72<<1)
+
+	carrier := gen.CmplxOscillatorF64(len(bits)>>1, 10e3, sampleRate)
+	for idx := range carrier {
+		carrier[idx] *= float64(bits[idx])
+	}
+
+	signal := make([]byte, len(carrier))
+	gen.F64toU8(carrier, signal)
+
+	return append(signal, noise()...)
+}
+
+func TestExitStatus(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping exit status tests in short mode")
+	}
+
+	dir := t.TempDir()
+
+	// A file standing where output directories would be created.
+	notDir := filepath.Join(dir, "file")
+	if err := os.WriteFile(notDir, nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	// A port nothing listens on.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := l.Addr().String()
+	l.Close()
+
+	quiet := fakeRTLTCP(t, noise())
+	signal := fakeRTLTCP(t, scmSignal(t))
+
+	for _, tc := range []struct {
+		name   string
+		status int
+		args   []string
+	}{
+		{"Completed", exitOK, []string{"-server=" + signal, "-msglimit=1", "-duration=10s"}},
+		{"MissingConfig", exitUsage, []string{"-config=" + filepath.Join(dir, "missing.toml")}},
+		{"InvalidFlag", exitUsage, []string{"-server=" + quiet, "-filtermode=bogus"}},
+		{"InvalidTemplate", exitUsage, []string{"-samplefile=" + filepath.Join(dir, "{{.Bogus}}.bin")}},
+		{"UnknownFlag", exitUsage, []string{"-bogus"}},
+		{"Check", exitOK, []string{"-server=" + quiet, "-check", "-samplefile=" + filepath.Join(dir, "check", "samples.bin")}},
+		{"CheckFailed", exitDevice, []string{"-server=" + closed, "-check", "-retry.max=1", "-retry.backoff=1ms"}},
+		{"NoDevice", exitDevice, []string{"-server=" + closed, "-retry.max=1", "-retry.backoff=1ms"}},
+		{"NoMessages", exitNoMessages, []string{"-server=" + quiet, "-duration=500ms"}},
+		{"NoPackets", exitNoPackets, []string{"-server=" + quiet, "-nopacketwatchdog=200ms", "-nopacketaction=exit"}},
+		{"OutputFailed", exitOutput, []string{"-server=" + quiet, "-samplefile=" + filepath.Join(notDir, "samples.bin")}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			args := append([]string{"-summary=false"}, tc.args...)
+			if status := runRtlamr(t, nil, args...); status != tc.status {
+				t.Fatalf("Expected status %d, got %d\n", tc.status, status)
+			}
+		})
+	}
+
+	t.Run("WriteFailed", func(t *testing.T) {
+		if runtime.GOOS == "windows" {
+			t.Skip("no read-only stdout on windows")
+		}
+
+		// Messages written to a read-only stdout fail to encode.
+		name := filepath.Join(dir, "readonly")
+		if err := os.WriteFile(name, nil, 0444); err != nil {
+			t.Fatal(err)
+		}
+		stdout, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer stdout.Close()
+
+		args := []string{"-summary=false", "-server=" + signal, "-retry.max=1", "-duration=10s"}
+		if status := runRtlamr(t, stdout, args...); status != exitOutput {
+			t.Fatalf("Expected status %d, got %d\n", exitOutput, status)
+		}
+	})
+}
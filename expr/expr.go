@@ -0,0 +1,620 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package expr compiles filter expressions such as:
+//
+//	MeterID in (1234, 5678) && Consumption > 0 && MsgType == "SCM"
+//
+// Expressions are made of comparisons (==, !=, <, <=, >, >=) and set
+// membership (in) joined by &&, || and !, grouped with parentheses. A field
+// on its own is true when it is non-zero. Fields common to all messages are
+// MeterID, MeterType, Consumption, MsgType and ChecksumOK, other fields are
+// provided by messages implementing parse.FieldReporter. Comparisons with a
+// field the message doesn't have are false.
+//
+// Comparisons which could never match, such as a string field with a number
+// or a meter id with a number wider than 32 bits, are compile errors.
+//
+// Sets too large to list, such as ranges of meter ids, are matched by InSet
+// rather than compiled.
+package expr
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/bemasher/rtlamr/parse"
+)
+
+// Kind is the kind of value a field holds.
+type Kind int
+
+const (
+	Any Kind = iota // Not checked at compile time.
+	Number
+	String
+)
+
+func (k Kind) String() string {
+	switch k {
+	case Number:
+		return "number"
+	case String:
+		return "string"
+	}
+	return "any"
+}
+
+// Field describes the values a field holds, for checking the literals it's
+// compared with.
+type Field struct {
+	Kind Kind
+	// Max is the largest value of a Number field holding whole numbers from
+	// 0, such as a meter id. Zero allows any number.
+	Max float64
+}
+
+// Fields available in every message.
+var CommonFields = map[string]Field{
+	"MeterID":     {Number, math.MaxUint32},
+	"MeterType":   {Number, math.MaxUint8},
+	"Consumption": {Number, math.MaxUint32},
+	"MsgType":     {String, 0},
+	"ChecksumOK":  {Number, 1},
+}
+
+// Expr is a compiled expression. Evaluating it doesn't allocate.
+type Expr struct {
+	src  string
+	root node
+}
+
+// Compile parses src. Identifiers which are neither common fields nor
+// accepted by known are an error, known may be nil to accept any field
+// without checking its values. Errors give the column of the offending token.
+func Compile(src string, known func(name string) (Field, bool)) (*Expr, error) {
+	tokens, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens, known: known}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, fmt.Errorf("column %d: unexpected %s", tok.pos, tok)
+	}
+
+	return &Expr{src, root}, nil
+}
+
+// Set is a set of whole numbers matched by InSet, such as sorted ranges
+// searched by binary search. Contains mustn't allocate.
+type Set interface {
+	Contains(n uint) bool
+	String() string
+}
+
+// InSet returns an expression true when the number field holds a whole
+// number in set. Fields are checked as by Compile.
+func InSet(field string, set Set, known func(name string) (Field, bool)) (*Expr, error) {
+	p := &parser{known: known}
+	typ, ok := p.fieldType(field)
+	if !ok {
+		return nil, fmt.Errorf("unknown field %q", field)
+	}
+	if typ.Kind == String {
+		return nil, fmt.Errorf("%s is a string", field)
+	}
+
+	src := fmt.Sprintf("%s in (%s)", field, set)
+	return &Expr{src, rangeNode{operand{field: field, typ: typ}, set}}, nil
+}
+
+func (e *Expr) String() string {
+	return e.src
+}
+
+// Match evaluates the expression against msg.
+func (e *Expr) Match(msg parse.Message) bool {
+	return e.root.eval(msg)
+}
+
+// Filter implements parse.MessageFilter.
+func (e *Expr) Filter(msg parse.Message) bool {
+	return e.root.eval(msg)
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokNumber
+	tokString
+	tokLParen
+	tokRParen
+	tokComma
+	tokEq
+	tokNe
+	tokLt
+	tokLe
+	tokGt
+	tokGe
+	tokAnd
+	tokOr
+	tokNot
+	tokIn
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int // Column, starting at 1.
+}
+
+func (t token) String() string {
+	if t.kind == tokEOF {
+		return "end of expression"
+	}
+	return strconv.Quote(t.text)
+}
+
+// Operators, longest first so that <= is preferred over <.
+var operators = []struct {
+	text string
+	kind tokenKind
+}{
+	{"==", tokEq}, {"!=", tokNe}, {"<=", tokLe}, {">=", tokGe},
+	{"&&", tokAnd}, {"||", tokOr},
+	{"<", tokLt}, {">", tokGt}, {"!", tokNot},
+	{"(", tokLParen}, {")", tokRParen}, {",", tokComma},
+}
+
+func lex(src string) (tokens []token, err error) {
+	isDigit := func(b byte) bool {
+		return '0' <= b && b <= '9'
+	}
+	isIdent := func(b byte) bool {
+		return b == '_' || 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z' || isDigit(b)
+	}
+
+	for pos := 0; pos < len(src); {
+		r := src[pos]
+		col := pos + 1
+
+		switch {
+		case r == ' ' || r == '\t' || r == '\n' || r == '\r':
+			pos++
+			continue
+		case r == '"':
+			end := pos + 1
+			for ; end < len(src) && src[end] != '"'; end++ {
+				if src[end] == '\\' {
+					end++
+				}
+			}
+			if end >= len(src) {
+				return nil, fmt.Errorf("column %d: unterminated string", col)
+			}
+			text, err := strconv.Unquote(src[pos : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("column %d: invalid string %s", col, src[pos:end+1])
+			}
+			tokens = append(tokens, token{tokString, text, col})
+			pos = end + 1
+			continue
+		case isDigit(r):
+			end := pos
+			for end < len(src) && (isIdent(src[end]) || src[end] == '.') {
+				end++
+			}
+			tokens = append(tokens, token{tokNumber, src[pos:end], col})
+			pos = end
+			continue
+		case isIdent(r):
+			end := pos
+			for end < len(src) && isIdent(src[end]) {
+				end++
+			}
+			kind := tokIdent
+			if src[pos:end] == "in" {
+				kind = tokIn
+			}
+			tokens = append(tokens, token{kind, src[pos:end], col})
+			pos = end
+			continue
+		}
+
+		found := false
+		for _, op := range operators {
+			if strings.HasPrefix(src[pos:], op.text) {
+				tokens = append(tokens, token{op.kind, op.text, col})
+				pos += len(op.text)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("column %d: unexpected character %q", col, r)
+		}
+	}
+
+	return append(tokens, token{tokEOF, "", len(src) + 1}), nil
+}
+
+type parser struct {
+	tokens []token
+	idx    int
+	known  func(string) (Field, bool)
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.idx]
+}
+
+func (p *parser) next() token {
+	tok := p.tokens[p.idx]
+	if tok.kind != tokEOF {
+		p.idx++
+	}
+	return tok
+}
+
+func (p *parser) expect(kind tokenKind, what string) error {
+	if tok := p.next(); tok.kind != kind {
+		return fmt.Errorf("column %d: expected %s, found %s", tok.pos, what, tok)
+	}
+	return nil
+}
+
+func (p *parser) parseOr() (node, error) {
+	l, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == tokOr {
+		p.next()
+		r, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l = orNode{l, r}
+	}
+	return l, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	l, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == tokAnd {
+		p.next()
+		r, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		l = andNode{l, r}
+	}
+	return l, nil
+}
+
+func (p *parser) parseUnary() (node, error) {
+	switch p.peek().kind {
+	case tokNot:
+		p.next()
+		n, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{n}, nil
+	case tokLParen:
+		p.next()
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(tokRParen, `")"`); err != nil {
+			return nil, err
+		}
+		return n, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *parser) parseComparison() (node, error) {
+	start := p.peek()
+	l, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	switch op := p.peek(); op.kind {
+	case tokEq, tokNe, tokLt, tokLe, tokGt, tokGe:
+		p.next()
+		r, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		if err := checkCmp(op, l, r); err != nil {
+			return nil, err
+		}
+		return cmpNode{op.kind, l, r}, nil
+	case tokIn:
+		p.next()
+		return p.parseSet(l)
+	}
+
+	if l.field == "" {
+		return nil, fmt.Errorf("column %d: expected a comparison after %s", start.pos, start)
+	}
+	return truthNode{l}, nil
+}
+
+func (p *parser) parseSet(l operand) (node, error) {
+	if err := p.expect(tokLParen, `"(" after in`); err != nil {
+		return nil, err
+	}
+
+	n := setNode{l, make(map[float64]bool), make(map[string]bool)}
+	for {
+		tok := p.peek()
+		v, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		if v.field != "" {
+			return nil, fmt.Errorf("column %d: sets may only contain numbers and strings", tok.pos)
+		}
+		if err := checkLiteral(l, v, true); err != nil {
+			return nil, err
+		}
+		if v.lit.IsString {
+			n.strs[v.lit.Str] = true
+		} else {
+			n.nums[v.lit.Num] = true
+		}
+
+		if p.peek().kind != tokComma {
+			break
+		}
+		p.next()
+	}
+
+	if err := p.expect(tokRParen, `"," or ")"`); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+func (p *parser) parseOperand() (operand, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokIdent:
+		typ, ok := p.fieldType(tok.text)
+		if !ok {
+			return operand{}, fmt.Errorf("column %d: unknown field %q", tok.pos, tok.text)
+		}
+		return operand{field: tok.text, typ: typ, tok: tok}, nil
+	case tokNumber:
+		n, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			u, uerr := strconv.ParseUint(tok.text, 0, 64)
+			if uerr != nil {
+				return operand{}, fmt.Errorf("column %d: invalid number %q", tok.pos, tok.text)
+			}
+			n = float64(u)
+		}
+		return operand{lit: parse.Num(n), typ: Field{Kind: Number}, tok: tok}, nil
+	case tokString:
+		return operand{lit: parse.Value{Str: tok.text, IsString: true}, typ: Field{Kind: String}, tok: tok}, nil
+	}
+	return operand{}, fmt.Errorf("column %d: expected a field, number or string, found %s", tok.pos, tok)
+}
+
+func (p *parser) fieldType(name string) (Field, bool) {
+	if typ, ok := CommonFields[name]; ok {
+		return typ, true
+	}
+	if p.known == nil {
+		return Field{}, true
+	}
+	return p.known(name)
+}
+
+// checkCmp rejects comparisons which could never be true because the
+// operands are of different kinds, or a literal is out of its field's range.
+func checkCmp(op token, l, r operand) error {
+	if l.typ.Kind != Any && r.typ.Kind != Any && l.typ.Kind != r.typ.Kind {
+		switch {
+		case l.field == "" && r.field == "":
+			return fmt.Errorf("column %d: can't compare a string and a number", op.pos)
+		case l.field != "" && r.field != "":
+			return fmt.Errorf("column %d: can't compare %s (%s) and %s (%s)", op.pos, l.field, l.typ.Kind, r.field, r.typ.Kind)
+		}
+	}
+
+	equality := op.kind == tokEq || op.kind == tokNe
+	if l.field != "" && r.field == "" {
+		return checkLiteral(l, r, equality)
+	}
+	if r.field != "" && l.field == "" {
+		return checkLiteral(r, l, equality)
+	}
+	return nil
+}
+
+// checkLiteral checks that lit can be compared with field. Equality requires
+// whole numbers for fields with a range.
+func checkLiteral(field, lit operand, equality bool) error {
+	if field.field == "" || field.typ.Kind == Any {
+		return nil
+	}
+	if field.typ.Kind != lit.typ.Kind {
+		return fmt.Errorf("column %d: %s is a %s, can't compare it with a %s", lit.tok.pos, field.field, field.typ.Kind, lit.typ.Kind)
+	}
+	if field.typ.Max == 0 || lit.lit.IsString {
+		return nil
+	}
+
+	n := lit.lit.Num
+	if n < 0 || n > field.typ.Max {
+		return fmt.Errorf("column %d: %s is out of range for %s (0 to %.0f)", lit.tok.pos, lit.tok.text, field.field, field.typ.Max)
+	}
+	if equality && n != math.Trunc(n) {
+		return fmt.Errorf("column %d: %s is a whole number, can't equal %s", lit.tok.pos, field.field, lit.tok.text)
+	}
+	return nil
+}
+
+type node interface {
+	eval(msg parse.Message) bool
+}
+
+// operand is either a field or a literal.
+type operand struct {
+	field string
+	lit   parse.Value
+	typ   Field
+	tok   token // For errors.
+}
+
+func (o operand) value(msg parse.Message) (parse.Value, bool) {
+	switch o.field {
+	case "":
+		return o.lit, true
+	case "MeterID":
+		return parse.Num(float64(msg.MeterID())), true
+	case "MeterType":
+		return parse.Num(float64(msg.MeterType())), true
+	case "Consumption":
+		return parse.Num(float64(msg.MeterConsumption())), true
+	case "MsgType":
+		return parse.Value{Str: msg.MsgType(), IsString: true}, true
+	case "ChecksumOK":
+		return parse.Bool(msg.ChecksumOK()), true
+	}
+
+	if fr, ok := msg.(parse.FieldReporter); ok {
+		return fr.Field(o.field)
+	}
+	return parse.Value{}, false
+}
+
+type orNode struct{ l, r node }
+
+func (n orNode) eval(msg parse.Message) bool {
+	return n.l.eval(msg) || n.r.eval(msg)
+}
+
+type andNode struct{ l, r node }
+
+func (n andNode) eval(msg parse.Message) bool {
+	return n.l.eval(msg) && n.r.eval(msg)
+}
+
+type notNode struct{ n node }
+
+func (n notNode) eval(msg parse.Message) bool {
+	return !n.n.eval(msg)
+}
+
+type truthNode struct{ o operand }
+
+func (n truthNode) eval(msg parse.Message) bool {
+	v, ok := n.o.value(msg)
+	if !ok {
+		return false
+	}
+	if v.IsString {
+		return v.Str != ""
+	}
+	return v.Num != 0
+}
+
+type cmpNode struct {
+	op   tokenKind
+	l, r operand
+}
+
+func (n cmpNode) eval(msg parse.Message) bool {
+	l, lok := n.l.value(msg)
+	r, rok := n.r.value(msg)
+	if !lok || !rok || l.IsString != r.IsString {
+		return false
+	}
+
+	var c int
+	if l.IsString {
+		c = strings.Compare(l.Str, r.Str)
+	} else if l.Num < r.Num {
+		c = -1
+	} else if l.Num > r.Num {
+		c = 1
+	}
+
+	switch n.op {
+	case tokEq:
+		return c == 0
+	case tokNe:
+		return c != 0
+	case tokLt:
+		return c < 0
+	case tokLe:
+		return c <= 0
+	case tokGt:
+		return c > 0
+	case tokGe:
+		return c >= 0
+	}
+	return false
+}
+
+type setNode struct {
+	o    operand
+	nums map[float64]bool
+	strs map[string]bool
+}
+
+func (n setNode) eval(msg parse.Message) bool {
+	v, ok := n.o.value(msg)
+	if !ok {
+		return false
+	}
+	if v.IsString {
+		return n.strs[v.Str]
+	}
+	return n.nums[v.Num]
+}
+
+// rangeNode matches a field against a Set built by the caller.
+type rangeNode struct {
+	o   operand
+	set Set
+}
+
+func (n rangeNode) eval(msg parse.Message) bool {
+	v, ok := n.o.value(msg)
+	if !ok || v.IsString || v.Num < 0 || v.Num >= math.MaxUint64 || v.Num != math.Trunc(v.Num) {
+		return false
+	}
+	return n.set.Contains(uint(v.Num))
+}
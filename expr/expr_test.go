@@ -0,0 +1,150 @@
+package expr
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/bemasher/rtlamr/idm"
+	"github.com/bemasher/rtlamr/parse"
+	"github.com/bemasher/rtlamr/r900"
+	"github.com/bemasher/rtlamr/scm"
+)
+
+func TestMatch(t *testing.T) {
+	scmMsg := scm.SCM{ID: 1234, Type: 8, Consumption: 100}
+	idmMsg := idm.IDM{ERTSerialNumber: 5678, ERTType: 8, LastConsumptionCount: 0}
+	r900Msg := r900.R900{ID: 9012, Leak: 2}
+
+	for _, c := range []struct {
+		Src  string
+		Msg  parse.Message
+		Expt bool
+	}{
+		{`MeterID in (1234, 5678) && Consumption > 0 && MsgType == "SCM"`, scmMsg, true},
+		{`MeterID in (1234, 5678) && Consumption > 0 && MsgType == "SCM"`, idmMsg, false},
+		{`MeterID in (1234,5678)`, idmMsg, true},
+		{`MeterID == 1234 || MeterType == 8`, idmMsg, true},
+		{`!(MeterID == 1234)`, scmMsg, false},
+		{`MsgType != "SCM"`, r900Msg, true},
+		{`MsgType in ("IDM", "R900")`, r900Msg, true},
+		{`Consumption >= 100 && Consumption <= 100`, scmMsg, true},
+		{`Consumption < 100`, scmMsg, false},
+		{`Leak`, r900Msg, true},
+		{`Leak`, scmMsg, false},
+		{`Leak > 0 || Type == 0x08`, scmMsg, true},
+		{`!Consistent && ChecksumOK`, idmMsg, true},
+		{`Leak == 0`, scmMsg, false},
+		{`(MeterID == 1 || MeterID == 1234) && !Leak`, scmMsg, true},
+		{`MsgType == MsgType && "a" < "b"`, scmMsg, true},
+	} {
+		e, err := Compile(c.Src, nil)
+		if err != nil {
+			t.Fatalf("%s: %s\n", c.Src, err)
+		}
+		if recv := e.Match(c.Msg); recv != c.Expt {
+			t.Fatalf("%s on %s: expected %t got %t\n", c.Src, c.Msg.MsgType(), c.Expt, recv)
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	known := func(name string) (Field, bool) {
+		return Field{Number, 15}, name == "Leak"
+	}
+
+	for src, expt := range map[string]string{
+		`MeterID ==`:                      "column 11: expected a field",
+		`MeterID = 1`:                     "column 9: unexpected character",
+		`Leek > 0`:                        `column 1: unknown field "Leek"`,
+		`MeterID in 1`:                    `column 12: expected "(" after in`,
+		`MeterID in (1, Leak)`:            "column 16: sets may only contain",
+		`MeterID in (1 2)`:                `column 15: expected "," or ")"`,
+		`(MeterID == 1`:                   `column 14: expected ")"`,
+		`MsgType == "SCM`:                 "column 12: unterminated string",
+		`MeterID == 1 MeterType`:          `column 14: unexpected "MeterType"`,
+		`1 && Leak`:                       "column 1: expected a comparison",
+		`"SCM" == 1`:                      "column 7: can't compare a string and a number",
+		`MeterID == 12ab`:                 `column 12: invalid number "12ab"`,
+		`MeterID == 1 && && Leak == 0`:    `column 17: expected a field`,
+		`MsgType > 5`:                     "column 11: MsgType is a string, can't compare it with a number",
+		`MeterID == "abc"`:                "column 12: MeterID is a number, can't compare it with a string",
+		`MeterID == 99999999999999999999`: "column 12: 99999999999999999999 is out of range for MeterID (0 to 4294967295)",
+		`MeterID in (1, -1)`:              "column 16: unexpected character",
+		`MeterType in (8, 256)`:           "column 18: 256 is out of range for MeterType",
+		`MsgType in ("SCM", 1)`:           "column 20: MsgType is a string",
+		`Leak > 16`:                       "column 8: 16 is out of range for Leak (0 to 15)",
+		`Consumption == 1.5`:              "column 16: Consumption is a whole number, can't equal 1.5",
+		`MsgType == MeterID`:              "column 9: can't compare MsgType (string) and MeterID (number)",
+	} {
+		_, err := Compile(src, known)
+		if err == nil {
+			t.Fatalf("%s: expected error\n", src)
+		}
+		if !strings.HasPrefix(err.Error(), expt) {
+			t.Fatalf("%s: expected %q got %q\n", src, expt, err)
+		}
+	}
+}
+
+func TestMatchAllocs(t *testing.T) {
+	e, err := Compile(`MeterID in (1234, 5678) && Consumption > 0 && MsgType == "SCM" || Leak > 0`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var msg parse.Message = scm.SCM{ID: 1234, Consumption: 100}
+	if allocs := testing.AllocsPerRun(100, func() { e.Match(msg) }); allocs != 0 {
+		t.Fatalf("Expected no allocations got %f\n", allocs)
+	}
+}
+
+func TestInSet(t *testing.T) {
+	set := rangeSet{{10, 19}, {30, 30}}
+	e, err := InSet("MeterID", set, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recv, expt := e.String(), "MeterID in (10-19,30)"; recv != expt {
+		t.Fatalf("Expected %q got %q\n", expt, recv)
+	}
+	for id, expt := range map[uint32]bool{9: false, 10: true, 19: true, 20: false, 30: true} {
+		if recv := e.Match(scm.SCM{ID: id}); recv != expt {
+			t.Fatalf("Meter %d: expected %t got %t\n", id, expt, recv)
+		}
+	}
+	if allocs := testing.AllocsPerRun(100, func() { e.Match(scm.SCM{ID: 15}) }); allocs != 0 {
+		t.Fatalf("Expected no allocations got %v\n", allocs)
+	}
+
+	if _, err := InSet("MsgType", set, nil); err == nil {
+		t.Fatal("Expected error for a string field")
+	}
+	if _, err := InSet("Leek", set, func(string) (Field, bool) { return Field{}, false }); err == nil {
+		t.Fatal("Expected error for an unknown field")
+	}
+}
+
+// rangeSet is a sorted list of inclusive ranges.
+type rangeSet [][2]uint
+
+func (rs rangeSet) Contains(n uint) bool {
+	for _, r := range rs {
+		if r[0] <= n && n <= r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+func (rs rangeSet) String() string {
+	var ranges []string
+	for _, r := range rs {
+		if r[0] == r[1] {
+			ranges = append(ranges, fmt.Sprint(r[0]))
+		} else {
+			ranges = append(ranges, fmt.Sprintf("%d-%d", r[0], r[1]))
+		}
+	}
+	return strings.Join(ranges, ",")
+}
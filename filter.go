@@ -0,0 +1,981 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"math"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bemasher/rtlamr/expr"
+	"github.com/bemasher/rtlamr/filter"
+	"github.com/bemasher/rtlamr/idm"
+	"github.com/bemasher/rtlamr/parse"
+	"github.com/bemasher/rtlamr/r900"
+	"github.com/bemasher/rtlamr/scm"
+	"github.com/bemasher/rtlamr/scmplus"
+)
+
+type UintMap map[uint]bool
+
+func (m UintMap) String() (s string) {
+	var values []string
+	for k := range m {
+		values = append(values, strconv.FormatUint(uint64(k), 10))
+	}
+	return strings.Join(values, ",")
+}
+
+func (m UintMap) Set(value string) error {
+	values := strings.Split(value, ",")
+
+	for _, v := range values {
+		n, err := ParseUint(v, 64)
+		if err != nil {
+			return err
+		}
+
+		m[uint(n)] = true
+	}
+
+	return nil
+}
+
+// ReadFilterList passes each entry of a filter file to set. Files hold one
+// entry per line, blank lines and anything following a # are ignored.
+func ReadFilterList(r io.Reader, set func(string) error) error {
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		entry := scanner.Text()
+		if idx := strings.Index(entry, "#"); idx != -1 {
+			entry = entry[:idx]
+		}
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if err := set(entry); err != nil {
+			return fmt.Errorf("line %d: %s", line, err)
+		}
+	}
+
+	return scanner.Err()
+}
+
+// ReadFilterFile reads a filter file into set, see ReadFilterList.
+func ReadFilterFile(filename string, set func(string) error) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := ReadFilterList(file, set); err != nil {
+		return fmt.Errorf("%s: %s", filename, err)
+	}
+
+	return nil
+}
+
+// MeterIDFilter matches meter ids, ranges of ids, wildcards and alias names
+// given by -filterid and -filteridfile. The set in effect is replaced rather than
+// mutated so the file can be reloaded while packets are being filtered. Each set
+// is matched by an expression searching its ranges, see expr.InSet.
+type MeterIDFilter struct {
+	Filename string
+	Aliases  *Aliases // Resolves alias names, none are known if nil.
+
+	parserName string // Checked against the width of its id field if set.
+
+	flagRanges []IDRange    // Given on the command line.
+	flagNames  []string     // Aliases given on the command line, resolved on reload.
+	state      atomic.Value // *idState
+	mu         sync.Mutex   // Serializes replacement of state.
+}
+
+type idState struct {
+	ranges    IDRanges
+	satisfied UintMap  // Meters which satisfied -single, kept across reloads.
+	pending   IDRanges // Ranges less satisfied meters, matched by match.
+	match     *expr.Expr
+}
+
+func newIDState(ranges IDRanges, satisfied UintMap) *idState {
+	var heard []IDRange
+	for id := range satisfied {
+		heard = append(heard, IDRange{id, id})
+	}
+	pending := ranges.Subtract(NewIDRanges(heard))
+	return &idState{ranges, satisfied, pending, matchIDs(pending)}
+}
+
+// matchIDs returns an expression matching meter ids in ranges, nil for none.
+// The ranges are searched rather than compiled, so large sets and -single
+// satisfying meters one at a time stay cheap.
+func matchIDs(ranges IDRanges) *expr.Expr {
+	if len(ranges) == 0 {
+		return nil
+	}
+	match, err := expr.InSet("MeterID", ranges, nil)
+	if err != nil {
+		// MeterID is always a number.
+		panic(err)
+	}
+	return match
+}
+
+// compileMatch compiles an expression built by a filter, nil for an empty
+// one, which matches nothing.
+func compileMatch(src string) (*expr.Expr, error) {
+	if src == "" {
+		return nil, nil
+	}
+	return NewExprFilter(src)
+}
+
+func NewMeterIDFilter() *MeterIDFilter {
+	return &MeterIDFilter{}
+}
+
+func (m *MeterIDFilter) String() string {
+	values := m.flagNames
+	if s := IDRanges(m.flagRanges).String(); s != "" {
+		values = append([]string{s}, values...)
+	}
+	return strings.Join(values, ",")
+}
+
+func (m *MeterIDFilter) Set(value string) error {
+	ranges, names, err := parseIDList(value)
+	if err != nil {
+		return err
+	}
+	m.flagRanges = append(m.flagRanges, ranges...)
+	m.flagNames = append(m.flagNames, names...)
+	return nil
+}
+
+// parseIDList splits a comma-separated list into id ranges and alias names.
+func parseIDList(value string) (ranges []IDRange, names []string, err error) {
+	for _, token := range strings.Split(value, ",") {
+		r, err := ParseIDRange(token)
+		if err != nil {
+			if name := strings.TrimSpace(token); isAliasName(name) {
+				names = append(names, name)
+				continue
+			}
+			return nil, nil, err
+		}
+		ranges = append(ranges, r)
+	}
+	return
+}
+
+// resolveAliases returns the ids of the given alias names.
+func (m *MeterIDFilter) resolveAliases(names []string) (ranges []IDRange, err error) {
+	for _, name := range names {
+		id, ok := m.Aliases.ID(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown meter alias %q", name)
+		}
+		ranges = append(ranges, IDRange{uint(id), uint(id)})
+	}
+	return
+}
+
+func (m *MeterIDFilter) load() *idState {
+	if s, ok := m.state.Load().(*idState); ok {
+		return s
+	}
+	return &idState{}
+}
+
+// Ranges returns the ranges in effect.
+func (m *MeterIDFilter) Ranges() IDRanges {
+	return m.load().ranges
+}
+
+// Resolve loads the filter for the given parser, or comma separated list of
+// parsers. Ids which don't fit in any parser's id field are an error.
+func (m *MeterIDFilter) Resolve(parserName string) error {
+	for _, name := range strings.Split(parserName, ",") {
+		if _, ok := parserMsgTypes[name]; !ok {
+			return fmt.Errorf("unknown message type %q", name)
+		}
+	}
+	m.parserName = parserName
+
+	_, _, err := m.Reload()
+	return err
+}
+
+// Reload builds new ranges from the command line and the filter file, if
+// any, and swaps them in. Alias names are resolved against the aliases in
+// effect. Returns the ranges added and removed by the swap.
+func (m *MeterIDFilter) Reload() (added, removed []string, err error) {
+	ranges, err := m.resolveAliases(m.flagNames)
+	if err != nil {
+		return nil, nil, err
+	}
+	ranges = append(ranges, m.flagRanges...)
+
+	if m.Filename != "" {
+		err := ReadFilterFile(m.Filename, func(value string) error {
+			r, names, err := parseIDList(value)
+			if err != nil {
+				return err
+			}
+			ranges = append(ranges, r...)
+
+			r, err = m.resolveAliases(names)
+			ranges = append(ranges, r...)
+			return err
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if m.parserName != "" {
+		if err := checkIDWidth(ranges, m.parserName); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	prev := m.load()
+	next := newIDState(NewIDRanges(ranges), prev.satisfied)
+
+	for _, r := range next.ranges.Subtract(prev.ranges) {
+		added = append(added, r.String())
+	}
+	for _, r := range prev.ranges.Subtract(next.ranges) {
+		removed = append(removed, r.String())
+	}
+
+	m.state.Store(next)
+
+	return added, removed, nil
+}
+
+// checkIDWidth returns an error for ranges with no ids that fit in the id
+// field of the parsers' messages and warns of ranges with ids some can't
+// match. Given several parsers, ids need only fit in the widest.
+func checkIDWidth(ranges []IDRange, parserName string) error {
+	names := strings.Split(parserName, ",")
+	widest := names[0]
+	for _, name := range names {
+		if idBits[parserMsgTypes[name]] > idBits[parserMsgTypes[widest]] {
+			widest = name
+		}
+	}
+
+	for _, r := range ranges {
+		msgType := parserMsgTypes[widest]
+		bits := idBits[msgType]
+		limit := uint64(1)<<bits - 1
+		if uint64(r.Lo) > limit {
+			return fmt.Errorf("meter id %s can't occur in %s messages (-msgtype=%s), ids are %d bits wide and at most %d (0x%X)", r, msgType, widest, bits, limit, limit)
+		}
+
+		for _, name := range names {
+			msgType := parserMsgTypes[name]
+			bits := idBits[msgType]
+			limit := uint64(1)<<bits - 1
+			if uint64(r.Hi) > limit {
+				slog.Warn(fmt.Sprintf("meter ids %d-%d of %s can never match %s messages, ids are %d bits wide", max(uint64(r.Lo), limit+1), r.Hi, r, msgType, bits))
+			}
+		}
+	}
+
+	return nil
+}
+
+// Satisfy marks a meter as heard by -single, further messages from it are
+// filtered.
+func (m *MeterIDFilter) Satisfy(id uint) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	prev := m.load()
+	satisfied := make(UintMap)
+	for k := range prev.satisfied {
+		satisfied[k] = true
+	}
+	satisfied[id] = true
+
+	pending := prev.pending.Subtract(IDRanges{{id, id}})
+	m.state.Store(&idState{prev.ranges, satisfied, pending, matchIDs(pending)})
+}
+
+// Satisfied returns the number of meters heard by -single.
+func (m *MeterIDFilter) Satisfied() int {
+	return len(m.load().satisfied)
+}
+
+// SatisfiedIDs returns the sorted ids of meters heard by -single.
+func (m *MeterIDFilter) SatisfiedIDs() []uint {
+	return sortedKeys(m.load().satisfied)
+}
+
+func sortedKeys(m UintMap) (keys []uint) {
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return
+}
+
+// Missing returns the ranges of meters -single is still waiting on, ignoring
+// those in exclude.
+func (m *MeterIDFilter) Missing(exclude IDRanges) IDRanges {
+	return m.load().pending.Subtract(exclude)
+}
+
+// Pending returns the number of meters -single is still waiting on, ignoring
+// those in exclude.
+func (m *MeterIDFilter) Pending(exclude IDRanges) uint64 {
+	return m.Missing(exclude).Count()
+}
+
+func (m *MeterIDFilter) Filter(msg parse.Message) bool {
+	s := m.load()
+	return s.match != nil && s.match.Match(msg)
+}
+
+// Diff returns the sorted values in m but not prev and in prev but not m.
+func (m UintMap) Diff(prev UintMap) (added, removed []uint) {
+	for k := range m {
+		if !prev[k] {
+			added = append(added, k)
+		}
+	}
+	for k := range prev {
+		if !m[k] {
+			removed = append(removed, k)
+		}
+	}
+	sort.Slice(added, func(i, j int) bool { return added[i] < added[j] })
+	sort.Slice(removed, func(i, j int) bool { return removed[i] < removed[j] })
+	return
+}
+
+// TypeSpace describes the meter type codes a message type can carry.
+type TypeSpace struct {
+	Max uint
+
+	// Type codes making up each commodity. A protocol carrying a single
+	// commodity names it in Commodity instead and matches any code.
+	Commodities map[string][]uint
+	Commodity   string
+}
+
+// Commodity codes for ERT types are taken from meters.md. SCM+ endpoint
+// types are community reports and likely incomplete.
+var ertTypes = TypeSpace{
+	Max: 0x0F,
+	Commodities: map[string][]uint{
+		"electric": {4, 5, 7, 8},
+		"gas":      {2, 9, 12},
+		"water":    {11, 13},
+	},
+}
+
+// Type code spaces keyed by the value of each message's MsgType.
+var typeSpaces = map[string]TypeSpace{
+	"SCM": ertTypes,
+	"IDM": ertTypes,
+	"SCM+": {
+		Max: 0xFF,
+		Commodities: map[string][]uint{
+			"electric": {0x07, 0x08},
+			"gas":      {0x9C},
+			"water":    {0xAB},
+		},
+	},
+	"R900": {Max: 0xFF, Commodity: "water"},
+}
+
+// Width in bits of the meter id field of each message type.
+var idBits = map[string]uint{
+	"SCM":  26,
+	"SCM+": 32,
+	"IDM":  32,
+	"R900": 32,
+}
+
+// Message types produced by each parser.
+var parserMsgTypes = map[string]string{
+	"scm":     "SCM",
+	"scm+":    "SCM+",
+	"idm":     "IDM",
+	"r900":    "R900",
+	"r900bcd": "R900",
+}
+
+// MeterTypeFilter matches meter types given either as numeric codes or as
+// commodity names. SCM and SCM+ use different code spaces, so the filter is
+// resolved into a set of codes for each active message type, and matches
+// nothing until then. Like MeterIDFilter, the resolved codes are replaced
+// rather than mutated and compiled to an expression.
+type MeterTypeFilter struct {
+	UintMap
+	names []string
+
+	Filename   string
+	parserName string
+
+	resolved atomic.Value // *resolvedTypes
+	mu       sync.Mutex
+}
+
+type resolvedTypes struct {
+	types map[string]UintMap
+	any   map[string]bool
+	match *expr.Expr
+}
+
+// typeExpr returns an expression matching the resolved types.
+func (r *resolvedTypes) typeExpr() string {
+	var terms []string
+	for msgType, codes := range r.types {
+		if r.any[msgType] {
+			terms = append(terms, fmt.Sprintf("MsgType == %q", msgType))
+			continue
+		}
+		if len(codes) == 0 {
+			continue
+		}
+		var types []string
+		for _, code := range sortedKeys(codes) {
+			types = append(types, strconv.FormatUint(uint64(code), 10))
+		}
+		terms = append(terms, fmt.Sprintf("MsgType == %q && MeterType in (%s)", msgType, strings.Join(types, ", ")))
+	}
+	sort.Strings(terms)
+	return strings.Join(terms, " || ")
+}
+
+func NewMeterTypeFilter() *MeterTypeFilter {
+	return &MeterTypeFilter{UintMap: make(UintMap)}
+}
+
+func (m *MeterTypeFilter) String() string {
+	values := m.names
+	if s := m.UintMap.String(); s != "" {
+		values = append([]string{s}, values...)
+	}
+	return strings.Join(values, ",")
+}
+
+func (m *MeterTypeFilter) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		name := strings.ToLower(strings.TrimSpace(v))
+		if _, err := ParseUint(name, 64); err == nil {
+			if err := m.UintMap.Set(name); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if !isCommodity(name) {
+			return fmt.Errorf("invalid meter type %q, expected a number or one of: electric, gas, water", v)
+		}
+		m.names = append(m.names, name)
+	}
+
+	return nil
+}
+
+func isCommodity(name string) bool {
+	for _, space := range typeSpaces {
+		if _, ok := space.Commodities[name]; ok || space.Commodity == name {
+			return true
+		}
+	}
+	return false
+}
+
+// commodityOf returns the commodity a meter type code of msgType belongs
+// to, or blank if it isn't known.
+func commodityOf(msgType string, code uint) string {
+	space := typeSpaces[msgType]
+	if space.Commodity != "" {
+		return space.Commodity
+	}
+	for name, codes := range space.Commodities {
+		for _, c := range codes {
+			if c == code {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// Resolve expands the filter and the filter file, if any, into type codes
+// for the given parser, or comma separated list of parsers. Numeric codes
+// which can't occur in any parser's code space are an error.
+func (m *MeterTypeFilter) Resolve(parserName string) error {
+	_, _, err := m.resolve(parserName)
+	return err
+}
+
+// Reload re-reads the filter file and swaps in the resolved codes. Returns
+// the codes added and removed for any active message type.
+func (m *MeterTypeFilter) Reload() (added, removed []string, err error) {
+	addedCodes, removedCodes, err := m.resolve(m.parserName)
+	for _, code := range addedCodes {
+		added = append(added, strconv.FormatUint(uint64(code), 10))
+	}
+	for _, code := range removedCodes {
+		removed = append(removed, strconv.FormatUint(uint64(code), 10))
+	}
+	return
+}
+
+func (m *MeterTypeFilter) resolve(parserName string) (added, removed []uint, err error) {
+	var msgTypes []string
+	for _, name := range strings.Split(parserName, ",") {
+		msgType, ok := parserMsgTypes[name]
+		if !ok {
+			return nil, nil, fmt.Errorf("unknown message type %q", name)
+		}
+		msgTypes = append(msgTypes, msgType)
+	}
+
+	// Merge the file with the command line without modifying the latter.
+	values := NewMeterTypeFilter()
+	for code := range m.UintMap {
+		values.UintMap[code] = true
+	}
+	values.names = append(values.names, m.names...)
+	if m.Filename != "" {
+		if err := ReadFilterFile(m.Filename, values.Set); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	r := &resolvedTypes{
+		types: make(map[string]UintMap),
+		any:   make(map[string]bool),
+	}
+
+	// Codes needn't occur in every message type's code space, only in one.
+	valid := make(UintMap)
+	var top uint
+	for _, msgType := range msgTypes {
+		space := typeSpaces[msgType]
+		top = max(top, space.Max)
+
+		codes := make(UintMap)
+		for code := range values.UintMap {
+			if code <= space.Max {
+				codes[code] = true
+				valid[code] = true
+			}
+		}
+
+		for _, name := range values.names {
+			if space.Commodity == name {
+				r.any[msgType] = true
+			}
+			for _, code := range space.Commodities[name] {
+				codes[code] = true
+			}
+		}
+
+		r.types[msgType] = codes
+	}
+
+	for _, code := range sortedKeys(values.UintMap) {
+		if !valid[code] {
+			return nil, nil, fmt.Errorf("type %d can't occur in %s messages, valid types are 0-%d", code, parserName, top)
+		}
+	}
+
+	if r.match, err = compileMatch(r.typeExpr()); err != nil {
+		return nil, nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	prev, _ := m.resolved.Load().(*resolvedTypes)
+	addedCodes, removedCodes := make(UintMap), make(UintMap)
+	for msgType, codes := range r.types {
+		var prevCodes UintMap
+		if prev != nil {
+			prevCodes = prev.types[msgType]
+		}
+		a, rm := codes.Diff(prevCodes)
+		for _, code := range a {
+			addedCodes[code] = true
+		}
+		for _, code := range rm {
+			removedCodes[code] = true
+		}
+	}
+
+	m.parserName = parserName
+	m.resolved.Store(r)
+
+	return sortedKeys(addedCodes), sortedKeys(removedCodes), nil
+}
+
+// Codes returns the sorted type codes the filter matches for a message type.
+func (m *MeterTypeFilter) Codes(msgType string) (codes []uint) {
+	r, ok := m.resolved.Load().(*resolvedTypes)
+	if !ok {
+		return nil
+	}
+	for code := range r.types[msgType] {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool { return codes[i] < codes[j] })
+	return
+}
+
+func (m *MeterTypeFilter) Filter(msg parse.Message) bool {
+	r, ok := m.resolved.Load().(*resolvedTypes)
+	return ok && r.match != nil && r.match.Match(msg)
+}
+
+type reloadableFilter struct {
+	Name     string
+	Filename string
+	Reload   func() (added, removed []string, err error)
+}
+
+// filterFiles lists the filters loaded from a file.
+func (rcvr *Receiver) filterFiles() (filters []reloadableFilter) {
+	for _, f := range []reloadableFilter{
+		// Aliases are reloaded first so id filters resolve the new names.
+		{"Aliases", *aliasFile, rcvr.aliases.Reload},
+		{"MeterDB", *meterDBFile, rcvr.aliases.Reload},
+		{"FilterID", *meterIDFile, rcvr.meterID.Reload},
+		{"FilterType", *meterTypeFile, rcvr.meterType.Reload},
+		{"ExcludeID", *excludeIDFile, rcvr.excludeID.Reload},
+		{"ExcludeType", *excludeTypeFile, rcvr.excludeType.Reload},
+	} {
+		if f.Filename != "" {
+			filters = append(filters, f)
+		}
+	}
+	return
+}
+
+// ReloadFilters re-reads filter files and logs the changes.
+func (rcvr *Receiver) ReloadFilters() {
+	for _, f := range rcvr.filterFiles() {
+		added, removed, err := f.Reload()
+		if err != nil {
+			slog.Error("reloading filter file", "filter", f.Name, "err", err)
+		} else {
+			log.Printf("%s reloaded: added %s removed %s\n", f.Name, added, removed)
+		}
+	}
+}
+
+// WatchFilters reloads filter files when their modification time changes,
+// checked every poll, until ctx is done. SIGHUP reloads them along with
+// reopening output files, see notifyHangup.
+func (rcvr *Receiver) WatchFilters(ctx context.Context, poll time.Duration) {
+	modTimes := func() (times []time.Time) {
+		for _, f := range rcvr.filterFiles() {
+			if info, err := os.Stat(f.Filename); err == nil {
+				times = append(times, info.ModTime())
+			} else {
+				times = append(times, time.Time{})
+			}
+		}
+		return
+	}
+
+	ticker := time.NewTicker(poll)
+	defer ticker.Stop()
+
+	last := modTimes()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			current := modTimes()
+			changed := false
+			for idx := range current {
+				if !current[idx].Equal(last[idx]) {
+					changed = true
+				}
+			}
+			if changed {
+				log.Println("Filter files changed, reloading")
+				rcvr.ReloadFilters()
+				last = current
+			}
+		}
+	}
+}
+
+// Zero values of each message type, used to validate field and flag names.
+var messageTypes = []parse.Message{scm.SCM{}, scmplus.SCM{}, idm.IDM{}, r900.R900{}}
+
+// NewExprFilter compiles a -filter expression. Fields must belong to at least
+// one message type.
+func NewExprFilter(src string) (*expr.Expr, error) {
+	return expr.Compile(src, messageField)
+}
+
+// messageField describes the named field of the message types having it. A
+// field's range is the widest of its message types', unbounded if any of them
+// computes it rather than storing it as an unsigned integer.
+func messageField(name string) (field expr.Field, found bool) {
+	bounded := true
+	for _, msg := range messageTypes {
+		fr, ok := msg.(parse.FieldReporter)
+		if !ok {
+			continue
+		}
+		v, ok := fr.Field(name)
+		if !ok {
+			continue
+		}
+
+		kind := expr.Number
+		if v.IsString {
+			kind = expr.String
+		}
+		if found && kind != field.Kind {
+			// Differs between message types, so checked when evaluated.
+			return expr.Field{}, true
+		}
+		field.Kind = kind
+		found = true
+
+		max := fieldMax(msg, name)
+		if max == 0 {
+			bounded = false
+		}
+		field.Max = math.Max(field.Max, max)
+	}
+
+	if !bounded || field.Kind != expr.Number {
+		field.Max = 0
+	}
+	return field, found
+}
+
+// fieldMax returns the largest value of msg's unsigned integer or boolean
+// field, 0 if msg doesn't store the field as one.
+func fieldMax(msg parse.Message, name string) float64 {
+	v := reflect.ValueOf(msg).FieldByName(name)
+	if !v.IsValid() {
+		return 0
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		return 1
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uint:
+		return math.Ldexp(1, v.Type().Bits()) - 1
+	}
+	return 0
+}
+
+// FlagFilter matches messages with any of the named flags set. Without
+// names, it matches messages with any flag set. Messages which don't report
+// a named flag don't match.
+type FlagFilter struct {
+	Names []string
+}
+
+// NewFlagFilter returns a filter for the named flags, matched without regard
+// to case.
+func NewFlagFilter(names []string) (*FlagFilter, error) {
+	known := make(map[string]string)
+	var valid []string
+	for _, msg := range messageTypes {
+		fr, ok := msg.(parse.FlagReporter)
+		if !ok {
+			continue
+		}
+		for name := range fr.Flags() {
+			if _, ok := known[strings.ToLower(name)]; !ok {
+				valid = append(valid, name)
+			}
+			known[strings.ToLower(name)] = name
+		}
+	}
+	sort.Strings(valid)
+
+	ff := &FlagFilter{}
+	for _, name := range names {
+		canonical, ok := known[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return nil, fmt.Errorf("unknown flag %q, expected one of: %s", name, strings.Join(valid, ", "))
+		}
+		ff.Names = append(ff.Names, canonical)
+	}
+
+	return ff, nil
+}
+
+func (ff *FlagFilter) Filter(msg parse.Message) bool {
+	fr, ok := msg.(parse.FlagReporter)
+	if !ok {
+		return false
+	}
+	flags := fr.Flags()
+
+	if len(ff.Names) == 0 {
+		for _, v := range flags {
+			if v != 0 {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, name := range ff.Names {
+		if flags[name] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// UniqueFilter is -unique, see filter.Unique.
+type UniqueFilter = filter.Unique
+
+func NewUniqueFilter(window time.Duration, maxMeters int) *UniqueFilter {
+	return filter.NewUnique(filter.Window(window), filter.MaxMeters(maxMeters))
+}
+
+// uniqueKey identifies a meter in the caches of per-meter state.
+type uniqueKey struct {
+	ID      uint32
+	MsgType string
+}
+
+// Built-in filters are registered like any other so -customfilter and the
+// dedicated flags share a single construction path. Filters given by id or
+// type are reloadable flag values and so are added to the chain directly,
+// but may also be instantiated here.
+func init() {
+	filter.Register("id", func(arg string) (parse.MessageFilter, error) {
+		f := NewMeterIDFilter()
+		if err := f.Set(arg); err != nil {
+			return nil, err
+		}
+		if err := f.Resolve(*msgType); err != nil {
+			return nil, err
+		}
+		return f, nil
+	})
+	filter.Register("type", func(arg string) (parse.MessageFilter, error) {
+		f := NewMeterTypeFilter()
+		if err := f.Set(arg); err != nil {
+			return nil, err
+		}
+		if err := f.Resolve(*msgType); err != nil {
+			return nil, err
+		}
+		return f, nil
+	})
+	filter.Register("expr", func(arg string) (parse.MessageFilter, error) {
+		e, err := NewExprFilter(arg)
+		if err != nil {
+			return nil, err
+		}
+		return e, nil
+	})
+	filter.Register("flag", func(arg string) (parse.MessageFilter, error) {
+		var names []string
+		if arg != "" {
+			names = strings.Split(arg, ",")
+		}
+		ff, err := NewFlagFilter(names)
+		if err != nil {
+			return nil, err
+		}
+		return ff, nil
+	})
+	filter.Register("onchange", func(arg string) (parse.MessageFilter, error) {
+		var fields []string
+		for _, field := range strings.Split(arg, ",") {
+			if field = strings.TrimSpace(field); field != "" {
+				fields = append(fields, field)
+			}
+		}
+		return NewOnChangeFilter(fields, *onChangeHeartbeat, *onChangeMaxMeters), nil
+	})
+	filter.Register("crossproto", func(arg string) (parse.MessageFilter, error) {
+		window := *dedupeWindow
+		if arg != "" {
+			var err error
+			if window, err = time.ParseDuration(arg); err != nil {
+				return nil, err
+			}
+		}
+		return NewCrossProtoFilter(window, *dedupeMaxMeters), nil
+	})
+	filter.Register("maxdelta", func(arg string) (parse.MessageFilter, error) {
+		md := NewMaxDeltaFilter(*maxDelta, *maxDeltaPercent, *maxDeltaMaxMeters)
+		if strings.HasSuffix(arg, "%") {
+			percent, err := strconv.ParseFloat(strings.TrimSuffix(arg, "%"), 64)
+			if err != nil {
+				return nil, err
+			}
+			md.Delta, md.Percent = 0, percent
+		} else if arg != "" {
+			delta, err := strconv.ParseUint(arg, 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			md.Delta, md.Percent = delta, 0
+		}
+		if md.Delta == 0 && md.Percent == 0 {
+			return nil, fmt.Errorf("expected a number of units or a percentage")
+		}
+		md.Log = *logRejected
+		return md, nil
+	})
+	filter.Register("unique", func(arg string) (parse.MessageFilter, error) {
+		window := *uniqueWindow
+		if arg != "" {
+			var err error
+			if window, err = time.ParseDuration(arg); err != nil {
+				return nil, err
+			}
+		}
+		return NewUniqueFilter(window, *uniqueMaxMeters), nil
+	})
+}
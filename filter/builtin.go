@@ -0,0 +1,253 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package filter
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/bemasher/rtlamr/clock"
+	"github.com/bemasher/rtlamr/lru"
+	"github.com/bemasher/rtlamr/parse"
+)
+
+// Option configures a built-in filter. Options a filter doesn't use are
+// ignored.
+type Option func(*options)
+
+type options struct {
+	window    time.Duration
+	maxMeters int
+	clock     clock.Clock
+}
+
+func newOptions(opts []Option) options {
+	o := options{clock: clock.Real}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// Window sets how long a stateful filter remembers a message, 0 for
+// indefinitely.
+func Window(d time.Duration) Option {
+	return func(o *options) { o.window = d }
+}
+
+// MaxMeters limits the number of meters a stateful filter tracks, the least
+// recently heard is forgotten first. 0 is unlimited.
+func MaxMeters(n int) Option {
+	return func(o *options) { o.maxMeters = n }
+}
+
+// Clock sets the source of the current time, clock.Real by default. Tests
+// step a clock.Fake.
+func Clock(c clock.Clock) Option {
+	return func(o *options) { o.clock = c }
+}
+
+// Func adapts a function to a filter.
+type Func func(parse.Message) bool
+
+func (f Func) Filter(msg parse.Message) bool {
+	return f(msg)
+}
+
+// IDSet matches messages from any of its meter ids.
+type IDSet map[uint32]bool
+
+// IDs returns a filter matching the given meter ids.
+func IDs(ids ...uint32) IDSet {
+	set := make(IDSet, len(ids))
+	for _, id := range ids {
+		set[id] = true
+	}
+	return set
+}
+
+func (set IDSet) Filter(msg parse.Message) bool {
+	return set[msg.MeterID()]
+}
+
+// TypeSet matches messages from any of its ERT meter types.
+type TypeSet map[uint8]bool
+
+// Types returns a filter matching the given ERT meter types.
+func Types(types ...uint8) TypeSet {
+	set := make(TypeSet, len(types))
+	for _, t := range types {
+		set[t] = true
+	}
+	return set
+}
+
+func (set TypeSet) Filter(msg parse.Message) bool {
+	return set[msg.MeterType()]
+}
+
+type allFilter []parse.MessageFilter
+
+// All returns a filter matching messages every one of filters matches,
+// evaluated in order up to the first which doesn't.
+func All(filters ...parse.MessageFilter) parse.MessageFilter {
+	return allFilter(filters)
+}
+
+func (filters allFilter) Filter(msg parse.Message) bool {
+	for _, f := range filters {
+		if !f.Filter(msg) {
+			return false
+		}
+	}
+	return true
+}
+
+type anyFilter []parse.MessageFilter
+
+// Any returns a filter matching messages any of filters matches, evaluated
+// in order up to the first which does.
+func Any(filters ...parse.MessageFilter) parse.MessageFilter {
+	return anyFilter(filters)
+}
+
+func (filters anyFilter) Filter(msg parse.Message) bool {
+	for _, f := range filters {
+		if f.Filter(msg) {
+			return true
+		}
+	}
+	return false
+}
+
+type notFilter struct {
+	parse.MessageFilter
+}
+
+// Not returns a filter matching messages f doesn't.
+func Not(f parse.MessageFilter) parse.MessageFilter {
+	return notFilter{f}
+}
+
+func (nf notFilter) Filter(msg parse.Message) bool {
+	return !nf.MessageFilter.Filter(msg)
+}
+
+// Unique drops messages whose checksum matches the last message passed from
+// the same meter and message type. With a Window, a message is also passed
+// once the window has elapsed since the last one passed. Configured by the
+// Window, MaxMeters and Clock options.
+type Unique struct {
+	Window time.Duration
+
+	seen  *lru.Cache
+	clock clock.Clock
+}
+
+type uniqueKey struct {
+	ID      uint32
+	MsgType string
+}
+
+type uniqueEntry struct {
+	Checksum []byte
+	Emitted  time.Time
+}
+
+// UniqueState is the last message Unique passed for a meter.
+type UniqueState struct {
+	ID       uint32
+	MsgType  string
+	Checksum string
+	Emitted  time.Time
+}
+
+// NewUnique returns a Unique filter.
+func NewUnique(opts ...Option) *Unique {
+	o := newOptions(opts)
+	return &Unique{
+		Window: o.window,
+		seen:   lru.New(o.maxMeters),
+		clock:  o.clock,
+	}
+}
+
+// Len returns the number of meters tracked.
+func (u *Unique) Len() int {
+	return u.seen.Len()
+}
+
+// Evictions returns the number of meters forgotten to stay within the
+// maximum.
+func (u *Unique) Evictions() uint64 {
+	return u.seen.Evictions
+}
+
+// Snapshot returns the state of every tracked meter from least to most
+// recently heard.
+func (u *Unique) Snapshot() (states []UniqueState) {
+	u.seen.Range(func(key, value interface{}) {
+		k, v := key.(uniqueKey), value.(uniqueEntry)
+		states = append(states, UniqueState{k.ID, k.MsgType, fmt.Sprintf("%02X", v.Checksum), v.Emitted})
+	})
+	return
+}
+
+// Restore adds states from a previous Snapshot. Nothing is added if any of
+// the states are invalid.
+func (u *Unique) Restore(states []UniqueState) error {
+	entries := make([]uniqueEntry, len(states))
+	for idx, s := range states {
+		checksum, err := hex.DecodeString(s.Checksum)
+		if err != nil {
+			return fmt.Errorf("meter %d: invalid checksum %q", s.ID, s.Checksum)
+		}
+		entries[idx] = uniqueEntry{checksum, s.Emitted}
+	}
+
+	for idx, s := range states {
+		u.seen.Add(uniqueKey{s.ID, s.MsgType}, entries[idx])
+	}
+	return nil
+}
+
+func (u *Unique) Stateful() {}
+
+func (u *Unique) Filter(msg parse.Message) bool {
+	// Don't let packets with bad checksums poison the filter.
+	if !msg.ChecksumOK() {
+		return true
+	}
+
+	checksum := msg.Checksum()
+	key := uniqueKey{msg.MeterID(), msg.MsgType()}
+	now := u.clock.Now()
+
+	if v, ok := u.seen.Get(key); ok && bytes.Equal(v.(uniqueEntry).Checksum, checksum) {
+		if u.Window == 0 || now.Sub(v.(uniqueEntry).Emitted) < u.Window {
+			return false
+		}
+	}
+
+	entry := uniqueEntry{make([]byte, len(checksum)), now}
+	copy(entry.Checksum, checksum)
+	u.seen.Add(key, entry)
+
+	return true
+}
@@ -0,0 +1,90 @@
+package filter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bemasher/rtlamr/clock"
+	"github.com/bemasher/rtlamr/parse"
+	"github.com/bemasher/rtlamr/scm"
+)
+
+// evenConsumption is a custom filter, as an embedding program might write.
+type evenConsumption struct{}
+
+func (evenConsumption) Filter(msg parse.Message) bool {
+	return msg.MeterConsumption()%2 == 0
+}
+
+func TestChainWithCustomFilter(t *testing.T) {
+	fc := parse.FilterChain{Mode: parse.MatchAll}
+	fc.Add("ids", IDs(1, 2))
+	fc.Add("more ids", IDs(3)) // Grouped with the first, either set matches.
+	fc.Add("types", Types(7))
+	fc.Add("even", evenConsumption{})
+	fc.Exclude("not 2", IDs(2))
+	fc.AddStateful("unique", NewUnique())
+
+	for _, tc := range []struct {
+		msg  scm.SCM
+		expt bool
+	}{
+		{scm.SCM{ID: 1, Type: 7, Consumption: 10, ChecksumVal: 1}, true},
+		{scm.SCM{ID: 1, Type: 7, Consumption: 10, ChecksumVal: 1}, false}, // Duplicate.
+		{scm.SCM{ID: 3, Type: 7, Consumption: 12, ChecksumVal: 2}, true},
+		{scm.SCM{ID: 4, Type: 7, Consumption: 10, ChecksumVal: 3}, false}, // Not in either id set.
+		{scm.SCM{ID: 1, Type: 8, Consumption: 10, ChecksumVal: 4}, false}, // Wrong type.
+		{scm.SCM{ID: 1, Type: 7, Consumption: 11, ChecksumVal: 5}, false}, // Odd.
+		{scm.SCM{ID: 2, Type: 7, Consumption: 10, ChecksumVal: 6}, false}, // Excluded.
+	} {
+		if recv := fc.Match(tc.msg); recv != tc.expt {
+			t.Errorf("%+v: expected %t got %t", tc.msg, tc.expt, recv)
+		}
+	}
+
+	// Any mode needs only one group, the custom filter here.
+	fc = parse.FilterChain{Mode: parse.MatchAny}
+	fc.Add("ids", IDs(1))
+	fc.Add("even", evenConsumption{})
+	if !fc.Match(scm.SCM{ID: 5, Consumption: 2}) {
+		t.Error("expected a match by the custom filter alone")
+	}
+}
+
+func TestCompose(t *testing.T) {
+	big := Func(func(msg parse.Message) bool { return msg.MeterConsumption() > 100 })
+	f := Any(All(IDs(1), big), Not(Types(7, 8)))
+
+	for _, tc := range []struct {
+		msg  scm.SCM
+		expt bool
+	}{
+		{scm.SCM{ID: 1, Type: 7, Consumption: 200}, true},
+		{scm.SCM{ID: 1, Type: 7, Consumption: 50}, false},
+		{scm.SCM{ID: 2, Type: 7, Consumption: 200}, false},
+		{scm.SCM{ID: 2, Type: 9, Consumption: 0}, true},
+	} {
+		if recv := f.Filter(tc.msg); recv != tc.expt {
+			t.Errorf("%+v: expected %t got %t", tc.msg, tc.expt, recv)
+		}
+	}
+}
+
+func TestUniqueOptions(t *testing.T) {
+	fake := clock.NewFake(time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC))
+	u := NewUnique(Window(time.Minute), MaxMeters(1), Clock(fake))
+
+	msg := scm.SCM{ID: 1, ChecksumVal: 1}
+	if !u.Filter(msg) || u.Filter(msg) {
+		t.Fatal("expected only the first message to pass")
+	}
+	fake.Advance(time.Minute)
+	if !u.Filter(msg) {
+		t.Error("expected the message to pass once the window elapsed")
+	}
+
+	u.Filter(scm.SCM{ID: 2, ChecksumVal: 1})
+	if u.Len() != 1 || u.Evictions() != 1 {
+		t.Errorf("expected 1 meter and 1 eviction got %d and %d", u.Len(), u.Evictions())
+	}
+}
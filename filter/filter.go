@@ -0,0 +1,150 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package filter provides message filters and a registry of them. Filters
+// registered here can be instantiated by name, such as by rtlamr's
+// -customfilter flag, so embedding programs and plugins can contribute their
+// own.
+//
+// Filters are combined with a parse.FilterChain. Filters added with Add are
+// grouped by their Go type: a message matches a group if any of its filters
+// match, so two IDSets added separately pass either set's meters. The chain's
+// Mode then requires every group (MatchAll) or any group (MatchAny) to match.
+// Messages passing the groups are dropped if any filter added with Exclude
+// matches, and finally must pass every stateful filter, such as Unique, in
+// the order they were added. All, Any and Not compose filters before adding
+// them where the grouping by type doesn't express the intent.
+package filter
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/bemasher/rtlamr/parse"
+)
+
+// Factory constructs a filter from its argument. Arguments are free-form and
+// interpreted by each filter, an invalid argument should return an error.
+// Filters which record the messages they pass should implement
+// parse.StatefulFilter.
+type Factory func(arg string) (parse.MessageFilter, error)
+
+var (
+	factoryMutex sync.Mutex
+	factories    = make(map[string]Factory)
+)
+
+// Register makes a filter available by name. Register panics if factory is
+// nil or a filter is already registered with the same name.
+func Register(name string, factory Factory) {
+	factoryMutex.Lock()
+	defer factoryMutex.Unlock()
+
+	if factory == nil {
+		panic("filter: factory is nil")
+	}
+	if _, dup := factories[name]; dup {
+		panic(fmt.Sprintf("filter: filter already registered (%s)", name))
+	}
+	factories[name] = factory
+}
+
+// Names returns the names of all registered filters in sorted order.
+func Names() (names []string) {
+	factoryMutex.Lock()
+	defer factoryMutex.Unlock()
+
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return
+}
+
+// New instantiates the named filter with the given argument.
+func New(name, arg string) (parse.MessageFilter, error) {
+	factoryMutex.Lock()
+	factory, exists := factories[name]
+	factoryMutex.Unlock()
+
+	if !exists {
+		return nil, fmt.Errorf("unknown filter %q, expected one of: %s", name, strings.Join(Names(), ", "))
+	}
+
+	f, err := factory(arg)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+
+	return f, nil
+}
+
+// Spec names a registered filter and its argument.
+type Spec struct {
+	Name, Arg string
+}
+
+func (s Spec) String() string {
+	if s.Arg == "" {
+		return s.Name
+	}
+	return s.Name + ":" + s.Arg
+}
+
+// Specs is a flag value collecting filters given as name:arg, in the order
+// they were given. The argument may be omitted.
+type Specs []Spec
+
+func (specs *Specs) String() string {
+	var values []string
+	for _, s := range *specs {
+		values = append(values, s.String())
+	}
+	return strings.Join(values, ",")
+}
+
+func (specs *Specs) Set(value string) error {
+	s := Spec{Name: value}
+	if idx := strings.Index(value, ":"); idx != -1 {
+		s.Name, s.Arg = value[:idx], value[idx+1:]
+	}
+
+	factoryMutex.Lock()
+	_, exists := factories[s.Name]
+	factoryMutex.Unlock()
+
+	if !exists {
+		return fmt.Errorf("unknown filter %q, expected one of: %s", s.Name, strings.Join(Names(), ", "))
+	}
+
+	*specs = append(*specs, s)
+	return nil
+}
+
+// New instantiates each filter in order.
+func (specs Specs) New() (filters []parse.MessageFilter, err error) {
+	for _, s := range specs {
+		f, err := New(s.Name, s.Arg)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, f)
+	}
+	return
+}
@@ -0,0 +1,56 @@
+package filter
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/bemasher/rtlamr/parse"
+)
+
+type idFilter uint32
+
+func (f idFilter) Filter(msg parse.Message) bool {
+	return msg.MeterID() == uint32(f)
+}
+
+func TestRegistry(t *testing.T) {
+	Register("test", func(arg string) (parse.MessageFilter, error) {
+		if arg == "" {
+			return nil, errors.New("expected an argument")
+		}
+		return idFilter(len(arg)), nil
+	})
+
+	var specs Specs
+	for _, value := range []string{"test:abc", "test:a:b"} {
+		if err := specs.Set(value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if recv, expt := specs.String(), "test:abc,test:a:b"; recv != expt {
+		t.Fatalf("Expected %s got %s\n", expt, recv)
+	}
+
+	filters, err := specs.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(filters) != 2 || filters[0] != idFilter(3) || filters[1] != idFilter(3) {
+		t.Fatalf("Expected filters in order got %v\n", filters)
+	}
+
+	if _, err := New("test", ""); err == nil || !strings.HasPrefix(err.Error(), "test:") {
+		t.Fatalf("Expected error naming the filter got %v\n", err)
+	}
+	if err := specs.Set("missing:1"); err == nil || !strings.Contains(err.Error(), "test") {
+		t.Fatalf("Expected error listing registered filters got %v\n", err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("Expected duplicate registration to panic")
+		}
+	}()
+	Register("test", func(string) (parse.MessageFilter, error) { return nil, nil })
+}
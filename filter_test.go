@@ -0,0 +1,650 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bemasher/rtlamr/clock"
+	"github.com/bemasher/rtlamr/filter"
+	"github.com/bemasher/rtlamr/idm"
+	"github.com/bemasher/rtlamr/parse"
+	"github.com/bemasher/rtlamr/r900"
+	"github.com/bemasher/rtlamr/scm"
+	"github.com/bemasher/rtlamr/scmplus"
+)
+
+func TestMeterTypeFilter(t *testing.T) {
+	mtf := NewMeterTypeFilter()
+	if err := mtf.Set("gas,8"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mtf.Resolve("scm"); err != nil {
+		t.Fatal(err)
+	}
+	for code, expt := range map[uint8]bool{2: true, 8: true, 9: true, 12: true, 4: false, 11: false} {
+		if recv := mtf.Filter(scm.SCM{ID: 1, Type: code}); recv != expt {
+			t.Fatalf("SCM type %d: expected %t got %t\n", code, expt, recv)
+		}
+	}
+
+	if err := mtf.Resolve("scm+"); err != nil {
+		t.Fatal(err)
+	}
+	for code, expt := range map[uint8]bool{0x9C: true, 8: true, 2: false, 9: false} {
+		if recv := mtf.Filter(scmplus.SCM{EndpointID: 1, EndpointType: code}); recv != expt {
+			t.Fatalf("SCM+ type %d: expected %t got %t\n", code, expt, recv)
+		}
+	}
+
+	// Each message type decoded matches its own codes.
+	if err := mtf.Resolve("scm,scm+"); err != nil {
+		t.Fatal(err)
+	}
+	if !mtf.Filter(scm.SCM{ID: 1, Type: 2}) || !mtf.Filter(scmplus.SCM{EndpointID: 1, EndpointType: 0x9C}) {
+		t.Fatal("Expected gas meters of both message types to match")
+	}
+	if mtf.Filter(scmplus.SCM{EndpointID: 1, EndpointType: 2}) {
+		t.Fatal("Expected SCM gas type not to match SCM+")
+	}
+}
+
+func TestMeterTypeFilterInvalid(t *testing.T) {
+	mtf := NewMeterTypeFilter()
+	if err := mtf.Set("steam"); err == nil {
+		t.Fatal("Expected error for unknown commodity")
+	}
+
+	if err := mtf.Set("156"); err != nil {
+		t.Fatal(err)
+	}
+	if err := mtf.Resolve("scm"); err == nil {
+		t.Fatal("Expected error for type out of range of scm")
+	}
+	if err := mtf.Resolve("scm+"); err != nil {
+		t.Fatal(err)
+	}
+	// The type need only occur in one of the message types decoded.
+	if err := mtf.Resolve("scm,scm+"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMeterIDFilterWidth(t *testing.T) {
+	ids := NewMeterIDFilter()
+	if err := ids.Set("0x3FFFFFF"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ids.Resolve("scm"); err != nil {
+		t.Fatal(err)
+	}
+	if !ids.Filter(scm.SCM{ID: 0x3FFFFFF}) {
+		t.Fatal("Expected hex id to match")
+	}
+
+	if err := ids.Set("0x4000000"); err != nil {
+		t.Fatal(err)
+	}
+	err := ids.Resolve("scm")
+	if err == nil || !strings.Contains(err.Error(), "msgtype=scm") {
+		t.Fatalf("Expected error naming the message type got %v\n", err)
+	}
+	if err := ids.Resolve("scm+"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ids.Resolve("scm,idm"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ids.Resolve("scm,bogus"); err == nil {
+		t.Fatal("Expected error for an unknown message type")
+	}
+}
+
+func TestMeterIDFilterAliases(t *testing.T) {
+	dir, err := ioutil.TempDir("", "aliases")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	aliases := &Aliases{Filename: filepath.Join(dir, "aliases.csv")}
+
+	if err := ioutil.WriteFile(aliases.Filename, []byte("# id, name\n12345678,house-water,water\n0x10,house-gas\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := aliases.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	ids := NewMeterIDFilter()
+	ids.Aliases = aliases
+	if err := ids.Set("house-gas,20"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ids.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if recv, expt := ids.Ranges().String(), "16,20"; recv != expt {
+		t.Fatalf("Expected %s got %s\n", expt, recv)
+	}
+
+	msg := parse.LogMessage{Message: scm.SCM{ID: 12345678}}
+	aliases.Apply(&msg)
+	if msg.MeterName != "house-water" || msg.Commodity != "water" {
+		t.Fatalf("Expected house-water and water got %q and %q\n", msg.MeterName, msg.Commodity)
+	}
+
+	// Names which are no longer aliased are an error on reload.
+	if err := ioutil.WriteFile(aliases.Filename, []byte("12345678,house-water\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, removed, err := aliases.Reload(); err != nil || len(removed) != 1 {
+		t.Fatalf("Expected house-gas removed got %s %v\n", removed, err)
+	}
+	if _, _, err := ids.Reload(); err == nil || !strings.Contains(err.Error(), "house-gas") {
+		t.Fatalf("Expected error naming house-gas got %v\n", err)
+	}
+
+	for _, table := range []string{"1,xxx\n", "1,a\n2,a\n", "1,a,steam\n", "1\n"} {
+		if _, err := readAliases(strings.NewReader(table)); err == nil {
+			t.Fatalf("%q: expected error\n", table)
+		}
+	}
+}
+
+func TestReadFilterList(t *testing.T) {
+	ids := make(UintMap)
+	list := "# meters\n12345678\n\n  23456789 # garage\n"
+	if err := ReadFilterList(strings.NewReader(list), ids.Set); err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 2 || !ids[12345678] || !ids[23456789] {
+		t.Fatalf("Expected ids 12345678 and 23456789 got %s\n", ids)
+	}
+
+	err := ReadFilterList(strings.NewReader("12345678\nmeter\n"), ids.Set)
+	if err == nil || !strings.HasPrefix(err.Error(), "line 2:") {
+		t.Fatalf("Expected error on line 2 got %v\n", err)
+	}
+}
+
+func TestWatchFilters(t *testing.T) {
+	defer func(name string) { *meterIDFile = name }(*meterIDFile)
+
+	*meterIDFile = filepath.Join(t.TempDir(), "filterid")
+	if err := os.WriteFile(*meterIDFile, []byte("1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	rcvr := &Receiver{meterID: NewMeterIDFilter()}
+	rcvr.meterID.Filename = *meterIDFile
+	if _, _, err := rcvr.meterID.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		rcvr.WatchFilters(ctx, 10*time.Millisecond)
+	}()
+
+	// Changes are picked up without a signal.
+	time.Sleep(50 * time.Millisecond)
+	if err := os.WriteFile(*meterIDFile, []byte("2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(*meterIDFile, time.Now(), time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); rcvr.meterID.Ranges().String() != "2"; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected ranges 2 got %s\n", rcvr.meterID.Ranges())
+		}
+	}
+
+	// The watcher stops with its context.
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("WatchFilters didn't return after its context was cancelled")
+	}
+}
+
+func TestMeterIDFilterReload(t *testing.T) {
+	file, err := ioutil.TempFile("", "filterid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.Close()
+
+	write := func(list string) {
+		if err := ioutil.WriteFile(file.Name(), []byte(list), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(recv, expt []string) {
+		t.Helper()
+		if fmt.Sprint(recv) != fmt.Sprint(expt) {
+			t.Fatalf("Expected %s got %s\n", expt, recv)
+		}
+	}
+
+	mif := NewMeterIDFilter()
+	mif.Filename = file.Name()
+	if err := mif.Set("3"); err != nil {
+		t.Fatal(err)
+	}
+
+	write("1\n2\n")
+	added, removed, err := mif.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(added, []string{"1-3"})
+	check(removed, nil)
+
+	old := mif.Ranges()
+
+	write("2\n4\n")
+	if added, removed, err = mif.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	check(added, []string{"4"})
+	check(removed, []string{"1"})
+
+	// The previous set is replaced, not modified.
+	if old.String() != "1-3" {
+		t.Fatalf("Previous id set was modified: %s\n", old)
+	}
+
+	// Meters satisfied by -single stay filtered.
+	mif.Satisfy(2)
+	if added, removed, err = mif.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	check(added, nil)
+	check(removed, nil)
+	if mif.Filter(scm.SCM{ID: 2}) || !mif.Filter(scm.SCM{ID: 4}) {
+		t.Fatal("Expected meter 2 to be filtered and meter 4 to pass")
+	}
+
+	// A malformed file leaves the current set in place.
+	write("2\nmeter\n")
+	if _, _, err = mif.Reload(); err == nil {
+		t.Fatal("Expected error for malformed file")
+	}
+	if recv := mif.Ranges().String(); recv != "2-4" {
+		t.Fatalf("Expected 2-4 got %s\n", recv)
+	}
+}
+
+func TestExcludeFilter(t *testing.T) {
+	include := NewMeterIDFilter()
+	if err := include.Set("1,2"); err != nil {
+		t.Fatal(err)
+	}
+	exclude := NewMeterIDFilter()
+	if err := exclude.Set("2"); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []*MeterIDFilter{include, exclude} {
+		if _, _, err := f.Reload(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var fc parse.FilterChain
+	fc.Exclude("exclude", exclude)
+	fc.Add("include", include)
+
+	// Exclusions win over inclusions of the same id.
+	for id, expt := range map[uint32]bool{1: true, 2: false, 3: false} {
+		if recv := fc.Match(scm.SCM{ID: id}); recv != expt {
+			t.Fatalf("Meter %d: expected %t got %t\n", id, expt, recv)
+		}
+	}
+
+	// Exclusions apply without any inclusions.
+	fc = parse.FilterChain{}
+	fc.Exclude("exclude", exclude)
+	for id, expt := range map[uint32]bool{1: true, 2: false, 3: true} {
+		if recv := fc.Match(scm.SCM{ID: id}); recv != expt {
+			t.Fatalf("Meter %d: expected %t got %t\n", id, expt, recv)
+		}
+	}
+}
+
+func TestMeterIDFilterSingle(t *testing.T) {
+	mif := NewMeterIDFilter()
+	if err := mif.Set("10,20-29"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := mif.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	exclude := NewIDRanges([]IDRange{{25, 29}})
+	if recv := mif.Pending(exclude); recv != 6 {
+		t.Fatalf("Expected 6 pending got %d\n", recv)
+	}
+
+	mif.Satisfy(21)
+	mif.Satisfy(10)
+	if recv := mif.Pending(exclude); recv != 4 {
+		t.Fatalf("Expected 4 pending got %d\n", recv)
+	}
+	if recv := mif.Satisfied(); recv != 2 {
+		t.Fatalf("Expected 2 satisfied got %d\n", recv)
+	}
+	if mif.Filter(scm.SCM{ID: 21}) || !mif.Filter(scm.SCM{ID: 22}) {
+		t.Fatal("Expected meter 21 to be filtered and meter 22 to pass")
+	}
+
+	// Hearing a meter again doesn't change what's missing.
+	mif.Satisfy(21)
+	if recv, expt := mif.Missing(exclude).String(), "20,22-24"; recv != expt {
+		t.Fatalf("Expected %s missing got %s\n", expt, recv)
+	}
+	if recv := mif.SatisfiedIDs(); len(recv) != 2 || recv[0] != 10 || recv[1] != 21 {
+		t.Fatalf("Expected satisfied ids [10 21] got %d\n", recv)
+	}
+}
+
+func TestUniqueFilterWindow(t *testing.T) {
+	fake := clock.NewFake(time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC))
+	uf := filter.NewUnique(filter.Window(15*time.Minute), filter.Clock(fake))
+
+	first := scm.SCM{ID: 1, Consumption: 100, ChecksumVal: 0x1234}
+	changed := scm.SCM{ID: 1, Consumption: 101, ChecksumVal: 0x4321}
+
+	for _, step := range []struct {
+		Elapsed time.Duration
+		Msg     parse.Message
+		Expt    bool
+	}{
+		{0, first, true},
+		{time.Minute, first, false},
+		{time.Minute, changed, true},
+		{14 * time.Minute, changed, false},
+		{time.Minute, changed, true},
+		{time.Minute, changed, false},
+	} {
+		fake.Advance(step.Elapsed)
+		if recv := uf.Filter(step.Msg); recv != step.Expt {
+			t.Fatalf("%s: expected %t got %t\n", fake.Now(), step.Expt, recv)
+		}
+	}
+
+	// Without a window duplicates are suppressed indefinitely.
+	uf = filter.NewUnique(filter.Clock(fake))
+	if !uf.Filter(first) {
+		t.Fatal("Expected first message to pass")
+	}
+	fake.Advance(24 * time.Hour)
+	if uf.Filter(first) {
+		t.Fatal("Expected duplicate message to be suppressed")
+	}
+}
+
+func TestUniqueFilterEviction(t *testing.T) {
+	uf := NewUniqueFilter(0, 2)
+	for _, id := range []uint32{1, 2, 1, 3} {
+		uf.Filter(scm.SCM{ID: id, ChecksumVal: 0x1234})
+	}
+
+	if uf.Len() != 2 || uf.Evictions() != 1 {
+		t.Fatalf("Expected 2 meters and 1 eviction got %d and %d\n", uf.Len(), uf.Evictions())
+	}
+
+	// Meter 2 was least recently heard and is no longer suppressed.
+	if !uf.Filter(scm.SCM{ID: 2, ChecksumVal: 0x1234}) {
+		t.Fatal("Expected evicted meter to pass")
+	}
+	if uf.Filter(scm.SCM{ID: 3, ChecksumVal: 0x1234}) {
+		t.Fatal("Expected tracked meter to be suppressed")
+	}
+}
+
+func TestFlagFilter(t *testing.T) {
+	tamper, err := NewFlagFilter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leak, err := NewFlagFilter([]string{"leak", "BackFlow"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for idx, c := range []struct {
+		Msg          parse.Message
+		Tamper, Leak bool
+	}{
+		{scm.SCM{ID: 1}, false, false},
+		{scm.SCM{ID: 1, TamperPhy: 1}, true, false},
+		{scmplus.SCM{EndpointID: 1, Tamper: 0x0100}, true, false},
+		{idm.IDM{TamperCounters: []byte{0, 0, 0, 0, 0, 0}}, false, false},
+		{idm.IDM{TamperCounters: []byte{0, 0, 2, 0, 0, 0}}, true, false},
+		{r900.R900{ID: 1, NoUse: 3}, false, false},
+		{r900.R900{ID: 1, Leak: 2}, true, true},
+		{r900.R900{ID: 1, BackFlow: 1}, true, true},
+	} {
+		if recv := tamper.Filter(c.Msg); recv != c.Tamper {
+			t.Fatalf("Case %d: expected tamper %t got %t\n", idx, c.Tamper, recv)
+		}
+		if recv := leak.Filter(c.Msg); recv != c.Leak {
+			t.Fatalf("Case %d: expected leak %t got %t\n", idx, c.Leak, recv)
+		}
+	}
+
+	if _, err := NewFlagFilter([]string{"Leek"}); err == nil {
+		t.Fatal("Expected error for unknown flag")
+	}
+}
+
+func TestExprFilter(t *testing.T) {
+	e, err := NewExprFilter(`Leak > 0 || TamperPhy > 0`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !e.Filter(r900.R900{Leak: 1}) || e.Filter(scm.SCM{}) {
+		t.Fatal("Expected only the leaking meter to match")
+	}
+
+	// Fields must exist in some message type.
+	if _, err := NewExprFilter(`Leek > 0`); err == nil {
+		t.Fatal("Expected error for unknown field")
+	}
+
+	// Literals are checked against the width of the field in the message
+	// types having it, computed fields are unbounded.
+	for src, expt := range map[string]string{
+		`Leak == 256`:             "column 9: 256 is out of range for Leak (0 to 255)",
+		`ERTType == "gas"`:        "column 12: ERTType is a number",
+		`TamperCounters > 100000`: "",
+		`ID == 4294967295`:        "",
+		`ID == 4294967296`:        "column 7: 4294967296 is out of range for ID",
+	} {
+		_, err := NewExprFilter(src)
+		if expt == "" && err != nil || expt != "" && (err == nil || !strings.HasPrefix(err.Error(), expt)) {
+			t.Fatalf("%s: expected %q got %v\n", src, expt, err)
+		}
+	}
+}
+
+func TestFilterExprs(t *testing.T) {
+	ranges := NewIDRanges([]IDRange{{1, 1}, {5, 5}, {10, 19}})
+	s := newIDState(ranges, nil)
+	if recv, expt := s.match.String(), "MeterID in (1,5,10-19)"; recv != expt {
+		t.Fatalf("Expected %q got %q\n", expt, recv)
+	}
+	s = newIDState(ranges, UintMap{5: true, 12: true})
+	if recv, expt := s.match.String(), "MeterID in (1,10-11,13-19)"; recv != expt {
+		t.Fatalf("Expected %q got %q\n", expt, recv)
+	}
+	for id, expt := range map[uint32]bool{1: true, 5: false, 10: true, 12: false, 19: true, 20: false} {
+		if recv := s.match.Match(scm.SCM{ID: id}); recv != expt {
+			t.Fatalf("Meter %d: expected %t got %t\n", id, expt, recv)
+		}
+	}
+
+	types := NewMeterTypeFilter()
+	if err := types.Set("gas,8"); err != nil {
+		t.Fatal(err)
+	}
+	if err := types.Resolve("scm"); err != nil {
+		t.Fatal(err)
+	}
+	r := types.resolved.Load().(*resolvedTypes)
+	if recv, expt := r.match.String(), `MsgType == "SCM" && MeterType in (2, 8, 9, 12)`; recv != expt {
+		t.Fatalf("Expected %q got %q\n", expt, recv)
+	}
+}
+
+func TestFilterChainGroups(t *testing.T) {
+	ids := NewMeterIDFilter()
+	if err := ids.Set("123"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ids.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	types := NewMeterTypeFilter()
+	if err := types.Set("gas"); err != nil {
+		t.Fatal(err)
+	}
+	if err := types.Resolve("scm"); err != nil {
+		t.Fatal(err)
+	}
+
+	exclude := NewMeterIDFilter()
+	if err := exclude.Set("456"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := exclude.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		Msg      scm.SCM
+		All, Any bool
+	}{
+		{scm.SCM{ID: 123, Type: 12}, true, true},   // Id and gas.
+		{scm.SCM{ID: 123, Type: 8}, false, true},   // Id only.
+		{scm.SCM{ID: 789, Type: 12}, false, true},  // Gas only.
+		{scm.SCM{ID: 789, Type: 8}, false, false},  // Neither.
+		{scm.SCM{ID: 456, Type: 12}, false, false}, // Gas but excluded.
+	}
+
+	for _, mode := range []parse.FilterMode{parse.MatchAll, parse.MatchAny} {
+		fc := parse.FilterChain{Mode: mode}
+		fc.Add("ids", ids)
+		fc.Add("types", types)
+		fc.Exclude("exclude", exclude)
+
+		for idx, c := range cases {
+			expt := c.All
+			if mode == parse.MatchAny {
+				expt = c.Any
+			}
+			if recv := fc.Match(c.Msg); recv != expt {
+				t.Fatalf("Mode %d case %d: expected %t got %t\n", mode, idx, expt, recv)
+			}
+		}
+	}
+
+	// Filters of the same kind are ORed within their group.
+	other := NewMeterIDFilter()
+	if err := other.Set("789"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := other.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	fc := parse.FilterChain{}
+	fc.Add("ids", ids)
+	fc.Add("other", other)
+	if !fc.Match(scm.SCM{ID: 123}) || !fc.Match(scm.SCM{ID: 789}) || fc.Match(scm.SCM{ID: 1}) {
+		t.Fatal("Expected filters of the same kind to be ORed")
+	}
+}
+
+func TestFilterChainStatefulLast(t *testing.T) {
+	ids := NewMeterIDFilter()
+	if err := ids.Set("123"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ids.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	exclude := NewMeterIDFilter()
+	if err := exclude.Set("456"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := exclude.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Stateful filters are evaluated last regardless of the order added.
+	uf := NewUniqueFilter(0, 0)
+	fc := parse.FilterChain{Mode: parse.MatchAny}
+	fc.AddStateful("uf", uf)
+	fc.Add("ids", ids)
+	fc.Exclude("exclude", exclude)
+
+	for _, msg := range []scm.SCM{
+		{ID: 456, ChecksumVal: 1}, // Excluded.
+		{ID: 789, ChecksumVal: 1}, // Not in any group.
+	} {
+		if fc.Match(msg) {
+			t.Fatalf("Expected meter %d to be dropped\n", msg.ID)
+		}
+	}
+	if uf.Len() != 0 {
+		t.Fatalf("Expected dropped messages not to reach the unique filter, tracking %d\n", uf.Len())
+	}
+
+	if !fc.Match(scm.SCM{ID: 123, ChecksumVal: 1}) {
+		t.Fatal("Expected first message to pass")
+	}
+	if fc.Match(scm.SCM{ID: 123, ChecksumVal: 1}) {
+		t.Fatal("Expected duplicate message to be dropped")
+	}
+}
+
+func TestBuiltinFilters(t *testing.T) {
+	e, err := filter.New("expr", "MeterID == 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !e.Filter(scm.SCM{ID: 1}) || e.Filter(scm.SCM{ID: 2}) {
+		t.Fatal("Expected expr filter to match meter 1 only")
+	}
+
+	for _, name := range []string{"unique", "onchange"} {
+		f, err := filter.New(name, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := f.(parse.StatefulFilter); !ok {
+			t.Fatalf("Expected %s to be stateful\n", name)
+		}
+	}
+
+	if _, err := filter.New("unique", "soon"); err == nil {
+		t.Fatal("Expected error for invalid window")
+	}
+	if _, err := filter.New("expr", "Bogus == 1"); err == nil {
+		t.Fatal("Expected error for unknown field")
+	}
+}
@@ -17,91 +17,477 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
-	"encoding/xml"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
 	"os"
-	"strconv"
 	"strings"
+	"time"
 
-	"github.com/bemasher/rtlamr/csv"
+	"github.com/bemasher/rtlamr/filter"
 	"github.com/bemasher/rtlamr/parse"
 )
 
 var sampleFilename = flag.String("samplefile", os.DevNull, "raw signal dump file")
-var sampleFile *os.File
-
-var msgType = flag.String("msgtype", "scm", "message type to receive: scm, scm+, idm, r900 and r900bcd")
+var samplePre = flag.Duration("samplefile.pre", 0, "samples preceding each packet written to -samplefile, rather than the blocks it was decoded from")
+var samplePost = flag.Duration("samplefile.post", 0, "samples following each packet written to -samplefile, rather than the blocks it was decoded from")
+var snippetDir = flag.String("snippets", "", "write the samples of each decoded packet to a file of its own in the given directory, with its fields as json")
+var snippetPre = flag.Duration("snippets.pre", 10*time.Millisecond, "samples preceding each packet written by -snippets")
+var snippetPost = flag.Duration("snippets.post", 10*time.Millisecond, "samples following each packet written by -snippets")
+var snippetMax = RateLimit{60, time.Minute}
+var sampleIndex = flag.String("samplefile.index", "", "write the offset, length, message type, meter id and checksum result of each packet written to -samplefile to the given file, for rtlamr replay -index")
+var sampleIndexFile *os.File
+var sampleSigMF = flag.Bool("samplefile.sigmf", false, "write -samplefile as a SigMF recording, annotating decoded packets")
+var sampleRotateSize ByteSize
+var sampleRotateInterval = flag.Duration("samplefile.rotate.interval", 0, "rotate -samplefile once it's been open this long, 0 for never")
+var sampleRotateMaxTotal ByteSize
+
+var msgType = flag.String("msgtype", "scm", "message type to receive: scm, scm+, idm, r900, r900bcd, a comma separated list of those sharing a frequency, or auto to detect")
+
+var autoListen = flag.Duration("auto.listen", time.Minute, "time to listen on each configuration with -msgtype=auto")
+var autoExit = flag.Bool("auto.exit", false, "exit after reporting with -msgtype=auto rather than receiving the recommended message type")
+
+var survey = flag.Bool("survey", false, "report noise, interference and preamble hits stepping from -survey.start to -survey.stop, then exit")
+var surveyStart = flag.Uint("survey.start", 902000000, "first center frequency of -survey in Hz")
+var surveyStop = flag.Uint("survey.stop", 928000000, "last center frequency of -survey in Hz")
+var surveyStep = flag.Uint("survey.step", 2000000, "frequency step of -survey in Hz")
+var surveyDuration = flag.Duration("survey.duration", time.Minute, "total time -survey listens for, shared evenly between steps")
 
 var symbolLength = flag.Int("symbollength", 72, "symbol length in samples")
 
+var lowRate = flag.Bool("lowrate", false, "sample at 1.048576 MS/s for slow CPUs, reduces sensitivity, scm, scm+ and idm only")
+
 var decimation = flag.Int("decimation", 1, "integer decimation factor, keep every nth sample")
 
+var configFile = flag.String("config", "", "read settings from a file, flags given on the command line or by environment variables take precedence")
+var checkOnly = flag.Bool("check", false, "validate the configuration, connect to rtl_tcp and read one block of samples, then exit")
+var selfTest = flag.Bool("selftest", false, "decode a generated packet of each message type without rtl_tcp, report whether each passed and exit")
+var selfTestRF = flag.Bool("selftest.rf", false, "with -selftest, also connect to rtl_tcp and read samples like -check")
+var configPrint = flag.Bool("config.print", false, "print the effective settings and exit")
+
+var schedule Schedule
+var scheduleTZ = flag.String("schedule.tz", "Local", "time zone of -schedule windows, such as America/Chicago")
+var pidFile = flag.String("pidfile", "", "write the process id to this file once connected to rtl_tcp, refusing to start if it names a running process")
+var logOutput = flag.String("logoutput", "", "append diagnostic logging to this file rather than stderr")
+var logOutputFile *os.File
+
+var httpListen = flag.String("http.listen", "", "address to serve /healthz and /status on, such as :8080")
+var httpMaxAge = flag.Duration("http.maxage", 10*time.Second, "/healthz fails if no sample block has been read for this long")
+var httpToken = flag.String("http.token", "", "bearer token required by the -http.listen api under /api/")
+var dashboardHistory = flag.Duration("dashboard.history", 24*time.Hour, "consumption history kept per meter for the -http.listen dashboard, 0 to disable")
+
+var otelEndpoint = flag.String("otel.endpoint", "", "OpenTelemetry collector to export metrics to using OTLP over http, such as localhost:4318")
+var otelInterval = flag.Duration("otel.interval", time.Minute, "interval to export -otel.endpoint metrics at")
+var otelTraces = flag.Bool("otel.traces", false, "with -otel.endpoint, also export a span timing each sampled packet")
+var otelTraceRatio = flag.Float64("otel.traces.ratio", 0.01, "fraction of packets traced with -otel.traces")
+
+var summary = flag.Bool("summary", true, "report totals when the receiver stops, to stderr or stdout as json with -format=json")
+
+var showTUI = flag.Bool("tui", false, "show a table of meters heard above recent output if stderr is a terminal")
+var showStatusLine = flag.Bool("statusline", false, "show a self-updating status line on stderr if it's a terminal")
+
+var shutdownTimeout = flag.Duration("shutdowntimeout", 5*time.Second, "time to wait for the receiver to stop after an interrupt before exiting anyway, 0 waits indefinitely")
+
+var retryMax = flag.Int("retry.max", 5, "consecutive failures of an operation tolerated before exiting, 0 for no limit")
+var retryBackoff = flag.Duration("retry.backoff", time.Second, "delay before reconnecting to rtl_tcp, doubled with each consecutive failure")
+var retryMaxBackoff = flag.Duration("retry.maxbackoff", time.Minute, "limit of the delay before reconnecting to rtl_tcp")
+
+var cronSpec = flag.String("cron", "", "cron expression of times to start receiving at, such as \"0 9 * * *\", releasing rtl_tcp between captures")
+var cronDuration = flag.Duration("cronduration", 0, "how long each -cron capture lasts")
+var scheduleSuspend = flag.Bool("schedule.suspend", false, "release rtl_tcp outside of -schedule windows rather than discarding samples")
+
 var timeLimit = flag.Duration("duration", 0, "time to run for, 0 for infinite, ex. 1h5m10s")
-var meterID MeterIDFilter
-var meterType MeterTypeFilter
+var msgLimit = flag.Uint64("msglimit", 0, "number of messages to write before exiting, 0 for no limit")
+var msgLimitPerType = flag.Bool("msglimit.pertype", false, "apply -msglimit to each message type in -msgtype, exiting once all have reached it")
+var meterIDFile = flag.String("filteridfile", "", "file of meter ids to filter on, one per line, merged with -filterid")
+var meterTypeFile = flag.String("filtertypefile", "", "file of meter types to filter on, one per line, merged with -filtertype")
+var filterExpr = flag.String("filter", "", "display only messages matching an expression, ex. 'MeterID in (1234,5678) && Consumption > 0'")
+
+var filterMode = flag.String("filtermode", "all", "combine filters of different kinds requiring all or any of them to match")
+
+var customFilters filter.Specs
+
+var filterTamper = flag.Bool("filtertamper", false, "display only messages with a tamper, leak, backflow or other flag set")
+var filterFlag = flag.String("filterflag", "", "display only messages with any of the named flags set, comma-separated: TamperPhy, TamperEnc, Tamper, TamperCounters, PowerOutageFlags, Leak, LeakNow or BackFlow")
+
+var excludeIDFile = flag.String("excludeidfile", "", "file of meter ids to exclude, one per line, merged with -excludeid")
+var excludeTypeFile = flag.String("excludetypefile", "", "file of meter types to exclude, one per line, merged with -excludetype")
+
+var watchFilters = flag.Bool("watchfilters", false, "reload filter files when they change, they are always reloaded on SIGHUP")
+
+var aliasFile = flag.String("aliases", "", "csv file of meter id, name, optional commodity and optional multiplier to name meters by")
+var meterDBFile = flag.String("meterdb", "", "file of meter names, commodities, units, multipliers and expected intervals, replacing -aliases")
+var meterDBOnly = flag.Bool("meterdb.only", false, "drop messages from meters not in -meterdb")
+
+var merge = flag.Bool("merge", false, "emit the latest message of every protocol heard from a meter with each packet")
+var mergeMaxMeters = flag.Int("merge.maxmeters", 1024, "maximum number of meters to track in merge mode, least recently heard are evicted first, 0 for unlimited")
+
+var r900Extended = flag.Bool("r900.extended", false, "emit experimental interpretations of undocumented r900 fields and the raw payload")
+
+var rawHex = flag.Bool("raw", false, "attach the raw packet as hex to each message")
+
+var allowBadCRC = flag.Bool("allowbadcrc", false, "also emit packets which fail their checksum, marked with ChecksumOK")
+
+var dumpBits = flag.String("dumpbits", "", "write the quantized bits of every preamble candidate to the given file as json lines")
+var dumpBitsMax = RateLimit{100, time.Second}
+
+var debugCandidates = flag.Bool("debugcandidates", false, "log every preamble candidate at debug level with its preamble bits and why parsing stopped")
+var debugCandidatesMax = RateLimit{100, time.Second}
+
+var statsInterval = flag.Duration("stats", 0, "interval to log receiver statistics at, 0 to disable")
+var noPacketWindow = flag.Duration("nopacketwatchdog", 30*time.Minute, "take -nopacketaction if samples are decoded for this long without a packet passing its checksum, 0 to disable")
+var noPacketActions = NoPacketActions{noPacketWarn}
+var stallThreshold = flag.Duration("stallthreshold", 10*time.Second, "reset the dongle if samples arrive at under half the sample rate for this long, 0 to disable")
+
+var strictIDM = flag.Bool("strictidm", false, "drop idm packets inconsistent with the previous packet from the same meter")
+var idmConsistent = flag.Bool("idm.consistent", false, "mark idm messages with whether they are consistent with the previous packet from the same meter")
 
 var unique = flag.Bool("unique", false, "suppress duplicate messages from each meter")
+var uniqueMaxMeters = flag.Int("unique.maxmeters", 10000, "maximum number of meters to track with -unique, least recently heard are evicted first, 0 for unlimited")
+var uniqueWindow = flag.Duration("unique.window", 0, "with -unique, emit duplicate messages once this long has passed since the last emission, 0 to suppress duplicates forever")
+
+var dedupeCrossProto = flag.Bool("dedupe.crossproto", false, "drop messages reporting the same consumption as a message of another type from the same meter")
+var dedupeWindow = flag.Duration("dedupe.window", time.Minute, "with -dedupe.crossproto, only drop messages within this long of the other message type's")
+var maxDelta = flag.Uint64("maxdelta", 0, "drop messages whose consumption differs from the meter's last accepted reading by more than this many units, 0 to disable")
+var maxDeltaPercent = flag.Float64("maxdelta.percent", 0, "drop messages whose consumption differs from the meter's last accepted reading by more than this percentage, 0 to disable")
+var maxDeltaMaxMeters = flag.Int("maxdelta.maxmeters", 10000, "maximum number of meters to track with -maxdelta, least recently heard are evicted first, 0 for unlimited")
+var logRejected = flag.Bool("logrejected", false, "log messages dropped by -maxdelta")
 
-var encoder Encoder
-var format = flag.String("format", "plain", "format to write log messages in: plain, csv, json, or xml")
+var minSNR = flag.Float64("minsnr", 0, "drop packets whose estimated signal to noise ratio is below this many dB, 0 to disable")
+
+var dedupeMaxMeters = flag.Int("dedupe.maxmeters", 10000, "maximum number of meters to track with -dedupe.crossproto, least recently heard are evicted first, 0 for unlimited")
+
+var onChange = flag.Bool("onchange", false, "emit messages only when consumption or tamper fields differ from the last message from each meter")
+var onChangeHeartbeat = flag.Duration("onchange.heartbeat", 0, "with -onchange, emit unchanged messages once this long has passed since the last emission, 0 to disable")
+var onChangeFieldList = flag.String("onchange.fields", "", "comma-separated message fields compared by -onchange, defaults to consumption and tamper fields of each message type")
+var onChangeMaxMeters = flag.Int("onchange.maxmeters", 10000, "maximum number of meters to track with -onchange, least recently heard are evicted first, 0 for unlimited")
+
+var delta = flag.Bool("delta", false, "add the change in consumption and the rate of use per hour since each meter's previous reading")
+var deltaMaxMeters = flag.Int("delta.maxmeters", 10000, "maximum number of meters to track with -delta, least recently heard are evicted first, 0 for unlimited")
+
+var collect = flag.Bool("collect", false, "write each idm consumption interval once, as it's first heard, in place of idm messages")
+var collectInterval = flag.Duration("collect.interval", 5*time.Minute, "length of the consumption intervals of idm meters with -collect")
+var collectMaxMeters = flag.Int("collect.maxmeters", 10000, "maximum number of meters to track with -collect, least recently heard are evicted first, 0 for unlimited")
+
+var leakAlert = flag.Duration("leakalert", 0, "alert when a meter's consumption has increased at every reading for this long, enables -delta, 0 to disable")
+var leakAlertUseFlags = flag.Bool("leakalert.useflags", false, "alert when an r900 meter reports a current leak, enables -delta")
+var leakDetector *LeakDetector
+
+var absence = flag.Duration("absence", 0, "alert when a meter which has passed the filters, or is in -meterdb, hasn't been heard for this long, 0 to disable")
+var absenceMaxMeters = flag.Int("absence.maxmeters", 10000, "maximum number of meters to watch with -absence, least recently heard are evicted first, 0 for unlimited")
+
+var stateFilename = flag.String("statefile", "", "file to save -unique, -delta, -absence and -collect state to periodically and on exit, loaded at startup")
+var stateInterval = flag.Duration("statefile.interval", 5*time.Minute, "interval to save -statefile at")
+
+var format = flag.String("format", "plain", "format to write log messages in: plain, csv, json, xml, gob or collectd")
+var gobUnsafe = flag.Bool("gobunsafe", false, "allow -format=gob output to stdout")
+var xmlFragment = flag.Bool("xml.fragment", false, "with -format=xml, write bare elements one per line rather than a document with a root element")
+var collectdHostname = flag.String("collectd.hostname", "", "host name of -format=collectd values, defaults to $COLLECTD_HOSTNAME or the system's host name")
+var collectdInterval = flag.Duration("collectd.interval", 0, "interval of -format=collectd values, each meter is written at most once per interval, defaults to $COLLECTD_INTERVAL or 30s")
+
+var logFilename = flag.String("logfile", "/dev/stdout", "file to append log messages to")
+var mirrorStdout = flag.Bool("stdout", false, "with -logfile, also write log messages to stdout")
+var stdoutFormat = flag.String("stdout.format", "", "format to write log messages to stdout in with -stdout, defaults to -format")
+
+var outputBuffer = flag.Int("output.buffer", 64, "number of decoded messages held waiting to be written")
+var outputDropOldest = flag.Bool("output.dropoldest", false, "discard the oldest message held when -output.buffer is full rather than waiting for output to catch up")
+
+var execCommand = flag.String("exec", "", "command to start and write each message to as a json line on its stdin, restarted if it exits")
+var execDrop = flag.Bool("exec.drop", false, "drop messages when -exec's queue is full, the default")
+var execBlock = flag.Bool("exec.block", false, "wait for -exec's child to catch up when its queue is full rather than dropping messages")
+var execBuffer = flag.Int("exec.buffer", 64, "number of messages queued for -exec's child")
+var execSink *ExecSink
+
+var dbusEnabled = flag.Bool("dbus", false, "claim org.rtlamr.Receiver on the session bus and emit a ReadingReceived signal for each message, Linux only")
+var dbusSystem = flag.Bool("dbus.system", false, "with -dbus, use the system bus rather than the session bus")
+
+var quiet = flag.Bool("quiet", false, "suppress informational diagnostics, equivalent to -loglevel=warn unless it's given")
 
 var single = flag.Bool("single", false, "one shot execution, if used with -filterid, will wait for exactly one packet from each meter id")
+var singleTimeout = flag.Duration("single.timeout", 0, "give up on -single meters not heard within this long of starting, 0 for no timeout")
 
-var version = flag.Bool("version", false, "display build date and commit hash")
+var singleMax = flag.Int("single.max", 0, "exit -single after this many distinct meters have been heard, 0 for no limit")
 
-func RegisterFlags() {
-	meterID = MeterIDFilter{make(UintMap)}
-	meterType = MeterTypeFilter{make(UintMap)}
-
-	flag.Var(meterID, "filterid", "display only messages matching an id in a comma-separated list of ids.")
-	flag.Var(meterType, "filtertype", "display only messages matching a type in a comma-separated list of types.")
-
-	rtlamrFlags := map[string]bool{
-		"samplefile":   true,
-		"msgtype":      true,
-		"symbollength": true,
-		"decimation":   true,
-		"duration":     true,
-		"filterid":     true,
-		"filtertype":   true,
-		"format":       true,
-		"unique":       true,
-		"single":       true,
-		"cpuprofile":   true,
-		"version":      true,
-	}
-
-	printDefaults := func(validFlags map[string]bool, inclusion bool) {
-		flag.CommandLine.VisitAll(func(f *flag.Flag) {
-			if validFlags[f.Name] != inclusion {
-				return
-			}
+var singlePerType = flag.Bool("single.pertype", false, "exit -single once each message type in -msgtype has been heard, instead of each meter")
 
-			format := "  -%s=%s: %s\n"
-			fmt.Fprintf(os.Stderr, format, f.Name, f.Value, f.Usage)
-		})
+var waitForClock = flag.Duration("waitforclock", 0, "drop packets until the system clock is past the build date and synchronized, for up to this long, then mark their times suspect, 0 to disable")
+
+var receiverID = flag.String("receiverid", hostname(), "identifies this receiver in structured log messages")
+var verboseEnvelope = flag.Bool("verboseenvelope", false, "include schema version, receiver id, commit and tuner configuration in plain log messages")
+
+var version = flag.Bool("version", false, "display build date and commit hash")
+var listMsgTypesFlag = flag.Bool("listmsgtypes", false, "print the radio configuration of every message type and exit")
+var jsonSchemaFlag = flag.Bool("jsonschema", false, "print the JSON Schema of -format=json output and exit")
+
+// RegisterFlags registers rtlamr's flags, the receiver's id and type filters
+// among them. rtl_tcp's flags are registered separately by rcvr.SDR.
+func (rcvr *Receiver) RegisterFlags() {
+	rcvr.meterID = NewMeterIDFilter()
+	rcvr.meterType = NewMeterTypeFilter()
+	rcvr.excludeID = NewMeterIDFilter()
+	rcvr.excludeType = NewMeterTypeFilter()
+	rcvr.meterID.Aliases = &rcvr.aliases
+	rcvr.excludeID.Aliases = &rcvr.aliases
+
+	flag.Var(rcvr.meterID, "filterid", "display only messages matching an id in a comma-separated list of ids, ranges (45000000-45000199) or wildcards (4512xxxx).")
+	flag.Var(rcvr.meterType, "filtertype", "display only messages matching a type in a comma-separated list of types or commodities: electric, gas or water.")
+	flag.Var(rcvr.excludeID, "excludeid", "drop messages matching an id in a comma-separated list of ids, ranges or wildcards, applied after -filterid and -filtertype.")
+	flag.Var(rcvr.excludeType, "excludetype", "drop messages matching a type in a comma-separated list of types or commodities, applied after -filterid and -filtertype.")
+	flag.Var(&noPacketActions, "nopacketaction", "comma-separated actions taken in turn by -nopacketwatchdog: warn, again (automatic gain), retune or exit, the last repeats")
+	flag.Var(&sampleRotateSize, "samplefile.rotate.size", "rotate -samplefile once it's grown to this size, such as 1GB, 0 for never")
+	flag.Var(&sampleRotateMaxTotal, "samplefile.rotate.maxtotal", "remove the oldest files rotated from -samplefile to keep them and the current file within this size, 0 for no limit")
+	flag.Var(&snippetMax, "snippets.max", "maximum rate of -snippets as count/unit, units are s, m or h, 0 for unlimited")
+	flag.Var(&dumpBitsMax, "dumpbits.max", "maximum rate of -dumpbits records as count/unit, units are s, m or h, 0 for unlimited")
+	flag.Var(&debugCandidatesMax, "debugcandidates.max", "maximum rate of -debugcandidates messages as count/unit, units are s, m or h, 0 for unlimited")
+	flag.Var(&customFilters, "customfilter", "add a registered filter to the chain given as name:arg, may be repeated")
+	flag.Var(&schedule, "schedule", "comma-separated daily windows to receive during, such as 08:00-11:00,13:00-14:00")
+	flag.TextVar(logLevel, "loglevel", new(slog.LevelVar), "minimum level of diagnostic logging: debug, info, warn or error")
+	flag.Var(&rcvr.multiplier, "multiplier", "scale consumption by a single multiplier or by a csv file of meter id, multiplier and unit")
+
+	flag.Var(&helpGroup, "help", "show usage and exit, or only the flags of one group given as -help=name")
+
+	// Short aliases share the canonical flag's value.
+	for alias, name := range flagAliases {
+		f := flag.Lookup(name)
+		flag.Var(&flagAlias{f}, alias, "alias for -"+name)
 	}
 
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
-		printDefaults(rtlamrFlags, true)
+		printUsage(os.Stderr, "")
+		fmt.Fprintf(os.Stderr, "\n%s", subcommandUsage)
+	}
+}
+
+// flagGroup is a set of related flags shown together by -help.
+type flagGroup struct {
+	Name  string // Selects the group with -help=name.
+	Title string
+	Flags []string
+}
+
+// flagGroups lists rtlamr's flags in the order they're shown by -help.
+// Flags not in any group belong to rtl_tcp and are shown last.
+var flagGroups = []flagGroup{
+	{"general", "General", []string{
+		"help", "config", "config.print", "version", "check", "selftest",
+		"selftest.rf", "listmsgtypes", "jsonschema", "quiet", "loglevel",
+		"logoutput", "pidfile", "shutdowntimeout",
+	}},
+	{"decode", "Decoding", []string{
+		"msgtype", "auto.listen", "auto.exit", "symbollength", "lowrate",
+		"decimation", "strictidm", "idm.consistent", "allowbadcrc", "r900.extended",
+		"dumpbits", "dumpbits.max", "debugcandidates", "debugcandidates.max",
+	}},
+	{"survey", "Surveying", []string{
+		"survey", "survey.start", "survey.stop", "survey.step", "survey.duration",
+	}},
+	{"run", "Running", []string{
+		"duration", "msglimit", "msglimit.pertype", "single", "single.max", "single.pertype", "single.timeout",
+		"schedule", "schedule.tz", "schedule.suspend", "cron", "cronduration",
+		"retry.max", "retry.backoff", "retry.maxbackoff", "stallthreshold",
+		"nopacketwatchdog", "nopacketaction", "waitforclock",
+	}},
+	{"filter", "Filtering", []string{
+		"filterid", "filteridfile", "filtertype", "filtertypefile",
+		"excludeid", "excludeidfile", "excludetype", "excludetypefile",
+		"filter", "filtermode", "filtertamper", "filterflag", "watchfilters",
+		"customfilter", "meterdb.only", "unique", "unique.window",
+		"unique.maxmeters", "dedupe.crossproto", "dedupe.window",
+		"dedupe.maxmeters", "maxdelta", "maxdelta.percent",
+		"maxdelta.maxmeters", "logrejected", "minsnr", "onchange", "onchange.heartbeat",
+		"onchange.fields", "onchange.maxmeters",
+	}},
+	{"output", "Output", []string{
+		"format", "xml.fragment", "gobunsafe", "collectd.hostname",
+		"collectd.interval", "logfile", "stdout", "stdout.format", "samplefile",
+		"samplefile.sigmf", "samplefile.index",
+		"samplefile.pre", "samplefile.post", "samplefile.rotate.size",
+		"samplefile.rotate.interval", "samplefile.rotate.maxtotal",
+		"snippets", "snippets.pre",
+		"snippets.post", "snippets.max", "raw",
+		"verboseenvelope", "receiverid", "multiplier", "aliases", "meterdb",
+		"merge", "merge.maxmeters", "delta", "delta.maxmeters", "collect",
+		"collect.interval", "collect.maxmeters", "statefile",
+		"statefile.interval", "exec", "exec.drop", "exec.block", "exec.buffer",
+		"output.buffer", "output.dropoldest", "dbus", "dbus.system",
+	}},
+	{"alert", "Alerts", []string{
+		"leakalert", "leakalert.useflags", "absence", "absence.maxmeters",
+	}},
+	{"monitor", "Monitoring", []string{
+		"tui", "statusline", "stats", "summary", "http.listen", "http.maxage",
+		"http.token", "dashboard.history", "otel.endpoint", "otel.interval",
+		"otel.traces", "otel.traces.ratio",
+	}},
+}
+
+// rtltcpGroup is the name of the group of rtl_tcp's flags.
+const rtltcpGroup = "rtltcp"
 
-		fmt.Fprintln(os.Stderr)
-		fmt.Fprintln(os.Stderr, "rtltcp specific:")
-		printDefaults(rtlamrFlags, false)
+// flagAliases maps short aliases to the flags they stand for.
+var flagAliases = map[string]string{
+	"f": "centerfreq",
+	"m": "msgtype",
+	"o": "logfile",
+}
+
+// flagAlias sets the flag it stands for, so flag.Visit sees the canonical
+// flag as set.
+type flagAlias struct {
+	f *flag.Flag
+}
+
+func (fa *flagAlias) String() string {
+	if fa.f == nil {
+		return ""
+	}
+	return fa.f.Value.String()
+}
+
+func (fa *flagAlias) Set(value string) error {
+	return flag.Set(fa.f.Name, value)
+}
+
+func (fa *flagAlias) IsBoolFlag() bool {
+	bf, ok := fa.f.Value.(interface{ IsBoolFlag() bool })
+	return ok && bf.IsBoolFlag()
+}
+
+// helpFlag is -help, which may be given alone or with a group name.
+type helpFlag struct {
+	set   bool
+	group string
+}
+
+var helpGroup helpFlag
+
+func (hf *helpFlag) String() string {
+	return hf.group
+}
+
+func (hf *helpFlag) Set(value string) error {
+	switch value {
+	case "true":
+		hf.set = true
+	case "false":
+		hf.set = false
+	default:
+		hf.set, hf.group = true, strings.ToLower(value)
 	}
+	return nil
+}
+
+func (hf *helpFlag) IsBoolFlag() bool {
+	return true
 }
 
-func EnvOverride() {
-	flag.VisitAll(func(f *flag.Flag) {
-		envName := "RTLAMR_" + strings.ToUpper(f.Name)
-		flagValue := os.Getenv(envName)
+// printUsage writes the flags of the named group, or of every group if name
+// is blank, to w.
+func printUsage(w io.Writer, name string) error {
+	var names []string
+	grouped := map[string]bool{}
+	for _, g := range flagGroups {
+		names = append(names, g.Name)
+		for _, f := range g.Flags {
+			grouped[f] = true
+		}
+	}
+	names = append(names, rtltcpGroup)
+
+	if name != "" && !contains(names, name) {
+		return fmt.Errorf("unknown flag group %q, expected one of: %s", name, strings.Join(names, ", "))
+	}
+
+	aliases := map[string]string{}
+	for alias, f := range flagAliases {
+		aliases[f] = alias
+	}
+	printFlag := func(f *flag.Flag) {
+		names := "-" + f.Name
+		if alias, ok := aliases[f.Name]; ok {
+			names = "-" + alias + ", " + names
+		}
+		fmt.Fprintf(w, "  %s=%s: %s\n", names, f.Value, f.Usage)
+	}
+
+	first := true
+	header := func(title string) {
+		if !first {
+			fmt.Fprintln(w)
+		}
+		first = false
+		fmt.Fprintf(w, "%s:\n", title)
+	}
+
+	for _, g := range flagGroups {
+		if name != "" && name != g.Name {
+			continue
+		}
+		header(g.Title)
+		for _, f := range g.Flags {
+			printFlag(flag.Lookup(f))
+		}
+	}
+
+	if name == "" || name == rtltcpGroup {
+		header("rtltcp specific")
+		flag.VisitAll(func(f *flag.Flag) {
+			if _, alias := f.Value.(*flagAlias); !alias && !grouped[f.Name] {
+				printFlag(f)
+			}
+		})
+	}
+
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// EnvOverride sets flags from environment variables named by the flag in
+// upper case, prefixed by RTLAMR_ and with dots and dashes replaced by
+// underscores, such as RTLAMR_SINGLE_MAX. Flags set this way are visited by
+// flag.Visit like those given on the command line.
+//
+// EnvOverride is called both before and after parsing the command line.
+// Before, it sets flags holding a single value so they're shown by -help and
+// replaced by the command line. After, it sets flags accumulating a list of
+// values, such as -filterid, only if they weren't given on the command line,
+// which would otherwise extend the environment's list rather than replace it.
+func EnvOverride(fs *flag.FlagSet, getenv func(string) string) {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	fs.VisitAll(func(f *flag.Flag) {
+		if _, single := f.Value.(flag.Getter); single == fs.Parsed() || fs.Parsed() && set[f.Name] {
+			return
+		}
+		if _, alias := f.Value.(*flagAlias); alias || f.Name == "help" {
+			return
+		}
+
+		envName := "RTLAMR_" + strings.NewReplacer(".", "_", "-", "_").Replace(strings.ToUpper(f.Name))
+		flagValue := getenv(envName)
+		if flagValue == "" {
+			// Accept the flag's name verbatim as well.
+			envName = "RTLAMR_" + strings.ToUpper(f.Name)
+			flagValue = getenv(envName)
+		}
+
 		if flagValue != "" {
-			if err := flag.Set(f.Name, flagValue); err != nil {
+			if err := fs.Set(f.Name, flagValue); err != nil {
 				log.Printf(
 					"Environment variable %q failed to override flag %q with value %q: %q\n",
 					envName, f.Name, flagValue, err,
@@ -113,102 +499,273 @@ func EnvOverride() {
 	})
 }
 
-func HandleFlags() {
+// Configure opens output files and sets up encoders and filters from the
+// parsed flags. Errors are annotated with the exit status they cause.
+func (rcvr *Receiver) Configure() error {
 	var err error
 
-	sampleFile, err = os.Create(*sampleFilename)
-	if err != nil {
-		log.Fatal("Error creating sample file:", err)
+	// Expand templated output paths, see PathData.
+	now := time.Now()
+	paths := map[string]*string{"logfile": logFilename, "logoutput": logOutput, "samplefile": sampleFilename, "samplefile.index": sampleIndex, "dumpbits": dumpBits}
+	expanded := map[string]string{}
+	for name, path := range paths {
+		if expanded[name], err = expandPath(*path, now); err != nil {
+			return withStatus(exitUsage, fmt.Errorf("-%s: %w", name, err))
+		}
 	}
 
-	*format = strings.ToLower(*format)
-	switch *format {
-	case "plain":
-		encoder = PlainEncoder{*sampleFilename}
-	case "csv":
-		encoder = csv.NewEncoder(os.Stdout)
-	case "json":
-		encoder = json.NewEncoder(os.Stdout)
-	case "xml":
-		encoder = xml.NewEncoder(os.Stdout)
+	// -check verifies output files are writable without truncating them.
+	create := os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	if *checkOnly {
+		create = os.O_WRONLY | os.O_CREATE | os.O_APPEND
 	}
-}
 
-// JSON, XML and GOB all implement this interface so we can simplify log
-// output formatting.
-type Encoder interface {
-	Encode(interface{}) error
-}
+	if *quiet {
+		levelSet := false
+		flag.Visit(func(f *flag.Flag) { levelSet = levelSet || f.Name == "loglevel" })
+		if !levelSet {
+			logLevel.Set(slog.LevelWarn)
+		}
+	}
 
-type UintMap map[uint]bool
+	if *logOutput != "" {
+		logOutputFile, err = openOutput(expanded["logoutput"], os.O_WRONLY|os.O_CREATE|os.O_APPEND)
+		if err != nil {
+			return withStatus(exitOutput, fmt.Errorf("opening log output: %w", err))
+		}
+		logSink.SetOutput(logOutputFile)
+	}
 
-func (m UintMap) String() (s string) {
-	var values []string
-	for k := range m {
-		values = append(values, strconv.FormatUint(uint64(k), 10))
+	if *pidFile != "" {
+		if err := checkPidFile(*pidFile); err != nil {
+			return withStatus(exitFatal, fmt.Errorf("-pidfile: %w", err))
+		}
 	}
-	return strings.Join(values, ",")
-}
 
-func (m UintMap) Set(value string) error {
-	values := strings.Split(value, ",")
+	if *selfTestRF && !*selfTest {
+		return withStatus(exitUsage, errors.New("-selftest.rf requires -selftest"))
+	}
+
+	if *survey {
+		if strings.EqualFold(*msgType, "auto") {
+			return withStatus(exitUsage, errors.New("-survey can't be used with -msgtype=auto"))
+		}
+		if *surveyStep == 0 || *surveyStop < *surveyStart || uint64(*surveyStop) >= 1<<32 {
+			return withStatus(exitUsage, errors.New("-survey.step must be positive and -survey.stop at least -survey.start, below 4.3GHz"))
+		}
+		if *surveyDuration <= 0 {
+			return withStatus(exitUsage, errors.New("-survey.duration must be positive"))
+		}
+	}
 
-	for _, v := range values {
-		n, err := strconv.ParseUint(v, 10, 64)
+	if *sampleSigMF && *sampleFilename == os.DevNull {
+		return withStatus(exitUsage, errors.New("-samplefile.sigmf requires -samplefile"))
+	}
+	if *sampleIndex != "" && *sampleFilename == os.DevNull {
+		return withStatus(exitUsage, errors.New("-samplefile.index requires -samplefile"))
+	}
+	if *outputBuffer <= 0 {
+		return withStatus(exitUsage, errors.New("-output.buffer must be positive"))
+	}
+	if *samplePre < 0 || *samplePost < 0 {
+		return withStatus(exitUsage, errors.New("-samplefile.pre and -samplefile.post must not be negative"))
+	}
+	if sampleRotateSize != 0 || *sampleRotateInterval != 0 || sampleRotateMaxTotal != 0 {
+		if *sampleFilename == os.DevNull {
+			return withStatus(exitUsage, errors.New("-samplefile.rotate options require -samplefile"))
+		}
+		if *sampleRotateInterval < 0 {
+			return withStatus(exitUsage, errors.New("-samplefile.rotate.interval must not be negative"))
+		}
+		if sampleRotateMaxTotal != 0 && sampleRotateSize == 0 && *sampleRotateInterval == 0 {
+			return withStatus(exitUsage, errors.New("-samplefile.rotate.maxtotal requires -samplefile.rotate.size or -samplefile.rotate.interval"))
+		}
+		if sampleRotateMaxTotal != 0 && sampleRotateMaxTotal < sampleRotateSize {
+			return withStatus(exitUsage, errors.New("-samplefile.rotate.maxtotal must not be less than -samplefile.rotate.size"))
+		}
+	}
+	if *sampleSigMF && newCompressor(*sampleFilename) != nil {
+		return withStatus(exitUsage, errors.New("-samplefile.sigmf can't be compressed"))
+	}
+	f, err := openOutput(sampleFileName(expanded["samplefile"]), create)
+	if err != nil {
+		return withStatus(exitOutput, fmt.Errorf("creating sample file: %w", err))
+	}
+	rcvr.sampleFile = newSampleFile(f, 0)
+	if *sampleIndex != "" {
+		sampleIndexFile, err = openOutput(expanded["samplefile.index"], create)
 		if err != nil {
-			return err
+			return withStatus(exitOutput, fmt.Errorf("creating sample index: %w", err))
 		}
+	}
 
-		m[uint(n)] = true
+	if *aliasFile != "" && *meterDBFile != "" {
+		return withStatus(exitUsage, errors.New("-aliases and -meterdb are mutually exclusive"))
+	}
+	if *aliasFile != "" {
+		rcvr.aliases.Filename = *aliasFile
+		if _, _, err := rcvr.aliases.Reload(); err != nil {
+			return withStatus(exitUsage, fmt.Errorf("reading alias file: %w", err))
+		}
+	}
+	if *meterDBFile != "" {
+		rcvr.aliases.Filename, rcvr.aliases.MeterDB = *meterDBFile, true
+		if _, _, err := rcvr.aliases.Reload(); err != nil {
+			return withStatus(exitUsage, fmt.Errorf("reading meter database: %w", err))
+		}
+	} else if *meterDBOnly {
+		return withStatus(exitUsage, errors.New("-meterdb.only requires -meterdb"))
 	}
 
-	return nil
-}
+	rcvr.meterID.Filename = *meterIDFile
+	rcvr.meterType.Filename = *meterTypeFile
 
-type MeterIDFilter struct {
-	UintMap
-}
+	rcvr.excludeID.Filename = *excludeIDFile
+	rcvr.excludeType.Filename = *excludeTypeFile
 
-func (m MeterIDFilter) Filter(msg parse.Message) bool {
-	return m.UintMap[uint(msg.MeterID())]
-}
+	if *dumpBits != "" {
+		rcvr.dumpBitsFile, err = openOutput(expanded["dumpbits"], create)
+		if err != nil {
+			return withStatus(exitOutput, fmt.Errorf("creating bit dump file: %w", err))
+		}
+	}
 
-type MeterTypeFilter struct {
-	UintMap
-}
+	if *snippetPre < 0 || *snippetPost < 0 {
+		return withStatus(exitUsage, errors.New("-snippets.pre and -snippets.post must not be negative"))
+	}
+	if *snippetDir != "" {
+		if err := os.MkdirAll(*snippetDir, 0777); err != nil {
+			return withStatus(exitOutput, fmt.Errorf("creating snippet directory: %w", err))
+		}
+	}
+
+	if schedule.Location, err = time.LoadLocation(*scheduleTZ); err != nil {
+		return withStatus(exitUsage, fmt.Errorf("-schedule.tz: %w", err))
+	}
+
+	if *cronSpec != "" {
+		if err := setupCron(); err != nil {
+			return withStatus(exitUsage, err)
+		}
+	}
+
+	parse.AllowBadCRC = *allowBadCRC
+
+	if *merge {
+		rcvr.mergeState = NewMergeState(*mergeMaxMeters)
+	}
+
+	if *absence < 0 {
+		return withStatus(exitUsage, errors.New("-absence must not be negative"))
+	}
+	if *absence != 0 || *meterDBFile != "" {
+		rcvr.absenceMonitor = NewAbsenceMonitor(*absence, *absenceMaxMeters, &rcvr.aliases, time.Now())
+	}
+
+	if *leakAlert < 0 {
+		return withStatus(exitUsage, errors.New("-leakalert must not be negative"))
+	}
+	if *leakAlert != 0 || *leakAlertUseFlags {
+		*delta = true
+		leakDetector = NewLeakDetector(*leakAlert, *deltaMaxMeters)
+		leakDetector.UseFlags = *leakAlertUseFlags
+	}
+
+	*format = strings.ToLower(*format)
+	if err := rcvr.out.Setup(expanded["logfile"]); err != nil {
+		return err
+	}
 
-func (m MeterTypeFilter) Filter(msg parse.Message) bool {
-	return m.UintMap[uint(msg.MeterType())]
+	if *execCommand != "" {
+		if *execDrop && *execBlock {
+			return withStatus(exitUsage, errors.New("-exec.drop and -exec.block are mutually exclusive"))
+		}
+		sink, err := NewExecSink(*execCommand, *execBuffer, *execBlock, RetryPolicy{0, *retryBackoff, *retryMaxBackoff})
+		if err != nil {
+			return withStatus(exitUsage, fmt.Errorf("-exec: %w", err))
+		}
+		execSink = sink
+		rcvr.out.Add(execSink)
+	}
+
+	if *dbusEnabled {
+		svc, err := NewDBusService(*dbusSystem, RetryPolicy{0, *retryBackoff, *retryMaxBackoff})
+		if err != nil {
+			return withStatus(exitUsage, fmt.Errorf("-dbus: %w", err))
+		}
+		rcvr.dbusService = svc
+	}
+
+	return nil
 }
 
-type UniqueFilter map[uint][]byte
+// stdoutWriter writes to os.Stdout as of each write, so encoders follow it if
+// it's replaced, such as by -tui.
+type stdoutWriter struct{}
 
-func NewUniqueFilter() UniqueFilter {
-	return make(UniqueFilter)
+func (stdoutWriter) Write(p []byte) (int, error) {
+	return os.Stdout.Write(p)
 }
 
-func (uf UniqueFilter) Filter(msg parse.Message) bool {
-	checksum := msg.Checksum()
-	mid := uint(msg.MeterID())
+// JSON, XML and GOB all implement this interface so we can simplify log
+// output formatting.
+type Encoder interface {
+	Encode(interface{}) error
+}
 
-	if val, ok := uf[mid]; ok && bytes.Compare(val, checksum) == 0 {
-		return false
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return ""
 	}
-
-	uf[mid] = make([]byte, len(checksum))
-	copy(uf[mid], checksum)
-	return true
+	return name
 }
 
 type PlainEncoder struct {
-	sampleFilename string
+	w               io.Writer
+	sampleFilename  string
+	verboseEnvelope bool
 }
 
 func (pe PlainEncoder) Encode(msg interface{}) (err error) {
+	if m, ok := msg.(parse.LogMessage); ok && !pe.verboseEnvelope {
+		m.SchemaVersion = 0
+		m.ReceiverID = ""
+		m.Commit = ""
+		m.CenterFreq = 0
+		m.SampleRate = 0
+		m.Backend = ""
+		msg = m
+	}
+
 	if m, ok := msg.(parse.LogMessage); ok && pe.sampleFilename == os.DevNull {
-		_, err = fmt.Println(m.StringNoOffset())
+		_, err = fmt.Fprintln(pe.w, m.StringNoOffset())
 	} else {
-		_, err = fmt.Println(m)
+		_, err = fmt.Fprintln(pe.w, msg)
 	}
 	return
 }
+
+// setupCron schedules captures from -cron and -cronduration. The dongle must
+// be free between captures, so rtl_tcp is always released.
+func setupCron() error {
+	if len(schedule.Windows) != 0 {
+		return errors.New("-cron and -schedule are mutually exclusive")
+	}
+	if *cronDuration <= 0 {
+		return errors.New("-cron requires a positive -cronduration")
+	}
+
+	c, err := ParseCron(*cronSpec)
+	if err != nil {
+		return fmt.Errorf("-cron: %w", err)
+	}
+	if c.Next(time.Now().In(schedule.Location)).IsZero() {
+		return fmt.Errorf("-cron: %q never matches", *cronSpec)
+	}
+
+	schedule.Cron, schedule.CronDuration = &c, *cronDuration
+	*scheduleSuspend = true
+
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var registerFlags sync.Once
+
+// RegisterFlags registers rtlamr's flags without rtl_tcp's.
+func RegisterFlags() { new(Receiver).RegisterFlags() }
+
+func TestFlagGroups(t *testing.T) {
+	registerFlags.Do(RegisterFlags)
+
+	seen := map[string]string{}
+	for _, g := range flagGroups {
+		for _, name := range g.Flags {
+			if flag.Lookup(name) == nil {
+				t.Errorf("group %s: flag -%s isn't defined", g.Name, name)
+			}
+			if other, ok := seen[name]; ok {
+				t.Errorf("flag -%s is in groups %s and %s", name, other, g.Name)
+			}
+			seen[name] = g.Name
+		}
+	}
+
+	// Without rtltcp's flags registered, every flag must be grouped.
+	flag.VisitAll(func(f *flag.Flag) {
+		if _, alias := f.Value.(*flagAlias); alias || strings.HasPrefix(f.Name, "test.") {
+			return
+		}
+		if _, ok := seen[f.Name]; !ok {
+			t.Errorf("flag -%s isn't in any group", f.Name)
+		}
+	})
+}
+
+func TestPrintUsage(t *testing.T) {
+	registerFlags.Do(RegisterFlags)
+
+	var buf bytes.Buffer
+	if err := printUsage(&buf, "filter"); err != nil {
+		t.Fatal(err)
+	}
+	usage := buf.String()
+	if !strings.HasPrefix(usage, "Filtering:\n") {
+		t.Errorf("usage doesn't begin with the group's title:\n%s", usage)
+	}
+	if !strings.Contains(usage, "  -filterid=") || strings.Contains(usage, "-msgtype=") {
+		t.Errorf("usage doesn't hold only the filter group:\n%s", usage)
+	}
+
+	buf.Reset()
+	if err := printUsage(&buf, ""); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "  -m, -msgtype=") {
+		t.Errorf("alias missing from usage:\n%s", buf.String())
+	}
+
+	if err := printUsage(&buf, "bogus"); err == nil {
+		t.Error("expected an error for an unknown group")
+	}
+}
+
+func TestFlagAlias(t *testing.T) {
+	registerFlags.Do(RegisterFlags)
+
+	// flagAlias sets flags on flag.CommandLine, so exercise it there.
+	defer flag.Set("msgtype", flag.Lookup("msgtype").DefValue)
+	if err := flag.Lookup("m").Value.Set("idm"); err != nil {
+		t.Fatal(err)
+	}
+	if got := flag.Lookup("msgtype").Value.String(); got != "idm" {
+		t.Errorf("-msgtype = %q, want idm", got)
+	}
+	if got := flag.Lookup("m").Value.String(); got != "idm" {
+		t.Errorf("-m = %q, want idm", got)
+	}
+
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		set = set || f.Name == "msgtype"
+	})
+	if !set {
+		t.Error("-msgtype isn't visited as set")
+	}
+}
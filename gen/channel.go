@@ -0,0 +1,92 @@
+package gen
+
+import (
+	"math"
+	"math/rand"
+)
+
+// Channel impairs signals the way the path from a meter to the receiver
+// does. The zero value is a perfect channel: no noise, the carrier 10kHz from
+// the center frequency and chips at exactly the nominal rate.
+type Channel struct {
+	// SNR is the ratio of signal to noise power in dB. Zero or +Inf adds no
+	// noise, use a tiny value such as 1e-9 for equal power.
+	SNR float64
+
+	// FreqOffset is added to the carrier's 10kHz offset from the center
+	// frequency, in Hz.
+	FreqOffset float64
+
+	// RateError is the fraction by which the meter's chip rate is off, such
+	// as 100e-6 for a crystal 100ppm fast.
+	RateError float64
+
+	// Rand is the source of noise, math/rand's if nil.
+	Rand *rand.Rand
+}
+
+// amplitude leaves headroom for noise before samples clip.
+const amplitude = 0.5
+
+func (ch Channel) noisy() bool {
+	return ch.SNR != 0 && !math.IsInf(ch.SNR, 1)
+}
+
+func (ch Channel) norm() float64 {
+	if ch.Rand != nil {
+		return ch.Rand.NormFloat64()
+	}
+	return rand.NormFloat64()
+}
+
+// addNoise adds complex Gaussian noise to interleaved samples at the
+// channel's SNR.
+func (ch Channel) addNoise(samples []float64) {
+	if !ch.noisy() {
+		return
+	}
+
+	// Signal power is amplitude², split evenly between inphase and
+	// quadrature noise.
+	sigma := amplitude / math.Sqrt(2*math.Pow(10, ch.SNR/10))
+	for idx := range samples {
+		samples[idx] += sigma * ch.norm()
+	}
+}
+
+// Silence returns n interleaved inphase and quadrature samples of the
+// channel's noise alone, the center of the sample range without noise.
+func (ch Channel) Silence(n int) []byte {
+	f64 := make([]float64, n<<1)
+	ch.addNoise(f64)
+
+	samples := make([]byte, len(f64))
+	F64toU8(f64, samples)
+
+	return samples
+}
+
+// Modulate returns interleaved 8-bit inphase and quadrature samples of chips
+// keyed on and off, with chipLength samples per chip at the nominal chip
+// rate, passed through the channel.
+func (ch Channel) Modulate(chips []byte, chipLength int, sampleRate float64) []byte {
+	samplesPerChip := float64(chipLength) / (1 + ch.RateError)
+	n := int(math.Ceil(float64(len(chips)) * samplesPerChip))
+
+	freq := 2 * math.Pi * (10e3 + ch.FreqOffset) / sampleRate
+	f64 := make([]float64, n<<1)
+	for idx := 0; idx < n; idx++ {
+		chip := int(float64(idx) / samplesPerChip)
+		if chip >= len(chips) || chips[chip] == 0 {
+			continue
+		}
+		s, c := math.Sincos(freq * float64(idx))
+		f64[idx<<1], f64[idx<<1+1] = amplitude*s, amplitude*c
+	}
+	ch.addNoise(f64)
+
+	samples := make([]byte, len(f64))
+	F64toU8(f64, samples)
+
+	return samples
+}
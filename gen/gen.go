@@ -9,8 +9,6 @@ import (
 )
 
 func NewRandSCM() (pkt []byte, err error) {
-	bch := crc.NewCRC("BCH", 0, 0x6F63, 0)
-
 	pkt = make([]byte, 12)
 	_, err = rand.Read(pkt)
 	if err != nil {
@@ -21,13 +19,37 @@ func NewRandSCM() (pkt []byte, err error) {
 	pkt[1] = 0x53
 	pkt[2] &= 0x07
 
-	checksum := bch.Checksum(pkt[2:10])
+	checksum := crc.BCH(crc.BCHPoly, pkt[2:10])
 	pkt[10] = uint8(checksum >> 8)
 	pkt[11] = uint8(checksum & 0xFF)
 
 	return
 }
 
+// NewSCM returns an SCM packet from the given meter with its tamper counters
+// clear. Only the low 26 bits of id, 4 bits of ertType and 24 bits of
+// consumption are sent.
+func NewSCM(id uint32, ertType uint8, consumption uint32) []byte {
+	return SCM{ID: id, Type: ertType, Consumption: consumption}.Packet()
+}
+
+// Modulate returns interleaved 8-bit inphase and quadrature samples of pkt,
+// Manchester coded with chipLength samples per chip on a carrier offset 10kHz
+// from the center frequency.
+func Modulate(pkt []byte, chipLength int, sampleRate float64) []byte {
+	bits := Upsample(UnpackBits(NewManchesterLUT().Encode(pkt)), chipLength<<1)
+
+	carrier := CmplxOscillatorF64(len(bits)>>1, 10e3, sampleRate)
+	for idx := range carrier {
+		carrier[idx] *= float64(bits[idx])
+	}
+
+	samples := make([]byte, len(carrier))
+	F64toU8(carrier, samples)
+
+	return samples
+}
+
 type ManchesterLUT [16]byte
 
 func NewManchesterLUT() ManchesterLUT {
@@ -112,7 +134,8 @@ func F64toU8(f64 []float64, u8 []byte) {
 		panic(fmt.Errorf("arrays must have same dimensions: %d != %d", len(f64), len(u8)))
 	}
 
+	// Values beyond full scale, such as a signal with noise added, clip.
 	for idx, val := range f64 {
-		u8[idx] = uint8(val*127.5 + 127.5)
+		u8[idx] = uint8(math.Max(0, math.Min(255, val*127.5+127.5)))
 	}
 }
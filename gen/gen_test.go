@@ -38,6 +38,31 @@ func TestNewRandSCM(t *testing.T) {
 	}
 }
 
+func TestNewSCM(t *testing.T) {
+	p, err := parse.NewParser("scm", 72, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := p.Cfg()
+
+	samples := make([]byte, cfg.BlockSize2)
+	samples = append(samples, Modulate(NewSCM(45012345, 12, 98765), 72, float64(cfg.SampleRate))...)
+	samples = append(samples, make([]byte, 3*cfg.BlockSize2-len(samples)%cfg.BlockSize2)...)
+
+	var msgs []parse.Message
+	for len(samples) != 0 {
+		msgs = append(msgs, p.Parse(p.Dec().Decode(samples[:cfg.BlockSize2]))...)
+		samples = samples[cfg.BlockSize2:]
+	}
+
+	if len(msgs) != 1 {
+		t.Fatalf("Expected 1 message got %d\n", len(msgs))
+	}
+	if msg := msgs[0]; msg.MeterID() != 45012345 || msg.MeterType() != 12 || msg.MeterConsumption() != 98765 {
+		t.Fatalf("Expected meter 45012345 type 12 consumption 98765 got %+v\n", msg)
+	}
+}
+
 func TestManchesterLUT(t *testing.T) {
 	lut := NewManchesterLUT()
 
@@ -0,0 +1,291 @@
+package gen
+
+import (
+	"encoding/binary"
+
+	"github.com/bemasher/rtlamr/crc"
+	"github.com/bemasher/rtlamr/idm"
+	"github.com/bemasher/rtlamr/r900/gf"
+)
+
+// Each message type's fields are named as in its parser's package. Packet
+// and Symbols build what the meter transmits, the inverse of the parser,
+// including the checksum.
+
+// SCM holds the fields of an SCM packet.
+type SCM struct {
+	ID          uint32 // 26 bits.
+	Type        uint8  // 4 bits.
+	TamperPhy   uint8  // 2 bits.
+	TamperEnc   uint8  // 2 bits.
+	Consumption uint32 // 24 bits.
+}
+
+// Packet returns the SCM packet's 12 bytes:
+//
+//	bits  0-20  preamble 0x1F2A60
+//	bits 21-22  high 2 bits of the id
+//	bits 23     unused
+//	bits 24-25  physical tamper
+//	bits 26-29  ERT type
+//	bits 30-31  encoder tamper
+//	bits 32-55  consumption
+//	bits 56-79  low 24 bits of the id
+//	bits 80-95  BCH checksum of bits 16-79
+func (scm SCM) Packet() []byte {
+	pkt := []byte{
+		0xF9, 0x53, uint8(scm.ID>>24&0x03) << 1,
+		(scm.TamperPhy&0x03)<<6 | (scm.Type&0x0F)<<2 | scm.TamperEnc&0x03,
+		uint8(scm.Consumption >> 16), uint8(scm.Consumption >> 8), uint8(scm.Consumption),
+		uint8(scm.ID >> 16), uint8(scm.ID >> 8), uint8(scm.ID),
+		0, 0,
+	}
+
+	checksum := crc.BCH(crc.BCHPoly, pkt[2:10])
+	pkt[10] = uint8(checksum >> 8)
+	pkt[11] = uint8(checksum & 0xFF)
+
+	return pkt
+}
+
+// SCMPlus holds the fields of an SCM+ packet.
+type SCMPlus struct {
+	EndpointType uint8
+	EndpointID   uint32
+	Consumption  uint32
+	Tamper       uint16
+}
+
+// Packet returns the SCM+ packet's 16 bytes:
+//
+//	bytes  0-1   frame sync 0x16A3
+//	byte   2     protocol id 0x1E
+//	byte   3     endpoint type
+//	bytes  4-7   endpoint id
+//	bytes  8-11  consumption
+//	bytes 12-13  tamper
+//	bytes 14-15  inverted CRC-CCITT of bytes 2-13
+func (scm SCMPlus) Packet() []byte {
+	pkt := make([]byte, 16)
+	binary.BigEndian.PutUint16(pkt[0:2], 0x16A3)
+	pkt[2] = 0x1E
+	pkt[3] = scm.EndpointType
+	binary.BigEndian.PutUint32(pkt[4:8], scm.EndpointID)
+	binary.BigEndian.PutUint32(pkt[8:12], scm.Consumption)
+	binary.BigEndian.PutUint16(pkt[12:14], scm.Tamper)
+	binary.BigEndian.PutUint16(pkt[14:16], ^crc.CCITT(pkt[2:14]))
+
+	return pkt
+}
+
+// IDM holds the fields of an IDM packet.
+type IDM struct {
+	ERTType                  uint8 // 4 bits.
+	ERTSerialNumber          uint32
+	ConsumptionIntervalCount uint8
+	ModuleProgrammingState   uint8
+	TamperCounters           [6]byte
+	AsynchronousCounters     uint16
+	PowerOutageFlags         [6]byte
+	LastConsumptionCount     uint32
+
+	// Most recent first, only the low 9 bits of each are sent.
+	DifferentialConsumptionIntervals [47]uint16
+
+	// Time since the current interval began in 1/16ths of a second.
+	TransmitTimeOffset uint16
+}
+
+// Packet returns the IDM packet's 92 bytes:
+//
+//	bytes  0-3   preamble 0x555516A3
+//	byte   4     packet type 0x1C
+//	byte   5     packet length 0x5C
+//	byte   6     hamming code
+//	byte   7     application version
+//	byte   8     ERT type in the low nibble
+//	bytes  9-12  ERT serial number
+//	byte  13     consumption interval count
+//	byte  14     module programming state
+//	bytes 15-20  tamper counters
+//	bytes 21-22  asynchronous counters
+//	bytes 23-28  power outage flags
+//	bytes 29-32  last consumption count
+//	bytes 33-85  47 9-bit differential consumption intervals
+//	bytes 86-87  transmit time offset
+//	bytes 88-89  serial number CRC, see idm.SerialNumberCRC
+//	bytes 90-91  inverted CRC-CCITT of bytes 4-89
+func (m IDM) Packet() []byte {
+	pkt := make([]byte, 92)
+	binary.BigEndian.PutUint32(pkt[0:4], 0x555516A3)
+	pkt[4] = 0x1C
+	pkt[5] = 92
+	pkt[8] = m.ERTType & 0x0F
+	binary.BigEndian.PutUint32(pkt[9:13], m.ERTSerialNumber)
+	pkt[13] = m.ConsumptionIntervalCount
+	pkt[14] = m.ModuleProgrammingState
+	copy(pkt[15:21], m.TamperCounters[:])
+	binary.BigEndian.PutUint16(pkt[21:23], m.AsynchronousCounters)
+	copy(pkt[23:29], m.PowerOutageFlags[:])
+	binary.BigEndian.PutUint32(pkt[29:33], m.LastConsumptionCount)
+
+	bit := 264
+	for _, interval := range m.DifferentialConsumptionIntervals {
+		for b := 8; b >= 0; b-- {
+			if interval>>uint(b)&1 != 0 {
+				pkt[bit>>3] |= 0x80 >> uint(bit&7)
+			}
+			bit++
+		}
+	}
+
+	binary.BigEndian.PutUint16(pkt[86:88], m.TransmitTimeOffset)
+	binary.BigEndian.PutUint16(pkt[88:90], idm.SerialNumberCRC(m.ERTSerialNumber))
+	binary.BigEndian.PutUint16(pkt[90:92], ^crc.CCITT(pkt[4:90]))
+
+	return pkt
+}
+
+// R900 holds the fields of an R900 packet.
+type R900 struct {
+	ID          uint32
+	Unkn1       uint8
+	NoUse       uint8  // 6 bits.
+	BackFlow    uint8  // 2 bits.
+	Consumption uint32 // 24 bits, see BCD for r900bcd.
+	Unkn3       uint8  // 2 bits.
+	Leak        uint8  // 4 bits.
+	LeakNow     uint8  // 2 bits.
+}
+
+// r900Field is GF(32) with polynomial 37 and generator 2, in which R900's
+// Reed-Solomon code is defined.
+var r900Field = gf.NewField(32, 37, 2)
+
+// Symbols returns the packet's 16 5-bit data symbols followed by the 5
+// symbols of its Reed-Solomon code. The data symbols hold 80 bits:
+//
+//	bits  0-31  id
+//	bits 32-39  unknown
+//	bits 40-45  no use
+//	bits 46-47  backflow
+//	bits 48-71  consumption
+//	bits 72-73  unknown
+//	bits 74-77  leak
+//	bits 78-79  leak now
+func (r R900) Symbols() []byte {
+	bits := uint64(r.ID)<<48 | uint64(r.Unkn1)<<40 | uint64(r.NoUse&0x3F)<<34 |
+		uint64(r.BackFlow&0x03)<<32 | uint64(r.Consumption&0xFFFFFF)<<8 |
+		uint64(r.Unkn3&0x03)<<6 | uint64(r.Leak&0x0F)<<2 | uint64(r.LeakNow&0x03)
+
+	// 80 bits, the top 16 in id's high half.
+	symbols := make([]byte, 21)
+	hi, lo := uint64(r.ID>>16), bits
+	for idx := 15; idx >= 0; idx-- {
+		symbols[idx] = byte(lo & 0x1F)
+		lo = lo>>5 | (hi&0x1F)<<59
+		hi >>= 5
+	}
+
+	// The code is shortened, the receiver places the data and parity
+	// symbols at either end of a 31 symbol codeword and requires its 5
+	// syndromes to be zero. Syndromes are linear in each symbol, so the
+	// parity symbols solve a linear system.
+	codeword := make([]byte, 31)
+	copy(codeword, symbols[:16])
+	rhs := r900Field.Syndrome(codeword, 5, 29)
+
+	var m [5][6]byte
+	for k := 0; k < 5; k++ {
+		unit := make([]byte, 31)
+		unit[26+k] = 1
+		for j, s := range r900Field.Syndrome(unit, 5, 29) {
+			m[j][k] = s
+		}
+	}
+	for j := range m {
+		m[j][5] = rhs[j]
+	}
+	for col := 0; col < 5; col++ {
+		pivot := col
+		for m[pivot][col] == 0 {
+			pivot++
+		}
+		m[col], m[pivot] = m[pivot], m[col]
+		inv := r900Field.Inv(m[col][col])
+		for c := range m[col] {
+			m[col][c] = r900Field.Mul(m[col][c], inv)
+		}
+		for row := range m {
+			if row != col && m[row][col] != 0 {
+				f := m[row][col]
+				for c := range m[row] {
+					m[row][c] ^= r900Field.Mul(f, m[col][c])
+				}
+			}
+		}
+	}
+	for k := 0; k < 5; k++ {
+		symbols[16+k] = m[k][5]
+	}
+
+	return symbols
+}
+
+// BCD returns v's decimal digits packed one per nibble, as r900bcd meters
+// send consumption. Only the low 6 digits fit R900's consumption.
+func BCD(v uint32) (bcd uint32) {
+	for shift := 0; v != 0; shift += 4 {
+		bcd |= v % 10 << uint(shift)
+		v /= 10
+	}
+	return bcd
+}
+
+// ManchesterChips returns the chips sending pkt, each bit Manchester coded
+// as two chips.
+func ManchesterChips(pkt []byte) []byte {
+	return UnpackBits(NewManchesterLUT().Encode(pkt))
+}
+
+// r900Chips are the chips sent for each base-6 digit of an R900 symbol.
+var r900Chips = [6]string{"0011", "0101", "0110", "1100", "1010", "1001"}
+
+// R900Chips returns the chips sending an R900 packet with the given symbols.
+// The preamble is Manchester coded, and each symbol is sent as two base-6
+// digits of 4 chips each.
+func R900Chips(symbols []byte) []byte {
+	var chips []byte
+	for _, b := range "00000000000000001110010101100100" {
+		if b == '1' {
+			chips = append(chips, 1, 0)
+		} else {
+			chips = append(chips, 0, 1)
+		}
+	}
+	for _, symbol := range symbols {
+		for _, digit := range []byte{symbol / 6, symbol % 6} {
+			for _, c := range r900Chips[digit] {
+				chips = append(chips, byte(c-'0'))
+			}
+		}
+	}
+
+	return chips
+}
+
+// ModulateR900 returns interleaved 8-bit inphase and quadrature samples of an
+// R900 packet with the given symbols, with chipLength samples per chip on a
+// carrier offset 10kHz from the center frequency.
+func ModulateR900(symbols []byte, chipLength int, sampleRate float64) []byte {
+	signal := Upsample(R900Chips(symbols), chipLength)
+	carrier := CmplxOscillatorF64(len(signal), 10e3, sampleRate)
+	for idx := range carrier {
+		carrier[idx] *= float64(signal[idx>>1])
+	}
+
+	samples := make([]byte, len(carrier))
+	F64toU8(carrier, samples)
+
+	return samples
+}
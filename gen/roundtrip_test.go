@@ -0,0 +1,156 @@
+package gen
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/bemasher/rtlamr/idm"
+	"github.com/bemasher/rtlamr/parse"
+	"github.com/bemasher/rtlamr/r900"
+	"github.com/bemasher/rtlamr/scm"
+	"github.com/bemasher/rtlamr/scmplus"
+
+	_ "github.com/bemasher/rtlamr/r900bcd"
+)
+
+// roundTrip passes chips through ch and returns the messages of msgType
+// decoded from them.
+func roundTrip(t *testing.T, msgType string, chips []byte, ch Channel) []parse.Message {
+	t.Helper()
+
+	bd, err := parse.NewBlockDecoder(msgType, 72, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := parse.Config(msgType, 72)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	samples := ch.Silence(bd.BlockSize() >> 1)
+	samples = append(samples, ch.Modulate(chips, cfg.ChipLength, float64(bd.SampleRate()))...)
+	samples = append(samples, ch.Silence(bd.BlockSize()-len(samples)%bd.BlockSize()>>1+bd.BlockSize())...)
+
+	return bd.Write(samples)
+}
+
+// channels are impairments each packet must be decoded through.
+var channels = map[string]Channel{
+	"Perfect":    {},
+	"Noise":      {SNR: 12},
+	"FreqOffset": {FreqOffset: 25e3},
+	"RateError":  {RateError: 300e-6},
+	"All":        {SNR: 15, FreqOffset: -15e3, RateError: -200e-6},
+}
+
+func TestRoundTripSCM(t *testing.T) {
+	want := SCM{ID: 0x2ABCDEF, Type: 12, TamperPhy: 2, TamperEnc: 1, Consumption: 0xFEDCBA}
+
+	for name, ch := range channels {
+		t.Run(name, func(t *testing.T) {
+			ch.Rand = rand.New(rand.NewSource(1))
+			msgs := roundTrip(t, "scm", ManchesterChips(want.Packet()), ch)
+			if len(msgs) != 1 {
+				t.Fatalf("decoded %d messages, want 1", len(msgs))
+			}
+
+			got := msgs[0].(scm.SCM)
+			if got.ID != want.ID || got.Type != want.Type || got.TamperPhy != want.TamperPhy ||
+				got.TamperEnc != want.TamperEnc || got.Consumption != want.Consumption {
+				t.Errorf("decoded %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestRoundTripSCMPlus(t *testing.T) {
+	want := SCMPlus{EndpointType: 0xAB, EndpointID: 0xDEADBEEF, Consumption: 0x01234567, Tamper: 0x8421}
+
+	for name, ch := range channels {
+		t.Run(name, func(t *testing.T) {
+			ch.Rand = rand.New(rand.NewSource(1))
+			msgs := roundTrip(t, "scm+", ManchesterChips(want.Packet()), ch)
+			if len(msgs) != 1 {
+				t.Fatalf("decoded %d messages, want 1", len(msgs))
+			}
+
+			got := msgs[0].(scmplus.SCM)
+			if got.EndpointType != want.EndpointType || got.EndpointID != want.EndpointID ||
+				got.Consumption != want.Consumption || got.Tamper != want.Tamper {
+				t.Errorf("decoded %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestRoundTripIDM(t *testing.T) {
+	want := IDM{
+		ERTType:                  8,
+		ERTSerialNumber:          0x87654321,
+		ConsumptionIntervalCount: 200,
+		ModuleProgrammingState:   0x5A,
+		TamperCounters:           [6]byte{1, 2, 3, 4, 5, 6},
+		AsynchronousCounters:     0x1234,
+		PowerOutageFlags:         [6]byte{0x80, 0, 0, 0, 0, 0x01},
+		LastConsumptionCount:     0xCAFEF00D,
+		TransmitTimeOffset:       0x0F0F,
+	}
+	for idx := range want.DifferentialConsumptionIntervals {
+		want.DifferentialConsumptionIntervals[idx] = uint16(idx*37) & 0x1FF
+	}
+
+	for name, ch := range channels {
+		t.Run(name, func(t *testing.T) {
+			ch.Rand = rand.New(rand.NewSource(1))
+			msgs := roundTrip(t, "idm", ManchesterChips(want.Packet()), ch)
+			if len(msgs) != 1 {
+				t.Fatalf("decoded %d messages, want 1", len(msgs))
+			}
+
+			got := msgs[0].(idm.IDM)
+			if got.ERTType != want.ERTType || got.ERTSerialNumber != want.ERTSerialNumber ||
+				got.ConsumptionIntervalCount != want.ConsumptionIntervalCount ||
+				got.ModuleProgrammingState != want.ModuleProgrammingState ||
+				string(got.TamperCounters) != string(want.TamperCounters[:]) ||
+				got.AsynchronousCounters != want.AsynchronousCounters ||
+				string(got.PowerOutageFlags) != string(want.PowerOutageFlags[:]) ||
+				got.LastConsumptionCount != want.LastConsumptionCount ||
+				got.DifferentialConsumptionIntervals != idm.Interval(want.DifferentialConsumptionIntervals) ||
+				got.TransmitTimeOffset != want.TransmitTimeOffset ||
+				got.SerialNumberCRC != idm.SerialNumberCRC(want.ERTSerialNumber) {
+				t.Errorf("decoded %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestRoundTripR900(t *testing.T) {
+	want := R900{ID: 1560012345, Unkn1: 0xA3, NoUse: 0x2A, BackFlow: 2, Consumption: 0xABCDEF, Unkn3: 1, Leak: 9, LeakNow: 3}
+
+	for name, ch := range channels {
+		t.Run(name, func(t *testing.T) {
+			ch.Rand = rand.New(rand.NewSource(1))
+			msgs := roundTrip(t, "r900", R900Chips(want.Symbols()), ch)
+			if len(msgs) != 1 {
+				t.Fatalf("decoded %d messages, want 1", len(msgs))
+			}
+
+			got := msgs[0].(r900.R900)
+			if (R900{got.ID, got.Unkn1, got.NoUse, got.BackFlow, got.Consumption, got.Unkn3, got.Leak, got.LeakNow}) != want {
+				t.Errorf("decoded %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestRoundTripR900BCD(t *testing.T) {
+	pkt := R900{ID: 1560012345, Consumption: BCD(987654)}
+
+	msgs := roundTrip(t, "r900bcd", R900Chips(pkt.Symbols()), Channel{})
+	if len(msgs) != 1 {
+		t.Fatalf("decoded %d messages, want 1", len(msgs))
+	}
+	if got := msgs[0].MeterConsumption(); got != 987654 {
+		t.Errorf("decoded consumption %d, want 987654", got)
+	}
+}
@@ -0,0 +1,241 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bemasher/rtlamr/lru"
+	"github.com/bemasher/rtlamr/parse"
+)
+
+// Number of meters whose last message is reported by /status and /meters.
+const healthMaxMeters = 1024
+
+// DeviceStatus is the tuner configuration reported by /status.
+type DeviceStatus struct {
+	MsgType     string
+	CenterFreq  uint32
+	SampleRate  int
+	TunerGain   float64 `json:",omitempty"` // dB, if given by -tunergain.
+	GainByIndex uint    `json:",omitempty"`
+	AGC         bool
+}
+
+// HealthStatus is served as json by /status.
+type HealthStatus struct {
+	Uptime      string
+	Device      DeviceStatus
+	LastBlock   *time.Time `json:",omitempty"`
+	Blocks      uint64
+	Decoded     uint64
+	BadChecksum uint64
+	Emitted     uint64
+	Overruns    uint64               // Blocks handled slower than real time.
+	Packets     map[string]uint64    // Emitted messages per message type.
+	Meters      map[uint32]time.Time // Last emitted message per meter.
+}
+
+// Health tracks receiver activity for the -http.listen endpoints. The
+// receiver updates it while the http server reads it concurrently.
+type Health struct {
+	MaxAge  time.Duration // Blocks older than this fail /healthz.
+	History time.Duration // Consumption history kept per meter for the dashboard.
+	Token   string        // Bearer token required by /api/, if set.
+
+	mu        sync.Mutex
+	start     time.Time
+	device    DeviceStatus
+	lastBlock time.Time
+	outputErr error
+	counts    Stats
+	packets   map[string]uint64
+	meters    *lru.Cache // Meter ids to *MeterReading.
+}
+
+func NewHealth(maxAge time.Duration) *Health {
+	return &Health{
+		MaxAge:  maxAge,
+		start:   time.Now(),
+		packets: make(map[string]uint64),
+		meters:  lru.New(healthMaxMeters),
+	}
+}
+
+// Configured records the tuner configuration once the receiver is set up.
+func (h *Health) Configured(device DeviceStatus) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.device = device
+}
+
+// Block records that a sample block was read and the receiver's counts.
+func (h *Health) Block(t time.Time, s Stats) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastBlock = t
+	h.counts = Stats{Blocks: s.Blocks, Decoded: s.Decoded, BadChecksum: s.BadChecksum, Emitted: s.Emitted, Overruns: s.Overruns}
+}
+
+// Emitted records a message written to the output, or the error writing
+// it. The output is reported unhealthy until a message is written again.
+func (h *Health) Emitted(msg parse.LogMessage, err error) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.outputErr = err
+	if err != nil {
+		return
+	}
+	h.packets[msg.MsgType()]++
+
+	reading, ok := h.meters.Get(msg.MeterID())
+	if !ok {
+		reading = new(MeterReading)
+		h.meters.Add(msg.MeterID(), reading)
+	}
+	reading.(*MeterReading).update(msg, h.History)
+}
+
+// Check returns an error describing why the receiver is unhealthy, if it is.
+func (h *Health) Check(now time.Time) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.lastBlock.IsZero() {
+		return fmt.Errorf("no samples read since starting %s ago", now.Sub(h.start).Truncate(time.Second))
+	}
+	if age := now.Sub(h.lastBlock); age > h.MaxAge {
+		return fmt.Errorf("no samples read for %s", age.Truncate(time.Second))
+	}
+	if h.outputErr != nil {
+		return fmt.Errorf("writing output: %s", h.outputErr)
+	}
+	return nil
+}
+
+// Status returns a snapshot of the receiver's activity.
+func (h *Health) Status(now time.Time) HealthStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	status := HealthStatus{
+		Uptime:      now.Sub(h.start).Truncate(time.Second).String(),
+		Device:      h.device,
+		Blocks:      h.counts.Blocks,
+		Decoded:     h.counts.Decoded,
+		BadChecksum: h.counts.BadChecksum,
+		Emitted:     h.counts.Emitted,
+		Overruns:    h.counts.Overruns,
+		Packets:     make(map[string]uint64, len(h.packets)),
+		Meters:      make(map[uint32]time.Time, h.meters.Len()),
+	}
+	if !h.lastBlock.IsZero() {
+		lastBlock := h.lastBlock
+		status.LastBlock = &lastBlock
+	}
+	for msgType, count := range h.packets {
+		status.Packets[msgType] = count
+	}
+	h.meters.Range(func(key, value interface{}) {
+		status.Meters[key.(uint32)] = value.(*MeterReading).Time
+	})
+
+	return status
+}
+
+// Readings returns a copy of the last reading of each meter, most recently
+// heard first.
+func (h *Health) Readings() []MeterReading {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	readings := make([]MeterReading, 0, h.meters.Len())
+	h.meters.Range(func(key, value interface{}) {
+		r := *value.(*MeterReading)
+		r.History = append([]HistoryPoint(nil), r.History...)
+		readings = append(readings, r)
+	})
+
+	sort.SliceStable(readings, func(i, j int) bool {
+		return readings[i].Time.After(readings[j].Time)
+	})
+
+	return readings
+}
+
+// ServeHTTP serves /healthz, /status, /meters, the dashboard at / and the
+// api under /api/.
+func (h *Health) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	w.Header().Set("Content-Type", "application/json")
+
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		h.serveAPI(w, r, now)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(dashboardHTML)
+	case "/healthz":
+		var body struct {
+			OK     bool
+			Reason string `json:",omitempty"`
+		}
+		body.OK = true
+		if err := h.Check(now); err != nil {
+			body.OK, body.Reason = false, err.Error()
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(body)
+	case "/status":
+		json.NewEncoder(w).Encode(h.Status(now))
+	case "/meters":
+		json.NewEncoder(w).Encode(h.Readings())
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Listen serves the health endpoints on addr until the returned listener is
+// closed.
+func (h *Health) Listen(addr string) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	go http.Serve(l, h)
+	return l, nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bemasher/rtlamr/parse"
+	"github.com/bemasher/rtlamr/scm"
+)
+
+func TestHealth(t *testing.T) {
+	h := NewHealth(10 * time.Second)
+	now := time.Now()
+
+	get := func(path string) (int, map[string]interface{}) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+
+		var body map[string]interface{}
+		if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+			t.Fatalf("%s: %s\n", path, err)
+		}
+		return rec.Code, body
+	}
+
+	if code, body := get("/healthz"); code != http.StatusServiceUnavailable || body["Reason"] == nil {
+		t.Fatalf("Expected unavailable before reading samples got %d %v\n", code, body)
+	}
+
+	h.Block(now, Stats{Blocks: 1, Overruns: 2})
+	if code, body := get("/healthz"); code != http.StatusOK {
+		t.Fatalf("Expected ok got %d %v\n", code, body)
+	}
+
+	if err := h.Check(now.Add(11 * time.Second)); err == nil {
+		t.Fatal("Expected error once blocks are stale")
+	}
+
+	msg := parse.LogMessage{Time: now, Message: scm.SCM{ID: 1234, Consumption: 100}}
+	h.Emitted(msg, errors.New("no space left on device"))
+	if err := h.Check(now); err == nil {
+		t.Fatal("Expected error after failed write")
+	}
+	h.Emitted(msg, nil)
+	if err := h.Check(now); err != nil {
+		t.Fatalf("Expected nil after successful write got %q\n", err)
+	}
+
+	status := h.Status(now)
+	if status.Packets["SCM"] != 1 {
+		t.Fatalf("Expected 1 SCM packet got %v\n", status.Packets)
+	}
+	if last, ok := status.Meters[1234]; !ok || !last.Equal(now) {
+		t.Fatalf("Expected meter 1234 last heard at %s got %v\n", now, status.Meters)
+	}
+
+	if code, body := get("/status"); code != http.StatusOK || body["Blocks"] != 1.0 || body["Overruns"] != 2.0 {
+		t.Fatalf("Expected status with 1 block and 2 overruns got %d %v\n", code, body)
+	}
+}
+
+func TestDashboard(t *testing.T) {
+	h := NewHealth(10 * time.Second)
+	h.History = 24 * time.Hour
+	start := time.Date(2015, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	// A reading every 5 minutes for two days fills more slots than are kept.
+	for i := 0; i < 2*24*12; i++ {
+		h.Emitted(parse.LogMessage{
+			Time:      start.Add(time.Duration(i) * 5 * time.Minute),
+			MeterName: "house-water",
+			Message:   scm.SCM{ID: 1234, Consumption: uint32(i)},
+		}, nil)
+	}
+	h.Emitted(parse.LogMessage{Time: start, Message: scm.SCM{ID: 5678}}, nil)
+
+	readings := h.Readings()
+	if len(readings) != 2 || readings[0].ID != 1234 || readings[0].Name != "house-water" || readings[0].Count != 2*24*12 {
+		t.Fatalf("Unexpected readings: %+v\n", readings)
+	}
+
+	history := readings[0].History
+	if len(history) > dashboardSlots {
+		t.Fatalf("Expected at most %d points got %d\n", dashboardSlots, len(history))
+	}
+	last := history[len(history)-1]
+	if last.Consumption != readings[0].Consumption || last.Time.Sub(history[0].Time) > h.History {
+		t.Fatalf("Unexpected history from %+v to %+v\n", history[0], last)
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "text/html; charset=utf-8" || rec.Body.Len() == 0 {
+		t.Fatalf("Expected dashboard got %d %q\n", rec.Code, rec.Header().Get("Content-Type"))
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/meters", nil))
+	var meters []MeterReading
+	if err := json.NewDecoder(rec.Body).Decode(&meters); err != nil || len(meters) != 2 {
+		t.Fatalf("Expected 2 meters got %v %v\n", meters, err)
+	}
+}
+
+func TestHealthAPI(t *testing.T) {
+	h := NewHealth(10 * time.Second)
+	h.History = time.Hour
+	h.Token = "secret"
+	now := time.Now()
+
+	get := func(path, token string, body interface{}) int {
+		t.Helper()
+		req := httptest.NewRequest("GET", path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s: Content-Type %q, want application/json", path, ct)
+		}
+		if err := json.NewDecoder(rec.Body).Decode(body); err != nil {
+			t.Fatalf("%s: %s", path, err)
+		}
+		return rec.Code
+	}
+
+	h.Emitted(parse.LogMessage{Time: now.Add(-2 * time.Hour), Message: scm.SCM{ID: 1, Consumption: 100}}, nil)
+	h.Emitted(parse.LogMessage{Time: now.Add(-30 * time.Minute), Message: scm.SCM{ID: 1, Consumption: 110}}, nil)
+	h.Emitted(parse.LogMessage{Time: now, Message: scm.SCM{ID: 2, Consumption: 200}}, nil)
+	h.Emitted(parse.LogMessage{Time: now.Add(-10 * time.Minute), Message: scm.SCM{ID: 1, Consumption: 120}}, nil)
+
+	var apiErr apiError
+	if code := get("/api/meters", "", &apiErr); code != http.StatusUnauthorized {
+		t.Errorf("without token got %d, want 401", code)
+	}
+	if code := get("/api/meters", "wrong", &apiErr); code != http.StatusUnauthorized {
+		t.Errorf("with wrong token got %d, want 401", code)
+	}
+
+	var meters []APIMeter
+	if code := get("/api/meters", "secret", &meters); code != http.StatusOK {
+		t.Fatalf("/api/meters got %d", code)
+	}
+	if len(meters) != 2 || meters[0].ID != 2 || meters[1].ID != 1 || meters[1].Count != 3 {
+		t.Errorf("unexpected meters %+v", meters)
+	}
+
+	var msg map[string]interface{}
+	if code := get("/api/meters/1", "secret", &msg); code != http.StatusOK {
+		t.Fatalf("/api/meters/1 got %d", code)
+	}
+	if m, ok := msg["Message"].(map[string]interface{}); !ok || m["Consumption"] != 120.0 {
+		t.Errorf("unexpected reading %v", msg)
+	}
+
+	if code := get("/api/meters/3", "secret", &apiErr); code != http.StatusNotFound || apiErr.Error == "" {
+		t.Errorf("unknown meter got %d %+v, want 404", code, apiErr)
+	}
+	if code := get("/api/meters/x", "secret", &apiErr); code != http.StatusBadRequest {
+		t.Errorf("invalid id got %d, want 400", code)
+	}
+
+	var history []HistoryPoint
+	if code := get("/api/meters/1/history", "secret", &history); code != http.StatusOK || len(history) != 2 {
+		t.Errorf("history got %d %+v, want 2 points", code, history)
+	}
+	if code := get("/api/meters/1/history?since=15m", "secret", &history); code != http.StatusOK || len(history) != 1 || history[0].Consumption != 120 {
+		t.Errorf("history since 15m got %d %+v, want 1 point", code, history)
+	}
+	since := now.Add(-time.Hour).Format(time.RFC3339)
+	if code := get("/api/meters/1/history?since="+since, "secret", &history); code != http.StatusOK || len(history) != 2 {
+		t.Errorf("history since %s got %d %+v, want 2 points", since, code, history)
+	}
+	if code := get("/api/meters/1/history?since=bogus", "secret", &apiErr); code != http.StatusBadRequest {
+		t.Errorf("invalid since got %d, want 400", code)
+	}
+
+	h.History = 0
+	if code := get("/api/meters/1/history", "secret", &apiErr); code != http.StatusNotFound {
+		t.Errorf("disabled history got %d, want 404", code)
+	}
+}
@@ -0,0 +1,24 @@
+package idm
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/bemasher/rtlamr/crc"
+	"github.com/bemasher/rtlamr/parse"
+	"github.com/bemasher/rtlamr/parse/parsetest"
+)
+
+func FuzzIDM(f *testing.F) {
+	parsetest.Fuzz(f, "idm", func(msg parse.Message) error {
+		raw := msg.Raw()
+		if len(raw) != 92 {
+			return fmt.Errorf("raw packet is %d bytes, want 92", len(raw))
+		}
+		if !crc.NewCCITT().Valid(raw[4:]) {
+			return errors.New("checksum doesn't verify")
+		}
+		return nil
+	})
+}
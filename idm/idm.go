@@ -18,17 +18,21 @@ package idm
 
 import (
 	"encoding/binary"
+	"encoding/gob"
 	"fmt"
+	"math/bits"
 	"strconv"
 	"strings"
 
 	"github.com/bemasher/rtlamr/crc"
 	"github.com/bemasher/rtlamr/decode"
+	"github.com/bemasher/rtlamr/lru"
 	"github.com/bemasher/rtlamr/parse"
 )
 
 func init() {
-	parse.Register("idm", NewParser)
+	parse.Register("idm", NewParser, parse.DefaultConstraints)
+	gob.RegisterName("IDM", IDM{})
 }
 
 func NewPacketConfig(chipLength int) (cfg decode.PacketConfig) {
@@ -42,9 +46,16 @@ func NewPacketConfig(chipLength int) (cfg decode.PacketConfig) {
 	return
 }
 
+// Maximum number of meters whose last packet is kept for consistency checks.
+const MaxMeters = 1024
+
 type Parser struct {
 	decode.Decoder
 	crc.CRC
+
+	last *lru.Cache
+
+	allowBadCRC bool
 }
 
 func (p Parser) Dec() decode.Decoder {
@@ -58,13 +69,22 @@ func (p *Parser) Cfg() *decode.PacketConfig {
 func NewParser(chipLength, decimation int) (p parse.Parser) {
 	return &Parser{
 		decode.NewDecoder(NewPacketConfig(chipLength), decimation),
-		crc.NewCRC("CCITT", 0xFFFF, 0x1021, 0x1D0F),
+		crc.NewCCITT(),
+		lru.New(MaxMeters),
+		parse.AllowBadCRC,
 	}
 }
 
+// SetAllowBadCRC sets whether Parse keeps packets failing their checksum.
+func (p *Parser) SetAllowBadCRC(allow bool) {
+	p.allowBadCRC = allow
+}
+
 func (p Parser) Parse(indices []int) (msgs []parse.Message) {
 	seen := make(map[string]bool)
 
+	var failed []parse.Message
+
 	for _, pkt := range p.Decoder.Slice(indices) {
 		s := string(pkt)
 		if seen[s] {
@@ -79,19 +99,60 @@ func (p Parser) Parse(indices []int) (msgs []parse.Message) {
 			continue
 		}
 
-		// If the checksum fails, bail.
-		if residue := p.Checksum(data.Bytes[4:92]); residue != p.Residue {
+		// If the checksum fails, bail unless we're keeping failed packets.
+		checksumOK := p.Valid(data.Bytes[4:92])
+		if !checksumOK && !p.allowBadCRC {
 			continue
 		}
 
 		idm := NewIDM(data)
+		idm.badChecksum = !checksumOK
 
 		// If the meter id is 0, bail.
 		if idm.ERTSerialNumber == 0 {
 			continue
 		}
 
-		msgs = append(msgs, idm)
+		if checksumOK {
+			// Check against the previous packet from this meter, if any.
+			idm.consistent = true
+			if prev, ok := p.last.Get(idm.ERTSerialNumber); ok {
+				idm.consistent = Consistent(prev.(IDM), idm)
+			}
+			p.last.Add(idm.ERTSerialNumber, idm)
+
+			msgs = append(msgs, idm)
+		} else {
+			failed = append(failed, idm)
+		}
+	}
+
+	if len(msgs) == 0 {
+		msgs = failed
+	}
+
+	return
+}
+
+// Diagnose explains why the packet at the preamble candidate idx did or
+// didn't parse.
+func (p Parser) Diagnose(idx int) (c parse.Candidate) {
+	pkts := p.Decoder.Slice([]int{idx})
+	if len(pkts) == 0 || len(pkts[0]) != 92 {
+		c.Stop = "length"
+		return
+	}
+	pkt := pkts[0]
+
+	c.Checksum = fmt.Sprintf("%04X", binary.BigEndian.Uint16(pkt[90:92]))
+	c.Expected = fmt.Sprintf("%04X", ^crc.CCITT(pkt[4:90]))
+	if !p.Valid(pkt[4:92]) && !p.allowBadCRC {
+		c.Stop = "checksum"
+		return
+	}
+
+	if NewIDM(parse.NewDataFromBytes(pkt)).ERTSerialNumber == 0 {
+		c.Stop = "id"
 	}
 
 	return
@@ -116,6 +177,10 @@ type IDM struct {
 	TransmitTimeOffset               uint16
 	SerialNumberCRC                  uint16
 	PacketCRC                        uint16
+
+	raw         []byte
+	consistent  bool // Agrees with the previous packet from the same meter, see Consistent.
+	badChecksum bool
 }
 
 func NewIDM(data parse.Data) (idm IDM) {
@@ -143,12 +208,59 @@ func NewIDM(data parse.Data) (idm IDM) {
 	idm.TransmitTimeOffset = binary.BigEndian.Uint16(data.Bytes[86:88])
 	idm.SerialNumberCRC = binary.BigEndian.Uint16(data.Bytes[88:90])
 	idm.PacketCRC = binary.BigEndian.Uint16(data.Bytes[90:92])
+	idm.raw = data.Bytes
 
 	return
 }
 
+// SerialNumberCRC returns the serial number CRC IDM packets carry for the
+// given ERT serial number, the inverted CRC-CCITT of its 4 bytes.
+func SerialNumberCRC(serial uint32) uint16 {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], serial)
+	return ^crc.CCITT(b[:])
+}
+
+// IsConsistent reports whether the packet agreed with the previous packet
+// the parser decoded from the same meter, or is the first from it.
+func (idm IDM) IsConsistent() bool {
+	return idm.consistent
+}
+
 type Interval [47]uint16
 
+// Consistent reports whether cur, a packet received after prev from the same
+// meter, could have followed it. Intervals are most recent first and the
+// interval count advances by one each interval, so the history in prev must
+// reappear in cur shifted by the number of elapsed intervals. The consumption
+// counter must not decrease, and must have grown by at least the consumption
+// of the intervals which completed entirely between the two packets.
+func Consistent(prev, cur IDM) bool {
+	if cur.LastConsumptionCount < prev.LastConsumptionCount {
+		return false
+	}
+
+	elapsed := int(cur.ConsumptionIntervalCount - prev.ConsumptionIntervalCount)
+	if elapsed >= len(cur.DifferentialConsumptionIntervals) {
+		// No overlap between the two packets to compare.
+		return true
+	}
+
+	// The current interval is still accumulating, compare only completed ones.
+	for idx := 1; idx+elapsed < len(cur.DifferentialConsumptionIntervals); idx++ {
+		if cur.DifferentialConsumptionIntervals[idx+elapsed] != prev.DifferentialConsumptionIntervals[idx] {
+			return false
+		}
+	}
+
+	var completed uint32
+	for idx := 1; idx < elapsed; idx++ {
+		completed += uint32(cur.DifferentialConsumptionIntervals[idx])
+	}
+
+	return cur.LastConsumptionCount-prev.LastConsumptionCount >= completed
+}
+
 func (interval Interval) Record() (r []string) {
 	for _, val := range interval {
 		r = append(r, strconv.FormatUint(uint64(val), 10))
@@ -168,12 +280,76 @@ func (idm IDM) MeterType() uint8 {
 	return idm.ERTType
 }
 
+func (idm IDM) MeterConsumption() uint32 {
+	return idm.LastConsumptionCount
+}
+
 func (idm IDM) Checksum() []byte {
 	checksum := make([]byte, 2)
 	binary.BigEndian.PutUint16(checksum, idm.PacketCRC)
 	return checksum
 }
 
+func (idm IDM) ChecksumOK() bool {
+	return !idm.badChecksum
+}
+
+func (idm IDM) Raw() []byte {
+	return idm.raw
+}
+
+// Field reports TamperCounters and PowerOutageFlags as Flags does.
+func (idm IDM) Field(name string) (parse.Value, bool) {
+	switch name {
+	case "ERTType":
+		return parse.Num(float64(idm.ERTType)), true
+	case "ERTSerialNumber":
+		return parse.Num(float64(idm.ERTSerialNumber)), true
+	case "ConsumptionIntervalCount":
+		return parse.Num(float64(idm.ConsumptionIntervalCount)), true
+	case "ModuleProgrammingState":
+		return parse.Num(float64(idm.ModuleProgrammingState)), true
+	case "TamperCounters":
+		var tamper uint
+		for _, b := range idm.TamperCounters {
+			tamper += uint(b)
+		}
+		return parse.Num(float64(tamper)), true
+	case "AsynchronousCounters":
+		return parse.Num(float64(idm.AsynchronousCounters)), true
+	case "PowerOutageFlags":
+		var outages int
+		for _, b := range idm.PowerOutageFlags {
+			outages += bits.OnesCount8(b)
+		}
+		return parse.Num(float64(outages)), true
+	case "LastConsumptionCount":
+		return parse.Num(float64(idm.LastConsumptionCount)), true
+	case "TransmitTimeOffset":
+		return parse.Num(float64(idm.TransmitTimeOffset)), true
+	case "Consistent":
+		return parse.Bool(idm.consistent), true
+	}
+	return parse.Value{}, false
+}
+
+// Flags reports the sum of the tamper counters and the number of power outage
+// flags set, the 6 byte fields don't fit a uint on 32-bit platforms.
+func (idm IDM) Flags() map[string]uint {
+	var tamper, outages uint
+	for _, b := range idm.TamperCounters {
+		tamper += uint(b)
+	}
+	for _, b := range idm.PowerOutageFlags {
+		outages += uint(bits.OnesCount8(b))
+	}
+
+	return map[string]uint{
+		"TamperCounters":   tamper,
+		"PowerOutageFlags": outages,
+	}
+}
+
 func (idm IDM) String() string {
 	var fields []string
 
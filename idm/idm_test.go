@@ -0,0 +1,131 @@
+package idm
+
+import (
+	"io"
+	"testing"
+
+	"github.com/bemasher/rtlamr/parse"
+	"github.com/bemasher/rtlamr/parse/parsetest"
+)
+
+// Builds a sequence of packets from a meter consuming according to usage,
+// one packet per interval.
+func newSequence(usage []uint16) (pkts []IDM) {
+	var (
+		idm   IDM
+		total uint32 = 1000
+	)
+
+	for count, u := range usage {
+		copy(idm.DifferentialConsumptionIntervals[1:], idm.DifferentialConsumptionIntervals[:])
+		idm.DifferentialConsumptionIntervals[0] = u
+		total += uint32(u)
+
+		idm.ERTSerialNumber = 12345678
+		idm.ConsumptionIntervalCount = uint8(count)
+		idm.LastConsumptionCount = total
+
+		pkts = append(pkts, idm)
+	}
+
+	return
+}
+
+func TestConsistent(t *testing.T) {
+	usage := make([]uint16, 300)
+	for idx := range usage {
+		usage[idx] = uint16(idx*7) % 23
+	}
+	pkts := newSequence(usage)
+
+	for _, elapsed := range []int{0, 1, 2, 5, 46, 47, 60} {
+		for idx := 0; idx+elapsed < len(pkts); idx += 13 {
+			if !Consistent(pkts[idx], pkts[idx+elapsed]) {
+				t.Fatalf("Expected packets %d and %d to be consistent\n", idx, idx+elapsed)
+			}
+		}
+	}
+}
+
+func TestInconsistent(t *testing.T) {
+	usage := make([]uint16, 16)
+	for idx := range usage {
+		usage[idx] = uint16(idx + 1)
+	}
+	pkts := newSequence(usage)
+	prev, cur := pkts[8], pkts[10]
+
+	// Corrupted history.
+	corrupt := cur
+	corrupt.DifferentialConsumptionIntervals[5] ^= 0x100
+	if Consistent(prev, corrupt) {
+		t.Fatal("Expected corrupted interval to be inconsistent")
+	}
+
+	// Counter running backwards.
+	corrupt = cur
+	corrupt.LastConsumptionCount = prev.LastConsumptionCount - 1
+	if Consistent(prev, corrupt) {
+		t.Fatal("Expected decreasing consumption to be inconsistent")
+	}
+
+	// Counter not accounting for completed intervals.
+	corrupt = cur
+	corrupt.LastConsumptionCount = prev.LastConsumptionCount + uint32(cur.DifferentialConsumptionIntervals[1]) - 1
+	if Consistent(prev, corrupt) {
+		t.Fatal("Expected consumption short of completed intervals to be inconsistent")
+	}
+}
+
+// TestConsistentDecoded decodes the consecutive packets of the idm fixture
+// through one parser, twice. The second pass starts with a packet whose
+// counter is behind the last packet of the first, which must be flagged.
+func TestConsistentDecoded(t *testing.T) {
+	cases, err := parsetest.Cases()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var c parsetest.Case
+	for _, c = range cases {
+		if c.MsgType == "idm" {
+			break
+		}
+	}
+
+	bd, err := parse.NewBlockDecoder(c.MsgType, c.SymbolLength, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var consistent []bool
+	for pass := 0; pass < 2; pass++ {
+		r, err := c.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		block := make([]byte, bd.BlockSize())
+		for {
+			if _, err := io.ReadFull(r, block); err != nil {
+				break
+			}
+			msgs, err := bd.Decode(block)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, msg := range msgs {
+				consistent = append(consistent, msg.(IDM).IsConsistent())
+			}
+		}
+		r.Close()
+	}
+
+	expt := []bool{true, true, false, true}
+	if len(consistent) != len(expt) {
+		t.Fatalf("Expected %d packets got %d\n", len(expt), len(consistent))
+	}
+	for idx := range expt {
+		if consistent[idx] != expt[idx] {
+			t.Fatalf("Expected %v got %v\n", expt, consistent)
+		}
+	}
+}
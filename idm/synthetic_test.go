@@ -0,0 +1,11 @@
+package idm
+
+import (
+	"testing"
+
+	"github.com/bemasher/rtlamr/parse/parsetest"
+)
+
+func TestSynthetic(t *testing.T) {
+	parsetest.Synthetic(t, "idm")
+}
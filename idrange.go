@@ -0,0 +1,170 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// IDRange is an inclusive range of meter ids.
+type IDRange struct {
+	Lo, Hi uint
+}
+
+func (r IDRange) String() string {
+	if r.Lo == r.Hi {
+		return strconv.FormatUint(uint64(r.Lo), 10)
+	}
+	return strconv.FormatUint(uint64(r.Lo), 10) + "-" + strconv.FormatUint(uint64(r.Hi), 10)
+}
+
+// ParseUint parses a decimal or 0x prefixed hexadecimal number.
+func ParseUint(s string, bitSize int) (uint64, error) {
+	if len(s) > 2 && (s[:2] == "0x" || s[:2] == "0X") {
+		return strconv.ParseUint(s[2:], 16, bitSize)
+	}
+	return strconv.ParseUint(s, 10, bitSize)
+}
+
+// ParseIDRange parses a meter id, an inclusive range of ids such as
+// 45000000-45000199 or an id with trailing wildcard digits such as 4512xxxx.
+// Ids may also be given in hex with a 0x prefix, but can't be wildcarded.
+func ParseIDRange(token string) (r IDRange, err error) {
+	token = strings.TrimSpace(token)
+
+	parseID := func(s string) (uint, error) {
+		n, err := ParseUint(s, 32)
+		if err != nil {
+			return 0, fmt.Errorf("invalid meter id %q: expected a number between 0 and %d or 0x0 and 0x%X", token, uint32(math.MaxUint32), uint32(math.MaxUint32))
+		}
+		return uint(n), nil
+	}
+
+	if idx := strings.Index(token, "-"); idx != -1 {
+		if r.Lo, err = parseID(token[:idx]); err != nil {
+			return
+		}
+		if r.Hi, err = parseID(token[idx+1:]); err != nil {
+			return
+		}
+		if r.Lo > r.Hi {
+			return r, fmt.Errorf("invalid meter id range %q: start is greater than end", token)
+		}
+		return
+	}
+
+	lower := strings.ToLower(token)
+	prefix := strings.TrimRight(lower, "x")
+	if wildcards := len(lower) - len(prefix); wildcards > 0 && !strings.HasPrefix(lower, "0x") {
+		if strings.Contains(prefix, "x") {
+			return r, fmt.Errorf("invalid meter id %q: wildcards are only allowed as trailing digits", token)
+		}
+
+		// An all wildcard token matches every id with at most that many digits.
+		var base uint64
+		if prefix != "" {
+			n, err := parseID(prefix)
+			if err != nil {
+				return r, err
+			}
+			base = uint64(n)
+		}
+
+		scale := uint64(math.Pow10(wildcards))
+		lo, hi := base*scale, base*scale+scale-1
+		if hi > math.MaxUint32 {
+			if lo > math.MaxUint32 {
+				return r, fmt.Errorf("invalid meter id %q: no ids of that form fit in 32 bits", token)
+			}
+			hi = math.MaxUint32
+		}
+
+		return IDRange{uint(lo), uint(hi)}, nil
+	}
+
+	r.Lo, err = parseID(token)
+	r.Hi = r.Lo
+	return
+}
+
+// IDRanges is a sorted list of disjoint ranges, searched by binary search.
+type IDRanges []IDRange
+
+// NewIDRanges sorts ranges and merges those which overlap or are adjacent.
+func NewIDRanges(ranges []IDRange) (merged IDRanges) {
+	sorted := make([]IDRange, len(ranges))
+	copy(sorted, ranges)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Lo < sorted[j].Lo })
+
+	for _, r := range sorted {
+		if n := len(merged); n > 0 && uint64(r.Lo) <= uint64(merged[n-1].Hi)+1 {
+			if r.Hi > merged[n-1].Hi {
+				merged[n-1].Hi = r.Hi
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+
+	return
+}
+
+func (ranges IDRanges) String() string {
+	var values []string
+	for _, r := range ranges {
+		values = append(values, r.String())
+	}
+	return strings.Join(values, ",")
+}
+
+// Contains returns true if id is in any of the ranges.
+func (ranges IDRanges) Contains(id uint) bool {
+	idx := sort.Search(len(ranges), func(i int) bool { return ranges[i].Hi >= id })
+	return idx < len(ranges) && ranges[idx].Lo <= id
+}
+
+// Count returns the number of ids in the ranges.
+func (ranges IDRanges) Count() (n uint64) {
+	for _, r := range ranges {
+		n += uint64(r.Hi-r.Lo) + 1
+	}
+	return
+}
+
+// Subtract returns the ids in ranges which aren't in other.
+func (ranges IDRanges) Subtract(other IDRanges) (diff IDRanges) {
+	for _, r := range ranges {
+		lo := uint64(r.Lo)
+		for _, o := range other {
+			if o.Hi < r.Lo || o.Lo > r.Hi || uint64(o.Hi) < lo {
+				continue
+			}
+			if uint64(o.Lo) > lo {
+				diff = append(diff, IDRange{uint(lo), o.Lo - 1})
+			}
+			lo = uint64(o.Hi) + 1
+		}
+		if lo <= uint64(r.Hi) {
+			diff = append(diff, IDRange{uint(lo), r.Hi})
+		}
+	}
+	return
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseIDRange(t *testing.T) {
+	for token, expt := range map[string]IDRange{
+		"12345678":            {12345678, 12345678},
+		"45000000-45000199":   {45000000, 45000199},
+		"4512xxxx":            {45120000, 45129999},
+		"4512XXXX":            {45120000, 45129999},
+		"xxx":                 {0, 999},
+		"4xxxxxxxxx":          {4000000000, 4294967295},
+		"0x2AE7B11":           {44989201, 44989201},
+		"0X2ae7b11-0x2AE7B20": {44989201, 44989216},
+	} {
+		recv, err := ParseIDRange(token)
+		if err != nil {
+			t.Fatalf("%s: %s\n", token, err)
+		}
+		if recv != expt {
+			t.Fatalf("%s: expected %s got %s\n", token, expt, recv)
+		}
+	}
+
+	for _, token := range []string{"meter", "45x2", "200-100", "4294967296", "5xxxxxxxxx", "1-", "0x", "0x12xx", "0x100000000"} {
+		_, err := ParseIDRange(token)
+		if err == nil {
+			t.Fatalf("%s: expected error\n", token)
+		}
+		if !strings.Contains(err.Error(), token) {
+			t.Fatalf("%s: error doesn't name the token: %s\n", token, err)
+		}
+	}
+}
+
+func TestIDRanges(t *testing.T) {
+	ranges := NewIDRanges([]IDRange{{20, 29}, {5, 5}, {30, 35}, {1, 3}, {25, 40}, {4, 4}})
+	if recv, expt := ranges.String(), "1-5,20-40"; recv != expt {
+		t.Fatalf("Expected %s got %s\n", expt, recv)
+	}
+
+	for id, expt := range map[uint]bool{0: false, 1: true, 5: true, 6: false, 19: false, 20: true, 40: true, 41: false} {
+		if recv := ranges.Contains(id); recv != expt {
+			t.Fatalf("%d: expected %t got %t\n", id, expt, recv)
+		}
+	}
+
+	if recv := ranges.Count(); recv != 26 {
+		t.Fatalf("Expected 26 ids got %d\n", recv)
+	}
+
+	diff := ranges.Subtract(NewIDRanges([]IDRange{{0, 2}, {4, 4}, {22, 23}, {40, 50}}))
+	if recv, expt := diff.String(), "3,5,20-21,24-39"; recv != expt {
+		t.Fatalf("Expected %s got %s\n", expt, recv)
+	}
+}
@@ -0,0 +1,217 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/bemasher/rtlamr/idm"
+	"github.com/bemasher/rtlamr/parse"
+	"github.com/bemasher/rtlamr/r900"
+	"github.com/bemasher/rtlamr/scm"
+	"github.com/bemasher/rtlamr/scmplus"
+)
+
+// schemaPayloads are the types of Message written for each MsgType. R900
+// messages are extended with -r900.extended.
+var schemaPayloads = []struct {
+	MsgType string
+	Types   []interface{}
+}{
+	{"IDM", []interface{}{idm.IDM{}}},
+	{"Merged", []interface{}{MergedMessage{}}},
+	{"R900", []interface{}{r900.R900{}, r900.R900Extended{}}},
+	{"SCM", []interface{}{scm.SCM{}}},
+	{"SCM+", []interface{}{scmplus.SCM{}}},
+}
+
+var (
+	timeType    = reflect.TypeOf(time.Time{})
+	messageType = reflect.TypeOf((*parse.Message)(nil)).Elem()
+)
+
+// jsonSchema returns a JSON Schema of the objects written by -format=json:
+// messages, alerts and the interval records of -collect. It's generated from
+// the structs they're encoded from, keys are their Go field names and don't
+// change without bumping SchemaVersion.
+func jsonSchema() map[string]interface{} {
+	defs := schemaDefs{}
+
+	// Message is any payload, LogMessage narrows it by MsgType.
+	var payloads, msgTypes, conditions []interface{}
+	for _, p := range schemaPayloads {
+		var refs []interface{}
+		for _, v := range p.Types {
+			refs = append(refs, defs.schema(reflect.TypeOf(v)))
+		}
+		payload := refs[0]
+		if len(refs) > 1 {
+			payload = map[string]interface{}{"anyOf": refs}
+		}
+
+		payloads = append(payloads, refs...)
+		msgTypes = append(msgTypes, p.MsgType)
+		conditions = append(conditions, map[string]interface{}{
+			"if": map[string]interface{}{
+				"properties": map[string]interface{}{"MsgType": map[string]interface{}{"const": p.MsgType}},
+			},
+			"then": map[string]interface{}{
+				"properties": map[string]interface{}{"Message": payload},
+			},
+		})
+	}
+	defs["parse.Message"] = map[string]interface{}{"anyOf": payloads}
+
+	logMessage := defs.object(reflect.TypeOf(parse.LogMessage{}))
+	logMessage["properties"].(map[string]interface{})["MsgType"] = map[string]interface{}{
+		"type": "string",
+		"enum": msgTypes,
+	}
+	logMessage["required"] = append(logMessage["required"].([]string), "MsgType")
+	logMessage["allOf"] = conditions
+	defs["parse.LogMessage"] = logMessage
+
+	return map[string]interface{}{
+		"$schema":     "https://json-schema.org/draft/2020-12/schema",
+		"title":       "rtlamr -format=json",
+		"description": fmt.Sprintf("Objects written one per line by rtlamr -format=json, SchemaVersion %d.", parse.SchemaVersion),
+		"anyOf": []interface{}{
+			defs.schema(reflect.TypeOf(parse.LogMessage{})),
+			defs.schema(reflect.TypeOf(Alert{})),
+			defs.schema(reflect.TypeOf(IntervalRecord{})),
+		},
+		"$defs": defs,
+	}
+}
+
+// writeJSONSchema writes the schema of -format=json to w, see -jsonschema.
+func writeJSONSchema(w io.Writer) error {
+	buf, err := json.MarshalIndent(jsonSchema(), "", "\t")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(buf, '\n'))
+	return err
+}
+
+// schemaDefs holds the schemas of structs by the name of their type, without
+// the package of those in main, referred to by $ref.
+type schemaDefs map[string]interface{}
+
+// schema returns the schema of values of t as encoding/json writes them.
+// Structs are added to defs and referred to. Types without a schema panic,
+// the tests cover every type written.
+func (defs schemaDefs) schema(t reflect.Type) map[string]interface{} {
+	switch t {
+	case timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case messageType:
+		return map[string]interface{}{"$ref": "#/$defs/parse.Message"}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return defs.schema(t.Elem())
+	case reflect.Struct:
+		name := strings.TrimPrefix(t.String(), "main.")
+		if _, ok := defs[name]; !ok {
+			// Claim the name first, structs may refer to themselves.
+			defs[name] = nil
+			defs[name] = defs.object(t)
+		}
+		return map[string]interface{}{"$ref": "#/$defs/" + name}
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "contentEncoding": "base64"}
+		}
+		return map[string]interface{}{"type": "array", "items": defs.schema(t.Elem())}
+	case reflect.Array:
+		return map[string]interface{}{
+			"type":     "array",
+			"items":    defs.schema(t.Elem()),
+			"minItems": t.Len(),
+			"maxItems": t.Len(),
+		}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		s := map[string]interface{}{"type": "integer", "minimum": 0}
+		if t.Bits() < 64 {
+			s["maximum"] = uint64(math.MaxUint64) >> (64 - t.Bits())
+		}
+		return s
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	}
+
+	panic(fmt.Sprintf("jsonschema: no schema for %s", t))
+}
+
+// object returns the schema of struct t. Fields without omitempty are
+// required.
+func (defs schemaDefs) object(t reflect.Type) map[string]interface{} {
+	properties := map[string]interface{}{}
+	required := []string{}
+	defs.fields(t, properties, &required)
+
+	return map[string]interface{}{
+		"type":                 "object",
+		"properties":           properties,
+		"required":             required,
+		"additionalProperties": false,
+	}
+}
+
+// fields adds the fields of struct t to properties, inlining embedded structs
+// as encoding/json does.
+func (defs schemaDefs) fields(t reflect.Type, properties map[string]interface{}, required *[]string) {
+	for idx := 0; idx < t.NumField(); idx++ {
+		f := t.Field(idx)
+		if !f.IsExported() && !(f.Anonymous && f.Type.Kind() == reflect.Struct) {
+			continue
+		}
+
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			defs.fields(f.Type, properties, required)
+			continue
+		}
+
+		if name == "" {
+			name = f.Name
+		}
+		properties[name] = defs.schema(f.Type)
+		if !strings.Contains(","+opts+",", ",omitempty,") {
+			*required = append(*required, name)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/bemasher/rtlamr/parse"
+)
+
+// docs/schema.json is published for downstream tooling, changes to the
+// structs written must be reflected in it.
+func TestJSONSchemaPublished(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeJSONSchema(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	name := filepath.Join("docs", "schema.json")
+	published, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(published, buf.Bytes()) {
+		t.Fatalf("%s is out of date, regenerate it with go run . -jsonschema > docs/schema.json\n", name)
+	}
+}
+
+// The keys written for each payload are those the schema lists, with at
+// least those it requires.
+func TestJSONSchemaKeys(t *testing.T) {
+	defs := jsonSchema()["$defs"].(schemaDefs)
+
+	check := func(t *testing.T, def string, v interface{}) {
+		t.Helper()
+
+		buf, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var fields map[string]interface{}
+		if err := json.Unmarshal(buf, &fields); err != nil {
+			t.Fatal(err)
+		}
+
+		schema := defs[def].(map[string]interface{})
+		properties := schema["properties"].(map[string]interface{})
+		for key := range fields {
+			if _, ok := properties[key]; !ok {
+				t.Fatalf("%s: key %s isn't in the schema\n", def, key)
+			}
+		}
+		for _, key := range schema["required"].([]string) {
+			if _, ok := fields[key]; !ok {
+				t.Fatalf("%s: required key %s wasn't written\n", def, key)
+			}
+		}
+	}
+
+	for _, p := range schemaPayloads {
+		for _, v := range p.Types {
+			def := reflect.TypeOf(v).String()
+			if def == "main.MergedMessage" {
+				def = "MergedMessage"
+			}
+			t.Run(p.MsgType+"/"+def, func(t *testing.T) {
+				check(t, def, v)
+				msg := parse.LogMessage{Message: v.(parse.Message)}
+				check(t, "parse.LogMessage", msg)
+			})
+		}
+	}
+
+	check(t, "Alert", Alert{})
+	check(t, "IntervalRecord", IntervalRecord{})
+
+	var msgTypes []string
+	for _, v := range defs["parse.LogMessage"].(map[string]interface{})["properties"].(map[string]interface{})["MsgType"].(map[string]interface{})["enum"].([]interface{}) {
+		msgTypes = append(msgTypes, v.(string))
+	}
+	if !sort.StringsAreSorted(msgTypes) {
+		t.Fatalf("Expected sorted message types, got %v\n", msgTypes)
+	}
+}
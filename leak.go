@@ -0,0 +1,103 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"time"
+
+	"github.com/bemasher/rtlamr/lru"
+	"github.com/bemasher/rtlamr/parse"
+	"github.com/bemasher/rtlamr/r900"
+)
+
+// LeakDetector raises an alert when every change in consumption reported by
+// -delta over Window was positive, or if UseFlags is set when an r900 meter
+// reports a current leak. Once raised, a meter's alert re-arms only after a
+// reading with no usage.
+type LeakDetector struct {
+	Window   time.Duration // Disabled if zero.
+	UseFlags bool
+
+	meters *lru.Cache // leakEntry keyed by uniqueKey.
+}
+
+type leakEntry struct {
+	Last      time.Time // Time of the previous reading.
+	FlowSince time.Time // Zero unless usage has been continuous.
+	Alerted   bool
+}
+
+func NewLeakDetector(window time.Duration, maxMeters int) *LeakDetector {
+	return &LeakDetector{Window: window, meters: lru.New(maxMeters)}
+}
+
+// Observe updates the meter's state from msg, which must have been through
+// DeltaTracker.Apply, and returns an alert if one is raised.
+func (ld *LeakDetector) Observe(msg parse.LogMessage) (alert *Alert) {
+	if !msg.Message.ChecksumOK() {
+		return nil
+	}
+
+	key := uniqueKey{msg.MeterID(), msg.MsgType()}
+
+	var entry leakEntry
+	if v, ok := ld.meters.Get(key); ok {
+		entry = v.(leakEntry)
+	}
+	defer func() {
+		entry.Last = msg.Time
+		ld.meters.Add(key, entry)
+	}()
+
+	switch {
+	case msg.Delta == nil:
+		// First reading or a reset meter, usage is unknown.
+		entry.FlowSince = time.Time{}
+	case *msg.Delta == 0:
+		entry.FlowSince = time.Time{}
+		entry.Alerted = false
+	case entry.FlowSince.IsZero():
+		entry.FlowSince = entry.Last
+		if entry.Last.IsZero() {
+			entry.FlowSince = msg.Time
+		}
+	}
+
+	if entry.Alerted {
+		return nil
+	}
+
+	source, since := "", time.Time{}
+	if ld.Window != 0 && !entry.FlowSince.IsZero() && msg.Time.Sub(entry.FlowSince) >= ld.Window {
+		source, since = "flow", entry.FlowSince
+	} else if r, ok := msg.Message.(r900.R900); ok && ld.UseFlags && r.LeakNow != 0 {
+		source, since = "flags", msg.Time
+	} else {
+		return nil
+	}
+
+	entry.Alerted = true
+	return &Alert{
+		Time:      msg.Time,
+		Alert:     "leak",
+		Source:    source,
+		MsgType:   msg.MsgType(),
+		ID:        msg.MeterID(),
+		MeterName: msg.MeterName,
+		Since:     since,
+	}
+}
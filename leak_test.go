@@ -0,0 +1,89 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bemasher/rtlamr/parse"
+	"github.com/bemasher/rtlamr/r900"
+	"github.com/bemasher/rtlamr/scm"
+)
+
+func TestLeakDetector(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	type reading struct {
+		msg     parse.Message
+		elapsed time.Duration
+		expt    string // Source of the alert raised, if any.
+	}
+
+	testCases := []struct {
+		name     string
+		window   time.Duration
+		useFlags bool
+		readings []reading
+	}{
+		{"ContinuousFlow", 2 * time.Hour, false, []reading{
+			{scm.SCM{ID: 1, Consumption: 100}, 0, ""},
+			{scm.SCM{ID: 1, Consumption: 101}, time.Hour, ""},
+			{scm.SCM{ID: 1, Consumption: 102}, time.Hour, "flow"},
+			{scm.SCM{ID: 1, Consumption: 103}, time.Hour, ""},
+		}},
+		{"ZeroUsage", 2 * time.Hour, false, []reading{
+			{scm.SCM{ID: 1, Consumption: 100}, 0, ""},
+			{scm.SCM{ID: 1, Consumption: 101}, time.Hour, ""},
+			{scm.SCM{ID: 1, Consumption: 101}, time.Hour, ""},
+			{scm.SCM{ID: 1, Consumption: 102}, time.Hour, ""},
+			{scm.SCM{ID: 1, Consumption: 103}, 30 * time.Minute, ""},
+			{scm.SCM{ID: 1, Consumption: 104}, time.Hour, "flow"},
+		}},
+		{"Rearm", time.Hour, false, []reading{
+			{scm.SCM{ID: 1, Consumption: 100}, 0, ""},
+			{scm.SCM{ID: 1, Consumption: 101}, time.Hour, "flow"},
+			{scm.SCM{ID: 1, Consumption: 102}, time.Hour, ""},
+			{scm.SCM{ID: 1, Consumption: 102}, time.Hour, ""},
+			{scm.SCM{ID: 1, Consumption: 103}, time.Hour, "flow"},
+		}},
+		{"PerMeter", time.Hour, false, []reading{
+			{scm.SCM{ID: 1, Consumption: 100}, 0, ""},
+			{scm.SCM{ID: 2, Consumption: 100}, 0, ""},
+			{scm.SCM{ID: 2, Consumption: 100}, time.Hour, ""},
+			{scm.SCM{ID: 1, Consumption: 101}, 0, "flow"},
+		}},
+		{"Flags", 0, true, []reading{
+			{r900.R900{ID: 1, Consumption: 100}, 0, ""},
+			{r900.R900{ID: 1, Consumption: 101, LeakNow: 1}, time.Hour, "flags"},
+			{r900.R900{ID: 1, Consumption: 102, LeakNow: 1}, time.Hour, ""},
+			{r900.R900{ID: 1, Consumption: 102}, time.Hour, ""},
+			{r900.R900{ID: 1, Consumption: 102, LeakNow: 2}, time.Hour, "flags"},
+		}},
+		{"FlagsIgnored", 0, false, []reading{
+			{r900.R900{ID: 1, Consumption: 100, LeakNow: 1}, 0, ""},
+			{r900.R900{ID: 1, Consumption: 101, LeakNow: 1}, time.Hour, ""},
+		}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dt := NewDeltaTracker(0)
+			ld := NewLeakDetector(tc.window, 0)
+			ld.UseFlags = tc.useFlags
+
+			now := start
+			for idx, r := range tc.readings {
+				now = now.Add(r.elapsed)
+				msg := parse.LogMessage{Time: now, Message: r.msg}
+				dt.Apply(&msg)
+
+				recv := ""
+				if alert := ld.Observe(msg); alert != nil {
+					recv = alert.Source
+				}
+				if recv != r.expt {
+					t.Fatalf("Reading %d: expected alert %q got %q\n", idx, r.expt, recv)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/bemasher/rtlamr/parse"
+)
+
+// MsgTypeInfo is the radio configuration of a registered message type, see
+// -listmsgtypes. Lengths are in samples at the type's sample rate.
+type MsgTypeInfo struct {
+	MsgType         string
+	CenterFreq      uint32
+	SampleRate      int
+	DataRate        int
+	ChipLength      int
+	SymbolLength    int
+	Preamble        string
+	PreambleSymbols int
+	PacketSymbols   int
+	PacketLength    int
+}
+
+// MsgTypeInfos returns the configuration of every registered message type
+// at the given symbol length.
+func MsgTypeInfos(symbolLength int) (infos []MsgTypeInfo, err error) {
+	for _, name := range parse.Names() {
+		cfg, err := parse.Config(name, symbolLength)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, MsgTypeInfo{
+			MsgType:         name,
+			CenterFreq:      cfg.CenterFreq,
+			SampleRate:      cfg.SampleRate,
+			DataRate:        cfg.DataRate,
+			ChipLength:      cfg.ChipLength,
+			SymbolLength:    cfg.SymbolLength,
+			Preamble:        cfg.Preamble,
+			PreambleSymbols: cfg.PreambleSymbols,
+			PacketSymbols:   cfg.PacketSymbols,
+			PacketLength:    cfg.PacketLength,
+		})
+	}
+	return infos, nil
+}
+
+// listMsgTypes writes the configuration of every registered message type to
+// w as a table, or as json with -format=json.
+func listMsgTypes(w io.Writer) error {
+	infos, err := MsgTypeInfos(*symbolLength)
+	if err != nil {
+		return err
+	}
+
+	if *format == "json" {
+		return json.NewEncoder(w).Encode(infos)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "MsgType\tCenterFreq\tSampleRate\tDataRate\tChipLength\tSymbolLength\tPreamble\tPacketSymbols\tPacketLength")
+	for _, info := range infos {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%d\t%s\t%d\t%d\n",
+			info.MsgType, info.CenterFreq, info.SampleRate, info.DataRate,
+			info.ChipLength, info.SymbolLength, info.Preamble, info.PacketSymbols, info.PacketLength,
+		)
+	}
+	return tw.Flush()
+}
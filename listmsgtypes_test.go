@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/bemasher/rtlamr/parse"
+)
+
+func TestMsgTypeInfos(t *testing.T) {
+	infos, err := MsgTypeInfos(72)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := parse.Names()
+	if len(infos) != len(names) {
+		t.Fatalf("Expected %d message types got %d\n", len(names), len(infos))
+	}
+	for idx, info := range infos {
+		if info.MsgType != names[idx] {
+			t.Fatalf("Expected %s got %s\n", names[idx], info.MsgType)
+		}
+		if info.CenterFreq == 0 || info.SampleRate == 0 || info.Preamble == "" || info.PacketLength == 0 {
+			t.Fatalf("Incomplete configuration for %s: %+v\n", info.MsgType, info)
+		}
+	}
+
+	if _, err := parse.Config("bogus", 72); err == nil {
+		t.Fatal("Expected error for unregistered message type")
+	}
+}
@@ -0,0 +1,193 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync"
+)
+
+// logLevel is the minimum level of diagnostic messages logged, see -loglevel.
+var logLevel = new(slog.LevelVar)
+
+// logSink is the destination of diagnostic logging, stderr unless
+// -logoutput is given. Received messages are never written to it.
+var logSink = &syncWriter{w: os.Stderr}
+
+// syncWriter serializes writes to a writer which may be replaced, such as
+// when -logoutput is reopened. It may also keep a status line drawn on the
+// last line of a terminal, which is cleared for each write and redrawn after.
+type syncWriter struct {
+	mu     sync.Mutex
+	w      io.Writer
+	status string
+}
+
+// Clears the current line of a terminal.
+const clearLine = "\r\x1b[K"
+
+func (sw *syncWriter) Write(p []byte) (int, error) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	if sw.status == "" {
+		return sw.w.Write(p)
+	}
+
+	io.WriteString(sw.w, clearLine)
+	n, err := sw.w.Write(p)
+	io.WriteString(sw.w, sw.status)
+	return n, err
+}
+
+// Around calls fn with the status line cleared, such as while writing to
+// another stream shown on the same terminal. Without a status line fn isn't
+// serialized with logging, so a stream which blocks doesn't block logging.
+func (sw *syncWriter) Around(fn func()) {
+	sw.mu.Lock()
+	if sw.status == "" {
+		sw.mu.Unlock()
+		fn()
+		return
+	}
+	defer sw.mu.Unlock()
+
+	io.WriteString(sw.w, clearLine)
+	fn()
+	io.WriteString(sw.w, sw.status)
+}
+
+// SetStatus replaces the status line, an empty status removes it.
+func (sw *syncWriter) SetStatus(status string) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	io.WriteString(sw.w, clearLine+status)
+	sw.status = status
+}
+
+func (sw *syncWriter) SetOutput(w io.Writer) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	sw.w = w
+}
+
+// logHandler formats records like the log package with Lmicroseconds and
+// Lshortfile, followed by the level if it isn't info and any attributes as
+// key=value pairs:
+//
+//	15:04:05.000000 main.go:123: WARN reading samples err=EOF
+type logHandler struct {
+	w     io.Writer
+	level slog.Leveler
+	attrs []byte // Preformatted attributes from WithAttrs.
+	group string // Prefix of attribute keys from WithGroup.
+}
+
+func newLogHandler(w io.Writer, level slog.Leveler) *logHandler {
+	return &logHandler{w: w, level: level}
+}
+
+func (h *logHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *logHandler) Handle(_ context.Context, r slog.Record) error {
+	var buf bytes.Buffer
+
+	buf.WriteString(r.Time.Format("15:04:05.000000"))
+	if r.PC != 0 {
+		frame, _ := runtime.CallersFrames([]uintptr{r.PC}).Next()
+		fmt.Fprintf(&buf, " %s:%d:", filepath.Base(frame.File), frame.Line)
+	}
+	if r.Level != slog.LevelInfo {
+		buf.WriteString(" " + r.Level.String())
+	}
+	buf.WriteString(" " + r.Message)
+
+	buf.Write(h.attrs)
+	r.Attrs(func(a slog.Attr) bool {
+		appendAttr(&buf, h.group, a)
+		return true
+	})
+
+	if b := buf.Bytes(); b[len(b)-1] != '\n' {
+		buf.WriteByte('\n')
+	}
+
+	_, err := h.w.Write(buf.Bytes())
+	return err
+}
+
+func (h *logHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	var buf bytes.Buffer
+	buf.Write(h.attrs)
+	for _, a := range attrs {
+		appendAttr(&buf, h.group, a)
+	}
+
+	nh := *h
+	nh.attrs = buf.Bytes()
+	return &nh
+}
+
+func (h *logHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	nh := *h
+	nh.group += name + "."
+	return &nh
+}
+
+func appendAttr(buf *bytes.Buffer, group string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+
+	if a.Value.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			group += a.Key + "."
+		}
+		for _, ga := range a.Value.Group() {
+			appendAttr(buf, group, ga)
+		}
+		return
+	}
+
+	value := a.Value.String()
+	if value == "" || bytes.ContainsAny([]byte(value), " \t\n\"=") {
+		value = strconv.Quote(value)
+	}
+	fmt.Fprintf(buf, " %s%s=%s", group, a.Key, value)
+}
+
+// setupLogging sends diagnostic logging, including the log package's, through
+// a handler honoring -loglevel. The log package's source file is kept as long
+// as Lshortfile is set beforehand.
+func setupLogging() {
+	slog.SetDefault(slog.New(newLogHandler(logSink, logLevel)))
+}
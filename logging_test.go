@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"regexp"
+	"testing"
+)
+
+func TestLogHandler(t *testing.T) {
+	var buf bytes.Buffer
+	level := new(slog.LevelVar)
+	logger := slog.New(newLogHandler(&buf, level))
+
+	logger.Debug("hidden")
+	if buf.Len() != 0 {
+		t.Fatalf("Expected debug to be dropped at info got %q\n", buf.String())
+	}
+
+	for _, step := range []struct {
+		Log  func()
+		Expt string
+	}{
+		{func() { logger.Info("GainCount: 0") }, `^\d\d:\d\d:\d\d\.\d{6} logging_test\.go:\d+: GainCount: 0\n$`},
+		{func() { logger.Warn("reading samples", "err", errors.New("unexpected EOF")) }, ` WARN reading samples err="unexpected EOF"\n$`},
+		{func() { logger.With("id", 1234).WithGroup("msg").Error("dropped", "type", 7) }, ` ERROR dropped id=1234 msg\.type=7\n$`},
+		{func() { level.Set(slog.LevelDebug); logger.Debug("shown", "empty", "") }, ` DEBUG shown empty=""\n$`},
+	} {
+		buf.Reset()
+		step.Log()
+		if !regexp.MustCompile(step.Expt).MatchString(buf.String()) {
+			t.Fatalf("Expected match for %q got %q\n", step.Expt, buf.String())
+		}
+	}
+}
@@ -0,0 +1,56 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+// The low rate preset samples at 32 * 32768 = 1.048576 MS/s, the lowest
+// integral multiple of the data rate within the dongle's upper sample rate
+// band.
+const lowRateSymbolLength = 32
+
+// Message types which may be used with the low rate preset. R900 hops over a
+// wider band than the reduced sample rate covers.
+var lowRateMsgTypes = map[string]bool{
+	"scm":  true,
+	"scm+": true,
+	"idm":  true,
+}
+
+// LowRate applies the low sample rate preset to the given message type.
+func LowRate(msgType string) error {
+	if msgType != "auto" && !lowRateMsgTypes[msgType] {
+		return fmt.Errorf("-lowrate is not supported for message type %q, use scm, scm+ or idm", msgType)
+	}
+
+	symbolLengthSet := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "symbollength" {
+			symbolLengthSet = true
+		}
+	})
+	if symbolLengthSet {
+		return fmt.Errorf("-lowrate and -symbollength are mutually exclusive")
+	}
+
+	*symbolLength = lowRateSymbolLength
+
+	return nil
+}
@@ -0,0 +1,98 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package lru implements a bounded least-recently-used cache for per-meter
+// state. It is not safe for concurrent use.
+package lru
+
+import "container/list"
+
+// Cache holds at most MaxEntries values, evicting the least recently used
+// entry when full. A MaxEntries of 0 means the cache is unbounded.
+type Cache struct {
+	MaxEntries int
+
+	// Number of entries evicted to make room for new ones.
+	Evictions uint64
+
+	ll    *list.List
+	items map[interface{}]*list.Element
+}
+
+type entry struct {
+	key   interface{}
+	value interface{}
+}
+
+// New returns an empty cache holding at most maxEntries values.
+func New(maxEntries int) *Cache {
+	return &Cache{
+		MaxEntries: maxEntries,
+		ll:         list.New(),
+		items:      make(map[interface{}]*list.Element),
+	}
+}
+
+// Add inserts or replaces the value for key and marks it most recently used.
+func (c *Cache) Add(key, value interface{}) {
+	if e, ok := c.items[key]; ok {
+		c.ll.MoveToFront(e)
+		e.Value.(*entry).value = value
+		return
+	}
+
+	c.items[key] = c.ll.PushFront(&entry{key, value})
+
+	if c.MaxEntries != 0 && c.ll.Len() > c.MaxEntries {
+		c.removeElement(c.ll.Back())
+		c.Evictions++
+	}
+}
+
+// Get returns the value for key and marks it most recently used.
+func (c *Cache) Get(key interface{}) (value interface{}, ok bool) {
+	e, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(e)
+	return e.Value.(*entry).value, true
+}
+
+// Remove deletes key from the cache if present.
+func (c *Cache) Remove(key interface{}) {
+	if e, ok := c.items[key]; ok {
+		c.removeElement(e)
+	}
+}
+
+// Len returns the number of entries in the cache.
+func (c *Cache) Len() int {
+	return c.ll.Len()
+}
+
+// Range calls fn for each entry from least to most recently used, without
+// changing their order. Adding entries in the same order rebuilds the cache.
+func (c *Cache) Range(fn func(key, value interface{})) {
+	for e := c.ll.Back(); e != nil; e = e.Prev() {
+		fn(e.Value.(*entry).key, e.Value.(*entry).value)
+	}
+}
+
+func (c *Cache) removeElement(e *list.Element) {
+	c.ll.Remove(e)
+	delete(c.items, e.Value.(*entry).key)
+}
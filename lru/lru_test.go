@@ -0,0 +1,56 @@
+package lru
+
+import "testing"
+
+func TestEviction(t *testing.T) {
+	c := New(2)
+
+	c.Add(1, "a")
+	c.Add(2, "b")
+
+	// Touch 1 so that 2 becomes the least recently used entry.
+	if v, ok := c.Get(1); !ok || v != "a" {
+		t.Fatalf("Expected a got %v %v\n", v, ok)
+	}
+
+	c.Add(3, "c")
+
+	if _, ok := c.Get(2); ok {
+		t.Fatal("Expected 2 to be evicted")
+	}
+	if c.Len() != 2 || c.Evictions != 1 {
+		t.Fatalf("Expected 2 entries and 1 eviction, got %d and %d\n", c.Len(), c.Evictions)
+	}
+
+	c.Remove(1)
+	if _, ok := c.Get(1); ok || c.Len() != 1 {
+		t.Fatal("Expected 1 to be removed")
+	}
+}
+
+func TestUnbounded(t *testing.T) {
+	c := New(0)
+	for i := 0; i < 1024; i++ {
+		c.Add(i, i)
+	}
+	if c.Len() != 1024 || c.Evictions != 0 {
+		t.Fatalf("Expected 1024 entries and no evictions, got %d and %d\n", c.Len(), c.Evictions)
+	}
+}
+
+func TestRange(t *testing.T) {
+	c := New(0)
+	c.Add(1, "a")
+	c.Add(2, "b")
+	c.Add(3, "c")
+	c.Get(1)
+
+	var keys []interface{}
+	c.Range(func(key, value interface{}) {
+		keys = append(keys, key)
+	})
+
+	if len(keys) != 3 || keys[0] != 2 || keys[1] != 3 || keys[2] != 1 {
+		t.Fatalf("Expected [2 3 1] got %v\n", keys)
+	}
+}
@@ -18,52 +18,183 @@ package main
 
 import (
 	"bytes"
-	"encoding/xml"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
+	"log/slog"
 	"os"
 	"os/signal"
+	"slices"
 	"strings"
+	"syscall"
 	"time"
 
+	"github.com/bemasher/rtlamr/clock"
+	"github.com/bemasher/rtlamr/filter"
 	"github.com/bemasher/rtlamr/parse"
+	"github.com/bemasher/rtlamr/receiver"
 	"github.com/bemasher/rtltcp"
 
-	_ "github.com/bemasher/rtlamr/idm"
-	_ "github.com/bemasher/rtlamr/r900"
 	_ "github.com/bemasher/rtlamr/r900bcd"
 	_ "github.com/bemasher/rtlamr/scm"
 	_ "github.com/bemasher/rtlamr/scmplus"
 )
 
-var rcvr Receiver
-
 type Receiver struct {
 	rtltcp.SDR
-	p  parse.Parser
-	fc parse.FilterChain
+	centerFreq uint32 // Tuned frequency, restored on reconnecting.
+	sampleRate uint32
+	parsers    []parse.Parser // One for each message type in -msgtype.
+	fc         parse.FilterChain
+	clock      clock.Clock // Drives Run's timers and -schedule, clock.Real if nil.
+
+	meterID, excludeID     *MeterIDFilter   // -filterid and -excludeid.
+	meterType, excludeType *MeterTypeFilter // -filtertype and -excludetype.
+
+	singleTypes map[string]uint // A meter heard of each message type, for -single.pertype.
+
+	// Filters and message handling kept across reconnects, nil unless
+	// their flags are given.
+	uniqueFilter      *UniqueFilter      // -unique.
+	minSNRFilter      *MinSNRFilter      // -minsnr.
+	deltaTracker      *DeltaTracker      // -delta.
+	intervalCollector *IntervalCollector // -collect.
+	absenceMonitor    *AbsenceMonitor    // -absence and -meterdb.
+	mergeState        MergeState         // -merge.
+	aliases           Aliases            // -aliases and -meterdb.
+	multiplier        Multiplier         // -multiplier.
+
+	stats       Stats
+	health      *Health       // -http.listen.
+	otel        *OTelExporter // -otel.endpoint.
+	dbusService *DBusService  // -dbus.
+
+	sampleFile   *SampleFile // -samplefile, replaced when reopened or rotated.
+	dumpBitsFile *os.File    // -dumpbits.
+
+	out Outputs // -logfile, -stdout and -exec.
 }
 
-func (rcvr *Receiver) NewReceiver() {
-	var err error
-	if rcvr.p, err = parse.NewParser(strings.ToLower(*msgType), *symbolLength, *decimation); err != nil {
-		log.Fatal(err)
+// NewReceiver connects to rtl_tcp and configures the parser and filters.
+// Errors are returned after connecting so the caller can close the
+// connection before exiting. Errors not annotated with an exit status are
+// configuration errors.
+func (rcvr *Receiver) NewReceiver(ctx context.Context) (err error) {
+	// Message types are normalized so they can be compared and logged.
+	names := strings.Split(strings.ToLower(*msgType), ",")
+	for idx := range names {
+		names[idx] = strings.TrimSpace(names[idx])
+	}
+	*msgType = strings.Join(names, ",")
+
+	if len(names) > 1 && slices.Contains(names, "auto") {
+		return errors.New("-msgtype=auto can't be combined with other message types")
+	}
+	if len(names) > 1 && *dumpBits != "" {
+		return errors.New("-dumpbits requires a single -msgtype")
+	}
+	if *msgLimitPerType && *msgLimit == 0 {
+		return errors.New("-msglimit.pertype requires -msglimit")
+	}
+	if *singlePerType && !*single {
+		return errors.New("-single.pertype requires -single")
+	}
+
+	if *autoExit && *msgType != "auto" {
+		return errors.New("-auto.exit requires -msgtype=auto")
+	}
+
+	// Detection listens for minutes, -check only needs a configuration to
+	// probe.
+	if *checkOnly && *msgType == "auto" {
+		log.Println("-check: skipping -msgtype=auto detection, checking with scm")
+		*msgType = "scm"
+		names = []string{*msgType}
+	}
+
+	if *lowRate {
+		for _, name := range names {
+			if err := LowRate(name); err != nil {
+				return err
+			}
+		}
+	}
+
+	if *msgType == "auto" {
+		names = detectMsgTypes()
+	}
+	if err := rcvr.validateConfig(names); err != nil {
+		return err
+	}
+
+	if *msgType != "auto" {
+		if err := rcvr.NewParser(); err != nil {
+			return err
+		}
 	}
 
 	// Connect to rtl_tcp server.
-	if err := rcvr.Connect(nil); err != nil {
-		log.Fatal(err)
+	if err := rcvr.connect(ctx); err != nil {
+		return err
 	}
 
 	rcvr.HandleFlags()
 
-	cfg := rcvr.p.Cfg()
+	if *msgType == "auto" {
+		if *msgType, err = rcvr.Detect(ctx); err != nil {
+			return err
+		}
+		if err := rcvr.NewParser(); err != nil {
+			return err
+		}
+		names = []string{*msgType}
+	}
+
+	cfg := rcvr.parsers[0].Cfg()
+
+	if err := rcvr.meterID.Resolve(*msgType); err != nil {
+		return fmt.Errorf("-filterid: %s", err)
+	}
+	if err := rcvr.excludeID.Resolve(*msgType); err != nil {
+		return fmt.Errorf("-excludeid: %s", err)
+	}
+	if err := rcvr.meterType.Resolve(*msgType); err != nil {
+		return fmt.Errorf("-filtertype: %s", err)
+	}
+	if err := rcvr.excludeType.Resolve(*msgType); err != nil {
+		return fmt.Errorf("-excludetype: %s", err)
+	}
+
+	switch strings.ToLower(*filterMode) {
+	case "all":
+		rcvr.fc.Mode = parse.MatchAll
+	case "any":
+		rcvr.fc.Mode = parse.MatchAny
+	default:
+		return fmt.Errorf("-filtermode: invalid mode %q, expected all or any", *filterMode)
+	}
+
+	// newFilter instantiates a registered filter, keeping the first error
+	// naming the flag it was given by. Returns nil on error.
+	newFilter := func(flagName, name, arg string) parse.MessageFilter {
+		f, ferr := filter.New(name, arg)
+		if ferr != nil && err == nil {
+			err = fmt.Errorf("-%s: %s", flagName, ferr)
+		}
+		return f
+	}
 
 	gainFlagSet := false
+	filterIDSet, filterTypeSet := false, false
+	excludeIDSet, excludeTypeSet := false, false
 	flag.Visit(func(f *flag.Flag) {
+		if err != nil {
+			return
+		}
+
 		switch f.Name {
 		case "centerfreq":
 			cfg.CenterFreq = uint32(rcvr.Flags.CenterFreq)
@@ -72,128 +203,540 @@ func (rcvr *Receiver) NewReceiver() {
 		case "gainbyindex", "tunergainmode", "tunergain", "agcmode":
 			gainFlagSet = true
 		case "unique":
-			rcvr.fc.Add(NewUniqueFilter())
-		case "filterid":
-			rcvr.fc.Add(meterID)
-		case "filtertype":
-			rcvr.fc.Add(meterType)
+			if uf, ok := newFilter(f.Name, "unique", "").(*UniqueFilter); ok {
+				rcvr.uniqueFilter = uf
+				rcvr.stats.unique = rcvr.uniqueFilter
+				rcvr.fc.AddStateful(f.Name, rcvr.uniqueFilter)
+			}
+		case "dedupe.crossproto":
+			if *dedupeCrossProto {
+				if df, ok := newFilter(f.Name, "crossproto", "").(*CrossProtoFilter); ok {
+					rcvr.stats.dedupe = df
+					rcvr.fc.AddStateful(f.Name, rcvr.stats.dedupe)
+				}
+			}
+		case "maxdelta", "maxdelta.percent":
+			if rcvr.stats.maxDelta == nil && (*maxDelta != 0 || *maxDeltaPercent != 0) {
+				if mf, ok := newFilter(f.Name, "maxdelta", "").(*MaxDeltaFilter); ok {
+					rcvr.stats.maxDelta = mf
+					rcvr.fc.AddStateful("maxdelta", rcvr.stats.maxDelta)
+				}
+			}
+		case "onchange":
+			if *onChange {
+				if of := newFilter(f.Name, "onchange", *onChangeFieldList); of != nil {
+					rcvr.fc.AddStateful(f.Name, of)
+				}
+			}
+		case "filter":
+			if ef := newFilter(f.Name, "expr", *filterExpr); ef != nil {
+				rcvr.fc.Add(f.Name, ef)
+			}
+		case "filtertamper":
+			if *filterTamper {
+				if ff := newFilter(f.Name, "flag", ""); ff != nil {
+					rcvr.fc.Add(f.Name, ff)
+				}
+			}
+		case "filterflag":
+			if ff := newFilter(f.Name, "flag", *filterFlag); ff != nil {
+				rcvr.fc.Add(f.Name, ff)
+			}
+		case "meterdb.only":
+			if *meterDBOnly {
+				rcvr.fc.Add(f.Name, &rcvr.aliases)
+			}
+		case "minsnr":
+			if *minSNR < 0 {
+				err = fmt.Errorf("-minsnr: must not be negative")
+			} else if *minSNR != 0 {
+				rcvr.minSNRFilter = NewMinSNRFilter(*minSNR)
+				rcvr.fc.Exclude(f.Name, rcvr.minSNRFilter)
+			}
+		case "filterid", "filteridfile":
+			filterIDSet = true
+		case "filtertype", "filtertypefile":
+			filterTypeSet = true
+		case "excludeid", "excludeidfile":
+			excludeIDSet = true
+		case "excludetype", "excludetypefile":
+			excludeTypeSet = true
 		}
 	})
+	if err != nil {
+		return err
+	}
 
-	rcvr.SetCenterFreq(cfg.CenterFreq)
-	rcvr.SetSampleRate(uint32(cfg.SampleRate))
+	if filterIDSet {
+		rcvr.fc.Add("filterid", rcvr.meterID)
+	}
+	if filterTypeSet {
+		rcvr.fc.Add("filtertype", rcvr.meterType)
+		for _, name := range names {
+			log.Printf("FilterType: %s %d\n", parserMsgTypes[name], rcvr.meterType.Codes(parserMsgTypes[name]))
+		}
+	}
+	if excludeIDSet {
+		rcvr.fc.Exclude("excludeid", rcvr.excludeID)
+	}
+	if excludeTypeSet {
+		rcvr.fc.Exclude("excludetype", rcvr.excludeType)
+		for _, name := range names {
+			log.Printf("ExcludeType: %s %d\n", parserMsgTypes[name], rcvr.excludeType.Codes(parserMsgTypes[name]))
+		}
+	}
 
-	if !gainFlagSet {
-		rcvr.SetGainMode(true)
+	// Custom filters follow the built-in filters in the order given.
+	for _, spec := range customFilters {
+		f := newFilter("customfilter", spec.Name, spec.Arg)
+		if err != nil {
+			return err
+		}
+		if _, ok := f.(parse.StatefulFilter); ok {
+			rcvr.fc.AddStateful(spec.String(), f)
+		} else {
+			rcvr.fc.Add(spec.String(), f)
+		}
 	}
 
-	rcvr.p.Log()
+	if *delta {
+		rcvr.deltaTracker = NewDeltaTracker(*deltaMaxMeters)
+		rcvr.deltaTracker.R900BCD = slices.Contains(names, "r900bcd")
+	}
+
+	if *collect {
+		if !slices.Contains(names, "idm") {
+			slog.Warn("-collect has no effect without idm in -msgtype")
+		}
+		rcvr.intervalCollector = NewIntervalCollector(*collectInterval, *collectMaxMeters)
+	}
+
+	if *stateFilename != "" {
+		if rcvr.uniqueFilter == nil && rcvr.deltaTracker == nil && rcvr.absenceMonitor == nil && rcvr.intervalCollector == nil {
+			slog.Warn("-statefile has no effect without -unique, -delta, -absence or -collect")
+		}
+		if err := rcvr.LoadState(*stateFilename); err != nil {
+			slog.Warn("ignoring state file", "file", *stateFilename, "err", err)
+		}
+	}
+
+	rcvr.centerFreq, rcvr.sampleRate = cfg.CenterFreq, uint32(cfg.SampleRate)
+	rcvr.tune(!gainFlagSet)
+
+	for _, p := range rcvr.parsers {
+		p.Log()
+	}
+
+	rcvr.health.Configured(DeviceStatus{
+		MsgType:     *msgType,
+		CenterFreq:  cfg.CenterFreq,
+		SampleRate:  cfg.SampleRate,
+		TunerGain:   rcvr.Flags.TunerGain,
+		GainByIndex: rcvr.Flags.GainByIndex,
+		AGC:         rcvr.Flags.AgcMode,
+	})
 
 	// Tell the user how many gain settings were reported by rtl_tcp.
 	log.Println("GainCount:", rcvr.SDR.Info.GainCount)
 
+	return nil
+}
+
+// gainFlagsSet returns true if any flag controlling the tuner's gain was
+// given, otherwise the receiver enables manual gain.
+func gainFlagsSet() (set bool) {
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "gainbyindex", "tunergainmode", "tunergain", "agcmode":
+			set = true
+		}
+	})
 	return
 }
 
-func (rcvr *Receiver) Run() {
-	// Setup signal channel for interruption.
-	sigint := make(chan os.Signal, 1)
-	signal.Notify(sigint, os.Kill, os.Interrupt)
+// tune applies the receiver's center frequency and sample rate, and enables
+// manual gain mode if requested.
+func (rcvr *Receiver) tune(manualGain bool) {
+	rcvr.SetCenterFreq(rcvr.centerFreq)
+	rcvr.SetSampleRate(rcvr.sampleRate)
+	if manualGain {
+		rcvr.SetGainMode(true)
+	}
+
+	slog.Debug("Tuner configured",
+		"centerfreq", rcvr.centerFreq,
+		"samplerate", rcvr.sampleRate,
+		"manualgain", manualGain,
+		"tunergain", rcvr.Flags.TunerGain,
+		"gainbyindex", rcvr.Flags.GainByIndex,
+		"agc", rcvr.Flags.AgcMode,
+		"freqcorrection", rcvr.Flags.FreqCorrection,
+	)
+}
+
+// Close closes the connection to rtl_tcp, if any.
+func (rcvr *Receiver) Close() error {
+	if rcvr.TCPConn == nil {
+		return nil
+	}
+	return rcvr.SDR.Close()
+}
+
+// retryPolicy returns the policy given by the -retry flags.
+func retryPolicy() RetryPolicy {
+	return RetryPolicy{*retryMax, *retryBackoff, *retryMaxBackoff}
+}
+
+// connect dials rtl_tcp, retrying with backoff until -retry.max consecutive
+// attempts have failed or ctx is cancelled.
+func (rcvr *Receiver) connect(ctx context.Context) error {
+	r := retrier{Op: "connecting to rtl_tcp", Policy: retryPolicy(), Status: exitDevice}
+	for {
+		slog.Debug("Connecting to rtl_tcp", "server", rcvr.Flags.ServerAddr)
+		err := rcvr.Connect(nil)
+		if err == nil {
+			r.Succeed()
+			return nil
+		}
+		if err := r.Fail(err); err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(r.Backoff()):
+		}
+	}
+}
+
+// reconnect re-establishes the rtl_tcp connection after it was released by
+// -schedule.suspend or lost, and restores the tuner configuration.
+func (rcvr *Receiver) reconnect() error {
+	if err := rcvr.Connect(nil); err != nil {
+		return err
+	}
+	rcvr.HandleFlags()
+	rcvr.tune(!gainFlagsSet())
+
+	return nil
+}
+
+// NewParser creates a parser for each message type in -msgtype. They keep
+// packets failing their checksum so they're counted, Run drops them unless
+// -allowbadcrc is set.
+func (rcvr *Receiver) NewParser() (err error) {
+	if rcvr.parsers, err = parse.NewParsers(*msgType, *symbolLength, *decimation); err != nil {
+		return configError(err)
+	}
+	for _, p := range rcvr.parsers {
+		if s, ok := p.(parse.BadCRCSetter); ok {
+			s.SetAllowBadCRC(true)
+		}
+	}
+	return nil
+}
+
+// blockSize returns the size of the blocks read, the largest of the parsers'
+// block sizes.
+func (rcvr *Receiver) blockSize() (size int) {
+	for _, p := range rcvr.parsers {
+		size = max(size, p.Cfg().BlockSize2)
+	}
+	return size
+}
+
+// blockRead is a request to read block from r, answered with its error.
+type blockRead struct {
+	r     *io.PipeReader
+	block []byte
+	err   error
+}
+
+// sdrSource supplies the receiver with the blocks read by Run, timed by the
+// packet clock. rtl_tcp is closed by runReceive rather than by the source,
+// and reading stops once the receiver is stopped.
+type sdrSource struct {
+	read func(block []byte) error
+	time time.Time // When the last block read finished.
+}
+
+func (src *sdrSource) Read(block []byte) error {
+	return src.read(block)
+}
+
+func (src *sdrSource) Close() error {
+	return nil
+}
+
+func (src *sdrSource) Time() time.Time {
+	return src.time
+}
+
+func (src *sdrSource) Backend() string {
+	return receiver.Backend
+}
+
+// Run receives until ctx is cancelled, the time limit is reached or -single
+// is satisfied. Returns the exit status.
+func (rcvr *Receiver) Run(ctx context.Context) int {
+	if rcvr.clock == nil {
+		rcvr.clock = clock.Real
+	}
+	s := &session{
+		rcvr:     rcvr,
+		ctx:      ctx,
+		start:    rcvr.clock.Now(),
+		debug:    slog.Default().Enabled(ctx, slog.LevelDebug),
+		reading:  retrier{Op: "reading samples", Policy: retryPolicy(), Status: exitDevice},
+		encoding: retrier{Op: "encoding message", Policy: retryPolicy(), Status: exitOutput},
+		writing:  retrier{Op: "writing raw samples", Policy: retryPolicy(), Status: exitOutput},
+		dumping:  retrier{Op: "writing bit dump", Policy: retryPolicy(), Status: exitOutput},
+	}
 
 	// Setup time limit channel
 	tLimit := make(<-chan time.Time, 1)
 	if *timeLimit != 0 {
-		tLimit = time.After(*timeLimit)
+		tLimit = rcvr.clock.After(*timeLimit)
 	}
 
-	in, out := io.Pipe()
+	// Setup -single timeout channel, measured from the start so that meters
+	// heard early don't extend the wait for those not yet heard.
+	singleLimit := make(<-chan time.Time)
+	if *single && *singleTimeout != 0 {
+		singleLimit = rcvr.clock.After(*singleTimeout)
+	}
 
-	go func() {
-		tcpBlock := make([]byte, 16384)
-		for {
-			n, err := rcvr.Read(tcpBlock)
-			if err != nil {
-				return
+	// Setup stats ticker, a final line is logged on exit.
+	rcvr.stats.chain = &rcvr.fc
+	statsTick := make(<-chan time.Time)
+	if *statsInterval != 0 {
+		defer func() { log.Println("Stats:", rcvr.stats) }()
+
+		ticker := rcvr.clock.NewTicker(*statsInterval)
+		defer ticker.Stop()
+		statsTick = ticker.C()
+	}
+
+	if *watchFilters && len(rcvr.filterFiles()) != 0 {
+		watchCtx, stopWatching := context.WithCancel(ctx)
+		defer stopWatching()
+		go rcvr.WatchFilters(watchCtx, time.Second)
+	}
+
+	// Setup state file ticker
+	stateTick := make(<-chan time.Time)
+	if *stateFilename != "" && *stateInterval != 0 {
+		ticker := rcvr.clock.NewTicker(*stateInterval)
+		defer ticker.Stop()
+		stateTick = ticker.C()
+	}
+
+	// Check for absent meters independently of packets arriving.
+	absenceTick := make(<-chan time.Time)
+	if rcvr.absenceMonitor != nil {
+		ticker := rcvr.clock.NewTicker(absenceCheckInterval)
+		defer ticker.Stop()
+		absenceTick = ticker.C()
+	}
+
+	// Report readiness and liveness to systemd if started by it.
+	notifier, err := NewNotifier(os.Getenv, os.Getpid())
+	if err != nil {
+		slog.Error("connecting to systemd notify socket", "err", err)
+	}
+	defer notifier.Close()
+	defer notifier.Stopping()
+	s.notifier = notifier
+
+	// Reopen output files and reload filter files on hangup, output files
+	// are only written to by this goroutine.
+	hangupCtx, stopHangup := context.WithCancel(ctx)
+	defer stopHangup()
+	hangup := notifyHangup(hangupCtx)
+
+	// Watch for dongles which stop delivering samples without rtl_tcp
+	// disconnecting.
+	s.watchdog = NewWatchdog(*stallThreshold, rcvr.sampleRate)
+	s.in = s.startReader()
+
+	// Setup schedule timer, fires immediately to log the first window and
+	// then at the start and end of each window.
+	s.active = schedule.Active(rcvr.clock.Now())
+	s.scheduleTimer = make(<-chan time.Time)
+	if !schedule.Empty() {
+		s.scheduleTimer = rcvr.clock.After(0)
+	}
+
+	// Report why and after how long the receiver stopped.
+	if *summary {
+		defer func() {
+			if err := writeSummary(NewExitSummary(s.reason, rcvr.clock.Now().Sub(s.start), rcvr.stats)); err != nil {
+				slog.Error("writing summary", "err", err)
 			}
-			out.Write(tcpBlock[:n])
+		}()
+	}
+
+	// Setup -tui, restoring the terminal before the summary.
+	if *showTUI {
+		var stop func()
+		if s.tui, stop = startTUI(s.start); s.tui != nil {
+			defer stop()
 		}
-	}()
+	}
 
-	block := make([]byte, rcvr.p.Cfg().BlockSize2)
-	sampleBuf := new(bytes.Buffer)
+	// Setup -statusline, redrawn every second below diagnostic logging and
+	// cleared before the summary.
+	s.statusSink = logSink
+	statusTick := make(<-chan time.Time)
+	if *showStatusLine && s.tui == nil && isTerminal(os.Stderr) {
+		if logOutputFile != nil {
+			s.statusSink = &syncWriter{w: os.Stderr}
+		}
+		s.statusLine = NewStatusLine(s.start)
 
-	start := time.Now()
-	for {
-		// Exit on interrupt or time limit, otherwise receive.
-		select {
-		case <-sigint:
-			return
-		case <-tLimit:
-			fmt.Println("Time Limit Reached:", time.Since(start))
-			return
-		default:
-			// Read new sample block.
-			_, err := io.ReadFull(in, block)
-			if err != nil {
-				log.Fatal("Error reading samples: ", err)
-			}
-
-			// If dumping samples, discard the oldest block from the buffer if
-			// it's full and write the new block to it.
-			if *sampleFilename != os.DevNull {
-				if sampleBuf.Len() > rcvr.p.Cfg().BufferLength<<1 {
-					io.CopyN(ioutil.Discard, sampleBuf, int64(len(block)))
-				}
-				sampleBuf.Write(block)
-			}
+		ticker := rcvr.clock.NewTicker(time.Second)
+		defer ticker.Stop()
+		statusTick = ticker.C()
+		defer s.statusSink.SetStatus("")
+	}
 
-			pktFound := false
-			indices := rcvr.p.Dec().Decode(block)
+	// The receiver is stopped by cancelling the stream, see stop.
+	s.streamCtx, s.stopStream = context.WithCancel(ctx)
+	defer s.stopStream()
 
-			for _, pkt := range rcvr.p.Parse(indices) {
-				if !rcvr.fc.Match(pkt) {
-					continue
-				}
+	blockSize := rcvr.blockSize()
+	s.blockDuration = time.Duration(blockSize>>1) * time.Second / time.Duration(rcvr.sampleRate)
+	s.packetClock = NewClock()
 
-				var msg parse.LogMessage
-				msg.Time = time.Now()
-				msg.Offset, _ = sampleFile.Seek(0, os.SEEK_CUR)
-				msg.Length = sampleBuf.Len()
-				msg.Message = pkt
+	if rcvr.dumpBitsFile != nil {
+		s.bitDumper = NewBitDumper(rcvr.dumpBitsFile, dumpBitsMax, rcvr.parsers[0].Dec().DecCfg)
+	}
+	if *debugCandidates {
+		if s.debug {
+			s.candidateLogger = NewCandidateLogger(debugCandidatesMax)
+		} else {
+			slog.Warn("-debugcandidates logs at debug level, set -loglevel=debug to see candidates")
+		}
+	}
+	// Act on -nopacketwatchdog if samples are flowing but nothing passing
+	// its checksum has been decoded for too long.
+	s.noPackets = NewNoPacketWatchdog(*noPacketWindow, noPacketActions)
 
-				err = encoder.Encode(msg)
-				if err != nil {
-					log.Fatal("Error encoding message: ", err)
-				}
+	s.newRecorder(blockSize)
+	defer s.flushRecorder()
 
-				// The XML encoder doesn't write new lines after each element, print them.
-				if _, ok := encoder.(*xml.Encoder); ok {
-					fmt.Println()
-				}
+	defer s.startReading()()
 
-				pktFound = true
-				if *single {
-					if len(meterID.UintMap) == 0 {
-						break
-					} else {
-						delete(meterID.UintMap, uint(pkt.MeterID()))
-					}
-				}
-			}
+	// src reads blocks from rtl_tcp for the receiver, timed by the packet
+	// clock.
+	src := new(sdrSource)
+	src.read = func(block []byte) error {
+		if err := s.read(block); err != nil {
+			return err
+		}
+		src.time = s.packetClock.Block(s.blockDuration)
+		return nil
+	}
 
-			if pktFound {
-				if *sampleFilename != os.DevNull {
-					_, err = sampleFile.Write(sampleBuf.Bytes())
-					if err != nil {
-						log.Fatal("Error writing raw samples to file:", err)
-					}
-				}
-				if *single && len(meterID.UintMap) == 0 {
-					return
+	// The receiver decodes and filters the blocks src reads, with the rest of
+	// rtlamr's handling of blocks and packets added as hooks, and emits the
+	// messages it streams, holding up to -output.buffer waiting to be
+	// written.
+	recv, err := receiver.NewFromSource(receiver.Config{
+		MsgType:      *msgType,
+		SymbolLength: *symbolLength,
+		Decimation:   *decimation,
+		CenterFreq:   rcvr.centerFreq,
+		SampleRate:   rcvr.parsers[0].Cfg().SampleRate,
+		ReceiverID:   *receiverID,
+		Commit:       commitHash,
+		RawHex:       *rawHex,
+		AllowBadCRC:  *allowBadCRC,
+		StreamBuffer: *outputBuffer,
+		DropOldest:   *outputDropOldest,
+		Clock:        rcvr.clock,
+		Locker:       &s.mu,
+	}, src)
+	if err != nil {
+		slog.Error(err.Error())
+		return exitFatal
+	}
+	s.samplesHooks(recv)
+	s.decodeHooks(recv)
+	s.filterHooks(recv)
+	s.packetHooks(recv)
+	s.blockHooks(recv)
+	s.emitHooks(recv)
+
+	// Timers run alongside the receiver until it stops, the messages it
+	// streams having been written by its emit hooks.
+	msgs, errs := recv.Stream(s.streamCtx)
+receive:
+	for {
+		select {
+		case <-ctx.Done():
+			s.finish("interrupted", s.exit)
+			break receive
+		case <-tLimit:
+			s.finish("time limit reached", s.exit)
+			break receive
+		case <-singleLimit:
+			s.finish("single timeout", rcvr.singleExit)
+			break receive
+		case <-statsTick:
+			s.mu.Lock()
+			log.Println("Stats:", rcvr.stats)
+			s.mu.Unlock()
+		case <-stateTick:
+			s.mu.Lock()
+			if err := rcvr.SaveState(*stateFilename); err != nil {
+				slog.Error("saving state", "err", err)
+			}
+			s.mu.Unlock()
+		case now := <-absenceTick:
+			s.mu.Lock()
+			// Nothing can be heard outside of -schedule's windows.
+			if s.active {
+				for _, alert := range rcvr.absenceMonitor.Check(now) {
+					emitAlert(&rcvr.out, alert, s.statusSink)
 				}
 			}
+			s.mu.Unlock()
+		case <-hangup:
+			s.mu.Lock()
+			rcvr.reopenOutputs(s.bitDumper, s.recorder.index)
+			if len(rcvr.filterFiles()) != 0 {
+				log.Println("Received SIGHUP, reloading filter files")
+				rcvr.ReloadFilters()
+			}
+			s.mu.Unlock()
+		case <-statusTick:
+			s.mu.Lock()
+			s.statusSink.SetStatus(s.statusLine.Update(rcvr.clock.Now(), rcvr.stats))
+			s.mu.Unlock()
+		case _, ok := <-msgs:
+			if !ok {
+				break receive
+			}
 		}
 	}
+
+	// The receiver has stopped once the stream is closed.
+	for range msgs {
+	}
+	if err := <-errs; err != nil {
+		s.fatal = err
+	}
+	switch {
+	case s.halted:
+		return s.stopStatus
+	case s.ended != nil && s.fatal == nil:
+		return s.ended()
+	}
+	// Unless it failed, the receiver only stops otherwise once interrupted.
+	s.reason = "interrupted"
+	return s.exit()
 }
 
 func init() {
@@ -206,11 +749,58 @@ var (
 )
 
 func main() {
+	os.Exit(run())
+}
+
+func run() int {
+	setupLogging()
+
+	// Bare rtlamr receives, as it did before subcommands.
+	args := os.Args[1:]
+	if len(args) != 0 {
+		if args[0] == "receive" {
+			args = args[1:]
+		} else if cmd := subcommand(args[0]); cmd != nil {
+			return cmd(args[1:])
+		}
+	}
+
+	return runReceive(args)
+}
+
+// runReceive receives from rtl_tcp as configured by args. Returns the exit
+// status.
+func runReceive(args []string) int {
+	rcvr := new(Receiver)
+	rcvr.SDR.RegisterFlags()
 	rcvr.RegisterFlags()
-	RegisterFlags()
-	EnvOverride()
+	EnvOverride(flag.CommandLine, os.Getenv)
+	flag.CommandLine.Parse(args)
+	EnvOverride(flag.CommandLine, os.Getenv)
 
-	flag.Parse()
+	if helpGroup.set {
+		var usage bytes.Buffer
+		if err := printUsage(&usage, helpGroup.group); err != nil {
+			log.Println("-help:", err)
+			return exitUsage
+		}
+		fmt.Fprintf(os.Stderr, "Usage of %s:\n%s\n%s", os.Args[0], usage.Bytes(), subcommandUsage)
+		return exitOK
+	}
+
+	if *configFile != "" {
+		if err := ReadConfigFile(flag.CommandLine, *configFile); err != nil {
+			log.Println("-config:", err)
+			return exitUsage
+		}
+	}
+	if *configPrint {
+		if err := PrintConfig(flag.CommandLine, os.Stdout); err != nil {
+			log.Println("Error printing settings:", err)
+			return exitOutput
+		}
+		return exitOK
+	}
 	if *version {
 		if buildDate == "" || commitHash == "" {
 			fmt.Println("Built from source.")
@@ -220,15 +810,237 @@ func main() {
 			fmt.Println("Build Date:", buildDate)
 			fmt.Println("Commit:    ", commitHash)
 		}
-		os.Exit(0)
+		return 0
 	}
 
-	HandleFlags()
+	if *listMsgTypesFlag {
+		*format = strings.ToLower(*format)
+		if err := listMsgTypes(os.Stdout); err != nil {
+			log.Println("Error listing message types:", err)
+			return exitOutput
+		}
+		return exitOK
+	}
 
-	rcvr.NewReceiver()
+	if *jsonSchemaFlag {
+		if err := writeJSONSchema(os.Stdout); err != nil {
+			log.Println("Error writing json schema:", err)
+			return exitOutput
+		}
+		return exitOK
+	}
+
+	if *selfTest {
+		*format = strings.ToLower(*format)
+		pass, err := writeSelfTest(os.Stdout, SelfTest(context.Background()))
+		if err != nil {
+			log.Println("Error writing self-test results:", err)
+			return exitOutput
+		}
+		if !pass {
+			log.Println("Self-test failed")
+			return exitFatal
+		}
+		if !*selfTestRF {
+			return exitOK
+		}
+
+		// Go on to probe the receiver like -check.
+		*checkOnly = true
+	}
+
+	defer rcvr.closeOutputs()
+	if err := rcvr.Configure(); err != nil {
+		log.Println(err)
+		return exitStatus(err, exitFatal)
+	}
 
-	defer sampleFile.Close()
 	defer rcvr.Close()
+	if *pidFile != "" {
+		defer removePidFile(*pidFile)
+	}
+
+	if *httpListen != "" {
+		rcvr.health = NewHealth(*httpMaxAge)
+		rcvr.health.History = *dashboardHistory
+		rcvr.health.Token = *httpToken
+		l, err := rcvr.health.Listen(*httpListen)
+		if err != nil {
+			log.Println("-http.listen:", err)
+			return exitFatal
+		}
+		defer l.Close()
+		log.Println("Serving /healthz and /status on", l.Addr())
+	}
+
+	if execSink != nil && !*checkOnly {
+		execSink.Start()
+		defer execSink.Close()
+	}
+	if rcvr.dbusService != nil && !*checkOnly {
+		rcvr.dbusService.Start()
+		defer rcvr.dbusService.Close()
+	}
+
+	if *otelEndpoint != "" {
+		ratio := 0.0
+		if *otelTraces {
+			ratio = *otelTraceRatio
+		}
+		exporter, err := NewOTelExporter(*otelEndpoint, *otelInterval, ratio, map[string]string{
+			"service.name":       "rtlamr",
+			"service.version":    commitHash,
+			"host.name":          hostname(),
+			"rtlamr.receiver.id": *receiverID,
+		})
+		if err != nil {
+			log.Println("-otel.endpoint:", err)
+			return exitUsage
+		}
+		rcvr.otel = exporter
+		rcvr.otel.Start()
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			rcvr.otel.Shutdown(ctx)
+		}()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sig := notifyShutdown()
+	defer signal.Stop(sig)
+	go cancelOnSignal(ctx, cancel, sig)
+
+	done := make(chan int, 1)
+	go func() {
+		done <- rcvr.receive(ctx)
+	}()
+
+	select {
+	case status := <-done:
+		return status
+	case <-ctx.Done():
+	}
+
+	// Give the receiver -shutdowntimeout to stop once cancelled, or until
+	// another signal. Outputs are closed by the deferred cleanup either way.
+	timeout := make(<-chan time.Time)
+	if *shutdownTimeout != 0 {
+		timeout = time.After(*shutdownTimeout)
+	}
+	select {
+	case status := <-done:
+		return status
+	case s := <-sig:
+		slog.Warn("received second signal, abandoning the receiver", "signal", s)
+		return exitFatal
+	case <-timeout:
+		slog.Warn("receiver didn't stop in time, abandoning it", "shutdowntimeout", *shutdownTimeout)
+		return exitFatal
+	}
+}
+
+// receive sets up the receiver and runs it until ctx is cancelled, saving
+// -statefile once it stops. Returns the exit status.
+func (rcvr *Receiver) receive(ctx context.Context) int {
+	if err := rcvr.NewReceiver(ctx); err != nil {
+		if ctx.Err() != nil {
+			return exitOK
+		}
+		log.Println(err)
+		return exitStatus(err, exitUsage)
+	}
 
-	rcvr.Run()
+	if *checkOnly {
+		return rcvr.check()
+	}
+
+	if *survey {
+		if err := rcvr.Survey(ctx); err != nil {
+			if ctx.Err() != nil {
+				return exitOK
+			}
+			log.Println(err)
+			return exitStatus(err, exitUsage)
+		}
+		return exitOK
+	}
+
+	if *pidFile != "" {
+		if err := writePidFile(*pidFile); err != nil {
+			slog.Error("writing pid file", "err", err)
+		}
+	}
+
+	if *autoExit {
+		return 0
+	}
+
+	status := rcvr.Run(ctx)
+
+	if *stateFilename != "" {
+		if err := rcvr.SaveState(*stateFilename); err != nil {
+			slog.Error("saving state", "err", err)
+		}
+	}
+
+	return status
+}
+
+// notifyShutdown relays interrupt and termination, as sent by Ctrl-C and
+// systemd, until signal.Stop is called. SIGKILL can't be caught.
+func notifyShutdown() chan os.Signal {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	return sig
+}
+
+// cancelOnSignal cancels ctx on the first signal received from sig.
+func cancelOnSignal(ctx context.Context, cancel context.CancelFunc, sig <-chan os.Signal) {
+	select {
+	case s := <-sig:
+		// Cancel first, logging may be what's stuck.
+		cancel()
+		log.Printf("Received %s, shutting down\n", s)
+	case <-ctx.Done():
+	}
+}
+
+// syncOutputs syncs the log, raw sample, sample index and bit dump files to
+// disk, ending the stream of compressed samples first.
+func (rcvr *Receiver) syncOutputs() {
+	rcvr.out.Sync()
+
+	files := []*os.File{rcvr.dumpBitsFile, sampleIndexFile}
+	if rcvr.sampleFile != nil {
+		if err := rcvr.sampleFile.Flush(); err != nil {
+			slog.Error("compressing sample file", "err", err)
+		}
+		files = append(files, rcvr.sampleFile.File)
+	}
+
+	for _, f := range files {
+		if f == nil || f.Name() == os.DevNull {
+			continue
+		}
+		if err := f.Sync(); err != nil {
+			slog.Error("syncing output", "file", f.Name(), "err", err)
+		}
+	}
+}
+
+// closeOutputs ends the -format=xml document and syncs and closes the log,
+// raw sample, sample index and bit dump files.
+func (rcvr *Receiver) closeOutputs() {
+	rcvr.out.Close()
+	rcvr.syncOutputs()
+	for _, f := range []*os.File{rcvr.dumpBitsFile, sampleIndexFile} {
+		if f != nil {
+			f.Close()
+		}
+	}
+	if rcvr.sampleFile != nil {
+		rcvr.sampleFile.Close()
+	}
 }
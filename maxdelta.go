@@ -0,0 +1,103 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"log"
+
+	"github.com/bemasher/rtlamr/lru"
+	"github.com/bemasher/rtlamr/parse"
+)
+
+// MaxDeltaFilter drops messages whose consumption differs from the last
+// accepted reading of the same meter and message type by more than Delta
+// units or Percent percent. A large jump is accepted once two consecutive
+// messages agree on it, such as after a meter is replaced.
+type MaxDeltaFilter struct {
+	Delta   uint64
+	Percent float64
+	Log     bool // Log rejected messages.
+
+	last     *lru.Cache // maxDeltaEntry keyed by uniqueKey.
+	rejected uint64
+}
+
+type maxDeltaEntry struct {
+	Accepted uint32
+	Pending  *uint32 // Rejected reading awaiting corroboration.
+}
+
+func NewMaxDeltaFilter(delta uint64, percent float64, maxMeters int) *MaxDeltaFilter {
+	return &MaxDeltaFilter{
+		Delta:   delta,
+		Percent: percent,
+		last:    lru.New(maxMeters),
+	}
+}
+
+// Rejected returns the number of messages dropped.
+func (md *MaxDeltaFilter) Rejected() uint64 {
+	return md.rejected
+}
+
+// plausible returns true if next is within the allowed change from prev.
+func (md *MaxDeltaFilter) plausible(prev, next uint32) bool {
+	delta := uint64(next) - uint64(prev)
+	if next < prev {
+		delta = uint64(prev) - uint64(next)
+	}
+
+	if md.Delta != 0 && delta > md.Delta {
+		return false
+	}
+	if md.Percent != 0 && float64(delta) > float64(prev)*md.Percent/100 {
+		return false
+	}
+	return true
+}
+
+func (md *MaxDeltaFilter) Stateful() {}
+
+func (md *MaxDeltaFilter) Filter(msg parse.Message) bool {
+	// Packets with bad checksums don't carry trustworthy values.
+	if !msg.ChecksumOK() {
+		return true
+	}
+
+	key := uniqueKey{msg.MeterID(), msg.MsgType()}
+	consumption := msg.MeterConsumption()
+
+	v, ok := md.last.Get(key)
+	if !ok {
+		md.last.Add(key, maxDeltaEntry{Accepted: consumption})
+		return true
+	}
+	entry := v.(maxDeltaEntry)
+
+	if md.plausible(entry.Accepted, consumption) || entry.Pending != nil && md.plausible(*entry.Pending, consumption) {
+		md.last.Add(key, maxDeltaEntry{Accepted: consumption})
+		return true
+	}
+
+	md.rejected++
+	if md.Log {
+		log.Printf("Rejected %s %d: consumption %d differs too much from %d\n", msg.MsgType(), msg.MeterID(), consumption, entry.Accepted)
+	}
+	md.last.Add(key, maxDeltaEntry{entry.Accepted, &consumption})
+
+	return false
+}
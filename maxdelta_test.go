@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/bemasher/rtlamr/scm"
+)
+
+func TestMaxDeltaFilter(t *testing.T) {
+	md := NewMaxDeltaFilter(100, 0, 0)
+
+	for idx, step := range []struct {
+		Consumption uint32
+		Expt        bool
+	}{
+		{1000, true},
+		{1050, true},
+		{5000000, false}, // Corrupt.
+		{1060, true},
+		{9000, false}, // Meter replaced, awaiting corroboration.
+		{9010, true},
+		{9000, true}, // Decreases are measured the same way.
+		{1, false},
+		{2000000, false}, // Not corroborated by the previous reading.
+	} {
+		if recv := md.Filter(scm.SCM{ID: 1, Consumption: step.Consumption}); recv != step.Expt {
+			t.Fatalf("Step %d: expected %t got %t\n", idx, step.Expt, recv)
+		}
+	}
+
+	if recv := md.Rejected(); recv != 4 {
+		t.Fatalf("Expected 4 rejected got %d\n", recv)
+	}
+
+	pct := NewMaxDeltaFilter(0, 10, 0)
+	for idx, step := range []struct {
+		Consumption uint32
+		Expt        bool
+	}{
+		{1000, true},
+		{1100, true},
+		{1300, false},
+	} {
+		if recv := pct.Filter(scm.SCM{ID: 1, Consumption: step.Consumption}); recv != step.Expt {
+			t.Fatalf("Percent step %d: expected %t got %t\n", idx, step.Expt, recv)
+		}
+	}
+}
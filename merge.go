@@ -0,0 +1,175 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bemasher/rtlamr/lru"
+	"github.com/bemasher/rtlamr/parse"
+)
+
+// MergeState tracks the most recent message of each protocol heard from
+// every meter. Meters are evicted least recently heard first.
+type MergeState struct {
+	meters *lru.Cache // []ProtocolState keyed by id truncated to SCM's width.
+}
+
+func NewMergeState(maxMeters int) MergeState {
+	return MergeState{lru.New(maxMeters)}
+}
+
+// sameMeter returns true if ps and msg, whose ids agree in their lower 26
+// bits, came from the same meter. SCM truncates ids to 26 bits, so an SCM
+// message is merged with whichever meter's ids it agrees with.
+func (ps ProtocolState) sameMeter(msg parse.Message) bool {
+	return ps.MsgType == "SCM" || msg.MsgType() == "SCM" || ps.Message.MeterID() == msg.MeterID()
+}
+
+// Update records msg and returns a merged message holding the latest values
+// of every protocol seen from the same meter.
+func (ms MergeState) Update(msg parse.Message, t time.Time) MergedMessage {
+	key := msg.MeterID() & (1<<idBits["SCM"] - 1)
+
+	var protocols []ProtocolState
+	if v, ok := ms.meters.Get(key); ok {
+		protocols = v.([]ProtocolState)
+	}
+
+	// Replace this meter and protocol's state, other meters sharing the
+	// truncated id keep theirs.
+	state := ProtocolState{msg.MsgType(), t, msg}
+	next := make([]ProtocolState, 0, len(protocols)+1)
+	found := false
+	for _, ps := range protocols {
+		if ps.MsgType == state.MsgType && ps.Message.MeterID() == msg.MeterID() {
+			ps, found = state, true
+		}
+		next = append(next, ps)
+	}
+	if !found {
+		next = append(next, state)
+	}
+	ms.meters.Add(key, next)
+
+	merged := MergedMessage{
+		Trigger: msg.MsgType(),
+		ID:      msg.MeterID(),
+		trigger: msg,
+	}
+
+	// Of the states an SCM message could belong to, the latest of each
+	// protocol is merged.
+	for _, ps := range next {
+		if !ps.sameMeter(msg) {
+			continue
+		}
+
+		latest := true
+		for idx, prev := range merged.Protocols {
+			if prev.MsgType == ps.MsgType {
+				latest = false
+				if ps.LastSeen.After(prev.LastSeen) {
+					merged.Protocols[idx] = ps
+				}
+			}
+		}
+		if latest {
+			merged.Protocols = append(merged.Protocols, ps)
+		}
+	}
+	for _, ps := range merged.Protocols {
+		if ps.MsgType != "SCM" {
+			merged.ID = ps.Message.MeterID()
+		}
+	}
+
+	return merged
+}
+
+// ProtocolState is the last message of a single protocol heard from a meter.
+type ProtocolState struct {
+	MsgType  string    `xml:",attr"`
+	LastSeen time.Time `xml:",attr"`
+	Message  parse.Message
+}
+
+// MergedMessage is emitted in place of each packet in -merge mode. Trigger
+// names the protocol of the packet which caused the emission. ID is the
+// meter's full id once a protocol other than SCM has been heard from it.
+type MergedMessage struct {
+	Trigger   string          `xml:",attr"`
+	ID        uint32          `xml:",attr"`
+	Protocols []ProtocolState `xml:"Protocol"`
+
+	trigger parse.Message
+}
+
+func (mm MergedMessage) MsgType() string {
+	return "Merged"
+}
+
+func (mm MergedMessage) MeterID() uint32 {
+	return mm.ID
+}
+
+func (mm MergedMessage) MeterType() uint8 {
+	return mm.trigger.MeterType()
+}
+
+func (mm MergedMessage) MeterConsumption() uint32 {
+	return mm.trigger.MeterConsumption()
+}
+
+func (mm MergedMessage) Checksum() []byte {
+	return mm.trigger.Checksum()
+}
+
+func (mm MergedMessage) ChecksumOK() bool {
+	return mm.trigger.ChecksumOK()
+}
+
+func (mm MergedMessage) Raw() []byte {
+	return mm.trigger.Raw()
+}
+
+func (mm MergedMessage) String() string {
+	var fields []string
+
+	fields = append(fields, "Trigger:"+mm.Trigger)
+	fields = append(fields, fmt.Sprintf("ID:%10d", mm.ID))
+	for _, p := range mm.Protocols {
+		fields = append(fields, fmt.Sprintf("%s:{LastSeen:%s %s}", p.MsgType, p.LastSeen.Format(parse.TimeFormat), p.Message))
+	}
+
+	return "{" + strings.Join(fields, " ") + "}"
+}
+
+func (mm MergedMessage) Record() (r []string) {
+	r = append(r, mm.Trigger)
+	r = append(r, strconv.FormatUint(uint64(mm.ID), 10))
+	for _, p := range mm.Protocols {
+		r = append(r, p.MsgType)
+		r = append(r, p.LastSeen.Format(time.RFC3339Nano))
+		r = append(r, p.Message.Record()...)
+	}
+
+	return
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bemasher/rtlamr/idm"
+	"github.com/bemasher/rtlamr/parse"
+	"github.com/bemasher/rtlamr/scm"
+	"github.com/bemasher/rtlamr/scmplus"
+)
+
+func TestMergeState(t *testing.T) {
+	now := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	ms := NewMergeState(0)
+
+	// SCM carries the lower 26 bits of the IDM and SCM+ ids.
+	const id = 0x1C000001
+	scmMsg := scm.SCM{ID: id & (1<<26 - 1), Consumption: 100}
+	idmMsg := idm.IDM{ERTSerialNumber: id, LastConsumptionCount: 101}
+	scmPlus := scmplus.SCM{EndpointID: id, Consumption: 102}
+	otherPlus := scmplus.SCM{EndpointID: 0x2C000001, Consumption: 200}
+
+	for idx, step := range []struct {
+		Msg       parse.Message
+		ID        uint32
+		Protocols []string
+	}{
+		{scmMsg, id & (1<<26 - 1), []string{"SCM"}},
+		{idmMsg, id, []string{"SCM", "IDM"}},
+		{scmPlus, id, []string{"SCM", "IDM", "SCM+"}},
+		{scmMsg, id, []string{"SCM", "IDM", "SCM+"}},
+		// Another meter whose id shares the lower 26 bits is only merged
+		// with SCM, which can't tell the two apart.
+		{otherPlus, 0x2C000001, []string{"SCM", "SCM+"}},
+		{idm.IDM{ERTSerialNumber: id, LastConsumptionCount: 103}, id, []string{"SCM", "IDM", "SCM+"}},
+	} {
+		now = now.Add(time.Second)
+		merged := ms.Update(step.Msg, now)
+
+		var protocols []string
+		for _, p := range merged.Protocols {
+			protocols = append(protocols, p.MsgType)
+		}
+		if merged.Trigger != step.Msg.MsgType() || merged.ID != step.ID || !reflect.DeepEqual(protocols, step.Protocols) {
+			t.Fatalf("Step %d: got trigger %s, id %d and protocols %v, expected %s, %d and %v\n",
+				idx, merged.Trigger, merged.ID, protocols, step.Msg.MsgType(), step.ID, step.Protocols)
+		}
+	}
+
+	// The latest message of each protocol is kept.
+	merged := ms.Update(scmMsg, now.Add(time.Second))
+	for _, p := range merged.Protocols {
+		if p.MsgType == "IDM" && p.Message.MeterConsumption() != 103 {
+			t.Fatalf("Expected the latest IDM consumption got %d\n", p.Message.MeterConsumption())
+		}
+	}
+	// An SCM message could be either meter, the latest SCM+ is merged.
+	for _, p := range merged.Protocols {
+		if p.MsgType == "SCM+" && p.Message.MeterID() != 0x2C000001 {
+			t.Fatalf("Expected the latest SCM+ meter got %d\n", p.Message.MeterID())
+		}
+	}
+}
+
+func TestMergeStateEvicts(t *testing.T) {
+	now := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	ms := NewMergeState(2)
+
+	ms.Update(scm.SCM{ID: 1}, now)
+	ms.Update(idm.IDM{ERTSerialNumber: 1}, now)
+	ms.Update(scm.SCM{ID: 2}, now)
+	ms.Update(idm.IDM{ERTSerialNumber: 2}, now)
+	ms.Update(scm.SCM{ID: 3}, now)
+
+	// Meter 1 was heard least recently and forgotten.
+	if merged := ms.Update(idm.IDM{ERTSerialNumber: 2}, now); len(merged.Protocols) != 2 {
+		t.Fatalf("Expected meter 2 kept got %d protocols\n", len(merged.Protocols))
+	}
+	if merged := ms.Update(scm.SCM{ID: 1}, now); len(merged.Protocols) != 1 {
+		t.Fatalf("Expected meter 1 evicted got %d protocols\n", len(merged.Protocols))
+	}
+}
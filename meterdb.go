@@ -0,0 +1,194 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bemasher/rtlamr/parse"
+)
+
+// readMeterDB parses a meter database, a subset of YAML mapping meter ids to
+// their details:
+//
+//	# Meters on the house.
+//	12345678:
+//	  name: house-water
+//	  commodity: water
+//	  unit: gal
+//	  multiplier: 0.1
+//	  interval: 15m
+//
+// Every field is optional. Values may be quoted, and # starts a comment
+// outside of quotes.
+func readMeterDB(r io.Reader) (*aliasTable, error) {
+	t := &aliasTable{make(map[uint32]Alias), make(map[string]uint32)}
+
+	var (
+		id     uint32
+		alias  *Alias
+		fields map[string]bool
+	)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := stripComment(scanner.Text())
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+
+		trimmed := strings.TrimLeft(text, " \t")
+		indented := len(trimmed) != len(text)
+		if strings.Contains(text[:len(text)-len(trimmed)], "\t") {
+			return nil, fmt.Errorf("line %d: tabs can't be used for indentation", line)
+		}
+
+		key, value, ok := strings.Cut(strings.TrimSpace(text), ":")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key: value", line)
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+
+		if !indented {
+			if value != "" {
+				return nil, fmt.Errorf("line %d: expected a meter id followed by its fields on indented lines", line)
+			}
+			if alias != nil {
+				if err := t.add(id, *alias); err != nil {
+					return nil, err
+				}
+			}
+
+			parsed, err := ParseUint(key, 32)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid meter id: %s", line, err)
+			}
+			id = uint32(parsed)
+			if _, dup := t.ids[id]; dup {
+				return nil, fmt.Errorf("line %d: meter %d is already defined", line, id)
+			}
+			alias, fields = &Alias{line: line}, map[string]bool{}
+			continue
+		}
+
+		if alias == nil {
+			return nil, fmt.Errorf("line %d: field %q must follow a meter id", line, key)
+		}
+		if fields[key] {
+			return nil, fmt.Errorf("line %d: duplicate field %q", line, key)
+		}
+		fields[key] = true
+
+		value, err := unquote(value)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err)
+		}
+		if err := alias.set(key, value); err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if alias != nil {
+		if err := t.add(id, *alias); err != nil {
+			return nil, err
+		}
+	}
+
+	return t, nil
+}
+
+// set assigns a field of a meter database entry.
+func (alias *Alias) set(key, value string) error {
+	switch key {
+	case "name":
+		if !isAliasName(value) {
+			return fmt.Errorf("invalid name %q, names must begin with a letter and not be a meter id", value)
+		}
+		alias.Name = value
+	case "commodity":
+		alias.Commodity = strings.ToLower(value)
+		if !isCommodity(alias.Commodity) {
+			return fmt.Errorf("invalid commodity %q, expected one of: electric, gas, water", value)
+		}
+	case "unit":
+		if alias.Scale == nil {
+			alias.Scale = &Scale{Multiplier: 1}
+		}
+		alias.Scale.Unit = value
+	case "multiplier":
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("invalid multiplier: %s", err)
+		}
+		if alias.Scale == nil {
+			alias.Scale = &Scale{}
+		}
+		alias.Scale.Multiplier = f
+	case "interval":
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid interval: %s", err)
+		}
+		if d <= 0 {
+			return errors.New("interval must be positive")
+		}
+		alias.Interval = d
+	default:
+		return fmt.Errorf("unknown field %q, expected one of: name, commodity, unit, multiplier, interval", key)
+	}
+	return nil
+}
+
+// add adds a meter to the table, names must be unique.
+func (t *aliasTable) add(id uint32, alias Alias) error {
+	if alias.Name != "" {
+		if prev, dup := t.names[alias.Name]; dup {
+			return fmt.Errorf("line %d: name %q is already used by meter %d", alias.line, alias.Name, prev)
+		}
+		t.names[alias.Name] = id
+	}
+	t.ids[id] = alias
+	return nil
+}
+
+// unquote removes single or double quotes from value, if it's quoted.
+func unquote(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, `"`):
+		return strconv.Unquote(value)
+	case strings.HasPrefix(value, "'"):
+		if len(value) < 2 || !strings.HasSuffix(value, "'") {
+			return "", fmt.Errorf("unterminated string %s", value)
+		}
+		return strings.ReplaceAll(value[1:len(value)-1], "''", "'"), nil
+	}
+	return value, nil
+}
+
+// Filter passes messages from meters in the table, see -meterdb.only.
+func (a *Aliases) Filter(msg parse.Message) bool {
+	_, ok := a.Lookup(msg.MeterID())
+	return ok
+}
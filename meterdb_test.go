@@ -0,0 +1,90 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bemasher/rtlamr/parse"
+	"github.com/bemasher/rtlamr/scm"
+)
+
+func TestReadMeterDB(t *testing.T) {
+	db := `# Meters on the house.
+12345678:
+  name: house-water  # The main line.
+  commodity: Water
+  unit: "gal"
+  multiplier: 0.1
+  interval: 15m
+
+0x00BC614F:
+  name: 'house-gas'
+
+42:
+  multiplier: 2
+`
+
+	table, err := readMeterDB(strings.NewReader(db))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alias, ok := table.ids[12345678]
+	if !ok || alias.Name != "house-water" || alias.Commodity != "water" || alias.Interval != 15*time.Minute {
+		t.Fatalf("Unexpected entry: %+v\n", alias)
+	}
+	if alias.Scale == nil || alias.Scale.Multiplier != 0.1 || alias.Scale.Unit != "gal" {
+		t.Fatalf("Unexpected scale: %+v\n", alias.Scale)
+	}
+	if id := table.names["house-gas"]; id != 12345679 {
+		t.Fatalf("Expected house-gas to be meter 12345679 got %d\n", id)
+	}
+	if alias := table.ids[42]; alias.Name != "" || alias.Scale == nil || alias.Scale.Multiplier != 2 {
+		t.Fatalf("Unexpected entry: %+v\n", alias)
+	}
+
+	var aliases Aliases
+	aliases.table.Store(table)
+	msg := parse.LogMessage{Message: scm.SCM{ID: 12345678, Consumption: 100}}
+	aliases.Apply(&msg)
+	if msg.MeterName != "house-water" || msg.ScaledConsumption == nil || *msg.ScaledConsumption != 10 || msg.Unit != "gal" {
+		t.Fatalf("Unexpected message: %+v\n", msg)
+	}
+
+	if !aliases.Filter(scm.SCM{ID: 42}) || aliases.Filter(scm.SCM{ID: 43}) {
+		t.Fatal("Expected only meters in the database to pass")
+	}
+}
+
+func TestReadMeterDBInvalid(t *testing.T) {
+	testCases := []struct {
+		name string
+		db   string
+		expt string
+	}{
+		{"FieldWithoutID", "  name: house\n", "line 1: field \"name\" must follow a meter id"},
+		{"InvalidID", "1:\n  name: a\nhouse:\n", "line 3: invalid meter id"},
+		{"DuplicateID", "1:\n\n1:\n", "line 3: meter 1 is already defined"},
+		{"InlineValue", "1: house\n", "line 1: expected a meter id"},
+		{"UnknownField", "1:\n  colour: red\n", "line 2: unknown field \"colour\""},
+		{"DuplicateField", "1:\n  name: a\n  name: b\n", "line 3: duplicate field \"name\""},
+		{"InvalidName", "1:\n  name: 123\n", "line 2: invalid name"},
+		{"DuplicateName", "1:\n  name: a\n2:\n  name: a\n", "line 3: name \"a\" is already used by meter 1"},
+		{"InvalidCommodity", "1:\n  commodity: steam\n", "line 2: invalid commodity"},
+		{"InvalidMultiplier", "1:\n  multiplier: lots\n", "line 2: invalid multiplier"},
+		{"InvalidInterval", "1:\n  interval: -1m\n", "line 2: interval must be positive"},
+		{"Tabs", "1:\n\tname: a\n", "line 2: tabs can't be used"},
+		{"Unterminated", "1:\n  name: 'a\n", "line 2: unterminated string"},
+		{"MissingColon", "1:\n  name\n", "line 2: expected key: value"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := readMeterDB(strings.NewReader(tc.db))
+			if err == nil || !strings.HasPrefix(err.Error(), tc.expt) {
+				t.Fatalf("Expected error %q got %v\n", tc.expt, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,38 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import "github.com/bemasher/rtlamr/parse"
+
+// MinSNRFilter matches packets whose estimated signal to noise ratio is below
+// Min dB, for excluding the occasional packet from a distant meter which
+// passes its checksum by luck, see -minsnr.
+type MinSNRFilter struct {
+	Min float64
+
+	// SNR estimates the SNR of the packet being filtered from the samples it
+	// was decoded from. The receiver sets it once samples are held.
+	SNR func(msg parse.Message) float64
+}
+
+func NewMinSNRFilter(min float64) *MinSNRFilter {
+	return &MinSNRFilter{Min: min}
+}
+
+func (f *MinSNRFilter) Filter(msg parse.Message) bool {
+	return f.SNR(msg) < f.Min
+}
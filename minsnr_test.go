@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bemasher/rtlamr/gen"
+	"github.com/bemasher/rtlamr/parse"
+)
+
+func TestMinSNRFilter(t *testing.T) {
+	f := NewMinSNRFilter(10)
+	for _, snr := range []float64{9.9, 10, 25} {
+		f.SNR = func(parse.Message) float64 { return snr }
+		if excluded := f.Filter(nil); excluded != (snr < 10) {
+			t.Fatalf("SNR %.1f: expected excluded %t, got %t\n", snr, snr < 10, excluded)
+		}
+	}
+}
+
+func TestMinSNR(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping receiver test in short mode")
+	}
+
+	p, err := parse.NewParser("scm", 72, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := gen.Channel{SNR: 20, Rand: rand.New(rand.NewSource(1))}
+	samples := genSamples(*p.Cfg(), ch, 1, 50*time.Millisecond, func(int) []byte {
+		return gen.ManchesterChips(gen.SCM{ID: 1001, Type: 7, Consumption: 1000}.Packet())
+	})
+	server := fakeRTLTCP(t, samples)
+
+	for _, tc := range []struct {
+		name    string
+		minSNR  string
+		status  int
+		emitted bool
+	}{
+		{"Below", "5", exitOK, true},
+		{"Above", "60", exitNoMessages, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			stdout, err := os.Create(filepath.Join(t.TempDir(), "stdout"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer stdout.Close()
+
+			status := runRtlamr(t, stdout, "-format=json", "-server="+server, "-duration=2s", "-minsnr="+tc.minSNR)
+			if status != tc.status {
+				t.Fatalf("Expected status %d, got %d\n", tc.status, status)
+			}
+			if _, err := stdout.Seek(0, 0); err != nil {
+				t.Fatal(err)
+			}
+
+			emitted := false
+			scanner := bufio.NewScanner(stdout)
+			for scanner.Scan() {
+				if !strings.Contains(scanner.Text(), `"Reason"`) {
+					emitted = true
+				}
+			}
+			if emitted != tc.emitted {
+				t.Fatalf("Expected emitted %t, got %t\n", tc.emitted, emitted)
+			}
+		})
+	}
+}
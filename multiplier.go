@@ -0,0 +1,137 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/bemasher/rtlamr/parse"
+)
+
+// Scale converts a meter's raw consumption count to commodity units.
+type Scale struct {
+	Multiplier float64
+	Unit       string
+}
+
+// Multiplier is a flag value holding either a single multiplier applied to
+// every meter or a per-meter table loaded from a csv file of the form:
+//
+//	# meter id, multiplier, unit
+//	12345678,0.01,ccf
+type Multiplier struct {
+	value  string
+	global *Scale
+	meters map[uint32]Scale
+}
+
+func (m *Multiplier) String() string {
+	return m.value
+}
+
+func (m *Multiplier) Set(value string) error {
+	m.value = value
+	m.global = nil
+	m.meters = nil
+
+	if f, err := strconv.ParseFloat(value, 64); err == nil {
+		m.global = &Scale{Multiplier: f}
+		return nil
+	}
+
+	file, err := os.Open(value)
+	if err != nil {
+		return fmt.Errorf("multiplier is neither a number nor a readable file: %s", err)
+	}
+	defer file.Close()
+
+	m.meters, err = ReadScales(file)
+	return err
+}
+
+// ReadScales parses a csv table mapping meter ids to a multiplier and an
+// optional unit. Lines beginning with # are ignored, each meter may only be
+// defined once.
+func ReadScales(r io.Reader) (map[uint32]Scale, error) {
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	meters := make(map[uint32]Scale)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		line, _ := reader.FieldPos(0)
+		if len(record) < 2 || len(record) > 3 {
+			return nil, fmt.Errorf("line %d: expected meter id, multiplier and optional unit", line)
+		}
+
+		id, err := strconv.ParseUint(strings.TrimSpace(record[0]), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid meter id: %s", line, err)
+		}
+
+		var s Scale
+		if s.Multiplier, err = strconv.ParseFloat(strings.TrimSpace(record[1]), 64); err != nil {
+			return nil, fmt.Errorf("line %d: invalid multiplier: %s", line, err)
+		}
+		if len(record) == 3 {
+			s.Unit = strings.TrimSpace(record[2])
+		}
+
+		if _, dup := meters[uint32(id)]; dup {
+			return nil, fmt.Errorf("line %d: meter %d is already defined", line, id)
+		}
+		meters[uint32(id)] = s
+	}
+
+	return meters, nil
+}
+
+// Lookup returns the scale for the given meter id, if any.
+func (m *Multiplier) Lookup(id uint32) (s Scale, ok bool) {
+	if m.global != nil {
+		return *m.global, true
+	}
+	s, ok = m.meters[id]
+	return
+}
+
+// Apply fills in the scaled consumption fields of msg. The raw count in the
+// message itself is left untouched.
+func (m *Multiplier) Apply(msg *parse.LogMessage) {
+	s, ok := m.Lookup(msg.MeterID())
+	if !ok {
+		return
+	}
+
+	scaled := float64(msg.MeterConsumption()) * s.Multiplier
+	msg.ScaledConsumption = &scaled
+	msg.Unit = s.Unit
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bemasher/rtlamr/parse"
+	"github.com/bemasher/rtlamr/scm"
+)
+
+func TestReadScales(t *testing.T) {
+	testCases := []struct {
+		name  string
+		table string
+		expt  map[uint32]Scale
+		err   string
+	}{
+		{"Empty", "", map[uint32]Scale{}, ""},
+		{"Comments", "# meter id, multiplier, unit\n\n12345678,0.01,ccf\n", map[uint32]Scale{12345678: {0.01, "ccf"}}, ""},
+		{"NoUnit", "1, 2\n2,0.5, kWh\n", map[uint32]Scale{1: {2, ""}, 2: {0.5, "kWh"}}, ""},
+		{"TooFewFields", "1\n", nil, "line 1: expected meter id"},
+		{"TooManyFields", "1,2,ccf,extra\n", nil, "line 1: expected meter id"},
+		{"BadID", "# header\nabc,2\n", nil, "line 2: invalid meter id"},
+		{"IDOverflow", "4294967296,2\n", nil, "line 1: invalid meter id"},
+		{"BadMultiplier", "1,two\n", nil, "line 1: invalid multiplier"},
+		{"Duplicate", "1,2\n3,4\n1,5\n", nil, "line 3: meter 1 is already defined"},
+		{"BadQuote", "1,\"2\n", nil, "extraneous or missing"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			recv, err := ReadScales(strings.NewReader(tc.table))
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("Expected error containing %q got %v\n", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(recv) != len(tc.expt) {
+				t.Fatalf("Expected %v got %v\n", tc.expt, recv)
+			}
+			for id, s := range tc.expt {
+				if recv[id] != s {
+					t.Fatalf("Meter %d: expected %+v got %+v\n", id, s, recv[id])
+				}
+			}
+		})
+	}
+}
+
+func TestMultiplierSet(t *testing.T) {
+	var m Multiplier
+	if err := m.Set(filepath.Join(t.TempDir(), "missing.csv")); err == nil || !strings.Contains(err.Error(), "neither a number nor a readable file") {
+		t.Fatalf("Expected error for a missing file, got %v\n", err)
+	}
+
+	if err := m.Set("0.5"); err != nil {
+		t.Fatal(err)
+	}
+	if s, ok := m.Lookup(42); !ok || s.Multiplier != 0.5 || s.Unit != "" {
+		t.Fatalf("Expected a global multiplier of 0.5, got %+v %t\n", s, ok)
+	}
+}
+
+func TestMultiplierApply(t *testing.T) {
+	// Encoders choose their csv columns from the -multiplier flag.
+	registerFlags.Do(RegisterFlags)
+	m := flag.Lookup("multiplier").Value.(*Multiplier)
+	defer func(saved Multiplier) { *m = saved }(*m)
+	m.value, m.global, m.meters = "scales.csv", nil, map[uint32]Scale{12345678: {0.01, "ccf"}}
+
+	scaled := parse.LogMessage{Time: time.Unix(0, 0).UTC(), Message: scm.SCM{ID: 12345678, Consumption: 150}}
+	m.Apply(&scaled)
+	if scaled.ScaledConsumption == nil || *scaled.ScaledConsumption != 1.5 || scaled.Unit != "ccf" {
+		t.Fatalf("Unexpected scaled message: %+v\n", scaled)
+	}
+	if scaled.MeterConsumption() != 150 {
+		t.Fatalf("Raw consumption changed to %d\n", scaled.MeterConsumption())
+	}
+
+	unknown := parse.LogMessage{Time: time.Unix(0, 0).UTC(), Message: scm.SCM{ID: 1, Consumption: 150}}
+	m.Apply(&unknown)
+	if unknown.ScaledConsumption != nil || unknown.Unit != "" {
+		t.Fatalf("Unknown meter was scaled: %+v\n", unknown)
+	}
+
+	// The scaled fields survive every encoder, and unknown meters omit them.
+	testCases := []struct {
+		format       string
+		scaled, unit string
+	}{
+		{"plain", "ScaledConsumption:1.5", "Unit:ccf"},
+		{"csv", ",1.5,ccf", ",1.5,ccf"},
+		{"json", `"ScaledConsumption":1.5`, `"Unit":"ccf"`},
+		{"xml", "<ScaledConsumption>1.5</ScaledConsumption>", "<Unit>ccf</Unit>"},
+		{"collectd", ":1.5\n", ":1.5\n"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.format, func(t *testing.T) {
+			for _, msg := range []parse.LogMessage{scaled, unknown} {
+				var buf bytes.Buffer
+				enc, err := newEncoder(tc.format, &buf)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := enc.Encode(msg); err != nil {
+					t.Fatal(err)
+				}
+				endDocuments(enc)
+
+				out := buf.String()
+				if msg.ScaledConsumption != nil && (!strings.Contains(out, tc.scaled) || !strings.Contains(out, tc.unit)) {
+					t.Fatalf("Expected %q and %q in %q\n", tc.scaled, tc.unit, out)
+				}
+				if msg.ScaledConsumption == nil && strings.Contains(out, "1.5") {
+					t.Fatalf("Unknown meter has a scaled value in %q\n", out)
+				}
+			}
+		})
+	}
+
+	// Gob keeps the fields as they are.
+	var buf bytes.Buffer
+	if err := parse.NewGobEncoder(&buf).Encode(scaled); err != nil {
+		t.Fatal(err)
+	}
+	rec, err := parse.NewGobReader(&buf).Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg, ok := rec.Value.(parse.LogMessage); !ok || msg.ScaledConsumption == nil || *msg.ScaledConsumption != 1.5 || msg.Unit != "ccf" {
+		t.Fatalf("Unexpected gob record: %+v\n", rec)
+	}
+}
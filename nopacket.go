@@ -0,0 +1,122 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Actions taken by -nopacketwatchdog.
+const (
+	noPacketWarn   = "warn"   // Log a warning, which every action does.
+	noPacketAgain  = "again"  // Switch the tuner to automatic gain.
+	noPacketRetune = "retune" // Step the center frequency to a nearby channel.
+	noPacketExit   = "exit"   // Exit with exitNoPackets.
+)
+
+// NoPacketActions is a flag value holding the comma-separated actions taken
+// by -nopacketwatchdog, such as again,retune,exit.
+type NoPacketActions []string
+
+func (a *NoPacketActions) String() string {
+	return strings.Join(*a, ",")
+}
+
+func (a *NoPacketActions) Set(value string) error {
+	var actions NoPacketActions
+	for _, token := range strings.Split(value, ",") {
+		token = strings.ToLower(strings.TrimSpace(token))
+		switch token {
+		case noPacketWarn, noPacketAgain, noPacketRetune, noPacketExit:
+			actions = append(actions, token)
+		default:
+			return fmt.Errorf("invalid action %q, expected warn, again, retune or exit", token)
+		}
+	}
+	*a = actions
+	return nil
+}
+
+// retuneOffsets are the steps from the configured center frequency tried in
+// turn by the retune action, in units of half the sample rate. The last
+// returns to the configured frequency.
+var retuneOffsets = []int{1, -1, 2, -2, 0}
+
+// NoPacketWatchdog tracks how long samples have been decoded without a
+// packet passing its checksum. Time is measured in samples so periods when
+// samples aren't flowing or aren't being decoded don't count. A nil
+// NoPacketWatchdog never fires.
+type NoPacketWatchdog struct {
+	Window  time.Duration
+	Actions NoPacketActions
+
+	quiet   time.Duration // Samples decoded since the last packet or action.
+	next    int           // Index of the next action, the last repeats.
+	retunes int           // Retune actions taken, indexes retuneOffsets.
+}
+
+// NewNoPacketWatchdog returns a watchdog taking the given actions, nil if
+// window is zero.
+func NewNoPacketWatchdog(window time.Duration, actions NoPacketActions) *NoPacketWatchdog {
+	if window == 0 {
+		return nil
+	}
+	if len(actions) == 0 {
+		actions = NoPacketActions{noPacketWarn}
+	}
+	return &NoPacketWatchdog{Window: window, Actions: actions}
+}
+
+// Packet records a packet passing its checksum, starting over from the first
+// action.
+func (w *NoPacketWatchdog) Packet() {
+	if w == nil {
+		return
+	}
+	w.quiet, w.next = 0, 0
+}
+
+// Decoded records a block of samples spanning d decoded without a packet.
+// Returns the action to take once Window has passed since the last packet or
+// action, otherwise an empty string.
+func (w *NoPacketWatchdog) Decoded(d time.Duration) string {
+	if w == nil {
+		return ""
+	}
+
+	w.quiet += d
+	if w.quiet < w.Window {
+		return ""
+	}
+	w.quiet = 0
+
+	action := w.Actions[w.next]
+	if w.next < len(w.Actions)-1 {
+		w.next++
+	}
+	return action
+}
+
+// Retune returns the center frequency to try next, stepping from freq
+// through nearby channels and back.
+func (w *NoPacketWatchdog) Retune(freq, sampleRate uint32) uint32 {
+	offset := retuneOffsets[w.retunes%len(retuneOffsets)]
+	w.retunes++
+	return uint32(int64(freq) + int64(offset)*int64(sampleRate/2))
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNoPacketActions(t *testing.T) {
+	var actions NoPacketActions
+	if err := actions.Set("again, Retune,exit"); err != nil {
+		t.Fatal(err)
+	}
+	if recv := actions.String(); recv != "again,retune,exit" {
+		t.Fatalf("Expected %q, got %q\n", "again,retune,exit", recv)
+	}
+
+	if err := actions.Set("again,reboot"); err == nil {
+		t.Fatal("Expected error for unknown action")
+	}
+}
+
+func TestNoPacketWatchdog(t *testing.T) {
+	w := NewNoPacketWatchdog(time.Minute, NoPacketActions{noPacketAgain, noPacketRetune, noPacketExit})
+
+	// Each window without a packet takes the next action, the last repeats.
+	for _, expt := range []string{noPacketAgain, noPacketRetune, noPacketExit, noPacketExit} {
+		for i := 0; i < 5; i++ {
+			if action := w.Decoded(10 * time.Second); action != "" {
+				t.Fatalf("Unexpected action %q before window passed\n", action)
+			}
+		}
+		if action := w.Decoded(10 * time.Second); action != expt {
+			t.Fatalf("Expected %q, got %q\n", expt, action)
+		}
+	}
+
+	// A packet starts over from the first action.
+	w.Decoded(50 * time.Second)
+	w.Packet()
+	if action := w.Decoded(50 * time.Second); action != "" {
+		t.Fatalf("Unexpected action %q after packet\n", action)
+	}
+	if action := w.Decoded(10 * time.Second); action != noPacketAgain {
+		t.Fatalf("Expected %q, got %q\n", noPacketAgain, action)
+	}
+
+	// Retuning steps out from the configured frequency and back.
+	var freqs []uint32
+	for i := 0; i < len(retuneOffsets)+1; i++ {
+		freqs = append(freqs, w.Retune(912000000, 2000000))
+	}
+	expt := []uint32{913000000, 911000000, 914000000, 910000000, 912000000, 913000000}
+	for idx := range expt {
+		if freqs[idx] != expt[idx] {
+			t.Fatalf("Expected %v, got %v\n", expt, freqs)
+		}
+	}
+
+	var disabled *NoPacketWatchdog
+	disabled.Packet()
+	if action := disabled.Decoded(time.Hour); action != "" {
+		t.Fatalf("Unexpected action %q from disabled watchdog\n", action)
+	}
+}
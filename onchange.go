@@ -0,0 +1,108 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/bemasher/rtlamr/lru"
+	"github.com/bemasher/rtlamr/parse"
+)
+
+// Fields compared by -onchange for each message type when none are given.
+// IDM interval history changes with every packet, so only the running total
+// and tamper fields are compared.
+var onChangeFields = map[string][]string{
+	"SCM":  {"Consumption", "TamperPhy", "TamperEnc"},
+	"SCM+": {"Consumption", "Tamper"},
+	"IDM":  {"LastConsumptionCount", "TamperCounters", "PowerOutageFlags"},
+	"R900": {"Consumption", "NoUse", "BackFlow", "Leak", "LeakNow"},
+}
+
+// OnChangeFilter drops messages whose compared fields match the last message
+// emitted by the same meter and message type. With a heartbeat, a message is
+// also emitted once the heartbeat has elapsed since the last emission.
+type OnChangeFilter struct {
+	Fields    []string // Overrides onChangeFields if not empty.
+	Heartbeat time.Duration
+
+	last *lru.Cache
+	now  func() time.Time
+}
+
+type onChangeEntry struct {
+	Values  string
+	Emitted time.Time
+}
+
+func NewOnChangeFilter(fields []string, heartbeat time.Duration, maxMeters int) *OnChangeFilter {
+	return &OnChangeFilter{
+		Fields:    fields,
+		Heartbeat: heartbeat,
+		last:      lru.New(maxMeters),
+		now:       time.Now,
+	}
+}
+
+// values formats the compared fields of msg. Fields the message type doesn't
+// have are skipped.
+func (oc *OnChangeFilter) values(msg parse.Message) string {
+	fields := oc.Fields
+	if len(fields) == 0 {
+		fields = onChangeFields[msg.MsgType()]
+	}
+
+	v := reflect.Indirect(reflect.ValueOf(msg))
+	if v.Kind() != reflect.Struct {
+		return fmt.Sprint(msg.MeterConsumption())
+	}
+
+	var values []string
+	for _, name := range fields {
+		if field := v.FieldByName(name); field.IsValid() {
+			values = append(values, fmt.Sprintf("%s:%v", name, field.Interface()))
+		}
+	}
+
+	return strings.Join(values, " ")
+}
+
+func (oc *OnChangeFilter) Stateful() {}
+
+func (oc *OnChangeFilter) Filter(msg parse.Message) bool {
+	// Packets with bad checksums don't carry trustworthy values.
+	if !msg.ChecksumOK() {
+		return true
+	}
+
+	key := uniqueKey{msg.MeterID(), msg.MsgType()}
+	values := oc.values(msg)
+	now := oc.now()
+
+	if v, ok := oc.last.Get(key); ok && v.(onChangeEntry).Values == values {
+		if oc.Heartbeat == 0 || now.Sub(v.(onChangeEntry).Emitted) < oc.Heartbeat {
+			return false
+		}
+	}
+
+	oc.last.Add(key, onChangeEntry{values, now})
+
+	return true
+}
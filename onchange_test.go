@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bemasher/rtlamr/idm"
+	"github.com/bemasher/rtlamr/parse"
+	"github.com/bemasher/rtlamr/scm"
+)
+
+func TestOnChangeFilter(t *testing.T) {
+	now := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	oc := NewOnChangeFilter(nil, time.Hour, 0)
+	oc.now = func() time.Time { return now }
+
+	first := scm.SCM{ID: 1, Consumption: 100, ChecksumVal: 0x1234}
+	retransmit := scm.SCM{ID: 1, Consumption: 100, ChecksumVal: 0x1234}
+	tampered := scm.SCM{ID: 1, Consumption: 100, TamperPhy: 1, ChecksumVal: 0x4321}
+
+	// IDM intervals differ between packets with the same total.
+	idm1 := idm.IDM{ERTSerialNumber: 2, LastConsumptionCount: 50}
+	idm2 := idm.IDM{ERTSerialNumber: 2, LastConsumptionCount: 50, TransmitTimeOffset: 7}
+	idm2.DifferentialConsumptionIntervals[0] = 3
+	idm3 := idm.IDM{ERTSerialNumber: 2, LastConsumptionCount: 51}
+
+	for idx, step := range []struct {
+		Elapsed time.Duration
+		Msg     parse.Message
+		Expt    bool
+	}{
+		{0, first, true},
+		{time.Minute, retransmit, false},
+		{time.Minute, tampered, true},
+		{time.Minute, idm1, true},
+		{time.Minute, idm2, false},
+		{time.Minute, idm3, true},
+		{time.Hour, tampered, true},
+	} {
+		now = now.Add(step.Elapsed)
+		if recv := oc.Filter(step.Msg); recv != step.Expt {
+			t.Fatalf("Step %d: expected %t got %t\n", idx, step.Expt, recv)
+		}
+	}
+
+	// An explicit field set overrides the defaults.
+	oc = NewOnChangeFilter([]string{"Consumption"}, 0, 0)
+	if !oc.Filter(first) || oc.Filter(tampered) {
+		t.Fatal("Expected only consumption to be compared")
+	}
+}
@@ -0,0 +1,520 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	mathrand "math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bemasher/rtlamr/lru"
+	"github.com/bemasher/rtlamr/parse"
+)
+
+// Meters whose consumption is exported by -otel.endpoint, the least recently
+// heard are dropped first.
+const otelMaxMeters = 10000
+
+// Spans held between exports, further spans are dropped until the next.
+const otelMaxSpans = 2048
+
+// How often spans are exported, independent of -otel.interval.
+const otelSpanInterval = 5 * time.Second
+
+// OTelExporter sends receiver counters and the consumption of each meter to
+// an OpenTelemetry collector using OTLP over http with json encoding, and
+// optionally a sample of spans timing each packet. A nil exporter does
+// nothing, so the receiver may call it unconditionally.
+type OTelExporter struct {
+	Interval   time.Duration
+	TraceRatio float64 // Fraction of packets traced, 0 for none.
+
+	metricsURL string
+	tracesURL  string
+	resource   otlpResource
+	client     *http.Client
+
+	mu      sync.Mutex
+	start   time.Time
+	counts  Stats
+	byType  map[string]uint64
+	meters  *lru.Cache // otlpNumberDataPoint keyed by uniqueKey.
+	spans   []otlpSpan
+	dropped uint64 // Spans dropped since the last export.
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewOTelExporter returns an exporter sending to endpoint, given as
+// host:port or as a url whose path is replaced by the OTLP paths.
+func NewOTelExporter(endpoint string, interval time.Duration, traceRatio float64, attrs map[string]string) (*OTelExporter, error) {
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "http://" + endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme %q, expected http or https", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("%q has no host", endpoint)
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("interval must be positive")
+	}
+	if traceRatio < 0 || traceRatio > 1 {
+		return nil, fmt.Errorf("trace ratio must be between 0 and 1")
+	}
+
+	base := strings.TrimSuffix(u.Scheme+"://"+u.Host+u.Path, "/")
+
+	var resource otlpResource
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if attrs[k] != "" {
+			resource.Attributes = append(resource.Attributes, otlpString(k, attrs[k]))
+		}
+	}
+
+	return &OTelExporter{
+		Interval:   interval,
+		TraceRatio: traceRatio,
+		metricsURL: base + "/v1/metrics",
+		tracesURL:  base + "/v1/traces",
+		resource:   resource,
+		client:     &http.Client{Timeout: 10 * time.Second},
+		start:      time.Now(),
+		byType:     make(map[string]uint64),
+		meters:     lru.New(otelMaxMeters),
+	}, nil
+}
+
+// Start exports periodically until Shutdown is called.
+func (oe *OTelExporter) Start() {
+	if oe == nil {
+		return
+	}
+	oe.stop, oe.done = make(chan struct{}), make(chan struct{})
+	go oe.run()
+}
+
+func (oe *OTelExporter) run() {
+	defer close(oe.done)
+
+	metrics := time.NewTicker(oe.Interval)
+	defer metrics.Stop()
+
+	var spans <-chan time.Time
+	if oe.TraceRatio > 0 {
+		t := time.NewTicker(otelSpanInterval)
+		defer t.Stop()
+		spans = t.C
+	}
+
+	for {
+		select {
+		case <-oe.stop:
+			return
+		case <-metrics.C:
+			oe.export(context.Background(), false)
+		case <-spans:
+			oe.export(context.Background(), true)
+		}
+	}
+}
+
+// Shutdown stops periodic exports and makes a final one, giving up once
+// ctx is done.
+func (oe *OTelExporter) Shutdown(ctx context.Context) {
+	if oe == nil {
+		return
+	}
+	if oe.stop != nil {
+		close(oe.stop)
+		<-oe.done
+	}
+	oe.export(ctx, true)
+	oe.export(ctx, false)
+}
+
+// Block records the receiver's counts after a sample block is read.
+func (oe *OTelExporter) Block(s Stats) {
+	if oe == nil {
+		return
+	}
+	oe.mu.Lock()
+	defer oe.mu.Unlock()
+	oe.counts = Stats{
+		Blocks:      s.Blocks,
+		Decoded:     s.Decoded,
+		BadChecksum: s.BadChecksum,
+		Emitted:     s.Emitted,
+		Stalls:      s.Stalls,
+	}
+	for msgType, count := range s.decodedByType {
+		oe.byType[msgType] = count
+	}
+}
+
+// Emitted records the consumption of a message written to the output.
+func (oe *OTelExporter) Emitted(msg parse.LogMessage) {
+	if oe == nil {
+		return
+	}
+
+	value := float64(msg.MeterConsumption())
+	if msg.ScaledConsumption != nil {
+		value = *msg.ScaledConsumption
+	}
+
+	attrs := []otlpKeyValue{
+		otlpString("meter.id", strconv.FormatUint(uint64(msg.MeterID()), 10)),
+		otlpString("msg.type", msg.MsgType()),
+	}
+	if msg.MeterName != "" {
+		attrs = append(attrs, otlpString("meter.name", msg.MeterName))
+	}
+	commodity := msg.Commodity
+	if commodity == "" {
+		commodity = commodityOf(msg.MsgType(), uint(msg.MeterType()))
+	}
+	if commodity != "" {
+		attrs = append(attrs, otlpString("commodity", commodity))
+	}
+
+	oe.mu.Lock()
+	defer oe.mu.Unlock()
+	oe.meters.Add(uniqueKey{msg.MeterID(), msg.MsgType()}, otlpNumberDataPoint{
+		Attributes:   attrs,
+		TimeUnixNano: otlpTime(msg.Time),
+		AsDouble:     &value,
+	})
+}
+
+// Tracing reports whether packets are traced, so their timing is worth
+// measuring.
+func (oe *OTelExporter) Tracing() bool {
+	return oe != nil && oe.TraceRatio > 0
+}
+
+// PacketTiming holds the times bounding each stage of handling a packet.
+// Decoding and parsing cover the whole block the packet was found in.
+type PacketTiming struct {
+	DecodeStart, ParseStart, ParseEnd time.Time
+	WriteStart, WriteEnd              time.Time
+}
+
+// Packet records a span for a packet written to the output, with a child
+// span for each stage, if it's sampled.
+func (oe *OTelExporter) Packet(msg parse.LogMessage, t PacketTiming, err error) {
+	if !oe.Tracing() || mathrand.Float64() >= oe.TraceRatio {
+		return
+	}
+
+	traceID, rootID := otlpID(16), otlpID(8)
+	root := otlpSpan{
+		TraceID:           traceID,
+		SpanID:            rootID,
+		Name:              "packet",
+		Kind:              otlpSpanKindInternal,
+		StartTimeUnixNano: otlpTime(t.DecodeStart),
+		EndTimeUnixNano:   otlpTime(t.WriteEnd),
+		Attributes: []otlpKeyValue{
+			otlpString("meter.id", strconv.FormatUint(uint64(msg.MeterID()), 10)),
+			otlpString("msg.type", msg.MsgType()),
+		},
+	}
+	if err != nil {
+		root.Status = &otlpStatus{Code: otlpStatusError, Message: err.Error()}
+	}
+
+	spans := []otlpSpan{root}
+	for _, stage := range []struct {
+		name       string
+		start, end time.Time
+	}{
+		{"decode", t.DecodeStart, t.ParseStart},
+		{"parse", t.ParseStart, t.ParseEnd},
+		{"write", t.WriteStart, t.WriteEnd},
+	} {
+		spans = append(spans, otlpSpan{
+			TraceID:           traceID,
+			SpanID:            otlpID(8),
+			ParentSpanID:      rootID,
+			Name:              stage.name,
+			Kind:              otlpSpanKindInternal,
+			StartTimeUnixNano: otlpTime(stage.start),
+			EndTimeUnixNano:   otlpTime(stage.end),
+		})
+	}
+
+	oe.mu.Lock()
+	defer oe.mu.Unlock()
+	if len(oe.spans)+len(spans) > otelMaxSpans {
+		oe.dropped += uint64(len(spans))
+		return
+	}
+	oe.spans = append(oe.spans, spans...)
+}
+
+// export sends either the pending spans or the current metrics. Failures
+// are logged and the data is discarded.
+func (oe *OTelExporter) export(ctx context.Context, traces bool) {
+	var (
+		target string
+		body   interface{}
+	)
+	if traces {
+		oe.mu.Lock()
+		spans, dropped := oe.spans, oe.dropped
+		oe.spans, oe.dropped = nil, 0
+		oe.mu.Unlock()
+
+		if dropped != 0 {
+			slog.Debug("dropped otel spans", "count", dropped)
+		}
+		if len(spans) == 0 {
+			return
+		}
+		target, body = oe.tracesURL, oe.traces(spans)
+	} else {
+		target, body = oe.metricsURL, oe.metrics(time.Now())
+	}
+
+	if err := oe.post(ctx, target, body); err != nil {
+		slog.Warn("exporting to -otel.endpoint", "err", err)
+	}
+}
+
+func (oe *OTelExporter) post(ctx context.Context, target string, body interface{}) error {
+	buf, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := oe.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", target, resp.Status)
+	}
+	return nil
+}
+
+// metrics returns the counters and meter gauges as an OTLP metrics request.
+func (oe *OTelExporter) metrics(now time.Time) otlpMetricsRequest {
+	oe.mu.Lock()
+	defer oe.mu.Unlock()
+
+	start, end := otlpTime(oe.start), otlpTime(now)
+	counter := func(name, unit, desc string, values map[string]uint64, attr string) otlpMetric {
+		sum := &otlpSum{AggregationTemporality: otlpCumulative, IsMonotonic: true}
+		keys := make([]string, 0, len(values))
+		for k := range values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			dp := otlpNumberDataPoint{
+				StartTimeUnixNano: start,
+				TimeUnixNano:      end,
+				AsInt:             strconv.FormatUint(values[k], 10),
+			}
+			if attr != "" {
+				dp.Attributes = []otlpKeyValue{otlpString(attr, k)}
+			}
+			sum.DataPoints = append(sum.DataPoints, dp)
+		}
+		return otlpMetric{Name: name, Unit: unit, Description: desc, Sum: sum}
+	}
+	total := func(v uint64) map[string]uint64 {
+		return map[string]uint64{"": v}
+	}
+
+	metrics := []otlpMetric{
+		counter("rtlamr.blocks", "{block}", "Sample blocks read.", total(oe.counts.Blocks), ""),
+		counter("rtlamr.packets", "{packet}", "Packets decoded with a valid checksum.", oe.byType, "msg.type"),
+		counter("rtlamr.checksum_failures", "{packet}", "Packets failing their checksum.", total(oe.counts.BadChecksum), ""),
+		counter("rtlamr.emitted", "{message}", "Messages written after filtering.", total(oe.counts.Emitted), ""),
+		counter("rtlamr.stalls", "{stall}", "Stalls in sample delivery found by -stallthreshold.", total(oe.counts.Stalls), ""),
+	}
+
+	gauge := &otlpGauge{}
+	oe.meters.Range(func(_, value interface{}) {
+		gauge.DataPoints = append(gauge.DataPoints, value.(otlpNumberDataPoint))
+	})
+	if len(gauge.DataPoints) != 0 {
+		metrics = append(metrics, otlpMetric{
+			Name:        "rtlamr.meter.consumption",
+			Description: "Last consumption reported by each meter, scaled by -multiplier if given.",
+			Gauge:       gauge,
+		})
+	}
+
+	return otlpMetricsRequest{[]otlpResourceMetrics{{
+		Resource:     oe.resource,
+		ScopeMetrics: []otlpScopeMetrics{{Scope: otlpScope{Name: "rtlamr"}, Metrics: metrics}},
+	}}}
+}
+
+func (oe *OTelExporter) traces(spans []otlpSpan) otlpTracesRequest {
+	return otlpTracesRequest{[]otlpResourceSpans{{
+		Resource:   oe.resource,
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "rtlamr"}, Spans: spans}},
+	}}}
+}
+
+// The following follow the json encoding of OTLP's protobuf messages, in
+// which 64-bit integers are strings and ids are hex.
+
+const (
+	otlpCumulative       = 2
+	otlpSpanKindInternal = 1
+	otlpStatusError      = 2
+)
+
+type otlpMetricsRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope    `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpMetric struct {
+	Name        string     `json:"name"`
+	Description string     `json:"description,omitempty"`
+	Unit        string     `json:"unit,omitempty"`
+	Sum         *otlpSum   `json:"sum,omitempty"`
+	Gauge       *otlpGauge `json:"gauge,omitempty"`
+}
+
+type otlpSum struct {
+	DataPoints             []otlpNumberDataPoint `json:"dataPoints"`
+	AggregationTemporality int                   `json:"aggregationTemporality"`
+	IsMonotonic            bool                  `json:"isMonotonic"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpNumberDataPoint `json:"dataPoints"`
+}
+
+type otlpNumberDataPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      string         `json:"timeUnixNano"`
+	AsInt             string         `json:"asInt,omitempty"`
+	AsDouble          *float64       `json:"asDouble,omitempty"`
+}
+
+type otlpTracesRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            *otlpStatus    `json:"status,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpKeyValue struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+func otlpString(key, value string) (kv otlpKeyValue) {
+	kv.Key = key
+	kv.Value.StringValue = value
+	return
+}
+
+func otlpTime(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func otlpID(n int) string {
+	id := make([]byte, n)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
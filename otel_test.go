@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bemasher/rtlamr/parse"
+	"github.com/bemasher/rtlamr/scm"
+)
+
+func TestOTelExporterNil(t *testing.T) {
+	var oe *OTelExporter
+	oe.Start()
+	oe.Block(Stats{Blocks: 1})
+	oe.Emitted(parse.LogMessage{Message: scm.SCM{ID: 1}})
+	oe.Packet(parse.LogMessage{Message: scm.SCM{ID: 1}}, PacketTiming{}, nil)
+	oe.Shutdown(context.Background())
+	if oe.Tracing() {
+		t.Error("nil exporter is tracing")
+	}
+}
+
+func TestOTelExporter(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests = map[string][]json.RawMessage{}
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body json.RawMessage
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		requests[r.URL.Path] = append(requests[r.URL.Path], body)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	oe, err := NewOTelExporter(srv.URL+"/otlp/", time.Hour, 1, map[string]string{"host.name": "host"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	s := Stats{Blocks: 10, Decoded: 2}
+	s.Packet(scm.SCM{ID: 1, Type: 12})
+	oe.Block(s)
+	msg := parse.LogMessage{Time: now, Message: scm.SCM{ID: 1, Type: 12, Consumption: 100}}
+	oe.Emitted(msg)
+	oe.Packet(msg, PacketTiming{now, now, now, now, now}, nil)
+	oe.Shutdown(context.Background())
+
+	var metrics otlpMetricsRequest
+	if len(requests["/otlp/v1/metrics"]) != 1 {
+		t.Fatalf("got %d metrics requests, want 1", len(requests["/otlp/v1/metrics"]))
+	}
+	if err := json.Unmarshal(requests["/otlp/v1/metrics"][0], &metrics); err != nil {
+		t.Fatal(err)
+	}
+	rm := metrics.ResourceMetrics[0]
+	if kv := rm.Resource.Attributes[0]; kv.Key != "host.name" || kv.Value.StringValue != "host" {
+		t.Errorf("resource attribute %+v, want host.name=host", kv)
+	}
+	found := map[string]otlpMetric{}
+	for _, m := range rm.ScopeMetrics[0].Metrics {
+		found[m.Name] = m
+	}
+	if m := found["rtlamr.blocks"]; m.Sum == nil || m.Sum.DataPoints[0].AsInt != "10" {
+		t.Errorf("rtlamr.blocks = %+v, want 10", m)
+	}
+	if m := found["rtlamr.packets"]; m.Sum == nil || m.Sum.DataPoints[0].AsInt != "1" || m.Sum.DataPoints[0].Attributes[0].Value.StringValue != "SCM" {
+		t.Errorf("rtlamr.packets = %+v, want 1 SCM", m)
+	}
+	m := found["rtlamr.meter.consumption"]
+	if m.Gauge == nil || len(m.Gauge.DataPoints) != 1 || *m.Gauge.DataPoints[0].AsDouble != 100 {
+		t.Fatalf("rtlamr.meter.consumption = %+v, want 100", m)
+	}
+	attrs := map[string]string{}
+	for _, kv := range m.Gauge.DataPoints[0].Attributes {
+		attrs[kv.Key] = kv.Value.StringValue
+	}
+	if attrs["meter.id"] != "1" || attrs["commodity"] != "gas" {
+		t.Errorf("gauge attributes %v, want meter.id 1 and commodity gas", attrs)
+	}
+
+	var traces otlpTracesRequest
+	if len(requests["/otlp/v1/traces"]) != 1 {
+		t.Fatalf("got %d traces requests, want 1", len(requests["/otlp/v1/traces"]))
+	}
+	if err := json.Unmarshal(requests["/otlp/v1/traces"][0], &traces); err != nil {
+		t.Fatal(err)
+	}
+	spans := traces.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 4 {
+		t.Fatalf("got %d spans, want 4", len(spans))
+	}
+	for _, span := range spans[1:] {
+		if span.TraceID != spans[0].TraceID || span.ParentSpanID != spans[0].SpanID {
+			t.Errorf("span %s isn't a child of %s", span.Name, spans[0].Name)
+		}
+	}
+}
+
+func TestNewOTelExporterInvalid(t *testing.T) {
+	for _, endpoint := range []string{"ftp://host:4318", "http://"} {
+		if _, err := NewOTelExporter(endpoint, time.Minute, 0, nil); err == nil {
+			t.Errorf("%q: expected an error", endpoint)
+		}
+	}
+	if _, err := NewOTelExporter("localhost:4318", time.Minute, 2, nil); err == nil {
+		t.Error("expected an error for a trace ratio above 1")
+	}
+}
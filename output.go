@@ -0,0 +1,367 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/bemasher/rtlamr/csv"
+	"github.com/bemasher/rtlamr/parse"
+)
+
+// newEncoder returns an encoder writing messages to w in the given format.
+func newEncoder(format string, w io.Writer) (Encoder, error) {
+	switch strings.ToLower(format) {
+	case "plain":
+		return PlainEncoder{w, *sampleFilename, *verboseEnvelope}, nil
+	case "csv":
+		return csvEncoder{csv.NewEncoder(w), recordColumns()}, nil
+	case "json":
+		return json.NewEncoder(w), nil
+	case "xml":
+		return newXMLEncoder(w, *xmlFragment), nil
+	case "gob":
+		return parse.NewGobEncoder(w), nil
+	case "collectd":
+		return NewCollectdEncoder(w, *collectdHostname, *collectdInterval), nil
+	}
+	return nil, fmt.Errorf("unknown format %q", format)
+}
+
+// csvEncoder writes messages as csv records with the same optional columns
+// on every row.
+type csvEncoder struct {
+	enc  *csv.Encoder
+	cols parse.RecordColumns
+}
+
+// columnRecord is a message recorded with a fixed set of optional columns.
+type columnRecord struct {
+	parse.LogMessage
+	cols parse.RecordColumns
+}
+
+func (cr columnRecord) Record() []string {
+	return cr.RecordColumns(cr.cols)
+}
+
+func (ce csvEncoder) Encode(v interface{}) error {
+	if msg, ok := v.(parse.LogMessage); ok {
+		v = columnRecord{msg, ce.cols}
+	}
+	return ce.enc.Encode(v)
+}
+
+// recordColumns returns the optional csv columns the flags can fill in.
+// -multiplier's value is held by the receiver registering it.
+func recordColumns() parse.RecordColumns {
+	named := *aliasFile != "" || *meterDBFile != ""
+	scaled := false
+	if f := flag.Lookup("multiplier"); f != nil {
+		scaled = f.Value.String() != ""
+	}
+	return parse.RecordColumns{
+		Scaled:      scaled || named,
+		Delta:       *delta,
+		RawHex:      *rawHex || *allowBadCRC,
+		ChecksumOK:  *allowBadCRC,
+		Consistent:  *idmConsistent,
+		Name:        named,
+		TimeSuspect: *waitForClock != 0,
+	}
+}
+
+// xmlEncoder writes messages as elements of an <rtlamr> root element
+// following the XML declaration, so its output is a well-formed document once
+// ended. With -xml.fragment the elements are written bare, one per line, as
+// they were before.
+type xmlEncoder struct {
+	mu       sync.Mutex
+	w        io.Writer
+	enc      *xml.Encoder
+	fragment bool
+	ended    bool
+}
+
+func newXMLEncoder(w io.Writer, fragment bool) *xmlEncoder {
+	return &xmlEncoder{w: w, fragment: fragment}
+}
+
+// begin starts a document on the encoder's writer if one isn't under way.
+// Documents are started by their first message rather than when the encoder
+// is created, so nothing is written to outputs rotated away from before use.
+func (xe *xmlEncoder) begin() error {
+	if xe.enc != nil {
+		return nil
+	}
+
+	xe.enc = xml.NewEncoder(xe.w)
+	if xe.fragment {
+		return nil
+	}
+
+	if _, err := io.WriteString(xe.w, xml.Header); err != nil {
+		return err
+	}
+	xe.enc.Indent("", "\t")
+	return xe.enc.EncodeToken(xmlRoot)
+}
+
+// end closes the root element of the document under way, if any.
+func (xe *xmlEncoder) end() error {
+	enc := xe.enc
+	xe.enc = nil
+	if xe.fragment || enc == nil {
+		return nil
+	}
+
+	if err := enc.EncodeToken(xmlRoot.End()); err != nil {
+		return err
+	}
+	if err := enc.Flush(); err != nil {
+		return err
+	}
+	_, err := io.WriteString(xe.w, "\n")
+	return err
+}
+
+var xmlRoot = xml.StartElement{Name: xml.Name{Local: "rtlamr"}}
+
+func (xe *xmlEncoder) Encode(v interface{}) error {
+	xe.mu.Lock()
+	defer xe.mu.Unlock()
+
+	if xe.ended {
+		return errors.New("xml document already ended")
+	}
+	if err := xe.begin(); err != nil {
+		return err
+	}
+	if err := xe.enc.Encode(v); err != nil {
+		return err
+	}
+	if xe.fragment {
+		_, err := io.WriteString(xe.w, "\n")
+		return err
+	}
+	return nil
+}
+
+// EndDocument closes the root element, starting the document first if nothing
+// was written so even an empty run leaves a well-formed file. Later messages
+// are an error.
+func (xe *xmlEncoder) EndDocument() error {
+	xe.mu.Lock()
+	defer xe.mu.Unlock()
+
+	if xe.ended {
+		return nil
+	}
+	xe.ended = true
+
+	if err := xe.begin(); err != nil {
+		return err
+	}
+	return xe.end()
+}
+
+// Rotate ends the document under way and calls swap to replace the writer
+// beneath the encoder. The next message starts a new document, so each file
+// is well-formed by itself.
+func (xe *xmlEncoder) Rotate(swap func()) error {
+	xe.mu.Lock()
+	defer xe.mu.Unlock()
+
+	err := xe.end()
+	swap()
+	return err
+}
+
+// documentEncoder is implemented by encoders whose output must be ended, such
+// as the root element of -format=xml.
+type documentEncoder interface {
+	Encoder
+	EndDocument() error
+	Rotate(swap func()) error
+}
+
+// endDocuments ends the documents written by enc and any encoders it holds.
+func endDocuments(enc Encoder) error {
+	switch e := enc.(type) {
+	case multiEncoder:
+		var errs []error
+		for _, enc := range e {
+			errs = append(errs, endDocuments(enc))
+		}
+		return errors.Join(errs...)
+	case documentEncoder:
+		return e.EndDocument()
+	}
+	return nil
+}
+
+// rotateDocument calls swap to replace the writer beneath enc, ending and
+// starting its document around it if it writes one.
+func rotateDocument(enc Encoder, swap func()) error {
+	if de, ok := enc.(documentEncoder); ok {
+		return de.Rotate(swap)
+	}
+	swap()
+	return nil
+}
+
+// multiEncoder writes each message to every encoder, even if some fail.
+type multiEncoder []Encoder
+
+func (me multiEncoder) Encode(v interface{}) error {
+	var errs []error
+	for _, enc := range me {
+		if err := enc.Encode(v); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Outputs writes messages to stdout and -logfile, and to -exec's child.
+type Outputs struct {
+	encoder Encoder // Every output.
+
+	logFile        *os.File    // -logfile, nil if writing to stdout.
+	logFileSink    *syncWriter // Writes to logFile, replaced when it's reopened.
+	logFileEncoder Encoder     // Writes to logFileSink.
+}
+
+// Encode writes v to every output.
+func (o *Outputs) Encode(v interface{}) error {
+	return o.encoder.Encode(v)
+}
+
+// Add writes messages to enc as well.
+func (o *Outputs) Add(enc Encoder) {
+	o.encoder = multiEncoder{o.encoder, enc}
+}
+
+// checkGobStdout returns an error if messages would be written to stdout in
+// gob, whose binary would garble a terminal, without -gobunsafe.
+func checkGobStdout(format string) error {
+	if strings.ToLower(format) == "gob" && !*gobUnsafe {
+		return withStatus(exitUsage, errors.New("-format=gob writes binary, give -logfile or -gobunsafe to write it to stdout"))
+	}
+	return nil
+}
+
+// Setup opens -logfile, given its expanded name, and creates encoders for it
+// and stdout.
+func (o *Outputs) Setup(name string) error {
+	if *logFilename == "/dev/stdout" {
+		if *mirrorStdout {
+			slog.Warn("-stdout has no effect without -logfile")
+		}
+		if err := checkGobStdout(*format); err != nil {
+			return err
+		}
+		enc, err := newEncoder(*format, stdoutWriter{})
+		if err != nil {
+			return withStatus(exitUsage, fmt.Errorf("-format: %w", err))
+		}
+		o.encoder = enc
+		return nil
+	}
+
+	var err error
+	if o.logFile, err = openOutput(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND); err != nil {
+		return withStatus(exitOutput, fmt.Errorf("opening log file: %w", err))
+	}
+	o.logFileSink = &syncWriter{w: o.logFile}
+
+	enc, err := newEncoder(*format, o.logFileSink)
+	if err != nil {
+		return withStatus(exitUsage, fmt.Errorf("-format: %w", err))
+	}
+	o.logFileEncoder = enc
+	encoders := multiEncoder{enc}
+
+	if *mirrorStdout {
+		stdoutFmt := *stdoutFormat
+		if stdoutFmt == "" {
+			stdoutFmt = *format
+		}
+		if err := checkGobStdout(stdoutFmt); err != nil {
+			return err
+		}
+		enc, err := newEncoder(stdoutFmt, stdoutWriter{})
+		if err != nil {
+			return withStatus(exitUsage, fmt.Errorf("-stdout.format: %w", err))
+		}
+		encoders = append(encoders, enc)
+	}
+
+	o.encoder = encoders
+	return nil
+}
+
+// Reopen reopens -logfile by the given name, ending the old file's document
+// before the new file is swapped in.
+func (o *Outputs) Reopen(name string) {
+	if o.logFile == nil {
+		return
+	}
+
+	f, err := reopen(o.logFile, name)
+	if err != nil {
+		slog.Error("reopening log file", "err", err)
+		return
+	}
+	if err := rotateDocument(o.logFileEncoder, func() { o.logFileSink.SetOutput(f) }); err != nil {
+		slog.Error("ending log file document", "err", err)
+	}
+	o.logFile = f
+	logReopened(f)
+}
+
+// Sync syncs -logfile to disk.
+func (o *Outputs) Sync() {
+	if o.logFile == nil {
+		return
+	}
+	if err := o.logFile.Sync(); err != nil {
+		slog.Error("syncing output", "file", o.logFile.Name(), "err", err)
+	}
+}
+
+// Close ends the -format=xml documents, and syncs and closes -logfile.
+func (o *Outputs) Close() {
+	if o.encoder != nil {
+		if err := endDocuments(o.encoder); err != nil {
+			slog.Error("ending output", "err", err)
+		}
+	}
+	o.Sync()
+	if o.logFile != nil {
+		o.logFile.Close()
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	stdcsv "encoding/csv"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bemasher/rtlamr/csv"
+	"github.com/bemasher/rtlamr/parse"
+	"github.com/bemasher/rtlamr/scm"
+)
+
+type failEncoder struct{}
+
+func (failEncoder) Encode(interface{}) error { return errors.New("disk full") }
+
+func TestMultiEncoder(t *testing.T) {
+	type record struct{ ID int }
+
+	var jsonBuf, xmlBuf bytes.Buffer
+	jsonEnc, err := newEncoder("JSON", &jsonBuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xmlEnc, err := newEncoder("xml", &xmlBuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A failing output doesn't keep messages from the others.
+	enc := multiEncoder{failEncoder{}, jsonEnc, xmlEnc}
+	for id := 1; id <= 2; id++ {
+		if err := enc.Encode(record{id}); err == nil || !strings.Contains(err.Error(), "disk full") {
+			t.Fatalf("Expected error from failing output, got %v\n", err)
+		}
+	}
+
+	if recv, expt := jsonBuf.String(), "{\"ID\":1}\n{\"ID\":2}\n"; recv != expt {
+		t.Fatalf("Expected %q got %q\n", expt, recv)
+	}
+	if err := endDocuments(enc); err != nil {
+		t.Fatal(err)
+	}
+	if recv, expt := xmlBuf.String(), xml.Header+"<rtlamr>\n\t<record>\n\t\t<ID>1</ID>\n\t</record>\n\t<record>\n\t\t<ID>2</ID>\n\t</record>\n</rtlamr>\n"; recv != expt {
+		t.Fatalf("Expected %q got %q\n", expt, recv)
+	}
+
+	if _, err := newEncoder("pretty", &jsonBuf); err == nil {
+		t.Fatal("Expected error for unknown format")
+	}
+}
+
+// wellFormed returns an error if doc isn't a single well-formed xml document
+// with a declaration.
+func wellFormed(doc string) error {
+	if !strings.HasPrefix(doc, xml.Header) {
+		return errors.New("missing xml declaration")
+	}
+
+	dec := xml.NewDecoder(strings.NewReader(doc))
+	depth, roots := 0, 0
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		switch tok.(type) {
+		case xml.StartElement:
+			if depth == 0 {
+				roots++
+			}
+			depth++
+		case xml.EndElement:
+			depth--
+		}
+	}
+	if roots != 1 || depth != 0 {
+		return fmt.Errorf("expected one root element, got %d", roots)
+	}
+	return nil
+}
+
+// TestCSVColumns mixes packets passing and failing their checksum, as with
+// -allowbadcrc, and packets with and without optional fields. Every row must
+// have the same columns in the same positions.
+func TestCSVColumns(t *testing.T) {
+	good, bad := true, false
+	delta := int64(5)
+	msgs := []parse.LogMessage{
+		{Message: scm.SCM{ID: 1, Consumption: 10}, ChecksumOK: &good},
+		{Message: scm.SCM{ID: 2, Consumption: 20}, ChecksumOK: &bad, RawHex: "F95300"},
+		{Message: scm.SCM{ID: 1, Consumption: 15}, ChecksumOK: &good, Delta: &delta, MeterName: "house"},
+	}
+	for idx := range msgs {
+		msgs[idx].Time = time.Unix(0, 0).UTC()
+	}
+
+	var buf bytes.Buffer
+	enc := csvEncoder{csv.NewEncoder(&buf), parse.RecordColumns{Delta: true, RawHex: true, ChecksumOK: true, Name: true}}
+	for _, msg := range msgs {
+		if err := enc.Encode(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rows, err := stdcsv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Delta, Rate, RawHex, ChecksumOK, MeterName and Commodity end each row.
+	expt := [][]string{
+		{"", "", "", "true", "", ""},
+		{"", "", "F95300", "false", "", ""},
+		{"5", "", "", "true", "house", ""},
+	}
+	for idx, row := range rows {
+		if len(row) != len(rows[0]) {
+			t.Fatalf("Row %d has %d columns, row 0 has %d\n", idx, len(row), len(rows[0]))
+		}
+		if tail := row[len(row)-6:]; strings.Join(tail, ",") != strings.Join(expt[idx], ",") {
+			t.Fatalf("Row %d: expected %q got %q\n", idx, expt[idx], tail)
+		}
+	}
+}
+
+func TestXMLEncoder(t *testing.T) {
+	type record struct{ ID int }
+
+	t.Run("Empty", func(t *testing.T) {
+		var buf bytes.Buffer
+		enc := newXMLEncoder(&buf, false)
+		if err := enc.EndDocument(); err != nil {
+			t.Fatal(err)
+		}
+		if err := wellFormed(buf.String()); err != nil {
+			t.Fatalf("%s: %q\n", err, buf.String())
+		}
+		if err := enc.Encode(record{1}); err == nil {
+			t.Fatal("Expected error encoding after the document ended")
+		}
+	})
+
+	t.Run("Rotate", func(t *testing.T) {
+		var first, second bytes.Buffer
+		sink := &syncWriter{w: &first}
+		enc := newXMLEncoder(sink, false)
+		if err := enc.Encode(record{1}); err != nil {
+			t.Fatal(err)
+		}
+		if err := rotateDocument(enc, func() { sink.SetOutput(&second) }); err != nil {
+			t.Fatal(err)
+		}
+		if err := enc.Encode(record{2}); err != nil {
+			t.Fatal(err)
+		}
+		if err := endDocuments(multiEncoder{enc}); err != nil {
+			t.Fatal(err)
+		}
+
+		for idx, buf := range []*bytes.Buffer{&first, &second} {
+			if err := wellFormed(buf.String()); err != nil {
+				t.Fatalf("file %d: %s: %q\n", idx, err, buf.String())
+			}
+			if id := fmt.Sprintf("<ID>%d</ID>", idx+1); !strings.Contains(buf.String(), id) {
+				t.Fatalf("Expected file %d to hold %s: %q\n", idx, id, buf.String())
+			}
+		}
+	})
+
+	t.Run("Fragment", func(t *testing.T) {
+		var buf bytes.Buffer
+		enc := newXMLEncoder(&buf, true)
+		for id := 1; id <= 2; id++ {
+			if err := enc.Encode(record{id}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := enc.EndDocument(); err != nil {
+			t.Fatal(err)
+		}
+		if recv, expt := buf.String(), "<record><ID>1</ID></record>\n<record><ID>2</ID></record>\n"; recv != expt {
+			t.Fatalf("Expected %q got %q\n", expt, recv)
+		}
+	})
+}
+
+func TestXMLDocumentOnExit(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping xml exit tests in short mode")
+	}
+
+	server := fakeRTLTCP(t, scmSignal(t))
+
+	for _, tc := range []struct {
+		name string
+		args []string
+	}{
+		{"Duration", []string{"-duration=1s"}},
+		{"MsgLimit", []string{"-msglimit=2", "-duration=10s"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			name := filepath.Join(t.TempDir(), "messages.xml")
+			args := append([]string{"-summary=false", "-format=xml", "-server=" + server, "-logfile=" + name}, tc.args...)
+			if status := runRtlamr(t, nil, args...); status != exitOK {
+				t.Fatalf("Expected status %d, got %d\n", exitOK, status)
+			}
+
+			doc, err := os.ReadFile(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := wellFormed(string(doc)); err != nil {
+				t.Fatalf("%s: %q\n", err, doc)
+			}
+			if !strings.Contains(string(doc), "<LogMessage>") {
+				t.Fatalf("Expected messages in %q\n", doc)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package parse
+
+import "fmt"
+
+// BlockDecoder decodes a stream of samples into messages. Samples are
+// interleaved 8-bit unsigned inphase and quadrature pairs, as delivered by
+// rtl_tcp, sampled at SampleRate() and tuned to CenterFreq().
+//
+// Packets may span blocks, so the decoder keeps the end of each block to
+// decode along with the next. Blocks must be successive; call Reset after a
+// discontinuity such as dropped samples or retuning so packets aren't pieced
+// together from unrelated signal. A packet is returned once the block
+// completing it has been decoded, possibly a block later. A BlockDecoder
+// isn't safe for concurrent use.
+type BlockDecoder struct {
+	newParser                NewParserFunc
+	symbolLength, decimation int
+	allowBadCRC              bool
+
+	p       Parser
+	pending []byte
+}
+
+// NewBlockDecoder returns a decoder for the named message type, which must
+// be registered by importing its package, such as
+// github.com/bemasher/rtlamr/scm. symbolLength is in samples, rtlamr's default
+// is 72, and every decimation'th sample is kept. Unsupported combinations
+// return a *ConfigError, as from NewParser.
+func NewBlockDecoder(name string, symbolLength, decimation int) (*BlockDecoder, error) {
+	parserMutex.Lock()
+	r, err := validate(name, symbolLength, decimation)
+	parserMutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	bd := &BlockDecoder{
+		newParser:    r.fn,
+		symbolLength: symbolLength,
+		decimation:   decimation,
+		allowBadCRC:  AllowBadCRC,
+	}
+	bd.Reset()
+
+	return bd, nil
+}
+
+// BlockSize returns the length in bytes of the blocks Decode accepts.
+func (bd *BlockDecoder) BlockSize() int {
+	return bd.p.Cfg().BlockSize2
+}
+
+// SampleRate returns the rate in samples per second the decoder expects.
+func (bd *BlockDecoder) SampleRate() int {
+	return bd.p.Cfg().SampleRate
+}
+
+// CenterFreq returns the frequency in Hz the samples should be tuned to.
+func (bd *BlockDecoder) CenterFreq() uint32 {
+	return bd.p.Cfg().CenterFreq
+}
+
+// SetAllowBadCRC sets whether packets failing their checksum are returned,
+// if the message type's parser supports it. See AllowBadCRC.
+func (bd *BlockDecoder) SetAllowBadCRC(allow bool) {
+	bd.allowBadCRC = allow
+	if s, ok := bd.p.(BadCRCSetter); ok {
+		s.SetAllowBadCRC(allow)
+	}
+}
+
+// Decode decodes the next block of samples, which must be BlockSize() bytes
+// long, and returns the messages found.
+func (bd *BlockDecoder) Decode(block []byte) ([]Message, error) {
+	if len(block) != bd.BlockSize() {
+		return nil, fmt.Errorf("block is %d bytes, expected %d", len(block), bd.BlockSize())
+	}
+	if len(bd.pending) != 0 {
+		return nil, fmt.Errorf("%d bytes are pending from Write, finish the block with Write", len(bd.pending))
+	}
+
+	return bd.p.Parse(bd.p.Dec().Decode(block)), nil
+}
+
+// Write decodes samples of any length, holding a partial block until the
+// next call completes it, and returns the messages found.
+func (bd *BlockDecoder) Write(samples []byte) (msgs []Message) {
+	blockSize := bd.BlockSize()
+	for len(samples) != 0 {
+		n := copy(bd.pending[len(bd.pending):blockSize], samples)
+		bd.pending = bd.pending[:len(bd.pending)+n]
+		samples = samples[n:]
+
+		if len(bd.pending) == blockSize {
+			msgs = append(msgs, bd.p.Parse(bd.p.Dec().Decode(bd.pending))...)
+			bd.pending = bd.pending[:0]
+		}
+	}
+
+	return msgs
+}
+
+// Reset discards samples carried over from previous blocks, including a
+// partial block held by Write, and any state kept across packets.
+func (bd *BlockDecoder) Reset() {
+	bd.p = bd.newParser(bd.symbolLength, bd.decimation)
+	bd.pending = make([]byte, 0, bd.BlockSize())
+	bd.SetAllowBadCRC(bd.allowBadCRC)
+}
@@ -0,0 +1,145 @@
+package parse_test
+
+import (
+	"fmt"
+	"log"
+	"testing"
+
+	"github.com/bemasher/rtlamr/crc"
+	"github.com/bemasher/rtlamr/gen"
+	"github.com/bemasher/rtlamr/parse"
+
+	_ "github.com/bemasher/rtlamr/scm"
+)
+
+// scmSamples returns samples of an SCM packet from the given meter, preceded
+// and followed by samples without any signal, padded to a whole number of
+// blocks.
+func scmSamples(bd *parse.BlockDecoder, id uint32, consumption uint32) []byte {
+	pkt := []byte{
+		0xF9, 0x53, byte(id>>24&0x03) << 3,
+		0, byte(consumption >> 16), byte(consumption >> 8), byte(consumption),
+		byte(id >> 16), byte(id >> 8), byte(id),
+		0, 0,
+	}
+	checksum := crc.BCH(crc.BCHPoly, pkt[2:10])
+	pkt[10], pkt[11] = byte(checksum>>8), byte(checksum)
+
+	bits := gen.Upsample(gen.UnpackBits(gen.NewManchesterLUT().Encode(pkt)), 72<<1)
+	carrier := gen.CmplxOscillatorF64(len(bits)>>1, 10e3, float64(bd.SampleRate()))
+	for idx := range carrier {
+		carrier[idx] *= float64(bits[idx])
+	}
+
+	samples := make([]byte, bd.BlockSize()+len(carrier))
+	gen.F64toU8(carrier, samples[bd.BlockSize():])
+	samples = append(samples, make([]byte, 2*bd.BlockSize()-len(samples)%bd.BlockSize())...)
+	for idx := range samples[:bd.BlockSize()] {
+		samples[idx] = 127
+	}
+	for idx := bd.BlockSize() + len(carrier); idx < len(samples); idx++ {
+		samples[idx] = 127
+	}
+
+	return samples
+}
+
+func ExampleBlockDecoder() {
+	bd, err := parse.NewBlockDecoder("scm", 72, 1)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	samples := scmSamples(bd, 12345678, 1000)
+	for len(samples) != 0 {
+		msgs, err := bd.Decode(samples[:bd.BlockSize()])
+		if err != nil {
+			log.Fatal(err)
+		}
+		samples = samples[bd.BlockSize():]
+
+		for _, msg := range msgs {
+			fmt.Println(msg.MsgType(), msg.MeterID(), msg.MeterConsumption())
+		}
+	}
+
+	// Output:
+	// SCM 12345678 1000
+}
+
+func TestBlockDecoderWrite(t *testing.T) {
+	bd, err := parse.NewBlockDecoder("scm", 72, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	samples := append(scmSamples(bd, 1111, 1), scmSamples(bd, 2222, 2)...)
+
+	// Odd-sized writes, splitting samples within a pair.
+	var ids []uint32
+	for len(samples) != 0 {
+		n := 1001
+		if n > len(samples) {
+			n = len(samples)
+		}
+		for _, msg := range bd.Write(samples[:n]) {
+			ids = append(ids, msg.MeterID())
+		}
+		samples = samples[n:]
+	}
+
+	if fmt.Sprint(ids) != "[1111 2222]" {
+		t.Errorf("decoded %v, want [1111 2222]", ids)
+	}
+}
+
+func TestBlockDecoderReset(t *testing.T) {
+	bd, err := parse.NewBlockDecoder("scm", 72, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	samples := scmSamples(bd, 12345678, 1000)
+
+	// Resetting partway through the packet discards its beginning.
+	half := len(samples) / bd.BlockSize() / 2 * bd.BlockSize()
+	if msgs := bd.Write(samples[:half]); len(msgs) != 0 {
+		t.Fatalf("decoded %d messages from half a packet", len(msgs))
+	}
+	bd.Reset()
+	if msgs := bd.Write(samples[half:]); len(msgs) != 0 {
+		t.Errorf("decoded %d messages across a reset", len(msgs))
+	}
+
+	// The decoder is usable again.
+	if msgs := bd.Write(samples); len(msgs) != 1 {
+		t.Errorf("decoded %d messages after the reset, want 1", len(msgs))
+	}
+}
+
+func TestBlockDecoderValidation(t *testing.T) {
+	for _, tc := range []struct {
+		name                     string
+		symbolLength, decimation int
+	}{
+		{"bogus", 72, 1},
+		{"scm", 0, 1},
+		{"scm", 72, 0},
+		{"scm", 72, 32},
+	} {
+		if _, err := parse.NewBlockDecoder(tc.name, tc.symbolLength, tc.decimation); err == nil {
+			t.Errorf("NewBlockDecoder(%q, %d, %d) succeeded", tc.name, tc.symbolLength, tc.decimation)
+		}
+	}
+
+	bd, err := parse.NewBlockDecoder("scm", 72, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bd.Decode(make([]byte, bd.BlockSize()-1)); err == nil {
+		t.Error("Decode accepted a short block")
+	}
+	bd.Write(make([]byte, 10))
+	if _, err := bd.Decode(make([]byte, bd.BlockSize())); err == nil {
+		t.Error("Decode accepted a block while Write held a partial one")
+	}
+}
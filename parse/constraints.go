@@ -0,0 +1,224 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package parse
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Constraints are the symbol lengths and decimations a parser decodes with,
+// declared when it's registered. Symbol lengths are in samples per chip, as
+// given by -symbollength, at the message type's data rate.
+type Constraints struct {
+	// SymbolLengths are inclusive ranges of supported symbol lengths.
+	SymbolLengths [][2]int
+
+	// MinChipLength is the fewest samples per chip left after decimation.
+	MinChipLength int
+
+	// WholeChips requires decimation to divide the chip length, for parsers
+	// whose filters span single chips. Otherwise decimation must divide the
+	// length of a symbol of two chips.
+	WholeChips bool
+}
+
+// DefaultConstraints suit parsers of 32768 chip per second messages sampled
+// within the rtl-sdr's bands of 225 to 300 kS/s and 0.9 to 3.2 MS/s, 7 to 9
+// and 28 to 97 samples per chip. Fewer than 3 samples per chip after
+// decimation don't decode reliably.
+var DefaultConstraints = Constraints{
+	SymbolLengths: [][2]int{{7, 9}, {28, 97}},
+	MinChipLength: 3,
+}
+
+// valid reports whether the constraints can be satisfied at all.
+func (c Constraints) valid() bool {
+	for _, r := range c.SymbolLengths {
+		if r[0] < 1 || r[1] < r[0] {
+			return false
+		}
+	}
+	return len(c.SymbolLengths) > 0 && c.MinChipLength > 0
+}
+
+// supported reports whether symbolLength is in one of the supported ranges.
+func (c Constraints) supported(symbolLength int) bool {
+	for _, r := range c.SymbolLengths {
+		if r[0] <= symbolLength && symbolLength <= r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// nearest returns the supported symbol length nearest to symbolLength,
+// preferring the shorter of two as near.
+func (c Constraints) nearest(symbolLength int) (nearest int) {
+	distance := -1
+	for _, r := range c.SymbolLengths {
+		sl := min(max(symbolLength, r[0]), r[1])
+		if d := max(sl-symbolLength, symbolLength-sl); distance < 0 || d < distance || d == distance && sl < nearest {
+			nearest, distance = sl, d
+		}
+	}
+	return nearest
+}
+
+// ranges describes the supported symbol lengths, as "7 to 9 and 28 to 97".
+func (c Constraints) ranges() string {
+	var ranges []string
+	for _, r := range c.SymbolLengths {
+		if r[0] == r[1] {
+			ranges = append(ranges, fmt.Sprint(r[0]))
+		} else {
+			ranges = append(ranges, fmt.Sprintf("%d to %d", r[0], r[1]))
+		}
+	}
+	if len(ranges) < 2 {
+		return strings.Join(ranges, "")
+	}
+	return strings.Join(ranges[:len(ranges)-1], ", ") + " and " + ranges[len(ranges)-1]
+}
+
+// check returns why a message can't be decoded at symbolLength and
+// decimation, or "" if it can.
+func (c Constraints) check(symbolLength, decimation int) string {
+	if !c.supported(symbolLength) {
+		return fmt.Sprintf("symbol lengths %s are supported", c.ranges())
+	}
+	if decimation < 1 {
+		return "decimation must be at least 1"
+	}
+
+	unit, unitName := symbolLength<<1, "symbol"
+	if c.WholeChips {
+		unit, unitName = symbolLength, "chip"
+	}
+
+	switch {
+	case unit%decimation != 0:
+		return fmt.Sprintf("decimation must divide the %s length of %d samples", unitName, unit)
+	case symbolLength/decimation < c.MinChipLength:
+		return fmt.Sprintf("decimation leaves %d samples per chip, at least %d are needed", symbolLength/decimation, c.MinChipLength)
+	}
+	return ""
+}
+
+// decimations returns the decimations supported at symbolLength.
+func (c Constraints) decimations(symbolLength int) (ds []int) {
+	for d := 1; d <= symbolLength; d++ {
+		if c.check(symbolLength, d) == "" {
+			ds = append(ds, d)
+		}
+	}
+	return ds
+}
+
+// suggest returns supported combinations near symbolLength and decimation:
+// the largest decimation up to the one given at the nearest supported symbol
+// length, and the nearest symbol length supporting the decimation given.
+func (c Constraints) suggest(symbolLength, decimation int) (suggestions [][2]int) {
+	nearest := c.nearest(symbolLength)
+	best := 1
+	for _, d := range c.decimations(nearest) {
+		if d <= decimation {
+			best = d
+		}
+	}
+	suggestions = append(suggestions, [2]int{nearest, best})
+	if best == decimation {
+		return suggestions
+	}
+
+	longest := 0
+	for _, r := range c.SymbolLengths {
+		longest = max(longest, r[1])
+	}
+	for offset := 1; offset <= longest; offset++ {
+		for _, sl := range []int{nearest - offset, nearest + offset} {
+			if c.check(sl, decimation) == "" {
+				return append(suggestions, [2]int{sl, decimation})
+			}
+		}
+	}
+	return suggestions
+}
+
+// ConfigError reports a symbol length and decimation a message type can't be
+// decoded with, and nearby combinations which it can.
+type ConfigError struct {
+	MsgType                  string
+	SymbolLength, Decimation int
+	Reason                   string
+
+	// Suggestions are supported symbol length and decimation pairs.
+	Suggestions [][2]int
+}
+
+func (e *ConfigError) Error() string {
+	var suggestions []string
+	for _, s := range e.Suggestions {
+		suggestions = append(suggestions, fmt.Sprintf("symbol length %d with decimation %d", s[0], s[1]))
+	}
+	return fmt.Sprintf("%s can't decode symbol length %d with decimation %d: %s, try %s",
+		e.MsgType, e.SymbolLength, e.Decimation, e.Reason, strings.Join(suggestions, " or "),
+	)
+}
+
+// Validate returns a *ConfigError if the registered message type name can't
+// be decoded with the given symbol length and decimation.
+func Validate(name string, symbolLength, decimation int) error {
+	parserMutex.Lock()
+	defer parserMutex.Unlock()
+
+	_, err := validate(name, symbolLength, decimation)
+	return err
+}
+
+// Decimations returns the decimations the registered message type name
+// supports at symbolLength, none if it doesn't support the symbol length.
+func Decimations(name string, symbolLength int) ([]int, error) {
+	parserMutex.Lock()
+	defer parserMutex.Unlock()
+
+	r, exists := parsers[name]
+	if !exists {
+		return nil, fmt.Errorf("invalid message type: %q", name)
+	}
+	return r.constraints.decimations(symbolLength), nil
+}
+
+// validate is Validate with parserMutex held, returning the registration.
+func validate(name string, symbolLength, decimation int) (registration, error) {
+	r, exists := parsers[name]
+	if !exists {
+		return r, fmt.Errorf("invalid message type: %q", name)
+	}
+
+	c := r.constraints
+	if reason := c.check(symbolLength, decimation); reason != "" {
+		return r, &ConfigError{
+			MsgType:      name,
+			SymbolLength: symbolLength,
+			Decimation:   decimation,
+			Reason:       reason,
+			Suggestions:  c.suggest(symbolLength, decimation),
+		}
+	}
+	return r, nil
+}
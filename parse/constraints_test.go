@@ -0,0 +1,93 @@
+package parse
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestConstraintsCheck(t *testing.T) {
+	wholeChips := DefaultConstraints
+	wholeChips.WholeChips = true
+
+	for _, tc := range []struct {
+		c                        Constraints
+		symbolLength, decimation int
+		ok                       bool
+	}{
+		{DefaultConstraints, 72, 1, true},
+		{DefaultConstraints, 72, 16, true},
+		{DefaultConstraints, 7, 1, true},
+		{DefaultConstraints, 9, 2, true},
+		{DefaultConstraints, 10, 1, false},
+		{DefaultConstraints, 28, 1, true},
+		{DefaultConstraints, 97, 1, true},
+		{DefaultConstraints, 27, 1, false},
+		{DefaultConstraints, 98, 1, false},
+		{DefaultConstraints, 72, 0, false},
+		{DefaultConstraints, 72, 3, true},
+		{DefaultConstraints, 72, 12, true},
+		{DefaultConstraints, 72, 5, false},
+		{DefaultConstraints, 72, 32, false},
+		{DefaultConstraints, 36, 8, true},
+		{DefaultConstraints, 36, 16, false},
+		{DefaultConstraints, 73, 2, true},
+		{wholeChips, 73, 2, false},
+		{wholeChips, 72, 8, true},
+		{wholeChips, 72, 16, false},
+	} {
+		reason := tc.c.check(tc.symbolLength, tc.decimation)
+		if ok := reason == ""; ok != tc.ok {
+			t.Errorf("%+v.check(%d, %d) = %q", tc.c, tc.symbolLength, tc.decimation, reason)
+		}
+	}
+}
+
+func TestConstraintsSuggest(t *testing.T) {
+	for _, tc := range []struct {
+		symbolLength, decimation int
+		want                     [][2]int
+	}{
+		{1, 1, [][2]int{{7, 1}}},
+		{10, 1, [][2]int{{9, 1}}},
+		{20, 1, [][2]int{{28, 1}}},
+		{8, 4, [][2]int{{8, 2}, {28, 4}}},
+		{72, 5, [][2]int{{72, 4}, {70, 5}}},
+		{72, 32, [][2]int{{72, 24}, {96, 32}}},
+		{500, 4, [][2]int{{97, 2}, {96, 4}}},
+		{72, 0, [][2]int{{72, 1}}},
+	} {
+		got := DefaultConstraints.suggest(tc.symbolLength, tc.decimation)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("suggest(%d, %d) = %v, want %v", tc.symbolLength, tc.decimation, got, tc.want)
+		}
+	}
+}
+
+func TestConstraintsRanges(t *testing.T) {
+	if got, want := DefaultConstraints.ranges(), "7 to 9 and 28 to 97"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	c := Constraints{SymbolLengths: [][2]int{{8, 8}, {16, 16}, {32, 64}}}
+	if got, want := c.ranges(), "8, 16 and 32 to 64"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestRegisterConstraints(t *testing.T) {
+	newParser := func(int, int) Parser { return nil }
+	for _, c := range []Constraints{
+		{},
+		{SymbolLengths: [][2]int{{28, 27}}, MinChipLength: 3},
+		{SymbolLengths: [][2]int{{0, 97}}, MinChipLength: 3},
+		{SymbolLengths: [][2]int{{28, 97}}},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Register accepted %+v", c)
+				}
+			}()
+			Register("constraints test", newParser, c)
+		}()
+	}
+}
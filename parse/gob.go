@@ -0,0 +1,123 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package parse
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+)
+
+func init() {
+	gob.RegisterName("LogMessage", LogMessage{})
+}
+
+// maxGobRecord bounds the length of a gob record so a corrupt length doesn't
+// exhaust memory.
+const maxGobRecord = 1 << 20
+
+// GobRecord frames each value written with -format=gob. Type names the
+// value's type, the MsgType of messages or the name of other types such as
+// Alert, and Value holds it. Message types
+// are registered with gob by their packages under their MsgType, so readers
+// must import the packages of the types they decode.
+type GobRecord struct {
+	Type  string
+	Value interface{}
+}
+
+// GobEncoder writes values as gob records. Each record is prefixed by its
+// length as a uvarint and is a gob stream of its own, type definitions
+// included, so streams mixing message types, appended to by several runs or
+// reopened mid-run decode the same way. Only exported fields are written, so
+// decoded messages lack their raw packets.
+type GobEncoder struct {
+	w   io.Writer
+	buf bytes.Buffer
+}
+
+func NewGobEncoder(w io.Writer) *GobEncoder {
+	return &GobEncoder{w: w}
+}
+
+// Encode writes v as a single record.
+func (ge *GobEncoder) Encode(v interface{}) error {
+	record := GobRecord{Type: reflect.TypeOf(v).Name(), Value: v}
+	if msg, ok := v.(LogMessage); ok && msg.Message != nil {
+		record.Type = msg.MsgType()
+	}
+
+	ge.buf.Reset()
+	if err := gob.NewEncoder(&ge.buf).Encode(record); err != nil {
+		return err
+	}
+
+	// Written at once so a record is never split between writes.
+	length := binary.AppendUvarint(nil, uint64(ge.buf.Len()))
+	_, err := ge.w.Write(append(length, ge.buf.Bytes()...))
+	return err
+}
+
+// GobReader reads the records written by GobEncoder.
+type GobReader struct {
+	r *bufio.Reader
+}
+
+func NewGobReader(r io.Reader) *GobReader {
+	return &GobReader{bufio.NewReader(r)}
+}
+
+// Read returns the next record, or io.EOF at the end of the stream. A stream
+// ending part way through a record, such as one still being written, returns
+// io.ErrUnexpectedEOF. A record of a type which isn't registered returns an
+// error, but the next Read continues with the following record.
+func (gr *GobReader) Read() (record GobRecord, err error) {
+	length, err := binary.ReadUvarint(gr.r)
+	if err == io.EOF {
+		return record, io.EOF
+	}
+	if err != nil {
+		return record, fmt.Errorf("reading gob record length: %w", noEOF(err))
+	}
+	if length > maxGobRecord {
+		return record, fmt.Errorf("gob record of %d bytes exceeds %d", length, maxGobRecord)
+	}
+
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(gr.r, buf); err != nil {
+		return record, fmt.Errorf("reading gob record: %w", noEOF(err))
+	}
+
+	if err := gob.NewDecoder(bytes.NewReader(buf)).Decode(&record); err != nil {
+		return record, fmt.Errorf("decoding gob record: %w", err)
+	}
+	return record, nil
+}
+
+// noEOF returns io.ErrUnexpectedEOF in place of io.EOF, for streams ending
+// within a record.
+func noEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,107 @@
+package parse
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type otherMessage struct {
+	ID   uint32
+	Name string
+}
+
+func (m otherMessage) MsgType() string          { return "Other" }
+func (m otherMessage) MeterID() uint32          { return m.ID }
+func (m otherMessage) MeterType() uint8         { return 0 }
+func (m otherMessage) MeterConsumption() uint32 { return 0 }
+func (m otherMessage) Checksum() []byte         { return nil }
+func (m otherMessage) ChecksumOK() bool         { return true }
+func (m otherMessage) Raw() []byte              { return nil }
+func (m otherMessage) Record() []string         { return nil }
+
+func init() {
+	gob.RegisterName("Test", testMessage{})
+	gob.RegisterName("Other", otherMessage{})
+}
+
+func TestGobRoundTrip(t *testing.T) {
+	scaled := 1.5
+	now := time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC)
+	msgs := []LogMessage{
+		{Time: now, Offset: 1, Length: 2, Message: testMessage{1}},
+		{Time: now, ScaledConsumption: &scaled, Unit: "kWh", Message: otherMessage{2, "garage"}},
+		{Time: now, Message: testMessage{3}},
+	}
+
+	// Two runs appending to the same log, each with its own encoder.
+	var buf bytes.Buffer
+	for _, batch := range [][]LogMessage{msgs[:2], msgs[2:]} {
+		enc := NewGobEncoder(&buf)
+		for _, msg := range batch {
+			if err := enc.Encode(msg); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	r := NewGobReader(&buf)
+	for _, expt := range msgs {
+		record, err := r.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if record.Type != expt.MsgType() {
+			t.Fatalf("Expected type %s got %s\n", expt.MsgType(), record.Type)
+		}
+		if !reflect.DeepEqual(record.Value, expt) {
+			t.Fatalf("Expected %+v got %+v\n", expt, record.Value)
+		}
+	}
+	if _, err := r.Read(); err != io.EOF {
+		t.Fatalf("Expected io.EOF got %v\n", err)
+	}
+}
+
+func TestGobReaderErrors(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewGobEncoder(&buf)
+	if err := enc.Encode(LogMessage{Message: testMessage{1}}); err != nil {
+		t.Fatal(err)
+	}
+	buf.Write(append(binary.AppendUvarint(nil, 7), "garbage"...))
+	if err := enc.Encode(LogMessage{Message: testMessage{3}}); err != nil {
+		t.Fatal(err)
+	}
+	complete := buf.Len()
+	if err := enc.Encode(LogMessage{Message: testMessage{4}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The last record is cut short, as if still being written.
+	r := NewGobReader(bytes.NewReader(buf.Bytes()[:complete+5]))
+	if _, err := r.Read(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A record which fails to decode doesn't lose those following it.
+	if _, err := r.Read(); err == nil {
+		t.Fatal("Expected error decoding a corrupt record")
+	}
+	record, err := r.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := record.Value.(LogMessage).MeterID(); id != 3 {
+		t.Fatalf("Expected meter 3 got %d\n", id)
+	}
+
+	if _, err := r.Read(); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Expected io.ErrUnexpectedEOF got %v\n", err)
+	}
+}
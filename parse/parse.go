@@ -1,9 +1,13 @@
 package parse
 
 import (
+	"encoding/json"
 	"fmt"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/bemasher/rtlamr/decode"
@@ -13,37 +17,139 @@ import (
 
 const (
 	TimeFormat = "2006-01-02T15:04:05.000"
+
+	// SchemaVersion is bumped whenever the fields of LogMessage or any
+	// message type, or the columns of their csv records, change.
+	SchemaVersion = 8
 )
 
 var (
 	parserMutex sync.Mutex
-	parsers     = make(map[string]NewParserFunc)
+	parsers     = make(map[string]registration)
 )
 
+// registration is a registered parser and the configurations it supports.
+type registration struct {
+	fn          NewParserFunc
+	constraints Constraints
+}
+
+// AllowBadCRC causes parsers to also return packets which matched the
+// preamble and length but failed their checksum. Failed packets are only
+// returned from blocks in which no packet passed.
+var AllowBadCRC bool
+
+// BadCRCSetter is implemented by parsers which can keep packets failing
+// their checksum independently of AllowBadCRC, so parsers sharing a process
+// needn't agree. Parsers take AllowBadCRC's value when created.
+type BadCRCSetter interface {
+	SetAllowBadCRC(allow bool)
+}
+
+// Candidate describes how far the packet at a preamble candidate got
+// through parsing, for -debugcandidates.
+type Candidate struct {
+	// Stop names the check the packet failed: length, symbol, checksum, id
+	// or protocol. Blank if the packet parsed.
+	Stop string
+
+	// Transmitted and expected checksums in hex, blank if the packet
+	// stopped before its checksum was checked.
+	Checksum, Expected string
+}
+
+// Diagnoser is implemented by parsers which can explain why the packet at a
+// preamble candidate did or didn't parse. Diagnose follows Parse of the
+// block the candidate was found in and doesn't change the parser's state.
+type Diagnoser interface {
+	Diagnose(idx int) Candidate
+}
+
 type NewParserFunc func(symbolLength, decimation int) Parser
 
-func Register(name string, parserFn NewParserFunc) {
+// Register makes a parser available by name, decoding the symbol lengths and
+// decimations c allows. Parsers must declare their constraints, most will use
+// DefaultConstraints.
+func Register(name string, parserFn NewParserFunc, c Constraints) {
 	parserMutex.Lock()
 	defer parserMutex.Unlock()
 
 	if parserFn == nil {
 		panic("parser: new parser func is nil")
 	}
+	if !c.valid() {
+		panic(fmt.Sprintf("parser: invalid constraints (%s): %+v", name, c))
+	}
 	if _, dup := parsers[name]; dup {
 		panic(fmt.Sprintf("parser: parser already registered (%s)", name))
 	}
-	parsers[name] = parserFn
+	parsers[name] = registration{parserFn, c}
+}
+
+// Names returns the names of all registered parsers in sorted order.
+func Names() (names []string) {
+	parserMutex.Lock()
+	defer parserMutex.Unlock()
+
+	for name := range parsers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return
 }
 
+// NewParser returns a parser for the registered message type name. A
+// *ConfigError is returned if it can't decode the symbol length and
+// decimation given.
 func NewParser(name string, symbolLength, decimation int) (Parser, error) {
 	parserMutex.Lock()
 	defer parserMutex.Unlock()
 
-	if parserFn, exists := parsers[name]; exists {
-		return parserFn(symbolLength, decimation), nil
-	} else {
-		return nil, fmt.Errorf("invalid message type: %q\n", name)
+	r, err := validate(name, symbolLength, decimation)
+	if err != nil {
+		return nil, err
+	}
+	return r.fn(symbolLength, decimation), nil
+}
+
+// NewParsers returns a parser for each message type in the comma separated
+// list names, to be decoded from the same samples. The message types must
+// share a center frequency and sample rate, as listed by listmsgtypes.
+func NewParsers(names string, symbolLength, decimation int) ([]Parser, error) {
+	var ps []Parser
+	var first string
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if seen[name] {
+			return nil, fmt.Errorf("message type %s given twice", name)
+		}
+		seen[name] = true
+
+		p, err := NewParser(name, symbolLength, decimation)
+		if err != nil {
+			return nil, err
+		}
+		if len(ps) == 0 {
+			first = name
+		} else if a, b := ps[0].Cfg(), p.Cfg(); a.CenterFreq != b.CenterFreq || a.SampleRate != b.SampleRate {
+			return nil, fmt.Errorf("%s and %s can't be decoded together, %s is received at %d Hz and %d S/s and %s at %d Hz and %d S/s",
+				first, name, first, a.CenterFreq, a.SampleRate, name, b.CenterFreq, b.SampleRate)
+		}
+		ps = append(ps, p)
 	}
+	return ps, nil
+}
+
+// Config returns the packet configuration of the registered message type
+// name for the given symbol length, without decimation.
+func Config(name string, symbolLength int) (decode.PacketConfig, error) {
+	p, err := NewParser(name, symbolLength, 1)
+	if err != nil {
+		return decode.PacketConfig{}, err
+	}
+	return *p.Cfg(), nil
 }
 
 type Data struct {
@@ -60,12 +166,15 @@ func NewDataFromBytes(data []byte) (d Data) {
 	return
 }
 
+// NewDataFromBits packs a string of 0s and 1s into bytes. A final partial
+// byte is padded with zeros on the right.
 func NewDataFromBits(data string) (d Data) {
 	d.Bits = data
 	d.Bytes = make([]byte, (len(data)+7)>>3)
-	for idx := 0; idx < len(data); idx += 8 {
-		b, _ := strconv.ParseUint(d.Bits[idx:idx+8], 2, 8)
-		d.Bytes[idx>>3] = uint8(b)
+	for idx := 0; idx < len(data); idx++ {
+		if data[idx] == '1' {
+			d.Bytes[idx>>3] |= 0x80 >> uint(idx&7)
+		}
 	}
 	return
 }
@@ -82,47 +191,404 @@ type Message interface {
 	MsgType() string
 	MeterID() uint32
 	MeterType() uint8
+	MeterConsumption() uint32
 	Checksum() []byte
+	ChecksumOK() bool
+
+	// Raw returns the packet as sampled from the quantized signal, preamble
+	// through checksum.
+	Raw() []byte
+}
+
+// FlagReporter is implemented by messages carrying tamper, leak or other
+// status indications. Flags maps the name of each indication to its value,
+// zero when not indicated.
+type FlagReporter interface {
+	Flags() map[string]uint
+}
+
+// Value is a message field, either a number or a string. Booleans are 1 or
+// 0.
+type Value struct {
+	Num      float64
+	Str      string
+	IsString bool
+}
+
+// Num returns a numeric Value.
+func Num(n float64) Value {
+	return Value{Num: n}
+}
+
+// Bool returns 1 for true and 0 for false.
+func Bool(b bool) Value {
+	if b {
+		return Value{Num: 1}
+	}
+	return Value{}
+}
+
+// FieldReporter is implemented by messages exposing their fields by name to
+// filter expressions. Field must not allocate.
+type FieldReporter interface {
+	Field(name string) (Value, bool)
 }
 
 type LogMessage struct {
 	Time   time.Time
 	Offset int64
 	Length int
+
+	// Identify the output format and the receiver which produced it.
+	SchemaVersion int    `json:",omitempty" xml:",omitempty"`
+	ReceiverID    string `json:",omitempty" xml:",omitempty"`
+	Commit        string `json:",omitempty" xml:",omitempty"`
+
+	// Where the packet was received: tuner configuration and the source of
+	// samples.
+	CenterFreq uint32 `json:",omitempty" xml:",omitempty"`
+	SampleRate int    `json:",omitempty" xml:",omitempty"`
+	Backend    string `json:",omitempty" xml:",omitempty"`
+
+	// Consumption scaled to commodity units, only present for meters with a
+	// known multiplier.
+	ScaledConsumption *float64 `json:",omitempty" xml:",omitempty"`
+	Unit              string   `json:",omitempty" xml:",omitempty"`
+
+	// Change in raw consumption since the meter's previous reading and the
+	// rate of change in units per hour, only present with -delta.
+	Delta *int64   `json:",omitempty" xml:",omitempty"`
+	Rate  *float64 `json:",omitempty" xml:",omitempty"`
+
+	RawHex     string `json:",omitempty" xml:",omitempty"`
+	ChecksumOK *bool  `json:",omitempty" xml:",omitempty"`
+
+	// Whether an IDM packet agrees with the previous packet from the same
+	// meter, only present with -idm.consistent.
+	Consistent *bool `json:",omitempty" xml:",omitempty"`
+
+	// Name and commodity of meters given by -aliases.
+	MeterName string `json:",omitempty" xml:",omitempty"`
+	Commodity string `json:",omitempty" xml:",omitempty"`
+
+	// Set if the system clock wasn't synchronized, see -waitforclock.
+	TimeSuspect bool `json:",omitempty" xml:",omitempty"`
+
 	Message
 }
 
+// MarshalJSON writes the envelope's fields along with MsgType, naming the
+// type of Message, so consumers can tell payloads apart without inspecting
+// their fields.
+func (msg LogMessage) MarshalJSON() ([]byte, error) {
+	// logMessage drops LogMessage's methods, MarshalJSON included.
+	type logMessage LogMessage
+
+	var msgType string
+	if msg.Message != nil {
+		msgType = msg.MsgType()
+	}
+
+	return json.Marshal(struct {
+		MsgType string `json:",omitempty"`
+		logMessage
+	}{msgType, logMessage(msg)})
+}
+
 func (msg LogMessage) String() string {
-	return fmt.Sprintf("{Time:%s Offset:%d Length:%d %s:%s}",
-		msg.Time.Format(TimeFormat), msg.Offset, msg.Length, msg.MsgType(), msg.Message,
-	)
+	return msg.format(true)
 }
 
 func (msg LogMessage) StringNoOffset() string {
-	return fmt.Sprintf("{Time:%s %s:%s}", msg.Time.Format(TimeFormat), msg.MsgType(), msg.Message)
+	return msg.format(false)
 }
 
-func (msg LogMessage) Record() (r []string) {
+func (msg LogMessage) format(offset bool) string {
+	fields := []string{"Time:" + msg.Time.Format(TimeFormat)}
+	if offset {
+		fields = append(fields, fmt.Sprintf("Offset:%d Length:%d", msg.Offset, msg.Length))
+	}
+	if msg.SchemaVersion != 0 {
+		fields = append(fields, fmt.Sprintf("SchemaVersion:%d", msg.SchemaVersion))
+	}
+	if msg.ReceiverID != "" {
+		fields = append(fields, "ReceiverID:"+msg.ReceiverID)
+	}
+	if msg.Commit != "" {
+		fields = append(fields, "Commit:"+msg.Commit)
+	}
+	if msg.CenterFreq != 0 {
+		fields = append(fields, fmt.Sprintf("CenterFreq:%d", msg.CenterFreq))
+	}
+	if msg.SampleRate != 0 {
+		fields = append(fields, fmt.Sprintf("SampleRate:%d", msg.SampleRate))
+	}
+	if msg.Backend != "" {
+		fields = append(fields, "Backend:"+msg.Backend)
+	}
+	if msg.ScaledConsumption != nil {
+		fields = append(fields, fmt.Sprintf("ScaledConsumption:%g", *msg.ScaledConsumption))
+		if msg.Unit != "" {
+			fields = append(fields, "Unit:"+msg.Unit)
+		}
+	}
+	if msg.Delta != nil {
+		fields = append(fields, fmt.Sprintf("Delta:%d", *msg.Delta))
+	}
+	if msg.Rate != nil {
+		fields = append(fields, fmt.Sprintf("Rate:%g", *msg.Rate))
+	}
+	if msg.RawHex != "" {
+		fields = append(fields, "RawHex:"+msg.RawHex)
+	}
+	if msg.ChecksumOK != nil {
+		fields = append(fields, fmt.Sprintf("ChecksumOK:%t", *msg.ChecksumOK))
+	}
+	if msg.Consistent != nil {
+		fields = append(fields, fmt.Sprintf("Consistent:%t", *msg.Consistent))
+	}
+	if msg.MeterName != "" {
+		fields = append(fields, "MeterName:"+msg.MeterName)
+		if msg.Commodity != "" {
+			fields = append(fields, "Commodity:"+msg.Commodity)
+		}
+	}
+	if msg.TimeSuspect {
+		fields = append(fields, "TimeSuspect:true")
+	}
+	fields = append(fields, fmt.Sprintf("%s:%s", msg.MsgType(), msg.Message))
+
+	return "{" + strings.Join(fields, " ") + "}"
+}
+
+// RecordColumns selects the optional columns of a LogMessage's csv record.
+// Columns are chosen once, from the flags setting their fields, so every row
+// of a file has the same columns in the same positions. Selected columns are
+// written empty for messages without the field.
+type RecordColumns struct {
+	Scaled      bool // ScaledConsumption and Unit.
+	Delta       bool // Delta and Rate.
+	RawHex      bool
+	ChecksumOK  bool
+	Consistent  bool
+	Name        bool // MeterName and Commodity.
+	TimeSuspect bool
+}
+
+// AllColumns selects every optional column.
+var AllColumns = RecordColumns{true, true, true, true, true, true, true}
+
+// Record returns msg's csv record with every optional column.
+func (msg LogMessage) Record() []string {
+	return msg.RecordColumns(AllColumns)
+}
+
+// RecordColumns returns msg's csv record with the optional columns cols
+// selects, in the order they're declared.
+func (msg LogMessage) RecordColumns(cols RecordColumns) (r []string) {
 	r = append(r, msg.Time.Format(time.RFC3339Nano))
 	r = append(r, strconv.FormatInt(msg.Offset, 10))
 	r = append(r, strconv.FormatInt(int64(msg.Length), 10))
 	r = append(r, msg.Message.Record()...)
+	r = append(r, strconv.Itoa(msg.SchemaVersion))
+	r = append(r, msg.ReceiverID)
+	r = append(r, msg.Commit)
+	r = append(r, strconv.FormatUint(uint64(msg.CenterFreq), 10))
+	r = append(r, strconv.Itoa(msg.SampleRate))
+	r = append(r, msg.Backend)
+	if cols.Scaled {
+		var scaled string
+		if msg.ScaledConsumption != nil {
+			scaled = strconv.FormatFloat(*msg.ScaledConsumption, 'f', -1, 64)
+		}
+		r = append(r, scaled, msg.Unit)
+	}
+	if cols.Delta {
+		var delta, rate string
+		if msg.Delta != nil {
+			delta = strconv.FormatInt(*msg.Delta, 10)
+		}
+		if msg.Rate != nil {
+			rate = strconv.FormatFloat(*msg.Rate, 'f', -1, 64)
+		}
+		r = append(r, delta, rate)
+	}
+	if cols.RawHex {
+		r = append(r, msg.RawHex)
+	}
+	if cols.ChecksumOK {
+		var checksumOK string
+		if msg.ChecksumOK != nil {
+			checksumOK = strconv.FormatBool(*msg.ChecksumOK)
+		}
+		r = append(r, checksumOK)
+	}
+	if cols.Consistent {
+		var consistent string
+		if msg.Consistent != nil {
+			consistent = strconv.FormatBool(*msg.Consistent)
+		}
+		r = append(r, consistent)
+	}
+	if cols.Name {
+		r = append(r, msg.MeterName, msg.Commodity)
+	}
+	if cols.TimeSuspect {
+		r = append(r, strconv.FormatBool(msg.TimeSuspect))
+	}
 	return r
 }
 
-type FilterChain []MessageFilter
+// FilterMode determines how the groups of a FilterChain combine.
+type FilterMode int
 
-func (fc *FilterChain) Add(filter MessageFilter) {
-	*fc = append(*fc, filter)
+const (
+	MatchAll FilterMode = iota // Messages must match every group.
+	MatchAny                   // Messages must match at least one group.
+)
+
+// FilterChain matches messages against groups of filters. Filters of the
+// same type form a group and a message matches a group if it passes any of
+// its filters. Groups combine according to Mode. Messages matching the groups
+// are then dropped if they match any exclusion, and finally passed through
+// the stateful filters in the order they were added.
+//
+// Groups are evaluated in the order their first filter was added, and filters
+// within a group in the order added, stopping at the first match. Evaluation
+// stops at the first group deciding the outcome, so later filters only count
+// the messages which reached them. Stateful filters are only called for
+// messages every other filter passed.
+type FilterChain struct {
+	Mode FilterMode
+
+	groups   []filterGroup
+	excludes []*chainFilter
+	stateful []*chainFilter
 }
 
-func (fc FilterChain) Match(msg Message) bool {
-	if len(fc) == 0 {
+type filterGroup struct {
+	kind    string
+	filters []*chainFilter
+}
+
+// chainFilter is a named filter and counts of the messages it evaluated and
+// those it returned true for. Counts are updated atomically so Stats may be
+// called while messages are matched, such as from the /status handler.
+type chainFilter struct {
+	name   string
+	role   FilterRole
+	filter MessageFilter
+
+	evaluated, matched atomic.Uint64
+}
+
+func newChainFilter(name string, role FilterRole, filter MessageFilter) *chainFilter {
+	return &chainFilter{name: name, role: role, filter: filter}
+}
+
+func (cf *chainFilter) eval(msg Message) bool {
+	cf.evaluated.Add(1)
+	if cf.filter.Filter(msg) {
+		cf.matched.Add(1)
 		return true
 	}
+	return false
+}
+
+func (cf *chainFilter) stats() FilterStats {
+	return FilterStats{
+		Name:      cf.name,
+		Role:      cf.role,
+		Evaluated: cf.evaluated.Load(),
+		Matched:   cf.matched.Load(),
+	}
+}
+
+// FilterRole is the position of a filter in a FilterChain.
+type FilterRole int
+
+const (
+	Include FilterRole = iota
+	Exclude
+	Stateful
+)
+
+func (fr FilterRole) String() string {
+	switch fr {
+	case Include:
+		return "include"
+	case Exclude:
+		return "exclude"
+	case Stateful:
+		return "stateful"
+	}
+	return fmt.Sprintf("FilterRole(%d)", int(fr))
+}
+
+func (fr FilterRole) MarshalText() ([]byte, error) {
+	return []byte(fr.String()), nil
+}
+
+// FilterStats counts the messages a filter evaluated and matched. For
+// exclusions matched messages were dropped, for stateful filters they were
+// passed.
+type FilterStats struct {
+	Name      string
+	Role      FilterRole
+	Evaluated uint64
+	Matched   uint64
+}
+
+func (fs FilterStats) String() string {
+	verb := "matched"
+	switch fs.Role {
+	case Exclude:
+		verb = "dropped"
+	case Stateful:
+		verb = "passed"
+	}
+	return fmt.Sprintf("%s: %d evaluated, %d %s", fs.Name, fs.Evaluated, fs.Matched, verb)
+}
+
+// Add adds filter to the group of filters of the same type.
+func (fc *FilterChain) Add(name string, filter MessageFilter) {
+	cf := newChainFilter(name, Include, filter)
+
+	kind := fmt.Sprintf("%T", filter)
+	for idx := range fc.groups {
+		if fc.groups[idx].kind == kind {
+			fc.groups[idx].filters = append(fc.groups[idx].filters, cf)
+			return
+		}
+	}
+	fc.groups = append(fc.groups, filterGroup{kind, []*chainFilter{cf}})
+}
 
-	for _, filter := range fc {
-		if !filter.Filter(msg) {
+// Exclude adds a filter whose matching messages are dropped.
+func (fc *FilterChain) Exclude(name string, filter MessageFilter) {
+	fc.excludes = append(fc.excludes, newChainFilter(name, Exclude, filter))
+}
+
+// AddStateful adds a filter which records the messages it passes, such as a
+// duplicate filter. Stateful filters only see messages which passed every
+// other filter, so dropped messages never affect their state.
+func (fc *FilterChain) AddStateful(name string, filter MessageFilter) {
+	fc.stateful = append(fc.stateful, newChainFilter(name, Stateful, filter))
+}
+
+func (fc FilterChain) Match(msg Message) bool {
+	if len(fc.groups) != 0 && !fc.include(msg) {
+		return false
+	}
+
+	for _, filter := range fc.excludes {
+		if filter.eval(msg) {
+			return false
+		}
+	}
+
+	for _, filter := range fc.stateful {
+		if !filter.eval(msg) {
 			return false
 		}
 	}
@@ -130,6 +596,80 @@ func (fc FilterChain) Match(msg Message) bool {
 	return true
 }
 
+// include returns true if msg matches the groups according to Mode.
+func (fc FilterChain) include(msg Message) bool {
+	matched := 0
+	for _, g := range fc.groups {
+		groupMatched := false
+		for _, filter := range g.filters {
+			if filter.eval(msg) {
+				groupMatched = true
+				break
+			}
+		}
+
+		if groupMatched {
+			matched++
+			if fc.Mode == MatchAny {
+				break
+			}
+		} else if fc.Mode == MatchAll {
+			return false
+		}
+	}
+
+	return matched != 0
+}
+
+// FilterStage is one step of matching a message against a FilterChain.
+type FilterStage struct {
+	Name  string
+	Match func(Message) bool // Returns false to drop the message.
+}
+
+// Stages returns the steps Match takes in order, a message matching the
+// chain if it passes every stage: the groups combined by Mode as one stage
+// named "include", then each exclusion and each stateful filter as a stage
+// named as it was added. Stages count evaluations as Match does, and filters
+// added afterwards aren't included.
+func (fc FilterChain) Stages() (stages []FilterStage) {
+	if len(fc.groups) != 0 {
+		stages = append(stages, FilterStage{"include", fc.include})
+	}
+	for _, filter := range fc.excludes {
+		stages = append(stages, FilterStage{filter.name, func(msg Message) bool {
+			return !filter.eval(msg)
+		}})
+	}
+	for _, filter := range fc.stateful {
+		stages = append(stages, FilterStage{filter.name, filter.eval})
+	}
+	return
+}
+
+// Stats returns the counts of each filter in the order they're evaluated.
+func (fc FilterChain) Stats() (stats []FilterStats) {
+	for _, g := range fc.groups {
+		for _, filter := range g.filters {
+			stats = append(stats, filter.stats())
+		}
+	}
+	for _, filter := range fc.excludes {
+		stats = append(stats, filter.stats())
+	}
+	for _, filter := range fc.stateful {
+		stats = append(stats, filter.stats())
+	}
+	return
+}
+
 type MessageFilter interface {
 	Filter(Message) bool
 }
+
+// StatefulFilter is implemented by filters which record the messages they
+// pass and so belong with FilterChain's stateful filters.
+type StatefulFilter interface {
+	MessageFilter
+	Stateful()
+}
@@ -0,0 +1,203 @@
+package parse
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testMessage struct {
+	ID uint32
+}
+
+func (m testMessage) MsgType() string          { return "Test" }
+func (m testMessage) MeterID() uint32          { return m.ID }
+func (m testMessage) MeterType() uint8         { return 0 }
+func (m testMessage) MeterConsumption() uint32 { return 0 }
+func (m testMessage) Checksum() []byte         { return nil }
+func (m testMessage) ChecksumOK() bool         { return true }
+func (m testMessage) Raw() []byte              { return nil }
+func (m testMessage) Record() []string         { return nil }
+
+// The JSON keys of the envelope are a contract with downstream consumers,
+// changing them requires bumping SchemaVersion.
+func TestLogMessageJSONKeys(t *testing.T) {
+	scaled := 1.5
+	delta := int64(3)
+	rate := 0.5
+	checksumOK := true
+
+	msg := LogMessage{
+		Time:              time.Now(),
+		SchemaVersion:     SchemaVersion,
+		ReceiverID:        "garage",
+		Commit:            "0123456",
+		CenterFreq:        912600155,
+		SampleRate:        2359296,
+		Backend:           "rtltcp",
+		ScaledConsumption: &scaled,
+		Unit:              "kWh",
+		Delta:             &delta,
+		Rate:              &rate,
+		RawHex:            "00",
+		ChecksumOK:        &checksumOK,
+		MeterName:         "house-water",
+		Commodity:         "water",
+		TimeSuspect:       true,
+		Message:           testMessage{1},
+	}
+
+	buf, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(buf, &fields); err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	expt := "Backend,CenterFreq,ChecksumOK,Commit,Commodity,Delta,Length,Message,MeterName,MsgType,Offset,Rate,RawHex,ReceiverID,SampleRate,ScaledConsumption,SchemaVersion,Time,TimeSuspect,Unit"
+	if recv := strings.Join(keys, ","); recv != expt {
+		t.Fatalf("Expected keys %s got %s\n", expt, recv)
+	}
+
+	// Optional fields are omitted when unset.
+	buf, err = json.Marshal(LogMessage{Message: testMessage{1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recv, expt := string(buf), `{"MsgType":"Test","Time":"0001-01-01T00:00:00Z","Offset":0,"Length":0,"Message":{"ID":1}}`; recv != expt {
+		t.Fatalf("Expected %s got %s\n", expt, recv)
+	}
+}
+
+type idFilter uint32
+
+func (f idFilter) Filter(msg Message) bool { return msg.MeterID() == uint32(f) }
+
+type evenFilter struct{}
+
+func (f evenFilter) Filter(msg Message) bool { return msg.MeterID()%2 == 0 }
+
+func TestFilterChainStats(t *testing.T) {
+	var fc FilterChain
+	fc.Add("one", idFilter(1))
+	fc.Add("two", idFilter(2))
+	fc.Add("even", evenFilter{})
+	fc.Exclude("four", idFilter(4))
+
+	for id := uint32(1); id <= 4; id++ {
+		fc.Match(testMessage{id})
+	}
+
+	var recv []string
+	for _, fs := range fc.Stats() {
+		recv = append(recv, fs.String())
+	}
+
+	// One and two form a group, only 1 and 2 match it and reach even. Only 2
+	// passes both groups and reaches the exclusion.
+	expt := "one: 4 evaluated, 1 matched; two: 3 evaluated, 1 matched; even: 2 evaluated, 1 matched; four: 1 evaluated, 0 dropped"
+	if strings.Join(recv, "; ") != expt {
+		t.Fatalf("Expected %s got %s\n", expt, strings.Join(recv, "; "))
+	}
+}
+
+// TestFilterChainStages checks that passing each stage in turn matches the
+// chain and counts as Match does.
+func TestFilterChainStages(t *testing.T) {
+	var fc FilterChain
+	fc.Add("one", idFilter(1))
+	fc.Add("even", evenFilter{})
+	fc.Mode = MatchAny
+	fc.Exclude("four", idFilter(4))
+	fc.AddStateful("six", idFilter(6))
+
+	var names []string
+	for _, stage := range fc.Stages() {
+		names = append(names, stage.Name)
+	}
+	if expt := "include,four,six"; strings.Join(names, ",") != expt {
+		t.Fatalf("Expected stages %s got %s\n", expt, strings.Join(names, ","))
+	}
+
+	var staged FilterChain
+	staged.Add("one", idFilter(1))
+	staged.Add("even", evenFilter{})
+	staged.Mode = MatchAny
+	staged.Exclude("four", idFilter(4))
+	staged.AddStateful("six", idFilter(6))
+	stages := staged.Stages()
+
+	for id := uint32(0); id <= 8; id++ {
+		pass := true
+		for _, stage := range stages {
+			if pass = stage.Match(testMessage{id}); !pass {
+				break
+			}
+		}
+		if match := fc.Match(testMessage{id}); pass != match {
+			t.Errorf("Meter %d: stages passed %v, chain matched %v\n", id, pass, match)
+		}
+	}
+
+	if recv, expt := fmt.Sprint(staged.Stats()), fmt.Sprint(fc.Stats()); recv != expt {
+		t.Fatalf("Expected stats %s got %s\n", expt, recv)
+	}
+}
+
+// TestFilterChainStatsConcurrent reads stats while messages are matched, as
+// the /status handler does. Run with -race.
+func TestFilterChainStatsConcurrent(t *testing.T) {
+	var fc FilterChain
+	fc.Add("even", evenFilter{})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for id := uint32(0); id < 1000; id++ {
+			fc.Match(testMessage{id})
+		}
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		fc.Stats()
+	}
+
+	if stats := fc.Stats(); stats[0].Evaluated != 1000 || stats[0].Matched != 500 {
+		t.Fatalf("Expected 1000 evaluated and 500 matched, got %+v\n", stats[0])
+	}
+}
+
+func FuzzNewDataFromBits(f *testing.F) {
+	f.Add("1111100101010011")
+	f.Add("101")
+	f.Fuzz(func(t *testing.T, bits string) {
+		data := NewDataFromBits(bits)
+		if len(data.Bytes) != (len(bits)+7)>>3 {
+			t.Fatalf("%d bits packed into %d bytes", len(bits), len(data.Bytes))
+		}
+
+		// Bits made only of 0s and 1s round trip, padded to whole bytes.
+		if strings.Trim(bits, "01") != "" {
+			return
+		}
+		if got := NewDataFromBytes(data.Bytes).Bits; !strings.HasPrefix(got, bits) || strings.Trim(got[len(bits):], "0") != "" {
+			t.Fatalf("%q packed and unpacked as %q", bits, got)
+		}
+	})
+}
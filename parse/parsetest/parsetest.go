@@ -0,0 +1,365 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package parsetest decodes the sample fixtures in rtlamr's testdata/synthetic
+// directory and compares the messages found with those expected, so each
+// parser's tests prove it still finds every packet. The fixtures are
+// generated by rtlamr gen rather than recorded from meters, so they catch
+// regressions in the parsers but can't show the generator and parsers agree
+// with real meters.
+//
+// Cases are listed one per line in testdata/synthetic/cases.txt as a name,
+// message type and symbol length. The fixture <name>.cu8.gz holds gzipped
+// samples as written by -samplefile, and <name>.json the messages expected
+// from it. Running a parser's tests with -update rewrites the JSON with the
+// messages decoded.
+package parsetest
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/bemasher/rtlamr/parse"
+)
+
+var update = flag.Bool("update", false, "rewrite the expected messages of synthetic fixtures with those decoded")
+
+// Case is a fixture and the receiver settings its samples were generated for.
+type Case struct {
+	Name         string
+	MsgType      string
+	SymbolLength int
+}
+
+// Dir returns the directory holding the synthetic fixtures.
+func Dir() string {
+	_, file, _, _ := runtime.Caller(0)
+	return filepath.Join(filepath.Dir(file), "..", "..", "testdata", "synthetic")
+}
+
+// Samples returns the path of the case's gzipped samples.
+func (c Case) Samples() string {
+	return filepath.Join(Dir(), c.Name+".cu8.gz")
+}
+
+// Expected returns the path of the case's expected messages.
+func (c Case) Expected() string {
+	return filepath.Join(Dir(), c.Name+".json")
+}
+
+// Open returns a reader of the case's samples.
+func (c Case) Open() (io.ReadCloser, error) {
+	f, err := os.Open(c.Samples())
+	if err != nil {
+		return nil, err
+	}
+
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", c.Samples(), err)
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{zr, f}, nil
+}
+
+// Cases returns the cases listed in cases.txt. Blank lines and those
+// beginning with # are skipped.
+func Cases() ([]Case, error) {
+	f, err := os.Open(filepath.Join(Dir(), "cases.txt"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var cases []Case
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("cases.txt:%d: expected a name, message type and symbol length", line)
+		}
+		symbolLength, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("cases.txt:%d: symbol length: %w", line, err)
+		}
+		cases = append(cases, Case{fields[0], fields[1], symbolLength})
+	}
+
+	return cases, scanner.Err()
+}
+
+// Decode returns the messages decoded from the case's samples.
+func Decode(c Case) ([]parse.Message, error) {
+	bd, err := parse.NewBlockDecoder(c.MsgType, c.SymbolLength, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := c.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var msgs []parse.Message
+	block := make([]byte, bd.BlockSize())
+	for {
+		// A partial block at the end of the samples holds too few samples to
+		// decode.
+		if _, err := io.ReadFull(r, block); errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return msgs, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		decoded, err := bd.Decode(block)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, decoded...)
+	}
+}
+
+// Synthetic decodes each case of the given message type, comparing the
+// messages found with those expected.
+func Synthetic(t *testing.T, msgType string) {
+	t.Helper()
+
+	cases, err := Cases()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := false
+	for _, c := range cases {
+		if c.MsgType != msgType {
+			continue
+		}
+		found = true
+
+		t.Run(c.Name, func(t *testing.T) {
+			msgs, err := Decode(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			Compare(t, c, msgs)
+		})
+	}
+
+	if !found {
+		t.Errorf("no synthetic fixtures of %s", msgType)
+	}
+}
+
+// Compare compares msgs with the case's expected messages field by field, or
+// with -update writes them as the expected messages.
+func Compare(t *testing.T, c Case, msgs []parse.Message) {
+	t.Helper()
+
+	got := make([]map[string]any, len(msgs))
+	for idx, msg := range msgs {
+		var err error
+		if got[idx], err = fields(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if *update {
+		buf, err := json.MarshalIndent(got, "", "\t")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(c.Expected(), append(buf, '\n'), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	buf, err := os.ReadFile(c.Expected())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want []map[string]any
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.UseNumber()
+	if err := dec.Decode(&want); err != nil {
+		t.Fatalf("%s: %s", c.Expected(), err)
+	}
+
+	if len(got) != len(want) {
+		t.Errorf("decoded %d messages, want %d", len(got), len(want))
+	}
+	for idx := 0; idx < len(got) && idx < len(want); idx++ {
+		keys := map[string]bool{}
+		for k := range got[idx] {
+			keys[k] = true
+		}
+		for k := range want[idx] {
+			keys[k] = true
+		}
+
+		names := make([]string, 0, len(keys))
+		for k := range keys {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+
+		for _, k := range names {
+			g, gok := got[idx][k]
+			w, wok := want[idx][k]
+			switch {
+			case !gok:
+				t.Errorf("message %d: %s missing, want %v", idx, k, w)
+			case !wok:
+				t.Errorf("message %d: unexpected %s %v", idx, k, g)
+			case !reflect.DeepEqual(g, w):
+				t.Errorf("message %d: %s = %v, want %v", idx, k, g, w)
+			}
+		}
+	}
+}
+
+// Seeds returns a window of samples around the first packet of each synthetic
+// fixture of msgType, for seeding fuzz targets. Captures are trimmed to the
+// block before the first sample above the noise through two blocks past a
+// packet's length.
+func Seeds(msgType string) ([][]byte, error) {
+	cases, err := Cases()
+	if err != nil {
+		return nil, err
+	}
+
+	var seeds [][]byte
+	for _, c := range cases {
+		if c.MsgType != msgType {
+			continue
+		}
+
+		cfg, err := parse.Config(c.MsgType, c.SymbolLength)
+		if err != nil {
+			return nil, err
+		}
+
+		r, err := c.Open()
+		if err != nil {
+			return nil, err
+		}
+		samples, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		start := bytes.IndexFunc(samples, func(r rune) bool { return r != 127 })
+		if start == -1 {
+			continue
+		}
+		start = start/cfg.BlockSize2*cfg.BlockSize2 - cfg.BlockSize2
+		if start < 0 {
+			start = 0
+		}
+		end := start + 2*cfg.PacketLength + 3*cfg.BlockSize2
+		if end > len(samples) {
+			end = len(samples)
+		}
+		seeds = append(seeds, samples[start:end])
+	}
+
+	return seeds, nil
+}
+
+// Fuzz decodes arbitrary samples as msgType at a symbol length of 72, seeded
+// with the packets of the synthetic fixtures. Decoding must not panic, and
+// verify is called with each message claiming a valid checksum to check it
+// independently of the parser.
+//
+// Inputs span several blocks, too long for the fuzzer to minimize in
+// reasonable time, so fuzz with minimization disabled:
+//
+//	go test ./idm -run '^$' -fuzz FuzzIDM -fuzzminimizetime=0x
+func Fuzz(f *testing.F, msgType string, verify func(parse.Message) error) {
+	seeds, err := Seeds(msgType)
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, seed := range seeds {
+		f.Add(seed, uint8(1))
+	}
+
+	decimations, err := parse.Decimations(msgType, 72)
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	f.Fuzz(func(t *testing.T, samples []byte, decimation uint8) {
+		bd, err := parse.NewBlockDecoder(msgType, 72, decimations[int(decimation)%len(decimations)])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, msg := range bd.Write(samples) {
+			if !msg.ChecksumOK() {
+				t.Errorf("message failing its checksum returned: %+v", msg)
+				continue
+			}
+			if err := verify(msg); err != nil {
+				t.Errorf("%s: %+v", err, msg)
+			}
+		}
+	})
+}
+
+// fields returns msg's fields and type as they're decoded from JSON, so they
+// compare equal to those read from the expected messages.
+func fields(msg parse.Message) (map[string]any, error) {
+	buf, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	var m map[string]any
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.UseNumber()
+	if err := dec.Decode(&m); err != nil {
+		return nil, err
+	}
+	m["MsgType"] = msg.MsgType()
+
+	return m, nil
+}
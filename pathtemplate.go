@@ -0,0 +1,64 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// PathData holds the variables available to templated output paths such as
+// -samplefile='capture-{{.Time.Format "20060102-150405"}}.cu8'.
+type PathData struct {
+	Time     time.Time // When the file is opened, or reopened on SIGHUP.
+	MsgType  string    // -msgtype as given.
+	Hostname string
+}
+
+// expandPath expands path as a text/template of PathData at the given time.
+// Paths without a template are returned unchanged.
+func expandPath(path string, now time.Time) (string, error) {
+	if !strings.Contains(path, "{{") {
+		return path, nil
+	}
+
+	tmpl, err := template.New("path").Parse(path)
+	if err != nil {
+		return "", err
+	}
+
+	hostname, _ := os.Hostname()
+	data := PathData{now, strings.ToLower(*msgType), hostname}
+
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// openOutput opens the named output file with the given flags, creating its
+// parent directories.
+func openOutput(name string, flag int) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(name), 0777); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(name, flag, 0666)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestExpandPath(t *testing.T) {
+	now := time.Date(2015, 6, 1, 9, 30, 15, 0, time.UTC)
+	hostname, _ := os.Hostname()
+
+	for _, tc := range []struct {
+		Path, Expt string
+	}{
+		{"capture.bin", "capture.bin"},
+		{`capture-{{.Time.Format "20060102-150405"}}.cu8`, "capture-20150601-093015.cu8"},
+		{"{{.Hostname}}/{{.MsgType}}.log", hostname + "/" + *msgType + ".log"},
+	} {
+		recv, err := expandPath(tc.Path, now)
+		if err != nil {
+			t.Fatalf("%s: %s\n", tc.Path, err)
+		}
+		if recv != tc.Expt {
+			t.Fatalf("%s: expected %q got %q\n", tc.Path, tc.Expt, recv)
+		}
+	}
+
+	for _, path := range []string{"{{.MeterID}}.bin", "{{.Time"} {
+		if _, err := expandPath(path, now); err == nil {
+			t.Fatalf("%s: expected error\n", path)
+		}
+	}
+}
+
+func TestOpenOutput(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "a", "b", "samples.bin")
+	f, err := openOutput(name, os.O_WRONLY|os.O_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+}
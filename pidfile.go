@@ -0,0 +1,64 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// checkPidFile returns an error if the pid file holds the pid of a running
+// process, probably another rtlamr using the same dongle. A missing, stale
+// or unreadable pid file is ignored and will be replaced.
+func checkPidFile(filename string) error {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(buf)))
+	if err != nil || pid <= 0 || pid == os.Getpid() {
+		return nil
+	}
+
+	if processAlive(pid) {
+		return fmt.Errorf("%s: already running as pid %d", filename, pid)
+	}
+
+	return nil
+}
+
+// writePidFile writes the pid of this process to the given file.
+func writePidFile(filename string) error {
+	return ioutil.WriteFile(filename, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+}
+
+// removePidFile removes the pid file if it still holds the pid of this
+// process.
+func removePidFile(filename string) error {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(string(buf)) != strconv.Itoa(os.Getpid()) {
+		return nil
+	}
+	return os.Remove(filename)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestPidFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pidfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "rtlamr.pid")
+
+	if err := checkPidFile(filename); err != nil {
+		t.Fatalf("Expected nil for missing pid file got %q\n", err)
+	}
+
+	if err := writePidFile(filename); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkPidFile(filename); err != nil {
+		t.Fatalf("Expected nil for own pid got %q\n", err)
+	}
+	if err := removePidFile(filename); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Fatalf("Expected pid file to be removed got %v\n", err)
+	}
+
+	// A pid file held by another running process refuses to start.
+	ppid := strconv.Itoa(os.Getppid())
+	if err := ioutil.WriteFile(filename, []byte(ppid+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkPidFile(filename); err == nil {
+		t.Fatal("Expected error for pid file of running process")
+	}
+
+	// Another process's pid file is left alone.
+	if err := removePidFile(filename); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filename); err != nil {
+		t.Fatalf("Expected pid file of another process to remain got %v\n", err)
+	}
+
+	// The pid of a process which has exited is stale.
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	pid := strconv.Itoa(cmd.Process.Pid)
+	if err := ioutil.WriteFile(filename, []byte(pid+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkPidFile(filename); err != nil {
+		t.Fatalf("Expected nil for stale pid file got %q\n", err)
+	}
+}
@@ -0,0 +1,33 @@
+package r900
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/bemasher/rtlamr/parse"
+	"github.com/bemasher/rtlamr/parse/parsetest"
+	"github.com/bemasher/rtlamr/r900/gf"
+)
+
+func FuzzR900(f *testing.F) {
+	field := gf.NewField(32, 37, 2)
+
+	parsetest.Fuzz(f, "r900", func(msg parse.Message) error {
+		// The packed preamble followed by 21 symbols.
+		raw := msg.Raw()
+		if len(raw) != 25 {
+			return fmt.Errorf("raw packet is %d bytes, want 25", len(raw))
+		}
+
+		var codeword [31]byte
+		copy(codeword[:16], raw[4:20])
+		copy(codeword[26:], raw[20:])
+		for _, s := range field.Syndrome(codeword[:], 5, 29) {
+			if s != 0 {
+				return errors.New("checksum doesn't verify")
+			}
+		}
+		return nil
+	})
+}
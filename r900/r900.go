@@ -18,6 +18,7 @@ package r900
 
 import (
 	"bytes"
+	"encoding/gob"
 	"fmt"
 	"math"
 	"strconv"
@@ -31,8 +32,18 @@ const (
 	PayloadSymbols = 42
 )
 
+// Constraints are the symbol lengths and decimations r900 decodes with. Its
+// filters span single chips, so decimation must divide the chip length.
+var Constraints = parse.Constraints{
+	SymbolLengths: parse.DefaultConstraints.SymbolLengths,
+	MinChipLength: parse.DefaultConstraints.MinChipLength,
+	WholeChips:    true,
+}
+
 func init() {
-	parse.Register("r900", NewParser)
+	parse.Register("r900", NewParser, Constraints)
+	gob.RegisterName("R900", R900{})
+	gob.RegisterName("R900Extended", R900Extended{})
 }
 
 func NewPacketConfig(chipLength int) (cfg decode.PacketConfig) {
@@ -55,12 +66,15 @@ type Parser struct {
 	csum      []float64
 	filtered  [][3]float64
 	quantized []byte
+
+	allowBadCRC bool
 }
 
 func NewParser(chipLength, decimation int) parse.Parser {
 	p := new(Parser)
 
 	p.Decoder = decode.NewDecoder(NewPacketConfig(chipLength), decimation)
+	p.allowBadCRC = parse.AllowBadCRC
 
 	// GF of order 32, polynomial 37, generator 2.
 	p.field = gf.NewField(32, 37, 2)
@@ -73,6 +87,11 @@ func NewParser(chipLength, decimation int) parse.Parser {
 	return p
 }
 
+// SetAllowBadCRC sets whether Parse keeps packets failing their checksum.
+func (p *Parser) SetAllowBadCRC(allow bool) {
+	p.allowBadCRC = allow
+}
+
 func (p Parser) Dec() decode.Decoder {
 	return p.Decoder
 }
@@ -159,6 +178,64 @@ func (p Parser) Quantize() {
 	}
 }
 
+// payload decodes the symbols following the preamble at preambleIdx into
+// symbols, returning them as a string of bits. It reports false if a pair of
+// digits doesn't form a valid symbol.
+func (p Parser) payload(preambleIdx int, symbols []byte) (bits string, ok bool) {
+	cfg := p.Decoder.DecCfg
+
+	payloadIdx := preambleIdx + cfg.PreambleLength - cfg.SymbolLength
+	var digits string
+	for idx := 0; idx < PayloadSymbols*4*cfg.ChipLength; idx += cfg.ChipLength * 4 {
+		qIdx := payloadIdx + idx
+
+		digits += strconv.Itoa(int(p.quantized[qIdx]))
+	}
+
+	for idx := 0; idx < len(digits); idx += 2 {
+		symbol, _ := strconv.ParseInt(digits[idx:idx+2], 6, 32)
+		if symbol > 31 {
+			return "", false
+		}
+		symbols[idx>>1] = byte(symbol)
+		bits += fmt.Sprintf("%05b", symbol)
+	}
+
+	return bits, true
+}
+
+// syndromes returns the Reed-Solomon syndromes of the payload symbols, all
+// zero if the checksum passes.
+func (p Parser) syndromes(symbols []byte) []byte {
+	copy(p.rsBuf[:], symbols[:16])
+	copy(p.rsBuf[26:], symbols[16:])
+	return p.field.Syndrome(p.rsBuf[:], 5, 29)
+}
+
+// Diagnose explains why the packet at the preamble candidate idx did or
+// didn't parse. The checksum is the payload's syndromes, expected to be zero.
+func (p Parser) Diagnose(idx int) (c parse.Candidate) {
+	if idx > p.Decoder.DecCfg.BlockSize {
+		c.Stop = "length"
+		return
+	}
+
+	symbols := make([]byte, 21)
+	if _, ok := p.payload(idx, symbols); !ok {
+		c.Stop = "symbol"
+		return
+	}
+
+	syndromes := p.syndromes(symbols)
+	c.Checksum = fmt.Sprintf("%02X", syndromes)
+	c.Expected = fmt.Sprintf("%02X", make([]byte, len(syndromes)))
+	if c.Checksum != c.Expected && !p.allowBadCRC {
+		c.Stop = "checksum"
+	}
+
+	return
+}
+
 // Given a list of indices the preamble exists at, decode and parse a message.
 func (p Parser) Parse(indices []int) (msgs []parse.Message) {
 	cfg := p.Decoder.DecCfg
@@ -168,52 +245,28 @@ func (p Parser) Parse(indices []int) (msgs []parse.Message) {
 	p.Filter()
 	p.Quantize()
 
-	preambleLength := cfg.PreambleLength
-	chipLength := cfg.ChipLength
-
 	symbols := make([]byte, 21)
 	zeros := make([]byte, 5)
 
 	seen := make(map[string]bool)
 
+	var failed []parse.Message
+
 	for _, preambleIdx := range indices {
 		if preambleIdx > cfg.BlockSize {
 			break
 		}
 
-		payloadIdx := preambleIdx + preambleLength - p.Dec().DecCfg.SymbolLength
-		var digits string
-		for idx := 0; idx < PayloadSymbols*4*cfg.ChipLength; idx += chipLength * 4 {
-			qIdx := payloadIdx + idx
-
-			digits += strconv.Itoa(int(p.quantized[qIdx]))
-		}
-
-		var (
-			bits      string
-			badSymbol bool
-		)
-		for idx := 0; idx < len(digits); idx += 2 {
-			symbol, _ := strconv.ParseInt(digits[idx:idx+2], 6, 32)
-			if symbol > 31 {
-				badSymbol = true
-				break
-			}
-			symbols[idx>>1] = byte(symbol)
-			bits += fmt.Sprintf("%05b", symbol)
-		}
-
-		if badSymbol || seen[bits] {
+		bits, ok := p.payload(preambleIdx, symbols)
+		if !ok || seen[bits] {
 			continue
 		}
 
 		seen[bits] = true
 
-		copy(p.rsBuf[:], symbols[:16])
-		copy(p.rsBuf[26:], symbols[16:])
-		syndromes := p.field.Syndrome(p.rsBuf[:], 5, 29)
-
-		if !bytes.Equal(zeros, syndromes) {
+		// If the checksum fails, bail unless we're keeping failed packets.
+		checksumOK := bytes.Equal(zeros, p.syndromes(symbols))
+		if !checksumOK && !p.allowBadCRC {
 			continue
 		}
 
@@ -236,9 +289,27 @@ func (p Parser) Parse(indices []int) (msgs []parse.Message) {
 		r900.Unkn3 = uint8(unkn3)
 		r900.Leak = uint8(leak)
 		r900.LeakNow = uint8(leaknow)
-		copy(r900.checksum[:], symbols[16:])
+		copy(r900.payload[:], symbols)
+
+		// Sample the preamble from the decoder's bit-decision, the raw packet
+		// is the packed preamble followed by the payload symbols.
+		preamble := make([]byte, cfg.PreambleSymbols>>3)
+		for idx := 0; idx < cfg.PreambleSymbols; idx++ {
+			preamble[idx>>3] <<= 1
+			preamble[idx>>3] |= p.Decoder.Quantized[preambleIdx+idx*cfg.SymbolLength]
+		}
+		r900.raw = append(preamble, symbols...)
+		r900.badChecksum = !checksumOK
+
+		if checksumOK {
+			msgs = append(msgs, r900)
+		} else {
+			failed = append(failed, r900)
+		}
+	}
 
-		msgs = append(msgs, r900)
+	if len(msgs) == 0 {
+		msgs = failed
 	}
 
 	return
@@ -253,7 +324,10 @@ type R900 struct {
 	Unkn3       uint8  `xml:",attr"` // 2 bits
 	Leak        uint8  `xml:",attr"` // 4 bits, day bins of leak
 	LeakNow     uint8  `xml:",attr"` // 2 bits, leak past 24h hi/lo
-	checksum    [5]byte
+
+	payload     [21]byte // 5-bit symbols, 16 data and 5 checksum
+	raw         []byte
+	badChecksum bool
 }
 
 func (r900 R900) MsgType() string {
@@ -268,8 +342,52 @@ func (r900 R900) MeterType() uint8 {
 	return r900.Unkn1
 }
 
+func (r900 R900) MeterConsumption() uint32 {
+	return r900.Consumption
+}
+
 func (r900 R900) Checksum() []byte {
-	return r900.checksum[:]
+	return r900.payload[16:]
+}
+
+func (r900 R900) ChecksumOK() bool {
+	return !r900.badChecksum
+}
+
+func (r900 R900) Raw() []byte {
+	return r900.raw
+}
+
+func (r900 R900) Field(name string) (parse.Value, bool) {
+	switch name {
+	case "ID":
+		return parse.Num(float64(r900.ID)), true
+	case "Unkn1":
+		return parse.Num(float64(r900.Unkn1)), true
+	case "NoUse":
+		return parse.Num(float64(r900.NoUse)), true
+	case "BackFlow":
+		return parse.Num(float64(r900.BackFlow)), true
+	case "Consumption":
+		return parse.Num(float64(r900.Consumption)), true
+	case "Unkn3":
+		return parse.Num(float64(r900.Unkn3)), true
+	case "Leak":
+		return parse.Num(float64(r900.Leak)), true
+	case "LeakNow":
+		return parse.Num(float64(r900.LeakNow)), true
+	}
+	return parse.Value{}, false
+}
+
+// Flags omits NoUse, which counts days without consumption rather than
+// indicating a fault.
+func (r900 R900) Flags() map[string]uint {
+	return map[string]uint{
+		"BackFlow": uint(r900.BackFlow),
+		"Leak":     uint(r900.Leak),
+		"LeakNow":  uint(r900.LeakNow),
+	}
 }
 
 func (r900 R900) String() string {
@@ -297,3 +415,73 @@ func (r900 R900) Record() (r []string) {
 
 	return
 }
+
+// ExtendedField locates a range of payload bits whose meaning is unconfirmed.
+type ExtendedField struct {
+	Name           string
+	Offset, Length int
+}
+
+// ExtendedFields lists the experimental interpretations of undocumented
+// payload bits. Offsets are in bits from the start of the payload. These are
+// community-sourced guesses, names and ranges will change as they're
+// confirmed or refuted.
+var ExtendedFields = []ExtendedField{
+	{"ExpDeviceClass", 32, 4},
+	{"ExpDeviceFlags", 36, 4},
+	{"ExpTamper", 72, 2},
+}
+
+// ExtendedValue is the value of an experimental field.
+type ExtendedValue struct {
+	Name   string `xml:",attr"`
+	Offset int    `xml:",attr"`
+	Length int    `xml:",attr"`
+	Value  uint64 `xml:",attr"`
+}
+
+// R900Extended is an R900 message with experimental fields and the raw
+// payload symbols attached.
+type R900Extended struct {
+	R900
+	Experimental []ExtendedValue
+	Payload      string `xml:",attr"`
+}
+
+// NewExtended decodes the experimental fields of msg.
+func NewExtended(msg R900) (ext R900Extended) {
+	ext.R900 = msg
+
+	var bits string
+	for _, symbol := range msg.payload {
+		bits += fmt.Sprintf("%05b", symbol)
+	}
+
+	for _, field := range ExtendedFields {
+		value, _ := strconv.ParseUint(bits[field.Offset:field.Offset+field.Length], 2, 64)
+		ext.Experimental = append(ext.Experimental, ExtendedValue{field.Name, field.Offset, field.Length, value})
+	}
+
+	ext.Payload = fmt.Sprintf("%02X", msg.payload)
+
+	return
+}
+
+func (ext R900Extended) String() string {
+	s := ext.R900.String()
+	s = s[:len(s)-1]
+	for _, v := range ext.Experimental {
+		s += fmt.Sprintf(" %s:%d", v.Name, v.Value)
+	}
+	return s + " Payload:" + ext.Payload + "}"
+}
+
+func (ext R900Extended) Record() (r []string) {
+	r = ext.R900.Record()
+	for _, v := range ext.Experimental {
+		r = append(r, strconv.FormatUint(v.Value, 10))
+	}
+	r = append(r, ext.Payload)
+
+	return
+}
@@ -0,0 +1,11 @@
+package r900
+
+import (
+	"testing"
+
+	"github.com/bemasher/rtlamr/parse/parsetest"
+)
+
+func TestSynthetic(t *testing.T) {
+	parsetest.Synthetic(t, "r900")
+}
@@ -24,7 +24,7 @@ import (
 )
 
 func init() {
-	parse.Register("r900bcd", NewParser)
+	parse.Register("r900bcd", NewParser, r900.Constraints)
 }
 
 type Parser struct {
@@ -35,6 +35,22 @@ func NewParser(ChipLength, decimation int) parse.Parser {
 	return Parser{r900.NewParser(ChipLength, decimation)}
 }
 
+// SetAllowBadCRC sets whether Parse keeps packets failing their checksum.
+func (p Parser) SetAllowBadCRC(allow bool) {
+	if s, ok := p.Parser.(parse.BadCRCSetter); ok {
+		s.SetAllowBadCRC(allow)
+	}
+}
+
+// Diagnose explains why the packet at the preamble candidate idx did or
+// didn't parse, as the r900 parser would.
+func (p Parser) Diagnose(idx int) (c parse.Candidate) {
+	if d, ok := p.Parser.(parse.Diagnoser); ok {
+		c = d.Diagnose(idx)
+	}
+	return
+}
+
 // Parse messages using r900 parser and convert consumption from BCD to int.
 func (p Parser) Parse(indices []int) (msgs []parse.Message) {
 	msgs = p.Parser.Parse(indices)
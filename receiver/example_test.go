@@ -0,0 +1,38 @@
+package receiver_test
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/bemasher/rtlamr/receiver"
+)
+
+func Example() {
+	// Two SCM packets recorded as interleaved 8-bit inphase and quadrature
+	// samples, as written by -samplefile.
+	f, err := os.Open("testdata/scm.cu8")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	rcvr, err := receiver.NewFromSource(receiver.Config{}, receiver.NewReaderSource(f))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	msgs, errs := rcvr.Stream(context.Background())
+	for msg := range msgs {
+		fmt.Println(msg.MsgType(), msg.MeterID(), msg.MeterType(), msg.MeterConsumption())
+	}
+
+	// Nothing is sent on errs once the file is exhausted.
+	if err := <-errs; err != nil {
+		log.Fatal(err)
+	}
+
+	// Output:
+	// SCM 12345678 12 1234567
+	// SCM 23456789 7 250
+}
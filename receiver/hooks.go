@@ -0,0 +1,248 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package receiver
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/bemasher/rtlamr/parse"
+)
+
+// Meta describes where a packet was received.
+type Meta struct {
+	Time   time.Time // When the block holding the packet was read, or as its source tells.
+	Block  uint64    // Number of blocks read before this one.
+	Offset int64     // Offset of the block in the source, -1 if unknown.
+	Length int       // Length of the block in bytes.
+
+	// Start and Count locate the packets decoded from the block in the
+	// stream of samples read, counting samples from the first read. Parsers
+	// don't report where each packet was found, so the packets of a block
+	// share the earliest preamble's location. Zero until the block is
+	// decoded.
+	Start, Count int64
+}
+
+// BlockStats summarizes the decoding of one block of samples.
+type BlockStats struct {
+	Meta
+	Candidates int           // Preamble matches.
+	Packets    int           // Packets parsed, including those failing their checksum.
+	Elapsed    time.Duration // Time spent decoding and parsing.
+}
+
+// Decode holds the result of decoding one block of samples, before the
+// packets are filtered. Decoding several message types, each parser decodes
+// the block in pieces of its own block size, and Meta locates the packets
+// within the piece.
+type Decode struct {
+	Meta
+	Parser  parse.Parser    // Parser the block was decoded by, its decoder holds the block's bits.
+	Indices []int           // Preamble matches, see decode.Decoder.Decode.
+	Packets []parse.Message // Packets parsed, including those failing their checksum.
+
+	Decoding, Parsing time.Duration // Time spent decoding and parsing.
+}
+
+// hooks holds the functions registered to be called from the decode loop.
+// Hooks are called synchronously in the order they were registered, holding
+// Config.Locker if set, and must be registered before Run. A hook which
+// panics is logged and skipped for that call, and one taking longer than
+// Config.HookBudget is logged as slow.
+type hooks struct {
+	samples      []samplesHook
+	decode       []decodeHook
+	filter       []filterHook
+	packet       []packetHook
+	emit         []emitHook
+	checksumFail []checksumFailHook
+	block        []blockHook
+	overrun      []overrunHook
+}
+
+type samplesHook struct {
+	name string
+	fn   func([]byte, Meta)
+}
+
+type decodeHook struct {
+	name string
+	fn   func(Decode)
+}
+
+type filterHook struct {
+	name string
+	fn   func(parse.Message, Meta) bool
+}
+
+type packetHook struct {
+	name string
+	fn   func(*parse.LogMessage, Meta)
+}
+
+type emitHook struct {
+	name string
+	fn   func(*parse.LogMessage)
+}
+
+type checksumFailHook struct {
+	name string
+	fn   func([]byte, Meta)
+}
+
+type blockHook struct {
+	name string
+	fn   func(BlockStats)
+}
+
+type overrunHook struct {
+	name string
+	fn   func(uint64)
+}
+
+// OnSamples registers fn to be called with each block of samples read,
+// before it's decoded. fn mustn't retain block, which is reused.
+func (rcvr *Receiver) OnSamples(name string, fn func(block []byte, meta Meta)) {
+	rcvr.hooks.samples = append(rcvr.hooks.samples, samplesHook{name, fn})
+}
+
+// OnDecode registers fn to be called once each block of samples is decoded
+// and parsed, before its packets are filtered. fn is called for each parser
+// and piece of the block decoded, see Decode.
+func (rcvr *Receiver) OnDecode(name string, fn func(d Decode)) {
+	rcvr.hooks.decode = append(rcvr.hooks.decode, decodeHook{name, fn})
+}
+
+// OnFilter registers fn to be called with each packet passing its checksum,
+// or failing it with Config.AllowBadCRC, dropping the packet if fn returns
+// false. Filter hooks are called in the order registered up to the first
+// dropping the packet, followed by Config.Filter. A filter hook which panics
+// passes the packet.
+func (rcvr *Receiver) OnFilter(name string, fn func(pkt parse.Message, meta Meta) bool) {
+	rcvr.hooks.filter = append(rcvr.hooks.filter, filterHook{name, fn})
+}
+
+// OnPacket registers fn to be called with each message passing the
+// receiver's filters, before Run's handler. Changes fn makes to msg are seen
+// by later hooks and the handler.
+func (rcvr *Receiver) OnPacket(name string, fn func(msg *parse.LogMessage, meta Meta)) {
+	rcvr.hooks.packet = append(rcvr.hooks.packet, packetHook{name, fn})
+}
+
+// OnEmit registers fn to be called with each message as it's delivered, once
+// every OnPacket hook has been: just before Run's handler, or as Stream sends
+// it, on a goroutine of its own. Outputs belong here, after the hooks which
+// amend messages. Changes fn makes to msg are seen by later hooks and the
+// handler or consumer.
+func (rcvr *Receiver) OnEmit(name string, fn func(msg *parse.LogMessage)) {
+	rcvr.hooks.emit = append(rcvr.hooks.emit, emitHook{name, fn})
+}
+
+// OnChecksumFail registers fn to be called with the raw bytes of each packet
+// failing its checksum, whether or not Config.AllowBadCRC delivers it.
+// Parsers only report failed packets from blocks in which no packet passed.
+func (rcvr *Receiver) OnChecksumFail(name string, fn func(raw []byte, meta Meta)) {
+	rcvr.hooks.checksumFail = append(rcvr.hooks.checksumFail, checksumFailHook{name, fn})
+}
+
+// OnBlock registers fn to be called after each block of samples is decoded
+// and its messages handled.
+func (rcvr *Receiver) OnBlock(name string, fn func(stats BlockStats)) {
+	rcvr.hooks.block = append(rcvr.hooks.block, blockHook{name, fn})
+}
+
+// OnOverrun registers fn to be called when Stream discards a message with
+// Config.DropOldest, with the total discarded so far.
+func (rcvr *Receiver) OnOverrun(name string, fn func(count uint64)) {
+	rcvr.hooks.overrun = append(rcvr.hooks.overrun, overrunHook{name, fn})
+}
+
+// callHook calls fn for the named hook, recovering a panic and timing it
+// against Config.HookBudget.
+func (rcvr *Receiver) callHook(event, name string, fn func()) {
+	if rcvr.cfg.Locker != nil {
+		rcvr.cfg.Locker.Lock()
+		defer rcvr.cfg.Locker.Unlock()
+	}
+
+	start := rcvr.cfg.Clock.Now()
+	defer func() {
+		if r := recover(); r != nil {
+			slog.Error("hook panicked", "event", event, "hook", name, "err", r)
+			return
+		}
+		if elapsed := rcvr.cfg.Clock.Now().Sub(start); rcvr.cfg.HookBudget > 0 && elapsed > rcvr.cfg.HookBudget {
+			slog.Warn("hook exceeded its time budget", "event", event, "hook", name, "elapsed", elapsed, "budget", rcvr.cfg.HookBudget)
+		}
+	}()
+
+	fn()
+}
+
+func (rcvr *Receiver) samples(block []byte, meta Meta) {
+	for _, h := range rcvr.hooks.samples {
+		rcvr.callHook("samples", h.name, func() { h.fn(block, meta) })
+	}
+}
+
+func (rcvr *Receiver) decode(d Decode) {
+	for _, h := range rcvr.hooks.decode {
+		rcvr.callHook("decode", h.name, func() { h.fn(d) })
+	}
+}
+
+func (rcvr *Receiver) filter(pkt parse.Message, meta Meta) bool {
+	for _, h := range rcvr.hooks.filter {
+		pass := true
+		rcvr.callHook("filter", h.name, func() { pass = h.fn(pkt, meta) })
+		if !pass {
+			return false
+		}
+	}
+	return true
+}
+
+func (rcvr *Receiver) packet(msg *parse.LogMessage, meta Meta) {
+	for _, h := range rcvr.hooks.packet {
+		rcvr.callHook("packet", h.name, func() { h.fn(msg, meta) })
+	}
+}
+
+func (rcvr *Receiver) emit(msg *parse.LogMessage) {
+	for _, h := range rcvr.hooks.emit {
+		rcvr.callHook("emit", h.name, func() { h.fn(msg) })
+	}
+}
+
+func (rcvr *Receiver) checksumFail(raw []byte, meta Meta) {
+	for _, h := range rcvr.hooks.checksumFail {
+		rcvr.callHook("checksumfail", h.name, func() { h.fn(raw, meta) })
+	}
+}
+
+func (rcvr *Receiver) block(stats BlockStats) {
+	for _, h := range rcvr.hooks.block {
+		rcvr.callHook("block", h.name, func() { h.fn(stats) })
+	}
+}
+
+func (rcvr *Receiver) overrun(count uint64) {
+	for _, h := range rcvr.hooks.overrun {
+		rcvr.callHook("overrun", h.name, func() { h.fn(count) })
+	}
+}
@@ -0,0 +1,127 @@
+package receiver
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/bemasher/rtlamr/gen"
+	"github.com/bemasher/rtlamr/parse"
+)
+
+func TestHooks(t *testing.T) {
+	samples, err := os.ReadFile("testdata/scm.cu8")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A packet with a corrupted checksum follows the recording.
+	pkt, err := gen.NewRandSCM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkt[11] ^= 0xFF
+	samples = append(samples, packetSignal(t, pkt)...)
+
+	rcvr, err := NewFromSource(Config{}, NewReaderSource(bytes.NewReader(samples)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var events []string
+	var read int64
+	rcvr.OnSamples("read", func(block []byte, meta Meta) {
+		read += int64(len(block) >> 1)
+	})
+	rcvr.OnDecode("located", func(d Decode) {
+		if len(d.Packets) != 0 && (d.Start < 0 || d.Count <= 0 || d.Start+d.Count > read) {
+			t.Errorf("packets located at %d+%d, outside of the %d samples read", d.Start, d.Count, read)
+		}
+	})
+	rcvr.OnFilter("filter", func(pkt parse.Message, meta Meta) bool {
+		events = append(events, "filter")
+		return true
+	})
+	rcvr.OnPacket("first", func(msg *parse.LogMessage, meta Meta) {
+		events = append(events, "first")
+	})
+	rcvr.OnPacket("panics", func(msg *parse.LogMessage, meta Meta) {
+		panic("hook failed")
+	})
+	rcvr.OnPacket("second", func(msg *parse.LogMessage, meta Meta) {
+		if msg.Offset != meta.Offset || msg.Time != meta.Time {
+			t.Errorf("message doesn't match its meta: %+v, %+v", msg, meta)
+		}
+		events = append(events, "second")
+	})
+	rcvr.OnEmit("emit", func(msg *parse.LogMessage) {
+		msg.MeterName = "emitted"
+		events = append(events, "emit")
+	})
+	var failed [][]byte
+	rcvr.OnChecksumFail("crc", func(raw []byte, meta Meta) {
+		failed = append(failed, raw)
+	})
+	blocks := 0
+	rcvr.OnBlock("blocks", func(stats BlockStats) {
+		if stats.Block != uint64(blocks) {
+			t.Errorf("block %d, want %d", stats.Block, blocks)
+		}
+		blocks++
+	})
+
+	err = rcvr.Run(context.Background(), func(msg parse.LogMessage) error {
+		if msg.MeterName != "emitted" {
+			t.Errorf("handler didn't see the emit hook's change: %+v", msg)
+		}
+		events = append(events, "handler")
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "filter,first,second,emit,handler,filter,first,second,emit,handler"
+	if got := strings.Join(events, ","); got != want {
+		t.Errorf("events %s, want %s", got, want)
+	}
+	if len(failed) != 1 {
+		t.Errorf("%d checksum failures, want 1", len(failed))
+	}
+	if want := len(samples) / rcvr.blockSize(); blocks != want {
+		t.Errorf("%d blocks, want %d", blocks, want)
+	}
+}
+
+func TestFilterHook(t *testing.T) {
+	rcvr, err := NewFromSource(Config{}, NewReaderSource(bytes.NewReader(scmSignal(t))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filtered := 0
+	rcvr.OnFilter("drop", func(pkt parse.Message, meta Meta) bool {
+		filtered++
+		return false
+	})
+	rcvr.OnFilter("after", func(pkt parse.Message, meta Meta) bool {
+		t.Error("filter hook called after the packet was dropped")
+		return true
+	})
+	rcvr.OnPacket("packet", func(msg *parse.LogMessage, meta Meta) {
+		t.Error("dropped packet reached OnPacket")
+	})
+
+	err = rcvr.Run(context.Background(), func(parse.LogMessage) error {
+		t.Error("dropped packet reached the handler")
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filtered != 1 {
+		t.Errorf("filter hook saw %d packets, want 1", filtered)
+	}
+}
@@ -0,0 +1,454 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package receiver decodes meter messages from rtl_tcp or any other source of
+// samples so they can be received by programs embedding rtlamr rather than
+// running it. Each
+// Receiver holds its own connection, parser and filters, so several may run
+// in one process.
+package receiver
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bemasher/rtlamr/clock"
+	"github.com/bemasher/rtlamr/decode"
+	"github.com/bemasher/rtlamr/parse"
+
+	_ "github.com/bemasher/rtlamr/idm"
+	_ "github.com/bemasher/rtlamr/r900"
+	_ "github.com/bemasher/rtlamr/r900bcd"
+	_ "github.com/bemasher/rtlamr/scm"
+	_ "github.com/bemasher/rtlamr/scmplus"
+)
+
+// Backend names rtl_tcp as the source of samples in log messages.
+const Backend = "rtltcp"
+
+// Config configures a Receiver. The zero value receives scm from rtl_tcp on
+// the local host with the message type's default tuning.
+type Config struct {
+	Server       string // Address of rtl_tcp, 127.0.0.1:1234 if blank.
+	MsgType      string // scm, scm+, idm, r900 or r900bcd, scm if blank. A comma separated list decodes each from the same samples.
+	SymbolLength int    // Samples per symbol, 72 if zero.
+	Decimation   int    // Keep every nth sample, 1 if zero.
+
+	CenterFreq     uint32  // Hz, the message type's if zero.
+	SampleRate     int     // Samples per second, given by SymbolLength if zero.
+	TunerGain      float64 // dB, manual gain mode is enabled if zero and AGC is false.
+	AGC            bool    // Enables the rtl's automatic gain control.
+	FreqCorrection int     // ppm.
+
+	ReceiverID  string // Copied to each message.
+	Commit      string // Copied to each message.
+	RawHex      bool   // Include the raw packet in each message.
+	AllowBadCRC bool   // Also deliver packets failing their checksum.
+
+	// Filter, if not nil, drops the messages it doesn't match.
+	Filter *parse.FilterChain
+
+	// StreamBuffer is the number of messages Stream holds waiting for the
+	// consumer, 64 if zero. Once it's full the receiver waits for the
+	// consumer, or if DropOldest is set discards the oldest message to make
+	// room.
+	StreamBuffer int
+	DropOldest   bool
+
+	// HookBudget is how long a hook may take before it's logged as slow,
+	// 100ms if zero, negative to never warn.
+	HookBudget time.Duration
+
+	// Locker, if not nil, is held while each hook is called. Stream calls
+	// OnEmit hooks while the next block is decoded, so hooks sharing state
+	// with each other or with the embedding program can be serialized.
+	Locker sync.Locker
+
+	// Clock times blocks as they're read, for sources which don't, and
+	// hooks against HookBudget. clock.Real if nil.
+	Clock clock.Clock
+}
+
+// Handler is called with each message received. Returning an error stops
+// the receiver, which returns it from Run.
+type Handler func(msg parse.LogMessage) error
+
+// Receiver decodes messages from a sample source.
+type Receiver struct {
+	cfg     Config
+	parsers []parse.Parser
+	open    func() (SampleSource, error)
+	backend string
+	hooks   hooks
+
+	dropped atomic.Uint64
+}
+
+// New returns a receiver for the given configuration, receiving from
+// rtl_tcp. It doesn't connect until Run is called, and reconnects on each
+// call.
+func New(cfg Config) (*Receiver, error) {
+	rcvr, err := newReceiver(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	rcvr.open = func() (SampleSource, error) {
+		return dial(rcvr.cfg)
+	}
+	rcvr.backend = Backend
+
+	return rcvr, nil
+}
+
+// NewFromSource returns a receiver decoding samples from src, which should
+// be sampled at the configuration's sample rate. Config's rtl_tcp and tuner
+// settings are ignored, though CenterFreq is still reported in messages. src
+// is closed once Run returns, so the receiver can only be run once.
+func NewFromSource(cfg Config, src SampleSource) (*Receiver, error) {
+	rcvr, err := newReceiver(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	rcvr.open = func() (SampleSource, error) {
+		return src, nil
+	}
+	if b, ok := src.(Backender); ok {
+		rcvr.backend = b.Backend()
+	}
+
+	return rcvr, nil
+}
+
+// newReceiver fills in cfg's defaults and creates its parser.
+func newReceiver(cfg Config) (*Receiver, error) {
+	if cfg.Server == "" {
+		cfg.Server = "127.0.0.1:1234"
+	}
+	if cfg.MsgType == "" {
+		cfg.MsgType = "scm"
+	}
+	cfg.MsgType = strings.ToLower(cfg.MsgType)
+	if cfg.SymbolLength == 0 {
+		cfg.SymbolLength = 72
+	}
+	if cfg.Decimation == 0 {
+		cfg.Decimation = 1
+	}
+	if cfg.StreamBuffer == 0 {
+		cfg.StreamBuffer = 64
+	}
+	if cfg.HookBudget == 0 {
+		cfg.HookBudget = 100 * time.Millisecond
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = clock.Real
+	}
+
+	parsers, err := parse.NewParsers(cfg.MsgType, cfg.SymbolLength, cfg.Decimation)
+	if err != nil {
+		return nil, err
+	}
+
+	// Failed packets are kept for OnChecksumFail, Run drops them unless
+	// AllowBadCRC is set.
+	for _, p := range parsers {
+		if s, ok := p.(parse.BadCRCSetter); ok {
+			s.SetAllowBadCRC(true)
+		}
+	}
+
+	if cfg.CenterFreq == 0 {
+		cfg.CenterFreq = parsers[0].Cfg().CenterFreq
+	}
+	if cfg.SampleRate == 0 {
+		cfg.SampleRate = parsers[0].Cfg().SampleRate
+	}
+
+	return &Receiver{cfg: cfg, parsers: parsers}, nil
+}
+
+// blockSize returns the length in bytes of the blocks read from the source,
+// the largest of the parsers' block sizes. Block sizes are powers of two, so
+// each parser decodes whole blocks of its own size from it.
+func (rcvr *Receiver) blockSize() (size int) {
+	for _, p := range rcvr.parsers {
+		size = max(size, p.Cfg().BlockSize2)
+	}
+	return size
+}
+
+// Config returns the receiver's configuration with defaults filled in.
+func (rcvr *Receiver) Config() Config {
+	return rcvr.cfg
+}
+
+// Run opens the receiver's sample source and calls handler with each message
+// received until ctx is cancelled, the source is exhausted or fails, or
+// handler returns an error. Returns nil once the source is exhausted, and
+// ctx's error once cancelled.
+func (rcvr *Receiver) Run(ctx context.Context, handler Handler) error {
+	return rcvr.run(ctx, func(msg parse.LogMessage) error {
+		rcvr.emit(&msg)
+		return handler(msg)
+	})
+}
+
+// run decodes the messages Run and Stream deliver, passing them to handler
+// once the OnPacket hooks have been called.
+func (rcvr *Receiver) run(ctx context.Context, handler Handler) error {
+	src, err := rcvr.open()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	// Unblock reading once ctx is cancelled, even if the source has stopped
+	// delivering samples.
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-ctx.Done():
+			src.Close()
+		case <-stopped:
+		}
+	}()
+
+	offsetter, _ := src.(Offsetter)
+	clocker, _ := src.(Clocker)
+
+	block := make([]byte, rcvr.blockSize())
+	var read int64 // Samples read, ending with the current block.
+	for n := uint64(0); ; n++ {
+		if err := src.Read(block); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("reading samples: %w", err)
+		}
+
+		read += int64(len(block) >> 1)
+
+		start := rcvr.cfg.Clock.Now()
+		meta := Meta{Time: start, Block: n, Offset: -1, Length: len(block)}
+		if offsetter != nil {
+			meta.Offset = offsetter.Offset()
+		}
+		if clocker != nil {
+			meta.Time = clocker.Time()
+		}
+		rcvr.samples(block, meta)
+
+		stats := BlockStats{Meta: meta}
+		for _, p := range rcvr.parsers {
+			size := p.Cfg().BlockSize2
+			for offset := 0; offset < len(block); offset += size {
+				decodeStart := rcvr.cfg.Clock.Now()
+				indices := p.Dec().Decode(block[offset : offset+size])
+				parseStart := rcvr.cfg.Clock.Now()
+				pkts := p.Parse(indices)
+				parseEnd := rcvr.cfg.Clock.Now()
+
+				// Packets are located within the part of the block decoded.
+				meta := meta
+				end := read - int64(len(block)-offset-size)>>1
+				meta.Start, meta.Count = locate(p.Dec(), end, indices)
+				stats.Candidates += len(indices)
+				stats.Packets += len(pkts)
+				stats.Elapsed += parseEnd.Sub(decodeStart)
+				rcvr.decode(Decode{
+					Meta:     meta,
+					Parser:   p,
+					Indices:  indices,
+					Packets:  pkts,
+					Decoding: parseStart.Sub(decodeStart),
+					Parsing:  parseEnd.Sub(parseStart),
+				})
+
+				if err := rcvr.deliver(pkts, meta, offsetter != nil, handler); err != nil {
+					return err
+				}
+			}
+		}
+
+		rcvr.block(stats)
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+}
+
+// deliver filters the packets decoded from a block and passes the messages
+// wrapping those left to handler, once the OnPacket hooks have been called.
+// Messages carry the block's offset and length if the source has offsets.
+func (rcvr *Receiver) deliver(pkts []parse.Message, meta Meta, offsets bool, handler Handler) error {
+	for _, pkt := range pkts {
+		if !pkt.ChecksumOK() {
+			rcvr.checksumFail(pkt.Raw(), meta)
+			if !rcvr.cfg.AllowBadCRC {
+				continue
+			}
+		}
+		if !rcvr.filter(pkt, meta) {
+			continue
+		}
+		if rcvr.cfg.Filter != nil && !rcvr.cfg.Filter.Match(pkt) {
+			continue
+		}
+
+		msg := rcvr.message(meta.Time, pkt)
+		if offsets {
+			msg.Offset, msg.Length = meta.Offset, meta.Length
+		}
+		rcvr.packet(&msg, meta)
+		if err := handler(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stream runs the receiver in the background, sending each message on the
+// returned channel. Messages wait for the consumer in a buffer holding at most
+// Config.StreamBuffer, and OnEmit hooks are called as each is taken from the
+// buffer to be sent, so those discarded with Config.DropOldest aren't
+// emitted. Once the receiver stops and the buffer is empty, the error which
+// stopped it is sent on the error channel, unless ctx was cancelled, and both
+// channels are closed. Messages still buffered once ctx is cancelled are
+// discarded.
+func (rcvr *Receiver) Stream(ctx context.Context) (<-chan parse.LogMessage, <-chan error) {
+	queue := make(chan parse.LogMessage, rcvr.cfg.StreamBuffer)
+	msgs := make(chan parse.LogMessage)
+	errs := make(chan error, 1)
+
+	var err error // Set before queue is closed.
+	go func() {
+		defer close(queue)
+
+		err = rcvr.run(ctx, func(msg parse.LogMessage) error {
+			if !rcvr.cfg.DropOldest {
+				// Once cancelled the message is discarded, and run stops
+				// after the block's hooks have been called.
+				select {
+				case queue <- msg:
+				case <-ctx.Done():
+				}
+				return nil
+			}
+
+			// The delivering goroutine may take the oldest message before
+			// we do, either way there's then room.
+			for {
+				select {
+				case queue <- msg:
+					return nil
+				default:
+				}
+				select {
+				case <-queue:
+					rcvr.overrun(rcvr.dropped.Add(1))
+				default:
+				}
+			}
+		})
+	}()
+
+	go func() {
+		defer close(errs)
+		defer close(msgs)
+
+		for msg := range queue {
+			if ctx.Err() != nil {
+				continue
+			}
+			rcvr.emit(&msg)
+			select {
+			case msgs <- msg:
+			case <-ctx.Done():
+			}
+		}
+		if err != nil && ctx.Err() == nil {
+			errs <- err
+		}
+	}()
+
+	return msgs, errs
+}
+
+// Dropped returns the number of messages Stream has discarded with
+// Config.DropOldest.
+func (rcvr *Receiver) Dropped() uint64 {
+	return rcvr.dropped.Load()
+}
+
+// locate returns the first sample and number of samples, counted from the
+// start of the stream, of the packets decoded from a block ending at sample
+// end given the preamble indices the decoder found in it. The earliest index
+// is used, or the decoder's whole window if there are none.
+func locate(d decode.Decoder, end int64, indices []int) (start, count int64) {
+	dec := int64(d.Decimation)
+
+	// The decoder's buffer ends with the newest block.
+	start = end - int64(d.DecCfg.BufferLength)*dec
+	count = int64(d.DecCfg.BufferLength) * dec
+	if len(indices) > 0 {
+		first := indices[0]
+		for _, idx := range indices {
+			first = min(first, idx)
+		}
+		start += int64(first) * dec
+		count = int64(d.DecCfg.PacketLength) * dec
+	}
+
+	start = max(start, 0)
+	count = min(count, end-start)
+	return start, count
+}
+
+// message wraps a packet received at the given time.
+func (rcvr *Receiver) message(t time.Time, pkt parse.Message) parse.LogMessage {
+	msg := parse.LogMessage{
+		Time:          t,
+		SchemaVersion: parse.SchemaVersion,
+		ReceiverID:    rcvr.cfg.ReceiverID,
+		Commit:        rcvr.cfg.Commit,
+		CenterFreq:    rcvr.cfg.CenterFreq,
+		SampleRate:    rcvr.cfg.SampleRate,
+		Backend:       rcvr.backend,
+		Message:       pkt,
+	}
+
+	if rcvr.cfg.RawHex || !pkt.ChecksumOK() {
+		msg.RawHex = fmt.Sprintf("%02X", pkt.Raw())
+	}
+	if rcvr.cfg.AllowBadCRC {
+		checksumOK := pkt.ChecksumOK()
+		msg.ChecksumOK = &checksumOK
+	}
+
+	return msg
+}
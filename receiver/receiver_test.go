@@ -0,0 +1,376 @@
+package receiver
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bemasher/rtlamr/clock"
+	"github.com/bemasher/rtlamr/gen"
+	"github.com/bemasher/rtlamr/parse"
+)
+
+// fakeRTLTCP serves samples repeatedly to each connection, discarding tuner
+// commands. Returns the server's address.
+func fakeRTLTCP(t *testing.T, samples []byte) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				go func() {
+					buf := make([]byte, 5)
+					for {
+						if _, err := conn.Read(buf); err != nil {
+							return
+						}
+					}
+				}()
+				if _, err := conn.Write(append([]byte("RTL0"), make([]byte, 8)...)); err != nil {
+					return
+				}
+				for {
+					if _, err := conn.Write(samples); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+// scmSignal returns a generated SCM packet followed by samples without any
+// signal.
+func scmSignal(t *testing.T) []byte {
+	t.Helper()
+
+	pkt, err := gen.NewRandSCM()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return packetSignal(t, pkt)
+}
+
+// packetSignal returns samples of the given SCM packet followed by samples
+// without any signal.
+func packetSignal(t *testing.T, pkt []byte) []byte {
+	t.Helper()
+
+	p, err := parse.NewParser("scm", 72, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sampleRate := float64(p.Cfg().SampleRate)
+
+	bits := gen.Upsample(gen.UnpackBits(gen.NewManchesterLUT().Encode(pkt)), 72<<1)
+
+	carrier := gen.CmplxOscillatorF64(len(bits)>>1, 10e3, sampleRate)
+	for idx := range carrier {
+		carrier[idx] *= float64(bits[idx])
+	}
+
+	signal := make([]byte, len(carrier)+1<<16)
+	gen.F64toU8(carrier, signal[:len(carrier)])
+	for idx := len(carrier); idx < len(signal); idx++ {
+		signal[idx] = 127
+	}
+
+	return signal
+}
+
+func TestNewDefaults(t *testing.T) {
+	rcvr, err := New(Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := rcvr.Config()
+	if cfg.Server != "127.0.0.1:1234" || cfg.MsgType != "scm" || cfg.SymbolLength != 72 || cfg.Decimation != 1 {
+		t.Errorf("unexpected defaults: %+v", cfg)
+	}
+	if cfg.CenterFreq == 0 || cfg.SampleRate == 0 {
+		t.Errorf("tuning not taken from the message type: %+v", cfg)
+	}
+
+	if _, err := New(Config{MsgType: "bogus"}); err == nil {
+		t.Error("expected an error for an unknown message type")
+	}
+}
+
+func TestRun(t *testing.T) {
+	server := fakeRTLTCP(t, scmSignal(t))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Two receivers share the process without sharing state.
+	errDone := errors.New("done")
+	results := make(chan error, 2)
+	for _, id := range []string{"a", "b"} {
+		rcvr, err := New(Config{Server: server, ReceiverID: id})
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func(id string) {
+			results <- rcvr.Run(ctx, func(msg parse.LogMessage) error {
+				if msg.ReceiverID != id || msg.MsgType() != "SCM" || msg.Backend != Backend {
+					t.Errorf("unexpected message: %+v", msg)
+				}
+				return errDone
+			})
+		}(id)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := <-results; !errors.Is(err, errDone) {
+			t.Errorf("Run returned %v, want the handler's error", err)
+		}
+	}
+}
+
+func TestRunCancel(t *testing.T) {
+	server := fakeRTLTCP(t, scmSignal(t))
+	rcvr, err := New(Config{Server: server})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	err = rcvr.Run(ctx, func(parse.LogMessage) error {
+		cancel()
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Run returned %v, want context.Canceled", err)
+	}
+}
+
+func TestStreamDropOldest(t *testing.T) {
+	server := fakeRTLTCP(t, scmSignal(t))
+	rcvr, err := New(Config{Server: server, StreamBuffer: 1, DropOldest: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var overruns atomic.Uint64
+	rcvr.OnOverrun("count", func(count uint64) {
+		overruns.Store(count)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	msgs, errs := rcvr.Stream(ctx)
+
+	// Messages keep arriving while nobody is reading.
+	deadline := time.After(10 * time.Second)
+	for rcvr.Dropped() < 3 {
+		select {
+		case <-deadline:
+			t.Fatalf("dropped %d messages, want at least 3", rcvr.Dropped())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	if _, ok := <-msgs; !ok {
+		t.Error("expected a buffered message")
+	}
+	if overruns.Load() < 3 {
+		t.Errorf("OnOverrun saw %d messages dropped, want at least 3", overruns.Load())
+	}
+
+	cancel()
+	for range msgs {
+	}
+	if err, ok := <-errs; ok {
+		t.Errorf("unexpected error after cancellation: %v", err)
+	}
+}
+
+// heldLocker records whether it's held, to check hooks are called holding
+// Config.Locker.
+type heldLocker struct {
+	mu   sync.Mutex
+	held atomic.Bool
+}
+
+func (l *heldLocker) Lock() {
+	l.mu.Lock()
+	l.held.Store(true)
+}
+
+func (l *heldLocker) Unlock() {
+	l.held.Store(false)
+	l.mu.Unlock()
+}
+
+func TestStreamEmit(t *testing.T) {
+	locker := new(heldLocker)
+	rcvr, err := NewFromSource(Config{Locker: locker}, NewReaderSource(bytes.NewReader(scmSignal(t))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	emitted := 0
+	rcvr.OnEmit("name", func(msg *parse.LogMessage) {
+		if !locker.held.Load() {
+			t.Error("emit hook called without holding Config.Locker")
+		}
+		emitted++
+		msg.MeterName = "emitted"
+	})
+
+	msgs, errs := rcvr.Stream(context.Background())
+	received := 0
+	for msg := range msgs {
+		if msg.MeterName != "emitted" {
+			t.Errorf("message sent before it was emitted: %+v", msg)
+		}
+		received++
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	locker.Lock()
+	defer locker.Unlock()
+	if received != 1 || emitted != 1 {
+		t.Errorf("emitted %d and received %d messages, want 1", emitted, received)
+	}
+}
+
+func TestReaderSource(t *testing.T) {
+	samples, err := os.ReadFile("testdata/scm.cu8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A partial block at the end is ignored.
+	samples = append(samples, 127, 127)
+
+	// Blocks are timed by the configured clock.
+	epoch := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	cfg := Config{ReceiverID: "file", Clock: clock.NewFake(epoch)}
+	rcvr, err := NewFromSource(cfg, NewReaderSource(bytes.NewReader(samples)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	blockSize := rcvr.blockSize()
+
+	var msgs []parse.LogMessage
+	err = rcvr.Run(context.Background(), func(msg parse.LogMessage) error {
+		msgs = append(msgs, msg)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Run returned %v at the end of the source", err)
+	}
+
+	if len(msgs) != 2 {
+		t.Fatalf("received %d messages, want 2", len(msgs))
+	}
+	for _, msg := range msgs {
+		if msg.Backend != "reader" {
+			t.Errorf("backend %q, want reader", msg.Backend)
+		}
+		if !msg.Time.Equal(epoch) {
+			t.Errorf("time %s, want the clock's %s", msg.Time, epoch)
+		}
+		if msg.Length != blockSize || msg.Offset%int64(blockSize) != 0 || msg.Offset >= int64(len(samples)) {
+			t.Errorf("unexpected provenance: offset %d, length %d", msg.Offset, msg.Length)
+		}
+	}
+	if msgs[0].Offset >= msgs[1].Offset {
+		t.Errorf("offsets not increasing: %d, %d", msgs[0].Offset, msgs[1].Offset)
+	}
+}
+
+// failingSource delivers the blocks of its source, then fails with err.
+type failingSource struct {
+	SampleSource
+	err error
+}
+
+func (fs failingSource) Read(block []byte) error {
+	if err := fs.SampleSource.Read(block); err != io.EOF {
+		return err
+	}
+	return fs.err
+}
+
+func TestSourceError(t *testing.T) {
+	samples, err := os.ReadFile("testdata/scm.cu8")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A source failing mid-stream, as a dongle may, stops Run with its error
+	// once the samples before it are decoded.
+	errUSB := errors.New("usb: device babble")
+	src := failingSource{NewReaderSource(bytes.NewReader(samples)), errUSB}
+	rcvr, err := NewFromSource(Config{}, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	received := 0
+	go func() {
+		done <- rcvr.Run(context.Background(), func(parse.LogMessage) error {
+			received++
+			return nil
+		})
+	}()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, errUSB) {
+			t.Errorf("Run returned %v, want the source's error", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run didn't return after the source failed")
+	}
+	if received != 2 {
+		t.Errorf("received %d messages before the error, want 2", received)
+	}
+}
+
+func TestDisconnected(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		conn.Write(append([]byte("RTL0"), make([]byte, 8)...))
+		conn.Close()
+	}()
+
+	rcvr, err := New(Config{Server: l.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rcvr.Run(context.Background(), func(parse.LogMessage) error { return nil }); !errors.Is(err, errDisconnected) {
+		t.Errorf("Run returned %v, want errDisconnected", err)
+	}
+}
@@ -0,0 +1,159 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package receiver
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/bemasher/rtltcp"
+)
+
+// SampleSource supplies interleaved 8-bit inphase and quadrature samples.
+// Close may be called concurrently with Read to unblock it.
+type SampleSource interface {
+	// Read fills block with the next samples. Returns io.EOF once the
+	// source is exhausted.
+	Read(block []byte) error
+	Close() error
+}
+
+// Offsetter is implemented by sample sources which can report where in the
+// source the last block read began, in bytes. Messages decoded from the
+// block carry it in Offset and the block's length in Length.
+type Offsetter interface {
+	Offset() int64
+}
+
+// Clocker is implemented by sample sources which know when their samples
+// were received, such as a replay synthesizing times from the position in a
+// recording. Messages decoded from the last block read carry Time in place
+// of the time the block was read.
+type Clocker interface {
+	Time() time.Time
+}
+
+// Backender is implemented by sample sources which name themselves in the
+// Backend field of messages.
+type Backender interface {
+	Backend() string
+}
+
+// readerSource reads samples from an io.Reader.
+type readerSource struct {
+	r      io.Reader
+	offset int64
+	next   int64
+}
+
+// NewReaderSource returns a sample source reading from r, such as a file
+// written by -samplefile or samples piped to stdin. If r is an io.Closer it's
+// closed along with the source.
+func NewReaderSource(r io.Reader) SampleSource {
+	return &readerSource{r: r}
+}
+
+func (rs *readerSource) Read(block []byte) error {
+	n, err := io.ReadFull(rs.r, block)
+	rs.offset, rs.next = rs.next, rs.next+int64(n)
+	// A partial block at the end of the source holds too few samples to
+	// decode.
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return err
+}
+
+func (rs *readerSource) Backend() string {
+	return "reader"
+}
+
+func (rs *readerSource) Offset() int64 {
+	return rs.offset
+}
+
+func (rs *readerSource) Close() error {
+	if c, ok := rs.r.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// errDisconnected is returned once rtl_tcp closes the connection, which
+// unlike the end of a file isn't the expected end of samples.
+var errDisconnected = errors.New("rtl_tcp closed the connection")
+
+// tcpSource reads samples from rtl_tcp.
+type tcpSource struct {
+	sdr rtltcp.SDR
+}
+
+// dial connects to rtl_tcp and tunes it for cfg.
+func dial(cfg Config) (*tcpSource, error) {
+	src := new(tcpSource)
+	src.sdr.Flags.ServerAddr = cfg.Server
+	if err := src.sdr.Connect(nil); err != nil {
+		return nil, fmt.Errorf("connecting to rtl_tcp: %w", err)
+	}
+
+	if err := src.tune(cfg); err != nil {
+		src.Close()
+		return nil, fmt.Errorf("tuning: %w", err)
+	}
+
+	return src, nil
+}
+
+// tune applies the center frequency, sample rate and gain settings.
+func (src *tcpSource) tune(cfg Config) error {
+	errs := []error{
+		src.sdr.SetCenterFreq(cfg.CenterFreq),
+		src.sdr.SetSampleRate(uint32(cfg.SampleRate)),
+	}
+
+	switch {
+	case cfg.AGC:
+		errs = append(errs, src.sdr.SetAGCMode(true))
+	case cfg.TunerGain != 0:
+		errs = append(errs,
+			src.sdr.SetGainMode(true),
+			src.sdr.SetGain(uint32(cfg.TunerGain*10)),
+		)
+	default:
+		errs = append(errs, src.sdr.SetGainMode(true))
+	}
+
+	if cfg.FreqCorrection != 0 {
+		errs = append(errs, src.sdr.SetFreqCorrection(uint32(cfg.FreqCorrection)))
+	}
+
+	return errors.Join(errs...)
+}
+
+func (src *tcpSource) Read(block []byte) error {
+	_, err := io.ReadFull(&src.sdr, block)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return errDisconnected
+	}
+	return err
+}
+
+func (src *tcpSource) Close() error {
+	return src.sdr.Close()
+}
@@ -0,0 +1,108 @@
+package receiver
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/bemasher/rtlamr/parse"
+	"github.com/bemasher/rtlamr/parse/parsetest"
+)
+
+// TestSynthetic decodes each synthetic fixture through a receiver reading
+// from a file, as replay does.
+func TestSynthetic(t *testing.T) {
+	cases, err := parsetest.Cases()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			r, err := c.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			cfg := Config{MsgType: c.MsgType, SymbolLength: c.SymbolLength}
+			rcvr, err := NewFromSource(cfg, NewReaderSource(r))
+			if err != nil {
+				r.Close()
+				t.Fatal(err)
+			}
+
+			var msgs []parse.Message
+			err = rcvr.Run(context.Background(), func(msg parse.LogMessage) error {
+				msgs = append(msgs, msg.Message)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			parsetest.Compare(t, c, msgs)
+		})
+	}
+}
+
+// TestMultipleTypes decodes the fixtures of the message types sharing a
+// center frequency and sample rate from one stream of samples.
+func TestMultipleTypes(t *testing.T) {
+	cases, err := parsetest.Cases()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var samples bytes.Buffer
+	want := make(map[string]int)
+	for _, c := range cases {
+		if c.MsgType == "r900" {
+			continue
+		}
+
+		r, err := c.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = io.Copy(&samples, r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		msgs, err := parsetest.Decode(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, msg := range msgs {
+			want[msg.MsgType()]++
+		}
+	}
+
+	cfg := Config{MsgType: "scm,scm+,idm"}
+	rcvr, err := NewFromSource(cfg, NewReaderSource(&samples))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(map[string]int)
+	err = rcvr.Run(context.Background(), func(msg parse.LogMessage) error {
+		got[msg.MsgType()]++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("received %v messages of each type, want %v", got, want)
+	}
+
+	for _, msgType := range []string{"scm,r900", "scm,scm"} {
+		if _, err := New(Config{MsgType: msgType}); err == nil {
+			t.Errorf("expected an error decoding %s together", msgType)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// reopen opens name for appending, creating it if f was renamed or removed,
+// and closes f. The new file is positioned at its end since the offsets of
+// logged messages are read from the sample file's position.
+func reopen(f *os.File, name string) (*os.File, error) {
+	defer f.Close()
+
+	nf, err := openOutput(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := nf.Seek(0, io.SeekEnd); err != nil {
+		nf.Close()
+		return nil, err
+	}
+
+	return nf, nil
+}
+
+// reopenSampleFile reopens -samplefile by the given name for appending, such
+// as after a failed write to a full disk. A compressed file's stream is ended
+// first so it decompresses in full.
+func (rcvr *Receiver) reopenSampleFile(name string) error {
+	if err := rcvr.sampleFile.Stop(); err != nil {
+		slog.Error("compressing sample file", "err", err)
+	}
+
+	f, err := reopen(rcvr.sampleFile.File, name)
+	if err != nil {
+		return err
+	}
+
+	// Offsets in a compressed file appended to continue from the samples
+	// already in it.
+	var pos int64
+	if fi, err := f.Stat(); err == nil && fi.Size() != 0 && name == rcvr.sampleFile.Name() {
+		pos = rcvr.sampleFile.Position()
+	}
+	rcvr.sampleFile = newSampleFile(f, pos)
+	return nil
+}
+
+// notifyHangup returns a channel receiving SIGHUP until ctx is done, when the
+// signal is no longer relayed. SIGHUP is the one signal reopening output
+// files after logrotate renames them and reloading filter files, so it's
+// only handled here.
+func notifyHangup(ctx context.Context) <-chan os.Signal {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		<-ctx.Done()
+		signal.Stop(hangup)
+	}()
+	return hangup
+}
+
+// reopenOutputs reopens -logfile, -logoutput, -samplefile,
+// -samplefile.index and -dumpbits on SIGHUP, which logrotate sends after
+// renaming them. Templated paths are expanded again, so a path including the
+// time starts a new file.
+func (rcvr *Receiver) reopenOutputs(bitDumper *BitDumper, index *SampleIndex) {
+	now := time.Now()
+	rename := func(path string, f *os.File) string {
+		name, err := expandPath(path, now)
+		if err != nil {
+			return f.Name()
+		}
+		return name
+	}
+
+	if rcvr.out.logFile != nil {
+		rcvr.out.Reopen(rename(*logFilename, rcvr.out.logFile))
+	}
+
+	if logOutputFile != nil {
+		if f, err := reopen(logOutputFile, rename(*logOutput, logOutputFile)); err != nil {
+			slog.Error("reopening log output", "err", err)
+		} else {
+			logSink.SetOutput(f)
+			logOutputFile = f
+			logReopened(f)
+		}
+	}
+
+	if *sampleFilename != os.DevNull {
+		if err := rcvr.reopenSampleFile(sampleFileName(rename(*sampleFilename, rcvr.sampleFile.File))); err != nil {
+			slog.Error("reopening sample file", "err", err)
+		} else {
+			logReopened(rcvr.sampleFile.File)
+		}
+	}
+
+	if sampleIndexFile != nil {
+		if f, err := reopen(sampleIndexFile, rename(*sampleIndex, sampleIndexFile)); err != nil {
+			slog.Error("reopening sample index", "err", err)
+		} else {
+			sampleIndexFile = f
+			index.SetWriter(f)
+			logReopened(f)
+		}
+	}
+
+	if rcvr.dumpBitsFile != nil {
+		f, err := reopen(rcvr.dumpBitsFile, rename(*dumpBits, rcvr.dumpBitsFile))
+		if err != nil {
+			slog.Error("reopening bit dump file", "err", err)
+			return
+		}
+		rcvr.dumpBitsFile = f
+		bitDumper.SetWriter(f)
+		logReopened(f)
+	}
+}
+
+func logReopened(f *os.File) {
+	fi, err := f.Stat()
+	if err != nil {
+		log.Printf("Reopened %s\n", f.Name())
+		return
+	}
+
+	if ino, ok := inode(fi); ok {
+		log.Printf("Reopened %s, inode %d\n", f.Name(), ino)
+	} else {
+		log.Printf("Reopened %s\n", f.Name())
+	}
+}
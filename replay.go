@@ -0,0 +1,449 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bemasher/rtlamr/parse"
+	"github.com/bemasher/rtlamr/receiver"
+)
+
+// runReplay decodes files of samples, writing messages like receive.
+func runReplay(args []string) int {
+	fs := newSubcommandFlags("replay", "file.cu8 ...")
+	msgType := fs.String("msgtype", "scm", "message type the samples were recorded for: scm, scm+, idm, r900 or r900bcd")
+	symbolLength := fs.Int("symbollength", 72, "symbol length in samples the samples were recorded with")
+	format := fs.String("format", "plain", "format to write messages in: plain, csv, json or xml")
+	loop := loopFlag(1)
+	fs.Var(&loop, "loop", "number of times to decode the files, 0 or -loop alone to repeat until interrupted")
+	start := fs.Duration("start", 0, "position in each file to begin decoding at")
+	duration := fs.Duration("duration", 0, "length of samples to decode from each file, 0 for the rest of the file")
+	pace := fs.Bool("pace", false, "decode no faster than the samples were recorded, the same as -speed=1")
+	speed := fs.Float64("speed", 0, "multiple of real time to decode at, 0 for as fast as possible")
+	fakeTime := fs.Bool("faketime", false, "stamp messages with times synthesized from their position in the samples, advancing across files and passes")
+	allowBadCRC := fs.Bool("allowbadcrc", false, "also write packets which failed their checksum")
+	index := fs.String("index", "", "decode only the packets located by a -samplefile.index, verifying each decodes again, in the files given or those the index names")
+	ids := NewMeterIDFilter()
+	fs.Var(ids, "filterid", "write only messages matching an id in a comma-separated list of ids, ranges or wildcards")
+	files, status, exit := parseSubcommandArgs(fs, args)
+	if exit {
+		return status
+	}
+
+	if *index != "" {
+		if *start != 0 || *duration != 0 || loop != 1 {
+			log.Println("replay: -index can't be combined with -start, -duration or -loop")
+			return exitUsage
+		}
+	} else if len(files) == 0 {
+		log.Println("replay: expected at least one file of samples")
+		fs.Usage()
+		return exitUsage
+	}
+	if slices.Contains(files, "-") && loop != 1 {
+		log.Println("replay: samples read from stdin can't be decoded more than once with -loop")
+		return exitUsage
+	}
+	if *start < 0 || *duration < 0 || *speed < 0 {
+		log.Println("replay: -start, -duration and -speed must not be negative")
+		return exitUsage
+	}
+	if *pace && *speed == 0 {
+		*speed = 1
+	}
+
+	cfg := receiver.Config{
+		MsgType:      *msgType,
+		SymbolLength: *symbolLength,
+		AllowBadCRC:  *allowBadCRC,
+		Filter:       new(parse.FilterChain),
+	}
+	if ids.String() != "" {
+		if err := ids.Resolve(strings.ToLower(*msgType)); err != nil {
+			log.Println("-filterid:", err)
+			return exitUsage
+		}
+		cfg.Filter.Add("filterid", ids)
+	}
+
+	enc, err := newEncoder(*format, stdoutWriter{})
+	if err != nil {
+		log.Println("-format:", err)
+		return exitUsage
+	}
+	defer func() {
+		if err := endDocuments(enc); err != nil {
+			log.Println("replay:", err)
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sig := notifyShutdown()
+	defer signal.Stop(sig)
+	go cancelOnSignal(ctx, cancel, sig)
+
+	r := replay{start: *start, duration: *duration, speed: *speed, enc: enc}
+	if *fakeTime {
+		r.clock = time.Now()
+	}
+
+	if *index != "" {
+		return r.indexed(ctx, cfg, *index, files)
+	}
+
+	for pass := 1; loop == 0 || pass <= int(loop); pass++ {
+		r.stats = replayStats{}
+		began := time.Now()
+		for _, name := range files {
+			status, err := r.file(ctx, cfg, name)
+			if ctx.Err() != nil {
+				return exitOK
+			}
+			if err != nil {
+				log.Printf("replay: %s: %s\n", name, err)
+				return status
+			}
+		}
+		log.Printf("replay: pass %d: %s\n", pass, r.stats.summary(time.Since(began)))
+	}
+
+	return exitOK
+}
+
+// indexed decodes the windows of recordings holding the packets located by
+// the named index, verifying each packet decodes again. Recordings given in
+// files replace those of the same name in the index and only their packets
+// are decoded. Returns the exit status.
+func (r *replay) indexed(ctx context.Context, cfg receiver.Config, name string, files []string) int {
+	recs, err := ReadSampleIndex(name)
+	if err != nil {
+		log.Println("replay: -index:", err)
+		return exitUsage
+	}
+
+	if len(files) != 0 {
+		given := make(map[string]string)
+		for _, file := range files {
+			given[filepath.Base(file)] = file
+		}
+		var kept []IndexRecord
+		for _, rec := range recs {
+			if file, ok := given[filepath.Base(rec.File)]; ok {
+				rec.File = file
+				kept = append(kept, rec)
+			}
+		}
+		recs = kept
+	}
+
+	windows, err := indexWindows(recs, func(msgType string) (int64, error) {
+		pktCfg, err := parse.Config(strings.ToLower(msgType), cfg.SymbolLength)
+		return int64(pktCfg.BlockSize2), err
+	})
+	if err != nil {
+		log.Println("replay: -index:", err)
+		return exitUsage
+	}
+
+	// Packets failing their checksum are decoded to match those indexed, but
+	// only written with -allowbadcrc. Packets are matched before filtering.
+	allowBadCRC, filter := cfg.AllowBadCRC, cfg.Filter
+	cfg.AllowBadCRC, cfg.Filter = true, nil
+
+	began, missing := time.Now(), 0
+	for _, w := range windows {
+		cfg.MsgType = w.msgType
+		status, err := r.window(ctx, cfg, w.file, w.start, w.length, func(msg parse.LogMessage) (int, error) {
+			checksumOK := msg.Message.ChecksumOK()
+			w.match(msg.MeterID(), checksumOK)
+			if (!checksumOK && !allowBadCRC) || !filter.Match(msg.Message) {
+				return exitOK, nil
+			}
+			return r.write(msg)
+		})
+		if ctx.Err() != nil {
+			return exitOK
+		}
+		if err != nil {
+			log.Printf("replay: %s: %s\n", w.file, err)
+			return status
+		}
+
+		for _, rec := range w.recs {
+			log.Printf("replay: %s: %s packet from %d at sample %d didn't decode again\n", w.file, rec.MsgType, rec.MeterID, rec.Offset)
+		}
+		missing += len(w.recs)
+	}
+
+	log.Printf("replay: index: %s\n", r.stats.summary(time.Since(began)))
+	log.Printf("replay: index: %d of %d packets decoded again\n", len(recs)-missing, len(recs))
+	if missing != 0 {
+		return exitNoMessages
+	}
+	return exitOK
+}
+
+// replay decodes windows of files of samples, writing messages to enc.
+type replay struct {
+	start, duration time.Duration
+	speed           float64
+	enc             Encoder
+
+	// clock is the synthesized time of the first sample replayed, zero
+	// unless -faketime is given. samples counts those replayed since, so
+	// times keep advancing across files and passes.
+	clock   time.Time
+	samples int64
+
+	stats replayStats
+}
+
+// replayStats counts what a pass decoded.
+type replayStats struct {
+	blocks, candidates, packets, failed, messages int
+	seconds                                       float64 // Of samples decoded.
+}
+
+func (s replayStats) summary(elapsed time.Duration) string {
+	return fmt.Sprintf("%d blocks, %.1fs of samples in %s (%.1fx real time), %d candidates, %d packets, %d failing their checksum, %d messages",
+		s.blocks, s.seconds, elapsed.Round(time.Millisecond), s.seconds/elapsed.Seconds(),
+		s.candidates, s.packets, s.failed, s.messages)
+}
+
+// file decodes the window of the named file given by -start and -duration.
+// Returns the exit status if it fails.
+func (r *replay) file(ctx context.Context, cfg receiver.Config, name string) (int, error) {
+	pktCfg, err := parse.Config(cfg.MsgType, cfg.SymbolLength)
+	if err != nil {
+		return exitUsage, err
+	}
+	sampleRate := float64(pktCfg.SampleRate)
+
+	// The window begins on a block boundary, so blocks and the messages
+	// decoded from them carry the same offsets as when decoding the whole
+	// file. The receiver starts afresh, so no packet is pieced together
+	// across the seek.
+	blockSize := int64(pktCfg.BlockSize2)
+	base := int64(r.start.Seconds()*sampleRate) * 2 / blockSize * blockSize
+	var length int64
+	if r.duration != 0 {
+		length = (int64(r.duration.Seconds()*sampleRate)*2 + blockSize - 1) / blockSize * blockSize
+	}
+
+	return r.window(ctx, cfg, name, base, length, r.write)
+}
+
+// write writes a message decoded by replay.
+func (r *replay) write(msg parse.LogMessage) (int, error) {
+	r.stats.messages++
+	msg.Commit = commitHash
+	if err := r.enc.Encode(msg); err != nil {
+		return exitOutput, err
+	}
+	return exitOK, nil
+}
+
+// window decodes length bytes of the named file from base, a multiple of the
+// block size, or the rest of the file if length is 0. Each message decoded is
+// passed to handle. Returns the exit status if it fails.
+func (r *replay) window(ctx context.Context, cfg receiver.Config, name string, base, length int64, handle func(parse.LogMessage) (int, error)) (int, error) {
+	pktCfg, err := parse.Config(cfg.MsgType, cfg.SymbolLength)
+	if err != nil {
+		return exitUsage, err
+	}
+	sampleRate := float64(pktCfg.SampleRate)
+
+	f, err := openSamples(name)
+	if err != nil {
+		return exitUsage, err
+	}
+
+	src := &replaySource{base: base, clock: r.clock, sampleRate: sampleRate}
+	if r.clock != (time.Time{}) {
+		src.clock = r.clock.Add(time.Duration(float64(r.samples) / sampleRate * float64(time.Second)))
+	}
+
+	var window io.Reader = f
+	if src.base != 0 {
+		// Compressed files can't seek, the samples are skipped.
+		if s, ok := f.(io.Seeker); ok {
+			_, err = s.Seek(src.base, io.SeekStart)
+		} else if _, err = io.CopyN(io.Discard, f, src.base); err == io.EOF {
+			err = nil
+		}
+		if err != nil {
+			f.Close()
+			return exitUsage, fmt.Errorf("-start: %w", err)
+		}
+	}
+	if length != 0 {
+		window = io.LimitReader(f, length)
+	}
+	src.SampleSource = receiver.NewReaderSource(struct {
+		io.Reader
+		io.Closer
+	}{window, f})
+
+	rcvr, err := receiver.NewFromSource(cfg, src)
+	if err != nil {
+		f.Close()
+		return exitUsage, err
+	}
+
+	rcvr.OnBlock("stats", func(stats receiver.BlockStats) {
+		r.stats.blocks++
+		r.stats.seconds += float64(stats.Length>>1) / sampleRate
+		r.stats.candidates += stats.Candidates
+		r.stats.packets += stats.Packets
+	})
+	rcvr.OnChecksumFail("stats", func([]byte, receiver.Meta) {
+		r.stats.failed++
+	})
+
+	if r.speed != 0 {
+		start := time.Now()
+		perBlock := time.Duration(float64(pktCfg.BlockSize) / sampleRate / r.speed * float64(time.Second))
+		rcvr.OnBlock("pace", func(stats receiver.BlockStats) {
+			time.Sleep(time.Until(start.Add(time.Duration(stats.Block+1) * perBlock)))
+		})
+	}
+
+	status := exitFatal
+	err = rcvr.Run(ctx, func(msg parse.LogMessage) error {
+		s, err := handle(msg)
+		if err != nil {
+			status = s
+		}
+		return err
+	})
+	r.samples += src.read >> 1
+	if err != nil {
+		return status, err
+	}
+
+	return exitOK, nil
+}
+
+// replaySource reads a window of a file, reporting offsets from the
+// beginning of the file and, with -faketime, synthesized times.
+type replaySource struct {
+	receiver.SampleSource
+	base int64 // Offset of the window in the file.
+	read int64 // Bytes read from the window.
+
+	clock      time.Time // Time of the window's first sample, zero for none.
+	sampleRate float64
+}
+
+func (src *replaySource) Read(block []byte) error {
+	err := src.SampleSource.Read(block)
+	if err == nil {
+		src.read += int64(len(block))
+	}
+	return err
+}
+
+func (src *replaySource) Offset() int64 {
+	return src.base + src.SampleSource.(receiver.Offsetter).Offset()
+}
+
+func (src *replaySource) Backend() string {
+	return src.SampleSource.(receiver.Backender).Backend()
+}
+
+func (src *replaySource) Time() time.Time {
+	if src.clock == (time.Time{}) {
+		return time.Now()
+	}
+	offset := src.SampleSource.(receiver.Offsetter).Offset() >> 1
+	return src.clock.Add(time.Duration(float64(offset) / src.sampleRate * float64(time.Second)))
+}
+
+// loopFlag is the number of times to replay, 0 to repeat until interrupted.
+// Given alone, -loop repeats until interrupted.
+type loopFlag int
+
+func (l *loopFlag) String() string {
+	return strconv.Itoa(int(*l))
+}
+
+func (l *loopFlag) Set(s string) error {
+	switch s {
+	case "true":
+		*l = 0
+		return nil
+	case "false":
+		*l = 1
+		return nil
+	}
+
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return fmt.Errorf("expected a count of at least 0")
+	}
+	*l = loopFlag(n)
+
+	return nil
+}
+
+func (l *loopFlag) IsBoolFlag() bool {
+	return true
+}
+
+// parseSubcommandArgs parses args like parseSubcommandFlags, allowing flags
+// to follow positional arguments, such as rtlamr replay big.cu8 -loop.
+// Arguments after -- are all positional. Returns the positional arguments.
+func parseSubcommandArgs(fs *flag.FlagSet, args []string) (positional []string, status int, exit bool) {
+	for {
+		if err := fs.Parse(args); err != nil {
+			if err == flag.ErrHelp {
+				return nil, exitOK, true
+			}
+			return nil, exitUsage, true
+		}
+
+		rest := fs.Args()
+		if consumed := len(args) - len(rest); consumed > 0 && args[consumed-1] == "--" {
+			positional = append(positional, rest...)
+			break
+		}
+		for len(rest) != 0 && (len(rest[0]) < 2 || rest[0][0] != '-') {
+			positional = append(positional, rest[0])
+			rest = rest[1:]
+		}
+		if len(rest) == 0 {
+			break
+		}
+		args = rest
+	}
+	EnvOverride(fs, os.Getenv)
+
+	return positional, 0, false
+}
@@ -0,0 +1,90 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// Failures of a single operation are logged at most once per interval.
+const retryLogInterval = time.Minute
+
+// RetryPolicy bounds how long the receiver recovers from a failing operation
+// before giving up.
+type RetryPolicy struct {
+	Max        int           // Consecutive failures tolerated, 0 for no limit.
+	Backoff    time.Duration // Delay before the first retry.
+	MaxBackoff time.Duration // Limit of the delay, which doubles with each failure.
+}
+
+// retrier tracks consecutive failures of a single operation such as reading
+// samples or writing messages.
+type retrier struct {
+	Op     string
+	Policy RetryPolicy
+	Status int // Exit status once the policy gives up.
+
+	failures   int
+	logged     time.Time
+	suppressed int
+}
+
+// Fail records a failure of the operation. Returns a fatal error once the
+// policy's limit of consecutive failures is exceeded, otherwise nil and the
+// caller should recover and carry on.
+func (r *retrier) Fail(err error) error {
+	r.failures++
+
+	if r.Policy.Max != 0 && r.failures > r.Policy.Max {
+		return withStatus(r.Status, fmt.Errorf("%s: giving up after %d consecutive failures: %s", r.Op, r.failures, err))
+	}
+
+	now := time.Now()
+	if now.Sub(r.logged) < retryLogInterval {
+		r.suppressed++
+		return nil
+	}
+
+	if r.suppressed != 0 {
+		slog.Warn(r.Op, "err", err, "suppressed", r.suppressed)
+	} else {
+		slog.Warn(r.Op, "err", err)
+	}
+	r.logged, r.suppressed = now, 0
+
+	return nil
+}
+
+// Succeed resets the count of consecutive failures. Logging remains rate
+// limited so an operation failing intermittently isn't logged every time.
+func (r *retrier) Succeed() {
+	r.failures = 0
+}
+
+// Backoff returns the delay before the next attempt.
+func (r *retrier) Backoff() time.Duration {
+	d := r.Policy.Backoff
+	for i := 1; i < r.failures && d < r.Policy.MaxBackoff; i++ {
+		d <<= 1
+	}
+	if r.Policy.MaxBackoff != 0 && d > r.Policy.MaxBackoff {
+		d = r.Policy.MaxBackoff
+	}
+	return d
+}
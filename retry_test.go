@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRetrier(t *testing.T) {
+	r := retrier{Op: "testing", Policy: RetryPolicy{2, time.Second, 3 * time.Second}}
+	errFail := errors.New("fail")
+
+	for i, expt := range []time.Duration{time.Second, 2 * time.Second} {
+		if err := r.Fail(errFail); err != nil {
+			t.Fatalf("failure %d: expected nil got %q\n", i+1, err)
+		}
+		if recv := r.Backoff(); recv != expt {
+			t.Fatalf("failure %d: expected backoff %s got %s\n", i+1, expt, recv)
+		}
+	}
+
+	if err := r.Fail(errFail); err == nil {
+		t.Fatalf("Expected error after exceeding %d failures\n", r.Policy.Max)
+	}
+	if recv := r.Backoff(); recv != 3*time.Second {
+		t.Fatalf("Expected backoff limited to %s got %s\n", r.Policy.MaxBackoff, recv)
+	}
+
+	r.Succeed()
+	if err := r.Fail(errFail); err != nil {
+		t.Fatalf("Expected nil after success got %q\n", err)
+	}
+	if recv := r.Backoff(); recv != time.Second {
+		t.Fatalf("Expected backoff reset to %s got %s\n", r.Policy.Backoff, recv)
+	}
+}
+
+func TestRetrierUnlimited(t *testing.T) {
+	r := retrier{Op: "testing", Policy: RetryPolicy{0, time.Second, time.Minute}}
+	for i := 0; i < 100; i++ {
+		if err := r.Fail(errors.New("fail")); err != nil {
+			t.Fatalf("failure %d: expected nil got %q\n", i+1, err)
+		}
+	}
+	if recv := r.Backoff(); recv != time.Minute {
+		t.Fatalf("Expected backoff %s got %s\n", time.Minute, recv)
+	}
+}
@@ -0,0 +1,228 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ByteSize is a flag value of a number of bytes with an optional unit, such
+// as 1GB. Units KB, MB, GB and TB are powers of 1000, KiB, MiB, GiB and TiB
+// powers of 1024.
+type ByteSize int64
+
+var byteUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"TiB", 1 << 40}, {"TB", 1e12}, {"GiB", 1 << 30}, {"GB", 1e9},
+	{"MiB", 1 << 20}, {"MB", 1e6}, {"KiB", 1 << 10}, {"KB", 1e3},
+	{"B", 1},
+}
+
+func (b *ByteSize) String() string {
+	for _, u := range byteUnits {
+		if *b != 0 && int64(*b)%u.size == 0 {
+			return strconv.FormatInt(int64(*b)/u.size, 10) + u.suffix
+		}
+	}
+	return strconv.FormatInt(int64(*b), 10)
+}
+
+func (b *ByteSize) Set(value string) error {
+	number, size := value, int64(1)
+	for _, u := range byteUnits {
+		if strings.HasSuffix(value, u.suffix) {
+			number, size = strings.TrimSuffix(value, u.suffix), u.size
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(strings.TrimSpace(number), 10, 64)
+	if err != nil || n < 0 || n > (1<<63-1)/size {
+		return fmt.Errorf("invalid size %q, expected bytes with an optional unit such as MB or GiB", value)
+	}
+	*b = ByteSize(n * size)
+	return nil
+}
+
+// rotatedTime is the format of the time a rotated sample file was opened,
+// inserted into its name. Milliseconds keep names of small files rotated in
+// quick succession apart.
+const rotatedTime = "20060102T150405.000Z"
+
+// rotatedName returns name with t inserted before its extensions, so
+// capture.cu8.zst becomes capture-20060102T150405.000Z.cu8.zst.
+func rotatedName(name string, t time.Time) string {
+	dir, file := filepath.Split(name)
+	base, ext := file, ""
+	if idx := strings.IndexByte(file[min(1, len(file)):], '.'); idx != -1 {
+		base, ext = file[:idx+1], file[idx+1:]
+	}
+	return filepath.Join(dir, base+"-"+t.UTC().Format(rotatedTime)+ext)
+}
+
+// rotatedPattern returns a glob matching the names rotatedName gives files
+// rotated from name.
+func rotatedPattern(name string) string {
+	var digits strings.Builder
+	for _, c := range rotatedTime {
+		if c >= '0' && c <= '9' {
+			digits.WriteString("[0-9]")
+		} else {
+			digits.WriteRune(c)
+		}
+	}
+	// The time can't contain separators, a zero time stands in for it.
+	zero := rotatedName(name, time.Time{})
+	stamp := time.Time{}.UTC().Format(rotatedTime)
+	idx := strings.LastIndex(zero, stamp)
+	return zero[:idx] + digits.String() + zero[idx+len(stamp):]
+}
+
+// sampleRotation closes -samplefile once it reaches -samplefile.rotate.size
+// or has been open for -samplefile.rotate.interval, renaming it with the time
+// it was opened, and begins a new file by the same name. Rotated files are
+// pruned, oldest first, to keep them and the current file within
+// -samplefile.rotate.maxtotal, though the current file may exceed the size
+// it's rotated at by a write.
+type sampleRotation struct {
+	size     int64
+	interval time.Duration
+	maxTotal int64
+	opened   time.Time // When the current file was opened.
+}
+
+// Due returns true if the current file, sf, should be rotated at now.
+func (sr *sampleRotation) Due(now time.Time, sf *SampleFile) bool {
+	if sr.interval != 0 && now.Sub(sr.opened) >= sr.interval {
+		return true
+	}
+	return sr.size != 0 && sf.Size() >= sr.size
+}
+
+// Rotate rotates -samplefile at now, between blocks so no packet's samples
+// are split across files. The metadata of -samplefile.sigmf is written and
+// renamed with the samples, and -samplefile.index records the new name. A
+// file holding no samples isn't renamed, its time is restarted instead.
+// Returns the file to write to next, sf itself if no file was opened in its
+// place.
+func (sr *sampleRotation) Rotate(now time.Time, sf *SampleFile, sigmf *SigMF, index *SampleIndex) (*SampleFile, error) {
+	if sf.Position() == 0 {
+		sr.opened = now
+		return sf, nil
+	}
+
+	var errs []error
+	if sigmf != nil {
+		errs = append(errs, sigmf.Flush())
+	}
+	errs = append(errs, sf.Close())
+
+	// A file which fails to rename is appended to rather than replaced.
+	name := sf.Name()
+	rotated := rotatedName(name, sr.opened)
+	if err := os.Rename(name, rotated); err != nil {
+		errs = append(errs, err)
+	} else {
+		log.Printf("Rotated %s to %s\n", name, rotated)
+		if *sampleSigMF {
+			meta := strings.TrimSuffix(name, sigmfDataExt) + sigmfMetaExt
+			err := os.Rename(meta, strings.TrimSuffix(rotated, sigmfDataExt)+sigmfMetaExt)
+			if !errors.Is(err, fs.ErrNotExist) {
+				errs = append(errs, err)
+			}
+		}
+		if index != nil {
+			errs = append(errs, index.Rotated(name, rotated))
+		}
+	}
+
+	// Templated names are expanded again, as when reopened on SIGHUP.
+	if expanded, err := expandPath(*sampleFilename, now); err == nil {
+		name = sampleFileName(expanded)
+	}
+	f, err := openOutput(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND)
+	if err != nil {
+		return sf, errors.Join(append(errs, err)...)
+	}
+	sf = newSampleFile(f, 0)
+	sr.opened = now
+
+	if sr.maxTotal != 0 {
+		errs = append(errs, sr.prune(name, sf.Size()))
+	}
+	return sf, errors.Join(errs...)
+}
+
+// prune removes the oldest files rotated from name until they fit within
+// maxTotal with room left for the current file, current bytes long, to grow
+// to size.
+func (sr *sampleRotation) prune(name string, current int64) error {
+	files, err := filepath.Glob(rotatedPattern(name))
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+
+	size := func(name string) int64 {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return 0
+		}
+		return fi.Size()
+	}
+	// Each file's SigMF metadata goes with it.
+	meta := func(name string) string {
+		return strings.TrimSuffix(name, sigmfDataExt) + sigmfMetaExt
+	}
+
+	total := max(current, sr.size)
+	for _, f := range files {
+		total += size(f)
+		if strings.HasSuffix(f, sigmfDataExt) {
+			total += size(meta(f))
+		}
+	}
+
+	var errs []error
+	for _, f := range files {
+		if total <= sr.maxTotal {
+			break
+		}
+		total -= size(f)
+		if err := os.Remove(f); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if strings.HasSuffix(f, sigmfDataExt) {
+			total -= size(meta(f))
+			os.Remove(meta(f))
+		}
+		log.Printf("Pruned %s\n", f)
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestByteSize(t *testing.T) {
+	for _, tc := range []struct {
+		value string
+		expt  ByteSize
+		str   string
+	}{
+		{"0", 0, "0"},
+		{"512", 512, "512B"},
+		{"1GB", 1e9, "1GB"},
+		{"32GB", 32e9, "32GB"},
+		{"2MiB", 2 << 20, "2MiB"},
+		{"1500KB", 1500e3, "1500KB"},
+	} {
+		var b ByteSize
+		if err := b.Set(tc.value); err != nil {
+			t.Fatalf("%q: %v", tc.value, err)
+		}
+		if b != tc.expt || b.String() != tc.str {
+			t.Errorf("%q: got %d (%s), want %d (%s)", tc.value, b, b.String(), tc.expt, tc.str)
+		}
+	}
+
+	for _, value := range []string{"", "GB", "-1MB", "1.5GB", "1PB", "99999999999TB"} {
+		var b ByteSize
+		if err := b.Set(value); err == nil {
+			t.Errorf("%q: expected an error", value)
+		}
+	}
+}
+
+func TestRotatedName(t *testing.T) {
+	ts := time.Date(2024, 3, 1, 12, 30, 45, 123e6, time.FixedZone("", 3600))
+	for name, expt := range map[string]string{
+		"capture.cu8":           "capture-20240301T113045.123Z.cu8",
+		"dir.d/capture.cu8.zst": "dir.d/capture-20240301T113045.123Z.cu8.zst",
+		"capture":               "capture-20240301T113045.123Z",
+		"rec/.hidden.cu8":       "rec/.hidden-20240301T113045.123Z.cu8",
+		"capture.sigmf-data":    "capture-20240301T113045.123Z.sigmf-data",
+	} {
+		got := rotatedName(filepath.FromSlash(name), ts)
+		if got != filepath.FromSlash(expt) {
+			t.Errorf("%s: got %s, want %s", name, got, expt)
+		}
+		if ok, _ := filepath.Match(rotatedPattern(filepath.FromSlash(name)), got); !ok {
+			t.Errorf("%s: pattern %s doesn't match %s", name, rotatedPattern(name), got)
+		}
+	}
+}
+
+func TestSampleFileRotate(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping receiving in short mode")
+	}
+
+	signal := fakeRTLTCP(t, scmSignal(t))
+	dir := t.TempDir()
+	base := filepath.Join(dir, "capture")
+
+	// Every packet's samples go to a file of their own.
+	args := []string{"-summary=false", "-server=" + signal, "-format=json", "-msglimit=4", "-duration=10s",
+		"-samplefile=" + base, "-samplefile.sigmf", "-samplefile.rotate.size=1B"}
+	if status := runRtlamr(t, nil, args...); status != exitOK {
+		t.Fatalf("expected status %d, got %d", exitOK, status)
+	}
+
+	rotated, _ := filepath.Glob(rotatedPattern(base + sigmfDataExt))
+	if len(rotated) != 3 {
+		t.Fatalf("expected 3 rotated files, got %v", rotated)
+	}
+	for _, name := range append(rotated, base+sigmfDataExt) {
+		fi, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf, err := os.ReadFile(strings.TrimSuffix(name, sigmfDataExt) + sigmfMetaExt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var meta sigmfMeta
+		if err := json.Unmarshal(buf, &meta); err != nil {
+			t.Fatal(err)
+		}
+
+		// Each file's annotations are of its own samples.
+		if len(meta.Annotations) != 1 || len(meta.Captures) != 1 || meta.Captures[0].SampleStart != 0 {
+			t.Errorf("%s: unexpected metadata %+v", name, meta)
+			continue
+		}
+		if a := meta.Annotations[0]; (a.SampleStart+a.SampleCount)*2 > fi.Size() {
+			t.Errorf("%s: annotation %+v exceeds %d bytes", name, a, fi.Size())
+		}
+	}
+
+	// Pruning keeps the newest rotated files which fit.
+	data, _ := os.Stat(rotated[len(rotated)-1])
+	limit := 2*data.Size() + 4096
+	args = append(args, "-samplefile.rotate.maxtotal="+strconv.FormatInt(limit, 10), "-msglimit=6")
+	if status := runRtlamr(t, nil, args...); status != exitOK {
+		t.Fatalf("expected status %d, got %d", exitOK, status)
+	}
+	rotated, _ = filepath.Glob(rotatedPattern(base + sigmfDataExt))
+	var total int64
+	for _, name := range rotated {
+		for _, name := range []string{name, strings.TrimSuffix(name, sigmfDataExt) + sigmfMetaExt} {
+			fi, err := os.Stat(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			total += fi.Size()
+		}
+	}
+	if len(rotated) != 2 || total > limit {
+		t.Errorf("%d bytes rotated to %v, expected 2 files within %d", total, rotated, limit)
+	}
+}
@@ -0,0 +1,239 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"time"
+)
+
+// sampleRecorder holds the most recent blocks of samples for -samplefile and
+// writes them when a packet is found, either all of the blocks held or, with
+// -samplefile.pre or -samplefile.post, a window around each packet. Each
+// sample is written once, so samples shared by the windows of packets found
+// close together aren't duplicated, and offsets into the stream of samples
+// read are tracked so packets can be located in the recording.
+type sampleRecorder struct {
+	buf        bytes.Buffer
+	size       int    // Bytes held before the oldest block is discarded.
+	sampleRate uint32 // Samples per second, for capture times.
+	blockTime  time.Time
+
+	start   int64       // Stream offset in bytes of the oldest sample held.
+	written int64       // Stream offset in bytes written through to file.
+	file    *SampleFile // File last written to, samples are rewritten after reopening.
+
+	pre, post int64          // Bytes written around each packet, see Window.
+	windows   []sampleWindow // Windows waiting for the samples following packets.
+
+	pending []sigmfAnnotation // Packets located in samples not yet written.
+	sigmf   *SigMF
+	index   *SampleIndex
+}
+
+// sampleWindow is a range of stream offsets in bytes to be written.
+type sampleWindow struct {
+	start, end int64
+}
+
+func newSampleRecorder(size int, sampleRate uint32) *sampleRecorder {
+	return &sampleRecorder{size: size, sampleRate: sampleRate}
+}
+
+// end returns the stream offset in bytes following the newest sample held.
+func (r *sampleRecorder) end() int64 {
+	return r.start + int64(r.buf.Len())
+}
+
+// Add appends a block which finished at blockTime to the buffer, discarding
+// the oldest block if it's full.
+func (r *sampleRecorder) Add(block []byte, blockTime time.Time) {
+	if r.buf.Len() > r.size {
+		r.start += int64(len(r.buf.Next(len(block))))
+	}
+	r.buf.Write(block)
+	r.blockTime = blockTime
+}
+
+// Len returns the number of bytes held, written for each packet found.
+func (r *sampleRecorder) Len() int {
+	return r.buf.Len()
+}
+
+// from returns the stream offset in bytes of the first sample held which
+// hasn't been written to f.
+func (r *sampleRecorder) from(f *SampleFile) int64 {
+	if f == r.file && r.written > r.start {
+		return r.written
+	}
+	return r.start
+}
+
+// Offset returns the offset in f the samples held start at once written.
+func (r *sampleRecorder) Offset(f *SampleFile) int64 {
+	return f.Position() - (r.from(f) - r.start)
+}
+
+// Locate limits the location of a packet, the first sample and number of
+// samples counted from the start of the stream as given by receiver.Meta, to
+// the samples held.
+func (r *sampleRecorder) Locate(start, count int64) (int64, int64) {
+	start = max(start, r.start>>1)
+	count = min(count, r.end()>>1-start)
+	return start, count
+}
+
+// Samples returns the samples held in the given range of the stream.
+func (r *sampleRecorder) Samples(start, count int64) []byte {
+	idx := start<<1 - r.start
+	return r.buf.Bytes()[idx : idx+count<<1]
+}
+
+// Annotating returns true if packets are recorded by Annotate.
+func (r *sampleRecorder) Annotating() bool {
+	return r.sigmf != nil || r.index != nil
+}
+
+// Annotate records a packet for -samplefile.sigmf and -samplefile.index,
+// annotated once the samples it was found in are written.
+func (r *sampleRecorder) Annotate(a sigmfAnnotation) {
+	if r.Annotating() {
+		r.pending = append(r.pending, a)
+	}
+}
+
+// Windowed returns true if windows around packets are written rather than
+// all of the samples held.
+func (r *sampleRecorder) Windowed() bool {
+	return r.pre != 0 || r.post != 0
+}
+
+// window returns the window of stream offsets written around a packet
+// located by Locate.
+func (r *sampleRecorder) window(start, count int64) sampleWindow {
+	return sampleWindow{max(start<<1-r.pre, r.start), (start+count)<<1 + r.post}
+}
+
+// WindowOffset returns the offset and length in bytes the window around a
+// packet located by Locate will be written at in f once queued.
+func (r *sampleRecorder) WindowOffset(f *SampleFile, start, count int64) (offset int64, length int) {
+	w := r.window(start, count)
+
+	// Samples already written or queued which the window overlaps are
+	// shared with it.
+	pos := f.Position()
+	tail, queued := r.from(f), int64(0)
+	for _, q := range r.windows {
+		queued += q.end - max(q.start, tail)
+		tail = q.end
+	}
+	offset = pos + queued
+	if (len(r.windows) != 0 || f == r.file) && w.start < tail {
+		offset -= tail - w.start
+	}
+
+	return offset, int(w.end - w.start)
+}
+
+// Queued returns true if windows are waiting for the samples following
+// packets, which would be written to the file their offsets were given for.
+func (r *sampleRecorder) Queued() bool {
+	return len(r.windows) != 0
+}
+
+// Queue queues the window around a packet located by Locate to be written by
+// Flush once the samples following it have been read. Windows overlapping
+// those queued are coalesced.
+func (r *sampleRecorder) Queue(start, count int64) {
+	w := r.window(start, count)
+	if n := len(r.windows); n != 0 && w.start <= r.windows[n-1].end {
+		r.windows[n-1].end = max(r.windows[n-1].end, w.end)
+		return
+	}
+	r.windows = append(r.windows, w)
+}
+
+// Flush writes the windows queued whose samples have been read. If final is
+// set, such as when rtlamr exits, all windows are written with the samples
+// read so far. Windows which fail to write are dropped.
+func (r *sampleRecorder) Flush(f *SampleFile, centerFreq uint32, final bool) error {
+	for len(r.windows) != 0 && (final || r.windows[0].end <= r.end()) {
+		w := r.windows[0]
+		r.windows = r.windows[1:]
+		if err := r.write(f, max(w.start, r.start), min(w.end, r.end()), centerFreq); err != nil {
+			r.windows = nil
+			return err
+		}
+	}
+	return nil
+}
+
+// Write writes the samples held which haven't already been written to f.
+// centerFreq is the frequency the newest block was received on.
+func (r *sampleRecorder) Write(f *SampleFile, centerFreq uint32) error {
+	return r.write(f, r.start, r.end(), centerFreq)
+}
+
+// write writes the samples held between the given stream offsets which
+// haven't already been written to f. Annotations of samples which fail to
+// write are dropped and the next write to f repeats the samples held.
+// Metadata for -samplefile.sigmf and -samplefile.index is updated but not
+// written, see SigMF.Flush and SampleIndex.Flush.
+func (r *sampleRecorder) write(f *SampleFile, start, end int64, centerFreq uint32) error {
+	n := 0
+	for n < len(r.pending) && r.pending[n].SampleStart<<1 < end {
+		n++
+	}
+	pending := r.pending[:n:n]
+	r.pending = r.pending[n:]
+
+	pos := f.Position()
+
+	from := start
+	if f == r.file && r.written > from {
+		from = r.written
+	}
+	contiguous := f == r.file && r.written == from
+	if from < end {
+		if _, err := f.Write(r.buf.Bytes()[from-r.start : end-r.start]); err != nil {
+			r.file = nil
+			return err
+		}
+	}
+	r.file, r.written = f, max(from, end)
+
+	if !r.Annotating() {
+		return nil
+	}
+
+	// Convert stream offsets to those of the recording.
+	for idx := range pending {
+		pending[idx].SampleStart = (pos-from)>>1 + pending[idx].SampleStart
+	}
+	if r.index != nil {
+		r.index.Add(f.Name(), pending...)
+	}
+	if r.sigmf == nil {
+		return nil
+	}
+	if !contiguous || r.sigmf.Frequency() != centerFreq {
+		lag := time.Duration(r.end()-from) >> 1 * time.Second / time.Duration(r.sampleRate)
+		r.sigmf.Capture(f.Name(), pos>>1, from>>1, r.blockTime.Add(-lag), centerFreq)
+	}
+	r.sigmf.Annotate(pending...)
+	return nil
+}
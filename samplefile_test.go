@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bemasher/rtlamr/parse"
+)
+
+func TestSampleRecorder(t *testing.T) {
+	file, err := os.Create(filepath.Join(t.TempDir(), "samples.cu8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := newSampleFile(file, 0)
+	defer f.Close()
+
+	// Blocks of 4 bytes, holding up to 3.
+	r := newSampleRecorder(8, 1)
+	var stream []byte
+	add := func(n int) {
+		for ; n > 0; n-- {
+			block := bytes.Repeat([]byte{byte(len(stream) / 4)}, 4)
+			stream = append(stream, block...)
+			r.Add(block, time.Now())
+		}
+	}
+	write := func(wantOffset int64) {
+		t.Helper()
+		if offset := r.Offset(f); offset != wantOffset {
+			t.Errorf("expected offset %d, got %d", wantOffset, offset)
+		}
+		held := append([]byte(nil), r.buf.Bytes()...)
+		if err := r.Write(f, 0); err != nil {
+			t.Fatal(err)
+		}
+		written, err := os.ReadFile(f.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := written[wantOffset : wantOffset+int64(r.Len())]; !bytes.Equal(got, held) {
+			t.Errorf("expected %v at offset %d, got %v", held, wantOffset, got)
+		}
+	}
+
+	// Blocks 0-2 are written, then 3 following them, then 5-7 once block 4
+	// has been discarded unwritten.
+	add(3)
+	write(0)
+	add(1)
+	write(4)
+	add(4)
+	write(16)
+
+	written, _ := os.ReadFile(f.Name())
+	if want := append(stream[:16:16], stream[20:]...); !bytes.Equal(written, want) {
+		t.Errorf("expected %v, got %v", want, written)
+	}
+}
+
+func TestSampleRecorderWindows(t *testing.T) {
+	file, err := os.Create(filepath.Join(t.TempDir(), "samples.cu8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := newSampleFile(file, 0)
+	defer f.Close()
+
+	// Blocks of 4 samples, one sample written either side of packets.
+	r := newSampleRecorder(64, 1)
+	r.pre, r.post = 2, 2
+	var stream []byte
+	add := func(n int) {
+		for ; n > 0; n-- {
+			block := make([]byte, 8)
+			for idx := range block {
+				block[idx] = byte(len(stream) + idx)
+			}
+			stream = append(stream, block...)
+			r.Add(block, time.Now())
+		}
+	}
+
+	type window struct {
+		offset int64
+		length int
+		start  int
+	}
+	var windows []window
+	queue := func(start, count int64) {
+		offset, length := r.WindowOffset(f, start, count)
+		windows = append(windows, window{offset, length, int(start-1) << 1})
+		r.Queue(start, count)
+	}
+
+	add(4)
+	queue(5, 2)  // Bytes 8-16.
+	queue(7, 2)  // Bytes 12-20, coalesced with the first.
+	queue(14, 1) // Bytes 26-32.
+	queue(15, 1) // Bytes 28-34, waiting for the next block.
+	if err := r.Flush(f, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.windows) != 1 {
+		t.Errorf("expected a window waiting for samples, got %v", r.windows)
+	}
+	add(1)
+	if err := r.Flush(f, 0, false); err != nil {
+		t.Fatal(err)
+	}
+
+	written, _ := os.ReadFile(f.Name())
+	if want := append(stream[8:20:20], stream[26:34]...); !bytes.Equal(written, want) {
+		t.Fatalf("expected %v, got %v", want, written)
+	}
+	for _, w := range windows {
+		if got, want := written[w.offset:w.offset+int64(w.length)], stream[w.start:w.start+w.length]; !bytes.Equal(got, want) {
+			t.Errorf("window at %d: expected %v, got %v", w.offset, want, got)
+		}
+	}
+}
+
+func TestSampleFilePosition(t *testing.T) {
+	write := func(t *testing.T, s *SampleFile, start int64) {
+		t.Helper()
+		for idx := int64(1); idx <= 2; idx++ {
+			if _, err := s.Write(make([]byte, 10)); err != nil {
+				t.Fatal(err)
+			}
+			if pos := s.Position(); pos != start+idx*10 {
+				t.Fatalf("expected position %d, got %d", start+idx*10, pos)
+			}
+		}
+	}
+
+	t.Run("devnull", func(t *testing.T) {
+		f, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		write(t, newSampleFile(f, 0), 0)
+	})
+
+	t.Run("pipe", func(t *testing.T) {
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		defer w.Close()
+		go io.Copy(io.Discard, r)
+		write(t, newSampleFile(w, 0), 0)
+	})
+
+	// Files appended to continue from their end.
+	t.Run("append", func(t *testing.T) {
+		name := filepath.Join(t.TempDir(), "samples.cu8")
+		if err := os.WriteFile(name, make([]byte, 6), 0644); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		write(t, newSampleFile(f, 0), 6)
+	})
+}
+
+func TestSampleFileOffset(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping receiving in short mode")
+	}
+
+	signal := fakeRTLTCP(t, scmSignal(t))
+	dir := t.TempDir()
+	p, err := parse.NewParser("scm", 72, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blockSize := int64(p.Cfg().BlockSize2)
+
+	type offset struct{ Offset, Length int64 }
+	readMsgs := func(t *testing.T, name string) (msgs []offset) {
+		t.Helper()
+		buf, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range strings.Split(strings.TrimSpace(string(buf)), "\n") {
+			var msg offset
+			if err := json.Unmarshal([]byte(line), &msg); err != nil {
+				t.Fatalf("%v: %s", err, line)
+			}
+			msgs = append(msgs, msg)
+		}
+		if len(msgs) != 3 {
+			t.Fatalf("expected 3 messages, got %d", len(msgs))
+		}
+		return msgs
+	}
+	receive := func(t *testing.T, stdout *os.File, args ...string) []offset {
+		t.Helper()
+		name := filepath.Join(t.TempDir(), "msgs.json")
+		args = append([]string{"-summary=false", "-server=" + signal, "-format=json", "-msglimit=3", "-duration=10s", "-logfile=" + name}, args...)
+		if status := runRtlamr(t, stdout, args...); status != exitOK {
+			t.Fatalf("expected status %d, got %d", exitOK, status)
+		}
+		return readMsgs(t, name)
+	}
+
+	// Without -samplefile, offsets count the sample stream.
+	t.Run("devnull", func(t *testing.T) {
+		msgs := receive(t, nil)
+		for idx, msg := range msgs {
+			if msg.Length == 0 || msg.Offset%blockSize != 0 || (idx > 0 && msg.Offset <= msgs[idx-1].Offset) {
+				t.Errorf("unexpected offset %d and length %d after %d", msg.Offset, msg.Length, msgs[max(idx-1, 0)].Offset)
+			}
+		}
+	})
+
+	// A pipe can't seek, offsets count the samples written to it, which
+	// decode again from stdin.
+	t.Run("pipe", func(t *testing.T) {
+		if runtime.GOOS == "windows" {
+			t.Skip("no /dev/stdout")
+		}
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		read := make(chan []byte)
+		go func() {
+			buf, _ := io.ReadAll(r)
+			read <- buf
+		}()
+
+		msgs := receive(t, w, "-samplefile=/dev/stdout")
+		w.Close()
+		samples := <-read
+
+		last := msgs[len(msgs)-1]
+		if msgs[0].Offset != 0 || last.Offset+last.Length != int64(len(samples)) {
+			t.Errorf("offsets %d to %d+%d don't span the %d bytes written", msgs[0].Offset, last.Offset, last.Length, len(samples))
+		}
+		for idx := 1; idx < len(msgs); idx++ {
+			if prev := msgs[idx-1]; msgs[idx].Offset != prev.Offset+prev.Length {
+				t.Errorf("message %d at %d doesn't follow %d+%d", idx, msgs[idx].Offset, prev.Offset, prev.Length)
+			}
+		}
+
+		out, err := os.Create(filepath.Join(dir, "replay.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer out.Close()
+		if status := runRtlamrStdin(t, bytes.NewReader(samples), out, "replay", "-format=json", "-"); status != exitOK {
+			t.Fatalf("replay: expected status %d, got %d", exitOK, status)
+		}
+		for _, msg := range readMsgs(t, out.Name()) {
+			if msg.Offset+msg.Length > int64(len(samples)) {
+				t.Errorf("replay: offset %d+%d past the %d bytes read", msg.Offset, msg.Length, len(samples))
+			}
+		}
+	})
+
+	if status := runRtlamr(t, nil, "replay", "-loop=2", "-"); status != exitUsage {
+		t.Errorf("replay -loop stdin: expected status %d, got %d", exitUsage, status)
+	}
+}
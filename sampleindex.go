@@ -0,0 +1,220 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// IndexRecord is a line of -samplefile.index locating a packet written to
+// -samplefile. File is only given by the first record of each recording,
+// records following it are in the same one.
+type IndexRecord struct {
+	File       string `json:",omitempty"` // Relative to the index's directory unless absolute.
+	Offset     int64  // First sample of the packet in the recording.
+	Length     int64  // Samples.
+	MsgType    string // As given by -msgtype.
+	MeterID    uint32 `json:",omitempty"`
+	ChecksumOK bool   `json:",omitempty"`
+
+	// Rotated, if given, is what File was renamed to by
+	// -samplefile.rotate.size or -samplefile.rotate.interval. The record
+	// locates no packet, those before it in File are in Rotated.
+	Rotated string `json:",omitempty"`
+}
+
+// SampleIndex writes -samplefile.index, so rtlamr replay -index can decode
+// the packets of a long recording without the samples between them.
+type SampleIndex struct {
+	msgType string
+
+	enc  *json.Encoder
+	dir  string // Names are written relative to it.
+	file string // Recording the previous record was in.
+
+	pending []IndexRecord
+}
+
+func NewSampleIndex(f *os.File, msgType string) *SampleIndex {
+	si := &SampleIndex{msgType: msgType}
+	si.SetWriter(f)
+	return si
+}
+
+// SetWriter directs further records to f, such as after the index is
+// reopened. The next record names its recording.
+func (si *SampleIndex) SetWriter(f *os.File) {
+	si.enc = json.NewEncoder(f)
+	si.dir, _ = filepath.Abs(filepath.Dir(f.Name()))
+	si.file = ""
+}
+
+// rel returns the name of a recording relative to the index's directory if
+// it's within it.
+func (si *SampleIndex) rel(name string) string {
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return name
+	}
+	if rel, err := filepath.Rel(si.dir, abs); err == nil && filepath.IsLocal(rel) {
+		return filepath.ToSlash(rel)
+	}
+	return abs
+}
+
+// Add records packets located in the named recording, written by Flush.
+func (si *SampleIndex) Add(name string, annotations ...sigmfAnnotation) {
+	for _, a := range annotations {
+		rec := IndexRecord{
+			Offset:     a.SampleStart,
+			Length:     a.SampleCount,
+			MsgType:    si.msgType,
+			MeterID:    a.MeterID,
+			ChecksumOK: a.ChecksumOK,
+		}
+		if name != si.file {
+			rec.File, si.file = si.rel(name), name
+		}
+		si.pending = append(si.pending, rec)
+	}
+}
+
+// Rotated records the renaming of a recording by rotation.
+func (si *SampleIndex) Rotated(name, rotated string) error {
+	if err := si.Flush(); err != nil {
+		return err
+	}
+	si.file = ""
+	return si.enc.Encode(IndexRecord{File: si.rel(name), Rotated: si.rel(rotated)})
+}
+
+// Flush writes the records added since the last flush. Records which fail to
+// write are dropped, and the next record names its recording.
+func (si *SampleIndex) Flush() error {
+	pending := si.pending
+	si.pending = nil
+	for _, rec := range pending {
+		if err := si.enc.Encode(rec); err != nil {
+			si.file = ""
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadSampleIndex reads the named index, returning a record for each packet
+// with its recording's path, relative to the current directory, in File.
+func ReadSampleIndex(name string) (recs []IndexRecord, err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	dir := filepath.Dir(name)
+	path := func(file string) string {
+		file = filepath.FromSlash(file)
+		if filepath.IsAbs(file) {
+			return file
+		}
+		return filepath.Join(dir, file)
+	}
+
+	var file string
+	s := bufio.NewScanner(f)
+	for line := 1; s.Scan(); line++ {
+		var rec IndexRecord
+		if err := json.Unmarshal(s.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		if rec.Rotated != "" {
+			from, to := path(rec.File), path(rec.Rotated)
+			for idx := range recs {
+				if recs[idx].File == from {
+					recs[idx].File = to
+				}
+			}
+			file = ""
+			continue
+		}
+
+		if rec.File != "" {
+			file = path(rec.File)
+		}
+		if file == "" {
+			return nil, fmt.Errorf("line %d: no recording named", line)
+		}
+		rec.File = file
+		recs = append(recs, rec)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	return recs, nil
+}
+
+// indexWindow is a range of a recording holding indexed packets of a single
+// message type, replayed by rtlamr replay -index.
+type indexWindow struct {
+	file          string
+	msgType       string
+	start, length int64 // Bytes.
+	recs          []IndexRecord
+}
+
+// indexWindows groups records into windows, block aligned with a block of
+// samples either side of their packets. Records must be in the order they
+// were written. Windows overlapping within a recording are merged.
+func indexWindows(recs []IndexRecord, blockSize func(msgType string) (int64, error)) (windows []indexWindow, err error) {
+	for _, rec := range recs {
+		size, err := blockSize(rec.MsgType)
+		if err != nil {
+			return nil, err
+		}
+		start := max(rec.Offset<<1-size, 0) / size * size
+		end := ((rec.Offset+rec.Length)<<1 + 2*size - 1) / size * size
+
+		if n := len(windows); n != 0 {
+			w := &windows[n-1]
+			if w.file == rec.File && w.msgType == rec.MsgType && start <= w.start+w.length {
+				w.length = max(w.length, end-w.start)
+				w.recs = append(w.recs, rec)
+				continue
+			}
+		}
+		windows = append(windows, indexWindow{rec.File, rec.MsgType, start, end - start, []IndexRecord{rec}})
+	}
+	return windows, nil
+}
+
+// match removes the record of the window matching a packet decoded from it,
+// reporting whether there was one.
+func (w *indexWindow) match(id uint32, checksumOK bool) bool {
+	for idx, rec := range w.recs {
+		if rec.MeterID == id && rec.ChecksumOK == checksumOK {
+			w.recs = append(w.recs[:idx], w.recs[idx+1:]...)
+			return true
+		}
+	}
+	return false
+}
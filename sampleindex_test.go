@@ -0,0 +1,118 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSampleIndex(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping receiving in short mode")
+	}
+
+	signal := fakeRTLTCP(t, scmSignal(t))
+	dir := t.TempDir()
+	capture, index := filepath.Join(dir, "capture.cu8"), filepath.Join(dir, "capture.idx")
+
+	// Windows around packets leave the recording's offsets unlike the
+	// stream's.
+	args := []string{"-summary=false", "-server=" + signal, "-msglimit=3", "-duration=10s",
+		"-samplefile=" + capture, "-samplefile.pre=5ms", "-samplefile.post=5ms", "-samplefile.index=" + index}
+	if status := runRtlamr(t, nil, args...); status != exitOK {
+		t.Fatalf("expected status %d, got %d", exitOK, status)
+	}
+
+	recs, err := ReadSampleIndex(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 3 {
+		t.Fatalf("expected 3 records, got %+v", recs)
+	}
+	fi, err := os.Stat(capture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range recs {
+		if rec.File != capture || rec.MsgType != "scm" || !rec.ChecksumOK || rec.Length == 0 || (rec.Offset+rec.Length)<<1 > fi.Size() {
+			t.Errorf("unexpected record %+v of %d samples", rec, fi.Size()>>1)
+		}
+	}
+	buf, _ := os.ReadFile(index)
+	if n := strings.Count(string(buf), `"File":"capture.cu8"`); n != 1 {
+		t.Errorf("expected the recording named once relative to the index, got %d:\n%s", n, buf)
+	}
+
+	out, err := os.Create(filepath.Join(dir, "replay"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	if status := runRtlamr(t, out, "replay", "-index="+index, "-format=json"); status != exitOK {
+		t.Fatalf("replay: expected status %d, got %d", exitOK, status)
+	}
+	buf, _ = os.ReadFile(out.Name())
+	if n := strings.Count(string(buf), "\n"); n != 3 {
+		t.Errorf("replay: expected 3 messages, got %d:\n%s", n, buf)
+	}
+
+	// A recording given in its place which lacks the packets fails.
+	moved := filepath.Join(t.TempDir(), "capture.cu8")
+	if err := os.WriteFile(moved, noise(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if status := runRtlamr(t, nil, "replay", "-index="+index, moved); status != exitNoMessages {
+		t.Errorf("replay moved: expected status %d, got %d", exitNoMessages, status)
+	}
+
+	if status := runRtlamr(t, nil, "replay", "-index="+index, "-start=1s"); status != exitUsage {
+		t.Errorf("replay -start: expected status %d, got %d", exitUsage, status)
+	}
+}
+
+func TestReadSampleIndex(t *testing.T) {
+	dir := t.TempDir()
+	index := filepath.Join(dir, "capture.idx")
+	lines := `{"File":"capture.cu8","Offset":100,"Length":10,"MsgType":"scm","MeterID":1,"ChecksumOK":true}
+{"Offset":200,"Length":10,"MsgType":"scm","MeterID":2}
+{"File":"capture.cu8","Rotated":"old/capture-1.cu8"}
+{"File":"capture.cu8","Offset":50,"Length":10,"MsgType":"scm","MeterID":3,"ChecksumOK":true}
+{"File":"/abs/other.cu8","Offset":0,"Length":10,"MsgType":"idm","MeterID":4,"ChecksumOK":true}
+`
+	if err := os.WriteFile(index, []byte(lines), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	recs, err := ReadSampleIndex(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated := filepath.Join(dir, "old", "capture-1.cu8")
+	var files []string
+	for _, rec := range recs {
+		files = append(files, rec.File)
+	}
+	want := []string{rotated, rotated, filepath.Join(dir, "capture.cu8"), filepath.FromSlash("/abs/other.cu8")}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("files %v, want %v", files, want)
+	}
+
+	// Neighbouring packets share a window, block aligned either side.
+	windows, err := indexWindows(recs, func(string) (int64, error) { return 64, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(windows) != 3 || len(windows[0].recs) != 2 || windows[0].start != 128 || windows[0].length != 384 {
+		t.Errorf("unexpected windows %+v", windows)
+	}
+
+	if err := os.WriteFile(index, []byte(`{"Offset":1,"Length":1}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadSampleIndex(index); err == nil {
+		t.Error("expected an error for a record without a recording")
+	}
+}
@@ -0,0 +1,173 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Window is a daily time range given as minutes since midnight. Windows
+// ending before they start span midnight.
+type Window struct {
+	Start, End int
+}
+
+func (w Window) String() string {
+	return fmt.Sprintf("%02d:%02d-%02d:%02d", w.Start/60, w.Start%60, w.End/60, w.End%60)
+}
+
+// Schedule is a flag value holding the daily windows during which messages
+// are received, such as 08:00-11:00,13:00-14:00. Windows may instead start
+// at times matching a cron expression and last CronDuration. An empty
+// schedule is always active.
+type Schedule struct {
+	Windows  []Window
+	Location *time.Location
+
+	Cron         *Cron
+	CronDuration time.Duration
+}
+
+func (s *Schedule) String() string {
+	var values []string
+	for _, w := range s.Windows {
+		values = append(values, w.String())
+	}
+	return strings.Join(values, ",")
+}
+
+func (s *Schedule) Set(value string) error {
+	for _, token := range strings.Split(value, ",") {
+		token = strings.TrimSpace(token)
+
+		bounds := strings.Split(token, "-")
+		if len(bounds) != 2 {
+			return fmt.Errorf("invalid window %q, expected start-end such as 08:00-11:00", token)
+		}
+
+		var w Window
+		for idx, minutes := range []*int{&w.Start, &w.End} {
+			t, err := time.Parse("15:04", strings.TrimSpace(bounds[idx]))
+			if err != nil {
+				return fmt.Errorf("invalid window %q, expected times as hh:mm", token)
+			}
+			*minutes = t.Hour()*60 + t.Minute()
+		}
+		if w.Start == w.End {
+			return fmt.Errorf("invalid window %q, start and end are the same", token)
+		}
+
+		s.Windows = append(s.Windows, w)
+	}
+
+	return nil
+}
+
+// bounds returns the start and end of w on the day of t, in s's location.
+// Times are computed from the wall clock so windows follow daylight saving.
+func (s Schedule) bounds(w Window, t time.Time, days int) (start, end time.Time) {
+	t = t.In(s.location())
+	start = time.Date(t.Year(), t.Month(), t.Day()+days, w.Start/60, w.Start%60, 0, 0, t.Location())
+
+	endDays := days
+	if w.End < w.Start {
+		endDays++
+	}
+	end = time.Date(t.Year(), t.Month(), t.Day()+endDays, w.End/60, w.End%60, 0, 0, t.Location())
+
+	return
+}
+
+func (s Schedule) location() *time.Location {
+	if s.Location == nil {
+		return time.Local
+	}
+	return s.Location
+}
+
+// Empty returns true if the schedule has no windows and is always active.
+func (s Schedule) Empty() bool {
+	return len(s.Windows) == 0 && s.Cron == nil
+}
+
+// Active returns true if t falls within a window.
+func (s Schedule) Active(t time.Time) bool {
+	if s.Cron != nil {
+		start := s.Cron.Next(t.In(s.location()).Add(-s.CronDuration))
+		return !start.IsZero() && !start.After(t)
+	}
+
+	if len(s.Windows) == 0 {
+		return true
+	}
+
+	for _, w := range s.Windows {
+		// Windows spanning midnight may have started the day before.
+		for days := -1; days <= 0; days++ {
+			start, end := s.bounds(w, t, days)
+			if !t.Before(start) && t.Before(end) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Next returns the first time after t at which Active changes. Overlapping
+// and adjacent windows are treated as one.
+func (s Schedule) Next(t time.Time) (next time.Time) {
+	if s.Cron != nil {
+		return s.cronNext(t)
+	}
+
+	active := s.Active(t)
+	for _, w := range s.Windows {
+		for days := -1; days <= 1; days++ {
+			start, end := s.bounds(w, t, days)
+			for _, edge := range []time.Time{start, end} {
+				if !edge.After(t) || !next.IsZero() && !edge.Before(next) {
+					continue
+				}
+				if s.Active(edge) != active {
+					next = edge
+				}
+			}
+		}
+	}
+	return
+}
+
+// cronNext returns the first time after t at which Active changes for a cron
+// schedule. Windows starting before the last has ended extend it, up to a day
+// ahead so schedules which never end don't search forever.
+func (s Schedule) cronNext(t time.Time) time.Time {
+	t = t.In(s.location())
+	if !s.Active(t) {
+		return s.Cron.Next(t)
+	}
+
+	end := t
+	for start := s.Cron.Next(t.Add(-s.CronDuration)); !start.IsZero() && !start.After(end); start = s.Cron.Next(start) {
+		end = start.Add(s.CronDuration)
+		if end.Sub(t) > 24*time.Hour {
+			break
+		}
+	}
+	return end
+}
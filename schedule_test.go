@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSchedule(t *testing.T) {
+	var s Schedule
+	if err := s.Set("08:00-11:00, 22:30-01:00"); err != nil {
+		t.Fatal(err)
+	}
+	s.Location = time.UTC
+
+	if recv, expt := s.String(), "08:00-11:00,22:30-01:00"; recv != expt {
+		t.Fatalf("Expected %s got %s\n", expt, recv)
+	}
+
+	at := func(hour, min int) time.Time {
+		return time.Date(2015, 1, 1, hour, min, 0, 0, time.UTC)
+	}
+
+	for _, step := range []struct {
+		T      time.Time
+		Active bool
+		Next   time.Time
+	}{
+		{at(7, 59), false, at(8, 0)},
+		{at(8, 0), true, at(11, 0)},
+		{at(10, 59), true, at(11, 0)},
+		{at(11, 0), false, at(22, 30)},
+		{at(23, 0), true, at(25, 0)},
+		{at(0, 30), true, at(1, 0)},
+		{at(1, 0), false, at(8, 0)},
+	} {
+		if recv := s.Active(step.T); recv != step.Active {
+			t.Fatalf("%s: expected active %t got %t\n", step.T, step.Active, recv)
+		}
+		if recv := s.Next(step.T); !recv.Equal(step.Next) {
+			t.Fatalf("%s: expected next %s got %s\n", step.T, step.Next, recv)
+		}
+	}
+
+	if err := s.Set("13:00-14:00"); err != nil || len(s.Windows) != 3 {
+		t.Fatalf("Expected windows to accumulate got %s %v\n", s.String(), err)
+	}
+
+	for _, value := range []string{"08:00", "8-11", "08:00-08:00", "25:00-26:00"} {
+		if err := s.Set(value); err == nil {
+			t.Fatalf("%s: expected error\n", value)
+		}
+	}
+}
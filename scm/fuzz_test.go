@@ -0,0 +1,24 @@
+package scm
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/bemasher/rtlamr/crc"
+	"github.com/bemasher/rtlamr/parse"
+	"github.com/bemasher/rtlamr/parse/parsetest"
+)
+
+func FuzzSCM(f *testing.F) {
+	parsetest.Fuzz(f, "scm", func(msg parse.Message) error {
+		raw := msg.Raw()
+		if len(raw) != 12 {
+			return fmt.Errorf("raw packet is %d bytes, want 12", len(raw))
+		}
+		if crc.BCH(crc.BCHPoly, raw[2:]) != 0 {
+			return errors.New("checksum doesn't verify")
+		}
+		return nil
+	})
+}
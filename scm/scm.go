@@ -18,6 +18,7 @@ package scm
 
 import (
 	"encoding/binary"
+	"encoding/gob"
 	"fmt"
 	"strconv"
 
@@ -27,7 +28,8 @@ import (
 )
 
 func init() {
-	parse.Register("scm", NewParser)
+	parse.Register("scm", NewParser, parse.DefaultConstraints)
+	gob.RegisterName("SCM", SCM{})
 }
 
 func NewPacketConfig(chipLength int) (cfg decode.PacketConfig) {
@@ -44,15 +46,23 @@ func NewPacketConfig(chipLength int) (cfg decode.PacketConfig) {
 type Parser struct {
 	decode.Decoder
 	crc.CRC
+
+	allowBadCRC bool
 }
 
 func NewParser(chipLength, decimation int) (p parse.Parser) {
 	return &Parser{
 		decode.NewDecoder(NewPacketConfig(chipLength), decimation),
-		crc.NewCRC("BCH", 0, 0x6F63, 0),
+		crc.NewBCH(),
+		parse.AllowBadCRC,
 	}
 }
 
+// SetAllowBadCRC sets whether Parse keeps packets failing their checksum.
+func (p *Parser) SetAllowBadCRC(allow bool) {
+	p.allowBadCRC = allow
+}
+
 func (p Parser) Dec() decode.Decoder {
 	return p.Decoder
 }
@@ -64,6 +74,8 @@ func (p *Parser) Cfg() *decode.PacketConfig {
 func (p Parser) Parse(indices []int) (msgs []parse.Message) {
 	seen := make(map[string]bool)
 
+	var failed []parse.Message
+
 	for _, pkt := range p.Decoder.Slice(indices) {
 		s := string(pkt)
 		if seen[s] {
@@ -78,19 +90,53 @@ func (p Parser) Parse(indices []int) (msgs []parse.Message) {
 			continue
 		}
 
-		// If the checksum fails, bail.
-		if p.Checksum(data.Bytes[2:12]) != 0 {
+		// If the checksum fails, bail unless we're keeping failed packets.
+		checksumOK := p.Valid(data.Bytes[2:12])
+		if !checksumOK && !p.allowBadCRC {
 			continue
 		}
 
 		scm := NewSCM(data)
+		scm.badChecksum = !checksumOK
 
 		// If the meter id is 0, bail.
 		if scm.ID == 0 {
 			continue
 		}
 
-		msgs = append(msgs, scm)
+		if checksumOK {
+			msgs = append(msgs, scm)
+		} else {
+			failed = append(failed, scm)
+		}
+	}
+
+	if len(msgs) == 0 {
+		msgs = failed
+	}
+
+	return
+}
+
+// Diagnose explains why the packet at the preamble candidate idx did or
+// didn't parse.
+func (p Parser) Diagnose(idx int) (c parse.Candidate) {
+	pkts := p.Decoder.Slice([]int{idx})
+	if len(pkts) == 0 || len(pkts[0]) != 12 {
+		c.Stop = "length"
+		return
+	}
+	pkt := pkts[0]
+
+	c.Checksum = fmt.Sprintf("%04X", binary.BigEndian.Uint16(pkt[10:12]))
+	c.Expected = fmt.Sprintf("%04X", crc.BCH(crc.BCHPoly, pkt[2:10]))
+	if !p.Valid(pkt[2:12]) && !p.allowBadCRC {
+		c.Stop = "checksum"
+		return
+	}
+
+	if NewSCM(parse.NewDataFromBytes(pkt)).ID == 0 {
+		c.Stop = "id"
 	}
 
 	return
@@ -104,6 +150,9 @@ type SCM struct {
 	TamperEnc   uint8  `xml:",attr"`
 	Consumption uint32 `xml:",attr"`
 	ChecksumVal uint16 `xml:"Checksum,attr"`
+
+	raw         []byte
+	badChecksum bool
 }
 
 func NewSCM(data parse.Data) (scm SCM) {
@@ -120,6 +169,7 @@ func NewSCM(data parse.Data) (scm SCM) {
 	scm.TamperEnc = uint8(tamperenc)
 	scm.Consumption = uint32(consumption)
 	scm.ChecksumVal = uint16(checksum)
+	scm.raw = data.Bytes
 
 	return
 }
@@ -136,12 +186,47 @@ func (scm SCM) MeterType() uint8 {
 	return scm.Type
 }
 
+func (scm SCM) MeterConsumption() uint32 {
+	return scm.Consumption
+}
+
 func (scm SCM) Checksum() []byte {
 	checksum := make([]byte, 2)
 	binary.BigEndian.PutUint16(checksum, scm.ChecksumVal)
 	return checksum
 }
 
+func (scm SCM) ChecksumOK() bool {
+	return !scm.badChecksum
+}
+
+func (scm SCM) Raw() []byte {
+	return scm.raw
+}
+
+func (scm SCM) Field(name string) (parse.Value, bool) {
+	switch name {
+	case "ID":
+		return parse.Num(float64(scm.ID)), true
+	case "Type":
+		return parse.Num(float64(scm.Type)), true
+	case "TamperPhy":
+		return parse.Num(float64(scm.TamperPhy)), true
+	case "TamperEnc":
+		return parse.Num(float64(scm.TamperEnc)), true
+	case "Consumption":
+		return parse.Num(float64(scm.Consumption)), true
+	}
+	return parse.Value{}, false
+}
+
+func (scm SCM) Flags() map[string]uint {
+	return map[string]uint{
+		"TamperPhy": uint(scm.TamperPhy),
+		"TamperEnc": uint(scm.TamperEnc),
+	}
+}
+
 func (scm SCM) String() string {
 	return fmt.Sprintf("{ID:%8d Type:%2d Tamper:{Phy:%02X Enc:%02X} Consumption:%8d CRC:0x%04X}",
 		scm.ID, scm.Type, scm.TamperPhy, scm.TamperEnc, scm.Consumption, scm.ChecksumVal,
@@ -0,0 +1,24 @@
+package scmplus
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/bemasher/rtlamr/crc"
+	"github.com/bemasher/rtlamr/parse"
+	"github.com/bemasher/rtlamr/parse/parsetest"
+)
+
+func FuzzSCMPlus(f *testing.F) {
+	parsetest.Fuzz(f, "scm+", func(msg parse.Message) error {
+		raw := msg.Raw()
+		if len(raw) != 16 {
+			return fmt.Errorf("raw packet is %d bytes, want 16", len(raw))
+		}
+		if !crc.NewCCITT().Valid(raw[2:]) {
+			return errors.New("checksum doesn't verify")
+		}
+		return nil
+	})
+}
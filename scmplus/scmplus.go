@@ -17,8 +17,8 @@
 package scmplus
 
 import (
-	"bytes"
 	"encoding/binary"
+	"encoding/gob"
 	"fmt"
 	"strconv"
 
@@ -28,7 +28,8 @@ import (
 )
 
 func init() {
-	parse.Register("scm+", NewParser)
+	parse.Register("scm+", NewParser, parse.DefaultConstraints)
+	gob.RegisterName("SCM+", SCM{})
 }
 
 func NewPacketConfig(chipLength int) (cfg decode.PacketConfig) {
@@ -45,6 +46,8 @@ func NewPacketConfig(chipLength int) (cfg decode.PacketConfig) {
 type Parser struct {
 	decode.Decoder
 	crc.CRC
+
+	allowBadCRC bool
 }
 
 func (p Parser) Dec() decode.Decoder {
@@ -58,13 +61,21 @@ func (p *Parser) Cfg() *decode.PacketConfig {
 func NewParser(chipLength, decimation int) (p parse.Parser) {
 	return &Parser{
 		decode.NewDecoder(NewPacketConfig(chipLength), decimation),
-		crc.NewCRC("CCITT", 0xFFFF, 0x1021, 0x1D0F),
+		crc.NewCCITT(),
+		parse.AllowBadCRC,
 	}
 }
 
+// SetAllowBadCRC sets whether Parse keeps packets failing their checksum.
+func (p *Parser) SetAllowBadCRC(allow bool) {
+	p.allowBadCRC = allow
+}
+
 func (p Parser) Parse(indices []int) (msgs []parse.Message) {
 	seen := make(map[string]bool)
 
+	var failed []parse.Message
+
 	for _, pkt := range p.Decoder.Slice(indices) {
 		s := string(pkt)
 		if seen[s] {
@@ -74,19 +85,57 @@ func (p Parser) Parse(indices []int) (msgs []parse.Message) {
 
 		data := parse.NewDataFromBytes(pkt)
 
-		// If the checksum fails, bail.
-		if residue := p.Checksum(data.Bytes[2:]); residue != p.Residue {
+		// If the checksum fails, bail unless we're keeping failed packets.
+		checksumOK := p.Valid(data.Bytes[2:])
+		if !checksumOK && !p.allowBadCRC {
 			continue
 		}
 
 		scm := NewSCM(data)
+		scm.badChecksum = !checksumOK
 
 		// If the EndpointID is 0 or ProtocolID is invalid, bail.
 		if scm.EndpointID == 0 || scm.ProtocolID != 0x1E {
 			continue
 		}
 
-		msgs = append(msgs, scm)
+		if checksumOK {
+			msgs = append(msgs, scm)
+		} else {
+			failed = append(failed, scm)
+		}
+	}
+
+	if len(msgs) == 0 {
+		msgs = failed
+	}
+
+	return
+}
+
+// Diagnose explains why the packet at the preamble candidate idx did or
+// didn't parse.
+func (p Parser) Diagnose(idx int) (c parse.Candidate) {
+	pkts := p.Decoder.Slice([]int{idx})
+	if len(pkts) == 0 || len(pkts[0]) != 16 {
+		c.Stop = "length"
+		return
+	}
+	pkt := pkts[0]
+
+	c.Checksum = fmt.Sprintf("%04X", binary.BigEndian.Uint16(pkt[14:16]))
+	c.Expected = fmt.Sprintf("%04X", ^crc.CCITT(pkt[2:14]))
+	if !p.Valid(pkt[2:]) && !p.allowBadCRC {
+		c.Stop = "checksum"
+		return
+	}
+
+	scm := NewSCM(parse.NewDataFromBytes(pkt))
+	switch {
+	case scm.ProtocolID != 0x1E:
+		c.Stop = "protocol"
+	case scm.EndpointID == 0:
+		c.Stop = "id"
 	}
 
 	return
@@ -100,11 +149,21 @@ type SCM struct {
 	EndpointID   uint32 `xml:",attr"`
 	Consumption  uint32 `xml:",attr"`
 	Tamper       uint16 `xml:",attr"`
-	PacketCRC    uint16 `xml:"Checksum,attr",json:"Checksum"`
+	PacketCRC    uint16 `xml:"Checksum,attr"`
+
+	raw         []byte
+	badChecksum bool
 }
 
 func NewSCM(data parse.Data) (scm SCM) {
-	binary.Read(bytes.NewReader(data.Bytes), binary.BigEndian, &scm)
+	scm.FrameSync = binary.BigEndian.Uint16(data.Bytes[0:2])
+	scm.ProtocolID = data.Bytes[2]
+	scm.EndpointType = data.Bytes[3]
+	scm.EndpointID = binary.BigEndian.Uint32(data.Bytes[4:8])
+	scm.Consumption = binary.BigEndian.Uint32(data.Bytes[8:12])
+	scm.Tamper = binary.BigEndian.Uint16(data.Bytes[12:14])
+	scm.PacketCRC = binary.BigEndian.Uint16(data.Bytes[14:16])
+	scm.raw = data.Bytes
 
 	return
 }
@@ -121,12 +180,46 @@ func (scm SCM) MeterType() uint8 {
 	return scm.EndpointType
 }
 
+func (scm SCM) MeterConsumption() uint32 {
+	return scm.Consumption
+}
+
 func (scm SCM) Checksum() []byte {
 	checksum := make([]byte, 2)
 	binary.BigEndian.PutUint16(checksum, scm.PacketCRC)
 	return checksum
 }
 
+func (scm SCM) ChecksumOK() bool {
+	return !scm.badChecksum
+}
+
+func (scm SCM) Raw() []byte {
+	return scm.raw
+}
+
+func (scm SCM) Field(name string) (parse.Value, bool) {
+	switch name {
+	case "ProtocolID":
+		return parse.Num(float64(scm.ProtocolID)), true
+	case "EndpointType":
+		return parse.Num(float64(scm.EndpointType)), true
+	case "EndpointID":
+		return parse.Num(float64(scm.EndpointID)), true
+	case "Consumption":
+		return parse.Num(float64(scm.Consumption)), true
+	case "Tamper":
+		return parse.Num(float64(scm.Tamper)), true
+	}
+	return parse.Value{}, false
+}
+
+func (scm SCM) Flags() map[string]uint {
+	return map[string]uint{
+		"Tamper": uint(scm.Tamper),
+	}
+}
+
 func (scm SCM) String() string {
 	return fmt.Sprintf("{ProtocolID:0x%02X EndpointType:0x%02X EndpointID:%10d Consumption:%10d Tamper:0x%04X PacketCRC:0x%04X}",
 		scm.ProtocolID,
@@ -0,0 +1,112 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Status is sent to systemd at this interval if the unit has no watchdog.
+const notifyStatusInterval = 10 * time.Second
+
+// Notifier reports readiness, liveness and status to systemd through the
+// socket named by NOTIFY_SOCKET. A nil Notifier does nothing, so callers
+// needn't check whether rtlamr is running under systemd.
+type Notifier struct {
+	conn     *net.UnixConn
+	interval time.Duration // Between watchdog pings, half of WatchdogSec.
+	watchdog bool
+	last     time.Time
+}
+
+// NewNotifier connects to the socket named by NOTIFY_SOCKET. Returns nil if
+// it isn't set. Watchdog pings are sent if WATCHDOG_USEC is set and
+// WATCHDOG_PID, if set, is this process.
+func NewNotifier(getenv func(string) string, pid int) (*Notifier, error) {
+	socket := getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil, nil
+	}
+
+	// Abstract sockets are named with a leading @.
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+
+	n := &Notifier{conn: conn, interval: notifyStatusInterval}
+
+	if usec, err := strconv.ParseUint(getenv("WATCHDOG_USEC"), 10, 64); err == nil && usec != 0 {
+		watchdogPID := getenv("WATCHDOG_PID")
+		if watchdogPID == "" || watchdogPID == strconv.Itoa(pid) {
+			n.watchdog = true
+			n.interval = time.Duration(usec) * time.Microsecond / 2
+		}
+	}
+
+	return n, nil
+}
+
+// Notify sends the given newline separated assignments, such as READY=1.
+func (n *Notifier) Notify(state string) error {
+	if n == nil {
+		return nil
+	}
+	_, err := n.conn.Write([]byte(state))
+	return err
+}
+
+// Ready tells systemd startup has finished.
+func (n *Notifier) Ready() error {
+	return n.Notify("READY=1")
+}
+
+// Alive is called after each sample block is decoded. At most once per
+// interval it pings the watchdog, if enabled, and updates the unit's status
+// with the result of status. If blocks stop arriving the pings stop and
+// systemd restarts the unit once WatchdogSec elapses.
+func (n *Notifier) Alive(now time.Time, status func() string) error {
+	if n == nil || now.Sub(n.last) < n.interval {
+		return nil
+	}
+	n.last = now
+
+	state := "STATUS=" + status()
+	if n.watchdog {
+		state = "WATCHDOG=1\n" + state
+	}
+	return n.Notify(state)
+}
+
+// Stopping tells systemd the receiver is shutting down.
+func (n *Notifier) Stopping() error {
+	return n.Notify("STOPPING=1")
+}
+
+func (n *Notifier) Close() error {
+	if n == nil {
+		return nil
+	}
+	return n.conn.Close()
+}
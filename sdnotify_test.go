@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNotifier(t *testing.T) {
+	dir, err := ioutil.TempDir("", "notify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "notify")
+	listener, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Skip("unixgram sockets unsupported:", err)
+	}
+	defer listener.Close()
+
+	env := map[string]string{
+		"NOTIFY_SOCKET": socket,
+		"WATCHDOG_USEC": "2000000",
+		"WATCHDOG_PID":  "42",
+	}
+
+	n, err := NewNotifier(func(name string) string { return env[name] }, 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	if n.interval != time.Second {
+		t.Fatalf("Expected watchdog interval of %s got %s\n", time.Second, n.interval)
+	}
+
+	recv := func() string {
+		buf := make([]byte, 256)
+		listener.SetReadDeadline(time.Now().Add(time.Second))
+		nr, err := listener.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf[:nr])
+	}
+
+	n.Ready()
+	if msg := recv(); msg != "READY=1" {
+		t.Fatalf("Expected %q got %q\n", "READY=1", msg)
+	}
+
+	status := func() string { return "Decoded: 1" }
+	start := time.Now()
+	n.Alive(start, status)
+	if msg, expt := recv(), "WATCHDOG=1\nSTATUS=Decoded: 1"; msg != expt {
+		t.Fatalf("Expected %q got %q\n", expt, msg)
+	}
+
+	// Pings are limited to one per interval.
+	n.Alive(start.Add(time.Second/2), status)
+	n.Alive(start.Add(time.Second), status)
+	if msg, expt := recv(), "WATCHDOG=1\nSTATUS=Decoded: 1"; msg != expt {
+		t.Fatalf("Expected %q got %q\n", expt, msg)
+	}
+	listener.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := listener.Read(make([]byte, 256)); err == nil {
+		t.Fatal("Expected a single ping per interval")
+	}
+}
+
+func TestNotifierDisabled(t *testing.T) {
+	n, err := NewNotifier(func(string) string { return "" }, 42)
+	if n != nil || err != nil {
+		t.Fatalf("Expected nil notifier without NOTIFY_SOCKET got %v, %v\n", n, err)
+	}
+
+	// A nil notifier does nothing.
+	if err := n.Ready(); err != nil {
+		t.Fatal(err)
+	}
+	n.Alive(time.Now(), func() string { return "" })
+	n.Close()
+}
@@ -0,0 +1,149 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bemasher/rtlamr/gen"
+	"github.com/bemasher/rtlamr/parse"
+	"github.com/bemasher/rtlamr/receiver"
+)
+
+// Fields of the packets generated by -selftest, and the SNR they're sent at.
+const (
+	selfTestID          = 12345678
+	selfTestType        = 7
+	selfTestConsumption = 123456
+	selfTestSNR         = 20
+)
+
+// SelfTestResult is the outcome of decoding a generated packet of one
+// message type.
+type SelfTestResult struct {
+	MsgType string
+	Pass    bool
+	Error   string `json:",omitempty"`
+}
+
+// SelfTest generates a packet of each registered message type, decodes it
+// through the same receiver replay uses with the configured -symbollength
+// and -decimation, and verifies the decoded fields.
+func SelfTest(ctx context.Context) (results []SelfTestResult) {
+	for _, name := range parse.Names() {
+		result := SelfTestResult{MsgType: name, Pass: true}
+		if err := selfTestMsgType(ctx, name); err != nil {
+			result.Pass, result.Error = false, err.Error()
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// selfTestMsgType decodes a generated packet of the given message type, returning
+// why it failed if it did.
+func selfTestMsgType(ctx context.Context, msgType string) error {
+	cfg, err := parse.Config(msgType, *symbolLength)
+	if err != nil {
+		return err
+	}
+	newPacket, err := genPacket(msgType, selfTestID, selfTestType, selfTestConsumption, 0, 0)
+	if err != nil {
+		return err
+	}
+
+	ch := gen.Channel{SNR: selfTestSNR, Rand: rand.New(rand.NewSource(1))}
+	samples := genSamples(cfg, ch, 1, 50*time.Millisecond, func(idx int) []byte {
+		return newPacket(idx, selfTestConsumption)
+	})
+
+	rcvr, err := receiver.NewFromSource(receiver.Config{
+		MsgType:      msgType,
+		SymbolLength: *symbolLength,
+		Decimation:   *decimation,
+		AllowBadCRC:  true,
+	}, receiver.NewReaderSource(bytes.NewReader(samples)))
+	if err != nil {
+		return err
+	}
+
+	var msgs []parse.LogMessage
+	if err := rcvr.Run(ctx, func(msg parse.LogMessage) error {
+		msgs = append(msgs, msg)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if len(msgs) != 1 {
+		return fmt.Errorf("decoded %d packets, expected 1", len(msgs))
+	}
+	msg := msgs[0]
+	if !msg.Message.ChecksumOK() {
+		return fmt.Errorf("checksum failed")
+	}
+	if id := msg.MeterID(); id != selfTestID {
+		return fmt.Errorf("decoded id %d, expected %d", id, selfTestID)
+	}
+	// R900 packets carry no meter type.
+	if t := msg.MeterType(); t != selfTestType && !strings.HasPrefix(msgType, "r900") {
+		return fmt.Errorf("decoded type %d, expected %d", t, selfTestType)
+	}
+	if c := msg.MeterConsumption(); c != selfTestConsumption {
+		return fmt.Errorf("decoded consumption %d, expected %d", c, selfTestConsumption)
+	}
+
+	return nil
+}
+
+// writeSelfTest writes the results as a table, or as a line of json with
+// -format=json. Returns whether every message type passed.
+func writeSelfTest(w io.Writer, results []SelfTestResult) (bool, error) {
+	pass := true
+	for _, result := range results {
+		pass = pass && result.Pass
+	}
+
+	if *format == "json" {
+		return pass, json.NewEncoder(w).Encode(struct {
+			Pass      bool
+			Protocols []SelfTestResult
+		}{pass, results})
+	}
+
+	var b strings.Builder
+	tw := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	for _, result := range results {
+		if result.Pass {
+			fmt.Fprintf(tw, "%s\tpass\n", result.MsgType)
+		} else {
+			fmt.Fprintf(tw, "%s\tFAIL\t%s\n", result.MsgType, result.Error)
+		}
+	}
+	tw.Flush()
+
+	_, err := io.WriteString(w, b.String())
+	return pass, err
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSelfTest(t *testing.T) {
+	dir := t.TempDir()
+	out, err := os.Create(filepath.Join(dir, "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	if status := runRtlamr(t, out, "-selftest", "-format=json"); status != exitOK {
+		t.Fatalf("expected status %d, got %d", exitOK, status)
+	}
+	buf, _ := os.ReadFile(out.Name())
+	var report struct {
+		Pass      bool
+		Protocols []SelfTestResult
+	}
+	if err := json.Unmarshal(buf, &report); err != nil {
+		t.Fatal(err)
+	}
+	if !report.Pass || len(report.Protocols) != 5 {
+		t.Errorf("unexpected report %s", buf)
+	}
+
+	var text strings.Builder
+	pass, err := writeSelfTest(&text, []SelfTestResult{
+		{MsgType: "scm", Pass: true},
+		{MsgType: "idm", Error: "decoded 0 packets, expected 1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pass || text.String() != "scm  pass\nidm  FAIL  decoded 0 packets, expected 1\n" {
+		t.Errorf("unexpected results %t:\n%s", pass, text.String())
+	}
+
+	signal := fakeRTLTCP(t, scmSignal(t))
+	if status := runRtlamr(t, nil, "-selftest", "-selftest.rf", "-server="+signal); status != exitOK {
+		t.Errorf("-selftest.rf: expected status %d, got %d", exitOK, status)
+	}
+	if status := runRtlamr(t, nil, "-selftest.rf", "-server="+signal); status != exitUsage {
+		t.Errorf("-selftest.rf alone: expected status %d, got %d", exitUsage, status)
+	}
+}
@@ -0,0 +1,897 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/bemasher/rtlamr/idm"
+	"github.com/bemasher/rtlamr/parse"
+	"github.com/bemasher/rtlamr/r900"
+	"github.com/bemasher/rtlamr/receiver"
+)
+
+// session is the state of one Run: reading blocks from rtl_tcp, the hooks
+// handling what the receiver decodes from them and the timers running
+// alongside. Samples are decoded on the receiver's goroutine and messages
+// written on the goroutine delivering them, while timers run on Run's.
+// State shared between them is only touched holding mu, which the receiver
+// holds while calling hooks.
+type session struct {
+	rcvr  *Receiver
+	ctx   context.Context
+	start time.Time
+	debug bool // Avoid building per-block debug messages unless they'll be logged.
+
+	mu sync.Mutex
+
+	// Why and with which status the receiver stopped, see stop and end.
+	streamCtx  context.Context
+	stopStream context.CancelFunc
+	reason     string
+	fatal      error
+	halted     bool
+	stopStatus int
+	ended      func() int
+
+	// Consecutive failures of each operation are counted against
+	// -retry.max, after which fatal is set and the receiver exits.
+	reading, encoding, writing, dumping retrier
+
+	// Blocks read from rtl_tcp, see read.
+	in            *io.PipeReader
+	watchdog      *Watchdog
+	readNext      chan blockRead
+	readDone      chan blockRead
+	readPending   bool
+	handleStart   time.Time // When the block being handled was read.
+	blockDuration time.Duration
+	packetClock   *Clock // Packets are held until the clock looks right, see -waitforclock.
+	active        bool   // Within -schedule's windows.
+	scheduleTimer <-chan time.Time
+	notifier      *Notifier
+	ready         bool
+
+	// Raw samples held for -samplefile and -snippets, see newRecorder.
+	recording bool
+	recorder  *sampleRecorder
+	snippets  *SnippetWriter
+	rotation  *sampleRotation
+
+	bitDumper       *BitDumper
+	candidateLogger *CandidateLogger
+	noPackets       *NoPacketWatchdog
+
+	statusSink *syncWriter
+	statusLine *StatusLine
+	tui        *TUI
+
+	// Set by hooks for those following them.
+	timing      PacketTiming
+	timeSuspect bool
+	pktFound    bool   // A packet was found in the block being decoded.
+	leakAlert   *Alert // Raised by the message being emitted.
+	encodeErr   error
+}
+
+// exit returns the exit status once the receiver stops, non-zero if it
+// gave up on an error or the time limit passed without a message.
+func (s *session) exit() int {
+	if s.fatal != nil {
+		slog.Error(s.fatal.Error())
+		s.reason = "error"
+		return exitStatus(s.fatal, exitFatal)
+	}
+	if s.reason == "time limit reached" && s.rcvr.stats.Emitted == 0 {
+		return exitNoMessages
+	}
+	return exitOK
+}
+
+// stop records the exit status and stops the receiver once the block being
+// decoded has been handled and its samples written. Messages still waiting
+// to be written are discarded. Called holding mu.
+func (s *session) stop(status int) {
+	s.stopStatus, s.halted = status, true
+	s.stopStream()
+}
+
+// end stops the receiver for the given reason once the messages already
+// decoded have been written, exiting with the status returned by status.
+// Called holding mu.
+func (s *session) end(why string, status func() int) {
+	s.reason, s.ended = why, status
+}
+
+// finish stops the receiver for the given reason, unless it's already
+// stopping.
+func (s *session) finish(why string, status func() int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.halted && s.ended == nil {
+		s.reason = why
+		s.stop(status())
+	}
+}
+
+// stopping returns true once the receiver is stopping, so the packets
+// following the one stopping it are skipped.
+func (s *session) stopping() bool {
+	return s.halted || s.ended != nil
+}
+
+// wait blocks for the given duration. Returns false if the receiver stopped
+// first.
+func (s *session) wait(d time.Duration) bool {
+	select {
+	case <-s.streamCtx.Done():
+		return false
+	case <-s.rcvr.clock.After(d):
+		return true
+	}
+}
+
+// startReader copies samples from rtl_tcp until either the connection or
+// the returned reader is closed. Errors reading from rtl_tcp are returned by
+// the reader, as is errStalled if the watchdog finds delivery has stalled.
+func (s *session) startReader() *io.PipeReader {
+	in, out := io.Pipe()
+	stopped := make(chan struct{})
+	s.watchdog.Start(time.Now())
+
+	// Unblock the reader once ctx is cancelled, even if rtl_tcp has stopped
+	// sending.
+	go func() {
+		select {
+		case <-s.ctx.Done():
+			out.CloseWithError(s.ctx.Err())
+		case <-stopped:
+		}
+	}()
+
+	go func() {
+		defer close(stopped)
+
+		tcpBlock := make([]byte, 16384)
+		for {
+			// Time out reads so the watchdog notices if rtl_tcp stops
+			// sending entirely.
+			if s.watchdog != nil {
+				s.rcvr.SetReadDeadline(time.Now().Add(watchdogWindow))
+			}
+			n, err := s.rcvr.Read(tcpBlock)
+			var nerr net.Error
+			if err != nil && !(s.watchdog != nil && errors.As(err, &nerr) && nerr.Timeout()) {
+				out.CloseWithError(err)
+				return
+			}
+
+			now := time.Now()
+			s.watchdog.Deliver(now, tcpBlock[:n])
+			if s.watchdog.Stalled(now) {
+				out.CloseWithError(errStalled)
+				return
+			}
+
+			if n == 0 {
+				continue
+			}
+			if _, err := out.Write(tcpBlock[:n]); err != nil {
+				return
+			}
+		}
+	}()
+	return in
+}
+
+// restart reconnects to rtl_tcp after reading samples failed with err,
+// backing off between attempts. Returns false if the receiver stopped, or
+// was stopped as too many attempts failed.
+func (s *session) restart(err error) bool {
+	s.in.Close()
+	s.rcvr.Close()
+
+	for {
+		if err := s.reading.Fail(err); err != nil {
+			s.mu.Lock()
+			s.fatal = err
+			s.stop(s.exit())
+			s.mu.Unlock()
+			return false
+		}
+		slog.Debug("Reconnecting to rtl_tcp", "attempt", s.reading.failures, "backoff", s.reading.Backoff())
+		if !s.wait(s.reading.Backoff()) {
+			return false
+		}
+		if err = s.rcvr.reconnect(); err == nil {
+			s.in = s.startReader()
+			return true
+		}
+	}
+}
+
+// suspend releases rtl_tcp until the given time and reconnects. Returns
+// false if the receiver stopped while suspended.
+func (s *session) suspend(until time.Time) bool {
+	s.in.Close()
+	s.rcvr.Close()
+	log.Println("Schedule: released rtl_tcp until", until.Format(time.RFC3339))
+
+	if !s.wait(until.Sub(s.rcvr.clock.Now())) {
+		return false
+	}
+
+	if err := s.rcvr.reconnect(); err != nil {
+		return s.restart(err)
+	}
+	s.in = s.startReader()
+
+	return true
+}
+
+// startReading reads blocks on a goroutine of its own so cancellation, the
+// time limit and timers are seen while rtl_tcp is silent. Each read is
+// requested with the reader to read from, which is answered with its error,
+// and the block read into isn't touched until it has been. Reading stops
+// once the returned function is called.
+func (s *session) startReading() (stop func()) {
+	s.readNext, s.readDone = make(chan blockRead), make(chan blockRead, 1)
+	go func() {
+		for read := range s.readNext {
+			_, read.err = io.ReadFull(read.r, read.block)
+			s.readDone <- read
+		}
+	}()
+	return func() { close(s.readNext) }
+}
+
+// read reads a block from rtl_tcp for the receiver, reconnecting while it
+// waits for it and only passing on blocks read within -schedule's windows.
+func (s *session) read(block []byte) error {
+	rcvr := s.rcvr
+	for {
+		if err := s.streamCtx.Err(); err != nil {
+			return err
+		}
+		// Blocks are only decoded on the receiver's goroutine, which calls
+		// end from its hooks.
+		if s.ended != nil {
+			return io.EOF
+		}
+		if !s.readPending {
+			// rtl_tcp buffers samples while a block is handled, falling
+			// behind if handling takes longer than the block spans.
+			if !s.handleStart.IsZero() && time.Since(s.handleStart) > s.blockDuration {
+				s.mu.Lock()
+				rcvr.stats.Overruns++
+				s.mu.Unlock()
+			}
+			s.handleStart = time.Time{}
+			s.readNext <- blockRead{r: s.in, block: block}
+			s.readPending = true
+		}
+
+		select {
+		case <-s.streamCtx.Done():
+			// Stop reading from rtl_tcp before anything else once
+			// interrupted.
+			if s.ctx.Err() != nil {
+				rcvr.Close()
+				s.in.Close()
+			}
+		case <-s.scheduleTimer:
+			now := rcvr.clock.Now()
+			next := schedule.Next(now)
+			s.mu.Lock()
+			s.active = schedule.Active(now)
+			if s.active {
+				log.Println("Schedule: receiving until", next.Format(time.RFC3339))
+				rcvr.absenceMonitor.Resume(now)
+			} else {
+				log.Println("Schedule: idle until", next.Format(time.RFC3339))
+				rcvr.syncOutputs()
+				if *stateFilename != "" {
+					if err := rcvr.SaveState(*stateFilename); err != nil {
+						slog.Error("saving state", "err", err)
+					}
+				}
+			}
+			s.mu.Unlock()
+			if !s.active && *scheduleSuspend {
+				if !s.suspend(next) {
+					continue
+				}
+				now = rcvr.clock.Now()
+				s.mu.Lock()
+				s.active = true
+				rcvr.absenceMonitor.Resume(now)
+				s.mu.Unlock()
+				next = schedule.Next(now)
+				log.Println("Schedule: receiving until", next.Format(time.RFC3339))
+			}
+			s.scheduleTimer = rcvr.clock.After(next.Sub(now))
+		case read := <-s.readDone:
+			s.readPending = false
+			// Reads from a reader since replaced, such as while suspended by
+			// -schedule, are discarded.
+			if read.r != s.in {
+				continue
+			}
+
+			// Reconnect to rtl_tcp on error.
+			if err := read.err; err != nil {
+				if s.streamCtx.Err() != nil {
+					continue
+				}
+				// Reissue the tuner configuration and discard the partial
+				// block on a stall, reconnecting if that isn't helping.
+				if errors.Is(err, errStalled) {
+					s.mu.Lock()
+					rcvr.stats.Stalls++
+					s.mu.Unlock()
+					if !s.watchdog.Reset(time.Now()) {
+						slog.Warn("sample delivery stalled, resetting", "stallthreshold", *stallThreshold)
+						s.mu.Lock()
+						rcvr.stats.StallResets++
+						s.mu.Unlock()
+						rcvr.tune(!gainFlagsSet())
+						s.in = s.startReader()
+						continue
+					}
+					slog.Warn("sample delivery stalled repeatedly, reconnecting", "stallthreshold", *stallThreshold)
+				}
+				s.restart(err)
+				continue
+			}
+			s.reading.Succeed()
+			s.handleStart = time.Now()
+
+			// Ping systemd's watchdog for every block read, including those
+			// discarded outside of -schedule windows, so only stalled
+			// sample delivery restarts the unit.
+			s.mu.Lock()
+			if !s.ready {
+				s.notifier.Ready()
+				s.ready = true
+			}
+			s.notifier.Alive(time.Now(), s.status)
+			rcvr.health.Block(time.Now(), rcvr.stats)
+			rcvr.otel.Block(rcvr.stats)
+
+			// Outside of the schedule's windows, keep the stream flowing
+			// but don't decode.
+			decoding := s.active
+			if decoding {
+				rcvr.stats.Blocks++
+			}
+			s.mu.Unlock()
+			if !decoding {
+				continue
+			}
+			return nil
+		}
+	}
+}
+
+// status describes the receiver's progress to systemd.
+func (s *session) status() string {
+	return fmt.Sprintf("Decoded %d packets, emitted %d messages", s.rcvr.stats.Decoded, s.rcvr.stats.Emitted)
+}
+
+// newRecorder sets up the raw samples held for -samplefile and -snippets,
+// with enough history for the samples written around packets, and for the
+// offsets of messages without them.
+func (s *session) newRecorder(blockSize int) {
+	rcvr := s.rcvr
+	s.recording = *sampleFilename != os.DevNull || *snippetDir != ""
+	var recordSize int
+	for _, p := range rcvr.parsers {
+		recordSize = max(recordSize, p.Cfg().BufferLength<<1)
+	}
+	padding := func(d time.Duration) int64 {
+		return int64(d) * int64(rcvr.sampleRate) / int64(time.Second) << 1
+	}
+	if *snippetDir != "" {
+		s.snippets = NewSnippetWriter(*snippetDir, *snippetPre, *snippetPost, snippetMax, rcvr.sampleRate)
+		recordSize += int(s.snippets.History())<<1 + blockSize
+	}
+	s.recorder = newSampleRecorder(recordSize, rcvr.sampleRate)
+	if *sampleFilename != os.DevNull {
+		s.recorder.pre, s.recorder.post = padding(*samplePre), padding(*samplePost)
+		s.recorder.size += int(s.recorder.pre+s.recorder.post) + blockSize
+	}
+	if *sampleSigMF {
+		s.recorder.sigmf = NewSigMF(sigmfGlobal{
+			SampleRate:    rcvr.sampleRate,
+			Commit:        commitHash,
+			BuildDate:     buildDate,
+			MsgType:       *msgType,
+			TunerGainMode: rcvr.Flags.TunerGainMode,
+			TunerGain:     rcvr.Flags.TunerGain,
+			GainByIndex:   rcvr.Flags.GainByIndex,
+			AGC:           rcvr.Flags.AgcMode,
+		})
+	}
+	if sampleIndexFile != nil {
+		s.recorder.index = NewSampleIndex(sampleIndexFile, *msgType)
+	}
+	if sampleRotateSize != 0 || *sampleRotateInterval != 0 {
+		s.rotation = &sampleRotation{
+			size:     int64(sampleRotateSize),
+			interval: *sampleRotateInterval,
+			maxTotal: int64(sampleRotateMaxTotal),
+			opened:   time.Now(),
+		}
+	}
+}
+
+// flushRecorder writes the windows waiting for samples and the snippets
+// waiting for padding as they are, once the receiver has stopped.
+func (s *session) flushRecorder() {
+	if s.recorder.Windowed() {
+		err := s.recorder.Flush(s.rcvr.sampleFile, s.rcvr.centerFreq, true)
+		if err == nil && s.recorder.sigmf != nil {
+			err = s.recorder.sigmf.Flush()
+		}
+		if err == nil && s.recorder.index != nil {
+			err = s.recorder.index.Flush()
+		}
+		if err != nil {
+			slog.Error("writing sample file", "err", err)
+		}
+	}
+	if s.snippets != nil {
+		if err := s.snippets.Write(s.recorder, true); err != nil {
+			slog.Error("writing snippets", "err", err)
+		}
+	}
+}
+
+// recorded handles the result of writing to -samplefile: samples which fail
+// to write are skipped and the file is reopened. Returns false if too many
+// writes have failed.
+func (s *session) recorded(err error) bool {
+	if err != nil {
+		if s.fatal = s.writing.Fail(err); s.fatal != nil {
+			return false
+		}
+		if err := s.rcvr.reopenSampleFile(s.rcvr.sampleFile.Name()); err != nil {
+			s.fatal = s.writing.Fail(err)
+		}
+		return s.fatal == nil
+	}
+	// The metadata is rewritten in full next time.
+	if s.recorder.sigmf != nil {
+		if err := s.recorder.sigmf.Flush(); err != nil {
+			s.fatal = s.writing.Fail(err)
+			return s.fatal == nil
+		}
+	}
+	if s.recorder.index != nil {
+		if err := s.recorder.index.Flush(); err != nil {
+			s.fatal = s.writing.Fail(err)
+			return s.fatal == nil
+		}
+	}
+	s.writing.Succeed()
+	return true
+}
+
+// samplesHooks holds each block until a packet is found, writing windows
+// and snippets now followed by enough samples. Blocks are held without
+// -samplefile too, so offsets count the sample stream.
+func (s *session) samplesHooks(recv *receiver.Receiver) {
+	rcvr := s.rcvr
+	recv.OnSamples("samplefile", func(block []byte, meta receiver.Meta) {
+		s.recorder.Add(block, meta.Time)
+		if s.recorder.Windowed() {
+			if !s.recorded(s.recorder.Flush(rcvr.sampleFile, rcvr.centerFreq, false)) {
+				s.stop(s.exit())
+				return
+			}
+		}
+		// Rotating between blocks keeps packets whole, and waits for
+		// windows whose offsets were given in the current file.
+		if s.rotation != nil && !s.recorder.Queued() && s.rotation.Due(meta.Time, rcvr.sampleFile) {
+			var err error
+			rcvr.sampleFile, err = s.rotation.Rotate(meta.Time, rcvr.sampleFile, s.recorder.sigmf, s.recorder.index)
+			if err != nil {
+				slog.Error("rotating sample file", "err", err)
+			}
+		}
+	})
+	if s.snippets != nil {
+		recv.OnSamples("snippets", func([]byte, receiver.Meta) {
+			if err := s.snippets.Write(s.recorder, false); err != nil {
+				if s.fatal = s.writing.Fail(err); s.fatal != nil {
+					s.stop(s.exit())
+				}
+			} else {
+				s.writing.Succeed()
+			}
+		})
+	}
+}
+
+// decodeHooks counts the packets decoded, writes -dumpbits and
+// -debugcandidates and feeds -nopacketwatchdog.
+func (s *session) decodeHooks(recv *receiver.Receiver) {
+	rcvr := s.rcvr
+	recv.OnDecode("stats", func(d receiver.Decode) {
+		if rcvr.otel.Tracing() {
+			s.timing.ParseEnd = time.Now()
+			s.timing.ParseStart = s.timing.ParseEnd.Add(-d.Parsing)
+			s.timing.DecodeStart = s.timing.ParseStart.Add(-d.Decoding)
+		}
+		for _, pkt := range d.Packets {
+			rcvr.stats.Packet(pkt)
+		}
+	})
+	if s.bitDumper != nil {
+		recv.OnDecode("dumpbits", func(d receiver.Decode) {
+			if err := s.bitDumper.Dump(d.Parser.Dec(), d.Indices, rcvr.stats.Blocks); err != nil {
+				if s.fatal = s.dumping.Fail(err); s.fatal != nil {
+					s.stop(s.exit())
+				}
+			} else {
+				s.dumping.Succeed()
+			}
+		})
+	}
+	if s.candidateLogger != nil {
+		recv.OnDecode("debugcandidates", func(d receiver.Decode) {
+			s.candidateLogger.Log(d.Parser, d.Indices, rcvr.stats.Blocks)
+		})
+	}
+	// -minsnr estimates the SNR of packets from the samples of the block
+	// being filtered, which the recorder always holds.
+	if rcvr.minSNRFilter != nil {
+		var located receiver.Meta
+		recv.OnDecode("minsnr", func(d receiver.Decode) {
+			located = d.Meta
+		})
+		rcvr.minSNRFilter.SNR = func(parse.Message) float64 {
+			return estimateSNR(s.recorder.Samples(s.recorder.Locate(located.Start, located.Count)))
+		}
+	}
+	recv.OnDecode("nopacketwatchdog", func(d receiver.Decode) {
+		for _, pkt := range d.Packets {
+			if pkt.ChecksumOK() {
+				s.noPackets.Packet()
+				return
+			}
+		}
+	})
+}
+
+// filterHooks drops packets failing -strictidm, each stage of the filter
+// chain and, while the clock isn't synchronized, -waitforclock.
+func (s *session) filterHooks(recv *receiver.Receiver) {
+	rcvr := s.rcvr
+	if *strictIDM {
+		recv.OnFilter("strictidm", func(pkt parse.Message, meta receiver.Meta) bool {
+			if idmMsg, ok := pkt.(idm.IDM); ok && !idmMsg.IsConsistent() {
+				if s.debug {
+					slog.Debug("Dropped inconsistent IDM", "id", pkt.MeterID())
+				}
+				return false
+			}
+			return true
+		})
+	}
+	// Each stage of the filter chain is a hook of its own.
+	for _, stage := range rcvr.fc.Stages() {
+		recv.OnFilter(stage.Name, func(pkt parse.Message, meta receiver.Meta) bool {
+			if !stage.Match(pkt) {
+				if s.debug {
+					slog.Debug("Filtered", "filter", stage.Name, "msgtype", pkt.MsgType(), "id", pkt.MeterID(), "type", pkt.MeterType(), "consumption", pkt.MeterConsumption())
+				}
+				return false
+			}
+			return true
+		})
+	}
+	if *waitForClock != 0 {
+		clockSane, clockWarned, held := false, false, 0
+		recv.OnFilter("waitforclock", func(parse.Message, receiver.Meta) bool {
+			s.timeSuspect = false
+			switch {
+			case clockSane:
+			case s.packetClock.Sane():
+				clockSane = true
+				log.Printf("Clock is synchronized, dropped %d packets while waiting\n", held)
+			case rcvr.clock.Now().Sub(s.start) < *waitForClock:
+				held++
+				return false
+			default:
+				s.timeSuspect = true
+				if !clockWarned {
+					slog.Warn("clock not synchronized, marking packet times suspect", "waitforclock", *waitForClock, "dropped", held)
+					clockWarned = true
+				}
+			}
+			return true
+		})
+	}
+}
+
+// packetHooks locates messages in the sample stream, giving their offsets
+// in -samplefile, and records the samples around them. -msglimit and -single
+// are counted as packets pass the filters, so -single's filters drop the
+// meters satisfied, and the receiver stops once those decoded have been
+// written. Packets following the one stopping the receiver are skipped.
+func (s *session) packetHooks(recv *receiver.Receiver) {
+	rcvr := s.rcvr
+	recv.OnPacket("samplefile", func(msg *parse.LogMessage, meta receiver.Meta) {
+		msg.CenterFreq = rcvr.centerFreq
+		msg.TimeSuspect = s.timeSuspect
+		if s.stopping() {
+			return
+		}
+		s.pktFound = true
+
+		var start, count int64
+		if s.recording {
+			start, count = s.recorder.Locate(meta.Start, meta.Count)
+		}
+		switch {
+		case *sampleFilename == os.DevNull:
+			msg.Offset, msg.Length = s.recorder.start, s.recorder.Len()
+		case s.recorder.Windowed():
+			msg.Offset, msg.Length = s.recorder.WindowOffset(rcvr.sampleFile, start, count)
+		default:
+			msg.Offset = s.recorder.Offset(rcvr.sampleFile)
+			msg.Length = s.recorder.Len()
+		}
+
+		pkt := msg.Message
+		if s.snippets != nil {
+			s.snippets.Add(s.recorder, pkt, msg.Time, rcvr.centerFreq, start, count)
+		}
+		if s.recorder.Windowed() {
+			s.recorder.Queue(start, count)
+		}
+		if s.recorder.Annotating() {
+			s.recorder.Annotate(sigmfAnnotation{
+				SampleStart: start,
+				SampleCount: count,
+				Label:       fmt.Sprintf("%s %d", pkt.MsgType(), pkt.MeterID()),
+				MeterID:     pkt.MeterID(),
+				MsgType:     pkt.MsgType(),
+				SNR:         estimateSNR(s.recorder.Samples(start, count)),
+				ChecksumOK:  pkt.ChecksumOK(),
+			})
+		}
+	})
+
+	if *msgLimit != 0 {
+		// With -msglimit.pertype messages are counted by type, and the limit
+		// is reached once every type in -msgtype has reached it.
+		received := make(map[string]uint64)
+		msgTypes := []string{""}
+		if *msgLimitPerType {
+			msgTypes = singleMsgTypes()
+		}
+		recv.OnPacket("msglimit", func(msg *parse.LogMessage, _ receiver.Meta) {
+			if s.stopping() {
+				return
+			}
+			msgType := ""
+			if *msgLimitPerType {
+				msgType = msg.MsgType()
+			}
+			received[msgType]++
+			for _, msgType := range msgTypes {
+				if received[msgType] < *msgLimit {
+					return
+				}
+			}
+			s.end("message limit reached", func() int { return exitOK })
+		})
+	}
+	if *single {
+		recv.OnPacket("single", func(msg *parse.LogMessage, meta receiver.Meta) {
+			// Packets failing checksum don't satisfy -single.
+			if s.stopping() || !msg.Message.ChecksumOK() {
+				return
+			}
+			rcvr.singleSatisfy(msg.MsgType(), uint(msg.MeterID()))
+			if rcvr.singleDone() {
+				s.end("single satisfied", rcvr.singleExit)
+			}
+		})
+	}
+}
+
+// blockHooks acts on -nopacketwatchdog once each parser has decoded the
+// block, and writes the samples held once the block's messages are, unless
+// windows around packets are written once the samples following them have
+// been read.
+func (s *session) blockHooks(recv *receiver.Receiver) {
+	rcvr := s.rcvr
+	// Retuning is relative to the configured center frequency.
+	baseFreq := rcvr.centerFreq
+	recv.OnBlock("nopacketwatchdog", func(receiver.BlockStats) {
+		switch s.noPackets.Decoded(s.blockDuration) {
+		case "":
+		case noPacketAgain:
+			slog.Warn("no packets decoded, switching to automatic gain", "nopacketwatchdog", *noPacketWindow)
+			rcvr.SetGainMode(false)
+			rcvr.SetAGCMode(true)
+		case noPacketRetune:
+			rcvr.centerFreq = s.noPackets.Retune(baseFreq, rcvr.sampleRate)
+			slog.Warn("no packets decoded, retuning", "nopacketwatchdog", *noPacketWindow, "centerfreq", rcvr.centerFreq)
+			rcvr.SetCenterFreq(rcvr.centerFreq)
+		case noPacketExit:
+			slog.Warn("no packets decoded, exiting", "nopacketwatchdog", *noPacketWindow)
+			s.reason = "no packets decoded"
+			s.stop(exitNoPackets)
+		default:
+			slog.Warn("no packets decoded", "nopacketwatchdog", *noPacketWindow)
+		}
+	})
+	recv.OnBlock("samplefile", func(receiver.BlockStats) {
+		if s.pktFound && *sampleFilename != os.DevNull && !s.recorder.Windowed() {
+			if !s.recorded(s.recorder.Write(rcvr.sampleFile, rcvr.centerFreq)) {
+				s.stop(s.exit())
+			}
+		}
+		s.pktFound = false
+	})
+	if s.debug {
+		recv.OnBlock("debug", func(bs receiver.BlockStats) {
+			slog.Debug("Decoded block", "block", rcvr.stats.Blocks, "elapsed", bs.Elapsed, "candidates", bs.Candidates, "packets", bs.Packets)
+		})
+	}
+}
+
+// emitHooks amends and writes messages, skipping those following the one
+// stopping the receiver, and counts those the stream drops.
+func (s *session) emitHooks(recv *receiver.Receiver) {
+	rcvr := s.rcvr
+	emit := func(name string, fn func(msg *parse.LogMessage)) {
+		recv.OnEmit(name, func(msg *parse.LogMessage) {
+			if !s.halted {
+				fn(msg)
+			}
+		})
+	}
+
+	emit("multiplier", rcvr.multiplier.Apply)
+	emit("aliases", rcvr.aliases.Apply)
+	if rcvr.deltaTracker != nil {
+		emit("delta", rcvr.deltaTracker.Apply)
+	}
+	if leakDetector != nil {
+		emit("leak", func(msg *parse.LogMessage) {
+			s.leakAlert = leakDetector.Observe(*msg)
+		})
+	}
+	if *idmConsistent {
+		emit("idmconsistent", func(msg *parse.LogMessage) {
+			if idmMsg, ok := msg.Message.(idm.IDM); ok {
+				consistent := idmMsg.IsConsistent()
+				msg.Consistent = &consistent
+			}
+		})
+	}
+	if *r900Extended {
+		emit("r900extended", func(msg *parse.LogMessage) {
+			if r900msg, ok := msg.Message.(r900.R900); ok {
+				msg.Message = r900.NewExtended(r900msg)
+			}
+		})
+	}
+	if *merge {
+		emit("merge", func(msg *parse.LogMessage) {
+			if msg.Message.ChecksumOK() {
+				msg.Message = rcvr.mergeState.Update(msg.Message, msg.Time)
+			}
+		})
+	}
+
+	// Messages which fail to encode are dropped, the hooks following encode
+	// only see those written.
+	emit("encode", func(msg *parse.LogMessage) {
+		// Merged messages are collected from the packet triggering them.
+		pkt := msg.Message
+		if mm, ok := pkt.(MergedMessage); ok {
+			pkt = mm.trigger
+		}
+
+		if rcvr.otel.Tracing() {
+			s.timing.WriteStart = time.Now()
+		}
+		// Messages and the status line may share a terminal.
+		s.statusSink.Around(func() {
+			idmMsg, ok := pkt.(idm.IDM)
+			if rcvr.intervalCollector == nil || !ok || !pkt.ChecksumOK() {
+				s.encodeErr = rcvr.out.Encode(*msg)
+				return
+			}
+			// With -collect, IDM messages are replaced by the intervals
+			// they carry which haven't been written.
+			for _, record := range rcvr.intervalCollector.Collect(idmMsg, msg.Time, msg.MeterName) {
+				if s.encodeErr = rcvr.out.Encode(record); s.encodeErr != nil {
+					return
+				}
+			}
+		})
+		if rcvr.otel.Tracing() {
+			s.timing.WriteEnd = time.Now()
+			rcvr.otel.Packet(*msg, s.timing, s.encodeErr)
+		}
+
+		if s.encodeErr == nil {
+			s.encoding.Succeed()
+		} else if s.fatal = s.encoding.Fail(s.encodeErr); s.fatal != nil {
+			s.stop(s.exit())
+		}
+	})
+	emit("alerts", func(msg *parse.LogMessage) {
+		if s.leakAlert != nil {
+			emitAlert(&rcvr.out, *s.leakAlert, s.statusSink)
+		}
+		if recovered := rcvr.absenceMonitor.Heard(*msg); recovered != nil {
+			emitAlert(&rcvr.out, *recovered, s.statusSink)
+		}
+	})
+	emit("health", func(msg *parse.LogMessage) {
+		rcvr.health.Emitted(*msg, s.encodeErr)
+	})
+
+	// written adds an emit hook called with the messages written.
+	written := func(name string, fn func(msg *parse.LogMessage)) {
+		emit(name, func(msg *parse.LogMessage) {
+			if s.encodeErr == nil {
+				fn(msg)
+			}
+		})
+	}
+	written("otel", func(msg *parse.LogMessage) {
+		rcvr.otel.Emitted(*msg)
+	})
+	written("dbus", func(msg *parse.LogMessage) {
+		rcvr.dbusService.Reading(*msg)
+	})
+	if s.statusLine != nil {
+		written("statusline", func(msg *parse.LogMessage) {
+			s.statusLine.Emitted(msg.Message)
+		})
+	}
+	if s.tui != nil {
+		written("tui", func(msg *parse.LogMessage) {
+			s.tui.Message(*msg)
+		})
+	}
+	written("stats", func(*parse.LogMessage) {
+		rcvr.stats.Emitted++
+	})
+
+	recv.OnOverrun("stats", func(count uint64) {
+		rcvr.stats.Dropped = count
+	})
+}
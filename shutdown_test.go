@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// startRtlamr starts rtlamr with the given arguments like runRtlamr, logging
+// to a file so it can be read while rtlamr runs.
+func startRtlamr(t *testing.T, stdout *os.File, args ...string) (cmd *exec.Cmd, log *os.File) {
+	t.Helper()
+
+	log, err := os.Create(filepath.Join(t.TempDir(), "stderr"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { log.Close() })
+
+	cmd = exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "RTLAMR_TESTMAIN=1")
+	cmd.Stdout = stdout
+	cmd.Stderr = log
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cmd.Process.Kill() })
+
+	return cmd, log
+}
+
+// waitFor polls cond until it returns true, failing the test after 10s.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); !cond(); time.Sleep(20 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+// exited waits for cmd to exit, returning its status.
+func exited(t *testing.T, cmd *exec.Cmd, log *os.File) int {
+	t.Helper()
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	select {
+	case err := <-done:
+		var ee *exec.ExitError
+		if errors.As(err, &ee) {
+			return ee.ExitCode()
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return exitOK
+	case <-time.After(10 * time.Second):
+		buf, _ := os.ReadFile(log.Name())
+		t.Fatalf("rtlamr didn't exit:\n%s", buf)
+	}
+	return exitFatal
+}
+
+func TestShutdownSignal(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping receiving in short mode")
+	}
+	if runtime.GOOS == "windows" {
+		t.Skip("signals can't be sent on windows")
+	}
+
+	signal := fakeRTLTCP(t, scmSignal(t))
+
+	// Termination, as systemd stops a service, cleans up as on interrupt.
+	for _, sig := range []os.Signal{syscall.SIGTERM, os.Interrupt} {
+		t.Run(sig.String(), func(t *testing.T) {
+			dir := t.TempDir()
+			msgs, pid := filepath.Join(dir, "msgs.json"), filepath.Join(dir, "rtlamr.pid")
+			cmd, log := startRtlamr(t, nil, "-server="+signal, "-format=json", "-logfile="+msgs,
+				"-samplefile="+filepath.Join(dir, "capture.cu8"), "-pidfile="+pid, "-statefile="+filepath.Join(dir, "state.json"), "-unique")
+
+			waitFor(t, "a message", func() bool {
+				fi, err := os.Stat(msgs)
+				return err == nil && fi.Size() != 0
+			})
+			if err := cmd.Process.Signal(sig); err != nil {
+				t.Fatal(err)
+			}
+			if status := exited(t, cmd, log); status != exitOK {
+				t.Errorf("expected status %d, got %d", exitOK, status)
+			}
+
+			buf, _ := os.ReadFile(log.Name())
+			if !strings.Contains(string(buf), "Received "+sig.String()+", shutting down") {
+				t.Errorf("expected shutdown logged:\n%s", buf)
+			}
+			if _, err := os.Stat(pid); !os.IsNotExist(err) {
+				t.Errorf("expected pid file removed, got %v", err)
+			}
+			if _, err := os.Stat(filepath.Join(dir, "state.json")); err != nil {
+				t.Errorf("expected state saved: %v", err)
+			}
+		})
+	}
+
+	// A second signal exits without waiting for a receiver which can't
+	// stop, here blocked writing to a stdout nobody reads.
+	t.Run("Second", func(t *testing.T) {
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		cmd, log := startRtlamr(t, w, "-server="+signal, "-format=json", "-shutdowntimeout=0", "-stats=20ms")
+		w.Close()
+
+		// Read a message, then stop reading and wait until stats are no
+		// longer logged.
+		if _, err := bufio.NewReader(r).ReadString('\n'); err != nil {
+			t.Fatal(err)
+		}
+		var last int
+		var since time.Time
+		waitFor(t, "the receiver to block", func() bool {
+			buf, _ := os.ReadFile(log.Name())
+			if n := strings.Count(string(buf), "Stats:"); n != last {
+				last, since = n, time.Now()
+			}
+			return last != 0 && time.Since(since) > 500*time.Millisecond
+		})
+
+		if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, "the first signal", func() bool {
+			buf, _ := os.ReadFile(log.Name())
+			return strings.Contains(string(buf), "shutting down")
+		})
+		if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+			t.Fatal(err)
+		}
+		if status := exited(t, cmd, log); status != exitFatal {
+			t.Errorf("expected status %d, got %d", exitFatal, status)
+		}
+		if buf, _ := os.ReadFile(log.Name()); !strings.Contains(string(buf), "second signal") {
+			t.Errorf("expected the second signal logged:\n%s", buf)
+		}
+	})
+}
+
+// stalledRTLTCP accepts rtl_tcp clients but never sends them samples,
+// returning its address.
+func stalledRTLTCP(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := conn.Write(append([]byte("RTL0"), make([]byte, 8)...)); err != nil {
+					return
+				}
+				io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func TestStalledSource(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping receiving in short mode")
+	}
+
+	// Without the stall watchdog, reads block for as long as rtl_tcp is
+	// silent.
+	stalled := stalledRTLTCP(t)
+	args := []string{"-summary=false", "-server=" + stalled, "-stallthreshold=0"}
+
+	t.Run("Duration", func(t *testing.T) {
+		cmd, log := startRtlamr(t, nil, append(args, "-duration=1s")...)
+		began := time.Now()
+		if status := exited(t, cmd, log); status != exitNoMessages {
+			t.Errorf("expected status %d, got %d", exitNoMessages, status)
+		}
+		if elapsed := time.Since(began); elapsed > 5*time.Second {
+			t.Errorf("took %s to reach a 1s time limit", elapsed)
+		}
+	})
+
+	t.Run("Interrupt", func(t *testing.T) {
+		if runtime.GOOS == "windows" {
+			t.Skip("signals can't be sent on windows")
+		}
+		cmd, log := startRtlamr(t, nil, args...)
+		waitFor(t, "rtlamr to connect", func() bool {
+			buf, _ := os.ReadFile(log.Name())
+			return strings.Contains(string(buf), "GainCount")
+		})
+		if err := cmd.Process.Signal(os.Interrupt); err != nil {
+			t.Fatal(err)
+		}
+		if status := exited(t, cmd, log); status != exitOK {
+			t.Errorf("expected status %d, got %d", exitOK, status)
+		}
+	})
+}
@@ -0,0 +1,187 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	sigmfDataExt = ".sigmf-data"
+	sigmfMetaExt = ".sigmf-meta"
+)
+
+// sampleFileName returns the name -samplefile is written to, with the SigMF
+// data extension appended for -samplefile.sigmf if it's missing.
+func sampleFileName(name string) string {
+	if *sampleSigMF && !strings.HasSuffix(name, sigmfDataExt) {
+		return name + sigmfDataExt
+	}
+	return name
+}
+
+// sigmfGlobal is the global object of a SigMF recording, see
+// https://github.com/sigmf/SigMF/blob/main/sigmf-spec.md. Fields in the
+// rtlamr namespace describe how the recording was made.
+type sigmfGlobal struct {
+	Datatype   string           `json:"core:datatype"`
+	SampleRate uint32           `json:"core:sample_rate"`
+	Version    string           `json:"core:version"`
+	Recorder   string           `json:"core:recorder"`
+	Extensions []sigmfExtension `json:"core:extensions"`
+
+	Commit        string  `json:"rtlamr:commit,omitempty"`
+	BuildDate     string  `json:"rtlamr:build_date,omitempty"`
+	MsgType       string  `json:"rtlamr:msgtype"`
+	TunerGainMode bool    `json:"rtlamr:tunergainmode"`
+	TunerGain     float64 `json:"rtlamr:tunergain"` // dB
+	GainByIndex   uint    `json:"rtlamr:gainbyindex,omitempty"`
+	AGC           bool    `json:"rtlamr:agcmode"`
+}
+
+type sigmfExtension struct {
+	Name     string `json:"name"`
+	Version  string `json:"version"`
+	Optional bool   `json:"optional"`
+}
+
+// sigmfCapture starts a segment of the recording: samples not following
+// those already written, or received on a different frequency.
+type sigmfCapture struct {
+	SampleStart int64     `json:"core:sample_start"`
+	GlobalIndex int64     `json:"core:global_index"` // Samples read before this segment.
+	Frequency   uint32    `json:"core:frequency"`
+	DateTime    time.Time `json:"core:datetime"`
+}
+
+// sigmfAnnotation locates a decoded packet in the recording.
+type sigmfAnnotation struct {
+	SampleStart int64   `json:"core:sample_start"`
+	SampleCount int64   `json:"core:sample_count"`
+	Label       string  `json:"core:label"`
+	MeterID     uint32  `json:"rtlamr:meter_id"`
+	MsgType     string  `json:"rtlamr:msgtype"`
+	SNR         float64 `json:"rtlamr:snr"` // dB, estimated.
+	ChecksumOK  bool    `json:"-"`          // For -samplefile.index.
+}
+
+type sigmfMeta struct {
+	Global      sigmfGlobal       `json:"global"`
+	Captures    []sigmfCapture    `json:"captures"`
+	Annotations []sigmfAnnotation `json:"annotations"`
+}
+
+// SigMF writes the metadata file accompanying samples written by
+// -samplefile.sigmf. The file is rewritten whenever packets are recorded so
+// it's complete however rtlamr exits.
+type SigMF struct {
+	name  string // Data file described.
+	meta  sigmfMeta
+	dirty bool // Changed since the file was written.
+}
+
+func NewSigMF(global sigmfGlobal) *SigMF {
+	global.Datatype = "cu8"
+	global.Version = "1.0.0"
+	global.Recorder = "rtlamr"
+	global.Extensions = []sigmfExtension{{Name: "rtlamr", Version: "1.0.0", Optional: true}}
+	return &SigMF{meta: sigmfMeta{Global: global}}
+}
+
+// Frequency returns the center frequency of the current capture.
+func (s *SigMF) Frequency() uint32 {
+	if len(s.meta.Captures) == 0 {
+		return 0
+	}
+	return s.meta.Captures[len(s.meta.Captures)-1].Frequency
+}
+
+// Capture starts a segment of samples written to the named data file at
+// sampleStart, which were read from the stream starting at globalIndex. A
+// different or new file starts a new recording.
+func (s *SigMF) Capture(name string, sampleStart, globalIndex int64, t time.Time, centerFreq uint32) {
+	if name != s.name || sampleStart == 0 {
+		s.name = name
+		s.meta.Captures, s.meta.Annotations = nil, nil
+	}
+	s.dirty = true
+	s.meta.Captures = append(s.meta.Captures, sigmfCapture{
+		SampleStart: sampleStart,
+		GlobalIndex: globalIndex,
+		Frequency:   centerFreq,
+		DateTime:    t.UTC(),
+	})
+}
+
+// Annotate adds annotations of packets in the current capture.
+func (s *SigMF) Annotate(annotations ...sigmfAnnotation) {
+	if len(annotations) == 0 {
+		return
+	}
+	s.dirty = true
+	s.meta.Annotations = append(s.meta.Annotations, annotations...)
+	sort.SliceStable(s.meta.Annotations, func(i, j int) bool {
+		return s.meta.Annotations[i].SampleStart < s.meta.Annotations[j].SampleStart
+	})
+}
+
+// Flush rewrites the metadata file if it has changed.
+func (s *SigMF) Flush() error {
+	if !s.dirty {
+		return nil
+	}
+
+	buf, err := json.MarshalIndent(s.meta, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(strings.TrimSuffix(s.name, sigmfDataExt)+sigmfMetaExt, buf); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// estimateSNR estimates the signal to noise ratio in dB of a packet's
+// interleaved 8-bit inphase and quadrature samples. Meters use on-off keying,
+// so the strongest quarter of samples is taken as signal and the weakest
+// quarter as noise.
+func estimateSNR(samples []byte) float64 {
+	power := make([]float64, len(samples)>>1)
+	for idx := range power {
+		i := (float64(samples[idx<<1]) - 127.5) / 127.5
+		q := (float64(samples[idx<<1+1]) - 127.5) / 127.5
+		power[idx] = i*i + q*q
+	}
+	if len(power) < 4 {
+		return 0
+	}
+	sort.Float64s(power)
+
+	quarter := len(power) >> 2
+	var noise, signal float64
+	for idx := 0; idx < quarter; idx++ {
+		noise += power[idx]
+		signal += power[len(power)-1-idx]
+	}
+	snr := 10 * math.Log10(signal/noise)
+	return math.Round(snr*10) / 10
+}
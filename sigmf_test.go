@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSampleFileSigMF(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping receiving in short mode")
+	}
+
+	signal := fakeRTLTCP(t, scmSignal(t))
+
+	for name, extra := range map[string][]string{
+		"Blocks":  nil,
+		"Windows": {"-samplefile.pre=5ms", "-samplefile.post=5ms"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+
+			stdout, err := os.Create(filepath.Join(dir, "stdout"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer stdout.Close()
+
+			base := filepath.Join(dir, "capture")
+			args := []string{"-summary=false", "-server=" + signal, "-format=json", "-msglimit=3", "-duration=10s",
+				"-samplefile=" + base, "-samplefile.sigmf", "-tunergain=20.7"}
+			args = append(args, extra...)
+			if status := runRtlamr(t, stdout, args...); status != exitOK {
+				t.Fatalf("expected status %d, got %d", exitOK, status)
+			}
+
+			type logMessage struct {
+				Offset  int64
+				Length  int64
+				Message struct{ ID uint32 }
+			}
+			var msgs []logMessage
+			stdout.Seek(0, 0)
+			for dec := json.NewDecoder(stdout); dec.More(); {
+				var msg logMessage
+				if err := dec.Decode(&msg); err != nil {
+					t.Fatal(err)
+				}
+				msgs = append(msgs, msg)
+			}
+
+			data, err := os.ReadFile(base + sigmfDataExt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			buf, err := os.ReadFile(base + sigmfMetaExt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var meta sigmfMeta
+			if err := json.Unmarshal(buf, &meta); err != nil {
+				t.Fatal(err)
+			}
+
+			if g := meta.Global; g.Datatype != "cu8" || g.SampleRate != 2359296 || g.MsgType != "scm" || g.TunerGain != 20.7 {
+				t.Errorf("unexpected global metadata: %+v", g)
+			}
+			if len(meta.Captures) == 0 || meta.Captures[0].SampleStart != 0 || meta.Captures[0].DateTime.IsZero() {
+				t.Errorf("unexpected captures: %+v", meta.Captures)
+			}
+
+			// Packets are too far apart to share samples, though the window
+			// of the last is cut short on exit.
+			var length int64
+			for _, msg := range msgs {
+				length += msg.Length
+			}
+			if n := int64(len(data)); n > length || n <= length-msgs[len(msgs)-1].Length {
+				t.Errorf("expected up to %d bytes written for %d messages, got %d", length, len(msgs), n)
+			}
+
+			if len(meta.Annotations) != len(msgs) {
+				t.Fatalf("expected %d annotations, got %d", len(msgs), len(meta.Annotations))
+			}
+			for idx, a := range meta.Annotations {
+				msg := msgs[idx]
+				if a.MeterID != msg.Message.ID || a.MsgType != "SCM" {
+					t.Errorf("annotation %d: expected meter %d, got %+v", idx, msg.Message.ID, a)
+				}
+
+				// Annotations lie within the samples logged with their message and
+				// cover the packet.
+				if a.SampleStart < msg.Offset>>1 || a.SampleStart+a.SampleCount > (msg.Offset+msg.Length)>>1 {
+					t.Errorf("annotation %d at %d+%d outside of message's samples at %d+%d", idx, a.SampleStart, a.SampleCount, msg.Offset>>1, msg.Length>>1)
+					continue
+				}
+				if snr := estimateSNR(data[a.SampleStart<<1 : (a.SampleStart+a.SampleCount)<<1]); snr < 20 || a.SNR != snr {
+					t.Errorf("annotation %d: expected signal, got SNR %.1f dB, annotated %.1f dB", idx, snr, a.SNR)
+				}
+			}
+		})
+	}
+}
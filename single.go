@@ -0,0 +1,161 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+)
+
+// SingleSummary reports the meters heard by -single and those still pending
+// when it exits. Pending meters are listed by id in TimedOut, or in
+// TimedOutRanges for runs of consecutive ids. With -single.pertype, PerType
+// holds a meter heard for each message type and TimedOutTypes the message
+// types missed.
+type SingleSummary struct {
+	Captured       []uint
+	TimedOut       []uint
+	TimedOutRanges []SummaryRange  `json:",omitempty"`
+	TimedOutTypes  []string        `json:",omitempty"`
+	PerType        map[string]uint `json:",omitempty"`
+}
+
+// SummaryRange is an inclusive range of meter ids in SingleSummary.
+type SummaryRange struct {
+	From uint `json:"from"`
+	To   uint `json:"to"`
+}
+
+// singleSatisfy marks a meter as heard by -single. With -filterid only the
+// meters it lists count, so messages from other meters let through by
+// -filtermode=any are written without standing in for those waited on. With
+// -single.pertype the first meter heard of each message type is kept
+// instead.
+func (rcvr *Receiver) singleSatisfy(msgType string, id uint) {
+	if *singlePerType {
+		if rcvr.singleTypes == nil {
+			rcvr.singleTypes = make(map[string]uint)
+		}
+		if _, ok := rcvr.singleTypes[msgType]; !ok {
+			rcvr.singleTypes[msgType] = id
+		}
+		return
+	}
+	if ranges := rcvr.meterID.Ranges(); len(ranges) == 0 || ranges.Contains(id) {
+		rcvr.meterID.Satisfy(id)
+	}
+}
+
+// singleMsgTypes returns the sorted message types -single.pertype and
+// -msglimit.pertype wait on, those of the parsers in -msgtype. r900 and
+// r900bcd share a message type.
+func singleMsgTypes() (msgTypes []string) {
+	for _, name := range strings.Split(*msgType, ",") {
+		if msgType := parserMsgTypes[name]; !slices.Contains(msgTypes, msgType) {
+			msgTypes = append(msgTypes, msgType)
+		}
+	}
+	slices.Sort(msgTypes)
+	return msgTypes
+}
+
+// singleDone returns true once -single has heard every meter in -filterid or
+// -single.max distinct meters, or with -single.pertype every message type.
+// Excluded meters will never be heard so they aren't waited on.
+func (rcvr *Receiver) singleDone() bool {
+	if *singlePerType {
+		return len(rcvr.singleTypes) == len(singleMsgTypes())
+	}
+	if *singleMax != 0 && rcvr.meterID.Satisfied() >= *singleMax {
+		return true
+	}
+	return rcvr.meterID.Pending(rcvr.excludeID.Ranges()) == 0
+}
+
+// singleExit writes the -single summary if -single.timeout or
+// -single.pertype is set and returns the exit status: exitNoMessages if no
+// meter was heard and exitMissed if some were but others weren't. Without
+// -filterid, a meter is missed only if none were heard. With
+// -single.pertype, message types are missed instead of meters.
+func (rcvr *Receiver) singleExit() int {
+	var summary SingleSummary
+	heard := 0
+	if *singlePerType {
+		summary.PerType = make(map[string]uint)
+		for msgType, id := range rcvr.singleTypes {
+			summary.PerType[msgType] = id
+		}
+		heard = len(summary.PerType)
+	} else {
+		summary.Captured = rcvr.meterID.SatisfiedIDs()
+		heard = len(summary.Captured)
+	}
+
+	var missing []string
+	done := heard > 0 && rcvr.singleDone()
+	switch {
+	case done:
+	case *singlePerType:
+		for _, msgType := range singleMsgTypes() {
+			if _, ok := summary.PerType[msgType]; !ok {
+				summary.TimedOutTypes = append(summary.TimedOutTypes, msgType)
+			}
+		}
+		missing = summary.TimedOutTypes
+	default:
+		for _, r := range rcvr.meterID.Missing(rcvr.excludeID.Ranges()) {
+			if r.Lo == r.Hi {
+				summary.TimedOut = append(summary.TimedOut, r.Lo)
+			} else {
+				summary.TimedOutRanges = append(summary.TimedOutRanges, SummaryRange{r.Lo, r.Hi})
+			}
+			missing = append(missing, r.String())
+		}
+	}
+
+	if *singleTimeout != 0 || *singlePerType {
+		switch {
+		case *format == "json":
+			if err := json.NewEncoder(os.Stdout).Encode(summary); err != nil {
+				slog.Error("encoding single summary", "err", err)
+			}
+		case *singlePerType:
+			var perType []string
+			for _, msgType := range singleMsgTypes() {
+				if id, ok := summary.PerType[msgType]; ok {
+					perType = append(perType, fmt.Sprintf("%s:%d", msgType, id))
+				}
+			}
+			log.Printf("PerType: %s TimedOut: %s\n", perType, missing)
+		default:
+			log.Printf("Captured: %d TimedOut: %s\n", summary.Captured, missing)
+		}
+	}
+
+	switch {
+	case heard == 0:
+		return exitNoMessages
+	case !done:
+		return exitMissed
+	}
+	return exitOK
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bemasher/rtlamr/gen"
+	"github.com/bemasher/rtlamr/parse"
+)
+
+// meterSignal returns samples holding one SCM packet from each of the given
+// meters in order, keyed by id with the meter's type as value.
+func meterSignal(t *testing.T, meters [][2]uint) []byte {
+	t.Helper()
+
+	p, err := parse.NewParser("scm", 72, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var packets []func(idx int, consumption uint32) []byte
+	for _, m := range meters {
+		newPacket, err := genPacket("scm", m[0], m[1], 0, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		packets = append(packets, newPacket)
+	}
+
+	ch := gen.Channel{SNR: 20, Rand: rand.New(rand.NewSource(1))}
+	return genSamples(*p.Cfg(), ch, len(packets), 50*time.Millisecond, func(idx int) []byte {
+		return packets[idx](idx, 1000)
+	})
+}
+
+func TestSingle(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping single tests in short mode")
+	}
+
+	// Meters 1001 and 1003 are type 7, 1002 is type 8.
+	server := fakeRTLTCP(t, meterSignal(t, [][2]uint{{1001, 7}, {1002, 8}, {1003, 7}}))
+
+	for _, tc := range []struct {
+		name   string
+		status int
+		args   []string
+		ids    []uint
+	}{
+		{"NoFilter", exitOK, nil, []uint{1001}},
+		{"Type", exitOK, []string{"-filtertype=8"}, []uint{1002}},
+		{"TypeNeverHeard", exitNoMessages, []string{"-filtertype=5"}, nil},
+		{"ID", exitOK, []string{"-filterid=1002,1003"}, []uint{1002, 1003}},
+		{"IDAndType", exitOK, []string{"-filterid=1001,1003", "-filtertype=7"}, []uint{1001, 1003}},
+		{"IDFailingType", exitMissed, []string{"-filterid=1001,1002", "-filtertype=7", "-single.timeout=2s"}, []uint{1001}},
+		{"IDNeverHeard", exitNoMessages, []string{"-filterid=2001", "-single.timeout=2s"}, nil},
+		{"Max", exitOK, []string{"-filterid=1001-1003", "-single.max=2"}, []uint{1001, 1002}},
+		// Meter 1002 passes the type filter but isn't one of the meters
+		// waited on, so it doesn't satisfy -single.max.
+		{"AnyMode", exitOK, []string{"-filtermode=any", "-filterid=1003", "-filtertype=8", "-single.max=1"}, []uint{1002, 1003}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			stdout, err := os.Create(filepath.Join(t.TempDir(), "stdout"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer stdout.Close()
+
+			args := append([]string{"-summary=false", "-format=json", "-server=" + server, "-single", "-duration=5s"}, tc.args...)
+			if status := runRtlamr(t, stdout, args...); status != tc.status {
+				t.Fatalf("Expected status %d, got %d\n", tc.status, status)
+			}
+
+			if _, err := stdout.Seek(0, 0); err != nil {
+				t.Fatal(err)
+			}
+
+			var ids []uint
+			scanner := bufio.NewScanner(stdout)
+			for scanner.Scan() {
+				var msg struct {
+					Message struct{ ID uint }
+				}
+				if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+					t.Fatal(err)
+				}
+				if msg.Message.ID != 0 {
+					ids = append(ids, msg.Message.ID)
+				}
+			}
+			if !reflect.DeepEqual(ids, tc.ids) {
+				t.Fatalf("Expected messages from %v, got %v\n", tc.ids, ids)
+			}
+		})
+	}
+}
+
+func TestSingleSummary(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping single tests in short mode")
+	}
+
+	server := fakeRTLTCP(t, meterSignal(t, [][2]uint{{1001, 7}, {1002, 8}, {1003, 7}}))
+
+	stdout, err := os.Create(filepath.Join(t.TempDir(), "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdout.Close()
+
+	args := []string{"-summary=false", "-format=json", "-server=" + server, "-single", "-duration=5s",
+		"-filterid=1001,1005,1007-1009", "-single.timeout=2s"}
+	if status := runRtlamr(t, stdout, args...); status != exitMissed {
+		t.Fatalf("Expected status %d, got %d\n", exitMissed, status)
+	}
+
+	if _, err := stdout.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// The summary is the last line written.
+	var line []byte
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		line = append(line[:0], scanner.Bytes()...)
+	}
+	expt := `{"Captured":[1001],"TimedOut":[1005],"TimedOutRanges":[{"from":1007,"to":1009}]}`
+	if string(line) != expt {
+		t.Fatalf("Expected summary %s, got %s\n", expt, line)
+	}
+}
+
+// perTypeSignal returns the samples of SCM meters 1001 and 1002 followed by
+// SCM+ meter 2001.
+func perTypeSignal(t *testing.T) []byte {
+	t.Helper()
+
+	p, err := parse.NewParser("scm+", 72, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newPacket, err := genPacket("scm+", 2001, 7, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := gen.Channel{SNR: 20, Rand: rand.New(rand.NewSource(2))}
+	samples := meterSignal(t, [][2]uint{{1001, 7}, {1002, 7}})
+	return append(samples, genSamples(*p.Cfg(), ch, 1, 50*time.Millisecond, func(idx int) []byte {
+		return newPacket(idx, 1000)
+	})...)
+}
+
+func TestSinglePerType(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping single tests in short mode")
+	}
+
+	server := fakeRTLTCP(t, perTypeSignal(t))
+
+	for _, tc := range []struct {
+		name    string
+		status  int
+		args    []string
+		summary SingleSummary
+	}{
+		{"AllHeard", exitOK, []string{"-msgtype=scm,scm+"}, SingleSummary{PerType: map[string]uint{"SCM": 1001, "SCM+": 2001}}},
+		{"Missed", exitMissed, []string{"-msgtype=scm,idm", "-single.timeout=2s"}, SingleSummary{TimedOutTypes: []string{"IDM"}, PerType: map[string]uint{"SCM": 1001}}},
+		{"NoneHeard", exitNoMessages, []string{"-msgtype=scm+,idm", "-filterid=2002", "-single.timeout=2s"}, SingleSummary{TimedOutTypes: []string{"IDM", "SCM+"}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			stdout, err := os.Create(filepath.Join(t.TempDir(), "stdout"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer stdout.Close()
+
+			args := append([]string{"-summary=false", "-format=json", "-server=" + server, "-single", "-single.pertype", "-duration=5s"}, tc.args...)
+			if status := runRtlamr(t, stdout, args...); status != tc.status {
+				t.Fatalf("Expected status %d, got %d\n", tc.status, status)
+			}
+
+			if _, err := stdout.Seek(0, 0); err != nil {
+				t.Fatal(err)
+			}
+
+			// The summary is the last line written.
+			var summary SingleSummary
+			scanner := bufio.NewScanner(stdout)
+			for scanner.Scan() {
+				summary = SingleSummary{}
+				if err := json.Unmarshal(scanner.Bytes(), &summary); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if !reflect.DeepEqual(summary, tc.summary) {
+				t.Fatalf("Expected summary %+v, got %+v\n", tc.summary, summary)
+			}
+		})
+	}
+}
+
+func TestMsgLimitPerType(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping msglimit tests in short mode")
+	}
+
+	server := fakeRTLTCP(t, perTypeSignal(t))
+
+	for _, tc := range []struct {
+		name string
+		args []string
+		expt []string
+	}{
+		{"Total", []string{"-msglimit=2"}, []string{"SCM", "SCM"}},
+		{"PerType", []string{"-msglimit=1", "-msglimit.pertype"}, []string{"SCM", "SCM", "SCM+"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			stdout, err := os.Create(filepath.Join(t.TempDir(), "stdout"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer stdout.Close()
+
+			args := append([]string{"-summary=false", "-format=json", "-server=" + server, "-msgtype=scm,scm+", "-duration=5s"}, tc.args...)
+			if status := runRtlamr(t, stdout, args...); status != exitOK {
+				t.Fatalf("Expected status %d, got %d\n", exitOK, status)
+			}
+
+			if _, err := stdout.Seek(0, 0); err != nil {
+				t.Fatal(err)
+			}
+
+			var msgTypes []string
+			scanner := bufio.NewScanner(stdout)
+			for scanner.Scan() {
+				var msg struct{ MsgType string }
+				if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+					t.Fatal(err)
+				}
+				msgTypes = append(msgTypes, msg.MsgType)
+			}
+			if !reflect.DeepEqual(msgTypes, tc.expt) {
+				t.Fatalf("Expected message types %q, got %q\n", tc.expt, msgTypes)
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bemasher/rtlamr/parse"
+)
+
+// SnippetRecord is written by -snippets beside the samples of each packet.
+type SnippetRecord struct {
+	Time         time.Time
+	MsgType      string
+	CenterFreq   uint32
+	SampleRate   uint32
+	PacketStart  int64         // Samples of padding preceding the packet.
+	PacketLength int64         // Samples the packet lasts, see -samplefile.sigmf for how it's located.
+	SNR          float64       // dB, estimated.
+	Dropped      int           `json:",omitempty"` // Snippets dropped by the rate limit since the previous one.
+	Message      parse.Message // Decoded fields.
+}
+
+// snippet is a packet waiting for the samples following it to be read.
+type snippet struct {
+	name   string // Path of the samples, without extension.
+	start  int64  // First sample of the stream to write, including padding.
+	end    int64  // Sample following the last to write.
+	record SnippetRecord
+}
+
+// SnippetWriter writes the samples of each packet decoded, padded before
+// and after, to a file of their own for -snippets, with a SnippetRecord in
+// a json file of the same name.
+type SnippetWriter struct {
+	dir       string
+	pre, post int64       // Samples of padding.
+	limit     rateLimiter // Counted in packet times.
+
+	pending []snippet
+}
+
+func NewSnippetWriter(dir string, pre, post time.Duration, limit RateLimit, sampleRate uint32) *SnippetWriter {
+	return &SnippetWriter{
+		dir:   dir,
+		pre:   int64(pre) * int64(sampleRate) / int64(time.Second),
+		post:  int64(post) * int64(sampleRate) / int64(time.Second),
+		limit: rateLimiter{RateLimit: limit},
+	}
+}
+
+// History returns the number of samples the recorder must hold beyond the
+// decoder's buffer for padding to be written.
+func (sw *SnippetWriter) History() int64 {
+	return sw.pre + sw.post
+}
+
+// Add queues the samples of a packet located by r.Locate to be written once
+// the padding following it has been read, unless the rate limit has been
+// reached.
+func (sw *SnippetWriter) Add(r *sampleRecorder, pkt parse.Message, t time.Time, centerFreq uint32, start, count int64) {
+	if !sw.limit.Allow(t) {
+		return
+	}
+
+	msgType := strings.ToLower(pkt.MsgType())
+	name := fmt.Sprintf("%s-%s-%d", t.UTC().Format("20060102T150405.000000Z"), msgType, pkt.MeterID())
+
+	s := snippet{
+		name:  filepath.Join(sw.dir, name),
+		start: max(start-sw.pre, r.start>>1),
+		end:   start + count + sw.post,
+		record: SnippetRecord{
+			Time:         t,
+			MsgType:      msgType,
+			CenterFreq:   centerFreq,
+			SampleRate:   r.sampleRate,
+			PacketLength: count,
+			SNR:          estimateSNR(r.Samples(start, count)),
+			Dropped:      sw.limit.Dropped(),
+			Message:      pkt,
+		},
+	}
+	s.record.PacketStart = start - s.start
+
+	sw.pending = append(sw.pending, s)
+}
+
+// Write writes the snippets whose samples r holds in full. If final is set,
+// such as when rtlamr exits, snippets are written with the padding read so
+// far. Snippets are dropped whether or not they're written successfully.
+func (sw *SnippetWriter) Write(r *sampleRecorder, final bool) (err error) {
+	held := r.end() >> 1
+	pending := sw.pending[:0]
+	for _, s := range sw.pending {
+		if s.end > held && !final {
+			pending = append(pending, s)
+			continue
+		}
+		if err == nil {
+			err = sw.write(r, s)
+		}
+	}
+	sw.pending = pending
+	return err
+}
+
+func (sw *SnippetWriter) write(r *sampleRecorder, s snippet) error {
+	// Samples older than those held were discarded while waiting.
+	start := max(s.start, r.start>>1)
+	s.record.PacketStart -= start - s.start
+	end := min(s.end, r.end()>>1)
+
+	f, err := openOutput(s.name+".cu8", os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(r.Samples(start, end-start)); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	buf, err := json.MarshalIndent(s.record, "", "\t")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.name+".json", append(buf, '\n'), 0666)
+}
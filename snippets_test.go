@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSnippets(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping receiving in short mode")
+	}
+
+	dir := filepath.Join(t.TempDir(), "snippets")
+	signal := fakeRTLTCP(t, scmSignal(t))
+
+	args := []string{"-summary=false", "-server=" + signal, "-msglimit=3", "-duration=10s",
+		"-snippets=" + dir, "-snippets.max=2/m"}
+	if status := runRtlamr(t, nil, args...); status != exitOK {
+		t.Fatalf("expected status %d, got %d", exitOK, status)
+	}
+
+	names, err := filepath.Glob(filepath.Join(dir, "*-scm-*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 2 {
+		t.Fatalf("expected 2 snippets limited by -snippets.max, got %v", names)
+	}
+
+	const padding = 10 * 2359296 / 1000
+	for _, name := range names {
+		buf, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var rec struct {
+			SnippetRecord
+			Message struct{ ID uint32 }
+		}
+		if err := json.Unmarshal(buf, &rec); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasSuffix(name, "-scm-"+strconv.FormatUint(uint64(rec.Message.ID), 10)+".json") {
+			t.Errorf("%s: named for the wrong meter, got ID %d", name, rec.Message.ID)
+		}
+
+		samples, err := os.ReadFile(strings.TrimSuffix(name, ".json") + ".cu8")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := int64(len(samples)) >> 1; rec.PacketStart > padding || n != rec.PacketStart+rec.PacketLength+padding {
+			t.Errorf("%s: expected packet at %d+%d with up to %d samples of padding, got %d samples",
+				name, rec.PacketStart, rec.PacketLength, padding, n)
+			continue
+		}
+
+		packet := samples[rec.PacketStart<<1 : (rec.PacketStart+rec.PacketLength)<<1]
+		if snr := estimateSNR(packet); snr < 20 || snr != rec.SNR {
+			t.Errorf("%s: expected signal, got SNR %.1f dB, recorded %.1f dB", name, snr, rec.SNR)
+		}
+		if after := samples[(rec.PacketStart+rec.PacketLength)<<1+1000:]; estimateSNR(after) > 3 {
+			t.Errorf("%s: expected noise following packet, got SNR %.1f dB", name, estimateSNR(after))
+		}
+	}
+}
@@ -0,0 +1,136 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/bemasher/rtlamr/filter"
+)
+
+// StateVersion is bumped whenever the format of the state file changes.
+// Files of any other version are ignored.
+const StateVersion = 1
+
+// State is saved to -statefile so filters pick up where they left off
+// after a restart.
+type State struct {
+	Version int
+	Saved   time.Time
+	Unique  []UniqueState  `json:",omitempty"`
+	Delta   []DeltaState   `json:",omitempty"`
+	Absence []AbsenceState `json:",omitempty"`
+	Collect []CollectState `json:",omitempty"`
+}
+
+// UniqueState is the last message -unique emitted for a meter.
+type UniqueState = filter.UniqueState
+
+// LoadState restores filter state from filename. A missing file is not an
+// error.
+func (rcvr *Receiver) LoadState(filename string) error {
+	buf, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var state State
+	if err := json.Unmarshal(buf, &state); err != nil {
+		return err
+	}
+	if state.Version != StateVersion {
+		return fmt.Errorf("unsupported state version %d, expected %d", state.Version, StateVersion)
+	}
+
+	if rcvr.uniqueFilter != nil {
+		if err := rcvr.uniqueFilter.Restore(state.Unique); err != nil {
+			return err
+		}
+	}
+	if rcvr.deltaTracker != nil {
+		rcvr.deltaTracker.Restore(state.Delta)
+	}
+	if rcvr.absenceMonitor != nil {
+		rcvr.absenceMonitor.Restore(state.Absence)
+	}
+	if rcvr.intervalCollector != nil {
+		rcvr.intervalCollector.Restore(state.Collect)
+	}
+
+	log.Printf("Loaded state from %s saved at %s\n", filename, state.Saved.Format(time.RFC3339))
+
+	return nil
+}
+
+// SaveState writes filter state to filename. The state is written to a
+// temporary file which replaces filename so a crash never leaves a partial
+// file behind.
+func (rcvr *Receiver) SaveState(filename string) error {
+	state := State{Version: StateVersion, Saved: time.Now()}
+	if rcvr.uniqueFilter != nil {
+		state.Unique = rcvr.uniqueFilter.Snapshot()
+	}
+	if rcvr.deltaTracker != nil {
+		state.Delta = rcvr.deltaTracker.Snapshot()
+	}
+	if rcvr.absenceMonitor != nil {
+		state.Absence = rcvr.absenceMonitor.Snapshot()
+	}
+	if rcvr.intervalCollector != nil {
+		state.Collect = rcvr.intervalCollector.Snapshot()
+	}
+
+	buf, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filename, buf)
+}
+
+// writeFileAtomic writes buf to a temporary file and renames it over
+// filename, so readers never see a partial file.
+func writeFileAtomic(filename string, buf []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), filename)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bemasher/rtlamr/scm"
+)
+
+func TestState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "state.json")
+
+	rcvr := new(Receiver)
+	rcvr.uniqueFilter = NewUniqueFilter(time.Hour, 0)
+	for _, id := range []uint32{1, 2} {
+		rcvr.uniqueFilter.Filter(scm.SCM{ID: id, ChecksumVal: 0x1234})
+	}
+
+	// A missing file is not an error.
+	if err := rcvr.LoadState(filename); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := rcvr.SaveState(filename); err != nil {
+		t.Fatal(err)
+	}
+
+	rcvr.uniqueFilter = NewUniqueFilter(time.Hour, 0)
+	if err := rcvr.LoadState(filename); err != nil {
+		t.Fatal(err)
+	}
+	if rcvr.uniqueFilter.Filter(scm.SCM{ID: 1, ChecksumVal: 0x1234}) {
+		t.Fatal("Expected restored meter to be suppressed")
+	}
+	if !rcvr.uniqueFilter.Filter(scm.SCM{ID: 3, ChecksumVal: 0x1234}) {
+		t.Fatal("Expected new meter to pass")
+	}
+
+	// Only the state file remains, no temporary files.
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("Expected only the state file, got %d files\n", len(files))
+	}
+
+	for _, corrupt := range []string{`{"Version":1,`, `{"Version":99}`} {
+		if err := ioutil.WriteFile(filename, []byte(corrupt), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := rcvr.LoadState(filename); err == nil {
+			t.Fatalf("Expected error loading %q\n", corrupt)
+		}
+	}
+}
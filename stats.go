@@ -0,0 +1,94 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bemasher/rtlamr/parse"
+)
+
+// Stats counts receiver activity for the periodic -stats output.
+type Stats struct {
+	Blocks      uint64 // Sample blocks processed.
+	Decoded     uint64 // Packets passing checksum.
+	BadChecksum uint64 // Packets failing checksum, counted whether or not they are emitted.
+	Emitted     uint64 // Messages written after filtering.
+	Stalls      uint64 // Stalls in sample delivery found by -stallthreshold.
+	StallResets uint64 // Stalls recovered from by resetting rather than reconnecting.
+	Overruns    uint64 // Blocks taking longer to handle than their samples span, so samples back up in rtl_tcp.
+	Dropped     uint64 // Messages discarded by -output.dropoldest.
+
+	decodedByType map[string]uint64   // Packets passing checksum per message type.
+	meters        map[uint32]struct{} // Distinct meters heard with a valid checksum.
+
+	unique   *UniqueFilter      // Reports tracked meters and evictions if set.
+	dedupe   *CrossProtoFilter  // Reports suppressed duplicates if set.
+	maxDelta *MaxDeltaFilter    // Reports rejected readings if set.
+	chain    *parse.FilterChain // Reports per-filter counts if set.
+}
+
+// Packet counts a packet returned by the parser.
+func (s *Stats) Packet(pkt parse.Message) {
+	if !pkt.ChecksumOK() {
+		s.BadChecksum++
+		return
+	}
+	s.Decoded++
+
+	if s.decodedByType == nil {
+		s.decodedByType = make(map[string]uint64)
+		s.meters = make(map[uint32]struct{})
+	}
+	s.decodedByType[pkt.MsgType()]++
+	s.meters[pkt.MeterID()] = struct{}{}
+}
+
+func (s Stats) String() string {
+	var fields []string
+
+	fields = append(fields, fmt.Sprintf("Blocks:%d", s.Blocks))
+	fields = append(fields, fmt.Sprintf("Decoded:%d", s.Decoded))
+	fields = append(fields, fmt.Sprintf("BadChecksum:%d", s.BadChecksum))
+	fields = append(fields, fmt.Sprintf("Emitted:%d", s.Emitted))
+	fields = append(fields, fmt.Sprintf("Stalls:%d", s.Stalls))
+	fields = append(fields, fmt.Sprintf("StallResets:%d", s.StallResets))
+	fields = append(fields, fmt.Sprintf("Overruns:%d", s.Overruns))
+	fields = append(fields, fmt.Sprintf("Dropped:%d", s.Dropped))
+	if s.unique != nil {
+		fields = append(fields, fmt.Sprintf("UniqueMeters:%d", s.unique.Len()))
+		fields = append(fields, fmt.Sprintf("UniqueEvictions:%d", s.unique.Evictions()))
+	}
+	if s.dedupe != nil {
+		fields = append(fields, fmt.Sprintf("DupSuppressed:%d", s.dedupe.Suppressed()))
+	}
+	if s.maxDelta != nil {
+		fields = append(fields, fmt.Sprintf("MaxDeltaRejected:%d", s.maxDelta.Rejected()))
+	}
+	if s.chain != nil {
+		var filters []string
+		for _, fs := range s.chain.Stats() {
+			filters = append(filters, fs.String())
+		}
+		if len(filters) != 0 {
+			fields = append(fields, "Filters:{"+strings.Join(filters, "; ")+"}")
+		}
+	}
+
+	return "{" + strings.Join(fields, " ") + "}"
+}
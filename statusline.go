@@ -0,0 +1,76 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/bemasher/rtlamr/parse"
+)
+
+// Packet rates shown by -statusline are averaged over this window.
+const statusRateWindow = time.Minute
+
+// StatusLine builds the line redrawn by -statusline.
+type StatusLine struct {
+	start   time.Time
+	samples []statusSample // Decoded counts over the rate window.
+	last    parse.Message  // Last message emitted.
+}
+
+type statusSample struct {
+	t       time.Time
+	decoded uint64
+}
+
+func NewStatusLine(start time.Time) *StatusLine {
+	return &StatusLine{start: start}
+}
+
+// Emitted records the last message written.
+func (sl *StatusLine) Emitted(msg parse.Message) {
+	sl.last = msg
+}
+
+// Update records the receiver's counts and returns the status line.
+func (sl *StatusLine) Update(now time.Time, s Stats) string {
+	sl.samples = append(sl.samples, statusSample{now, s.Decoded})
+	for len(sl.samples) > 2 && now.Sub(sl.samples[1].t) >= statusRateWindow {
+		sl.samples = sl.samples[1:]
+	}
+
+	var rate float64
+	first := sl.samples[0]
+	if elapsed := now.Sub(first.t); elapsed > 0 {
+		rate = float64(s.Decoded-first.decoded) / elapsed.Minutes()
+	}
+
+	line := fmt.Sprintf("%s | %.1f pkt/min | %d meters", now.Sub(sl.start).Truncate(time.Second), rate, len(s.meters))
+	if sl.last != nil {
+		line += fmt.Sprintf(" | last %s %d: %d", sl.last.MsgType(), sl.last.MeterID(), sl.last.MeterConsumption())
+	}
+
+	return line
+}
+
+// isTerminal returns true if f is a character device, such as a terminal.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
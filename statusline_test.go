@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/bemasher/rtlamr/scm"
+)
+
+func TestStatusLine(t *testing.T) {
+	start := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	sl := NewStatusLine(start)
+
+	var s Stats
+	sl.Update(start, s)
+
+	for i := 0; i < 10; i++ {
+		s.Packet(scm.SCM{ID: uint32(i % 2)})
+	}
+	sl.Emitted(scm.SCM{ID: 1, Consumption: 100})
+
+	expt := "30s | 20.0 pkt/min | 2 meters | last SCM 1: 100"
+	if recv := sl.Update(start.Add(30*time.Second), s); recv != expt {
+		t.Fatalf("Expected %q got %q\n", expt, recv)
+	}
+
+	// Rates are averaged from the latest sample at least a minute old.
+	s.Packet(scm.SCM{ID: 2})
+	expt = "2m0s | 0.7 pkt/min | 3 meters | last SCM 1: 100"
+	if recv := sl.Update(start.Add(2*time.Minute), s); recv != expt {
+		t.Fatalf("Expected %q got %q\n", expt, recv)
+	}
+}
+
+func TestSyncWriterStatus(t *testing.T) {
+	var buf bytes.Buffer
+	sw := &syncWriter{w: &buf}
+
+	sw.Write([]byte("first\n"))
+	sw.SetStatus("status")
+	sw.Write([]byte("second\n"))
+	sw.Around(func() { io.WriteString(&buf, "message\n") })
+	sw.SetStatus("")
+
+	expt := "first\n" + clearLine + "status" +
+		clearLine + "second\nstatus" +
+		clearLine + "message\nstatus" +
+		clearLine
+	if recv := buf.String(); recv != expt {
+		t.Fatalf("Expected %q got %q\n", expt, recv)
+	}
+}
@@ -0,0 +1,248 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bemasher/rtlamr/decode"
+	"github.com/bemasher/rtlamr/gen"
+	"github.com/bemasher/rtlamr/parse"
+)
+
+const subcommandUsage = `Subcommands, given before any flags:
+  receive  receive from rtl_tcp, the default without a subcommand
+  replay   decode samples recorded with -samplefile
+  scan     listen for each message type in turn and report what was heard
+  survey   report noise, interference and preamble hits across the band
+  gen      generate samples of synthetic packets
+  bench    measure how fast samples decode
+  decode-gob  convert logs written with -format=gob to json
+Run rtlamr <subcommand> -help for each subcommand's flags.
+`
+
+// subcommand returns the function running the named subcommand with its
+// arguments, or nil if there's no such subcommand. receive is handled by run.
+func subcommand(name string) func(args []string) int {
+	switch name {
+	case "replay":
+		return runReplay
+	case "scan":
+		return runScan
+	case "survey":
+		return runSurvey
+	case "gen":
+		return runGen
+	case "bench":
+		return runBench
+	case "decode-gob":
+		return runDecodeGob
+	}
+	return nil
+}
+
+// newSubcommandFlags returns a flag set for the named subcommand whose usage
+// describes its positional arguments.
+func newSubcommandFlags(name, positional string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage of %s %s [flags] %s:\n", os.Args[0], name, positional)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parseSubcommandFlags parses args, returning an exit status if the
+// subcommand should exit, such as after -help.
+func parseSubcommandFlags(fs *flag.FlagSet, args []string) (int, bool) {
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return exitOK, true
+		}
+		return exitUsage, true
+	}
+	EnvOverride(fs, os.Getenv)
+	return 0, false
+}
+
+// runScan listens for each message type with -msgtype=auto and exits with
+// its report. Flags are those of receive.
+func runScan(args []string) int {
+	return runReceive(append([]string{"-msgtype=auto", "-auto.exit"}, args...))
+}
+
+// runSurvey steps across the band with -survey and exits with its report.
+// Flags are those of receive.
+func runSurvey(args []string) int {
+	return runReceive(append([]string{"-survey"}, args...))
+}
+
+// runGen writes samples of synthetic packets, such as for testing a
+// receiver without a meter nearby.
+func runGen(args []string) int {
+	fs := newSubcommandFlags("gen", "")
+	msgType := fs.String("msgtype", "scm", "message type to generate: scm, scm+, idm, r900 or r900bcd")
+	meterID := fs.Uint("meterid", 12345678, "meter id to send")
+	meterType := fs.Uint("metertype", 7, "ERT meter type, or SCM+ endpoint type, to send")
+	consumption := fs.Uint("consumption", 0, "consumption to send")
+	increment := fs.Uint("increment", 0, "amount consumption increases with each packet")
+	tamper := fs.Uint64("tamper", 0, "tamper flags to send: scm's physical tamper in bits 2-3 and encoder tamper in bits 0-1, scm+'s tamper field or idm's 6 bytes of tamper counters")
+	count := fs.Int("count", 1, "number of packets to send")
+	gap := fs.Duration("gap", 100*time.Millisecond, "silence before each packet and after the last")
+	symbolLength := fs.Int("symbollength", 72, "symbol length in samples")
+	snr := fs.Float64("snr", math.Inf(1), "signal to noise ratio in dB, +Inf for no noise")
+	freqOffset := fs.Float64("freqoffset", 0, "offset of the carrier from its nominal frequency in Hz")
+	rateError := fs.Float64("rateerror", 0, "error of the meter's symbol rate in ppm")
+	seed := fs.Int64("seed", 1, "seed of the noise, for reproducible samples")
+	output := fs.String("o", "-", "file to write samples to, - for stdout")
+	if status, exit := parseSubcommandFlags(fs, args); exit {
+		return status
+	}
+
+	cfg, err := parse.Config(strings.ToLower(*msgType), *symbolLength)
+	if err != nil {
+		log.Println(err)
+		return exitUsage
+	}
+	newPacket, err := genPacket(strings.ToLower(*msgType), *meterID, *meterType, *consumption, *increment, *tamper)
+	if err != nil {
+		log.Println("gen:", err)
+		return exitUsage
+	}
+	ch := gen.Channel{
+		SNR:        *snr,
+		FreqOffset: *freqOffset,
+		RateError:  *rateError / 1e6,
+		Rand:       rand.New(rand.NewSource(*seed)),
+	}
+
+	var w io.Writer = stdoutWriter{}
+	if *output != "-" {
+		f, err := openOutput(*output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+		if err != nil {
+			log.Println("-o:", err)
+			return exitOutput
+		}
+		defer f.Close()
+		w = f
+	}
+
+	samples := genSamples(cfg, ch, *count, *gap, func(idx int) []byte {
+		return newPacket(idx, uint32(*consumption+uint(idx)**increment))
+	})
+	if _, err := w.Write(samples); err != nil {
+		log.Println("gen:", err)
+		return exitOutput
+	}
+
+	return exitOK
+}
+
+// genSamples returns count packets with the chips returned by packet, each
+// preceded by gap of the channel's noise alone and the last followed by it.
+// The samples are padded to whole blocks so the receiver decodes every
+// packet.
+func genSamples(cfg decode.PacketConfig, ch gen.Channel, count int, gap time.Duration, packet func(idx int) []byte) []byte {
+	gapSamples := int(gap.Seconds() * float64(cfg.SampleRate))
+
+	var samples []byte
+	for idx := 0; idx < count; idx++ {
+		samples = append(samples, ch.Silence(gapSamples)...)
+		samples = append(samples, ch.Modulate(packet(idx), cfg.ChipLength, float64(cfg.SampleRate))...)
+	}
+	samples = append(samples, ch.Silence(gapSamples)...)
+	samples = append(samples, ch.Silence((cfg.BlockSize2-len(samples)%cfg.BlockSize2+cfg.BlockSize2)>>1)...)
+	return samples
+}
+
+// genPacket returns a function returning the chips of the idx'th packet of
+// the given message type from a meter, or an error if the meter's fields
+// don't fit the message type. IDM packets hold a history of intervals each
+// consuming increment.
+func genPacket(msgType string, id, meterType, consumption, increment uint, tamper uint64) (func(idx int, consumption uint32) []byte, error) {
+	switch msgType {
+	case "scm":
+		if id >= 1<<26 || meterType >= 1<<4 || consumption >= 1<<24 || tamper >= 1<<4 {
+			return nil, fmt.Errorf("scm meter ids must be under 2^26, types under 16, consumption under 2^24 and tamper flags under 16")
+		}
+		return func(idx int, consumption uint32) []byte {
+			scm := gen.SCM{
+				ID:          uint32(id),
+				Type:        uint8(meterType),
+				TamperPhy:   uint8(tamper >> 2),
+				TamperEnc:   uint8(tamper & 0x03),
+				Consumption: consumption & 0xFFFFFF,
+			}
+			return gen.ManchesterChips(scm.Packet())
+		}, nil
+	case "scm+":
+		if uint64(id) >= 1<<32 || meterType >= 1<<8 || uint64(consumption) >= 1<<32 || tamper >= 1<<16 {
+			return nil, fmt.Errorf("scm+ meter ids must be under 2^32, types under 256, consumption under 2^32 and tamper flags under 2^16")
+		}
+		return func(idx int, consumption uint32) []byte {
+			scm := gen.SCMPlus{
+				EndpointType: uint8(meterType),
+				EndpointID:   uint32(id),
+				Consumption:  consumption,
+				Tamper:       uint16(tamper),
+			}
+			return gen.ManchesterChips(scm.Packet())
+		}, nil
+	case "idm":
+		if uint64(id) >= 1<<32 || meterType >= 1<<4 || uint64(consumption) >= 1<<32 || increment >= 1<<9 || tamper >= 1<<48 {
+			return nil, fmt.Errorf("idm meter ids must be under 2^32, types under 16, consumption under 2^32, increments under 512 and tamper counters under 2^48")
+		}
+		idm := gen.IDM{ERTType: uint8(meterType), ERTSerialNumber: uint32(id)}
+		for i := range idm.TamperCounters {
+			idm.TamperCounters[i] = byte(tamper >> uint(40-8*i))
+		}
+		for i := range idm.DifferentialConsumptionIntervals {
+			idm.DifferentialConsumptionIntervals[i] = uint16(increment)
+		}
+		return func(idx int, consumption uint32) []byte {
+			idm.ConsumptionIntervalCount = uint8(idx)
+			idm.LastConsumptionCount = consumption
+			return gen.ManchesterChips(idm.Packet())
+		}, nil
+	case "r900":
+		if uint64(id) >= 1<<32 || consumption >= 1<<24 || tamper != 0 {
+			return nil, fmt.Errorf("r900 meter ids must be under 2^32, consumption under 2^24 and there are no tamper flags")
+		}
+		return func(idx int, consumption uint32) []byte {
+			r900 := gen.R900{ID: uint32(id), Consumption: consumption & 0xFFFFFF}
+			return gen.R900Chips(r900.Symbols())
+		}, nil
+	case "r900bcd":
+		if uint64(id) >= 1<<32 || consumption >= 1e6 || tamper != 0 {
+			return nil, fmt.Errorf("r900bcd meter ids must be under 2^32, consumption under 10^6 and there are no tamper flags")
+		}
+		return func(idx int, consumption uint32) []byte {
+			r900 := gen.R900{ID: uint32(id), Consumption: gen.BCD(consumption % 1e6)}
+			return gen.R900Chips(r900.Symbols())
+		}, nil
+	}
+
+	return nil, fmt.Errorf("can't generate %q, only scm, scm+, idm, r900 and r900bcd are supported", msgType)
+}
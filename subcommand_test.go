@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSubcommands(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping subcommand tests in short mode")
+	}
+
+	dir := t.TempDir()
+	samples := filepath.Join(dir, "samples.cu8")
+
+	args := []string{"gen", "-meterid=45012345", "-consumption=100", "-increment=5", "-count=2", "-o=" + samples}
+	if status := runRtlamr(t, nil, args...); status != exitOK {
+		t.Fatalf("gen: expected status %d, got %d\n", exitOK, status)
+	}
+
+	out, err := os.Create(filepath.Join(dir, "out.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	args = []string{"replay", "-format=json", "-loop=2", "-filterid=45012345", samples}
+	if status := runRtlamr(t, out, args...); status != exitOK {
+		t.Fatalf("replay: expected status %d, got %d\n", exitOK, status)
+	}
+
+	buf, err := os.ReadFile(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var consumption []uint32
+	for _, line := range strings.Split(strings.TrimSpace(string(buf)), "\n") {
+		var msg struct {
+			Message struct{ ID, Consumption uint32 }
+		}
+		if err := json.Unmarshal([]byte(line), &msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Message.ID != 45012345 {
+			t.Errorf("unexpected meter %d", msg.Message.ID)
+		}
+		consumption = append(consumption, msg.Message.Consumption)
+	}
+	if got := fmt.Sprint(consumption); got != "[100 105 100 105]" {
+		t.Errorf("replayed consumption %s, want [100 105 100 105]", got)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		status int
+		args   []string
+	}{
+		{"ReplayNoFiles", exitUsage, []string{"replay"}},
+		{"ReplayMissing", exitUsage, []string{"replay", filepath.Join(dir, "missing.cu8")}},
+		{"ReplayHelp", exitOK, []string{"replay", "-help"}},
+		{"ReplayNegativeStart", exitUsage, []string{"replay", "-start=-1s", samples}},
+		{"ReplayBadLoop", exitUsage, []string{"replay", samples, "-loop=-1"}},
+		{"GenUnsupported", exitUsage, []string{"gen", "-msgtype=bogus"}},
+		{"GenTamperR900", exitUsage, []string{"gen", "-msgtype=r900", "-tamper=1"}},
+		{"Receive", exitOK, []string{"receive", "-version"}},
+		{"Legacy", exitOK, []string{"-version"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if status := runRtlamr(t, nil, tc.args...); status != tc.status {
+				t.Fatalf("Expected status %d, got %d\n", tc.status, status)
+			}
+		})
+	}
+}
+
+func TestReplayWindow(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping subcommand tests in short mode")
+	}
+
+	dir := t.TempDir()
+	samples := filepath.Join(dir, "samples.cu8")
+
+	// Packets about every 500ms, consuming 100, 105, 110 and 115.
+	args := []string{"gen", "-meterid=45012345", "-consumption=100", "-increment=5", "-count=4", "-gap=500ms", "-o=" + samples}
+	if status := runRtlamr(t, nil, args...); status != exitOK {
+		t.Fatalf("gen: expected status %d, got %d\n", exitOK, status)
+	}
+
+	out, err := os.Create(filepath.Join(dir, "out.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	// Flags may follow the file.
+	args = []string{"replay", "-format=json", samples, "-start=700ms", "-duration=1s", "-loop=2", "-faketime"}
+	if status := runRtlamr(t, out, args...); status != exitOK {
+		t.Fatalf("replay: expected status %d, got %d\n", exitOK, status)
+	}
+
+	buf, err := os.ReadFile(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		consumption []uint32
+		times       []time.Time
+	)
+	for _, line := range strings.Split(strings.TrimSpace(string(buf)), "\n") {
+		var msg struct {
+			Time    time.Time
+			Offset  int64
+			Message struct{ Consumption uint32 }
+		}
+		if err := json.Unmarshal([]byte(line), &msg); err != nil {
+			t.Fatal(err)
+		}
+		if start := int64(700*2359296/1000) * 2 / 8192 * 8192; msg.Offset < start {
+			t.Errorf("offset %d precedes the window", msg.Offset)
+		}
+		consumption = append(consumption, msg.Message.Consumption)
+		times = append(times, msg.Time)
+	}
+	if got := fmt.Sprint(consumption); got != "[105 110 105 110]" {
+		t.Fatalf("replayed consumption %s, want [105 110 105 110]", got)
+	}
+
+	// The second pass continues where the first left off, a window later.
+	for idx := 1; idx < len(times); idx++ {
+		if !times[idx].After(times[idx-1]) {
+			t.Errorf("time %s doesn't follow %s", times[idx], times[idx-1])
+		}
+	}
+	if d := times[2].Sub(times[0]); d < 990*time.Millisecond || d > 1010*time.Millisecond {
+		t.Errorf("passes are %s apart, want 1s", d)
+	}
+}
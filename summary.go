@@ -0,0 +1,106 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bemasher/rtlamr/parse"
+)
+
+// ExitSummary is reported once the receiver stops, see -summary.
+type ExitSummary struct {
+	Reason      string // Why the receiver stopped.
+	Runtime     string
+	Blocks      uint64
+	Decoded     map[string]uint64 // Packets passing checksum per message type.
+	BadChecksum uint64
+	Emitted     uint64
+	MessageRate float64             // Emitted messages per second.
+	Meters      int                 // Distinct meters heard with a valid checksum.
+	Filters     []parse.FilterStats `json:",omitempty"`
+}
+
+func NewExitSummary(reason string, runtime time.Duration, s Stats) ExitSummary {
+	summary := ExitSummary{
+		Reason:      reason,
+		Runtime:     runtime.String(),
+		Blocks:      s.Blocks,
+		Decoded:     make(map[string]uint64, len(s.decodedByType)),
+		BadChecksum: s.BadChecksum,
+		Emitted:     s.Emitted,
+		Meters:      len(s.meters),
+	}
+
+	if runtime > 0 {
+		summary.MessageRate = float64(s.Emitted) / runtime.Seconds()
+	}
+	for msgType, count := range s.decodedByType {
+		summary.Decoded[msgType] = count
+	}
+	if s.chain != nil {
+		summary.Filters = s.chain.Stats()
+	}
+
+	return summary
+}
+
+func (es ExitSummary) String() string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "Stopped: %s after %s\n", es.Reason, es.Runtime)
+	fmt.Fprintf(&b, "Blocks: %d\n", es.Blocks)
+
+	var msgTypes []string
+	for msgType := range es.Decoded {
+		msgTypes = append(msgTypes, msgType)
+	}
+	sort.Strings(msgTypes)
+
+	var decoded []string
+	for _, msgType := range msgTypes {
+		decoded = append(decoded, fmt.Sprintf("%s %d", msgType, es.Decoded[msgType]))
+	}
+	if len(decoded) == 0 {
+		decoded = append(decoded, "0")
+	}
+	fmt.Fprintf(&b, "Decoded: %s\n", strings.Join(decoded, ", "))
+
+	fmt.Fprintf(&b, "BadChecksum: %d\n", es.BadChecksum)
+	fmt.Fprintf(&b, "Emitted: %d (%.2f/s)\n", es.Emitted, es.MessageRate)
+	fmt.Fprintf(&b, "Meters: %d\n", es.Meters)
+	for _, fs := range es.Filters {
+		fmt.Fprintf(&b, "Filter %s\n", fs)
+	}
+
+	return b.String()
+}
+
+// writeSummary writes the summary to stderr, or as json to stdout with
+// -format=json.
+func writeSummary(es ExitSummary) error {
+	if *format == "json" {
+		return json.NewEncoder(os.Stdout).Encode(es)
+	}
+	_, err := fmt.Fprint(os.Stderr, es)
+	return err
+}
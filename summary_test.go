@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bemasher/rtlamr/gen"
+	"github.com/bemasher/rtlamr/parse"
+	"github.com/bemasher/rtlamr/scm"
+)
+
+func TestExitSummary(t *testing.T) {
+	var s Stats
+	var fc parse.FilterChain
+	fc.Exclude("excludeid", NewMeterIDFilter())
+	s.chain = &fc
+
+	s.Packet(scm.SCM{ID: 1})
+	s.Packet(scm.SCM{ID: 1})
+	s.Packet(scm.SCM{ID: 2})
+	s.Emitted = 3
+
+	es := NewExitSummary("time limit reached", 2*time.Second, s)
+	if es.Decoded["SCM"] != 3 || es.Meters != 2 || es.MessageRate != 1.5 {
+		t.Fatalf("Unexpected summary: %+v\n", es)
+	}
+
+	for _, expt := range []string{
+		"Stopped: time limit reached after 2s\n",
+		"Decoded: SCM 3\n",
+		"Emitted: 3 (1.50/s)\n",
+		"Filter excludeid: 0 evaluated, 0 dropped\n",
+	} {
+		if recv := es.String(); !strings.Contains(recv, expt) {
+			t.Fatalf("Expected %q in %q\n", expt, recv)
+		}
+	}
+
+	buf, err := json.Marshal(es)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(buf), `"Role":"exclude"`) {
+		t.Fatalf("Expected filter role by name got %s\n", buf)
+	}
+}
+
+// TestBadChecksumCounted checks packets failing their checksum are counted
+// without -allowbadcrc, though they aren't emitted.
+func TestBadChecksumCounted(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping receiver test in short mode")
+	}
+
+	p, err := parse.NewParser("scm", 72, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := gen.Channel{SNR: 20, Rand: rand.New(rand.NewSource(1))}
+	samples := genSamples(*p.Cfg(), ch, 1, 50*time.Millisecond, func(int) []byte {
+		pkt := gen.SCM{ID: 1001, Type: 7, Consumption: 1000}.Packet()
+		pkt[6] ^= 0x10
+		return gen.ManchesterChips(pkt)
+	})
+	server := fakeRTLTCP(t, samples)
+
+	for _, tc := range []struct {
+		name    string
+		args    []string
+		status  int
+		emitted bool
+	}{
+		{"Dropped", nil, exitNoMessages, false},
+		{"AllowBadCRC", []string{"-allowbadcrc"}, exitOK, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			stdout, err := os.Create(filepath.Join(t.TempDir(), "stdout"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer stdout.Close()
+
+			args := append([]string{"-format=json", "-server=" + server, "-duration=2s"}, tc.args...)
+			if status := runRtlamr(t, stdout, args...); status != tc.status {
+				t.Fatalf("Expected status %d, got %d\n", tc.status, status)
+			}
+			if _, err := stdout.Seek(0, 0); err != nil {
+				t.Fatal(err)
+			}
+
+			var es ExitSummary
+			emitted := false
+			scanner := bufio.NewScanner(stdout)
+			for scanner.Scan() {
+				if strings.Contains(scanner.Text(), `"Reason"`) {
+					if err := json.Unmarshal(scanner.Bytes(), &es); err != nil {
+						t.Fatal(err)
+					}
+				} else {
+					emitted = true
+				}
+			}
+			if es.BadChecksum == 0 {
+				t.Fatalf("Expected packets failing their checksum to be counted: %+v\n", es)
+			}
+			if emitted != tc.emitted {
+				t.Fatalf("Expected emitted %t, got %t\n", tc.emitted, emitted)
+			}
+		})
+	}
+}
@@ -0,0 +1,240 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bemasher/rtlamr/parse"
+)
+
+// Samples per frame whose power -survey measures, about 0.4ms at the
+// default sample rate.
+const surveyFrame = 1024
+
+// Frames at least this many dB above the noise floor are occupied.
+const surveyThreshold = 6
+
+// SurveyStep summarizes what was heard at one center frequency.
+type SurveyStep struct {
+	CenterFreq uint32
+	NoiseFloor float64        // Power of the quietest tenth of frames in dBFS.
+	Peak       float64        // Power of the loudest frame in dBFS.
+	DutyCycle  float64        // Fraction of frames 6dB or more above the noise floor.
+	Hits       map[string]int // Preamble candidates found for each message type.
+}
+
+// SurveyReport is the outcome of -survey.
+type SurveyReport struct {
+	SampleRate int
+	Dwell      float64  // Seconds listened at each step.
+	MsgTypes   []string // Message types preamble hits were counted for.
+	Steps      []SurveyStep
+}
+
+// Survey steps the tuner from -survey.start to -survey.stop, listening at
+// each step for an even share of -survey.duration, and writes a report of
+// the noise floor, interference and preamble hits at each to stdout.
+func (rcvr *Receiver) Survey(ctx context.Context) error {
+	// Automatic gain would hide the levels being measured.
+	if !gainFlagsSet() {
+		rcvr.SetGainMode(true)
+	}
+
+	report := SurveyReport{SampleRate: int(rcvr.sampleRate)}
+
+	// Count the preambles of every message type sampled at the same rate.
+	// Block sizes are powers of two, read the largest and feed each parser
+	// blocks of its own size.
+	var parsers []parse.Parser
+	blockSize := rcvr.blockSize()
+	for _, name := range parse.Names() {
+		p, err := parse.NewParser(name, *symbolLength, *decimation)
+		if err != nil {
+			return err
+		}
+		if p.Cfg().SampleRate != report.SampleRate {
+			continue
+		}
+		parsers = append(parsers, p)
+		report.MsgTypes = append(report.MsgTypes, name)
+		if size := p.Cfg().BlockSize2; size > blockSize {
+			blockSize = size
+		}
+	}
+
+	var freqs []uint32
+	for freq := uint64(*surveyStart); freq <= uint64(*surveyStop); freq += uint64(*surveyStep) {
+		freqs = append(freqs, uint32(freq))
+	}
+
+	// Each step discards a block buffered before retuning, and measures at
+	// least one more.
+	dwell := *surveyDuration / time.Duration(len(freqs))
+	blockDuration := time.Duration(blockSize>>1) * time.Second / time.Duration(report.SampleRate)
+	if dwell < 2*blockDuration {
+		return fmt.Errorf("-survey.duration: %s is too short for %d steps, at least %s is needed", *surveyDuration, len(freqs), 2*blockDuration*time.Duration(len(freqs)))
+	}
+	report.Dwell = dwell.Seconds()
+
+	m := newSurveyMeter(parsers, report.MsgTypes, blockSize)
+	for _, freq := range freqs {
+		log.Printf("Surveying %.3f MHz for %s\n", float64(freq)/1e6, dwell)
+
+		rcvr.SetCenterFreq(freq)
+		step, err := m.measure(ctx, rcvr, dwell)
+		if err != nil {
+			return err
+		}
+		step.CenterFreq = freq
+		report.Steps = append(report.Steps, step)
+	}
+
+	// Leave the tuner where it was.
+	rcvr.SetCenterFreq(rcvr.centerFreq)
+
+	var err error
+	if *format == "json" {
+		err = json.NewEncoder(os.Stdout).Encode(report)
+	} else {
+		err = report.WriteText(os.Stdout)
+	}
+	if err != nil {
+		return withStatus(exitOutput, fmt.Errorf("writing survey: %s", err))
+	}
+
+	return nil
+}
+
+// surveyMeter measures the samples read at each step of a survey.
+type surveyMeter struct {
+	parsers []parse.Parser
+	names   []string
+	block   []byte
+	frames  []float64
+
+	// Power of each unsigned sample, relative to full scale.
+	power [256]float64
+}
+
+func newSurveyMeter(parsers []parse.Parser, names []string, blockSize int) *surveyMeter {
+	m := &surveyMeter{
+		parsers: parsers,
+		names:   names,
+		block:   make([]byte, blockSize),
+	}
+	for idx := range m.power {
+		v := (float64(idx) - 127.5) / 127.5
+		m.power[idx] = v * v
+	}
+	return m
+}
+
+// measure reads samples from r for d, returning the power statistics and
+// preamble hits of the step. Stops early if ctx is cancelled.
+func (m *surveyMeter) measure(ctx context.Context, r io.Reader, d time.Duration) (step SurveyStep, err error) {
+	step.Hits = make(map[string]int, len(m.names))
+	for _, name := range m.names {
+		step.Hits[name] = 0
+	}
+	m.frames = m.frames[:0]
+
+	// Discard samples buffered before retuning.
+	if _, err := io.ReadFull(r, m.block); err != nil {
+		return step, withStatus(exitDevice, fmt.Errorf("reading samples: %s", err))
+	}
+
+	for deadline := time.Now().Add(d); time.Now().Before(deadline); {
+		if err := ctx.Err(); err != nil {
+			return step, err
+		}
+		if _, err := io.ReadFull(r, m.block); err != nil {
+			return step, withStatus(exitDevice, fmt.Errorf("reading samples: %s", err))
+		}
+
+		for offset := 0; offset+surveyFrame<<1 <= len(m.block); offset += surveyFrame << 1 {
+			var sum float64
+			for _, v := range m.block[offset : offset+surveyFrame<<1] {
+				sum += m.power[v]
+			}
+			m.frames = append(m.frames, sum/surveyFrame)
+		}
+
+		for pIdx, p := range m.parsers {
+			size := p.Cfg().BlockSize2
+			for offset := 0; offset < len(m.block); offset += size {
+				// Candidates past the first block are found again in the
+				// next one.
+				for _, qIdx := range p.Dec().Decode(m.block[offset : offset+size]) {
+					if qIdx <= p.Dec().DecCfg.BlockSize {
+						step.Hits[m.names[pIdx]]++
+					}
+				}
+			}
+		}
+	}
+
+	sort.Float64s(m.frames)
+	floor := m.frames[len(m.frames)/10]
+	occupied := len(m.frames) - sort.SearchFloat64s(m.frames, floor*math.Pow(10, surveyThreshold/10.0))
+
+	step.NoiseFloor = dBFS(floor)
+	step.Peak = dBFS(m.frames[len(m.frames)-1])
+	step.DutyCycle = float64(occupied) / float64(len(m.frames))
+
+	return step, nil
+}
+
+// dBFS converts power relative to full scale to decibels, limited to the
+// quantization noise of an 8-bit sample.
+func dBFS(power float64) float64 {
+	return 10 * math.Log10(math.Max(power, 1e-6))
+}
+
+// WriteText writes the report as a table with a row for each step.
+func (r SurveyReport) WriteText(w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Surveyed %d steps for %.1fs each at %.3f MS/s\n\n", len(r.Steps), r.Dwell, float64(r.SampleRate)/1e6)
+
+	tw := tabwriter.NewWriter(&b, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprint(tw, "MHz\tfloor dBFS\tpeak dBFS\tduty\t")
+	for _, name := range r.MsgTypes {
+		fmt.Fprintf(tw, "%s\t", name)
+	}
+	fmt.Fprintln(tw)
+	for _, step := range r.Steps {
+		fmt.Fprintf(tw, "%.3f\t%.1f\t%.1f\t%.1f%%\t", float64(step.CenterFreq)/1e6, step.NoiseFloor, step.Peak, 100*step.DutyCycle)
+		for _, name := range r.MsgTypes {
+			fmt.Fprintf(tw, "%d\t", step.Hits[name])
+		}
+		fmt.Fprintln(tw)
+	}
+	tw.Flush()
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
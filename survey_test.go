@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSurvey(t *testing.T) {
+	if testing.Short() {
+		t.Skip("surveys for a second")
+	}
+
+	signal := fakeRTLTCP(t, scmSignal(t))
+	out, err := os.Create(filepath.Join(t.TempDir(), "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	args := []string{"survey", "-server=" + signal, "-format=json", "-summary=false",
+		"-survey.start=911000000", "-survey.stop=913000000", "-survey.step=1000000", "-survey.duration=900ms"}
+	if status := runRtlamr(t, out, args...); status != exitOK {
+		t.Fatalf("expected status %d, got %d", exitOK, status)
+	}
+
+	buf, _ := os.ReadFile(out.Name())
+	var r SurveyReport
+	if err := json.Unmarshal(buf, &r); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Steps) != 3 || r.Steps[2].CenterFreq != 913000000 || math.Abs(r.Dwell-0.3) > 1e-9 {
+		t.Fatalf("unexpected report %+v", r)
+	}
+
+	// The fake server repeats a packet among silence, hit by scm and
+	// those sharing its preamble.
+	for _, step := range r.Steps {
+		if step.Hits["scm"] == 0 {
+			t.Errorf("%d: no scm preambles found", step.CenterFreq)
+		}
+		if step.Peak <= step.NoiseFloor+surveyThreshold || step.DutyCycle <= 0 || step.DutyCycle >= 0.5 {
+			t.Errorf("%d: unexpected levels %+v", step.CenterFreq, step)
+		}
+	}
+
+	var text strings.Builder
+	if err := r.WriteText(&text); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(text.String(), "913.000") || !strings.Contains(text.String(), "scm+") {
+		t.Errorf("unexpected text report:\n%s", text.String())
+	}
+
+	for _, args := range [][]string{
+		{"survey", "-server=" + signal, "-survey.start=913000000", "-survey.stop=912000000"},
+		{"survey", "-server=" + signal, "-survey.duration=1ms"},
+		{"survey", "-server=" + signal, "-msgtype=auto"},
+	} {
+		if status := runRtlamr(t, nil, args...); status != exitUsage {
+			t.Errorf("%v: expected status %d, got %d", args, exitUsage, status)
+		}
+	}
+}
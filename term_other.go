@@ -0,0 +1,37 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+var errNoTermios = errors.New("terminal control not supported on this platform")
+
+// makeRaw isn't supported, keys are read once Enter is pressed.
+func makeRaw(f *os.File) (restore func(), err error) {
+	return nil, errNoTermios
+}
+
+// termSize isn't supported, callers fall back to a default size.
+func termSize(f *os.File) (width, height int, err error) {
+	return 0, 0, errNoTermios
+}
@@ -0,0 +1,354 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bemasher/rtlamr/parse"
+)
+
+const (
+	tuiLogLines = 200                    // Lines of output kept for the log pane.
+	tuiRedraw   = 500 * time.Millisecond // Interval the screen is redrawn at.
+)
+
+// Escape sequences used by -tui.
+const (
+	tuiAltScreen  = "\x1b[?1049h\x1b[?25l" // Switch to the alternate screen and hide the cursor.
+	tuiMainScreen = "\x1b[?25h\x1b[?1049l" // Restore the cursor and the main screen.
+	tuiHome       = "\x1b[H"
+	tuiClearEOL   = "\x1b[K"
+	tuiClearEOS   = "\x1b[J"
+)
+
+// tuiMeter is a row of the -tui meter table.
+type tuiMeter struct {
+	MsgType  string
+	ID       uint32
+	Name     string
+	First    uint32 // Consumption when first heard.
+	Latest   uint32
+	Count    int
+	LastSeen time.Time
+}
+
+// TUI is the -tui screen: a table of meters heard, most recently heard
+// first, above the most recent lines of output. Output is written to the TUI
+// rather than the terminal and is shown in the log pane.
+type TUI struct {
+	mu sync.Mutex
+
+	start  time.Time
+	meters map[string]*tuiMeter // By message type and meter id.
+
+	lines   []string // Recent output, oldest first.
+	partial []byte   // Output following the last new line.
+	frozen  []string // Lines shown while the log pane is paused, nil if not.
+
+	filter  string // Only meters with an id or name containing this are shown.
+	editing bool   // Keys are appended to filter until Enter or Esc.
+}
+
+func NewTUI(start time.Time) *TUI {
+	return &TUI{start: start, meters: make(map[string]*tuiMeter)}
+}
+
+// Message records a message written by the receiver.
+func (t *TUI) Message(msg parse.LogMessage) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := msg.MsgType() + strconv.FormatUint(uint64(msg.MeterID()), 10)
+	m, ok := t.meters[key]
+	if !ok {
+		m = &tuiMeter{MsgType: msg.MsgType(), ID: msg.MeterID(), First: msg.MeterConsumption()}
+		t.meters[key] = m
+	}
+	if msg.MeterName != "" {
+		m.Name = msg.MeterName
+	}
+	m.Latest = msg.MeterConsumption()
+	m.Count++
+	m.LastSeen = msg.Time
+}
+
+// Write appends output to the log pane.
+func (t *TUI) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.partial = append(t.partial, p...)
+	for {
+		idx := bytes.IndexByte(t.partial, '\n')
+		if idx == -1 {
+			break
+		}
+		t.lines = append(t.lines, strings.TrimRight(string(t.partial[:idx]), "\r"))
+		t.partial = t.partial[idx+1:]
+	}
+	if over := len(t.lines) - tuiLogLines; over > 0 {
+		t.lines = append(t.lines[:0], t.lines[over:]...)
+	}
+
+	return len(p), nil
+}
+
+// Key handles a key press: p pauses and resumes the log pane, / starts
+// entering a filter applied by Enter, and Esc clears the filter.
+func (t *TUI) Key(b byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	const (
+		enter, newLine, esc, backspace, del = '\r', '\n', 0x1b, 0x08, 0x7f
+	)
+
+	if t.editing {
+		switch b {
+		case enter, newLine:
+			t.editing = false
+		case esc:
+			t.editing, t.filter = false, ""
+		case backspace, del:
+			if len(t.filter) > 0 {
+				t.filter = t.filter[:len(t.filter)-1]
+			}
+		default:
+			if b >= ' ' && b < del {
+				t.filter += string(rune(b))
+			}
+		}
+		return
+	}
+
+	switch b {
+	case 'p', 'P':
+		if t.frozen == nil {
+			t.frozen = append([]string{}, t.lines...)
+		} else {
+			t.frozen = nil
+		}
+	case '/':
+		t.editing, t.filter = true, ""
+	case esc:
+		t.filter = ""
+	}
+}
+
+// Render returns the screen for a terminal of the given size.
+func (t *TUI) Render(now time.Time, width, height int) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var meters []*tuiMeter
+	for _, m := range t.meters {
+		if t.filter == "" ||
+			strings.Contains(strconv.FormatUint(uint64(m.ID), 10), t.filter) ||
+			strings.Contains(strings.ToLower(m.Name), strings.ToLower(t.filter)) {
+			meters = append(meters, m)
+		}
+	}
+	sort.Slice(meters, func(i, j int) bool {
+		if !meters[i].LastSeen.Equal(meters[j].LastSeen) {
+			return meters[i].LastSeen.After(meters[j].LastSeen)
+		}
+		return meters[i].ID < meters[j].ID
+	})
+
+	var screen []string
+	header := fmt.Sprintf("rtlamr | %s | %d meters", now.Sub(t.start).Truncate(time.Second), len(t.meters))
+	if t.filter != "" && !t.editing {
+		header += fmt.Sprintf(" | filter %q, %d shown", t.filter, len(meters))
+	}
+	if t.frozen != nil {
+		header += " | log paused"
+	}
+	screen = append(screen, header, "")
+
+	// The log pane takes a third of the screen, the table what remains
+	// between the header and the footer.
+	logRows := height / 3
+	tableRows := height - logRows - len(screen) - 3
+	if tableRows < 1 {
+		tableRows = 1
+	}
+
+	const row = "%-8s  %-10s  %-14s  %-7s  %12s  %10s  %7s"
+	screen = append(screen, fmt.Sprintf(row, "Seen", "Meter ID", "Name", "Type", "Consumption", "Delta", "Packets"))
+	for idx, m := range meters {
+		if idx == tableRows {
+			break
+		}
+		screen = append(screen, fmt.Sprintf(row,
+			m.LastSeen.Format("15:04:05"), strconv.FormatUint(uint64(m.ID), 10), m.Name, m.MsgType,
+			strconv.FormatUint(uint64(m.Latest), 10), strconv.FormatInt(int64(m.Latest)-int64(m.First), 10), strconv.Itoa(m.Count),
+		))
+	}
+	for len(screen) < height-logRows-1 {
+		screen = append(screen, "")
+	}
+
+	lines := t.lines
+	if t.frozen != nil {
+		lines = t.frozen
+	}
+	if len(lines) > logRows-1 {
+		lines = lines[len(lines)-(logRows-1):]
+	}
+	screen = append(screen, strings.Repeat("-", width))
+	screen = append(screen, lines...)
+	for len(screen) < height-1 {
+		screen = append(screen, "")
+	}
+
+	if t.editing {
+		screen = append(screen, "Filter by meter id or name: "+t.filter+"_  (Enter to apply, Esc to clear)")
+	} else {
+		screen = append(screen, "p pause log  / filter  Esc clear filter  Ctrl-C quit")
+	}
+
+	for idx, line := range screen {
+		if len(line) > width {
+			screen[idx] = line[:width]
+		}
+	}
+
+	return tuiHome + strings.Join(screen, tuiClearEOL+"\r\n") + tuiClearEOL + tuiClearEOS
+}
+
+// startTUI takes over the terminal on stderr for -tui. Output to stdout, if
+// it's the same terminal, and diagnostic logging to stderr are shown in the
+// log pane, while output redirected elsewhere continues unchanged. Returns
+// nil if stderr isn't a terminal, otherwise the TUI and a function restoring
+// the terminal.
+func startTUI(start time.Time) (*TUI, func()) {
+	if !isTerminal(os.Stderr) {
+		slog.Warn("-tui requires a terminal on stderr, using normal output")
+		return nil, nil
+	}
+
+	tui := NewTUI(start)
+	term := os.Stderr
+
+	// Capture stdout through a pipe so messages written anywhere are shown
+	// in the log pane.
+	stdout := os.Stdout
+	copied := make(chan struct{})
+	var pw *os.File
+	if isTerminal(stdout) {
+		pr, w, err := os.Pipe()
+		if err != nil {
+			slog.Warn("-tui: capturing stdout", "err", err)
+			return nil, nil
+		}
+		pw, os.Stdout = w, w
+		go func() {
+			io.Copy(tui, pr)
+			close(copied)
+		}()
+	} else {
+		close(copied)
+	}
+
+	if logOutputFile == nil {
+		logSink.SetOutput(tui)
+	}
+
+	restore, err := makeRaw(os.Stdin)
+	if err != nil {
+		restore = func() {}
+	}
+	io.WriteString(term, tuiAltScreen)
+
+	// Keys redraw immediately, so draws are serialized and stop once the
+	// terminal has been restored.
+	var drawMu sync.Mutex
+	stopped := false
+	draw := func() {
+		drawMu.Lock()
+		defer drawMu.Unlock()
+		if stopped {
+			return
+		}
+
+		width, height, err := termSize(term)
+		if err != nil || width == 0 || height == 0 {
+			width, height = 80, 24
+		}
+		io.WriteString(term, tui.Render(time.Now(), width, height))
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(tuiRedraw)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				draw()
+			}
+		}
+	}()
+
+	// Keys are read until exit, the reader is left blocked on stdin.
+	if isTerminal(os.Stdin) {
+		go func() {
+			r := bufio.NewReader(os.Stdin)
+			for {
+				b, err := r.ReadByte()
+				if err != nil {
+					return
+				}
+				tui.Key(b)
+				draw()
+			}
+		}()
+	}
+
+	stop := func() {
+		close(done)
+		drawMu.Lock()
+		stopped = true
+		drawMu.Unlock()
+
+		if pw != nil {
+			os.Stdout = stdout
+			pw.Close()
+		}
+		<-copied
+		if logOutputFile == nil {
+			logSink.SetOutput(os.Stderr)
+		}
+		io.WriteString(term, tuiMainScreen)
+		restore()
+	}
+
+	return tui, stop
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bemasher/rtlamr/parse"
+	"github.com/bemasher/rtlamr/scm"
+)
+
+func TestTUI(t *testing.T) {
+	start := time.Date(2015, 6, 1, 9, 0, 0, 0, time.UTC)
+	tui := NewTUI(start)
+
+	message := func(id, consumption uint32, at time.Duration, name string) {
+		msg := parse.LogMessage{Time: start.Add(at), MeterName: name}
+		msg.Message = scm.SCM{ID: id, Consumption: consumption}
+		tui.Message(msg)
+	}
+	message(1111, 100, time.Second, "house-water")
+	message(2222, 500, 2*time.Second, "")
+	message(1111, 130, 3*time.Second, "")
+
+	for i := 0; i < 3; i++ {
+		fmt.Fprintf(tui, "line %d\n", i)
+	}
+	fmt.Fprint(tui, "partial")
+
+	screen := tui.Render(start.Add(time.Minute), 100, 20)
+
+	// The most recently heard meter is listed first, with its name kept
+	// from earlier messages and the change in consumption since first heard.
+	first, second := strings.Index(screen, "1111"), strings.Index(screen, "2222")
+	if first == -1 || second == -1 || first > second {
+		t.Fatalf("Expected 1111 listed before 2222:\n%s", screen)
+	}
+	for _, expt := range []string{"2 meters", "house-water", "130", "30", "line 2"} {
+		if !strings.Contains(screen, expt) {
+			t.Fatalf("Expected %q in screen:\n%s", expt, screen)
+		}
+	}
+	if strings.Contains(screen, "partial") {
+		t.Fatalf("Unexpected incomplete line in screen:\n%s", screen)
+	}
+	if recv := strings.Count(screen, "\r\n") + 1; recv != 20 {
+		t.Fatalf("Expected 20 lines, got %d\n", recv)
+	}
+
+	// Pausing freezes the log pane.
+	tui.Key('p')
+	fmt.Fprintln(tui, "line 3")
+	if screen := tui.Render(start, 100, 20); strings.Contains(screen, "line 3") || !strings.Contains(screen, "log paused") {
+		t.Fatalf("Expected paused log pane:\n%s", screen)
+	}
+	tui.Key('p')
+	if screen := tui.Render(start, 100, 20); !strings.Contains(screen, "line 3") {
+		t.Fatalf("Expected resumed log pane:\n%s", screen)
+	}
+
+	// Filtering by id hides other meters, Esc clears the filter.
+	for _, b := range []byte("/22\r") {
+		tui.Key(b)
+	}
+	if screen := tui.Render(start, 100, 20); strings.Contains(screen, "1111") || !strings.Contains(screen, "2222") {
+		t.Fatalf("Expected only 2222 shown:\n%s", screen)
+	}
+	tui.Key(0x1b)
+	if screen := tui.Render(start, 100, 20); !strings.Contains(screen, "1111") {
+		t.Fatalf("Expected filter cleared:\n%s", screen)
+	}
+}
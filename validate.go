@@ -0,0 +1,94 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/bemasher/rtlamr/parse"
+)
+
+// configError rewrites a *parse.ConfigError in terms of the -symbollength
+// and -decimation flags. Other errors are returned as they are.
+func configError(err error) error {
+	var ce *parse.ConfigError
+	if !errors.As(err, &ce) {
+		return err
+	}
+
+	var suggestions []string
+	for _, s := range ce.Suggestions {
+		suggestions = append(suggestions, fmt.Sprintf("-symbollength=%d -decimation=%d", s[0], s[1]))
+	}
+	return fmt.Errorf("-symbollength=%d -decimation=%d: %s can't decode this combination, %s; try %s",
+		ce.SymbolLength, ce.Decimation, ce.MsgType, ce.Reason, strings.Join(suggestions, " or "),
+	)
+}
+
+// validateConfig checks each of the message types named can be decoded with
+// -symbollength and -decimation, and at -samplerate if given, so bad
+// combinations are reported before connecting to rtl_tcp.
+func (rcvr *Receiver) validateConfig(names []string) error {
+	sampleRateSet := false
+	flag.Visit(func(f *flag.Flag) {
+		sampleRateSet = sampleRateSet || f.Name == "samplerate"
+	})
+
+	for _, name := range names {
+		if err := parse.Validate(name, *symbolLength, *decimation); err != nil {
+			return configError(err)
+		}
+		if !sampleRateSet {
+			continue
+		}
+
+		cfg, err := parse.Config(name, *symbolLength)
+		if err != nil {
+			return err
+		}
+		if err := validateSampleRate(name, cfg.SampleRate, cfg.DataRate, int(rcvr.Flags.SampleRate)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validateSampleRate checks rate, given by -samplerate, is the sample rate
+// -symbollength samples message type name at, as chips of any other length
+// don't match the parser's filters. Suggests the symbol length sampling
+// nearest to rate.
+func validateSampleRate(name string, sampleRate, dataRate, rate int) error {
+	if rate == sampleRate {
+		return nil
+	}
+
+	prefix := fmt.Sprintf("-samplerate=%d: %s is sampled at %d S/s with -symbollength=%d", rate, name, sampleRate, *symbolLength)
+	suggested := (rate + dataRate>>1) / dataRate
+	switch {
+	case parse.Validate(name, suggested, *decimation) != nil:
+		return fmt.Errorf("%s, omit -samplerate", prefix)
+	case suggested*dataRate != rate:
+		return fmt.Errorf("%s, sample rates are multiples of the %d chip/s data rate, use -symbollength=%d for %d S/s instead",
+			prefix, dataRate, suggested, suggested*dataRate,
+		)
+	}
+	return fmt.Errorf("%s, use -symbollength=%d instead", prefix, suggested)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bemasher/rtlamr/gen"
+	"github.com/bemasher/rtlamr/parse"
+)
+
+// TestConfigMatrix decodes a generated packet of every registered message
+// type at each symbol length and decimation it accepts, so parsers must
+// declare constraints they really decode with. Rejected combinations must
+// suggest accepted ones.
+func TestConfigMatrix(t *testing.T) {
+	for _, name := range parse.Names() {
+		t.Run(name, func(t *testing.T) {
+			newPacket, err := genPacket(name, selfTestID, selfTestType, selfTestConsumption, 0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			accepted := 0
+			for symbolLength := 1; symbolLength <= 128; symbolLength++ {
+				for decimation := 0; decimation <= 16; decimation++ {
+					err := parse.Validate(name, symbolLength, decimation)
+
+					var ce *parse.ConfigError
+					if errors.As(err, &ce) {
+						if len(ce.Suggestions) == 0 {
+							t.Errorf("%d/%d: no suggestions: %s", symbolLength, decimation, err)
+						}
+						for _, s := range ce.Suggestions {
+							if err := parse.Validate(name, s[0], s[1]); err != nil {
+								t.Errorf("%d/%d: suggested %d/%d: %s", symbolLength, decimation, s[0], s[1], err)
+							}
+						}
+						continue
+					} else if err != nil {
+						t.Fatal(err)
+					}
+					accepted++
+
+					bd, err := parse.NewBlockDecoder(name, symbolLength, decimation)
+					if err != nil {
+						t.Fatalf("%d/%d: %s", symbolLength, decimation, err)
+					}
+					cfg, err := parse.Config(name, symbolLength)
+					if err != nil {
+						t.Fatal(err)
+					}
+					// Decimations which don't divide the block size drop the
+					// samples left over at the end of each block, shifting the
+					// chips of packets spanning blocks. They're accepted, as
+					// they always have been, but not all decode this packet.
+					if cfg.BlockSize%decimation != 0 {
+						continue
+					}
+					samples := genSamples(cfg, gen.Channel{}, 1, 10*time.Millisecond, func(idx int) []byte {
+						return newPacket(idx, selfTestConsumption)
+					})
+					// Packets straddling blocks are occasionally decoded
+					// from both, only decoding at all is checked here.
+					msgs := bd.Write(samples)
+					if len(msgs) == 0 {
+						t.Errorf("%d/%d: nothing decoded", symbolLength, decimation)
+					}
+					for _, msg := range msgs {
+						if id := msg.MeterID(); id != selfTestID {
+							t.Errorf("%d/%d: decoded id %d, want %d", symbolLength, decimation, id, selfTestID)
+						}
+					}
+				}
+			}
+
+			if err := parse.Validate(name, 72, 1); err != nil {
+				t.Errorf("default configuration rejected: %s", err)
+			}
+			if err := parse.Validate(name, lowRateSymbolLength, 1); err != nil {
+				t.Errorf("-lowrate configuration rejected: %s", err)
+			}
+			t.Logf("%d combinations accepted", accepted)
+		})
+	}
+}
+
+func TestConfigError(t *testing.T) {
+	_, err := parse.NewParser("scm", 72, 5)
+	err = configError(err)
+	want := "-symbollength=72 -decimation=5: scm can't decode this combination, decimation must divide the symbol length of 144 samples; try -symbollength=72 -decimation=4 or -symbollength=70 -decimation=5"
+	if err == nil || err.Error() != want {
+		t.Errorf("got %v, want %q", err, want)
+	}
+
+	if err := configError(nil); err != nil {
+		t.Errorf("configError(nil) = %v", err)
+	}
+}
+
+func TestValidateSampleRate(t *testing.T) {
+	for _, tc := range []struct {
+		rate int
+		want string
+	}{
+		{72 * 32768, ""},
+		{73 * 32768, "use -symbollength=73 instead"},
+		{2400000, "use -symbollength=73 for 2392064 S/s instead"},
+		{1e6, "use -symbollength=31 for 1015808 S/s instead"},
+		{250000, "use -symbollength=8 for 262144 S/s instead"},
+		{500000, "omit -samplerate"},
+	} {
+		err := validateSampleRate("scm", 72*32768, 32768, tc.rate)
+		switch {
+		case tc.want == "" && err != nil:
+			t.Errorf("%d: %s", tc.rate, err)
+		case tc.want != "" && (err == nil || !strings.HasSuffix(err.Error(), tc.want)):
+			t.Errorf("%d: got %v, want suffix %q", tc.rate, err, tc.want)
+		}
+	}
+}
+
+func TestConfigRejectedBeforeConnecting(t *testing.T) {
+	for _, args := range [][]string{
+		{"-symbollength=10"},
+		{"-decimation=5"},
+		{"-msgtype=auto", "-decimation=7"},
+		{"-samplerate=2400000"},
+	} {
+		if status := runRtlamr(t, nil, append(args, "-server=127.0.0.1:1")...); status != exitUsage {
+			t.Errorf("%v: expected status %d, got %d", args, exitUsage, status)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// errStalled is returned by the sample reader once the watchdog finds sample
+// delivery has stalled.
+var errStalled = errors.New("sample delivery stalled")
+
+const (
+	// watchdogWindow is the period over which the delivery rate is measured.
+	watchdogWindow = time.Second
+
+	// A stall which would be the watchdogEscalateResets'th reset within
+	// watchdogEscalateWindow reconnects to rtl_tcp instead.
+	watchdogEscalateResets = 3
+	watchdogEscalateWindow = time.Minute
+)
+
+// Watchdog detects dongles which have wedged while rtl_tcp stays connected,
+// either delivering samples well below the sample rate, none at all, or only
+// zeros. A nil Watchdog never stalls.
+type Watchdog struct {
+	Threshold time.Duration // How long delivery may stall before a reset.
+	Rate      float64       // Expected bytes per second.
+
+	lastOK      time.Time // End of the last window delivered at half the expected rate.
+	windowStart time.Time
+	windowBytes int
+	resets      []time.Time
+}
+
+// NewWatchdog returns a watchdog expecting samples at the given rate, nil if
+// threshold is zero.
+func NewWatchdog(threshold time.Duration, sampleRate uint32) *Watchdog {
+	if threshold == 0 {
+		return nil
+	}
+	return &Watchdog{Threshold: threshold, Rate: float64(sampleRate) * 2}
+}
+
+// Start restarts measurement at now, such as after the reader was restarted.
+func (w *Watchdog) Start(now time.Time) {
+	if w == nil {
+		return
+	}
+	w.lastOK, w.windowStart, w.windowBytes = now, now, 0
+}
+
+// Deliver counts a block of samples read at now. Blocks of only zeros aren't
+// counted, as wedged dongles may deliver those indefinitely.
+func (w *Watchdog) Deliver(now time.Time, block []byte) {
+	if w == nil {
+		return
+	}
+
+	for _, b := range block {
+		if b != 0 {
+			w.windowBytes += len(block)
+			break
+		}
+	}
+
+	elapsed := now.Sub(w.windowStart)
+	if elapsed < watchdogWindow {
+		return
+	}
+	if float64(w.windowBytes)/elapsed.Seconds() >= w.Rate/2 {
+		w.lastOK = now
+	}
+	w.windowStart, w.windowBytes = now, 0
+}
+
+// Stalled returns true once delivery has been below half the expected rate
+// for Threshold.
+func (w *Watchdog) Stalled(now time.Time) bool {
+	return w != nil && now.Sub(w.lastOK) >= w.Threshold
+}
+
+// Reset records a reset after a stall at now. Returns true if resets aren't
+// recovering the dongle and the caller should reconnect to rtl_tcp instead.
+func (w *Watchdog) Reset(now time.Time) (escalate bool) {
+	recent := w.resets[:0]
+	for _, t := range w.resets {
+		if now.Sub(t) < watchdogEscalateWindow {
+			recent = append(recent, t)
+		}
+	}
+	w.resets = append(recent, now)
+
+	if len(w.resets) >= watchdogEscalateResets {
+		w.resets = w.resets[:0]
+		return true
+	}
+	return false
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWatchdog(t *testing.T) {
+	start := time.Unix(0, 0)
+	w := NewWatchdog(3*time.Second, 1000)
+	w.Start(start)
+
+	full := make([]byte, 2000)
+	for idx := range full {
+		full[idx] = 127
+	}
+	zeros := make([]byte, 2000)
+
+	// Delivering at the expected rate never stalls.
+	now := start
+	for i := 0; i < 10; i++ {
+		now = now.Add(time.Second)
+		w.Deliver(now, full)
+		if w.Stalled(now) {
+			t.Fatalf("Unexpected stall at %s\n", now.Sub(start))
+		}
+	}
+
+	// Only zeros stall once the threshold has passed.
+	stalled := now
+	for i := 1; i <= 3; i++ {
+		now = now.Add(time.Second)
+		w.Deliver(now, zeros)
+		if w.Stalled(now) != (i == 3) {
+			t.Fatalf("Expected stall %t after %d zero blocks\n", i == 3, i)
+		}
+	}
+	if now.Sub(stalled) != w.Threshold {
+		t.Fatalf("Expected stall after %s, got %s\n", w.Threshold, now.Sub(stalled))
+	}
+
+	// No delivery at all stalls too.
+	w.Start(now)
+	if w.Stalled(now.Add(time.Second)) || !w.Stalled(now.Add(3*time.Second)) {
+		t.Fatal("Expected stall without delivery")
+	}
+
+	// The third reset within a minute escalates, older resets are forgotten.
+	for i, tc := range []struct {
+		at       time.Duration
+		escalate bool
+	}{
+		{0, false},
+		{30 * time.Second, false},
+		{61 * time.Second, false},
+		{62 * time.Second, true},
+		{63 * time.Second, false},
+	} {
+		if escalate := w.Reset(start.Add(tc.at)); escalate != tc.escalate {
+			t.Fatalf("Reset %d at %s: expected escalate %t\n", i, tc.at, tc.escalate)
+		}
+	}
+
+	disabled := NewWatchdog(0, 1000)
+	disabled.Start(now)
+	disabled.Deliver(now, zeros)
+	if disabled.Stalled(now.Add(time.Hour)) {
+		t.Fatal("Disabled watchdog stalled")
+	}
+}
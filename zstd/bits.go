@@ -0,0 +1,131 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package zstd
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// bitWriter appends values to a bitstream least significant bit first.
+type bitWriter struct {
+	out   []byte
+	acc   uint64
+	nbits uint
+}
+
+// add appends the low n bits of v, n must not exceed 32.
+func (w *bitWriter) add(v uint64, n uint) {
+	w.acc |= (v & (1<<n - 1)) << w.nbits
+	w.nbits += n
+	for w.nbits >= 8 {
+		w.out = append(w.out, byte(w.acc))
+		w.acc >>= 8
+		w.nbits -= 8
+	}
+}
+
+// bytes pads the stream to a whole byte and returns it.
+func (w *bitWriter) bytes() []byte {
+	if w.nbits > 0 {
+		w.out = append(w.out, byte(w.acc))
+		w.acc, w.nbits = 0, 0
+	}
+	return w.out
+}
+
+// close ends a stream to be read backward with a marker bit.
+func (w *bitWriter) close() []byte {
+	w.add(1, 1)
+	return w.bytes()
+}
+
+// forwardReader reads a bitstream least significant bit first. Bits past the
+// end read as zero, overread reports whether any were consumed.
+type forwardReader struct {
+	in  []byte
+	pos uint
+}
+
+func (r *forwardReader) peek(n uint) uint64 {
+	idx := int(r.pos >> 3)
+	var v uint64
+	for i := min(idx+8, len(r.in)) - 1; i >= idx; i-- {
+		v = v<<8 | uint64(r.in[i])
+	}
+	return v >> (r.pos & 7) & (1<<n - 1)
+}
+
+func (r *forwardReader) skip(n uint) {
+	r.pos += n
+}
+
+func (r *forwardReader) read(n uint) uint64 {
+	v := r.peek(n)
+	r.skip(n)
+	return v
+}
+
+func (r *forwardReader) overread() bool {
+	return r.pos > uint(len(r.in))*8
+}
+
+// reverseReader reads a bitstream backward from its marker bit, as FSE and
+// Huffman streams are. Bits before the start read as zero, pos goes negative
+// once any were consumed.
+type reverseReader struct {
+	in  []byte
+	pos int
+}
+
+func newReverseReader(in []byte) (*reverseReader, error) {
+	if len(in) == 0 || in[len(in)-1] == 0 {
+		return nil, ErrCorrupt
+	}
+	return &reverseReader{in, (len(in)-1)*8 + bits.Len8(in[len(in)-1]) - 1}, nil
+}
+
+// load returns at least 56 bits of the stream starting at bit lo.
+func (r *reverseReader) load(lo int) uint64 {
+	idx := lo >> 3
+	var v uint64
+	if idx+8 <= len(r.in) {
+		v = binary.LittleEndian.Uint64(r.in[idx:])
+	} else {
+		for i := len(r.in) - 1; i >= idx; i-- {
+			v = v<<8 | uint64(r.in[i])
+		}
+	}
+	return v >> (lo & 7)
+}
+
+// peek returns the next n bits, n must not exceed 56.
+func (r *reverseReader) peek(n uint) uint64 {
+	var v uint64
+	if lo := r.pos - int(n); lo >= 0 {
+		v = r.load(lo)
+	} else if r.pos > 0 {
+		v = r.load(0) << uint(-lo)
+	}
+	return v & (1<<n - 1)
+}
+
+func (r *reverseReader) read(n uint) uint64 {
+	v := r.peek(n)
+	r.pos -= int(n)
+	return v
+}
@@ -0,0 +1,223 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package zstd
+
+import "math/bits"
+
+// fseEntry is a state of an FSE decoding table: the symbol it decodes and
+// how to find the next state.
+type fseEntry struct {
+	symbol   uint8
+	nbBits   uint8
+	newState uint16
+}
+
+type fseTable struct {
+	log    uint
+	states []fseEntry
+}
+
+// readNCount reads a normalized distribution of at most maxSymbol+1
+// probabilities with an accuracy log no greater than maxLog, returning the
+// number of bytes it used.
+func readNCount(in []byte, maxSymbol int, maxLog uint) ([]int16, uint, int, error) {
+	br := forwardReader{in: in}
+	log := uint(br.read(4)) + 5
+	if log > maxLog {
+		return nil, 0, 0, ErrCorrupt
+	}
+
+	remaining := int32(1<<log) + 1
+	threshold := int32(1 << log)
+	nbBits := log + 1
+
+	var norm []int16
+	previous0 := false
+	for remaining > 1 && len(norm) <= maxSymbol {
+		if previous0 {
+			n0 := len(norm)
+			for br.peek(16) == 0xFFFF && !br.overread() {
+				n0 += 24
+				br.skip(16)
+			}
+			for br.peek(2) == 3 {
+				n0 += 3
+				br.skip(2)
+			}
+			n0 += int(br.read(2))
+			if n0 > maxSymbol {
+				return nil, 0, 0, ErrCorrupt
+			}
+			for len(norm) < n0 {
+				norm = append(norm, 0)
+			}
+		}
+
+		max := 2*threshold - 1 - remaining
+		var count int32
+		if low := int32(br.peek(nbBits - 1)); low < max {
+			count = low
+			br.skip(nbBits - 1)
+		} else {
+			count = int32(br.peek(nbBits))
+			if count >= threshold {
+				count -= max
+			}
+			br.skip(nbBits)
+		}
+		count--
+
+		if count < 0 {
+			remaining += count
+		} else {
+			remaining -= count
+		}
+		if remaining < 1 {
+			return nil, 0, 0, ErrCorrupt
+		}
+		norm = append(norm, int16(count))
+		previous0 = count == 0
+
+		for remaining < threshold {
+			nbBits--
+			threshold >>= 1
+		}
+	}
+
+	if remaining != 1 || br.overread() {
+		return nil, 0, 0, ErrCorrupt
+	}
+	return norm, log, int(br.pos+7) / 8, nil
+}
+
+// writeNCount is the inverse of readNCount.
+func writeNCount(norm []int16, log uint) []byte {
+	var bw bitWriter
+	bw.add(uint64(log-5), 4)
+
+	remaining := int32(1<<log) + 1
+	threshold := int32(1 << log)
+	nbBits := log + 1
+
+	previous0 := false
+	for symbol := 0; symbol < len(norm) && remaining > 1; symbol++ {
+		if previous0 {
+			start := symbol
+			for symbol < len(norm) && norm[symbol] == 0 {
+				symbol++
+			}
+			if symbol == len(norm) {
+				break
+			}
+			for ; symbol >= start+24; start += 24 {
+				bw.add(0xFFFF, 16)
+			}
+			for ; symbol >= start+3; start += 3 {
+				bw.add(3, 2)
+			}
+			bw.add(uint64(symbol-start), 2)
+		}
+
+		count := int32(norm[symbol])
+		if count < 0 {
+			remaining += count
+		} else {
+			remaining -= count
+		}
+		count++
+
+		max := 2*threshold - 1 - (remaining + abs(int32(norm[symbol])))
+		if count >= threshold {
+			count += max
+		}
+		if count < max {
+			bw.add(uint64(count), nbBits-1)
+		} else {
+			bw.add(uint64(count), nbBits)
+		}
+		previous0 = norm[symbol] == 0
+
+		for remaining < threshold {
+			nbBits--
+			threshold >>= 1
+		}
+	}
+	return bw.bytes()
+}
+
+func abs(v int32) int32 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// buildFSE spreads a normalized distribution over a decoding table.
+func buildFSE(norm []int16, log uint) (*fseTable, error) {
+	size := 1 << log
+	t := &fseTable{log, make([]fseEntry, size)}
+
+	next := make([]uint16, len(norm))
+	high := size - 1
+	for s, c := range norm {
+		if c == -1 {
+			t.states[high].symbol = uint8(s)
+			high--
+			next[s] = 1
+		} else {
+			next[s] = uint16(c)
+		}
+	}
+
+	step := size>>1 + size>>3 + 3
+	mask := size - 1
+	pos := 0
+	for s, c := range norm {
+		for i := 0; i < int(c); i++ {
+			t.states[pos].symbol = uint8(s)
+			for pos = (pos + step) & mask; pos > high; pos = (pos + step) & mask {
+			}
+		}
+	}
+	if pos != 0 {
+		return nil, ErrCorrupt
+	}
+
+	for u := range t.states {
+		s := t.states[u].symbol
+		x := next[s]
+		next[s]++
+		nb := log - uint(bits.Len16(x)-1)
+		t.states[u].nbBits = uint8(nb)
+		t.states[u].newState = uint16(x<<nb) - uint16(size)
+	}
+	return t, nil
+}
+
+// rleTable decodes only symbol and reads no bits.
+func rleTable(symbol uint8) *fseTable {
+	return &fseTable{0, []fseEntry{{symbol: symbol}}}
+}
+
+// predefined returns the table of a default distribution, which are valid.
+func predefined(norm []int16, log uint) *fseTable {
+	t, err := buildFSE(norm, log)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
@@ -0,0 +1,524 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package zstd
+
+import (
+	"encoding/binary"
+	"math/bits"
+	"sort"
+)
+
+const maxHuffBits = 11
+
+type huffEntry struct {
+	symbol uint8
+	nbBits uint8
+}
+
+// huffTable decodes a symbol from the next log bits of a stream.
+type huffTable struct {
+	log     uint
+	entries []huffEntry
+}
+
+// readHuffTable reads a Huffman tree description, returning the number of
+// bytes it used.
+func readHuffTable(in []byte) (*huffTable, int, error) {
+	if len(in) == 0 {
+		return nil, 0, ErrCorrupt
+	}
+
+	var weights []uint8
+	var n int
+	if header := int(in[0]); header < 128 {
+		n = 1 + header
+		if len(in) < n {
+			return nil, 0, ErrCorrupt
+		}
+		norm, log, used, err := readNCount(in[1:n], maxHuffBits+1, 6)
+		if err != nil {
+			return nil, 0, err
+		}
+		t, err := buildFSE(norm, log)
+		if err != nil {
+			return nil, 0, err
+		}
+		if weights, err = decodeWeights(in[1+used:n], t); err != nil {
+			return nil, 0, err
+		}
+	} else {
+		count := header - 127
+		n = 1 + (count+1)/2
+		if len(in) < n {
+			return nil, 0, ErrCorrupt
+		}
+		weights = make([]uint8, count)
+		for idx := range weights {
+			b := in[1+idx/2]
+			if idx%2 == 0 {
+				weights[idx] = b >> 4
+			} else {
+				weights[idx] = b & 15
+			}
+		}
+	}
+
+	t, err := buildHuffTable(weights)
+	return t, n, err
+}
+
+// decodeWeights decodes Huffman weights with two interleaved FSE states.
+func decodeWeights(in []byte, t *fseTable) ([]uint8, error) {
+	br, err := newReverseReader(in)
+	if err != nil {
+		return nil, err
+	}
+
+	states := [2]uint64{br.read(t.log), br.read(t.log)}
+	var weights []uint8
+	for idx := 0; ; idx ^= 1 {
+		if len(weights) >= 255 {
+			return nil, ErrCorrupt
+		}
+		e := t.states[states[idx]]
+		weights = append(weights, e.symbol)
+		states[idx] = uint64(e.newState) + br.read(uint(e.nbBits))
+		if br.pos < 0 {
+			return append(weights, t.states[states[idx^1]].symbol), nil
+		}
+	}
+}
+
+// buildHuffTable completes weights with the last symbol's implied weight
+// and builds the decoding table.
+func buildHuffTable(weights []uint8) (*huffTable, error) {
+	if len(weights) > 255 {
+		return nil, ErrCorrupt
+	}
+
+	var rank [maxHuffBits + 2]uint32
+	var total uint32
+	for _, w := range weights {
+		if int(w) >= len(rank) {
+			return nil, ErrCorrupt
+		}
+		rank[w]++
+		if w > 0 {
+			total += 1 << (w - 1)
+		}
+	}
+	if total == 0 {
+		return nil, ErrCorrupt
+	}
+
+	log := uint(bits.Len32(total))
+	if log > maxHuffBits {
+		return nil, ErrCorrupt
+	}
+	left := uint32(1)<<log - total
+	if left&(left-1) != 0 {
+		return nil, ErrCorrupt
+	}
+	last := uint8(bits.Len32(left))
+	weights = append(weights[:len(weights):len(weights)], last)
+	rank[last]++
+
+	var start [maxHuffBits + 2]uint32
+	next := uint32(0)
+	for w := 1; w < len(rank); w++ {
+		start[w] = next
+		next += rank[w] << (w - 1)
+	}
+
+	t := &huffTable{log, make([]huffEntry, 1<<log)}
+	for s, w := range weights {
+		if w == 0 {
+			continue
+		}
+		e := huffEntry{uint8(s), uint8(log + 1 - uint(w))}
+		length := uint32(1) << (w - 1)
+		for u := start[w]; u < start[w]+length; u++ {
+			t.entries[u] = e
+		}
+		start[w] += length
+	}
+	return t, nil
+}
+
+// decode fills out with symbols from a single Huffman stream.
+func (t *huffTable) decode(out, in []byte) error {
+	br, err := newReverseReader(in)
+	if err != nil {
+		return err
+	}
+	for idx := range out {
+		e := t.entries[br.peek(t.log)]
+		out[idx] = e.symbol
+		br.pos -= int(e.nbBits)
+	}
+	if br.pos != 0 {
+		return ErrCorrupt
+	}
+	return nil
+}
+
+// decode4 fills out from four streams preceded by a jump table.
+func (t *huffTable) decode4(out, in []byte) error {
+	if len(in) < 6 {
+		return ErrCorrupt
+	}
+	var sizes [4]int
+	sizes[3] = len(in) - 6
+	for idx := 0; idx < 3; idx++ {
+		sizes[idx] = int(binary.LittleEndian.Uint16(in[idx*2:]))
+		sizes[3] -= sizes[idx]
+	}
+	segment := (len(out) + 3) / 4
+	if sizes[3] < 0 || len(out) < 3*segment {
+		return ErrCorrupt
+	}
+
+	in = in[6:]
+	for idx, size := range sizes {
+		dst := out[idx*segment:]
+		if idx < 3 {
+			dst = dst[:segment]
+		}
+		if err := t.decode(dst, in[:size]); err != nil {
+			return err
+		}
+		in = in[size:]
+	}
+	return nil
+}
+
+type huffCode struct {
+	code   uint64
+	nbBits uint
+}
+
+// huffEncoder holds a code built for a block's literals and its tree
+// description.
+type huffEncoder struct {
+	codes [256]huffCode
+	tree  []byte
+}
+
+// newHuffEncoder builds a length limited code for the symbols counted, nil
+// if there are fewer than two or the tree can't be described.
+func newHuffEncoder(counts *[256]int) *huffEncoder {
+	lengths, ok := huffLengths(counts, maxHuffBits)
+	if !ok {
+		return nil
+	}
+
+	var log uint8
+	last := 0
+	for s, l := range lengths {
+		log = max(log, l)
+		if l > 0 {
+			last = s
+		}
+	}
+
+	// Weights of all but the last symbol, whose is implied.
+	weights := make([]uint8, last)
+	for s := range weights {
+		if lengths[s] > 0 {
+			weights[s] = log + 1 - lengths[s]
+		}
+	}
+	tree := writeWeights(weights)
+	if tree == nil {
+		return nil
+	}
+
+	// Codes follow the decoding table's order: by weight, then by symbol.
+	var rank [maxHuffBits + 2]uint64
+	for _, l := range lengths {
+		if l > 0 {
+			rank[log+1-l]++
+		}
+	}
+	var start [maxHuffBits + 2]uint64
+	next := uint64(0)
+	for w := 1; w < len(rank); w++ {
+		start[w] = next
+		next += rank[w] << (w - 1)
+	}
+
+	h := &huffEncoder{tree: tree}
+	for s, l := range lengths {
+		if l == 0 {
+			continue
+		}
+		w := log + 1 - l
+		h.codes[s] = huffCode{start[w] >> (w - 1), uint(l)}
+		start[w] += 1 << (w - 1)
+	}
+	return h
+}
+
+// encode writes lits as a single stream, read back to front.
+func (h *huffEncoder) encode(out, lits []byte) []byte {
+	bw := bitWriter{out: out}
+	for idx := len(lits) - 1; idx >= 0; idx-- {
+		c := h.codes[lits[idx]]
+		bw.add(c.code, c.nbBits)
+	}
+	return bw.close()
+}
+
+// encode4 writes lits as four streams after their jump table, nil if a
+// stream is too large to jump over.
+func (h *huffEncoder) encode4(out, lits []byte) []byte {
+	segment := (len(lits) + 3) / 4
+	table := len(out)
+	out = append(out, make([]byte, 6)...)
+	for idx := 0; idx < 4; idx++ {
+		lo := min(idx*segment, len(lits))
+		hi := min(lo+segment, len(lits))
+		if idx == 3 {
+			hi = len(lits)
+		}
+		prev := len(out)
+		out = h.encode(out, lits[lo:hi])
+		if idx < 3 {
+			size := len(out) - prev
+			if size > 0xFFFF {
+				return nil
+			}
+			binary.LittleEndian.PutUint16(out[table+idx*2:], uint16(size))
+		}
+	}
+	return out
+}
+
+// huffLengths returns Huffman code lengths no longer than limit, false if
+// fewer than two symbols were counted.
+func huffLengths(counts *[256]int, limit uint8) (lengths [256]uint8, ok bool) {
+	type node struct {
+		count       int
+		left, right int
+	}
+
+	var syms []int
+	for s, c := range counts {
+		if c > 0 {
+			syms = append(syms, s)
+		}
+	}
+	if len(syms) < 2 {
+		return lengths, false
+	}
+	sort.SliceStable(syms, func(i, j int) bool {
+		return counts[syms[i]] < counts[syms[j]]
+	})
+
+	// Two queue construction: leaves in order of count, then the internal
+	// nodes, which are created in order of count.
+	nodes := make([]node, 0, 2*len(syms))
+	for _, s := range syms {
+		nodes = append(nodes, node{counts[s], -1, -1})
+	}
+	leaf, internal := 0, len(syms)
+	pop := func() int {
+		if leaf < len(syms) && (internal == len(nodes) || nodes[leaf].count <= nodes[internal].count) {
+			leaf++
+			return leaf - 1
+		}
+		internal++
+		return internal - 1
+	}
+	for len(nodes) < 2*len(syms)-1 {
+		a, b := pop(), pop()
+		nodes = append(nodes, node{nodes[a].count + nodes[b].count, a, b})
+	}
+
+	depth := make([]uint8, len(nodes))
+	for idx := len(nodes) - 1; idx >= len(syms); idx-- {
+		depth[nodes[idx].left] = depth[idx] + 1
+		depth[nodes[idx].right] = depth[idx] + 1
+	}
+
+	// Clamp to the limit, lengthen the rarest codes until the lengths
+	// satisfy Kraft's inequality, then shorten the longest codes, most
+	// common first, until the code is complete.
+	kraft := 0
+	for idx := range syms {
+		depth[idx] = min(depth[idx], limit)
+		kraft += 1 << (limit - depth[idx])
+	}
+	for kraft > 1<<limit {
+		for idx := range syms {
+			if kraft <= 1<<limit {
+				break
+			}
+			if depth[idx] < limit {
+				depth[idx]++
+				kraft -= 1 << (limit - depth[idx])
+			}
+		}
+	}
+	for kraft < 1<<limit {
+		longest := 0
+		for idx := range syms {
+			if depth[idx] >= depth[longest] {
+				longest = idx
+			}
+		}
+		kraft += 1 << (limit - depth[longest])
+		depth[longest]--
+	}
+
+	for idx, s := range syms {
+		lengths[s] = depth[idx]
+	}
+	return lengths, true
+}
+
+// writeWeights describes a Huffman tree by its weights, compressed when
+// that's smaller, nil if they can't be described.
+func writeWeights(weights []uint8) []byte {
+	if fse := compressWeights(weights); fse != nil && len(fse) < 128 && (len(weights) > 128 || len(fse) < (len(weights)+1)/2) {
+		return append([]byte{byte(len(fse))}, fse...)
+	}
+	if len(weights) == 0 || len(weights) > 128 {
+		return nil
+	}
+
+	out := make([]byte, 1+(len(weights)+1)/2)
+	out[0] = byte(127 + len(weights))
+	for idx, w := range weights {
+		if idx%2 == 0 {
+			out[1+idx/2] |= w << 4
+		} else {
+			out[1+idx/2] |= w
+		}
+	}
+	return out
+}
+
+// compressWeights FSE codes weights for decodeWeights, nil if they can't be.
+func compressWeights(weights []uint8) []byte {
+	var counts [maxHuffBits + 1]int
+	top := 0
+	distinct := 0
+	for _, w := range weights {
+		if counts[w] == 0 {
+			distinct++
+		}
+		counts[w]++
+		top = max(top, int(w))
+	}
+	if distinct < 2 {
+		return nil
+	}
+
+	const log = 6
+	norm := normalize(counts[:top+1], len(weights), log)
+	t, err := buildFSE(norm, log)
+	if err != nil {
+		return nil
+	}
+
+	stream := encodeInterleaved(t, weights)
+	if stream == nil {
+		return nil
+	}
+	return append(writeNCount(norm, log), stream...)
+}
+
+// normalize scales counts to sum to 1<<log, keeping every counted symbol.
+func normalize(counts []int, total int, log uint) []int16 {
+	size := 1 << log
+	norm := make([]int16, len(counts))
+	sum := 0
+	for s, c := range counts {
+		if c == 0 {
+			continue
+		}
+		norm[s] = int16(max(c*size/total, 1))
+		sum += int(norm[s])
+	}
+	for ; sum > size; sum-- {
+		top := 0
+		for s := range norm {
+			if norm[s] > norm[top] {
+				top = s
+			}
+		}
+		norm[top]--
+	}
+	for ; sum < size; sum++ {
+		top := 0
+		for s := range counts {
+			if counts[s] > counts[top] {
+				top = s
+			}
+		}
+		norm[top]++
+	}
+	return norm
+}
+
+// encodeInterleaved encodes syms for two interleaved decoding states by
+// working back from the last symbols, nil if the stream can't be ended.
+func encodeInterleaved(t *fseTable, syms []uint8) []byte {
+	n := len(syms)
+	if n < 2 {
+		return nil
+	}
+
+	first := make(map[uint8]int)
+	for u := len(t.states) - 1; u >= 0; u-- {
+		first[t.states[u].symbol] = u
+	}
+
+	// The decoder reads past the start of the stream updating the state
+	// that decoded syms[n-2], which must read bits to do so.
+	states := make([]int, n)
+	states[n-1] = first[syms[n-1]]
+	states[n-2] = first[syms[n-2]]
+	if t.states[states[n-2]].nbBits == 0 {
+		return nil
+	}
+
+	fields := make([]uint64, n)
+	for k := n - 3; k >= 0; k-- {
+		target := states[k+2]
+		states[k] = -1
+		for u, e := range t.states {
+			if e.symbol == syms[k] && int(e.newState) <= target && target < int(e.newState)+1<<e.nbBits {
+				states[k] = u
+				fields[k] = uint64(target - int(e.newState))
+				break
+			}
+		}
+		if states[k] < 0 {
+			return nil
+		}
+	}
+
+	var bw bitWriter
+	for k := n - 3; k >= 0; k-- {
+		bw.add(fields[k], uint(t.states[states[k]].nbBits))
+	}
+	bw.add(uint64(states[1]), t.log)
+	bw.add(uint64(states[0]), t.log)
+	return bw.close()
+}
@@ -0,0 +1,556 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package zstd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+)
+
+var (
+	llBase = [36]uint32{
+		0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+		16, 18, 20, 22, 24, 28, 32, 40, 48, 64, 128, 256, 512, 1024, 2048, 4096,
+		8192, 16384, 32768, 65536,
+	}
+	llBits = [36]uint8{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 6, 7, 8, 9, 10, 11, 12,
+		13, 14, 15, 16,
+	}
+	mlBase = [53]uint32{
+		3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18,
+		19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32, 33, 34,
+		35, 37, 39, 41, 43, 47, 51, 59, 67, 83, 99, 131, 259, 515, 1027, 2051,
+		4099, 8195, 16387, 32771, 65539,
+	}
+	mlBits = [53]uint8{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 4, 5, 7, 8, 9, 10, 11,
+		12, 13, 14, 15, 16,
+	}
+
+	llDefault = predefined([]int16{
+		4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1,
+		2, 2, 2, 2, 2, 2, 2, 2, 2, 3, 2, 1, 1, 1, 1, 1,
+		-1, -1, -1, -1,
+	}, 6)
+	mlDefault = predefined([]int16{
+		1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1,
+		-1, -1, -1, -1, -1,
+	}, 6)
+	ofDefault = predefined([]int16{
+		1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1,
+	}, 5)
+)
+
+// Reader decompresses a stream of concatenated frames, skipping skippable
+// frames between them.
+type Reader struct {
+	r   *bufio.Reader
+	err error
+
+	out  []byte // Decoded but not yet read.
+	hist []byte // Frame content, at least the last window's worth of it.
+
+	inFrame  bool
+	window   int
+	checksum bool
+	hash     xxh64
+
+	// State carried between a frame's blocks.
+	huff       *huffTable
+	ll, of, ml *fseTable
+	rep        [3]int
+
+	block []byte
+	lits  []byte
+}
+
+// NewReader returns a Reader decompressing r.
+func NewReader(r io.Reader) *Reader {
+	z := new(Reader)
+	z.Reset(r)
+	return z
+}
+
+// Reset discards the Reader's state and reads from r.
+func (z *Reader) Reset(r io.Reader) {
+	*z = Reader{
+		r:     bufio.NewReader(r),
+		hist:  z.hist[:0],
+		block: z.block,
+		lits:  z.lits,
+	}
+}
+
+func (z *Reader) Read(p []byte) (int, error) {
+	for len(z.out) == 0 {
+		if z.err != nil {
+			return 0, z.err
+		}
+		z.err = z.next()
+	}
+	n := copy(p, z.out)
+	z.out = z.out[n:]
+	return n, nil
+}
+
+// next decodes the next block, reading a frame header or skipping frames
+// first as needed.
+func (z *Reader) next() error {
+	if !z.inFrame {
+		if err := z.frameHeader(); err != nil {
+			return err
+		}
+	}
+
+	var header [3]byte
+	if _, err := io.ReadFull(z.r, header[:]); err != nil {
+		return unexpected(err)
+	}
+	v := uint32(header[0]) | uint32(header[1])<<8 | uint32(header[2])<<16
+	last := v&1 == 1
+	size := int(v >> 3)
+	blockMax := min(z.window, maxBlockSize)
+
+	// Keep at least a window of history, trimming it only once it's grown
+	// to twice that so copying is amortized.
+	if len(z.hist) > 2*z.window+maxBlockSize {
+		z.hist = append(z.hist[:0], z.hist[len(z.hist)-z.window:]...)
+	}
+	prev := len(z.hist)
+
+	switch v >> 1 & 3 {
+	case 0:
+		if size > blockMax {
+			return ErrCorrupt
+		}
+		z.hist = append(z.hist, make([]byte, size)...)
+		if _, err := io.ReadFull(z.r, z.hist[prev:]); err != nil {
+			return unexpected(err)
+		}
+	case 1:
+		if size > blockMax {
+			return ErrCorrupt
+		}
+		b, err := z.r.ReadByte()
+		if err != nil {
+			return unexpected(err)
+		}
+		for idx := 0; idx < size; idx++ {
+			z.hist = append(z.hist, b)
+		}
+	case 2:
+		if size > blockMax {
+			return ErrCorrupt
+		}
+		z.block = append(z.block[:0], make([]byte, size)...)
+		if _, err := io.ReadFull(z.r, z.block); err != nil {
+			return unexpected(err)
+		}
+		if err := z.decompress(z.block); err != nil {
+			return err
+		}
+		if len(z.hist)-prev > blockMax {
+			return ErrCorrupt
+		}
+	default:
+		return ErrCorrupt
+	}
+
+	z.out = z.hist[prev:]
+	if z.checksum {
+		z.hash.write(z.out)
+	}
+
+	if last {
+		z.inFrame = false
+		if z.checksum {
+			var sum [4]byte
+			if _, err := io.ReadFull(z.r, sum[:]); err != nil {
+				return unexpected(err)
+			}
+			if binary.LittleEndian.Uint32(sum[:]) != uint32(z.hash.sum()) {
+				return ErrChecksum
+			}
+		}
+	}
+	return nil
+}
+
+// frameHeader starts the next frame, io.EOF if there isn't one.
+func (z *Reader) frameHeader() error {
+	var magic [4]byte
+	for {
+		if _, err := io.ReadFull(z.r, magic[:]); err != nil {
+			return err
+		}
+		m := binary.LittleEndian.Uint32(magic[:])
+		if m == frameMagic {
+			break
+		}
+		if m&^0xF != skippableMagic {
+			return ErrMagic
+		}
+		if _, err := io.ReadFull(z.r, magic[:]); err != nil {
+			return unexpected(err)
+		}
+		if _, err := z.r.Discard(int(binary.LittleEndian.Uint32(magic[:]))); err != nil {
+			return unexpected(err)
+		}
+	}
+
+	fhd, err := z.r.ReadByte()
+	if err != nil {
+		return unexpected(err)
+	}
+	fcsFlag := fhd >> 6
+	single := fhd>>5&1 == 1
+	if fhd>>3&1 == 1 {
+		return ErrCorrupt
+	}
+
+	window := 0
+	if !single {
+		wd, err := z.r.ReadByte()
+		if err != nil {
+			return unexpected(err)
+		}
+		log := 10 + uint(wd>>3)
+		if log > 31 {
+			return ErrWindow
+		}
+		window = 1<<log + 1<<log/8*int(wd&7)
+	}
+
+	var field [8]byte
+	dict := field[:[]int{0, 1, 2, 4}[fhd&3]]
+	if _, err := io.ReadFull(z.r, dict); err != nil {
+		return unexpected(err)
+	}
+	for _, b := range dict {
+		if b != 0 {
+			return ErrDictionary
+		}
+	}
+
+	fcsSize := []int{0, 2, 4, 8}[fcsFlag]
+	if fcsFlag == 0 && single {
+		fcsSize = 1
+	}
+	fcs := field[:fcsSize]
+	if _, err := io.ReadFull(z.r, fcs); err != nil {
+		return unexpected(err)
+	}
+	var content uint64
+	for idx := len(fcs) - 1; idx >= 0; idx-- {
+		content = content<<8 | uint64(fcs[idx])
+	}
+	if fcsFlag == 1 {
+		content += 256
+	}
+	if single {
+		if content > maxWindow {
+			return ErrWindow
+		}
+		window = int(content)
+	}
+	if window > maxWindow {
+		return ErrWindow
+	}
+
+	z.inFrame = true
+	z.window = window
+	z.checksum = fhd>>2&1 == 1
+	z.hash.reset()
+	z.hist = z.hist[:0]
+	z.huff = nil
+	z.ll, z.of, z.ml = nil, nil, nil
+	z.rep = [3]int{1, 4, 8}
+	return nil
+}
+
+// decompress decodes a compressed block onto the history.
+func (z *Reader) decompress(in []byte) error {
+	lits, n, err := z.literals(in)
+	if err != nil {
+		return err
+	}
+	return z.sequences(in[n:], lits)
+}
+
+// literals decodes a block's literals section, returning the number of
+// bytes it used.
+func (z *Reader) literals(in []byte) ([]byte, int, error) {
+	if len(in) == 0 {
+		return nil, 0, ErrCorrupt
+	}
+	typ := in[0] & 3
+	format := in[0] >> 2 & 3
+
+	if typ < 2 {
+		var regen, n int
+		switch format {
+		case 0, 2:
+			regen, n = int(in[0]>>3), 1
+		case 1:
+			if len(in) < 2 {
+				return nil, 0, ErrCorrupt
+			}
+			regen, n = int(in[0]>>4)|int(in[1])<<4, 2
+		case 3:
+			if len(in) < 3 {
+				return nil, 0, ErrCorrupt
+			}
+			regen, n = int(in[0]>>4)|int(in[1])<<4|int(in[2])<<12, 3
+		}
+		if regen > maxBlockSize {
+			return nil, 0, ErrCorrupt
+		}
+
+		if typ == 0 {
+			if len(in) < n+regen {
+				return nil, 0, ErrCorrupt
+			}
+			return in[n : n+regen], n + regen, nil
+		}
+		if len(in) < n+1 {
+			return nil, 0, ErrCorrupt
+		}
+		z.lits = z.lits[:0]
+		for idx := 0; idx < regen; idx++ {
+			z.lits = append(z.lits, in[n])
+		}
+		return z.lits, n + 1, nil
+	}
+
+	n := []int{3, 3, 4, 5}[format]
+	if len(in) < n {
+		return nil, 0, ErrCorrupt
+	}
+	var v uint64
+	for idx := n - 1; idx >= 0; idx-- {
+		v = v<<8 | uint64(in[idx])
+	}
+	var regen, size int
+	switch format {
+	case 0, 1:
+		regen, size = int(v>>4&0x3FF), int(v>>14&0x3FF)
+	case 2:
+		regen, size = int(v>>4&0x3FFF), int(v>>18&0x3FFF)
+	case 3:
+		regen, size = int(v>>4&0x3FFFF), int(v>>22&0x3FFFF)
+	}
+	if regen > maxBlockSize || len(in) < n+size {
+		return nil, 0, ErrCorrupt
+	}
+	data := in[n : n+size]
+
+	if typ == 2 {
+		t, used, err := readHuffTable(data)
+		if err != nil {
+			return nil, 0, err
+		}
+		z.huff = t
+		data = data[used:]
+	} else if z.huff == nil {
+		return nil, 0, ErrCorrupt
+	}
+
+	z.lits = append(z.lits[:0], make([]byte, regen)...)
+	var err error
+	if format == 0 {
+		err = z.huff.decode(z.lits, data)
+	} else {
+		err = z.huff.decode4(z.lits, data)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	return z.lits, n + size, nil
+}
+
+// sequences decodes a block's sequences section and executes it.
+func (z *Reader) sequences(in, lits []byte) error {
+	if len(in) == 0 {
+		return ErrCorrupt
+	}
+
+	var count, n int
+	switch b := int(in[0]); {
+	case b < 128:
+		count, n = b, 1
+	case b < 255:
+		if len(in) < 2 {
+			return ErrCorrupt
+		}
+		count, n = (b-128)<<8|int(in[1]), 2
+	default:
+		if len(in) < 3 {
+			return ErrCorrupt
+		}
+		count, n = int(in[1])|int(in[2])<<8+0x7F00, 3
+	}
+	if count == 0 {
+		if n != len(in) {
+			return ErrCorrupt
+		}
+		z.hist = append(z.hist, lits...)
+		return nil
+	}
+
+	if len(in) <= n {
+		return ErrCorrupt
+	}
+	modes := in[n]
+	n++
+	if modes&3 != 0 {
+		return ErrCorrupt
+	}
+
+	var err error
+	for _, t := range []struct {
+		table     **fseTable
+		mode      byte
+		def       *fseTable
+		maxSymbol int
+		maxLog    uint
+	}{
+		{&z.ll, modes >> 6, llDefault, len(llBase) - 1, 9},
+		{&z.of, modes >> 4 & 3, ofDefault, 31, 8},
+		{&z.ml, modes >> 2 & 3, mlDefault, len(mlBase) - 1, 9},
+	} {
+		switch t.mode {
+		case 0:
+			*t.table = t.def
+		case 1:
+			if len(in) <= n || int(in[n]) > t.maxSymbol {
+				return ErrCorrupt
+			}
+			*t.table = rleTable(in[n])
+			n++
+		case 2:
+			norm, log, used, err := readNCount(in[n:], t.maxSymbol, t.maxLog)
+			if err != nil {
+				return err
+			}
+			if *t.table, err = buildFSE(norm, log); err != nil {
+				return err
+			}
+			n += used
+		case 3:
+			if *t.table == nil {
+				return ErrCorrupt
+			}
+		}
+	}
+
+	br, err := newReverseReader(in[n:])
+	if err != nil {
+		return err
+	}
+	ll, of, ml := z.ll, z.of, z.ml
+	llState := br.read(ll.log)
+	ofState := br.read(of.log)
+	mlState := br.read(ml.log)
+
+	for seq := 0; seq < count; seq++ {
+		ofCode := of.states[ofState].symbol
+		mlCode := ml.states[mlState].symbol
+		llCode := ll.states[llState].symbol
+		if ofCode > 31 {
+			return ErrCorrupt
+		}
+
+		offset := int(uint64(1)<<ofCode + br.read(uint(ofCode)))
+		matchLen := int(mlBase[mlCode] + uint32(br.read(uint(mlBits[mlCode]))))
+		litLen := int(llBase[llCode] + uint32(br.read(uint(llBits[llCode]))))
+
+		if offset > 3 {
+			offset -= 3
+			z.rep = [3]int{offset, z.rep[0], z.rep[1]}
+		} else {
+			if litLen == 0 {
+				offset++
+			}
+			switch offset {
+			case 1:
+				offset = z.rep[0]
+			case 2:
+				offset = z.rep[1]
+				z.rep = [3]int{offset, z.rep[0], z.rep[2]}
+			case 3:
+				offset = z.rep[2]
+				z.rep = [3]int{offset, z.rep[0], z.rep[1]}
+			case 4:
+				offset = z.rep[0] - 1
+				if offset == 0 {
+					return ErrCorrupt
+				}
+				z.rep = [3]int{offset, z.rep[0], z.rep[1]}
+			}
+		}
+
+		if litLen > len(lits) {
+			return ErrCorrupt
+		}
+		z.hist = append(z.hist, lits[:litLen]...)
+		lits = lits[litLen:]
+
+		if offset > len(z.hist) || offset > z.window || matchLen > maxBlockSize {
+			return ErrCorrupt
+		}
+		for matchLen > 0 {
+			src := z.hist[len(z.hist)-offset:]
+			chunk := min(matchLen, offset)
+			z.hist = append(z.hist, src[:chunk]...)
+			matchLen -= chunk
+		}
+
+		if seq < count-1 {
+			e := ll.states[llState]
+			llState = uint64(e.newState) + br.read(uint(e.nbBits))
+			e = ml.states[mlState]
+			mlState = uint64(e.newState) + br.read(uint(e.nbBits))
+			e = of.states[ofState]
+			ofState = uint64(e.newState) + br.read(uint(e.nbBits))
+		}
+		if br.pos < 0 {
+			return ErrCorrupt
+		}
+	}
+	if br.pos != 0 {
+		return ErrCorrupt
+	}
+
+	z.hist = append(z.hist, lits...)
+	return nil
+}
+
+// unexpected reports running out of input inside a frame.
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,183 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package zstd
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+var errClosed = errors.New("zstd: write after close")
+
+// Writer compresses to a single frame with a content checksum. Blocks of
+// maxBlockSize bytes are stored as runs, Huffman coded literals or raw,
+// whichever is smallest.
+type Writer struct {
+	w      io.Writer
+	err    error
+	header bool
+	closed bool
+	hash   xxh64
+	buf    []byte
+	out    []byte
+}
+
+// NewWriter returns a Writer compressing to w. Close must be called to end
+// the frame.
+func NewWriter(w io.Writer) *Writer {
+	z := new(Writer)
+	z.Reset(w)
+	return z
+}
+
+// Reset discards the Writer's state and starts a new frame written to w.
+func (z *Writer) Reset(w io.Writer) {
+	*z = Writer{w: w, buf: z.buf[:0], out: z.out}
+	z.hash.reset()
+}
+
+func (z *Writer) Write(p []byte) (int, error) {
+	if z.closed {
+		return 0, errClosed
+	}
+
+	n := len(p)
+	for len(p) > 0 && z.err == nil {
+		// A full block is held back until more data arrives so the
+		// frame's last block is never empty.
+		if len(z.buf) == maxBlockSize {
+			z.err = z.writeBlock(false)
+		}
+		c := min(len(p), maxBlockSize-len(z.buf))
+		z.buf = append(z.buf, p[:c]...)
+		p = p[c:]
+	}
+	if z.err != nil {
+		return 0, z.err
+	}
+	return n, nil
+}
+
+// Close writes the frame's last block and checksum. It doesn't close the
+// underlying writer.
+func (z *Writer) Close() error {
+	if z.closed {
+		return z.err
+	}
+	z.closed = true
+	if z.err == nil {
+		z.err = z.writeBlock(true)
+	}
+	if z.err == nil {
+		var sum [4]byte
+		binary.LittleEndian.PutUint32(sum[:], uint32(z.hash.sum()))
+		_, z.err = z.w.Write(sum[:])
+	}
+	return z.err
+}
+
+func (z *Writer) writeBlock(last bool) error {
+	out := z.out[:0]
+	if !z.header {
+		// Checksummed, no content size and a 128 KiB window.
+		out = binary.LittleEndian.AppendUint32(out, frameMagic)
+		out = append(out, 0x04, 0x38)
+		z.header = true
+	}
+
+	data := z.buf
+	z.hash.write(data)
+
+	var flag uint32
+	if last {
+		flag = 1
+	}
+	header := func(typ uint32, size int) {
+		v := uint32(size)<<3 | typ<<1 | flag
+		out = append(out, byte(v), byte(v>>8), byte(v>>16))
+	}
+
+	if len(data) > 1 && run(data) {
+		header(1, len(data))
+		out = append(out, data[0])
+	} else if lits := compressLiterals(data); lits != nil && len(lits)+1 < len(data) {
+		header(2, len(lits)+1)
+		out = append(out, lits...)
+		out = append(out, 0) // No sequences.
+	} else {
+		header(0, len(data))
+		out = append(out, data...)
+	}
+
+	z.out = out
+	z.buf = z.buf[:0]
+	_, err := z.w.Write(out)
+	return err
+}
+
+func run(data []byte) bool {
+	for _, b := range data[1:] {
+		if b != data[0] {
+			return false
+		}
+	}
+	return true
+}
+
+// compressLiterals returns a literals section Huffman coding data, nil if
+// it can't be coded.
+func compressLiterals(data []byte) []byte {
+	var counts [256]int
+	for _, b := range data {
+		counts[b]++
+	}
+	h := newHuffEncoder(&counts)
+	if h == nil {
+		return nil
+	}
+
+	// Room for the largest section header.
+	out := make([]byte, 5, 5+len(data))
+	out = append(out, h.tree...)
+	single := len(data) <= 0x3FF
+	if single {
+		out = h.encode(out, data)
+	} else if out = h.encode4(out, data); out == nil {
+		return nil
+	}
+
+	regen, size := uint64(len(data)), uint64(len(out)-5)
+	var v uint64
+	var n int
+	switch {
+	case single && size <= 0x3FF:
+		v, n = 2|regen<<4|size<<14, 3
+	case single:
+		return nil
+	case regen <= 0x3FFF && size <= 0x3FFF:
+		v, n = 2|2<<2|regen<<4|size<<18, 4
+	default:
+		v, n = 2|3<<2|regen<<4|size<<22, 5
+	}
+
+	out = out[5-n:]
+	for idx := 0; idx < n; idx++ {
+		out[idx] = byte(v >> (8 * idx))
+	}
+	return out
+}
@@ -0,0 +1,137 @@
+// RTLAMR - An rtl-sdr receiver for smart meters operating in the 900MHz ISM band.
+// Copyright (C) 2015 Douglas Hall
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package zstd reads and writes the Zstandard compressed data format,
+// RFC 8878. The reader decodes any frame without a dictionary. The writer
+// only Huffman codes literals, it doesn't search for repeated strings, which
+// suits noisy samples and keeps up with the sample rate at little cost.
+package zstd
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/bits"
+)
+
+const (
+	frameMagic     = 0xFD2FB528
+	skippableMagic = 0x184D2A50 // Low nibble may be anything.
+
+	maxBlockSize = 1 << 17
+	maxWindow    = 1 << 27 // Largest window accepted, as zstd itself defaults to.
+)
+
+// Errors returned while reading.
+var (
+	ErrMagic      = errors.New("zstd: invalid magic number")
+	ErrCorrupt    = errors.New("zstd: corrupt input")
+	ErrChecksum   = errors.New("zstd: checksum mismatch")
+	ErrDictionary = errors.New("zstd: dictionaries are not supported")
+	ErrWindow     = errors.New("zstd: window too large")
+)
+
+// xxh64 is the XXH64 hash with seed 0, of which frames carry the low 32 bits
+// of their content's as a checksum.
+type xxh64 struct {
+	v     [4]uint64
+	total uint64
+	mem   [32]byte
+	n     int
+}
+
+const (
+	prime1 uint64 = 11400714785074694791
+	prime2 uint64 = 14029467366897019727
+	prime3 uint64 = 1609587929392839161
+	prime4 uint64 = 9650029242287828579
+	prime5 uint64 = 2870177450012600261
+)
+
+func (h *xxh64) reset() {
+	p1, p2 := prime1, prime2
+	*h = xxh64{v: [4]uint64{p1 + p2, p2, 0, -p1}}
+}
+
+func xxhRound(acc, input uint64) uint64 {
+	return bits.RotateLeft64(acc+input*prime2, 31) * prime1
+}
+
+func xxhMerge(acc, v uint64) uint64 {
+	return (acc^xxhRound(0, v))*prime1 + prime4
+}
+
+func (h *xxh64) write(p []byte) {
+	h.total += uint64(len(p))
+
+	if h.n != 0 {
+		c := copy(h.mem[h.n:], p)
+		h.n += c
+		p = p[c:]
+		if h.n < 32 {
+			return
+		}
+		h.stripes(h.mem[:])
+		h.n = 0
+	}
+
+	full := len(p) &^ 31
+	h.stripes(p[:full])
+	h.n = copy(h.mem[:], p[full:])
+}
+
+func (h *xxh64) stripes(p []byte) {
+	for ; len(p) >= 32; p = p[32:] {
+		for idx := range h.v {
+			h.v[idx] = xxhRound(h.v[idx], binary.LittleEndian.Uint64(p[idx*8:]))
+		}
+	}
+}
+
+func (h *xxh64) sum() uint64 {
+	var v uint64
+	if h.total >= 32 {
+		v = bits.RotateLeft64(h.v[0], 1) + bits.RotateLeft64(h.v[1], 7) +
+			bits.RotateLeft64(h.v[2], 12) + bits.RotateLeft64(h.v[3], 18)
+		for _, lane := range h.v {
+			v = xxhMerge(v, lane)
+		}
+	} else {
+		v = h.v[2] + prime5
+	}
+	v += h.total
+
+	p := h.mem[:h.n]
+	for ; len(p) >= 8; p = p[8:] {
+		v ^= xxhRound(0, binary.LittleEndian.Uint64(p))
+		v = bits.RotateLeft64(v, 27)*prime1 + prime4
+	}
+	if len(p) >= 4 {
+		v ^= uint64(binary.LittleEndian.Uint32(p)) * prime1
+		v = bits.RotateLeft64(v, 23)*prime2 + prime3
+		p = p[4:]
+	}
+	for _, b := range p {
+		v ^= uint64(b) * prime5
+		v = bits.RotateLeft64(v, 11) * prime1
+	}
+
+	v ^= v >> 33
+	v *= prime2
+	v ^= v >> 29
+	v *= prime3
+	v ^= v >> 32
+	return v
+}
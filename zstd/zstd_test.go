@@ -0,0 +1,297 @@
+package zstd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// corpus returns data exercising matches, literals and runs, from which
+// testdata/corpus.*.zst were made by the zstd command.
+func corpus() []byte {
+	rng := rand.New(rand.NewSource(1))
+	words := strings.Fields("meter consumption interval tamper flags endpoint type id scm idm r900 checksum preamble")
+
+	var buf bytes.Buffer
+	for buf.Len() < 100000 {
+		switch rng.Intn(8) {
+		case 0:
+			buf.Write(make([]byte, rng.Intn(5000)))
+		case 1:
+			for n := rng.Intn(2000); n > 0; n-- {
+				buf.WriteByte(byte(rng.Intn(256)))
+			}
+		default:
+			fmt.Fprintf(&buf, "%s=%d ", words[rng.Intn(len(words))], rng.Intn(1000))
+		}
+	}
+	return buf.Bytes()
+}
+
+// samples returns noisy 8-bit IQ samples around 127.5.
+func samples(n int) []byte {
+	rng := rand.New(rand.NewSource(2))
+	buf := make([]byte, n)
+	for idx := range buf {
+		buf[idx] = byte(min(max(127.5+rng.NormFloat64()*12, 0), 255))
+	}
+	return buf
+}
+
+func TestXXH64(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		expt uint64
+	}{
+		{"", 0xEF46DB3751D8E999},
+		{"a", 0xD24EC4F1A98C6E5B},
+		{"abc", 0x44BC2CF5AD770999},
+		{"Nobody inspects the spammish repetition", 0xFBCEA83C8A378BF1},
+	} {
+		var h xxh64
+		h.reset()
+		h.write([]byte(tc.in))
+		if got := h.sum(); got != tc.expt {
+			t.Errorf("xxh64(%q) = %#x, want %#x", tc.in, got, tc.expt)
+		}
+	}
+}
+
+func roundTrip(t *testing.T, data []byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	// Uneven writes straddle block boundaries.
+	for p := data; len(p) > 0; {
+		n := min(len(p), 70000)
+		if _, err := w.Write(p[:n]); err != nil {
+			t.Fatal(err)
+		}
+		p = p[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := io.ReadAll(NewReader(bytes.NewReader(buf.Bytes())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("round trip of %d bytes returned %d different bytes", len(data), len(got))
+	}
+	return buf.Bytes()
+}
+
+func TestRoundTrip(t *testing.T) {
+	random := make([]byte, 200000)
+	rand.New(rand.NewSource(3)).Read(random)
+
+	for _, tc := range []struct {
+		name string
+		data []byte
+	}{
+		{"Empty", nil},
+		{"Byte", []byte{7}},
+		{"Run", bytes.Repeat([]byte{127}, 300000)},
+		{"Two", []byte("ab")},
+		{"Random", random},
+		{"Samples", samples(1000)},
+		{"Samples1024", samples(1024)},
+		{"SamplesLarge", samples(500000)},
+		{"Corpus", corpus()},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			roundTrip(t, tc.data)
+		})
+	}
+
+	// Noise is mostly entropy, but the samples' distribution is narrow.
+	if data := samples(1 << 20); len(roundTrip(t, data)) > len(data)*3/4 {
+		t.Error("samples weren't compressed")
+	}
+}
+
+func TestHuffLengths(t *testing.T) {
+	// Fibonacci counts make the unlimited code as deep as possible.
+	var counts [256]int
+	a, b := 1, 1
+	for s := 0; s < 30; s++ {
+		counts[s] = a
+		a, b = b, a+b
+	}
+
+	lengths, ok := huffLengths(&counts, maxHuffBits)
+	if !ok {
+		t.Fatal("no code")
+	}
+	kraft := 0
+	for s, l := range lengths {
+		if counts[s] > 0 && (l == 0 || l > maxHuffBits) {
+			t.Fatalf("symbol %d has length %d", s, l)
+		}
+		if l > 0 {
+			kraft += 1 << (maxHuffBits - l)
+		}
+	}
+	if kraft != 1<<maxHuffBits {
+		t.Errorf("code is incomplete: %d", kraft)
+	}
+
+	h := newHuffEncoder(&counts)
+	if h == nil {
+		t.Fatal("no encoder")
+	}
+	data := make([]byte, 0, 5000)
+	for s := 0; len(data) < cap(data); s = (s*7 + 3) % 30 {
+		data = append(data, byte(s))
+	}
+	roundTrip(t, data)
+}
+
+func TestNCount(t *testing.T) {
+	norm := []int16{20, 0, 0, 0, 0, 10, -1, 0, 1, 31}
+	for n := 0; n < 30; n++ {
+		norm = append(norm, 0)
+	}
+	norm = append(norm, -1)
+
+	got, log, n, err := readNCount(writeNCount(norm, 6), 63, 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if log != 6 || len(got) != len(norm) || n == 0 {
+		t.Fatalf("got %v log %d", got, log)
+	}
+	for idx := range norm {
+		if got[idx] != norm[idx] {
+			t.Fatalf("got %v, want %v", got, norm)
+		}
+	}
+}
+
+func TestDecodeTestdata(t *testing.T) {
+	expt := corpus()
+	files, _ := filepath.Glob("testdata/corpus.*.zst")
+	if len(files) == 0 {
+		t.Fatal("no testdata")
+	}
+	for _, name := range files {
+		buf, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(NewReader(bytes.NewReader(buf)))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !bytes.Equal(got, expt) {
+			t.Errorf("%s: decoded %d bytes differing from the corpus", name, len(got))
+		}
+	}
+}
+
+func TestConcatenated(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.Write([]byte("first "))
+	w.Close()
+
+	// A skippable frame between the two.
+	buf.Write([]byte{0x5E, 0x2A, 0x4D, 0x18, 3, 0, 0, 0, 1, 2, 3})
+
+	w.Reset(&buf)
+	w.Write([]byte("second"))
+	w.Close()
+
+	got, err := io.ReadAll(NewReader(&buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "first second" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestCorrupt(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.Write(samples(10000))
+	w.Close()
+	frame := buf.Bytes()
+
+	if _, err := io.ReadAll(NewReader(bytes.NewReader(frame[:len(frame)-10]))); err != io.ErrUnexpectedEOF {
+		t.Errorf("truncated: got %v", err)
+	}
+
+	flipped := bytes.Clone(frame)
+	flipped[len(flipped)-1] ^= 1
+	if _, err := io.ReadAll(NewReader(bytes.NewReader(flipped))); err != ErrChecksum {
+		t.Errorf("checksum: got %v", err)
+	}
+
+	if _, err := io.ReadAll(NewReader(strings.NewReader("not zstd"))); err != ErrMagic {
+		t.Errorf("magic: got %v", err)
+	}
+
+	// Damage anywhere must be reported, not panic.
+	for idx := 6; idx < len(frame); idx += 97 {
+		damaged := bytes.Clone(frame)
+		damaged[idx] ^= 0x5A
+		if _, err := io.ReadAll(NewReader(bytes.NewReader(damaged))); err == nil {
+			t.Errorf("damage at %d went unnoticed", idx)
+		}
+	}
+}
+
+// TestCommand checks the zstd command agrees with the reader and writer,
+// when it's installed.
+func TestCommand(t *testing.T) {
+	bin, err := exec.LookPath("zstd")
+	if err != nil {
+		t.Skip("zstd not installed")
+	}
+
+	for _, data := range [][]byte{samples(300000), corpus()} {
+		var buf bytes.Buffer
+		w := NewWriter(&buf)
+		w.Write(data)
+		w.Close()
+
+		cmd := exec.Command(bin, "-d", "-c")
+		cmd.Stdin = &buf
+		got, err := cmd.Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Error("zstd decoded different data")
+		}
+
+		for _, level := range []string{"-1", "-9", "--ultra", "--long=20"} {
+			cmd := exec.Command(bin, "-c", level, "-T1")
+			if level == "--ultra" {
+				cmd.Args = append(cmd.Args, "-22")
+			}
+			cmd.Stdin = bytes.NewReader(data)
+			frame, err := cmd.Output()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(NewReader(bytes.NewReader(frame)))
+			if err != nil {
+				t.Fatalf("%s: %v", level, err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("%s: decoded different data", level)
+			}
+		}
+	}
+}